@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	accessLogPath   = flag.String("accesslog", "", "アクセスログの出力先ファイル (空の場合は標準出力)")
+	accessLogFormat = flag.String("accesslog-format", "combined", "アクセスログの形式 (combined または json)")
+)
+
+// アクセスログの形式
+const (
+	accessLogCombined = "combined"
+	accessLogJSON     = "json"
+)
+
+// ErrUnknownAccessLogFormat 非対応のアクセスログ形式が指定された場合に発生するエラー
+var ErrUnknownAccessLogFormat = errors.New("chat: 非対応のアクセスログ形式です。")
+
+// accessLoggerはHTTPリクエストごとに1行のアクセスログを書き出す
+type accessLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+}
+
+// newAccessLoggerは指定された形式で書き出すaccessLoggerを生成する
+func newAccessLogger(out io.Writer, format string) (*accessLogger, error) {
+	switch format {
+	case accessLogCombined, accessLogJSON:
+	default:
+		return nil, ErrUnknownAccessLogFormat
+	}
+	return &accessLogger{out: out, format: format}, nil
+}
+
+// openAccessLogはフラグの設定に従ってaccessLoggerを生成する
+// pathが空の場合は標準出力に書き出す
+func openAccessLog(path, format string) (*accessLogger, error) {
+	var out io.Writer = os.Stdout
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	return newAccessLogger(out, format)
+}
+
+// Handler アクセスログを記録するミドルウェア
+func (l *accessLogger) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		l.write(r, rec, start, time.Since(start))
+	})
+}
+
+func (l *accessLogger) write(r *http.Request, rec *statusRecorder, start time.Time, d time.Duration) {
+	host := clientIP(r)
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch l.format {
+	case accessLogJSON:
+		json.NewEncoder(l.out).Encode(map[string]interface{}{
+			"time":        start.Format(time.RFC3339Nano),
+			"remote_addr": host,
+			"method":      r.Method,
+			"uri":         r.RequestURI,
+			"proto":       r.Proto,
+			"status":      status,
+			"size":        rec.size,
+			"duration_ms": float64(d) / float64(time.Millisecond),
+			"referer":     r.Referer(),
+			"user_agent":  r.UserAgent(),
+			"request_id":  requestIDFromContext(r.Context()),
+		})
+	default:
+		size := "-"
+		if rec.size > 0 {
+			size = fmt.Sprint(rec.size)
+		}
+		// Apacheのcombined形式の末尾に処理時間(マイクロ秒)とリクエストIDを付加する
+		fmt.Fprintf(l.out, "%s - - [%s] \"%s %s %s\" %d %s %q %q %d %s\n",
+			host, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method, r.RequestURI, r.Proto, status, size,
+			r.Referer(), r.UserAgent(), d.Microseconds(), requestIDFromContext(r.Context()))
+	}
+}
+
+// statusRecorderはレスポンスのステータスコードとサイズを記録する
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += n
+	return n, err
+}
+
+// Flush ストリーミングのレスポンスに対応するためFlusherを委譲する
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack WebSocketへのアップグレードに対応するためHijackerを委譲する
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("chat: Hijackに対応していません。")
+	}
+	rec.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
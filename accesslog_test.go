@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestAccessLogger(t *testing.T) {
+	if _, err := newAccessLogger(&bytes.Buffer{}, "xml"); err != ErrUnknownAccessLogFormat {
+		t.Errorf("非対応の形式はエラーにするべきです: %v", err)
+	}
+	// 不正なIDは引き継がずに採番し直す
+	tests := []struct {
+		header string
+	}{
+		{"abc-123"},
+		{"不正なID"},
+	}
+	for _, test := range tests {
+		var combined, jsonLines bytes.Buffer
+		combinedLog, _ := newAccessLogger(&combined, accessLogCombined)
+		jsonLog, _ := newAccessLogger(&jsonLines, accessLogJSON)
+		for _, l := range []*accessLogger{combinedLog, jsonLog} {
+			h := withRequestID(l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte("hello"))
+			})))
+			r := httptest.NewRequest("POST", "/api/rooms?x=1", nil)
+			r.Header.Set(requestIDHeader, test.header)
+			r.Header.Set("Referer", "https://example.com/")
+			r.Header.Set("User-Agent", "gochat-test")
+			h.ServeHTTP(httptest.NewRecorder(), r)
+		}
+
+		var entry map[string]interface{}
+		if err := json.Unmarshal(jsonLines.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]interface{}{
+			"remote_addr": "192.0.2.1",
+			"method":      "POST",
+			"uri":         "/api/rooms?x=1",
+			"proto":       "HTTP/1.1",
+			"status":      float64(http.StatusCreated),
+			"size":        float64(5),
+			"referer":     "https://example.com/",
+			"user_agent":  "gochat-test",
+		}
+		for key, value := range want {
+			if entry[key] != value {
+				t.Errorf("%s: %sが%vになるべきところ%vでした", test.header, key, value, entry[key])
+			}
+		}
+		if id, _ := entry["request_id"].(string); id == "" || (test.header == "abc-123" && id != "abc-123") {
+			t.Errorf("%s: リクエストIDを記録するべきです: %v", test.header, entry["request_id"])
+		}
+		if _, ok := entry["duration_ms"].(float64); !ok {
+			t.Errorf("%s: 処理時間を記録するべきです: %v", test.header, entry)
+		}
+
+		pattern := `^192\.0\.2\.1 - - \[[^\]]+\] "POST /api/rooms\?x=1 HTTP/1\.1" 201 5 "https://example\.com/" "gochat-test" \d+ (\S+)\n$`
+		m := regexp.MustCompile(pattern).FindStringSubmatch(combined.String())
+		if m == nil {
+			t.Errorf("%s: combined形式で記録するべきです: %q", test.header, combined.String())
+		} else if test.header == "abc-123" && m[1] != "abc-123" {
+			t.Errorf("%s: 受け取ったリクエストIDを記録するべきところ%sでした", test.header, m[1])
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"archive/zip"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var erasurePolicy = flag.String("erasure-policy", erasureAnonymize, "アカウント削除時の過去のメッセージの扱い (anonymize または delete)")
+
+// アカウント削除時の過去のメッセージの扱い
+const (
+	erasureAnonymize = "anonymize"
+	erasureDelete    = "delete"
+)
+
+// deletedUserName 匿名化されたメッセージの送信者名
+const deletedUserName = "削除されたユーザー"
+
+// accountDeleteHandler 自分のアカウントを削除する
+// GETでは確認画面を表示し、POSTで削除を実行する
+type accountDeleteHandler struct {
+	confirm http.Handler
+}
+
+func (h *accountDeleteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.confirm.ServeHTTP(w, r)
+	case http.MethodPost:
+		user, _ := userFromContext(r.Context())
+		if !validCSRFToken(user, r.FormValue("csrf_token")) {
+			httpError(w, r, "ページを読み込み直してから、もう一度お試しください", http.StatusForbidden)
+			return
+		}
+		if r.FormValue("confirm") != "delete" {
+			httpError(w, r, "確認のためdeleteと入力してください", http.StatusBadRequest)
+			return
+		}
+		if err := eraseUser(user.UniqueID(), *erasurePolicy); err == ErrUserNotFound {
+			httpError(w, r, "このアカウントは削除できません", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			requestLogger(r).Println("アカウントの削除に失敗しました:", user.UniqueID(), "-", err)
+			httpError(w, r, "アカウントの削除に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		auditRequest(r, auditAccountDeleted, user.UniqueID(), user.UniqueID(), map[string]string{"policy": *erasurePolicy})
+		clearAuthCookie(w)
+		w.Header()["Location"] = []string{"/login"}
+		w.WriteHeader(http.StatusSeeOther)
+	default:
+		httpError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
+
+// userDataItem ユーザーに関するデータの保存先の1つ
+// エクスポートと消去は同じ一覧(userDataItems)を使うため、ユーザーのデータを保存する場所を増やしたときはここに加える
+type userDataItem struct {
+	// nameはエクスポートするJSONのファイル名。exportがnilの場合は使わない
+	name string
+	// exportはエクスポートする内容を返す。nilの場合は集計用の記録や認証情報のためエクスポートしない
+	export func(userID string) (interface{}, error)
+	// filesはアップロードされたファイルなどをそのままアーカイブに加える
+	files func(userID string, z *zip.Writer) error
+	// eraseはpolicyに従ってデータを消去する
+	erase func(userID, policy string) error
+}
+
+// userDataItems ユーザーに関するすべてのデータ。消去はこの順に行い、最後にユーザーの情報を削除する
+var userDataItems = []userDataItem{
+	{
+		name:   "sessions.json",
+		export: func(userID string) (interface{}, error) { return sessions.ListByUser(userID) },
+		erase:  func(userID, _ string) error { return sessions.DeleteByUser(userID) },
+	},
+	{
+		name:   "api_keys.json",
+		export: func(userID string) (interface{}, error) { return apiKeys.ListByUser(userID) },
+		erase:  func(userID, _ string) error { return apiKeys.DeleteByUser(userID) },
+	},
+	{
+		name:   "reminders.json",
+		export: func(userID string) (interface{}, error) { return reminders.ListByUser(userID) },
+		erase: func(userID, _ string) error {
+			if own, err := reminders.ListByUser(userID); err == nil {
+				for _, r := range own {
+					reminders.Delete(r.ID)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		name:   "messages.json",
+		export: func(userID string) (interface{}, error) { return messages.ListByUser(userID) },
+		erase: func(userID, policy string) error {
+			sent, err := messages.ListByUser(userID)
+			if err != nil {
+				return err
+			}
+			for _, m := range sent {
+				if err := eraseMessage(m, policy); err != nil {
+					return err
+				}
+			}
+			// イベントログから履歴を復元したときに消去したメッセージが戻らないように記録する
+			return eventLog.Append(&message{Type: typeUserErased, ID: randomID(), UserID: userID, Message: policy, When: time.Now()})
+		},
+	},
+	{
+		name:   "attachments.json",
+		export: func(userID string) (interface{}, error) { return attachments.ListByUser(userID) },
+		files:  exportAttachmentFiles,
+		erase: func(userID, _ string) error {
+			if own, err := attachments.ListByUser(userID); err == nil {
+				for _, a := range own {
+					attachments.Delete(a.ID)
+					blobs.Delete(a.ID)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		files: exportAvatarFiles,
+		erase: func(userID, _ string) error { return deleteAvatarFiles(userID) },
+	},
+	{
+		erase: func(userID, _ string) error { return activity.Forget(userID) },
+	},
+	{
+		// アクセストークンは認証情報のためエクスポートしない。連携したアカウントはprofile.jsonに含まれる
+		erase: func(userID, _ string) error { return oauthTokens.DeleteByUser(userID) },
+	},
+	{
+		name:   "notification_preferences.json",
+		export: func(userID string) (interface{}, error) { return notificationPrefs.Get(userID) },
+		erase:  func(userID, _ string) error { return notificationPrefs.Delete(userID) },
+	},
+	{
+		name:   "stars.json",
+		export: func(userID string) (interface{}, error) { return stars.List(userID) },
+		erase:  func(userID, _ string) error { return stars.DeleteByUser(userID) },
+	},
+	{
+		name:   "groups.json",
+		export: exportGroups,
+		erase:  func(userID, _ string) error { return leaveGroups(userID) },
+	},
+	{
+		erase: func(userID, _ string) error { return welcomes.DeleteByUser(userID) },
+	},
+	{
+		erase: func(userID, _ string) error { return members.DeleteByUser(userID) },
+	},
+	{
+		name:   "highlights.json",
+		export: func(userID string) (interface{}, error) { return highlights.Get(userID) },
+		erase:  func(userID, _ string) error { return highlights.Set(userID, nil) },
+	},
+	{
+		name:   "stickers.json",
+		export: func(userID string) (interface{}, error) { return ownStickerPacks(userID) },
+		erase: func(userID, _ string) error {
+			packs, err := ownStickerPacks(userID)
+			if err != nil {
+				return err
+			}
+			for _, p := range packs {
+				if err := stickers.Delete(p.ID); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		name:   "profile.json",
+		export: func(userID string) (interface{}, error) { return users.GetByID(userID) },
+		erase:  func(userID, _ string) error { return users.Delete(userID) },
+	},
+}
+
+// eraseUser ユーザーに関するデータを消去する
+// セッションを失効させ、過去のメッセージを匿名化(またはpolicyに従って削除)し、
+// アップロードされたアバターと添付ファイル、ユーザーの情報などuserDataItemsのすべてのデータを削除する
+func eraseUser(userID, policy string) error {
+	if _, err := users.GetByID(userID); err != nil {
+		return err
+	}
+	for _, item := range userDataItems {
+		if err := item.erase(userID, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownStickerPacks ユーザーが作成したステッカーのパックを返す
+func ownStickerPacks(userID string) ([]*StickerPack, error) {
+	packs, err := stickers.List(userID)
+	if err != nil {
+		return nil, err
+	}
+	var own []*StickerPack
+	for _, p := range packs {
+		if p.OwnerID == userID {
+			own = append(own, p)
+		}
+	}
+	return own, nil
+}
+
+// eraseMessage 消去したユーザーのメッセージをpolicyに従って匿名化または削除する
+func eraseMessage(m *message, policy string) error {
+	if policy == erasureDelete {
+		return messages.Delete(m.ID)
+	}
+	m.UserID = ""
+	m.Name = deletedUserName
+	m.AvatarURL = ""
+	return messages.Update(m)
+}
+
+// deleteAvatarFiles アップロードされたユーザーのアバターを削除する
+func deleteAvatarFiles(userID string) error {
+	files, err := ioutil.ReadDir("avatars")
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, file := range files {
+		filename := file.Name()
+		if file.IsDir() || strings.TrimSuffix(filename, filepath.Ext(filename)) != userID {
+			continue
+		}
+		if err := os.Remove(filepath.Join("avatars", filename)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSetAuthCookieAttributes(t *testing.T) {
+	w := httptest.NewRecorder()
+	setAuthCookie(w, httptest.NewRequest(http.MethodGet, "/auth/callback/google", nil), "value")
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Errorf("認証用のCookieはHttpOnlyでSameSite=Laxであるべきです: %+v", cookies)
+	}
+}
+
+func TestAccountDeleteRequiresCSRFToken(t *testing.T) {
+	defer func(u UserStore, m MessageStore, l EventLog) { users, messages, eventLog = u, m, l }(users, messages, eventLog)
+	users, messages, eventLog = newMemoryUserStore(), newMemoryMessageStore(), nopEventLog{}
+	users.Create(&UserRecord{ID: "u1", Name: "Alice", Provider: "google", ProviderID: "1"})
+	user := sessionUser{uniqueID: "u1", name: "Alice", sessionID: "s1"}
+	h := &accountDeleteHandler{}
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"トークンなし", "", http.StatusForbidden},
+		{"別のセッションのトークン", csrfToken(sessionUser{uniqueID: "u1", name: "Alice", sessionID: "s2"}), http.StatusForbidden},
+		{"別のユーザーのトークン", csrfToken(sessionUser{uniqueID: "u2", name: "Bob", sessionID: "s1"}), http.StatusForbidden},
+		{"正しいトークン", csrfToken(user), http.StatusSeeOther},
+	}
+	for _, tt := range tests {
+		form := url.Values{"confirm": {"delete"}, "csrf_token": {tt.token}}
+		r := httptest.NewRequest(http.MethodPost, "/account/delete", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = r.WithContext(withUser(r.Context(), user))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: ステータスが%dであるべきです: %d", tt.name, tt.status, w.Code)
+		}
+	}
+	if _, err := users.GetByID("u1"); err != ErrUserNotFound {
+		t.Errorf("正しいトークンではアカウントを削除するべきです: %v", err)
+	}
+}
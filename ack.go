@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+var (
+	ackRetention  = flag.Duration("ack-retention", 5*time.Minute, "確認応答モードで切断後に未確認のイベントを再送のために保持する時間")
+	ackMaxPending = flag.Int("ack-max-pending", 1000, "確認応答モードで1つのストリームに保持する未確認のイベントの最大数 (超えた場合は古いものから破棄する)")
+)
+
+// capAck 確認応答モード(at-least-once)で受け取る
+// サーバーはイベントにSeqを付けて送信し、クライアントはackイベントで受信済みのSeqを知らせる
+// 再接続時にクエリパラメーターresumeでwelcomeのStreamを指定すると、未確認のイベントを再送する
+const capAck = "ack"
+
+// ackStream 確認応答モードの1つの配信ストリーム
+// 接続をまたいで未確認のイベントを保持する
+type ackStream struct {
+	id     string
+	userID string
+	room   string
+
+	mu sync.Mutex
+	// seqは最後に割り当てた番号
+	seq int64
+	// pendingは確認されていないイベント。Seqの昇順に並ぶ
+	pending []*message
+	// ownerは現在このストリームを使用している接続のID。切断中は空
+	owner string
+	// expiresは切断後にストリームを破棄する時刻
+	expires time.Time
+}
+
+// tracked 確認応答の対象にするイベントかどうか
+// 接続ごとに送り直すwelcomeとエラー、一時的なメッセージは対象にしない
+func tracked(msg *message) bool {
+	return msg.Type != typeWelcome && msg.Type != typeError && !msg.Ephemeral
+}
+
+// track イベントに番号を割り当て、未確認のイベントとして保持する
+// 元のイベントは他のクライアントと共有しているため複製して返す
+func (s *ackStream) track(msg *message) *message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	numbered := *msg
+	numbered.Seq = s.seq
+	numbered.prepared = nil
+	numbered.size = 0
+	s.pending = append(s.pending, &numbered)
+	if over := len(s.pending) - *ackMaxPending; *ackMaxPending > 0 && over > 0 {
+		s.pending = s.pending[over:]
+	}
+	return &numbered
+}
+
+// ack 指定された番号までのイベントを受信済みとして破棄する
+func (s *ackStream) ack(seq int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := 0
+	for i < len(s.pending) && s.pending[i].Seq <= seq {
+		i++
+	}
+	s.pending = s.pending[i:]
+}
+
+// unacked 確認されていないイベントを返す
+func (s *ackStream) unacked() []*message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*message(nil), s.pending...)
+}
+
+// ackStreams 確認応答モードの配信ストリームを保持する
+type ackStreams struct {
+	mu      sync.Mutex
+	streams map[string]*ackStream
+}
+
+func newAckStreams() *ackStreams {
+	return &ackStreams{streams: make(map[string]*ackStream)}
+}
+
+// open 接続に配信ストリームを割り当てる
+// resumeで指定されたストリームが同じユーザーとルームのものであれば引き継ぎ、そうでなければ新しく作る
+// 前の接続の切断がまだ検知されていない場合も、新しい接続が引き継ぐ
+func (a *ackStreams) open(resume, userID, room, clientID string, now time.Time) *ackStream {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.streams[resume]
+	if ok && s.owner == "" && now.After(s.expires) {
+		// 破棄の前に再接続した場合も期限を過ぎていれば引き継がない
+		delete(a.streams, s.id)
+		ok = false
+	}
+	if !ok || s.userID != userID || s.room != room {
+		s = &ackStream{id: randomID(), userID: userID, room: room}
+		a.streams[s.id] = s
+	}
+	s.owner = clientID
+	return s
+}
+
+// release 接続の終了時に呼び出し、ack-retentionの間だけ再接続を待つ
+func (a *ackStreams) release(s *ackStream, clientID string, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s.owner != clientID {
+		// 既に新しい接続が引き継いでいる
+		return
+	}
+	s.owner = ""
+	s.expires = now.Add(*ackRetention)
+	expires := s.expires
+	time.AfterFunc(*ackRetention, func() { a.expire(s, expires) })
+}
+
+// expire 切断後に再接続されなかったストリームを破棄する
+// expiresはreleaseで設定した時刻で、その後に引き継がれたり再び切断されたりした場合は何もしない
+func (a *ackStreams) expire(s *ackStream, expires time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.streams[s.id] == s && s.owner == "" && s.expires.Equal(expires) {
+		delete(a.streams, s.id)
+	}
+}
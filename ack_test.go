@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAckStreams(t *testing.T) {
+	streams := newAckStreams()
+	now := time.Now()
+	s := streams.open("", "u1", "general", "c1", now)
+	shared := &message{ID: "m1"}
+	first := s.track(shared)
+	s.track(&message{ID: "m2"})
+	s.track(&message{ID: "m3"})
+	if first.Seq != 1 || shared.Seq != 0 {
+		t.Errorf("複製したイベントに番号を付けるべきです: %d, %d", first.Seq, shared.Seq)
+	}
+	s.ack(2)
+	if pending := s.unacked(); len(pending) != 1 || pending[0].ID != "m3" {
+		t.Errorf("確認された番号までのイベントは破棄するべきです: %v", pending)
+	}
+
+	streams.release(s, "c1", now)
+	if other := streams.open(s.id, "u2", "general", "c2", now); other == s {
+		t.Error("他のユーザーのストリームを引き継ぐべきではありません")
+	}
+	resumed := streams.open(s.id, "u1", "general", "c3", now)
+	if resumed != s || len(resumed.unacked()) != 1 {
+		t.Error("再接続時は未確認のイベントを引き継ぐべきです")
+	}
+	if next := resumed.track(&message{ID: "m4"}); next.Seq != 4 {
+		t.Errorf("再接続後も番号を続けて割り当てるべきです: %d", next.Seq)
+	}
+
+	streams.release(s, "c3", now)
+	if expired := streams.open(s.id, "u1", "general", "c4", now.Add(*ackRetention+time.Second)); expired == s {
+		t.Error("保持期間を過ぎたストリームは破棄するべきです")
+	}
+}
+
+func TestAckStreamsExpire(t *testing.T) {
+	defer func(d time.Duration) { *ackRetention = d }(*ackRetention)
+	*ackRetention = 10 * time.Millisecond
+	streams := newAckStreams()
+	idle := streams.open("", "u1", "general", "c1", time.Now())
+	streams.release(idle, "c1", time.Now())
+	resumed := streams.open("", "u2", "general", "c2", time.Now())
+	streams.release(resumed, "c2", time.Now())
+	streams.open(resumed.id, "u2", "general", "c3", time.Now())
+	time.Sleep(50 * time.Millisecond)
+
+	streams.mu.Lock()
+	defer streams.mu.Unlock()
+	if _, ok := streams.streams[idle.id]; ok {
+		t.Error("再接続されなかったストリームは保持期間の後に破棄するべきです")
+	}
+	if _, ok := streams.streams[resumed.id]; !ok {
+		t.Error("引き継がれたストリームは破棄するべきではありません")
+	}
+}
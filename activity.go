@@ -0,0 +1,223 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// activityRetentionDays 日ごとの利用状況を保持する日数
+const activityRetentionDays = 90
+
+// DailyActivity 1日の利用状況
+type DailyActivity struct {
+	Date     string `json:"date"`
+	Users    int    `json:"users"`
+	Messages int64  `json:"messages"`
+}
+
+// ActivityStore 認証されたユーザーの日ごとの利用状況を保存する
+// roomが空の場合はルームに関係なくサービス全体の利用として扱う
+type ActivityStore interface {
+	// Record ユーザーがその日に利用したことを記録する
+	Record(day time.Time, userID, room string, messages int64) error
+	// UniqueUsers fromからtoまでの日に利用したユーザーの数を返す
+	UniqueUsers(room string, from, to time.Time) (int, error)
+	// Daily fromからtoまでの日ごとの利用状況を返す
+	Daily(room string, from, to time.Time) ([]DailyActivity, error)
+	// Rooms fromからtoまでに利用されたルームを返す
+	Rooms(from, to time.Time) ([]string, error)
+	// Forget ユーザーの利用の記録を削除する
+	Forget(userID string) error
+}
+
+// activityDay 利用状況を記録する日の表記
+func activityDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// activityDays fromからtoまでの日を順に返す
+func activityDays(from, to time.Time) []string {
+	var days []string
+	for d := from.UTC().Truncate(24 * time.Hour); !d.After(to.UTC()); d = d.AddDate(0, 0, 1) {
+		days = append(days, activityDay(d))
+	}
+	return days
+}
+
+// memoryActivityStore メモリ上に利用状況を保持するActivityStore
+type memoryActivityStore struct {
+	mu sync.Mutex
+	// usersは日付、ルームごとの利用したユーザー
+	users map[string]map[string]map[string]struct{}
+	// messagesは日付、ルームごとの投稿数
+	messages map[string]map[string]int64
+}
+
+func newMemoryActivityStore() *memoryActivityStore {
+	return &memoryActivityStore{
+		users:    make(map[string]map[string]map[string]struct{}),
+		messages: make(map[string]map[string]int64),
+	}
+}
+
+func (s *memoryActivityStore) Record(day time.Time, userID, room string, messages int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := activityDay(day)
+	if s.users[key] == nil {
+		s.users[key] = make(map[string]map[string]struct{})
+		s.messages[key] = make(map[string]int64)
+		s.prune(day)
+	}
+	for _, r := range []string{"", room} {
+		if s.users[key][r] == nil {
+			s.users[key][r] = make(map[string]struct{})
+		}
+		s.users[key][r][userID] = struct{}{}
+		s.messages[key][r] += messages
+		if room == "" {
+			break
+		}
+	}
+	return nil
+}
+
+// prune 保持期間を過ぎた日の記録を削除する。s.muを取得してから呼び出す
+func (s *memoryActivityStore) prune(now time.Time) {
+	oldest := activityDay(now.AddDate(0, 0, -activityRetentionDays))
+	for key := range s.users {
+		if key < oldest {
+			delete(s.users, key)
+			delete(s.messages, key)
+		}
+	}
+}
+
+func (s *memoryActivityStore) UniqueUsers(room string, from, to time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unique := make(map[string]struct{})
+	for _, day := range activityDays(from, to) {
+		for userID := range s.users[day][room] {
+			unique[userID] = struct{}{}
+		}
+	}
+	return len(unique), nil
+}
+
+func (s *memoryActivityStore) Daily(room string, from, to time.Time) ([]DailyActivity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []DailyActivity
+	for _, day := range activityDays(from, to) {
+		list = append(list, DailyActivity{Date: day, Users: len(s.users[day][room]), Messages: s.messages[day][room]})
+	}
+	return list, nil
+}
+
+func (s *memoryActivityStore) Rooms(from, to time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	for _, day := range activityDays(from, to) {
+		for room := range s.users[day] {
+			seen[room] = room != ""
+		}
+	}
+	var rooms []string
+	for room, ok := range seen {
+		if ok {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Strings(rooms)
+	return rooms, nil
+}
+
+func (s *memoryActivityStore) Forget(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rooms := range s.users {
+		for _, users := range rooms {
+			delete(users, userID)
+		}
+	}
+	return nil
+}
+
+// recordActivity 認証されたユーザーの利用を記録する
+func recordActivity(userID, room string, messages int64) {
+	if userID == "" {
+		return
+	}
+	if err := activity.Record(time.Now(), userID, room, messages); err != nil {
+		log.Println("利用状況の記録に失敗しました:", err)
+	}
+}
+
+// subscribeActivity ルームへの参加と投稿を利用状況として記録する
+func subscribeActivity(bus *eventBus) {
+	bus.Subscribe(EventClientJoined, func(e Event) { recordActivity(e.UserID, e.Room, 0) })
+	bus.Subscribe(EventMessageBroadcast, func(e Event) {
+		if e.Message != nil && isPost(e.Message) {
+			recordActivity(e.UserID, e.Room, 1)
+		}
+	})
+}
+
+// activeUsersReport アクティブユーザーの集計結果
+type activeUsersReport struct {
+	DAU    int                        `json:"dau"`
+	WAU    int                        `json:"wau"`
+	MAU    int                        `json:"mau"`
+	Series []DailyActivity            `json:"series"`
+	Rooms  map[string][]DailyActivity `json:"rooms"`
+}
+
+// activeUsersHandler 管理者用のアクティブユーザーの集計API
+// GET /api/admin/stats/active?days=30&room=general
+// roomを指定しない場合は利用されたすべてのルームの推移を返す
+func activeUsersHandler(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > activityRetentionDays {
+			writeJSONError(w, r, "daysには1から"+strconv.Itoa(activityRetentionDays)+"までの数を指定してください", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	now := time.Now()
+	report := activeUsersReport{Rooms: make(map[string][]DailyActivity)}
+	var err error
+	count := func(n int) (int, error) { return activity.UniqueUsers("", now.AddDate(0, 0, 1-n), now) }
+	if report.DAU, err = count(1); err == nil {
+		if report.WAU, err = count(7); err == nil {
+			report.MAU, err = count(30)
+		}
+	}
+	from := now.AddDate(0, 0, 1-days)
+	if err == nil {
+		report.Series, err = activity.Daily("", from, now)
+	}
+	rooms := []string{r.URL.Query().Get("room")}
+	if err == nil && rooms[0] == "" {
+		rooms, err = activity.Rooms(from, now)
+	}
+	for _, room := range rooms {
+		if err != nil {
+			break
+		}
+		report.Rooms[room], err = activity.Daily(room, from, now)
+	}
+	if err != nil {
+		requestLogger(r).Println("利用状況の取得に失敗しました:", err)
+		writeJSONError(w, r, "利用状況の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryActivityStore(t *testing.T) {
+	s := newMemoryActivityStore()
+	now := time.Now().UTC()
+	s.Record(now.AddDate(0, 0, -10), "u3", "", 0)
+	s.Record(now.AddDate(0, 0, -1), "u2", "random", 1)
+	s.Record(now, "u1", "general", 2)
+	s.Record(now, "u1", "general", 1)
+	s.Record(now, "u2", "", 0)
+
+	tests := []struct {
+		room  string
+		days  int
+		users int
+	}{
+		{"", 1, 2},
+		{"", 7, 2},
+		{"", 30, 3},
+		{"general", 30, 1},
+		{"random", 1, 0},
+		{"random", 7, 1},
+	}
+	for _, test := range tests {
+		if n, _ := s.UniqueUsers(test.room, now.AddDate(0, 0, 1-test.days), now); n != test.users {
+			t.Errorf("%q %d日: %d人になるべきところ%d人でした", test.room, test.days, test.users, n)
+		}
+	}
+	daily, _ := s.Daily("general", now.AddDate(0, 0, -1), now)
+	if len(daily) != 2 || daily[1].Date != activityDay(now) || daily[1].Users != 1 || daily[1].Messages != 3 || daily[0].Users != 0 {
+		t.Errorf("日ごとの利用者数と投稿数が不正です: %+v", daily)
+	}
+	if rooms, _ := s.Rooms(now.AddDate(0, 0, -1), now); len(rooms) != 2 || rooms[0] != "general" || rooms[1] != "random" {
+		t.Errorf("利用されたルームを名前順に返すべきです: %v", rooms)
+	}
+
+	s.Forget("u1")
+	if n, _ := s.UniqueUsers("general", now, now); n != 0 {
+		t.Errorf("削除したユーザーは数えるべきではありません: %d", n)
+	}
+	s.Record(now.AddDate(0, 0, activityRetentionDays+1), "u4", "", 0)
+	if n, _ := s.UniqueUsers("", now.AddDate(0, 0, -30), now); n != 0 {
+		t.Errorf("保持期間を過ぎた記録は削除するべきです: %d", n)
+	}
+}
+
+func TestActiveUsersHandler(t *testing.T) {
+	defer func(s ActivityStore) { activity = s }(activity)
+	activity = newMemoryActivityStore()
+	now := time.Now()
+	activity.Record(now, "u1", "general", 1)
+	activity.Record(now.AddDate(0, 0, -3), "u2", "random", 1)
+	activity.Record(now.AddDate(0, 0, -20), "u3", "", 0)
+
+	tests := []struct {
+		query string
+		code  int
+		rooms int
+	}{
+		{"", http.StatusOK, 2},
+		{"?days=7&room=general", http.StatusOK, 1},
+		{"?days=0", http.StatusBadRequest, 0},
+		{"?days=abc", http.StatusBadRequest, 0},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		activeUsersHandler(w, httptest.NewRequest("GET", "/api/admin/stats/active"+test.query, nil))
+		if w.Code != test.code {
+			t.Errorf("%q: %dになるべきところ%dでした", test.query, test.code, w.Code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var report activeUsersReport
+		if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		if report.DAU != 1 || report.WAU != 2 || report.MAU != 3 || len(report.Rooms) != test.rooms {
+			t.Errorf("%q: 集計結果が不正です: %+v", test.query, report)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+)
+
+var adminEmails = flag.String("admins", "", "管理者にするユーザーのメールアドレス (カンマ区切り)")
+
+// ユーザーの役割
+const (
+	roleUser      = ""
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+// isAdminEmail 管理者として設定されたメールアドレスかどうかを判定する
+func isAdminEmail(email string) bool {
+	if email == "" {
+		return false
+	}
+	for _, e := range strings.Split(*adminEmails, ",") {
+		if strings.EqualFold(strings.TrimSpace(e), email) {
+			return true
+		}
+	}
+	return false
+}
+
+// promoteAdmin 確認済みのメールアドレスが管理者として設定されている場合はユーザーを管理者にする
+// 未確認のアドレスは本人のものとは限らないため、一致しても管理者にしない
+func promoteAdmin(record *UserRecord) {
+	if record.EmailVerified && isAdminEmail(record.Email) {
+		record.Role = roleAdmin
+	}
+}
+
+// hasRole ユーザーが指定された役割以上の権限を持つかどうかを判定する
+// 管理者はモデレーターの権限も持つ
+func hasRole(userID, role string) bool {
+	record, err := users.GetByID(userID)
+	if err != nil {
+		return false
+	}
+	switch role {
+	case roleAdmin:
+		return record.Role == roleAdmin
+	case roleModerator:
+		return record.Role == roleAdmin || record.Role == roleModerator
+	}
+	return true
+}
+
+// outranks ユーザーが指定された役割より上の権限を持つかどうかを判定する
+// 利用停止などの操作は自分より下の役割のユーザーにだけ行える
+func outranks(userID, role string) bool {
+	switch role {
+	case roleAdmin:
+		return false
+	case roleModerator:
+		return hasRole(userID, roleAdmin)
+	}
+	return hasRole(userID, roleModerator)
+}
+
+type roleHandler struct {
+	role string
+	next http.Handler
+}
+
+func (h *roleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok || !hasRole(user.UniqueID(), h.role) {
+		writeJSONError(w, r, "権限がありません", http.StatusForbidden)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// MustRole 指定された役割を持つユーザーだけが利用できるようにハンドラの調整をする
+// MustAuthの内側で使用する
+func MustRole(role string, handler http.Handler) http.Handler {
+	return &roleHandler{role: role, next: handler}
+}
+
+// MustAdmin 管理者だけが利用できるようにハンドラの調整をする
+func MustAdmin(handler http.Handler) http.Handler {
+	return MustAuth(MustRole(roleAdmin, handler))
+}
+
+// protectDebugVars expvarがmuxに登録する/debug/varsを管理者だけが参照できるようにする
+// ロックアウト中のアカウントなどの内部の情報を含むため、公開しない
+func protectDebugVars(mux http.Handler) http.Handler {
+	admin := MustAdmin(mux)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/debug/vars" {
+			admin.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
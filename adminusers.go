@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// newUserRequest 管理者がユーザーを事前に登録する際の内容
+// ProviderとProviderIDを指定すると、そのアカウントで初めてログインしたときに登録したユーザーとして扱われる
+type newUserRequest struct {
+	Name       string `json:"name"`
+	Email      string `json:"email"`
+	Provider   string `json:"provider"`
+	ProviderID string `json:"provider_id"`
+	Role       string `json:"role"`
+}
+
+// adminUserResponse 管理者用APIで返すユーザーの情報
+type adminUserResponse struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Email    string `json:"email,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	Role     string `json:"role,omitempty"`
+}
+
+// adminUsersHandler 管理者用のユーザーの管理API
+// POST /api/admin/users              ユーザーを登録する
+// GET  /api/admin/users/{id}/export  ユーザーのデータをZIPで返す
+func adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/users"), "/")
+	switch {
+	case path == "" && r.Method == http.MethodPost:
+		createUserByAdmin(w, r)
+	case strings.HasSuffix(path, "/export") && r.Method == http.MethodGet:
+		exportUserByAdmin(w, r, strings.TrimSuffix(path, "/export"))
+	default:
+		writeJSONError(w, r, "見つかりません", http.StatusNotFound)
+	}
+}
+
+func createUserByAdmin(w http.ResponseWriter, r *http.Request) {
+	var req newUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		writeJSONError(w, r, "ユーザーの情報の形式が不正です", http.StatusBadRequest)
+		return
+	}
+	// 管理者による登録では予約された名前も使える
+	name, err := validateDisplayName(req.Name, true)
+	if err != nil {
+		writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Name = name
+	switch req.Role {
+	case roleUser, roleModerator, roleAdmin:
+	default:
+		writeJSONError(w, r, "役割が不正です: "+req.Role, http.StatusBadRequest)
+		return
+	}
+	if (req.Provider == "") != (req.ProviderID == "") {
+		writeJSONError(w, r, "providerとprovider_idは両方を指定してください", http.StatusBadRequest)
+		return
+	}
+	record := &UserRecord{
+		ID:    uniqueIDFor(req.Name),
+		Name:  req.Name,
+		Email: req.Email,
+		// 管理者が登録したアドレスは確認済みとみなす
+		EmailVerified: req.Email != "",
+		Provider:      req.Provider,
+		ProviderID:    req.ProviderID,
+		Role:          req.Role,
+	}
+	if _, err := users.GetByID(record.ID); err == nil {
+		record.ID = randomID()
+	}
+	if err := users.Create(record); err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrUserExists {
+			status = http.StatusConflict
+		}
+		writeJSONError(w, r, err.Error(), status)
+		return
+	}
+	admin, _ := userFromContext(r.Context())
+	auditRequest(r, auditAdminAction, admin.UniqueID(), record.ID, map[string]string{"action": "create_user", "role": record.Role})
+	writeJSON(w, http.StatusCreated, adminUserResponse{
+		ID:       record.ID,
+		Name:     record.Name,
+		Email:    record.Email,
+		Provider: record.Provider,
+		Role:     record.Role,
+	})
+}
+
+func exportUserByAdmin(w http.ResponseWriter, r *http.Request, userID string) {
+	data, err := buildExport(userID)
+	if err == ErrUserNotFound {
+		writeJSONError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Println("データのエクスポートに失敗しました:", userID, "-", err)
+		writeJSONError(w, r, "データのエクスポートに失敗しました", http.StatusInternalServerError)
+		return
+	}
+	admin, _ := userFromContext(r.Context())
+	auditRequest(r, auditAdminAction, admin.UniqueID(), userID, map[string]string{"action": "export_user"})
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+userID+`.zip"`)
+	w.Write(data)
+}
+
+// blobGCHandler 参照されていない添付ファイルをすぐに削除する
+// POST /api/admin/uploads/gc?dry_run=true&grace=24h
+func blobGCHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	grace := *blobGCGrace
+	if v := r.URL.Query().Get("grace"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			writeJSONError(w, r, "graceの形式が不正です", http.StatusBadRequest)
+			return
+		}
+		grace = d
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	result, err := collectOrphanBlobs(time.Now(), grace, dryRun)
+	if err != nil {
+		requestLogger(r).Println("添付ファイルの整理に失敗しました:", err)
+		writeJSONError(w, r, "添付ファイルの整理に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	admin, _ := userFromContext(r.Context())
+	auditRequest(r, auditAdminAction, admin.UniqueID(), "", map[string]string{"action": "blob_gc", "dry_run": r.URL.Query().Get("dry_run")})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"orphans": result.Orphans, "bytes": result.Bytes, "dry_run": dryRun})
+}
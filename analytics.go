@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+var (
+	analyticsSink       = flag.String("analytics-sink", "", "利用状況の集計の出力先 (file:パス、http(s)://のURL、s3://バケット/プレフィックス。空の場合は集計しない)")
+	analyticsInterval   = flag.Duration("analytics-interval", time.Hour, "利用状況を集計して出力する間隔")
+	analyticsS3Endpoint = flag.String("analytics-s3-endpoint", "s3.amazonaws.com", "s3://に出力する場合のエンドポイント (認証情報はAWS_ACCESS_KEY_IDとAWS_SECRET_ACCESS_KEYで指定する)")
+)
+
+// AnalyticsReport ある期間の匿名化した利用状況
+// ユーザーを特定できる情報は含めない
+type AnalyticsReport struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// MessagesByRoomは期間中にルームごとに投稿されたメッセージの数
+	MessagesByRoom map[string]int64 `json:"messages_by_room"`
+	// ActiveUsersは期間中に参加または投稿したユーザーの数
+	ActiveUsers int `json:"active_users"`
+	// Sessionsは期間中に終了した接続の数
+	Sessions             int     `json:"sessions"`
+	MedianSessionSeconds float64 `json:"median_session_seconds"`
+}
+
+// AnalyticsSink 集計した利用状況の出力先
+type AnalyticsSink interface {
+	Export(report *AnalyticsReport) error
+}
+
+// newAnalyticsSink フラグの設定に従ってAnalyticsSinkを生成する
+func newAnalyticsSink(spec string) (AnalyticsSink, error) {
+	switch {
+	case strings.HasPrefix(spec, "file:"):
+		return &fileAnalyticsSink{path: strings.TrimPrefix(spec, "file:")}, nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &webhookAnalyticsSink{endpoint: spec, client: &http.Client{Timeout: 30 * time.Second}}, nil
+	case strings.HasPrefix(spec, "s3://"):
+		return newS3AnalyticsSink(spec, *analyticsS3Endpoint)
+	}
+	return nil, fmt.Errorf("chat: 利用状況の出力先の指定が不正です: %s", spec)
+}
+
+// fileAnalyticsSink 1行に1件のJSONとしてファイルに追記するAnalyticsSink
+type fileAnalyticsSink struct {
+	path string
+}
+
+func (s *fileAnalyticsSink) Export(report *AnalyticsReport) error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(report)
+}
+
+// webhookAnalyticsSink JSONをPOSTするAnalyticsSink
+type webhookAnalyticsSink struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (s *webhookAnalyticsSink) Export(report *AnalyticsReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signWebhook(req, data)
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("chat: 利用状況の出力先がエラーを返しました: %s", res.Status)
+	}
+	return nil
+}
+
+// s3AnalyticsSink 期間ごとに1つのオブジェクトとして保存するAnalyticsSink
+type s3AnalyticsSink struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3AnalyticsSink(spec, endpoint string) (*s3AnalyticsSink, error) {
+	u, err := url.Parse(spec)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("chat: 利用状況の出力先の指定が不正です: %s", spec)
+	}
+	client, err := minio.New(endpoint, &minio.Options{Creds: credentials.NewEnvAWS(), Secure: true})
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3AnalyticsSink{client: client, bucket: u.Host, prefix: prefix}, nil
+}
+
+func (s *s3AnalyticsSink) Export(report *AnalyticsReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	key := s.prefix + report.Start.UTC().Format("2006/01/02/150405") + ".json"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err = s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/json"})
+	return err
+}
+
+// analyticsCollector ライフサイクルイベントから利用状況を集計する
+type analyticsCollector struct {
+	mu       sync.Mutex
+	start    time.Time
+	messages map[string]int64
+	// usersは人数を数えるためだけに使い、出力しない
+	users    map[string]struct{}
+	joined   map[string]time.Time
+	sessions []time.Duration
+}
+
+func newAnalyticsCollector() *analyticsCollector {
+	c := &analyticsCollector{joined: make(map[string]time.Time)}
+	c.reset(time.Now())
+	return c
+}
+
+// subscribe イベントの購読を開始する
+func (c *analyticsCollector) subscribe(bus *eventBus) {
+	bus.Subscribe(EventMessageBroadcast, c.observe)
+	bus.Subscribe(EventClientJoined, c.observe)
+	bus.Subscribe(EventClientLeft, c.observe)
+}
+
+func (c *analyticsCollector) observe(e Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.UserID != "" {
+		c.users[e.UserID] = struct{}{}
+	}
+	switch e.Kind {
+	case EventMessageBroadcast:
+		if e.Message != nil && isPost(e.Message) {
+			c.messages[e.Room]++
+		}
+	case EventClientJoined:
+		c.joined[e.ConnID] = e.When
+	case EventClientLeft:
+		if joined, ok := c.joined[e.ConnID]; ok {
+			c.sessions = append(c.sessions, e.When.Sub(joined))
+			delete(c.joined, e.ConnID)
+		}
+	}
+}
+
+// reset 新しい期間の集計を始める。c.muを取得してから呼び出す
+func (c *analyticsCollector) reset(now time.Time) {
+	c.start = now
+	c.messages = make(map[string]int64)
+	c.users = make(map[string]struct{})
+	c.sessions = nil
+}
+
+// flush 現在の期間の集計結果を返し、新しい期間を始める
+func (c *analyticsCollector) flush(now time.Time) *AnalyticsReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report := &AnalyticsReport{
+		Start:          c.start,
+		End:            now,
+		MessagesByRoom: c.messages,
+		ActiveUsers:    len(c.users),
+		Sessions:       len(c.sessions),
+	}
+	if n := len(c.sessions); n > 0 {
+		sort.Slice(c.sessions, func(i, j int) bool { return c.sessions[i] < c.sessions[j] })
+		median := c.sessions[n/2]
+		if n%2 == 0 {
+			median = (c.sessions[n/2-1] + c.sessions[n/2]) / 2
+		}
+		report.MedianSessionSeconds = median.Seconds()
+	}
+	c.reset(now)
+	return report
+}
+
+// run intervalごとに利用状況を集計してsinkに出力する
+func (c *analyticsCollector) run(sink AnalyticsSink, interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := sink.Export(c.flush(now)); err != nil {
+			log.Println("利用状況の出力に失敗しました:", err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnalyticsCollector(t *testing.T) {
+	c := newAnalyticsCollector()
+	start := time.Now()
+	events := []Event{
+		{Kind: EventClientJoined, Room: "general", UserID: "u1", ConnID: "c1", When: start},
+		{Kind: EventClientJoined, Room: "general", UserID: "u2", ConnID: "c2", When: start},
+		{Kind: EventClientJoined, Room: "random", UserID: "u3", ConnID: "c3", When: start},
+		{Kind: EventMessageBroadcast, Room: "general", UserID: "u1", Message: &message{Type: typeChat, Message: "秘密の話"}},
+		{Kind: EventMessageBroadcast, Room: "general", UserID: "u2", Message: &message{Type: typeChat}},
+		{Kind: EventMessageBroadcast, Room: "general", Message: &message{Type: typeMessageDeleted}},
+		{Kind: EventClientLeft, Room: "general", UserID: "u1", ConnID: "c1", When: start.Add(10 * time.Second)},
+		{Kind: EventClientLeft, Room: "general", UserID: "u2", ConnID: "c2", When: start.Add(30 * time.Second)},
+		{Kind: EventClientLeft, Room: "random", UserID: "u4", ConnID: "unknown", When: start.Add(time.Hour)},
+	}
+	for _, e := range events {
+		c.observe(e)
+	}
+	report := c.flush(start.Add(time.Minute))
+	if report.MessagesByRoom["general"] != 2 || len(report.MessagesByRoom) != 1 {
+		t.Errorf("ルームごとの投稿だけを数えるべきです: %v", report.MessagesByRoom)
+	}
+	if report.ActiveUsers != 4 || report.Sessions != 2 || report.MedianSessionSeconds != 20 {
+		t.Errorf("利用者数と接続時間の中央値が不正です: %+v", report)
+	}
+	data, _ := json.Marshal(report)
+	for _, s := range []string{"u1", "u2", "秘密の話"} {
+		if strings.Contains(string(data), s) {
+			t.Errorf("集計結果にユーザーやメッセージの内容(%s)を含めるべきではありません: %s", s, data)
+		}
+	}
+
+	c.observe(Event{Kind: EventClientLeft, Room: "random", UserID: "u3", ConnID: "c3", When: start.Add(2 * time.Minute)})
+	next := c.flush(start.Add(2 * time.Minute))
+	if !next.Start.Equal(report.End) || len(next.MessagesByRoom) != 0 || next.Sessions != 1 || next.MedianSessionSeconds != 120 {
+		t.Errorf("前の期間をまたぐ接続も含めて新しい期間を集計するべきです: %+v", next)
+	}
+}
+
+func TestNewAnalyticsSink(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"file:/tmp/analytics.jsonl", true},
+		{"https://example.com/hook", true},
+		{"s3://", false},
+		{"ftp://example.com", false},
+	}
+	for _, test := range tests {
+		if _, err := newAnalyticsSink(test.spec); (err == nil) != test.ok {
+			t.Errorf("%s: エラー%vになるべきところ%vでした", test.spec, !test.ok, err)
+		}
+	}
+}
+
+func TestAnalyticsSinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.jsonl")
+	sink := &fileAnalyticsSink{path: path}
+	for _, room := range []string{"general", "random"} {
+		if err := sink.Export(&AnalyticsReport{MessagesByRoom: map[string]int64{room: 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	for s := bufio.NewScanner(f); s.Scan(); lines++ {
+	}
+	if lines != 2 {
+		t.Errorf("1件ずつ追記するべきところ%d行でした", lines)
+	}
+
+	status := http.StatusOK
+	var received AnalyticsReport
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	hook := &webhookAnalyticsSink{endpoint: server.URL, client: server.Client()}
+	if err := hook.Export(&AnalyticsReport{ActiveUsers: 3}); err != nil || received.ActiveUsers != 3 {
+		t.Errorf("集計結果をPOSTするべきです: %+v, %v", received, err)
+	}
+	status = http.StatusInternalServerError
+	if err := hook.Export(&AnalyticsReport{}); err == nil {
+		t.Error("出力先がエラーを返した場合はエラーにするべきです")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrInvalidAnnouncement お知らせの内容が不正な場合に発生するエラー
+var ErrInvalidAnnouncement = errors.New("chat: お知らせの本文を指定してください。有効期限は現在より後の時刻を指定してください。")
+
+// announcementBoard 現在掲示しているお知らせを保持する
+// 掲示中に接続したクライアントにも有効期限まで届ける
+type announcementBoard struct {
+	mu      sync.Mutex
+	current *message
+}
+
+// Set お知らせを掲示する。本文が空の場合は取り下げる
+func (b *announcementBoard) Set(msg *message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if msg.Message == "" {
+		b.current = nil
+		return
+	}
+	b.current = msg
+}
+
+// Current 有効期限内のお知らせを返す。掲示していない場合はnilを返す
+func (b *announcementBoard) Current(now time.Time) *message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.current == nil || (b.current.Expires != nil && !now.Before(*b.current.Expires)) {
+		return nil
+	}
+	return b.current
+}
+
+// announcementEvent お知らせのイベントを作る。textが空の場合は取り下げを表す
+func announcementEvent(text string, expires *time.Time) *message {
+	return &message{Type: typeAnnouncement, ID: randomID(), Name: systemName, Message: text, When: time.Now(), Expires: expires}
+}
+
+// Announce ルームに関係なく、接続しているすべてのクライアントにお知らせを送信する
+// 他のノードにも中継し、保存は行わない
+func (rs *roomRegistry) Announce(msg *message) {
+	rs.announceLocal(msg)
+	if rs.cluster != nil {
+		if err := rs.cluster.Publish(clusterBroadcast, msg); err != nil {
+			reporter.Report(err, map[string]string{"op": "announce"})
+		}
+	}
+}
+
+// announceLocal このノードでお知らせを掲示し、すべてのルームのクライアントに配信する
+func (rs *roomRegistry) announceLocal(msg *message) {
+	announcements.Set(msg)
+	rs.deliverLocal(msg)
+}
+
+// announcementRequest お知らせを掲示するリクエスト
+type announcementRequest struct {
+	Message string     `json:"message"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// announcementHandler お知らせを管理する
+// GET    /api/admin/announcements  掲示中のお知らせ
+// POST   /api/admin/announcements  お知らせを掲示して全員に送信する
+// DELETE /api/admin/announcements  お知らせを取り下げる
+type announcementHandler struct {
+	rooms *roomRegistry
+}
+
+func (h *announcementHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	admin, _ := userFromContext(r.Context())
+	switch r.Method {
+	case http.MethodGet:
+		current := announcements.Current(time.Now())
+		if current == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, http.StatusOK, current)
+	case http.MethodPost:
+		var req announcementRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, r, ErrInvalidAnnouncement.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Message == "" || (req.Expires != nil && !req.Expires.After(time.Now())) {
+			writeJSONError(w, r, ErrInvalidAnnouncement.Error(), http.StatusBadRequest)
+			return
+		}
+		msg := announcementEvent(req.Message, req.Expires)
+		h.rooms.Announce(msg)
+		auditRequest(r, auditAdminAction, admin.UniqueID(), "", map[string]string{"action": "announce", "message": req.Message})
+		writeJSON(w, http.StatusCreated, msg)
+	case http.MethodDelete:
+		h.rooms.Announce(announcementEvent("", nil))
+		auditRequest(r, auditAdminAction, admin.UniqueID(), "", map[string]string{"action": "withdraw_announcement"})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
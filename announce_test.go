@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnnouncementBoard(t *testing.T) {
+	b := &announcementBoard{}
+	now := time.Now()
+	expires := now.Add(time.Hour)
+	b.Set(announcementEvent("メンテナンスのお知らせ", &expires))
+	if a := b.Current(now); a == nil || a.Message != "メンテナンスのお知らせ" {
+		t.Errorf("有効期限内のお知らせを返すべきです: %+v", a)
+	}
+	if a := b.Current(expires); a != nil {
+		t.Errorf("有効期限を過ぎたお知らせは返すべきではありません: %+v", a)
+	}
+	b.Set(announcementEvent("", nil))
+	if a := b.Current(now); a != nil {
+		t.Errorf("取り下げたお知らせは返すべきではありません: %+v", a)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// writeJSON 値をJSONとしてレスポンスに書き出す
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError リクエストIDを含むエラーをJSONとしてレスポンスに書き出す
+func writeJSONError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	writeJSON(w, status, map[string]interface{}{
+		"error":      message,
+		"request_id": requestIDFromContext(r.Context()),
+	})
+}
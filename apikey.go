@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiKeyPrefix 発行するAPIキーの接頭辞。ログなどでAPIキーであることを識別しやすくする
+const apiKeyPrefix = "gck_"
+
+// APIキーの権限
+const (
+	// scopeReadはGETなどの参照系のリクエストを許可する
+	scopeRead = "read"
+	// scopeWriteは更新系のリクエストを許可する
+	scopeWrite = "write"
+	// scopeChatはチャットルームへの接続を許可する
+	scopeChat = "chat"
+)
+
+// ErrAPIKeyNotFound 指定されたAPIキーが存在しない場合に発生するエラー
+var ErrAPIKeyNotFound = errors.New("chat: APIキーが見つかりません。")
+
+// APIKey ユーザーが発行したAPIキー。キー自体はハッシュ化して保存する
+type APIKey struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	Prefix     string    `json:"prefix"`
+	Hash       string    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+}
+
+// APIKeyStore APIキーを保存する
+type APIKeyStore interface {
+	Create(k *APIKey) error
+	// GetByHash キーのハッシュでAPIキーを取得する
+	// *見つからない場合にはErrAPIKeyNotFoundを返す
+	GetByHash(hash string) (*APIKey, error)
+	ListByUser(userID string) ([]*APIKey, error)
+	Touch(id string, t time.Time) error
+	Delete(id string) error
+	DeleteByUser(userID string) error
+}
+
+// memoryAPIKeyStore メモリ上にAPIキーを保持するAPIKeyStore
+type memoryAPIKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]*APIKey
+}
+
+func newMemoryAPIKeyStore() *memoryAPIKeyStore {
+	return &memoryAPIKeyStore{keys: make(map[string]*APIKey)}
+}
+
+func (s *memoryAPIKeyStore) Create(k *APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *k
+	s.keys[k.ID] = &stored
+	return nil
+}
+
+func (s *memoryAPIKeyStore) GetByHash(hash string) (*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.keys {
+		if k.Hash == hash {
+			copied := *k
+			return &copied, nil
+		}
+	}
+	return nil, ErrAPIKeyNotFound
+}
+
+func (s *memoryAPIKeyStore) ListByUser(userID string) ([]*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := []*APIKey{}
+	for _, k := range s.keys {
+		if k.UserID == userID {
+			copied := *k
+			list = append(list, &copied)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryAPIKeyStore) Touch(id string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	k.LastUsedAt = t
+	return nil
+}
+
+func (s *memoryAPIKeyStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[id]; !ok {
+		return ErrAPIKeyNotFound
+	}
+	delete(s.keys, id)
+	return nil
+}
+
+func (s *memoryAPIKeyStore) DeleteByUser(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, k := range s.keys {
+		if k.UserID == userID {
+			delete(s.keys, id)
+		}
+	}
+	return nil
+}
+
+// apiKeyUser APIキーで認証されたユーザー
+type apiKeyUser struct {
+	sessionUser
+	scopes []string
+}
+
+// Allows APIキーの権限でリクエストを処理できるかどうかを判定する
+func (u apiKeyUser) Allows(r *http.Request) bool {
+	required := scopeWrite
+	switch {
+	case r.URL.Path == "/room":
+		required = scopeChat
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		required = scopeRead
+	}
+	return u.HasScope(required)
+}
+
+// HasScope APIキーが指定された権限を持つかどうかを判定する
+func (u apiKeyUser) HasScope(scope string) bool {
+	for _, s := range u.scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyAuthenticator ユーザーのAPIキーを検証するTokenAuthenticator
+type apiKeyAuthenticator struct {
+	store APIKeyStore
+}
+
+// Authenticate Receiver:apiKeyAuthenticator
+func (a apiKeyAuthenticator) Authenticate(token string) (ChatUser, error) {
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return nil, ErrInvalidToken
+	}
+	key, err := a.store.GetByHash(hashToken(token))
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	record, err := users.GetByID(key.UserID)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	a.store.Touch(key.ID, time.Now())
+	return apiKeyUser{
+		sessionUser: sessionUser{uniqueID: record.ID, name: record.Name, avatarURL: record.AvatarURL},
+		scopes:      key.Scopes,
+	}, nil
+}
+
+// validScopes 指定された権限がすべて既知のものかどうかを判定する
+func validScopes(scopes []string) bool {
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, s := range scopes {
+		switch s {
+		case scopeRead, scopeWrite, scopeChat:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// apiKeysHandler 自分のAPIキーを管理するAPI
+// GET    /api/me/keys       一覧を返す
+// POST   /api/me/keys       name, scope(複数指定可)を指定して発行する。キーはこのレスポンスでのみ返す
+// DELETE /api/me/keys/{id}  失効させる
+func apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	if _, ok := user.(apiKeyUser); ok {
+		writeJSONError(w, r, "APIキーでAPIキーを管理することはできません", http.StatusForbidden)
+		return
+	}
+	if _, err := users.GetByID(user.UniqueID()); err != nil {
+		writeJSONError(w, r, "このアカウントではAPIキーを利用できません", http.StatusBadRequest)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/me/keys"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		list, err := apiKeys.ListByUser(user.UniqueID())
+		if err != nil {
+			writeJSONError(w, r, "APIキーの取得に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case id == "" && r.Method == http.MethodPost:
+		r.ParseForm()
+		name := strings.TrimSpace(r.FormValue("name"))
+		scopes := r.Form["scope"]
+		if name == "" || !validScopes(scopes) {
+			writeJSONError(w, r, "nameとscope(read, write, chat)を指定してください", http.StatusBadRequest)
+			return
+		}
+		token := apiKeyPrefix + randomID()
+		key := &APIKey{
+			ID:        randomID(),
+			UserID:    user.UniqueID(),
+			Name:      name,
+			Scopes:    scopes,
+			Prefix:    token[:len(apiKeyPrefix)+6],
+			Hash:      hashToken(token),
+			CreatedAt: time.Now(),
+		}
+		if err := apiKeys.Create(key); err != nil {
+			writeJSONError(w, r, "APIキーの発行に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		auditRequest(r, auditAdminAction, user.UniqueID(), user.UniqueID(), map[string]string{"action": "api_key_created", "key_id": key.ID})
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"key": key, "token": token})
+	case id != "" && r.Method == http.MethodDelete:
+		list, _ := apiKeys.ListByUser(user.UniqueID())
+		for _, k := range list {
+			if k.ID == id {
+				apiKeys.Delete(id)
+				auditRequest(r, auditAdminAction, user.UniqueID(), user.UniqueID(), map[string]string{"action": "api_key_revoked", "key_id": id})
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		writeJSONError(w, r, ErrAPIKeyNotFound.Error(), http.StatusNotFound)
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
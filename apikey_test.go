@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAPIKeyScopes(t *testing.T) {
+	defer func(u UserStore, k APIKeyStore, a TokenAuthenticator) { users, apiKeys, tokenAuth = u, k, a }(users, apiKeys, tokenAuth)
+	users, apiKeys = newMemoryUserStore(), newMemoryAPIKeyStore()
+	tokenAuth = TryTokenAuthenticators{apiKeyAuthenticator{store: apiKeys}}
+	defer func(l *loginLimiter) { loginLimits = l }(loginLimits)
+	loginLimits = newLoginLimiter(100, 0, 0)
+	users.Create(&UserRecord{ID: "u1", Name: "Alice"})
+
+	// manage ログイン中のユーザーとしてAPIキーを管理する
+	manage := func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = r.WithContext(withUser(r.Context(), sessionUser{uniqueID: "u1", name: "Alice"}))
+		w := httptest.NewRecorder()
+		apiKeysHandler(w, r)
+		return w
+	}
+	issue := func(scopes ...string) (string, string) {
+		w := manage("POST", "/api/me/keys", url.Values{"name": {"test"}, "scope": scopes})
+		var issued struct {
+			Key   APIKey `json:"key"`
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&issued); err != nil || w.Code != http.StatusCreated {
+			t.Fatalf("APIキーを発行できるべきです: %d, %v", w.Code, err)
+		}
+		return issued.Key.ID, issued.Token
+	}
+	_, read := issue(scopeRead)
+	_, write := issue(scopeRead, scopeWrite)
+	_, chat := issue(scopeChat)
+	revokedID, revoked := issue(scopeRead)
+	if w := manage("DELETE", "/api/me/keys/"+revokedID, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("APIキーを失効させられるべきところ%dでした", w.Code)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/rooms", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/room", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/api/me/keys", apiKeysHandler)
+	h := MustAuth(mux)
+	tests := []struct {
+		token, method, path string
+		code                int
+	}{
+		{read, "GET", "/api/rooms", http.StatusOK},
+		{read, "POST", "/api/rooms", http.StatusForbidden},
+		{write, "POST", "/api/rooms", http.StatusOK},
+		{read, "GET", "/room", http.StatusForbidden},
+		{write, "GET", "/room", http.StatusForbidden},
+		{chat, "GET", "/room", http.StatusOK},
+		{chat, "GET", "/api/rooms", http.StatusForbidden},
+		{revoked, "GET", "/api/rooms", http.StatusUnauthorized},
+		{write, "GET", "/api/me/keys", http.StatusForbidden},
+		{write, "POST", "/api/me/keys?name=more&scope=write", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.Header.Set("Authorization", "Bearer "+test.token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s (%s): %dになるべきところ%dでした", test.method, test.path, test.token[:len(apiKeyPrefix)+6], test.code, w.Code)
+		}
+	}
+	if list, _ := apiKeys.ListByUser("u1"); len(list) != 3 {
+		t.Errorf("APIキーでAPIキーを発行できないべきです: %d件", len(list))
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// closeReasonArchived ルームのアーカイブによって切断する際のクローズ理由
+const closeReasonArchived = "archived"
+
+var (
+	// ErrRoomArchived アーカイブされたルームに接続しようとした場合に発生するエラー
+	ErrRoomArchived = errors.New("chat: このルームはアーカイブされています。")
+	// ErrRoomNotArchived アーカイブされていないルームを完全に削除しようとした場合に発生するエラー
+	ErrRoomNotArchived = errors.New("chat: 削除する前にルームをアーカイブしてください。")
+)
+
+// archiveRoom ルームをアーカイブし、在室しているクライアントにお知らせを送って切断する
+func archiveRoom(rooms *roomRegistry, name, userID string) (*RoomInfo, error) {
+	rm, err := rooms.existing(name)
+	if err != nil {
+		return nil, err
+	}
+	info := roomInfo(name)
+	info.Archived, info.UpdatedBy, info.UpdatedAt = true, userID, time.Now()
+	if err := roomInfos.Save(info); err != nil {
+		return nil, err
+	}
+	rm.archived.Store(true)
+	notice := &message{
+		Type:     typeRoomArchived,
+		ID:       randomID(),
+		Room:     name,
+		Name:     systemName,
+		Message:  "このルームはアーカイブされました。",
+		When:     info.UpdatedAt,
+		RoomInfo: info,
+	}
+	select {
+	case rm.kick <- &kick{reason: closeReasonArchived, notice: notice}:
+	case <-rm.done:
+	}
+	return info, nil
+}
+
+// unarchiveRoom ルームのアーカイブを解除する
+func unarchiveRoom(rooms *roomRegistry, name, userID string) (*RoomInfo, error) {
+	info := roomInfo(name)
+	info.Archived, info.UpdatedBy, info.UpdatedAt = false, userID, time.Now()
+	if err := roomInfos.Save(info); err != nil {
+		return nil, err
+	}
+	if rm, ok := rooms.lookup(name); ok {
+		rm.archived.Store(false)
+	}
+	return info, nil
+}
+
+// purgeRoom アーカイブされたルームを終了し、メッセージと情報を削除する
+// 削除したメッセージの件数を返す
+func purgeRoom(rooms *roomRegistry, name string) (int, error) {
+	if !roomInfo(name).Archived {
+		return 0, ErrRoomNotArchived
+	}
+	rooms.remove(name)
+	forgetRoomMetrics(name)
+	n, err := messages.DeleteByRoom(name)
+	if err != nil {
+		return n, err
+	}
+	return n, roomInfos.Delete(name)
+}
+
+// serveArchive オーナーとモデレーターによるアーカイブ
+// POST /api/rooms/{room}/archive
+func (h *roomInfoHandler) serveArchive(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	user, _ := userFromContext(r.Context())
+	rm, err := h.rooms.existing(name)
+	if err == ErrRoomNotFound {
+		writeJSONError(w, r, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !rm.canManage(user.UniqueID()) {
+		writeJSONError(w, r, "ルームをアーカイブできるのはオーナーとモデレーターだけです", http.StatusForbidden)
+		return
+	}
+	info, err := archiveRoom(h.rooms, name, user.UniqueID())
+	if err != nil {
+		requestLogger(r).Println("ルームをアーカイブできませんでした:", err)
+		writeJSONError(w, r, "ルームをアーカイブできませんでした", http.StatusInternalServerError)
+		return
+	}
+	auditRequest(r, auditAdminAction, user.UniqueID(), name, map[string]string{"action": "room_archive"})
+	writeJSON(w, http.StatusOK, info)
+}
+
+// serveArchive 管理者によるアーカイブとその解除
+// POST   /api/admin/rooms/{room}/archive
+// DELETE /api/admin/rooms/{room}/archive
+func (h *roomAdminHandler) serveArchive(w http.ResponseWriter, r *http.Request, rm *room) {
+	admin, _ := userFromContext(r.Context())
+	var info *RoomInfo
+	var err error
+	action := "room_archive"
+	switch r.Method {
+	case http.MethodPost:
+		info, err = archiveRoom(h.rooms, rm.name, admin.UniqueID())
+	case http.MethodDelete:
+		action = "room_unarchive"
+		info, err = unarchiveRoom(h.rooms, rm.name, admin.UniqueID())
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Println("ルームのアーカイブを変更できませんでした:", err)
+		writeJSONError(w, r, "ルームのアーカイブを変更できませんでした", http.StatusInternalServerError)
+		return
+	}
+	auditRequest(r, auditAdminAction, admin.UniqueID(), rm.name, map[string]string{"action": action})
+	writeJSON(w, http.StatusOK, info)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestArchiveRoom(t *testing.T) {
+	defer func(s RoomStore, m MessageStore) { roomInfos, messages = s, m }(roomInfos, messages)
+	roomInfos, messages = newMemoryRoomStore(), newMemoryMessageStore()
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	rm, _ := rooms.get("old")
+	messages.Save(&message{ID: "m1", Room: "old", When: time.Now()})
+	messages.Save(&message{ID: "m2", Room: "general", When: time.Now()})
+
+	if _, err := purgeRoom(rooms, "old"); err != ErrRoomNotArchived {
+		t.Errorf("アーカイブしていないルームは削除できないべきです: %v", err)
+	}
+	if _, err := archiveRoom(rooms, "old", "owner"); err != nil {
+		t.Fatal(err)
+	}
+	if rm.canPost("owner") {
+		t.Error("アーカイブされたルームには投稿できないべきです")
+	}
+	if list, _ := roomDirectory(rooms, "", sortRoomsByName, false); len(list) != 0 {
+		t.Errorf("アーカイブされたルームは既定の一覧に表示しないべきです: %v", list)
+	}
+	if _, err := unarchiveRoom(rooms, "old", "admin"); err != nil || !rm.canPost("owner") {
+		t.Errorf("アーカイブを解除すると投稿できるべきです: %v", err)
+	}
+
+	archiveRoom(rooms, "old", "owner")
+	if n, err := purgeRoom(rooms, "old"); err != nil || n != 1 {
+		t.Fatalf("ルームのメッセージだけを削除するべきです: %d, %v", n, err)
+	}
+	if _, err := messages.Get("m2"); err != nil {
+		t.Error("他のルームのメッセージは削除しないべきです")
+	}
+	if _, ok := rooms.lookup("old"); ok {
+		t.Error("削除したルームは登録を解除するべきです")
+	}
+	if _, err := roomInfos.Get("old"); err != ErrRoomInfoNotFound {
+		t.Error("削除したルームの情報は削除するべきです")
+	}
+}
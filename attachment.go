@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrAttachmentNotFound 指定された添付ファイルが存在しない場合に発生するエラー
+var ErrAttachmentNotFound = errors.New("chat: 添付ファイルが見つかりません。")
+
+// Attachment アップロードされた添付ファイル。内容はBlobStoreにIDをキーとして保存される
+type Attachment struct {
+	ID          string `json:"id"`
+	UserID      string `json:"user_id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	// Purposeはアップロードの目的。アバターの場合はattachmentPurposeAvatar
+	Purpose string `json:"purpose,omitempty"`
+	// Heldが設定された添付ファイルはモデレーターの審査が終わるまで公開されない
+	Held      bool      `json:"held,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// attachmentETag 添付ファイルのETag
+func attachmentETag(a *Attachment) string {
+	return `"` + a.ID + `"`
+}
+
+// URL 添付ファイルをダウンロードするURL
+func (a *Attachment) URL() string {
+	return "/attachments/" + a.ID
+}
+
+// AttachmentStore 添付ファイルの情報を保存する
+type AttachmentStore interface {
+	Create(a *Attachment) error
+	Get(id string) (*Attachment, error)
+	ListByUser(userID string) ([]*Attachment, error)
+	Update(a *Attachment) error
+	Delete(id string) error
+}
+
+// memoryAttachmentStore メモリ上に添付ファイルの情報を保持するAttachmentStore
+type memoryAttachmentStore struct {
+	mu          sync.Mutex
+	attachments map[string]*Attachment
+}
+
+func newMemoryAttachmentStore() *memoryAttachmentStore {
+	return &memoryAttachmentStore{attachments: make(map[string]*Attachment)}
+}
+
+func (s *memoryAttachmentStore) Create(a *Attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *a
+	s.attachments[a.ID] = &stored
+	return nil
+}
+
+func (s *memoryAttachmentStore) Get(id string) (*Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.attachments[id]
+	if !ok {
+		return nil, ErrAttachmentNotFound
+	}
+	copied := *a
+	return &copied, nil
+}
+
+func (s *memoryAttachmentStore) ListByUser(userID string) ([]*Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []*Attachment{}
+	for _, a := range s.attachments {
+		if a.UserID == userID {
+			copied := *a
+			list = append(list, &copied)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list, nil
+}
+
+func (s *memoryAttachmentStore) Update(a *Attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.attachments[a.ID]; !ok {
+		return ErrAttachmentNotFound
+	}
+	stored := *a
+	s.attachments[a.ID] = &stored
+	return nil
+}
+
+func (s *memoryAttachmentStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.attachments[id]; !ok {
+		return ErrAttachmentNotFound
+	}
+	delete(s.attachments, id)
+	return nil
+}
+
+// attachmentHandler 添付ファイルをダウンロードする
+// GET /attachments/{id}
+func attachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	a, err := attachments.Get(strings.TrimPrefix(r.URL.Path, "/attachments/"))
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	// 審査待ちの添付ファイルはモデレーターだけが確認できる
+	if user, _ := userFromContext(r.Context()); a.Held && !hasRole(user.UniqueID(), roleModerator) {
+		httpError(w, r, "この添付ファイルは審査中です", http.StatusForbidden)
+		return
+	}
+	f, err := blobs.Open(a.ID)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	// アップロードされた内容をこのオリジンのページとして解釈させない
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename}))
+	// ServeContentはRangeとIf-Rangeに対応しているため、音声や動画のシークやダウンロードの再開ができる
+	// 添付ファイルの内容はIDごとに変わらないため、IDから強いETagを作る
+	// 審査の状態や権限を毎回確認するため、キャッシュした場合も再検証させる
+	w.Header().Set("ETag", attachmentETag(a))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeContent(w, r, a.Filename, a.CreatedAt, f)
+}
+
+// attachmentContentType ファイル名から添付ファイルのContent-Typeを決める
+func attachmentContentType(filename, declared string) string {
+	if t := mime.TypeByExtension(path.Ext(filename)); t != "" {
+		return t
+	}
+	if _, _, err := mime.ParseMediaType(declared); err == nil && declared != "" {
+		return declared
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttachmentRange(t *testing.T) {
+	defer func(b BlobStore, s AttachmentStore) { blobs, attachments = b, s }(blobs, attachments)
+	attachments = newMemoryAttachmentStore()
+	var err error
+	if blobs, err = newFileBlobStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("0123456789", 300)
+	a := &Attachment{ID: randomID(), UserID: "owner", Filename: "voice.txt", ContentType: "text/plain", Size: int64(len(content)), CreatedAt: time.Now()}
+	if _, err := blobs.Put(a.ID, strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := attachments.Create(a); err != nil {
+		t.Fatal(err)
+	}
+	handler := withCompression(http.HandlerFunc(attachmentHandler))
+	user := &sessionUser{uniqueID: "viewer"}
+	get := func(header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", a.URL(), nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r.WithContext(withUser(r.Context(), user)))
+		return w
+	}
+
+	full := get(nil)
+	if full.Code != http.StatusOK || full.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("範囲指定に対応していることを知らせるべきです: %d %v", full.Code, full.Header())
+	}
+	if full.Header().Get("Content-Encoding") != "" || full.Body.String() != content {
+		t.Error("範囲指定に対応するレスポンスは圧縮しないべきです")
+	}
+	etag := full.Header().Get("ETag")
+
+	w := get(map[string]string{"Range": "bytes=10-19"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "0123456789" {
+		t.Errorf("指定された範囲を206で返すべきです: %d %q", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 10-19/3000" {
+		t.Errorf("Content-Rangeが一致しません: %s", got)
+	}
+	if w := get(map[string]string{"Range": "bytes=2990-", "If-Range": etag}); w.Code != http.StatusPartialContent || w.Body.Len() != 10 {
+		t.Errorf("ETagが一致する場合は続きから返すべきです: %d", w.Code)
+	}
+	if w := get(map[string]string{"Range": "bytes=2990-", "If-Range": `"stale"`}); w.Code != http.StatusOK || w.Body.Len() != len(content) {
+		t.Errorf("ETagが一致しない場合は全体を返すべきです: %d", w.Code)
+	}
+	if w := get(map[string]string{"Range": "bytes=5000-"}); w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("範囲外の指定には416を返すべきです: %d", w.Code)
+	}
+}
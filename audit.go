@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var auditLogPath = flag.String("audit-log", "", "監査ログを追記するファイル (空の場合はメモリ上にのみ保持)")
+
+// 監査ログに記録する操作
+const (
+	auditLogin          = "login"
+	auditLogout         = "logout"
+	auditAuthFailed     = "auth_failed"
+	auditLockout        = "lockout"
+	auditAccountDeleted = "account_deleted"
+	auditBan            = "ban"
+	auditAdminAction    = "admin_action"
+	auditConfigReload   = "config_reload"
+	auditUploadRejected = "upload_rejected"
+	auditIPBlocked      = "ip_blocked"
+)
+
+// AuditEntry 監査ログの1件の記録
+type AuditEntry struct {
+	ID        int64             `json:"id"`
+	Time      time.Time         `json:"time"`
+	Action    string            `json:"action"`
+	UserID    string            `json:"user_id,omitempty"`
+	Target    string            `json:"target,omitempty"`
+	IP        string            `json:"ip,omitempty"`
+	Country   string            `json:"country,omitempty"`
+	ASN       uint              `json:"asn,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// AuditQuery 監査ログの検索条件。空の項目は条件に含めない
+type AuditQuery struct {
+	UserID string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+func (q AuditQuery) match(e *AuditEntry) bool {
+	return (q.UserID == "" || e.UserID == q.UserID || e.Target == q.UserID) &&
+		(q.Action == "" || e.Action == q.Action) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+// AuditStore 追記のみ可能な監査ログの保存先
+type AuditStore interface {
+	Append(e *AuditEntry) error
+	// Query 条件に一致する記録を新しい順に返す
+	Query(q AuditQuery) ([]*AuditEntry, error)
+}
+
+// memoryAuditStore メモリ上に監査ログを保持するAuditStore
+// outが指定されている場合は各記録をJSON Linesとして追記する
+type memoryAuditStore struct {
+	mu      sync.RWMutex
+	entries []*AuditEntry
+	out     io.Writer
+}
+
+func newMemoryAuditStore(out io.Writer) *memoryAuditStore {
+	return &memoryAuditStore{out: out}
+}
+
+// openAuditStore フラグの設定に従ってAuditStoreを生成する
+// ファイルに記録済みの監査ログは再起動後も検索できるように読み込む
+func openAuditStore(path string) (AuditStore, error) {
+	if path == "" {
+		return newMemoryAuditStore(nil), nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := newMemoryAuditStore(f)
+	if err := s.load(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load JSON Linesとして記録された監査ログを読み込む
+// 書き込み中に終了して壊れた行は読み飛ばし、次の記録が同じ行に続かないように改行を追記する
+func (s *memoryAuditStore) load(r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var e AuditEntry
+			if jsonErr := json.Unmarshal(line, &e); jsonErr != nil {
+				log.Println("監査ログの壊れた行を読み飛ばしました:", jsonErr)
+			} else {
+				e.ID = int64(len(s.entries) + 1)
+				s.entries = append(s.entries, &e)
+			}
+		}
+		if err == io.EOF {
+			if len(line) > 0 {
+				_, err = io.WriteString(s.out, "\n")
+				return err
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *memoryAuditStore) Append(e *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.ID = int64(len(s.entries) + 1)
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	stored := *e
+	s.entries = append(s.entries, &stored)
+	if s.out != nil {
+		return json.NewEncoder(s.out).Encode(e)
+	}
+	return nil
+}
+
+func (s *memoryAuditStore) Query(q AuditQuery) ([]*AuditEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []*AuditEntry
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		if q.Limit > 0 && len(list) >= q.Limit {
+			break
+		}
+		if e := s.entries[i]; q.match(e) {
+			copied := *e
+			list = append(list, &copied)
+		}
+	}
+	return list, nil
+}
+
+// recordAudit 監査ログに記録する。記録に失敗した場合はログに出力する
+// IPアドレスが記録されている場合は国とASNを付けて記録する
+func recordAudit(e *AuditEntry) {
+	if e.IP != "" && e.Country == "" && e.ASN == 0 {
+		info := geo.Lookup(e.IP)
+		e.Country, e.ASN = info.Country, info.ASN
+	}
+	if err := auditLog.Append(e); err != nil {
+		log.Println("監査ログの記録に失敗しました:", e.Action, "-", err)
+	}
+}
+
+// auditRequest HTTPリクエストの情報を付けて監査ログに記録する
+func auditRequest(r *http.Request, action, userID, target string, details map[string]string) {
+	recordAudit(&AuditEntry{
+		Action:    action,
+		UserID:    userID,
+		Target:    target,
+		IP:        clientIP(r),
+		RequestID: requestIDFromContext(r.Context()),
+		Details:   details,
+	})
+}
+
+// auditQueryHandler 監査ログを検索する管理者用API
+// GET /api/admin/audit?user=&action=&since=&until=&limit=
+func auditQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	q := AuditQuery{
+		UserID: r.FormValue("user"),
+		Action: r.FormValue("action"),
+		Limit:  100,
+	}
+	var err error
+	if v := r.FormValue("since"); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			writeJSONError(w, r, "sinceの形式が不正です", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("until"); v != "" {
+		if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			writeJSONError(w, r, "untilの形式が不正です", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit <= 0 {
+			writeJSONError(w, r, "limitの形式が不正です", http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := auditLog.Query(q)
+	if err != nil {
+		requestLogger(r).Println("監査ログの検索に失敗しました:", err)
+		writeJSONError(w, r, "監査ログの検索に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
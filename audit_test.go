@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryAuditStore(t *testing.T) {
+	var buf bytes.Buffer
+	store := newMemoryAuditStore(&buf)
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.Append(&AuditEntry{Time: base, Action: auditLogin, UserID: "abc"})
+	store.Append(&AuditEntry{Time: base.Add(time.Hour), Action: auditLogout, UserID: "abc"})
+	store.Append(&AuditEntry{Time: base.Add(2 * time.Hour), Action: auditLogin, UserID: "def"})
+
+	entries, _ := store.Query(AuditQuery{Action: auditLogin})
+	if len(entries) != 2 || entries[0].UserID != "def" {
+		t.Errorf("Queryは条件に一致する記録を新しい順に返すべきです: %v", entries)
+	}
+	entries, _ = store.Query(AuditQuery{UserID: "abc", Since: base.Add(time.Minute)})
+	if len(entries) != 1 || entries[0].Action != auditLogout {
+		t.Errorf("Queryがユーザーと期間で絞り込まれていません: %v", entries)
+	}
+	if n := bytes.Count(buf.Bytes(), []byte("\n")); n != 3 {
+		t.Errorf("各記録が1行ずつ追記されるべきですが%d行でした", n)
+	}
+}
+
+func TestOpenAuditStoreLoadsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	store, err := openAuditStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Append(&AuditEntry{Action: auditLogin, UserID: "abc"})
+	store.Append(&AuditEntry{Action: auditBan, UserID: "def"})
+	store.(*memoryAuditStore).out.(*os.File).Close()
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString("{\"action\":\"log")
+	f.Close()
+
+	reopened, err := openAuditStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := reopened.Query(AuditQuery{})
+	if len(entries) != 2 || entries[0].Action != auditBan || entries[1].UserID != "abc" {
+		t.Errorf("再起動前の監査ログを読み込むべきです: %v", entries)
+	}
+	reopened.Append(&AuditEntry{Action: auditLogout, UserID: "abc"})
+	if entries, _ := reopened.Query(AuditQuery{Limit: 1}); entries[0].ID != 3 {
+		t.Errorf("読み込んだ記録に続く番号を付けるべきです: %v", entries[0])
+	}
+	reopened.(*memoryAuditStore).out.(*os.File).Close()
+	if again, err := openAuditStore(path); err != nil {
+		t.Fatal(err)
+	} else if entries, _ := again.Query(AuditQuery{}); len(entries) != 3 {
+		t.Errorf("壊れた行の後に追記した記録も読み込むべきです: %v", entries)
+	} else {
+		again.(*memoryAuditStore).out.(*os.File).Close()
+	}
+}
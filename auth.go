@@ -1,14 +1,14 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"strings"
 
-	"github.com/stretchr/gomniauth"
 	"github.com/stretchr/objx"
 )
 
@@ -17,6 +17,7 @@ import gomniauthcommon "github.com/stretchr/gomniauth/common"
 // ChatUser Avatarの実装に必要な情報を保持
 type ChatUser interface {
 	UniqueID() string
+	Name() string
 	AvatarURL() string
 }
 
@@ -37,6 +38,37 @@ type authHandler struct {
 }
 
 func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if blockedIP(w, r, nil) {
+		return
+	}
+	if token, ok := bearerToken(r); ok {
+		// Bearerトークンによる認証
+		if wait, locked := loginLimits.check(ipKey(r)); locked {
+			tooManyAttempts(w, r, wait)
+			return
+		}
+		user, err := tokenAuth.Authenticate(token)
+		if err != nil {
+			loginLimits.fail(ipKey(r))
+			auditRequest(r, auditAuthFailed, "", "", map[string]string{"method": "bearer"})
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			httpError(w, r, "トークンが無効です", http.StatusUnauthorized)
+			return
+		}
+		loginLimits.succeed(ipKey(r))
+		if isBanned(user.UniqueID()) {
+			httpError(w, r, "このアカウントは利用停止されています", http.StatusForbidden)
+			return
+		}
+		if scoped, ok := user.(interface{ Allows(*http.Request) bool }); ok && !scoped.Allows(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+			httpError(w, r, "トークンの権限が不足しています", http.StatusForbidden)
+			return
+		}
+		recordActivity(user.UniqueID(), "", 0)
+		h.next.ServeHTTP(w, r.WithContext(withUser(r.Context(), user)))
+		return
+	}
 	if cookie, err := r.Cookie("auth"); err == http.ErrNoCookie || cookie.Value == "" {
 		// 未認証
 		w.Header().Set("Location", "/login")
@@ -44,72 +76,399 @@ func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else if err != nil {
 		// 何らかの別のエラーが発生
 		panic(err.Error())
+	} else if user, err := userFromCookie(cookie); err != nil {
+		// Cookieが壊れているため再ログインさせる
+		requestLogger(r).Println("認証用のCookieを解析できませんでした:", err)
+		w.Header().Set("Location", "/login")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	} else if _, err := sessions.Get(user.sessionID); err != nil {
+		// セッションが失効している
+		w.Header().Set("Location", "/login")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	} else if isBanned(user.UniqueID()) {
+		httpError(w, r, "このアカウントは利用停止されています", http.StatusForbidden)
 	} else {
-		// 成功。ラップされたハンドラを呼び出す
-		h.next.ServeHTTP(w, r)
+		// 成功。ユーザーをコンテキストに格納してラップされたハンドラを呼び出す
+		renewAuthCookie(w, r, cookie)
+		recordActivity(user.UniqueID(), "", 0)
+		h.next.ServeHTTP(w, r.WithContext(withUser(r.Context(), user)))
+	}
+}
+
+// ErrInvalidAuthCookie 認証用のCookieの内容が不正な場合に発生するエラー
+var ErrInvalidAuthCookie = errors.New("chat: 認証用のCookieが不正です。")
+
+// sessionUser 認証用のCookieから復元したユーザー
+type sessionUser struct {
+	uniqueID  string
+	name      string
+	avatarURL string
+	sessionID string
+}
+
+func (u sessionUser) UniqueID() string  { return u.uniqueID }
+func (u sessionUser) Name() string      { return u.name }
+func (u sessionUser) AvatarURL() string { return u.avatarURL }
+
+// setAuthCookie 署名した認証用のCookieを設定する
+func setAuthCookie(w http.ResponseWriter, r *http.Request, value string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth",
+		Value:    signCookieValue(value),
+		Path:     "/",
+		Secure:   isSecureRequest(r),
+		HttpOnly: true,
+		// 他のサイトから送信されたフォームにはCookieを付けない
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// csrfToken フォームに埋め込むCSRF対策のトークンを返す。ユーザーとセッションごとに異なる
+func csrfToken(user ChatUser) string {
+	return signing.Sign(csrfTokenValue(user))
+}
+
+// validCSRFToken フォームで送信されたトークンがユーザーとセッションに対応しているかどうかを判定する
+func validCSRFToken(user ChatUser, token string) bool {
+	if token == "" {
+		return false
+	}
+	_, err := signing.Verify(csrfTokenValue(user), token)
+	return err == nil
+}
+
+func csrfTokenValue(user ChatUser) string {
+	sessionID := ""
+	if u, ok := user.(sessionUser); ok {
+		sessionID = u.sessionID
+	}
+	return "csrf:" + user.UniqueID() + ":" + sessionID
+}
+
+// renewAuthCookie 以前の鍵で署名されたCookieを現在の鍵で署名し直す
+func renewAuthCookie(w http.ResponseWriter, r *http.Request, cookie *http.Cookie) {
+	if value, renew, err := verifyCookieValue(cookie.Value); err == nil && renew {
+		setAuthCookie(w, r, value)
+	}
+}
+
+// userFromCookie 認証用のCookieの署名を検証し、ユーザーを復元する
+func userFromCookie(cookie *http.Cookie) (sessionUser, error) {
+	value, _, err := verifyCookieValue(cookie.Value)
+	if err != nil {
+		return sessionUser{}, ErrInvalidAuthCookie
+	}
+	data, err := objx.FromBase64(value)
+	if err != nil {
+		return sessionUser{}, err
+	}
+	user := sessionUser{
+		uniqueID:  data.Get("userid").Str(),
+		name:      data.Get("name").Str(),
+		avatarURL: data.Get("avatar_url").Str(),
+		sessionID: data.Get("session_id").Str(),
+	}
+	if user.uniqueID == "" || user.sessionID == "" {
+		return sessionUser{}, ErrInvalidAuthCookie
+	}
+	return user, nil
+}
+
+// userData テンプレートやクライアントに渡すユーザー情報を生成する
+func userData(user ChatUser) map[string]interface{} {
+	avatarURL, err := avatars.GetAvatarURL(user)
+	if err != nil {
+		avatarURL = user.AvatarURL()
+	}
+	return map[string]interface{}{
+		"userid":     user.UniqueID(),
+		"name":       user.Name(),
+		"avatar_url": avatarURL,
 	}
 }
 
 // MustAuth 認証を確認するためにハンドラの調整をする
+// 認証用のCookieに加えて Authorization: Bearer ヘッダーのトークンを受け付ける
 func MustAuth(handler http.Handler) http.Handler {
 	return &authHandler{next: handler}
 }
 
+// isBanned ユーザーが利用停止されているかどうかを判定する
+func isBanned(userID string) bool {
+	record, err := users.GetByID(userID)
+	return err == nil && record.Banned
+}
+
+const userKey contextKey = "user"
+
+// withUser 認証済みのユーザーをコンテキストに格納する
+func withUser(ctx context.Context, user ChatUser) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// userFromContext コンテキストに格納された認証済みのユーザーを返す
+func userFromContext(ctx context.Context) (ChatUser, bool) {
+	user, ok := ctx.Value(userKey).(ChatUser)
+	return user, ok
+}
+
 func loginHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	if blockedIP(w, r, nil) {
+		return
+	}
 	segs := strings.Split(r.URL.Path, "/")
+	if len(segs) < 4 {
+		httpError(w, r, "認証プロバイダーが指定されていません", http.StatusNotFound)
+		return
+	}
 	action := segs[2]
 	provider := segs[3]
 
+	if wait, locked := loginLimits.check(ipKey(r)); locked {
+		tooManyAttempts(w, r, wait)
+		return
+	}
+
 	switch action {
 
 	case "login":
-		provider, err := gomniauth.Provider(provider)
+		provider, err := oauthLogins.get(requestScheme(r), requestHost(r), provider)
+		if errors.Is(err, ErrCallbackHost) {
+			httpError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
-			log.Fatalln("認証プロバイダーの取得に失敗しました:", provider, "-", err)
+			logger.Println("認証プロバイダーの取得に失敗しました:", provider, "-", err)
+			httpError(w, r, "認証プロバイダーの取得に失敗しました", http.StatusBadRequest)
+			return
 		}
 		loginURL, err := provider.GetBeginAuthURL(nil, nil)
 		if err != nil {
-			log.Fatalln("GetBeginAuthURLの呼び出し中にエラーが発生しました:", provider, "-", err)
+			logger.Println("GetBeginAuthURLの呼び出し中にエラーが発生しました:", provider, "-", err)
+			reportRequestError(r, err)
+			httpError(w, r, "ログインを開始できませんでした", http.StatusInternalServerError)
+			return
 		}
 		w.Header().Set("Location", loginURL)
 		w.WriteHeader(http.StatusTemporaryRedirect)
 
 	case "callback":
-		provider, err := gomniauth.Provider(provider)
+		// ログインを開始したときと同じホストに戻ってくるため、同じコールバックのURLで認証を完了する
+		provider, err := oauthLogins.get(requestScheme(r), requestHost(r), provider)
+		if errors.Is(err, ErrCallbackHost) {
+			httpError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
-			log.Fatalln("認証プロバイダーの取得に失敗しました", provider, "-", err)
+			logger.Println("認証プロバイダーの取得に失敗しました", provider, "-", err)
+			httpError(w, r, "認証プロバイダーの取得に失敗しました", http.StatusBadRequest)
+			return
 		}
 		creds, err := provider.CompleteAuth(objx.MustFromURLQuery(r.URL.RawQuery))
 		if err != nil {
-			log.Fatalln("認証を完了できませんでした", provider, "-", err)
+			loginLimits.fail(ipKey(r))
+			auditRequest(r, auditAuthFailed, "", "", map[string]string{"provider": provider.Name()})
+			logger.Println("認証を完了できませんでした", provider, "-", err)
+			httpError(w, r, "認証を完了できませんでした", http.StatusUnauthorized)
+			return
 		}
 		user, err := provider.GetUser(creds)
 		if err != nil {
-			log.Fatalln("ユーザーの取得に失敗しました", provider, "-", err)
+			logger.Println("ユーザーの取得に失敗しました", provider, "-", err)
+			reportRequestError(r, err)
+			httpError(w, r, "ユーザーの取得に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		if linking, ok := linkIntent(w, r); ok {
+			completeLink(w, r, linking, provider.Name(), user)
+			return
+		}
+		// 新規登録の前に、必要であればCAPTCHAを求める
+		newSignup := captcha.enabled() && isNewSignup(provider.Name(), user)
+		if newSignup && captcha.needed(r) {
+			captcha.challenge(w, "/auth/login/"+provider.Name())
+			return
+		}
+		record, err := saveLoginUser(provider.Name(), user)
+		if err != nil {
+			logger.Println("ユーザーの保存に失敗しました", provider, "-", err)
+			reportRequestError(r, err)
+			httpError(w, r, "ユーザーの保存に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		if newSignup {
+			captcha.signedUp(w, r)
+		}
+		if wait, locked := loginLimits.check(accountKey(record.ID)); locked {
+			tooManyAttempts(w, r, wait)
+			return
+		}
+		if record.Banned {
+			loginLimits.fail(ipKey(r), accountKey(record.ID))
+			auditRequest(r, auditAuthFailed, record.ID, "", map[string]string{"reason": "banned"})
+			httpError(w, r, "このアカウントは利用停止されています", http.StatusForbidden)
+			return
 		}
-		chatUser := &chatUser{User: user}
-		m := md5.New()
-		io.WriteString(m, strings.ToLower(user.Name()))
-		chatUser.uniqueID = fmt.Sprintf("%x", m.Sum(nil))
+		// トークンを保存できなくてもログインは続ける
+		if err := saveLoginToken(record.ID, provider.Name(), creds); err != nil {
+			logger.Println("認証プロバイダーのトークンの保存に失敗しました", provider, "-", err)
+			reportRequestError(r, err)
+		}
+		chatUser := &chatUser{User: user, uniqueID: record.ID}
 		avatarURL, err := avatars.GetAvatarURL(chatUser)
 		if err != nil {
-			log.Fatalln("GetAvatarURLに失敗しました", "-", err)
-		}
-		// データを保存
-		authCookieValue := objx.New(map[string]interface{}{
-			"userid":     chatUser.uniqueID,
-			"name":       user.Name(),
-			"avatar_url": avatarURL,
-		}).MustBase64()
-		http.SetCookie(w, &http.Cookie{
-			Name:  "auth",
-			Value: authCookieValue,
-			Path:  "/"})
-		w.Header()["Location"] = []string{"/chat"}
-		w.WriteHeader(http.StatusTemporaryRedirect)
+			logger.Println("GetAvatarURLに失敗しました", "-", err)
+			reportRequestError(r, err)
+			httpError(w, r, "アバターの取得に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		if record.TOTPEnabled {
+			// 二要素認証の確認画面へ
+			beginSecondFactor(w, r, record.ID, avatarURL, provider.Name())
+			return
+		}
+		completeLogin(w, r, record.ID, avatarURL, provider.Name())
 
 	default:
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "アクション%sには非対応です", action)
+		httpError(w, r, fmt.Sprintf("アクション%sには非対応です", action), http.StatusNotFound)
+	}
+}
+
+// completeLogin セッションを作成して認証用のCookieを発行し、チャット画面へリダイレクトする
+func completeLogin(w http.ResponseWriter, r *http.Request, userID, avatarURL, method string) {
+	if err := issueSession(w, r, userID, avatarURL, method); err != nil {
+		if errors.Is(err, ErrRejectedByHook) {
+			httpError(w, r, err.Error(), http.StatusForbidden)
+			return
+		}
+		requestLogger(r).Println("セッションの作成に失敗しました", userID, "-", err)
+		reportRequestError(r, err)
+		httpError(w, r, "セッションの作成に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	w.Header()["Location"] = []string{"/chat"}
+	w.WriteHeader(http.StatusTemporaryRedirect)
+}
+
+// issueSession セッションを作成して認証用のCookieを発行する
+func issueSession(w http.ResponseWriter, r *http.Request, userID, avatarURL, method string) error {
+	record, err := users.GetByID(userID)
+	if err != nil {
+		return err
 	}
+	if err := runAuthHooks(record, method); err != nil {
+		auditRequest(r, auditAuthFailed, record.ID, "", map[string]string{"reason": "hook"})
+		return err
+	}
+	session := &Session{
+		ID:         randomID(),
+		UserID:     record.ID,
+		UserAgent:  r.UserAgent(),
+		RemoteAddr: clientIP(r),
+	}
+	info := geo.Lookup(session.RemoteAddr)
+	session.Country, session.ASN = info.Country, info.ASN
+	if err := sessions.Create(session); err != nil {
+		return err
+	}
+	loginLimits.succeed(ipKey(r), accountKey(record.ID))
+	device := deviceID(w, r)
+	var unfamiliar []string
+	if *loginAlerts {
+		// 今回のログインを記録する前に過去のログインと比べる
+		unfamiliar = unfamiliarLogin(record.ID, device, session.RemoteAddr, session.Country)
+	}
+	auditRequest(r, auditLogin, record.ID, "", map[string]string{"method": method, "session_id": session.ID, "device": device})
+	if len(unfamiliar) > 0 {
+		go sendLoginAlert(record, session, unfamiliar, notMeLink(r, record.ID, session.ID))
+	}
+	// データを保存
+	authCookieValue := objx.New(map[string]interface{}{
+		"userid":     record.ID,
+		"name":       record.Name,
+		"avatar_url": avatarURL,
+		"session_id": session.ID,
+	}).MustBase64()
+	setAuthCookie(w, r, authCookieValue)
+	return nil
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie("auth"); err == nil {
+		if user, err := userFromCookie(cookie); err == nil {
+			sessions.Delete(user.sessionID)
+			auditRequest(r, auditLogout, user.UniqueID(), "", map[string]string{"session_id": user.sessionID})
+		}
+	}
+	clearAuthCookie(w)
+	w.Header()["Location"] = []string{"/chat"}
+	w.WriteHeader(http.StatusTemporaryRedirect)
+}
+
+// clearAuthCookie 認証用のCookieを削除する
+func clearAuthCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   "auth",
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+// saveLoginUser OAuthでログインしたユーザーをユーザーストアに保存する
+// 初回ログインの場合は新しく作成し、2回目以降はプロフィールを更新する
+func saveLoginUser(provider string, user gomniauthcommon.User) (*UserRecord, error) {
+	providerID := user.IDForProvider(provider)
+	record, err := users.GetByProviderID(provider, providerID)
+	if err == ErrUserNotFound {
+		// 確認済みのメールアドレスが一致するユーザーがいれば、別人として作成せずに連携する
+		if existing, findErr := findUserByVerifiedEmail(verifiedEmail(provider, user)); findErr == nil {
+			if err := linkIdentity(existing, provider, user); err != nil {
+				return nil, err
+			}
+			recordAudit(&AuditEntry{Action: auditAdminAction, UserID: existing.ID, Target: existing.ID,
+				Details: map[string]string{"action": "identity_linked", "provider": provider, "method": "verified_email"}})
+			return existing, nil
+		}
+	}
+	switch {
+	case err == nil && record.Provider != provider:
+		// 連携したアカウントでのログインではプロフィールを更新しない
+		return record, nil
+	case err == nil:
+		if name, err := validateDisplayName(user.Name(), false); err == nil && !record.CustomName {
+			record.Name = name
+		}
+		record.Email = user.Email()
+		record.EmailVerified = verifiedEmail(provider, user) != ""
+		record.AvatarURL = user.AvatarURL()
+		promoteAdmin(record)
+		return record, users.Update(record)
+	case err == ErrUserNotFound:
+		record = &UserRecord{
+			ID:            uniqueIDFor(user.Name()),
+			Name:          registrationName(user.Name()),
+			Email:         user.Email(),
+			EmailVerified: verifiedEmail(provider, user) != "",
+			AvatarURL:     user.AvatarURL(),
+			Provider:      provider,
+			ProviderID:    providerID,
+		}
+		promoteAdmin(record)
+		if _, err := users.GetByID(record.ID); err == nil {
+			// 同名の別ユーザーが既に存在する
+			record.ID = randomID()
+		}
+		return record, users.Create(record)
+	default:
+		return nil, err
+	}
+}
+
+// uniqueIDFor 名前からユーザーのIDを生成する
+func uniqueIDFor(name string) string {
+	m := md5.New()
+	io.WriteString(m, strings.ToLower(name))
+	return fmt.Sprintf("%x", m.Sum(nil))
 }
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// maxAutoRulesPerRoom 1つのルームに登録できる自動応答のルールの最大数
+const maxAutoRulesPerRoom = 50
+
+var (
+	autoRuleWorkers = flag.Int("auto-rule-workers", 4, "自動応答の返信やwebhookの送信を行うワーカーの数")
+	autoRuleQueue   = flag.Int("auto-rule-queue", 1000, "自動応答を待つメッセージの最大数 (超えた分のメッセージには自動応答しない)")
+)
+
+var (
+	// ErrAutoRuleNotFound 指定された自動応答のルールが存在しない場合に発生するエラー
+	ErrAutoRuleNotFound = errors.New("chat: 自動応答のルールが見つかりません。")
+	// ErrInvalidAutoRule 自動応答のルールの指定が不正な場合に発生するエラー
+	ErrInvalidAutoRule = errors.New("chat: 自動応答のルールには正規表現かキーワードのどちらかと、返信(2000文字以内)かHTTPSのwebhookのどちらかを指定してください。")
+	// ErrAutoRuleLimit ルームの自動応答のルールの数が上限に達している場合に発生するエラー
+	ErrAutoRuleLimit = errors.New("chat: 自動応答のルールの数が上限に達しています。")
+	// ErrAutoRuleDestination webhookの送信先が内部のアドレスの場合に発生するエラー
+	ErrAutoRuleDestination = errors.New("chat: 内部のアドレスにはwebhookを送信できません。")
+)
+
+// AutoRule ルームに投稿されたメッセージに自動で応答するルール
+// PatternかKeywordに一致したメッセージに対して、Replyを返信するか、Webhookにメッセージを送信する
+type AutoRule struct {
+	ID   string `json:"id"`
+	Room string `json:"room"`
+	// Patternは本文に一致させる正規表現。大文字と小文字は区別しない
+	Pattern string `json:"pattern,omitempty"`
+	// Keywordは本文に含まれていれば一致とする言葉。大文字と小文字は区別しない
+	Keyword string `json:"keyword,omitempty"`
+	// Replyはルームに投稿する返信。{name}は投稿したユーザーの名前に置き換える
+	Reply string `json:"reply,omitempty"`
+	// Webhookは一致したメッセージを署名付きでPOSTするURL
+	Webhook   string    `json:"webhook,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+
+	re *regexp.Regexp
+}
+
+// compile ルールを検証し、正規表現を準備する
+func (rule *AutoRule) compile() error {
+	if (rule.Pattern == "") == (rule.Keyword == "") || (rule.Reply == "") == (rule.Webhook == "") {
+		return ErrInvalidAutoRule
+	}
+	if utf8.RuneCountInString(rule.Reply) > 2000 {
+		return ErrInvalidAutoRule
+	}
+	if rule.Webhook != "" {
+		u, err := url.Parse(rule.Webhook)
+		if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+			return ErrInvalidAutoRule
+		}
+		// 名前で指定された送信先は接続するときに確認する
+		if ip := net.ParseIP(u.Hostname()); (ip != nil && !publicIP(ip)) || strings.EqualFold(u.Hostname(), "localhost") {
+			return ErrAutoRuleDestination
+		}
+	}
+	pattern := rule.Pattern
+	if rule.Keyword != "" {
+		pattern = regexp.QuoteMeta(rule.Keyword)
+	}
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return ErrInvalidAutoRule
+	}
+	rule.re = re
+	return nil
+}
+
+// matches メッセージがルールに一致するかどうか
+func (rule *AutoRule) matches(text string) bool {
+	return rule.re != nil && rule.re.MatchString(text)
+}
+
+// AutoRuleStore 自動応答のルールを保存する
+type AutoRuleStore interface {
+	// List ルームのルールを作成順に返す
+	List(room string) ([]*AutoRule, error)
+	Save(rule *AutoRule) error
+	Delete(room, id string) error
+}
+
+// memoryAutoRuleStore メモリ上に自動応答のルールを保持するAutoRuleStore
+type memoryAutoRuleStore struct {
+	mu    sync.RWMutex
+	rules map[string]map[string]*AutoRule
+}
+
+func newMemoryAutoRuleStore() *memoryAutoRuleStore {
+	return &memoryAutoRuleStore{rules: make(map[string]map[string]*AutoRule)}
+}
+
+func (s *memoryAutoRuleStore) List(room string) ([]*AutoRule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := []*AutoRule{}
+	for _, rule := range s.rules[room] {
+		copied := *rule
+		list = append(list, &copied)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list, nil
+}
+
+func (s *memoryAutoRuleStore) Save(rule *AutoRule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rules[rule.Room] == nil {
+		s.rules[rule.Room] = make(map[string]*AutoRule)
+	}
+	copied := *rule
+	s.rules[rule.Room][rule.ID] = &copied
+	return nil
+}
+
+func (s *memoryAutoRuleStore) Delete(room, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rules[room][id]; !ok {
+		return ErrAutoRuleNotFound
+	}
+	delete(s.rules[room], id)
+	return nil
+}
+
+// publicIP インターネット上のアドレスかどうか
+// ループバック、プライベート、リンクローカルなど内部のネットワークのアドレスは含まない
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// publicDialer 内部のアドレスには接続しないDialer
+// 名前解決の後のアドレスを確認するため、DNSやリダイレクトで内部のアドレスに誘導されても接続しない
+var publicDialer = &net.Dialer{
+	Timeout: 10 * time.Second,
+	Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+			return ErrAutoRuleDestination
+		}
+		return nil
+	},
+}
+
+// autoRuleHTTPClient 自動応答のwebhookの送信に使用するHTTPクライアント
+// ルームのオーナーが送信先を指定できるため、内部のアドレスには送信しない
+var autoRuleHTTPClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: &http.Transport{DialContext: publicDialer.DialContext, TLSHandshakeTimeout: 10 * time.Second},
+}
+
+// autoRuleWebhook 自動応答のwebhookに送信する本文
+type autoRuleWebhook struct {
+	Rule    string   `json:"rule"`
+	Room    string   `json:"room"`
+	Message *message `json:"message"`
+}
+
+// postAutoRuleWebhook 一致したメッセージをwebhookに送信する
+func postAutoRuleWebhook(rule *AutoRule, msg *message) error {
+	data, err := json.Marshal(&autoRuleWebhook{Rule: rule.ID, Room: msg.Room, Message: msg})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, rule.Webhook, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signWebhook(req, data)
+	res, err := autoRuleHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("chat: 自動応答のwebhookがエラーを返しました: %s", res.Status)
+	}
+	return nil
+}
+
+// autoRespond メッセージにルームのルールを適用する
+// 返信は最初に一致したルールの1件だけを投稿し、webhookは一致したすべてのルールに送信する
+// 自動応答の返信にはAutoを付け、他のルールを起動しないようにする
+func autoRespond(rooms *roomRegistry, msg *message) {
+	if msg.Type != typeChat || msg.Auto || msg.UserID == "" {
+		return
+	}
+	rules, err := autoRules.List(msg.Room)
+	if err != nil {
+		log.Println("自動応答のルールの取得に失敗しました:", err)
+		return
+	}
+	replied := false
+	for _, rule := range rules {
+		if (rule.re == nil && rule.compile() != nil) || !rule.matches(msg.Message) {
+			continue
+		}
+		if rule.Webhook != "" {
+			if err := postAutoRuleWebhook(rule, msg); err != nil {
+				log.Println("自動応答のwebhookの送信に失敗しました:", err)
+			}
+			continue
+		}
+		if replied {
+			continue
+		}
+		replied = true
+		rm, err := rooms.existing(msg.Room)
+		if err != nil {
+			continue
+		}
+		rm.Broadcast(&message{
+			Type:    typeChat,
+			ID:      randomID(),
+			Room:    msg.Room,
+			Name:    systemName,
+			Message: strings.ReplaceAll(rule.Reply, "{name}", msg.Name),
+			When:    time.Now(),
+			Ref:     msg.ID,
+			Auto:    true,
+		})
+	}
+}
+
+// subscribeAutoResponder 配信されたメッセージに自動応答のルールを適用する
+// Publishはroom.runのゴルーチンから呼び出されるため、返信やwebhookの送信は決まった数のワーカーで行う
+// 待ち行列が一杯の場合は、ルームの処理を止めないようにそのメッセージには自動応答しない
+func subscribeAutoResponder(bus *eventBus, rooms *roomRegistry) {
+	queue := make(chan *message, *autoRuleQueue)
+	workers := *autoRuleWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case msg := <-queue:
+					autoRespond(rooms, msg)
+				case <-rooms.ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	bus.Subscribe(EventMessageBroadcast, func(e Event) {
+		if e.Message == nil || e.Message.Type != typeChat || e.Message.Auto {
+			return
+		}
+		select {
+		case queue <- e.Message:
+		default:
+			log.Println("自動応答の待ち行列が一杯のため、メッセージを処理しませんでした:", e.Message.Room, e.Message.ID)
+		}
+	})
+}
+
+// serveAutoRules ルームの自動応答のルールのAPI (オーナーとモデレーターのみ)
+// GET    /api/rooms/{room}/rules       ルールの一覧
+// POST   /api/rooms/{room}/rules       JSONでルールを追加する
+// DELETE /api/rooms/{room}/rules/{id}  ルールを削除する
+func (h *roomInfoHandler) serveAutoRules(w http.ResponseWriter, r *http.Request, name, id string) {
+	user, _ := userFromContext(r.Context())
+	rm, err := h.rooms.existing(name)
+	if err == ErrRoomNotFound {
+		writeJSONError(w, r, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !rm.canManage(user.UniqueID()) {
+		writeJSONError(w, r, "自動応答を設定できるのはオーナーとモデレーターだけです", http.StatusForbidden)
+		return
+	}
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		list, err := autoRules.List(name)
+		if err != nil {
+			requestLogger(r).Println("自動応答のルールの取得に失敗しました:", err)
+			writeJSONError(w, r, "自動応答のルールを取得できませんでした", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case id == "" && r.Method == http.MethodPost:
+		var rule AutoRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			writeJSONError(w, r, ErrInvalidAutoRule.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := rule.compile(); err != nil {
+			writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if list, err := autoRules.List(name); err == nil && len(list) >= maxAutoRulesPerRoom {
+			writeJSONError(w, r, ErrAutoRuleLimit.Error(), http.StatusConflict)
+			return
+		}
+		rule.ID, rule.Room, rule.CreatedBy, rule.CreatedAt = randomID(), name, user.UniqueID(), time.Now()
+		if err := autoRules.Save(&rule); err != nil {
+			requestLogger(r).Println("自動応答のルールの保存に失敗しました:", err)
+			writeJSONError(w, r, "自動応答のルールを保存できませんでした", http.StatusInternalServerError)
+			return
+		}
+		auditRequest(r, auditAdminAction, user.UniqueID(), name, map[string]string{"action": "auto_rule_create", "rule": rule.ID, "webhook": rule.Webhook})
+		writeJSON(w, http.StatusCreated, &rule)
+	case id != "" && r.Method == http.MethodDelete:
+		if err := autoRules.Delete(name, id); err != nil {
+			writeJSONError(w, r, err.Error(), http.StatusNotFound)
+			return
+		}
+		auditRequest(r, auditAdminAction, user.UniqueID(), name, map[string]string{"action": "auto_rule_delete", "rule": id})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAutoRuleCompile(t *testing.T) {
+	for _, rule := range []AutoRule{
+		{Pattern: "help", Reply: "ヘルプ"},
+		{Keyword: "障害", Webhook: "https://example.com/hook"},
+	} {
+		if err := rule.compile(); err != nil {
+			t.Errorf("正しいルールは受け付けるべきです: %+v, %v", rule, err)
+		}
+	}
+	for _, rule := range []AutoRule{
+		{Reply: "ヘルプ"},
+		{Pattern: "help", Keyword: "help", Reply: "ヘルプ"},
+		{Pattern: "help"},
+		{Pattern: "help", Reply: "ヘルプ", Webhook: "https://example.com/hook"},
+		{Keyword: "障害", Webhook: "http://example.com/hook"},
+		{Pattern: "(", Reply: "ヘルプ"},
+	} {
+		if err := rule.compile(); err != ErrInvalidAutoRule {
+			t.Errorf("不正なルールは拒否するべきです: %+v, %v", rule, err)
+		}
+	}
+	for _, hook := range []string{"https://127.0.0.1/hook", "https://10.0.0.5:8443/hook", "https://[::1]/hook", "https://169.254.169.254/latest", "https://LOCALHOST/hook"} {
+		rule := AutoRule{Keyword: "障害", Webhook: hook}
+		if err := rule.compile(); err != ErrAutoRuleDestination {
+			t.Errorf("内部のアドレスへのwebhookは拒否するべきです: %s, %v", hook, err)
+		}
+	}
+	rule := AutoRule{Keyword: "a.b", Reply: "x"}
+	rule.compile()
+	if !rule.matches("see A.B now") || rule.matches("axb") {
+		t.Error("キーワードは大文字と小文字を区別せず、そのままの文字列として一致させるべきです")
+	}
+}
+
+func TestAutoRuleWebhookRefusesInternalAddress(t *testing.T) {
+	called := false
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	defer srv.Close()
+	defer func(c *http.Client) { autoRuleHTTPClient = c }(autoRuleHTTPClient)
+	// 名前で指定した送信先が内部のアドレスに解決された場合と同じく、接続するときに拒否する
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.DialContext = publicDialer.DialContext
+	autoRuleHTTPClient = &http.Client{Transport: transport}
+
+	rule := &AutoRule{ID: "r1", Keyword: "障害", Webhook: srv.URL}
+	err := postAutoRuleWebhook(rule, &message{Type: typeChat, ID: "m1", Room: "general", Message: "障害です"})
+	if !errors.Is(err, ErrAutoRuleDestination) || called {
+		t.Errorf("内部のアドレスにはwebhookを送信しないべきです: %v", err)
+	}
+}
+
+func TestAutoRespondLoopProtection(t *testing.T) {
+	defer func(s AutoRuleStore) { autoRules = s }(autoRules)
+	autoRules = newMemoryAutoRuleStore()
+	autoRules.Save(&AutoRule{ID: "r1", Room: "general", Pattern: "ping", Reply: "ping pong", CreatedAt: time.Now()})
+
+	defer func(b *eventBus) { events = b }(events)
+	events = newEventBus()
+	received := make(chan *message, 10)
+	events.Subscribe(EventMessageBroadcast, func(e Event) { received <- e.Message })
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	subscribeAutoResponder(events, rooms)
+	rm, err := rooms.get("general")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rm.Broadcast(&message{Type: typeChat, ID: "m1", Room: "general", UserID: "u1", Name: "Alice", Message: "ping", When: time.Now()})
+	<-received
+	select {
+	case reply := <-received:
+		if !reply.Auto || reply.Message != "ping pong" || reply.Ref != "m1" {
+			t.Errorf("ルールに従って返信するべきです: %+v", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("返信が届きませんでした")
+	}
+	select {
+	case m := <-received:
+		t.Errorf("自動応答の返信はルールを起動しないべきです: %+v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+var (
+	reconnectRetryAfter = flag.Duration("reconnect-retry-after", 5*time.Second, "過負荷やドレインで切断したクライアントに再接続まで待つよう知らせる時間")
+	reconnectJitter     = flag.Duration("reconnect-jitter", 10*time.Second, "再接続が集中しないようにクライアントがretry_afterに加える乱数の最大値")
+)
+
+// backoffHint 再接続までの待ち時間の目安
+// クライアントはRetryAfterに0からJitterまでの乱数を加えた時間だけ待ってから再接続する
+type backoffHint struct {
+	RetryAfter time.Duration
+	Jitter     time.Duration
+}
+
+// defaultBackoff フラグで設定された再接続の目安
+func defaultBackoff() backoffHint {
+	return backoffHint{RetryAfter: *reconnectRetryAfter, Jitter: *reconnectJitter}
+}
+
+// closeReason クローズ理由に再接続の目安を付け加える
+// 例: "send buffer full retry_after=5 jitter=0-10"
+func (h backoffHint) closeReason(reason string) string {
+	hint := fmt.Sprintf("retry_after=%d jitter=0-%d", int(h.RetryAfter.Seconds()), int(h.Jitter.Seconds()))
+	if reason == "" {
+		return hint
+	}
+	return reason + " " + hint
+}
+
+// apply イベントに再接続の目安を設定する
+func (h backoffHint) apply(msg *message) *message {
+	msg.RetryAfter = int(h.RetryAfter.Seconds())
+	msg.RetryJitter = int(h.Jitter.Seconds())
+	return msg
+}
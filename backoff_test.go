@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffHint(t *testing.T) {
+	tests := []struct {
+		hint          backoffHint
+		reason        string
+		closeReason   string
+		after, jitter int
+	}{
+		{backoffHint{5 * time.Second, 10 * time.Second}, "too many rooms", "too many rooms retry_after=5 jitter=0-10", 5, 10},
+		{backoffHint{0, 10 * time.Second}, "", "retry_after=0 jitter=0-10", 0, 10},
+		// 秒未満は切り捨てる
+		{backoffHint{1500 * time.Millisecond, 999 * time.Millisecond}, "send buffer full", "send buffer full retry_after=1 jitter=0-0", 1, 0},
+	}
+	for _, test := range tests {
+		if got := test.hint.closeReason(test.reason); got != test.closeReason {
+			t.Errorf("%+v: %qになるべきところ%qでした", test.hint, test.closeReason, got)
+		}
+		msg := test.hint.apply(&message{Type: typeError})
+		if msg.RetryAfter != test.after || msg.RetryJitter != test.jitter {
+			t.Errorf("%+v: %d秒と0-%d秒になるべきところ%d秒と0-%d秒でした", test.hint, test.after, test.jitter, msg.RetryAfter, msg.RetryJitter)
+		}
+	}
+}
+
+func TestBackoffCloseReasonFitsControlFrame(t *testing.T) {
+	// クローズフレームの本文はステータスコードの2バイトを含めて125バイトまで
+	const maxReason = 123
+	hint := backoffHint{RetryAfter: 24 * time.Hour, Jitter: 24 * time.Hour}
+	for _, reason := range []string{"too many rooms", "too many connections", "send buffer full"} {
+		if got := hint.closeReason(reason); len(got) > maxReason {
+			t.Errorf("%q: クローズ理由が%dバイトを超えています: %d", reason, maxReason, len(got))
+		}
+	}
+}
+
+func TestDefaultBackoff(t *testing.T) {
+	defer func(after, jitter time.Duration) { *reconnectRetryAfter, *reconnectJitter = after, jitter }(*reconnectRetryAfter, *reconnectJitter)
+	*reconnectRetryAfter, *reconnectJitter = 3*time.Second, 7*time.Second
+	if got := defaultBackoff(); got.RetryAfter != 3*time.Second || got.Jitter != 7*time.Second {
+		t.Errorf("フラグの値を使うべきです: %+v", got)
+	}
+	// 過負荷のエラーにも同じ目安を付ける
+	if msg := overloadedEvent("混雑しています"); msg.RetryAfter != 3 || msg.RetryJitter != 7 {
+		t.Errorf("過負荷のエラーに再接続の目安を付けるべきです: %d, %d", msg.RetryAfter, msg.RetryJitter)
+	}
+	// クライアントから送られた目安は配信しない
+	msg := &message{RetryAfter: 3, RetryJitter: 7}
+	msg.resetServerFields()
+	if msg.RetryAfter != 0 || msg.RetryJitter != 0 {
+		t.Errorf("クライアントが設定した再接続の目安は取り除くべきです: %d, %d", msg.RetryAfter, msg.RetryJitter)
+	}
+}
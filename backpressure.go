@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+
+	"github.com/gorilla/websocket"
+)
+
+// 送信バッファが一杯になったクライアントへの対応
+const (
+	// backpressureDisconnect 直ちに切断する (既定)
+	backpressureDisconnect = "disconnect"
+	// backpressureDropNewest 新しいイベントを破棄する
+	backpressureDropNewest = "drop-newest"
+	// backpressureDropOldest バッファ内の最も古いイベントを破棄して新しいイベントを入れる
+	backpressureDropOldest = "drop-oldest"
+	// backpressureDisconnectAfterN 新しいイベントを破棄し、破棄した数が上限に達したら切断する
+	backpressureDisconnectAfterN = "disconnect-after-n"
+)
+
+// defaultBackpressureLimit disconnect-after-nで上限が設定されていない場合の破棄できる数
+const defaultBackpressureLimit = 100
+
+// ErrInvalidBackpressure 非対応の送信バッファの方針が指定された場合に発生するエラー
+var ErrInvalidBackpressure = errors.New("chat: backpressureには disconnect, drop-newest, drop-oldest, disconnect-after-n のいずれかを指定してください。")
+
+var (
+	// droppedFramesは送信バッファが一杯のため破棄したイベントの合計
+	droppedFrames = expvar.NewInt("websocket_dropped_frames")
+	// droppedFramesByClientは接続中のクライアントごとに破棄したイベントの数。キーは"ルーム/リクエストID"
+	droppedFramesByClient = expvar.NewMap("websocket_dropped_frames_by_client")
+)
+
+// validBackpressure 送信バッファの方針として使用できるかどうかを判定する
+func validBackpressure(policy string) bool {
+	switch policy {
+	case "", backpressureDisconnect, backpressureDropNewest, backpressureDropOldest, backpressureDisconnectAfterN:
+		return true
+	}
+	return false
+}
+
+// pushはルームの送信バッファの方針に従ってクライアントにイベントを送信する
+// 送信できた場合は真を返す。room.runのゴルーチンからのみ呼び出す
+func (r *room) push(c *client, msg *message) bool {
+	select {
+	case c.send <- msg:
+		r.stats.sent(int64(msg.size))
+		return true
+	default:
+	}
+	settings := r.Settings()
+	switch settings.Backpressure {
+	case backpressureDropOldest:
+		// 書き込み側と取り合いになっても、どちらかが取り出せば空きができる
+		select {
+		case <-c.send:
+		default:
+		}
+		select {
+		case c.send <- msg:
+			r.stats.sent(int64(msg.size))
+		default:
+		}
+		r.dropped(c)
+		return true
+	case backpressureDropNewest:
+		r.dropped(c)
+		return false
+	case backpressureDisconnectAfterN:
+		limit := settings.BackpressureLimit
+		if limit <= 0 {
+			limit = defaultBackpressureLimit
+		}
+		if r.dropped(c) < limit {
+			return false
+		}
+	}
+	r.remove(c, websocket.CloseTryAgainLater, defaultBackoff().closeReason("send buffer full"))
+	return false
+}
+
+// droppedはクライアントへのイベントを破棄したことを記録し、これまでに破棄した数を返す
+func (r *room) dropped(c *client) int {
+	c.dropped++
+	droppedFrames.Add(1)
+	droppedFramesByClient.Add(r.name+"/"+c.requestID, 1)
+	droppedFramesByRoom.WithLabelValues(r.name).Inc()
+	return c.dropped
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestRoomPushBackpressure(t *testing.T) {
+	r := newRoom()
+	r.name = "test"
+	full := func() *client {
+		c := &client{send: make(chan *message, 1), requestID: "req"}
+		c.send <- &message{Message: "old"}
+		r.clients[c] = true
+		return c
+	}
+
+	r.SetSettings(roomSettings{Backpressure: backpressureDropOldest})
+	c := full()
+	if !r.push(c, &message{Message: "new"}) {
+		t.Error("drop-oldestでは新しいイベントが送信されるべきです")
+	}
+	if msg := <-c.send; msg.Message != "new" {
+		t.Errorf("drop-oldestでは古いイベントが破棄されるべきですが%qが残っています", msg.Message)
+	}
+
+	r.SetSettings(roomSettings{Backpressure: backpressureDropNewest})
+	c = full()
+	if r.push(c, &message{Message: "new"}) || (<-c.send).Message != "old" {
+		t.Error("drop-newestでは新しいイベントが破棄されるべきです")
+	}
+
+	r.SetSettings(roomSettings{Backpressure: backpressureDisconnectAfterN, BackpressureLimit: 2})
+	c = full()
+	r.push(c, &message{})
+	if !r.clients[c] {
+		t.Error("上限に達するまでは切断されるべきではありません")
+	}
+	r.push(c, &message{})
+	if r.clients[c] {
+		t.Error("破棄した数が上限に達したら切断されるべきです")
+	}
+
+	r.SetSettings(roomSettings{})
+	c = full()
+	r.push(c, &message{})
+	if r.clients[c] {
+		t.Error("既定では送信バッファが一杯になったら切断されるべきです")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	batchMax     = flag.Int("batch-max", 32, "batchを宣言したクライアントに1つのフレームでまとめて送るイベントの最大数 (1の場合はまとめない)")
+	batchLatency = flag.Duration("batch-latency", 0, "イベントをまとめるために次のイベントを待つ最大の時間 (0の場合は既に届いているイベントだけをまとめる)")
+)
+
+// capBatch 複数のイベントをJSONの配列として1つのフレームで受け取る
+// まとめるイベントが1件だけの場合は通常どおりオブジェクトとして送信する
+const capBatch = "batch"
+
+// collectBatchはforwardに続けて届いているイベントをbatch-maxまでまとめて返す
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) collectBatch(first *message) []*message {
+	batch := []*message{first}
+	var timeout <-chan time.Time
+	if *batchLatency > 0 {
+		timer := time.NewTimer(*batchLatency)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for len(batch) < *batchMax {
+		if timeout == nil {
+			select {
+			case msg := <-r.forward:
+				batch = append(batch, msg)
+			default:
+				return batch
+			}
+			continue
+		}
+		select {
+		case msg := <-r.forward:
+			batch = append(batch, msg)
+		case <-timeout:
+			return batch
+		}
+	}
+	return batch
+}
+
+// deliverBatchはbatchを宣言したクライアントにはまとめたフレームを、それ以外には1件ずつ配信する
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) deliverBatch(batch []*message) {
+	if len(batch) == 1 {
+		r.deliver(batch[0])
+		return
+	}
+	// 能力が同じクライアントには同じフレームを共有する
+	frames := make(map[string]*message)
+	for client := range r.clients {
+		if !client.caps[capBatch] {
+			continue
+		}
+		key := client.caps.key()
+		frame, ok := frames[key]
+		if !ok {
+			frame = prepareBatch(client.caps, batch)
+			frames[key] = frame
+		}
+		if frame != nil && !r.push(client, frame) {
+			r.tracer.Warn(" -- 送信に失敗しました")
+		}
+	}
+	for _, msg := range batch {
+		r.fanOut(msg, len(frames) > 0)
+	}
+}
+
+// prepareBatch クライアントの能力に合わせたイベントをJSONの配列として一度だけエンコードする
+// 送信するイベントがない場合はnilを返す
+func prepareBatch(caps capabilities, batch []*message) *message {
+	var shaped []*message
+	for _, msg := range batch {
+		if caps.wants(msg) {
+			shaped = append(shaped, caps.shape(msg))
+		}
+	}
+	if len(shaped) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(shaped); err != nil {
+		return nil
+	}
+	pm, err := websocket.NewPreparedMessage(websocket.TextMessage, buf.Bytes())
+	if err != nil {
+		return nil
+	}
+	return &message{Type: typeBatch, prepared: pm, size: buf.Len()}
+}
+
+// key 能力を一意に表す文字列
+func (caps capabilities) key() string {
+	list := make([]string, 0, len(caps))
+	for c := range caps {
+		list = append(list, c)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCollectBatch(t *testing.T) {
+	defer func(n int, d time.Duration) { *batchMax, *batchLatency = n, d }(*batchMax, *batchLatency)
+	defer func(n int) { *roomForwardBuffer = n }(*roomForwardBuffer)
+	*roomForwardBuffer = 8
+	tests := []struct {
+		max     int
+		latency time.Duration
+		queued  int
+		late    bool
+		size    int
+	}{
+		{32, 0, 2, false, 3},
+		{2, 0, 2, false, 2},
+		{1, 0, 2, false, 1},
+		{32, 0, 0, true, 1},
+		{32, 200 * time.Millisecond, 0, true, 2},
+	}
+	for _, test := range tests {
+		*batchMax, *batchLatency = test.max, test.latency
+		r := newRoom()
+		for i := 0; i < test.queued; i++ {
+			r.forward <- &message{ID: "queued"}
+		}
+		if test.late {
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				r.forward <- &message{ID: "late"}
+			}()
+		}
+		if batch := r.collectBatch(&message{ID: "first"}); len(batch) != test.size || batch[0].ID != "first" {
+			t.Errorf("max=%d latency=%v: %d件まとめるべきところ%d件でした", test.max, test.latency, test.size, len(batch))
+		}
+		if test.late && test.latency == 0 {
+			<-r.forward
+		}
+	}
+}
+
+func TestDeliverBatch(t *testing.T) {
+	r := newRoom()
+	r.name = "batch"
+	batched := &client{send: make(chan *message, 4), caps: capabilities{capBatch: true}}
+	plain := &client{send: make(chan *message, 4), caps: capabilities{}}
+	skipping := &client{send: make(chan *message, 4), caps: capabilities{capBatch: true, capSkipPrefix + typeMessageDeleted: true}}
+	for _, c := range []*client{batched, plain, skipping} {
+		r.clients[c] = true
+	}
+
+	r.deliverBatch([]*message{{Type: typeChat, ID: "m1"}, {Type: typeMessageDeleted, Ref: "m0"}})
+	tests := []struct {
+		name   string
+		c      *client
+		frames []string
+	}{
+		{"batch", batched, []string{typeBatch}},
+		{"plain", plain, []string{typeChat, typeMessageDeleted}},
+		{"batch,no-message_deleted", skipping, []string{typeBatch}},
+	}
+	for _, test := range tests {
+		var got []string
+		for len(test.c.send) > 0 {
+			got = append(got, (<-test.c.send).Type)
+		}
+		if len(got) != len(test.frames) {
+			t.Errorf("%s: %vを受け取るべきところ%vでした", test.name, test.frames, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.frames[i] {
+				t.Errorf("%s: %vを受け取るべきところ%vでした", test.name, test.frames, got)
+			}
+		}
+	}
+}
+
+func TestPrepareBatch(t *testing.T) {
+	batch := []*message{{Type: typeChat, ID: "m1", AvatarURL: "http://example.com/a.png"}, {Type: typeMessageDeleted, Ref: "m0"}}
+	caps := capabilities{capCompact: true, capSkipPrefix + typeMessageDeleted: true}
+	frame := prepareBatch(caps, batch)
+	data, _ := json.Marshal([]*message{{Type: typeChat, ID: "m1"}})
+	if frame == nil || frame.prepared == nil || frame.size != len(data)+1 {
+		t.Errorf("能力に合わせたイベントだけを配列としてエンコードするべきです: %+v", frame)
+	}
+	if prepareBatch(capabilities{capSkipPrefix + typeMessageDeleted: true}, batch[1:]) != nil {
+		t.Error("送信するイベントがない場合はnilを返すべきです")
+	}
+	if (capabilities{"b": true, "a": true}).key() != (capabilities{"a": true, "b": true}).key() {
+		t.Error("同じ能力は同じキーになるべきです")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// benchPrefix 負荷試験で送信するメッセージの接頭辞
+const benchPrefix = "bench "
+
+// benchStats 負荷試験の集計
+type benchStats struct {
+	connected  int64
+	dialErrors int64
+	sent       int64
+	sendErrors int64
+	received   int64
+	expected   int64
+	disconnect int64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+}
+
+func (s *benchStats) observe(d time.Duration) {
+	s.mu.Lock()
+	s.latencies = append(s.latencies, d)
+	s.mu.Unlock()
+}
+
+// percentile 昇順に並んだ遅延のp(0-100)パーセンタイルを返す
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+// benchConn 負荷試験の1つの接続
+type benchConn struct {
+	socket *websocket.Conn
+	room   int
+	mu     sync.Mutex
+}
+
+// benchCommand gochat bench
+// 複数のルームにWebSocketで接続して一定の割合でメッセージを送信し、配信の遅延とエラーの割合を出力する
+func benchCommand(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	server := fs.String("server", "ws://localhost:8080", "接続するサーバーのURL")
+	token := fs.String("token", os.Getenv("GOCHAT_TOKEN"), "chatの権限を持つAPIキーまたはボットのトークン (省略した場合は環境変数GOCHAT_TOKEN)")
+	conns := fs.Int("conns", 100, "接続の数")
+	rooms := fs.Int("rooms", 10, "接続を分散させるルームの数")
+	rate := fs.Float64("rate", 50, "全体で1秒あたりに送信するメッセージの数")
+	duration := fs.Duration("duration", 30*time.Second, "メッセージを送信する時間")
+	settle := fs.Duration("settle", 2*time.Second, "送信を終えてから配信を待つ時間")
+	batch := fs.Bool("batch", false, "batchを宣言して接続する")
+	fs.Parse(args)
+	if *conns < 1 || *rooms < 1 || *rate <= 0 {
+		return errors.New("chat: -conns、-rooms、-rateには正の数を指定してください。")
+	}
+	u, err := url.Parse(strings.TrimSuffix(*server, "/") + "/room")
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Authorization": {"Bearer " + *token}}
+
+	var stats benchStats
+	roomSize := make([]int64, *rooms)
+	var clients []*benchConn
+	var wg sync.WaitGroup
+	for i := 0; i < *conns; i++ {
+		room := i % *rooms
+		q := url.Values{"room": {fmt.Sprintf("bench-%d", room)}, "v": {strconv.Itoa(maxProtocolVersion)}}
+		if *batch {
+			q.Set("caps", capBatch)
+		}
+		u.RawQuery = q.Encode()
+		socket, _, err := websocket.DefaultDialer.Dial(u.String(), header)
+		if err != nil {
+			stats.dialErrors++
+			if stats.dialErrors == 1 {
+				fmt.Fprintln(os.Stderr, "接続に失敗しました:", err)
+			}
+			continue
+		}
+		c := &benchConn{socket: socket, room: room}
+		clients = append(clients, c)
+		roomSize[room]++
+		stats.connected++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.receive(&stats)
+		}()
+	}
+	if len(clients) == 0 {
+		return errors.New("chat: 1つも接続できませんでした。")
+	}
+	fmt.Printf("接続: %d (失敗 %d)。%vの間、毎秒%.0f件を送信します\n", stats.connected, stats.dialErrors, *duration, *rate)
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	deadline := time.After(*duration)
+	for i := 0; ; i++ {
+		select {
+		case <-ticker.C:
+			c := clients[i%len(clients)]
+			msg := map[string]string{"Message": benchPrefix + strconv.FormatInt(time.Now().UnixNano(), 10)}
+			c.mu.Lock()
+			err := c.socket.WriteJSON(msg)
+			c.mu.Unlock()
+			if err != nil {
+				atomic.AddInt64(&stats.sendErrors, 1)
+				continue
+			}
+			atomic.AddInt64(&stats.sent, 1)
+			atomic.AddInt64(&stats.expected, roomSize[c.room])
+			continue
+		case <-deadline:
+		}
+		break
+	}
+	ticker.Stop()
+	time.Sleep(*settle)
+	for _, c := range clients {
+		c.socket.Close()
+	}
+	wg.Wait()
+	stats.report(os.Stdout)
+	return nil
+}
+
+// receive 接続が閉じられるまでイベントを受信し、負荷試験のメッセージの遅延を記録する
+func (c *benchConn) receive(stats *benchStats) {
+	for {
+		_, data, err := c.socket.ReadMessage()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				atomic.AddInt64(&stats.disconnect, 1)
+			}
+			return
+		}
+		now := time.Now()
+		var events []*message
+		if len(data) > 0 && data[0] == '[' {
+			json.Unmarshal(data, &events)
+		} else {
+			var msg message
+			if json.Unmarshal(data, &msg) == nil {
+				events = append(events, &msg)
+			}
+		}
+		for _, msg := range events {
+			if msg.Type != typeChat || !strings.HasPrefix(msg.Message, benchPrefix) {
+				continue
+			}
+			sent, err := strconv.ParseInt(strings.TrimPrefix(msg.Message, benchPrefix), 10, 64)
+			if err != nil {
+				continue
+			}
+			atomic.AddInt64(&stats.received, 1)
+			stats.observe(now.Sub(time.Unix(0, sent)))
+		}
+	}
+}
+
+// report 集計結果を出力する
+func (s *benchStats) report(w *os.File) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	delivery := 0.0
+	if s.expected > 0 {
+		delivery = float64(s.received) / float64(s.expected) * 100
+	}
+	fmt.Fprintf(w, "送信: %d (エラー %d)\n", s.sent, s.sendErrors)
+	fmt.Fprintf(w, "配信: %d / %d (%.2f%%)\n", s.received, s.expected, delivery)
+	fmt.Fprintf(w, "接続エラー: %d、途中の切断: %d\n", s.dialErrors, s.disconnect)
+	fmt.Fprintf(w, "遅延: p50=%v p90=%v p99=%v max=%v\n",
+		percentile(s.latencies, 50), percentile(s.latencies, 90), percentile(s.latencies, 99), percentile(s.latencies, 100))
+}
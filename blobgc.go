@@ -0,0 +1,127 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	blobGCInterval = flag.Duration("blob-gc-interval", time.Hour, "参照されていない添付ファイルを削除する間隔 (0の場合は実行しない)")
+	blobGCGrace    = flag.Duration("blob-gc-grace", 24*time.Hour, "参照されていない添付ファイルを削除するまでの猶予期間")
+	blobGCDryRun   = flag.Bool("blob-gc-dry-run", false, "参照されていない添付ファイルを削除せずにログに出力だけする")
+)
+
+var (
+	blobGCRuns           = expvar.NewInt("blob_gc_runs")
+	blobGCDeletedFiles   = expvar.NewInt("blob_gc_deleted_files")
+	blobGCReclaimedBytes = expvar.NewInt("blob_gc_reclaimed_bytes")
+)
+
+// blobGCResult 1回の削除処理の結果
+type blobGCResult struct {
+	Orphans int
+	Bytes   int64
+}
+
+// attachmentURLPattern メッセージの本文に含まれる添付ファイルのURL
+var attachmentURLPattern = regexp.MustCompile(`/attachments/([A-Za-z0-9_-]+)`)
+
+// referencedAttachments いずれかのメッセージの本文から参照されている添付ファイルのIDを返す
+// 転送されたメッセージも本文に同じURLを含むため、転送先のルームに残っていれば参照されているとみなす
+func referencedAttachments() (map[string]bool, error) {
+	refs := make(map[string]bool)
+	err := messages.Each(func(m *message) error {
+		for _, match := range attachmentURLPattern.FindAllStringSubmatch(m.Message, -1) {
+			refs[match[1]] = true
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// attachmentReferenced 添付ファイルがメッセージ、アバター、スタンプのいずれかから参照されているかどうか
+// refsはreferencedAttachmentsで集めたメッセージから参照されている添付ファイル
+func attachmentReferenced(a *Attachment, refs map[string]bool) bool {
+	// 審査待ちのものはモデレーターが判断するまで残す
+	if a.Held || refs[a.ID] {
+		return true
+	}
+	url := a.URL()
+	if record, err := users.GetByID(a.UserID); err == nil && strings.Contains(record.AvatarURL, url) {
+		return true
+	}
+	// スタンプの画像はアップロードしたユーザーのパックか、管理者が用意したパックに登録されている
+	packs, err := stickers.List(a.UserID)
+	if err != nil {
+		return true
+	}
+	for _, p := range packs {
+		for _, s := range p.Stickers {
+			if s.AttachmentID == a.ID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// collectOrphanBlobs 猶予期間を過ぎても参照されていないファイルを削除する
+// dryRunが真の場合は削除せずに対象を数えるだけにする
+func collectOrphanBlobs(now time.Time, grace time.Duration, dryRun bool) (blobGCResult, error) {
+	var result blobGCResult
+	list, err := blobs.List()
+	if err != nil {
+		return result, err
+	}
+	// メッセージはファイルごとではなく、1回の処理でまとめて確認する
+	refs, err := referencedAttachments()
+	if err != nil {
+		return result, err
+	}
+	for _, b := range list {
+		if now.Sub(b.ModTime) < grace {
+			continue
+		}
+		a, err := attachments.Get(b.Key)
+		if err != nil {
+			// 情報を確認できないファイルは、誰のものか分からないため削除しない
+			continue
+		}
+		if attachmentReferenced(a, refs) {
+			continue
+		}
+		result.Orphans++
+		result.Bytes += b.Size
+		if dryRun {
+			log.Println("参照されていない添付ファイル (dry-run):", b.Key, formatBytes(b.Size))
+			continue
+		}
+		if err := blobs.Delete(b.Key); err != nil && err != ErrBlobNotFound {
+			log.Println("添付ファイルの削除に失敗しました:", b.Key, "-", err)
+			continue
+		}
+		attachments.Delete(a.ID)
+		blobGCDeletedFiles.Add(1)
+		blobGCReclaimedBytes.Add(b.Size)
+	}
+	blobGCRuns.Add(1)
+	return result, nil
+}
+
+// runBlobGC 参照されていない添付ファイルを定期的に削除する
+func runBlobGC(interval, grace time.Duration, dryRun bool) {
+	for now := range time.Tick(interval) {
+		result, err := collectOrphanBlobs(now, grace, dryRun)
+		if err != nil {
+			log.Println("添付ファイルの整理に失敗しました:", err)
+			continue
+		}
+		if result.Orphans > 0 {
+			log.Printf("参照されていない添付ファイル: %d件 (%s)\n", result.Orphans, formatBytes(result.Bytes))
+		}
+	}
+}
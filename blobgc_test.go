@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectOrphanBlobsKeepsStickers(t *testing.T) {
+	defer func(b BlobStore) { blobs = b }(blobs)
+	defer func(s AttachmentStore) { attachments = s }(attachments)
+	defer func(s StickerStore) { stickers = s }(stickers)
+	defer func(s MessageStore) { messages = s }(messages)
+	var err error
+	if blobs, err = newFileBlobStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	attachments = newMemoryAttachmentStore()
+	stickers = newMemoryStickerStore()
+	messages = newMemoryMessageStore()
+
+	for _, id := range []string{"sticker", "orphan"} {
+		attachments.Create(&Attachment{ID: id, UserID: "u1", ContentType: "image/png", CreatedAt: time.Now()})
+		if _, err := blobs.Put(id, strings.NewReader(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stickers.Save(&StickerPack{ID: "p1", Name: "猫", OwnerID: "u1", Stickers: []Sticker{{ID: "s1", Name: "hi", AttachmentID: "sticker"}}})
+
+	result, err := collectOrphanBlobs(time.Now().Add(48*time.Hour), 24*time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Orphans != 1 {
+		t.Errorf("参照されていないファイルだけを削除するべきです: %+v", result)
+	}
+	if _, err := attachments.Get("sticker"); err != nil {
+		t.Errorf("スタンプに登録された画像は削除するべきではありません: %v", err)
+	}
+	if _, err := attachments.Get("orphan"); err != ErrAttachmentNotFound {
+		t.Errorf("参照されていないファイルは削除するべきです: %v", err)
+	}
+}
+
+func TestCollectOrphanBlobsReferences(t *testing.T) {
+	defer func(b BlobStore) { blobs = b }(blobs)
+	defer func(s AttachmentStore) { attachments = s }(attachments)
+	defer func(s StickerStore) { stickers = s }(stickers)
+	defer func(s MessageStore) { messages = s }(messages)
+	var err error
+	if blobs, err = newFileBlobStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	attachments = newMemoryAttachmentStore()
+	stickers = newMemoryStickerStore()
+	messages = newMemoryMessageStore()
+
+	for _, id := range []string{"forwarded", "orphan", "unknown"} {
+		if _, err := blobs.Put(id, strings.NewReader(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"forwarded", "orphan"} {
+		attachments.Create(&Attachment{ID: id, UserID: "u1", CreatedAt: time.Now()})
+	}
+	// 元のメッセージは削除され、他のユーザーが転送したものだけが残っている
+	messages.Save(&message{ID: "m2", Room: "random", UserID: "u2", Message: "見て /attachments/forwarded",
+		Forwarded: &ForwardInfo{Room: "general", MessageID: "m1", UserID: "u1"}, When: time.Now()})
+
+	tests := []struct {
+		key  string
+		kept bool
+	}{
+		{"forwarded", true},
+		{"orphan", false},
+		{"unknown", true},
+	}
+	if _, err := collectOrphanBlobs(time.Now().Add(48*time.Hour), 24*time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		f, err := blobs.Open(tt.key)
+		if err == nil {
+			f.Close()
+		}
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("%s: 残すべきかどうかが不正です: %v", tt.key, kept)
+		}
+	}
+}
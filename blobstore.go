@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var blobDir = flag.String("blob-dir", "uploads", "添付ファイルを保存するディレクトリ")
+
+// ErrBlobNotFound 指定されたファイルが存在しない場合に発生するエラー
+var ErrBlobNotFound = errors.New("chat: ファイルが見つかりません。")
+
+// ErrInvalidBlobKey ファイルのキーが不正な場合に発生するエラー
+var ErrInvalidBlobKey = errors.New("chat: ファイルのキーが不正です。")
+
+// BlobInfo 保存されているファイルの情報
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore 添付ファイルの内容を保存する
+type BlobStore interface {
+	// Put rの内容をkeyに保存し、保存したバイト数を返す
+	Put(key string, r io.Reader) (int64, error)
+	Open(key string) (io.ReadSeekCloser, error)
+	Delete(key string) error
+	List() ([]BlobInfo, error)
+}
+
+// fileBlobStore ディレクトリにファイルとして保存するBlobStore
+type fileBlobStore struct {
+	dir string
+}
+
+func newFileBlobStore(dir string) (*fileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileBlobStore{dir: dir}, nil
+}
+
+// path キーに対応するファイルのパスを返す。ディレクトリの外を指すキーは拒否する
+func (s *fileBlobStore) path(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") {
+		return "", ErrInvalidBlobKey
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+func (s *fileBlobStore) Put(key string, r io.Reader) (int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	// 書き込み途中のファイルが見えないように一時ファイルに書いてから名前を変更する
+	tmp, err := ioutil.TempFile(s.dir, ".put-")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *fileBlobStore) Open(key string) (io.ReadSeekCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+func (s *fileBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+func (s *fileBlobStore) List() ([]BlobInfo, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	list := []BlobInfo{}
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		list = append(list, BlobInfo{Key: f.Name(), Size: f.Size(), ModTime: f.ModTime()})
+	}
+	return list, nil
+}
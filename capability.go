@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// capCompact 省略できる項目(アバターのURLなど)を送信しない
+const capCompact = "compact"
+
+// capSkipPrefix "no-"に続けてイベントの種類を指定すると、その種類のイベントを受け取らない
+// 例: no-message_deleted
+const capSkipPrefix = "no-"
+
+// capabilities 接続時にクライアントが宣言した能力
+type capabilities map[string]bool
+
+// capabilitiesFromRequest クエリパラメーターcapsのカンマ区切りの能力を解析する
+// 例: /room?room=general&caps=compact,no-reconnect
+func capabilitiesFromRequest(r *http.Request) capabilities {
+	caps := capabilities{}
+	for _, c := range strings.Split(r.URL.Query().Get("caps"), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			caps[c] = true
+		}
+	}
+	return caps
+}
+
+// wants クライアントがイベントを受け取るかどうかを判定する
+// チャットのメッセージとエラーは常に受け取る
+func (caps capabilities) wants(msg *message) bool {
+	if msg.Type == typeChat || msg.Type == typeError {
+		return true
+	}
+	return !caps[capSkipPrefix+msg.Type]
+}
+
+// shape クライアントの能力に合わせてイベントを整形する
+// 元のイベントは他のクライアントと共有しているため、変更する場合は複製する
+func (caps capabilities) shape(msg *message) *message {
+	if !caps[capCompact] || msg.AvatarURL == "" {
+		return msg
+	}
+	compact := *msg
+	compact.AvatarURL = ""
+	compact.prepared = nil
+	compact.size = 0
+	return &compact
+}
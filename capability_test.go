@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCapabilitiesFromRequest(t *testing.T) {
+	tests := []struct {
+		query string
+		caps  []string
+	}{
+		{"", nil},
+		{"caps=compact", []string{capCompact}},
+		{"caps=compact,%20no-typing,,", []string{capCompact, "no-typing"}},
+	}
+	for _, test := range tests {
+		caps := capabilitiesFromRequest(httptest.NewRequest("GET", "/room?"+test.query, nil))
+		if len(caps) != len(test.caps) {
+			t.Errorf("%q: %vになるべきところ%vでした", test.query, test.caps, caps)
+		}
+		for _, c := range test.caps {
+			if !caps[c] {
+				t.Errorf("%q: %sを含むべきです: %v", test.query, c, caps)
+			}
+		}
+	}
+}
+
+func TestCapabilitiesWants(t *testing.T) {
+	caps := capabilities{capSkipPrefix + typeMessageDeleted: true, capSkipPrefix + typeChat: true, capSkipPrefix + typeError: true}
+	tests := []struct {
+		msgType string
+		want    bool
+	}{
+		{typeChat, true},
+		{typeError, true},
+		{typeMessageDeleted, false},
+		{typeWelcome, true},
+	}
+	for _, test := range tests {
+		if got := caps.wants(&message{Type: test.msgType}); got != test.want {
+			t.Errorf("%q: %vになるべきところ%vでした", test.msgType, test.want, got)
+		}
+	}
+}
+
+func TestFanOutRespectsCapabilities(t *testing.T) {
+	r := newRoom()
+	r.name = "caps"
+	full := &client{send: make(chan *message, 4), caps: capabilities{}}
+	minimal := &client{send: make(chan *message, 4), caps: capabilities{capCompact: true, capSkipPrefix + typeMessageDeleted: true}}
+	r.clients[full] = true
+	r.clients[minimal] = true
+
+	chat := &message{Type: typeChat, ID: "m1", Message: "こんにちは", AvatarURL: "http://example.com/a.png"}
+	r.deliver(chat)
+	r.deliver(&message{Type: typeMessageDeleted, Ref: "m1"})
+
+	if got := (<-full.send).AvatarURL; got != chat.AvatarURL {
+		t.Errorf("compactを宣言していないクライアントにはアバターのURLを送るべきです: %q", got)
+	}
+	if got := (<-minimal.send).AvatarURL; got != "" {
+		t.Errorf("compactを宣言したクライアントにはアバターのURLを送るべきではありません: %q", got)
+	}
+	if chat.AvatarURL == "" {
+		t.Error("共有しているイベントを変更するべきではありません")
+	}
+	if got := <-full.send; got.Type != typeMessageDeleted {
+		t.Errorf("宣言していないクライアントには削除のイベントを送るべきです: %+v", got)
+	}
+	if len(minimal.send) != 0 {
+		t.Errorf("no-%sを宣言したクライアントには送るべきではありません", typeMessageDeleted)
+	}
+}
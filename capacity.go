@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var roomMaxClients = flag.Int("room-max-clients", 0, "1つのルームにこのノードで同時に在室できるクライアントの数の既定値 (0の場合は制限しない。ルームの設定max_clientsで上書きできる)")
+
+// closeReasonRoomFull 定員に達したルームへの接続を拒否する際のクローズ理由
+const closeReasonRoomFull = "room_full"
+
+// capacityはルームの定員を返す。0の場合は制限しない
+func (r *room) capacity() int {
+	if n := r.Settings().MaxClients; n > 0 {
+		return n
+	}
+	return *roomMaxClients
+}
+
+// fullはルームが定員に達しているかどうかを判定する
+// 待機中のクライアントがいる場合は、順番を守るため新しいクライアントも待機させる
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) full() bool {
+	n := r.capacity()
+	return n > 0 && (len(r.clients) >= n || len(r.waiting) > 0)
+}
+
+// admitはクライアントを在室者に加える
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) admit(c *client) {
+	r.clients[c] = true
+	deliveryMetrics.add(r.name, c)
+	c.admitted.Store(true)
+	r.memberJoined(c)
+	r.stats.setClients(len(r.clients))
+	events.Publish(clientEvent(EventClientJoined, r, c))
+	r.tracer.Info("新しいクライアントが参加しました")
+}
+
+// turnAwayは定員に達したルームに参加しようとしたクライアントを待機させるか拒否する
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) turnAway(c *client) {
+	if r.Settings().WaitingList {
+		r.waiting = append(r.waiting, c)
+		r.push(c, &message{Type: typeWaiting, Room: r.name, Name: systemName, Position: len(r.waiting), When: time.Now()})
+		r.tracer.Info("定員に達しているためクライアントを待機させました")
+		return
+	}
+	r.push(c, errorEvent(errRoomFull, "ルームが定員に達しています。しばらくしてから再接続してください。"))
+	c.closeCode, c.closeReason = websocket.CloseTryAgainLater, closeReasonRoomFull
+	close(c.send)
+	r.tracer.Info("定員に達しているためクライアントの参加を拒否しました")
+}
+
+// admitWaitingは空きができた分だけ待機中のクライアントを参加させ、残りのクライアントに順番を知らせる
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) admitWaiting() {
+	if len(r.waiting) == 0 {
+		return
+	}
+	admitted := 0
+	for len(r.waiting) > 0 && (r.capacity() == 0 || len(r.clients) < r.capacity()) {
+		c := r.waiting[0]
+		r.waiting = r.waiting[1:]
+		r.admit(c)
+		r.push(c, &message{Type: typeAdmitted, Room: r.name, Name: systemName, When: time.Now()})
+		admitted++
+	}
+	if admitted > 0 {
+		r.notifyWaiting()
+	}
+}
+
+// notifyWaitingは待機中のクライアントに現在の順番を知らせる
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) notifyWaiting() {
+	now := time.Now()
+	for i, c := range r.waiting {
+		r.push(c, &message{Type: typeWaiting, Room: r.name, Name: systemName, Position: i + 1, When: now})
+	}
+}
+
+// waitingPositionは待機中のクライアントの順番 (1から) を返す。待機していない場合は0を返す
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) waitingPosition(c *client) int {
+	for i, w := range r.waiting {
+		if w == c {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// dropWaitingは待機中のクライアントを取り除いて接続を終了させる。待機していない場合は何もしない
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) dropWaiting(c *client, code int, reason string) {
+	i := r.waitingPosition(c) - 1
+	if i < 0 {
+		return
+	}
+	r.waiting = append(r.waiting[:i], r.waiting[i+1:]...)
+	c.closeCode, c.closeReason = code, reason
+	close(c.send)
+	r.notifyWaiting()
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestRoomCapacity(t *testing.T) {
+	r := newRoom()
+	r.name = "test"
+	newClient := func() *client {
+		return &client{send: make(chan *message, 8), userData: map[string]interface{}{"userid": "u"}}
+	}
+
+	r.SetSettings(roomSettings{MaxClients: 1})
+	first := newClient()
+	r.admit(first)
+	rejected := newClient()
+	if !r.full() {
+		t.Fatal("定員に達したルームはfullになるべきです")
+	}
+	r.turnAway(rejected)
+	if msg := <-rejected.send; msg.Code != errRoomFull {
+		t.Errorf("room_fullのエラーになるべきところ%+vでした", msg)
+	}
+	if _, ok := <-rejected.send; ok || rejected.closeReason != closeReasonRoomFull {
+		t.Error("拒否したクライアントは切断されるべきです")
+	}
+
+	r.SetSettings(roomSettings{MaxClients: 1, WaitingList: true})
+	a, b := newClient(), newClient()
+	r.turnAway(a)
+	r.turnAway(b)
+	if msg := <-b.send; msg.Type != typeWaiting || msg.Position != 2 {
+		t.Errorf("2番目に待機しているお知らせになるべきところ%+vでした", msg)
+	}
+	r.remove(first, 1000, "")
+	r.admitWaiting()
+	if !r.clients[a] || !a.admitted.Load() || r.clients[b] {
+		t.Error("空きができたら先頭のクライアントだけが参加するべきです")
+	}
+	if msg := <-b.send; msg.Type != typeWaiting || msg.Position != 1 {
+		t.Errorf("順番が1番目に更新されるべきところ%+vでした", msg)
+	}
+}
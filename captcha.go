@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	captchaProvider  = flag.String("captcha", "", "新規登録で使用するCAPTCHA (hcaptcha または turnstile。空の場合は使用しない)")
+	captchaSiteKey   = flag.String("captcha-site-key", "", "CAPTCHAのサイトキー")
+	captchaSecret    = flag.String("captcha-secret", "", "CAPTCHAのシークレット (vault:などの参照も指定できる)")
+	captchaThreshold = flag.Int("captcha-signup-threshold", 3, "同じIPアドレスから1時間にこの数のアカウントが作成されたらCAPTCHAを求める (0の場合は常に求める)")
+)
+
+// captchaPassTTL CAPTCHAを通過してから新規登録を完了するまでの制限時間
+const captchaPassTTL = 10 * time.Minute
+
+// signupWindow IPアドレスごとのアカウントの作成数を数える期間
+const signupWindow = time.Hour
+
+var (
+	// ErrCaptchaFailed CAPTCHAの検証に失敗した場合に発生するエラー
+	ErrCaptchaFailed = errors.New("chat: CAPTCHAを確認できませんでした。もう一度お試しください。")
+	// ErrUnknownCaptcha -captchaに対応していないサービスが指定された場合に発生するエラー
+	ErrUnknownCaptcha = errors.New("chat: CAPTCHAにはhcaptchaまたはturnstileを指定してください。")
+)
+
+// CaptchaVerifier CAPTCHAのサービスで利用者の応答を検証する
+type CaptchaVerifier interface {
+	// Verify 応答のトークンを検証する。失敗した場合はErrCaptchaFailedを返す
+	Verify(ctx context.Context, token, remoteIP string) error
+	// Widget 画面に埋め込むスクリプトのURL、要素のクラス、応答を送信するフォームの項目名
+	Widget() (script, class, field string)
+}
+
+// siteverifyCaptcha hCaptchaとTurnstileに共通するsiteverify形式の検証
+type siteverifyCaptcha struct {
+	endpoint string
+	secret   string
+	script   string
+	class    string
+	field    string
+	client   *http.Client
+}
+
+func newCaptchaVerifier(name, secret string) (CaptchaVerifier, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	switch name {
+	case "":
+		return nil, nil
+	case "hcaptcha":
+		return &siteverifyCaptcha{
+			endpoint: "https://api.hcaptcha.com/siteverify",
+			secret:   secret,
+			script:   "https://js.hcaptcha.com/1/api.js",
+			class:    "h-captcha",
+			field:    "h-captcha-response",
+			client:   client,
+		}, nil
+	case "turnstile":
+		return &siteverifyCaptcha{
+			endpoint: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+			secret:   secret,
+			script:   "https://challenges.cloudflare.com/turnstile/v0/api.js",
+			class:    "cf-turnstile",
+			field:    "cf-turnstile-response",
+			client:   client,
+		}, nil
+	}
+	return nil, ErrUnknownCaptcha
+}
+
+func (c *siteverifyCaptcha) Verify(ctx context.Context, token, remoteIP string) error {
+	if token == "" {
+		return ErrCaptchaFailed
+	}
+	form := url.Values{"secret": {c.secret}, "response": {token}, "remoteip": {remoteIP}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+	if !body.Success {
+		return ErrCaptchaFailed
+	}
+	return nil
+}
+
+func (c *siteverifyCaptcha) Widget() (string, string, string) {
+	return c.script, c.class, c.field
+}
+
+// signupTracker IPアドレスごとに最近のアカウントの作成を数え、CAPTCHAが必要かどうかを判断する
+type signupTracker struct {
+	mu        sync.Mutex
+	signups   map[string][]time.Time
+	threshold int
+	now       func() time.Time
+	pruned    time.Time
+}
+
+func newSignupTracker(threshold int) *signupTracker {
+	return &signupTracker{signups: make(map[string][]time.Time), threshold: threshold, now: time.Now}
+}
+
+// recent 期間内の作成時刻だけを残して返す。呼び出し元でロックすること
+func (s *signupTracker) recent(ip string) []time.Time {
+	cutoff := s.now().Add(-signupWindow)
+	times := s.signups[ip]
+	for len(times) > 0 && times[0].Before(cutoff) {
+		times = times[1:]
+	}
+	if len(times) == 0 {
+		delete(s.signups, ip)
+	} else {
+		s.signups[ip] = times
+	}
+	return times
+}
+
+// required このIPアドレスからの新規登録にCAPTCHAが必要かどうかを返す
+func (s *signupTracker) required(ip string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.recent(ip)) >= s.threshold
+}
+
+// add アカウントの作成を記録する
+func (s *signupTracker) add(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.Sub(s.pruned) >= loginPruneInterval {
+		s.prune(now)
+	}
+	s.signups[ip] = append(s.recent(ip), now)
+}
+
+// prune 期間内の作成がなくなったIPアドレスの記録を削除する。s.muを保持して呼び出す
+func (s *signupTracker) prune(now time.Time) {
+	cutoff := now.Add(-signupWindow)
+	for ip, times := range s.signups {
+		if times[len(times)-1].Before(cutoff) {
+			delete(s.signups, ip)
+		}
+	}
+	s.pruned = now
+}
+
+// captchaGate 新規登録の前にCAPTCHAを求める
+type captchaGate struct {
+	verifier CaptchaVerifier
+	siteKey  string
+	signups  *signupTracker
+	once     sync.Once
+	templ    *template.Template
+}
+
+// enabled CAPTCHAを使用するかどうかを返す
+func (g *captchaGate) enabled() bool {
+	return g != nil && g.verifier != nil
+}
+
+// needed このリクエストからの新規登録を止めてCAPTCHAを求めるべきかどうかを返す
+// CAPTCHAを無効にしている場合や、既にCAPTCHAを通過している場合は偽を返す
+func (g *captchaGate) needed(r *http.Request) bool {
+	return g.enabled() && g.signups.required(clientIP(r)) && !g.passed(r)
+}
+
+// passed CAPTCHAを通過したことを示すCookieが有効かどうかを返す
+// Cookieは発行したIPアドレスでのみ有効とする
+func (g *captchaGate) passed(r *http.Request) bool {
+	cookie, err := r.Cookie("captcha")
+	if err != nil {
+		return false
+	}
+	value, _, err := verifyCookieValue(cookie.Value)
+	if err != nil {
+		return false
+	}
+	ip, expires, _ := strings.Cut(value, "|")
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	return err == nil && ip == clientIP(r) && time.Now().Before(time.Unix(unix, 0))
+}
+
+// signedUp アカウントの作成を記録し、通過済みのCookieを使えないようにする
+func (g *captchaGate) signedUp(w http.ResponseWriter, r *http.Request) {
+	if !g.enabled() {
+		return
+	}
+	g.signups.add(clientIP(r))
+	http.SetCookie(w, &http.Cookie{Name: "captcha", Path: "/", MaxAge: -1})
+}
+
+// challenge CAPTCHAの画面へリダイレクトする。通過後はnextへ戻る
+func (g *captchaGate) challenge(w http.ResponseWriter, next string) {
+	w.Header().Set("Location", "/login/captcha?next="+url.QueryEscape(next))
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// ServeHTTP CAPTCHAの画面
+// GET  /login/captcha?next=... CAPTCHAを表示する
+// POST /login/captcha          応答を検証し、通過を示すCookieを発行してnextへ戻る
+func (g *captchaGate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !g.enabled() {
+		http.NotFound(w, r)
+		return
+	}
+	next := r.FormValue("next")
+	// 外部のサイトへのリダイレクトに使われないよう、サイト内のパスだけを受け付ける
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/login"
+	}
+	script, class, field := g.verifier.Widget()
+	switch r.Method {
+	case http.MethodGet:
+		g.once.Do(func() {
+			g.templ = template.Must(template.ParseFiles(filepath.Join("templates", "captcha.html")))
+		})
+		g.templ.Execute(w, map[string]string{"Script": script, "Class": class, "SiteKey": g.siteKey, "Next": next})
+	case http.MethodPost:
+		if err := g.verifier.Verify(r.Context(), r.FormValue(field), clientIP(r)); err != nil {
+			if err != ErrCaptchaFailed {
+				requestLogger(r).Println("CAPTCHAの検証に失敗しました:", err)
+			}
+			auditRequest(r, auditAuthFailed, "", "", map[string]string{"reason": "captcha"})
+			httpError(w, r, ErrCaptchaFailed.Error(), http.StatusForbidden)
+			return
+		}
+		expires := time.Now().Add(captchaPassTTL).Unix()
+		http.SetCookie(w, &http.Cookie{
+			Name:     "captcha",
+			Value:    signCookieValue(clientIP(r) + "|" + strconv.FormatInt(expires, 10)),
+			Path:     "/",
+			MaxAge:   int(captchaPassTTL.Seconds()),
+			Secure:   isSecureRequest(r),
+			HttpOnly: true,
+		})
+		w.Header().Set("Location", next)
+		w.WriteHeader(http.StatusSeeOther)
+	default:
+		httpError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCaptcha "ok"という応答だけを受け付けるCaptchaVerifier
+type fakeCaptcha struct{}
+
+func (fakeCaptcha) Verify(_ context.Context, token, _ string) error {
+	if token != "ok" {
+		return ErrCaptchaFailed
+	}
+	return nil
+}
+
+func (fakeCaptcha) Widget() (string, string, string) { return "", "fake", "captcha-response" }
+
+func TestSignupTrackerPrune(t *testing.T) {
+	now := time.Now()
+	s := newSignupTracker(2)
+	s.now = func() time.Time { return now }
+	s.add("192.0.2.1")
+	now = now.Add(signupWindow + time.Minute)
+	s.add("192.0.2.2")
+	if _, ok := s.signups["192.0.2.1"]; ok {
+		t.Error("期間を過ぎたIPアドレスの記録は削除されるべきです")
+	}
+	if len(s.signups["192.0.2.2"]) != 1 {
+		t.Error("期間内の記録は残すべきです")
+	}
+}
+
+func TestCaptchaGate(t *testing.T) {
+	g := &captchaGate{verifier: fakeCaptcha{}, signups: newSignupTracker(2)}
+	r := httptest.NewRequest("GET", "/auth/callback/google", nil)
+	for i := 0; i < 2; i++ {
+		if g.needed(r) {
+			t.Fatalf("%d件目の登録ではCAPTCHAを求めるべきではありません", i+1)
+		}
+		g.signedUp(httptest.NewRecorder(), r)
+	}
+	if !g.needed(r) {
+		t.Fatal("しきい値を超えた登録ではCAPTCHAを求めるべきです")
+	}
+
+	post := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/login/captcha", strings.NewReader("next=%2Fauth%2Flogin%2Fgoogle&captcha-response="+token))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w
+	}
+	if w := post("bot"); w.Code != http.StatusForbidden {
+		t.Errorf("誤った応答は拒否するべきです: %d", w.Code)
+	}
+	w := post("ok")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/auth/login/google" {
+		t.Fatalf("通過後はnextへ戻るべきです: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	r.AddCookie(w.Result().Cookies()[0])
+	if g.needed(r) {
+		t.Error("CAPTCHAを通過した場合は求めるべきではありません")
+	}
+	other := httptest.NewRequest("GET", "/auth/callback/google", nil)
+	other.RemoteAddr = "203.0.113.9:1234"
+	other.AddCookie(w.Result().Cookies()[0])
+	if g.passed(other) {
+		t.Error("通過を示すCookieは別のIPアドレスでは使えないべきです")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/objx"
+)
+
+// ブラウザを使わずにチャットの機能をテストするための部品
+
+// errTestTimeout 期限までにイベントを受信できなかった場合に発生するエラー
+var errTestTimeout = errors.New("chat: イベントを受信できませんでした。")
+
+// fakeUser メモリ上に情報を保持するChatUser
+type fakeUser struct {
+	id     string
+	name   string
+	avatar string
+}
+
+func (u *fakeUser) UniqueID() string  { return u.id }
+func (u *fakeUser) Name() string      { return u.name }
+func (u *fakeUser) AvatarURL() string { return u.avatar }
+
+// authCookie ユーザーとしてログインした状態を表す、現在の鍵で署名した認証用のCookieを返す
+// 検証させる場合は、sessionIDのセッションを事前にセッションストアに作成する
+func authCookie(u ChatUser, sessionID string) *http.Cookie {
+	return signedCookie(&http.Cookie{
+		Name: "auth",
+		Value: objx.New(map[string]interface{}{
+			"userid":     u.UniqueID(),
+			"name":       u.Name(),
+			"avatar_url": u.AvatarURL(),
+			"session_id": sessionID,
+		}).MustBase64(),
+		Path: "/",
+	})
+}
+
+// fakeAvatar ユーザーごとに返すURLやエラーを設定できるAvatar
+type fakeAvatar struct {
+	mu   sync.Mutex
+	urls map[string]string
+	errs map[string]error
+	// callsは呼び出されたユーザーのIDを順に保持する
+	calls []string
+}
+
+func newFakeAvatar() *fakeAvatar {
+	return &fakeAvatar{urls: make(map[string]string), errs: make(map[string]error)}
+}
+
+// set ユーザーに返すURLを設定する
+func (a *fakeAvatar) set(userID, url string) *fakeAvatar {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.urls[userID] = url
+	delete(a.errs, userID)
+	return a
+}
+
+// setError ユーザーに返すエラーを設定する
+func (a *fakeAvatar) setError(userID string, err error) *fakeAvatar {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.errs[userID] = err
+	delete(a.urls, userID)
+	return a
+}
+
+// GetAvatarURL 設定されたURLまたはエラーを返す。設定されていないユーザーにはErrNoAvatarURLを返す
+func (a *fakeAvatar) GetAvatarURL(u ChatUser) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls = append(a.calls, u.UniqueID())
+	if err, ok := a.errs[u.UniqueID()]; ok {
+		return "", err
+	}
+	if url, ok := a.urls[u.UniqueID()]; ok {
+		return url, nil
+	}
+	return "", ErrNoAvatarURL
+}
+
+// testClient テスト用のWebSocketのクライアント
+type testClient struct {
+	conn    *websocket.Conn
+	timeout time.Duration
+	pending []*message
+}
+
+// dialRoom serverURL(httptest.ServerのURLなど)の/roomに接続する
+// queryにはroom、v、capsなどを指定する。cookieがnilでない場合は認証に使う
+func dialRoom(serverURL string, query url.Values, cookie *http.Cookie) (*testClient, error) {
+	u := "ws" + strings.TrimPrefix(serverURL, "http") + "/room"
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	header := http.Header{}
+	if cookie != nil {
+		header.Set("Cookie", cookie.String())
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(u, header)
+	if err != nil {
+		return nil, err
+	}
+	return &testClient{conn: conn, timeout: 2 * time.Second}, nil
+}
+
+// send チャットのメッセージを送信する
+func (c *testClient) send(text string) error {
+	return c.conn.WriteJSON(&message{Message: text})
+}
+
+// next 次のイベントを返す。まとめて届いたイベントは1件ずつ返す
+func (c *testClient) next() (*message, error) {
+	if len(c.pending) > 0 {
+		msg := c.pending[0]
+		c.pending = c.pending[1:]
+		return msg, nil
+	}
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		var netErr interface{ Timeout() bool }
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, errTestTimeout
+		}
+		return nil, err
+	}
+	if len(data) > 0 && data[0] == '[' {
+		if err := json.Unmarshal(data, &c.pending); err != nil {
+			return nil, err
+		}
+		return c.next()
+	}
+	var msg message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// expect 指定された種類のイベントが届くまで読み進めて返す
+func (c *testClient) expect(eventType string) (*message, error) {
+	for {
+		msg, err := c.next()
+		if err != nil {
+			return nil, err
+		}
+		if msg.Type == eventType {
+			return msg, nil
+		}
+	}
+}
+
+// close 接続を閉じる
+func (c *testClient) close() error {
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return c.conn.Close()
+}
+
+// fakeRoom 本体と同じプロトコルで動作するルームのテストダブル
+// ボットなどのクライアント側の処理を、ルームを動かさずにテストするために使う
+// 接続したクライアントにwelcomeを送り、チャットのメッセージを全員に配信して記録する
+type fakeRoom struct {
+	server *httptest.Server
+
+	mu sync.Mutex
+	// rejectが設定されている場合、チャットのメッセージを配信せずにこの内容のerrorを返す
+	reject   string
+	conns    map[*websocket.Conn]bool
+	received []*message
+	upgrader websocket.Upgrader
+}
+
+// newFakeRoom テストダブルのサーバーを起動する。使い終わったらcloseを呼び出す
+func newFakeRoom() *fakeRoom {
+	r := &fakeRoom{conns: make(map[*websocket.Conn]bool)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/room", r.serve)
+	r.server = httptest.NewServer(mux)
+	return r
+}
+
+// rejectWith 以降のチャットのメッセージを配信せずに、reasonを内容とするerrorを返すようにする
+// 空文字列を指定すると配信に戻す
+func (r *fakeRoom) rejectWith(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reject = reason
+}
+
+// messages 受信したチャットのメッセージを受信順に返す
+func (r *fakeRoom) messages() []*message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*message(nil), r.received...)
+}
+
+// broadcast 接続しているすべてのクライアントにイベントを送信する
+func (r *fakeRoom) broadcast(msg *message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for conn := range r.conns {
+		conn.WriteJSON(msg)
+	}
+}
+
+// close 接続を閉じてサーバーを終了する
+func (r *fakeRoom) close() {
+	r.mu.Lock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+	r.mu.Unlock()
+	r.server.Close()
+}
+
+func (r *fakeRoom) serve(w http.ResponseWriter, req *http.Request) {
+	conn, err := r.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	room := req.URL.Query().Get("room")
+	r.mu.Lock()
+	r.conns[conn] = true
+	conn.WriteJSON(&message{Type: typeWelcome, Version: 1})
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.conns, conn)
+		r.mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		var msg message
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg.Type != typeChat {
+			continue
+		}
+		r.mu.Lock()
+		if r.reject != "" {
+			conn.WriteJSON(&message{Type: typeError, Code: errBadRequest, Message: r.reject})
+			r.mu.Unlock()
+			continue
+		}
+		msg.Room = room
+		msg.When = time.Now()
+		r.received = append(r.received, &msg)
+		r.mu.Unlock()
+		r.broadcast(&msg)
+	}
+}
+
+func TestFakeRoom(t *testing.T) {
+	room := newFakeRoom()
+	defer room.close()
+	c, err := dialRoom(room.server.URL, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if _, err := c.expect(typeWelcome); err != nil {
+		t.Fatal(err)
+	}
+	c.send("hello")
+	if msg, err := c.expect(typeChat); err != nil || msg.Message != "hello" {
+		t.Errorf("送信したメッセージが配信されるべきです: %+v, %v", msg, err)
+	}
+	room.rejectWith("だめです")
+	c.send("spam")
+	if msg, err := c.expect(typeError); err != nil || msg.Message != "だめです" {
+		t.Errorf("拒否する場合はerrorを返すべきです: %+v, %v", msg, err)
+	}
+	if len(room.messages()) != 1 {
+		t.Errorf("配信したメッセージだけを記録するべきです: %d", len(room.messages()))
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+var clamdAddr = flag.String("clamd", "", "アップロードされたファイルを検査するclamdのアドレス (例: tcp://localhost:3310, unix:///run/clamav/clamd.ctl。空の場合は検査しない)")
+
+// clamdChunkSize INSTREAMでclamdに送信する1チャンクの最大サイズ
+const clamdChunkSize = 64 * 1024
+
+// ErrInfected アップロードされたファイルからマルウェアが検出された場合に発生するエラー
+var ErrInfected = errors.New("chat: ファイルからマルウェアが検出されました。")
+
+// Scanner アップロードされたファイルをウイルス検査する
+type Scanner interface {
+	// Scan rの内容を検査し、マルウェアが検出された場合はシグネチャ名を返す
+	// 大きなファイルをメモリに読み込まずに済むように、内容は順に読み出して検査する
+	Scan(r io.Reader) (string, error)
+}
+
+// nopScanner 何も検査しないScanner
+type nopScanner struct{}
+
+func (nopScanner) Scan(io.Reader) (string, error) { return "", nil }
+
+// clamdScanner clamdのINSTREAMコマンドで検査するScanner
+type clamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// newClamdScanner tcp://host:port またはunix:///path形式のアドレスからclamdScannerを生成する
+func newClamdScanner(addr string) (*clamdScanner, error) {
+	s := &clamdScanner{timeout: 30 * time.Second}
+	switch {
+	case strings.HasPrefix(addr, "tcp://"):
+		s.network, s.address = "tcp", strings.TrimPrefix(addr, "tcp://")
+	case strings.HasPrefix(addr, "unix://"):
+		s.network, s.address = "unix", strings.TrimPrefix(addr, "unix://")
+	default:
+		return nil, fmt.Errorf("chat: clamdのアドレスが不正です: %s", addr)
+	}
+	return s, nil
+}
+
+// command clamdにコマンドを送信し、応答を返す。INSTREAMではbodyをチャンクに分けて送信する
+func (s *clamdScanner) command(cmd string, body io.Reader) (string, error) {
+	conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.timeout))
+	w := bufio.NewWriter(conn)
+	w.WriteString("z" + cmd + "\x00")
+	if cmd == "INSTREAM" {
+		chunk := make([]byte, clamdChunkSize)
+		for {
+			n, err := io.ReadFull(body, chunk)
+			if n > 0 {
+				binary.Write(w, binary.BigEndian, uint32(n))
+				w.Write(chunk[:n])
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			} else if err != nil {
+				return "", err
+			}
+		}
+		binary.Write(w, binary.BigEndian, uint32(0))
+	}
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	res, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(res, "\x00")), nil
+}
+
+// Ping clamdが応答するかどうかを確認する
+func (s *clamdScanner) Ping() error {
+	res, err := s.command("PING", nil)
+	if err != nil {
+		return err
+	}
+	if res != "PONG" {
+		return fmt.Errorf("chat: clamdから想定外の応答がありました: %s", res)
+	}
+	return nil
+}
+
+func (s *clamdScanner) Scan(r io.Reader) (string, error) {
+	res, err := s.command("INSTREAM", r)
+	if err != nil {
+		return "", err
+	}
+	// 応答は "stream: OK" または "stream: <シグネチャ> FOUND"
+	res = strings.TrimPrefix(res, "stream: ")
+	switch {
+	case res == "OK":
+		return "", nil
+	case strings.HasSuffix(res, " FOUND"):
+		return strings.TrimSuffix(res, " FOUND"), nil
+	}
+	return "", fmt.Errorf("chat: clamdでの検査に失敗しました: %s", res)
+}
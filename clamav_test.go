@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeClamd INSTREAMで受け取った内容に応じて応答する偽のclamd
+// 内容にEICARを含む場合は検出、ERRORを含む場合はエラーを返す
+func fakeClamd(t *testing.T) (addr string, received chan []byte) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received = make(chan []byte, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeClamd(conn, received)
+		}
+	}()
+	return "tcp://" + ln.Addr().String(), received
+}
+
+func serveFakeClamd(conn net.Conn, received chan []byte) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	switch cmd {
+	case "zPING\x00":
+		conn.Write([]byte("PONG\x00"))
+		return
+	case "zINSTREAM\x00":
+	default:
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+	var data []byte
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return
+		}
+		data = append(data, chunk...)
+	}
+	received <- data
+	switch {
+	case bytes.Contains(data, []byte("EICAR")):
+		conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+	case bytes.Contains(data, []byte("ERROR")):
+		conn.Write([]byte("stream: INSTREAM size limit exceeded. ERROR\x00"))
+	default:
+		conn.Write([]byte("stream: OK\x00"))
+	}
+}
+
+func TestClamdScanner(t *testing.T) {
+	addr, received := fakeClamd(t)
+	s, err := newClamdScanner(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ping(); err != nil {
+		t.Errorf("PINGにPONGが返れば成功するべきです: %v", err)
+	}
+	tests := []struct {
+		content   string
+		signature string
+		err       bool
+	}{
+		{"hello world", "", false},
+		{"X5O!P%@AP EICAR-STANDARD-ANTIVIRUS-TEST-FILE!", "Eicar-Test-Signature", false},
+		// チャンクの区切りをまたいで送信する
+		{strings.Repeat("a", clamdChunkSize*2+10) + "EICAR", "Eicar-Test-Signature", false},
+		{strings.Repeat("a", clamdChunkSize), "", false},
+		{"ERROR", "", true},
+	}
+	for _, test := range tests {
+		name := test.content
+		if len(name) > 20 {
+			name = name[:20] + "..."
+		}
+		signature, err := s.Scan(strings.NewReader(test.content))
+		if signature != test.signature || (err != nil) != test.err {
+			t.Errorf("%q: %q、エラー%vになるべきところ%q、%vでした", name, test.signature, test.err, signature, err)
+		}
+		if data := <-received; string(data) != test.content {
+			t.Errorf("%q: 内容をそのまま送信するべきですが%dバイトでした", name, len(data))
+		}
+	}
+}
+
+func TestNewClamdScanner(t *testing.T) {
+	tests := []struct {
+		addr             string
+		network, address string
+		err              bool
+	}{
+		{"tcp://localhost:3310", "tcp", "localhost:3310", false},
+		{"unix:///run/clamav/clamd.ctl", "unix", "/run/clamav/clamd.ctl", false},
+		{"localhost:3310", "", "", true},
+	}
+	for _, test := range tests {
+		s, err := newClamdScanner(test.addr)
+		if (err != nil) != test.err {
+			t.Errorf("%s: エラーになるかどうかが%vになるべきところ%vでした", test.addr, test.err, err)
+			continue
+		}
+		if err == nil && (s.network != test.network || s.address != test.address) {
+			t.Errorf("%s: %s %sになるべきところ%s %sでした", test.addr, test.network, test.address, s.network, s.address)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// command サブコマンド
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+// commands gochat <サブコマンド> で実行できるコマンド
+// サブコマンドを省略した場合はserveを実行する
+var commands = map[string]command{
+	"serve":      {"Webサーバーを起動する", serveCommand},
+	"migrate":    {"データベースのスキーマを移行する (up, down, status)", migrateCommand},
+	"seed":       {"デモ用のユーザーとメッセージの履歴をデータベースに作成する", seedCommand},
+	"bench":      {"動作中のサーバーに負荷をかけて配信の遅延を測定する", benchCommand},
+	"adduser":    {"動作中のサーバーにユーザーを事前に登録する", addUserCommand},
+	"export":     {"動作中のサーバーからユーザーのデータをZIPで取り出す", exportCommand},
+	"gc-uploads": {"動作中のサーバーで参照されていない添付ファイルを削除する", gcUploadsCommand},
+}
+
+// ErrUnknownCommand 存在しないサブコマンドが指定された場合に発生するエラー
+var ErrUnknownCommand = errors.New("chat: サブコマンドが見つかりません。")
+
+// runCommand 引数からサブコマンドを選んで実行する
+func runCommand(args []string) error {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		printCommands(os.Stderr)
+		return fmt.Errorf("%w: %s", ErrUnknownCommand, name)
+	}
+	return cmd.run(args)
+}
+
+// printCommands サブコマンドの一覧を出力する
+func printCommands(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "使い方: gochat <サブコマンド> [フラグ]")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-12s %s\n", name, commands[name].usage)
+	}
+}
+
+func serveCommand(args []string) error {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	// 平文で設定に書かずに済むよう、シークレットの参照を起動時に解決する
+	if err := resolveSecretFlags(flag.CommandLine); err != nil {
+		return err
+	}
+	serve()
+	return nil
+}
+
+// adminClient 動作中のサーバーの管理者用APIを呼び出す
+// メモリ上のストアはサーバーのプロセスにしかないため、運用のコマンドはAPIを経由して操作する
+type adminClient struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+// adminFlags 管理者用APIを呼び出すコマンドに共通のフラグを登録する
+func adminFlags(fs *flag.FlagSet) *adminClient {
+	c := &adminClient{client: &http.Client{Timeout: 5 * time.Minute}}
+	fs.StringVar(&c.server, "server", "http://localhost:8080", "操作するサーバーのURL")
+	fs.StringVar(&c.token, "token", os.Getenv("GOCHAT_TOKEN"), "管理者のAPIキー (省略した場合は環境変数GOCHAT_TOKEN)")
+	return c
+}
+
+// do 管理者用APIを呼び出す。bodyがnilでない場合はJSONとして送信する
+func (c *adminClient) do(method, path string, body interface{}) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.server, "/")+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, fmt.Errorf("chat: サーバーがエラーを返しました: %s %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return res, nil
+}
+
+// printJSON レスポンスのJSONを整形して標準出力に書き出す
+func printJSON(res *http.Response) error {
+	defer res.Body.Close()
+	var v interface{}
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func addUserCommand(args []string) error {
+	fs := flag.NewFlagSet("adduser", flag.ExitOnError)
+	c := adminFlags(fs)
+	var u newUserRequest
+	fs.StringVar(&u.Name, "name", "", "ユーザー名 (必須)")
+	fs.StringVar(&u.Email, "email", "", "メールアドレス")
+	fs.StringVar(&u.Provider, "provider", "", "ログインに使う認証プロバイダー (例: google)")
+	fs.StringVar(&u.ProviderID, "provider-id", "", "認証プロバイダー上のID")
+	fs.StringVar(&u.Role, "role", roleUser, "役割 (moderator または admin)")
+	fs.Parse(args)
+	if u.Name == "" {
+		fs.Usage()
+		return errors.New("chat: -nameを指定してください。")
+	}
+	res, err := c.do(http.MethodPost, "/api/admin/users", &u)
+	if err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	c := adminFlags(fs)
+	userID := fs.String("user", "", "エクスポートするユーザーのID (必須)")
+	out := fs.String("o", "", "出力先のファイル (省略した場合は{ユーザーID}.zip)")
+	fs.Parse(args)
+	if *userID == "" {
+		fs.Usage()
+		return errors.New("chat: -userを指定してください。")
+	}
+	if *out == "" {
+		*out = *userID + ".zip"
+	}
+	res, err := c.do(http.MethodGet, "/api/admin/users/"+*userID+"/export", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, res.Body); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Println("エクスポートしました:", *out)
+	return nil
+}
+
+func gcUploadsCommand(args []string) error {
+	fs := flag.NewFlagSet("gc-uploads", flag.ExitOnError)
+	c := adminFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "削除せずに対象を数えるだけにする")
+	grace := fs.Duration("grace", 24*time.Hour, "参照されていない添付ファイルを削除するまでの猶予期間")
+	fs.Parse(args)
+	res, err := c.do(http.MethodPost, fmt.Sprintf("/api/admin/uploads/gc?dry_run=%t&grace=%s", *dryRun, *grace), nil)
+	if err != nil {
+		return err
+	}
+	return printJSON(res)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	defer func(c map[string]command) { commands = c }(commands)
+	var ran string
+	record := func(name string) func([]string) error {
+		return func(args []string) error {
+			ran = name + ":" + strings.Join(args, " ")
+			return nil
+		}
+	}
+	commands = map[string]command{
+		"serve":   {"", record("serve")},
+		"adduser": {"", record("adduser")},
+	}
+	tests := []struct {
+		args []string
+		ran  string
+		err  error
+	}{
+		{nil, "serve:", nil},
+		{[]string{"-addr", ":8081"}, "serve:-addr :8081", nil},
+		{[]string{"adduser", "-name", "Alice"}, "adduser:-name Alice", nil},
+		{[]string{"unknown"}, "", ErrUnknownCommand},
+	}
+	for _, test := range tests {
+		ran = ""
+		if err := runCommand(test.args); !errors.Is(err, test.err) || ran != test.ran {
+			t.Errorf("%v: %q、%vになるべきところ%q、%vでした", test.args, test.ran, test.err, ran, err)
+		}
+	}
+}
+
+func TestCreateUserByAdmin(t *testing.T) {
+	defer func(s UserStore) { users = s }(users)
+	users = newMemoryUserStore()
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"name": "Alice", "role": "moderator", "provider": "google", "provider_id": "1"}`, http.StatusCreated},
+		{`{"name": "Bob", "role": "owner"}`, http.StatusBadRequest},
+		{`{"name": "Carol", "provider": "google"}`, http.StatusBadRequest},
+		{`{"name": " "}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/api/admin/users", strings.NewReader(test.body))
+		r = r.WithContext(withUser(r.Context(), sessionUser{uniqueID: "admin"}))
+		w := httptest.NewRecorder()
+		adminUsersHandler(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: %dになるべきところ%dでした", test.body, test.code, w.Code)
+		}
+	}
+	record, err := users.GetByProviderID("google", "1")
+	if err != nil || record.Name != "Alice" || record.Role != roleModerator {
+		t.Errorf("登録したユーザーを保存するべきです: %+v, %v", record, err)
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	defer func(s UserStore) { users = s }(users)
+	users = newMemoryUserStore()
+	var gcQuery string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/admin/users/", adminUsersHandler)
+	mux.HandleFunc("/api/admin/users", adminUsersHandler)
+	mux.HandleFunc("/api/admin/uploads/gc", func(w http.ResponseWriter, r *http.Request) {
+		gcQuery = r.URL.RawQuery
+		writeJSON(w, http.StatusOK, map[string]interface{}{"orphans": 0})
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer admin-key" {
+			writeJSONError(w, r, "トークンが無効です", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r.WithContext(withUser(r.Context(), sessionUser{uniqueID: "admin"})))
+	}))
+	defer server.Close()
+	common := []string{"-server", server.URL, "-token", "admin-key"}
+
+	if err := addUserCommand(append(common, "-name", "Alice", "-provider", "github", "-provider-id", "42")); err != nil {
+		t.Fatal(err)
+	}
+	record, err := users.GetByProviderID("github", "42")
+	if err != nil {
+		t.Fatalf("adduserでユーザーを登録するべきです: %v", err)
+	}
+	if err := addUserCommand([]string{"-server", server.URL, "-token", "wrong", "-name", "Bob"}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("サーバーのエラーを返すべきです: %v", err)
+	}
+	if err := addUserCommand(common); err == nil {
+		t.Error("-nameがない場合はエラーにするべきです")
+	}
+
+	out := filepath.Join(t.TempDir(), "export.zip")
+	if err := exportCommand(append(common, "-user", record.ID, "-o", out)); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.OpenReader(out)
+	if err != nil {
+		t.Fatalf("exportでZIPを保存するべきです: %v", err)
+	}
+	z.Close()
+	if err := exportCommand(append(common, "-user", "nobody", "-o", out)); err == nil {
+		t.Error("存在しないユーザーのエクスポートはエラーにするべきです")
+	}
+
+	if err := gcUploadsCommand(append(common, "-dry-run", "-grace", "1h")); err != nil {
+		t.Fatal(err)
+	}
+	if gcQuery != "dry_run=true&grace=1h0m0s" {
+		t.Errorf("フラグをクエリパラメーターとして送るべきです: %s", gcQuery)
+	}
+}
@@ -1,13 +1,27 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-//clientはチャットを行なっている１人のユーザーを表す
+// closeWriteWait クローズフレームの送信を待つ時間
+const closeWriteWait = time.Second
+
+// closeReasonIdle 一定時間応答のないクライアントを切断する際のクローズ理由
+const closeReasonIdle = "disconnect_idle"
+
+var idleTimeout = flag.Duration("idle-timeout", 2*time.Minute, "メッセージもPongも送信しないクライアントを切断するまでの時間 (0の場合は切断しない)")
+
+// clientはチャットを行なっている１人のユーザーを表す
 type client struct {
+	// idはこの接続を識別するID
+	id string
 	// socketはこのクライアントのためのWebSocket
 	socket *websocket.Conn
 	// sendはメッセージが送られるチャネル
@@ -16,30 +30,300 @@ type client struct {
 	room *room
 	// userDataはユーザーに関する情報を保持する
 	userData map[string]interface{}
+	// requestIDはこの接続を確立したHTTPリクエストのID
+	requestID string
+	// versionはこのクライアントと合意したプロトコルのバージョン
+	version int
+	// capsは接続時にクライアントが宣言した能力。接続後は変更しない
+	caps capabilities
+	// droppedは送信バッファが一杯のため破棄したイベントの数。room.runのゴルーチンからのみ参照する
+	dropped int
+	// closeCodeとcloseReasonはチャットルームがsendを閉じる際に設定するクローズ理由
+	closeCode   int
+	closeReason string
+	// admittedはルームに参加済みかどうか。定員に達したルームで待機している間は偽
+	admitted atomic.Bool
+	// streamは確認応答モードの配信ストリーム。ackを宣言していない場合はnil
+	stream *ackStream
+	// writesとwriteNanosは書き込んだイベントの数とその時間の合計 (deliveryClientsを参照)
+	writes     atomic.Int64
+	writeNanos atomic.Int64
+	// readDoneとwriteDoneは受信・送信のゴルーチンが終了したかどうか。writingは書き込み中のイベントの開始時刻(UnixNano)
+	// suspectedLeakは前回の照合で漏れと判定した種類。room.runのゴルーチンからのみ参照する (checkLeaksを参照)
+	readDone      atomic.Bool
+	writeDone     atomic.Bool
+	writing       atomic.Int64
+	suspectedLeak string
 }
 
 func (c *client) read() {
+	defer c.readDone.Store(true)
+	if *idleTimeout > 0 {
+		// メッセージかPongを受信するたびに期限を延長する
+		c.socket.SetReadDeadline(time.Now().Add(*idleTimeout))
+		c.socket.SetPongHandler(func(string) error {
+			return c.socket.SetReadDeadline(time.Now().Add(*idleTimeout))
+		})
+	}
+	c.socket.SetReadLimit(maxFrameSize)
 	for {
-		var msg *message
-		if err := c.socket.ReadJSON(&msg); err == nil {
-			msg.When = time.Now()
-			msg.Name = c.userData["name"].(string)
-			if avatarURL, ok := c.userData["avatar_url"]; ok {
-				msg.AvatarURL = avatarURL.(string)
-			}
-			c.room.forward <- msg
-		} else {
+		_, data, err := c.socket.ReadMessage()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				c.close(websocket.CloseGoingAway, closeReasonIdle)
+			}
 			break
 		}
+		if *idleTimeout > 0 {
+			c.socket.SetReadDeadline(time.Now().Add(*idleTimeout))
+		}
+		msg, err := decodeMessage(data)
+		if err != nil {
+			c.reply(errorMessage(err.Error()))
+			continue
+		}
+		c.handle(msg)
 	}
 	c.socket.Close()
 }
 
+// handleはクライアントから受信したイベントを種類に応じて処理する
+func (c *client) handle(msg *message) {
+	switch msg.Type {
+	case typeChat, typeSticker, typeGIF, typeCode:
+		if !c.admitted.Load() {
+			c.reply(errorEvent(errRoomFull, "ルームに参加するまで投稿できません。"))
+			return
+		}
+		if !c.room.canPost(c.userID()) {
+			c.reply(errorEvent(errReadOnly, "このルームは読み取り専用です。投稿できるのはオーナーとモデレーターだけです。"))
+			return
+		}
+		msg.ID = randomID()
+		msg.Room = c.room.name
+		msg.When = time.Now()
+		msg.UserID = c.userID()
+		msg.Name = c.userData["name"].(string)
+		if avatarURL, ok := c.userData["avatar_url"]; ok {
+			msg.AvatarURL = avatarURL.(string)
+		}
+		// 転送元はforwardMessageだけが、自動応答の印はautoRespondだけが設定する
+		msg.resetServerFields()
+		if msg.Type != typeSticker {
+			msg.Sticker = nil
+		}
+		if msg.Type != typeGIF {
+			msg.GIF = nil
+		}
+		if msg.Type != typeCode {
+			msg.Snippet = nil
+		}
+		var err error
+		switch msg.Type {
+		case typeSticker:
+			err = resolveSticker(c.userID(), msg)
+		case typeGIF:
+			err = resolveGIF(msg)
+		case typeCode:
+			err = resolveCode(msg)
+		}
+		if err != nil {
+			c.reply(errorEvent(errBadRequest, err.Error()))
+			return
+		}
+		if len(msg.ClientID) > maxClientIDLength {
+			c.reply(errorEvent(errBadRequest, ErrInvalidClientID.Error()))
+			return
+		}
+		if err := runMessageHooks(msg); err != nil {
+			c.reply(errorMessage(err.Error()))
+			return
+		}
+		var mentioned []string
+		msg.Mentions = nil
+		if msg.Type == typeChat {
+			msg.Mentions, mentioned = resolveMentions(msg.Message)
+		}
+		if clientID := msg.ClientID; clientID != "" {
+			// 他のクライアントには不要なため、対応はsentイベントで本人にだけ知らせる
+			msg.ClientID = ""
+			id, first := c.room.sent.claim(msg.UserID, clientID, msg.ID, msg.When)
+			c.reply(sentEvent(clientID, id))
+			if !first {
+				return
+			}
+		}
+		if isShadowBanned(msg.UserID) {
+			// 本人のクライアントにだけ送り返し、他のユーザーへの転送と保存は行わない
+			c.room.sendDirect(msg)
+			return
+		}
+		c.room.Broadcast(msg)
+		if len(mentioned) > 0 {
+			// メールの送信などで受信を止めないように別のゴルーチンで知らせる
+			go notifyMentioned(msg, mentioned)
+		}
+	case typeAck:
+		if c.stream == nil {
+			c.reply(errorMessage("非対応のイベントです: " + msg.Type))
+			return
+		}
+		c.stream.ack(msg.Seq)
+	case typeHello:
+		version, err := negotiateVersion(msg.Version)
+		if err != nil {
+			c.reply(errorEvent(errUnsupportedVersion, err.Error()))
+			return
+		}
+		c.version = features.capVersion(version, c.room.name, c.userID())
+		c.reply(welcomeEvent(c.version, c.room.name, c.userID()))
+	case typeReport:
+		if !c.enabled(featureReport) {
+			c.reply(errorMessage("非対応のイベントです: " + msg.Type))
+			return
+		}
+		target, err := c.roomMessage(msg.Ref)
+		if err != nil {
+			c.reply(errorMessage(err.Error()))
+			return
+		}
+		if _, err := reportMessage(c.userID(), target.ID, msg.Message); err != nil {
+			c.reply(errorMessage(err.Error()))
+			return
+		}
+		c.reply(&message{Type: typeReportReceived, Ref: msg.Ref, When: time.Now()})
+	case typeRemind:
+		if !c.enabled(featureRemind) {
+			c.reply(errorMessage("非対応のイベントです: " + msg.Type))
+			return
+		}
+		target, err := c.roomMessage(msg.Ref)
+		if err != nil {
+			c.reply(errorMessage(err.Error()))
+			return
+		}
+		reminder, err := createReminder(c.userID(), target, msg.Message)
+		if err != nil {
+			c.reply(errorMessage(err.Error()))
+			return
+		}
+		c.reply(&message{Type: typeReminderSet, Ref: msg.Ref, Message: reminder.At.Format(time.RFC3339), When: time.Now()})
+	case typeTranslate:
+		if !c.enabled(featureTranslate) {
+			c.reply(errorMessage("非対応のイベントです: " + msg.Type))
+			return
+		}
+		// 翻訳は時間がかかるため受信ループを止めないように別のゴルーチンで行う
+		go func() {
+			target, err := c.roomMessage(msg.Ref)
+			if err != nil {
+				c.reply(errorMessage(err.Error()))
+				return
+			}
+			text, err := translations.translateMessage(translator, target, msg.Lang)
+			if err != nil {
+				c.reply(errorMessage(err.Error()))
+				return
+			}
+			c.reply(&message{Type: typeTranslation, Ref: msg.Ref, Lang: msg.Lang, Message: text, When: time.Now()})
+		}()
+	default:
+		c.reply(errorMessage("非対応のイベントです: " + msg.Type))
+	}
+}
+
+// roomMessageは参加しているルームのメッセージを返す
+// 他のルームのメッセージは参加の確認を経ていないため、存在しないものとして扱う
+func (c *client) roomMessage(id string) (*message, error) {
+	msg, err := messages.Get(id)
+	if err != nil || msg.Room != c.room.name {
+		return nil, ErrMessageNotFound
+	}
+	return msg, nil
+}
+
+// replyはこのクライアントだけにイベントを送信する
+func (c *client) reply(msg *message) {
+	select {
+	case c.room.reply <- &reply{client: c, msg: msg}:
+	case <-c.room.done:
+	}
+}
+
+// enabledは機能フラグでこのクライアントに機能が有効になっているかどうかを返す
+func (c *client) enabled(feature string) bool {
+	return features.Enabled(feature, c.room.name, c.userID())
+}
+
+func (c *client) userID() string {
+	return c.userData["userid"].(string)
+}
+
 func (c *client) write() {
-	for msg := range c.send {
-		if err := c.socket.WriteJSON(msg); err != nil {
-			break
+	defer c.writeDone.Store(true)
+	// 応答のないクライアントを見つけるため、期限の半分ごとにPingを送信する
+	var ping <-chan time.Time
+	if *idleTimeout > 0 {
+		ticker := time.NewTicker(*idleTimeout / 2)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	if c.stream != nil {
+		// 前の接続で確認されなかったイベントを先に再送する
+		for _, msg := range c.stream.unacked() {
+			if err := c.socket.WriteJSON(msg); err != nil {
+				c.socket.Close()
+				return
+			}
+		}
+	}
+loop:
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				break loop
+			}
+			if c.stream != nil && tracked(msg) {
+				msg = c.stream.track(msg)
+			}
+			var err error
+			start := time.Now()
+			c.writing.Store(start.UnixNano())
+			if msg.prepared != nil {
+				err = c.socket.WritePreparedMessage(msg.prepared)
+			} else {
+				err = c.socket.WriteJSON(msg)
+			}
+			c.writing.Store(0)
+			c.observeWrite(start)
+			if err != nil {
+				c.socket.Close()
+				return
+			}
+		case <-ping:
+			if err := c.socket.WriteControl(websocket.PingMessage, nil, time.Now().Add(closeWriteWait)); err != nil {
+				c.socket.Close()
+				return
+			}
+		}
+	}
+	if c.closeCode == 0 {
+		c.closeCode = websocket.CloseNormalClosure
+	}
+	c.close(c.closeCode, c.closeReason)
+}
+
+// close クローズ理由にリクエストIDを付けてクローズフレームを送信し、接続を閉じる
+func (c *client) close(code int, reason string) {
+	if c.requestID != "" {
+		if reason != "" {
+			reason += " "
 		}
+		reason += "request_id=" + c.requestID
 	}
+	c.socket.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason), time.Now().Add(closeWriteWait))
 	c.socket.Close()
 }
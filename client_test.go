@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHandleResetsServerFields(t *testing.T) {
+	defer func(b *eventBus) { events = b }(events)
+	events = newEventBus()
+	received := make(chan *message, 1)
+	events.Subscribe(EventMessageBroadcast, func(e Event) { received <- e.Message })
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	rm, err := rooms.get("general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{room: rm, send: make(chan *message, 1), userData: map[string]interface{}{"userid": "u1", "name": "Alice"}}
+	c.admitted.Store(true)
+
+	expires := time.Now()
+	c.handle(&message{
+		Type: typeChat, Message: "こんにちは",
+		Ephemeral: true, Seq: 42, Stream: "s1", Position: 1, Code: errRoomFull, Expires: &expires,
+		Status: &UserStatus{}, RoomInfo: &RoomInfo{Name: "general"}, Highlights: []string{"障害"},
+		Forwarded: &ForwardInfo{Room: "random"}, Auto: true,
+	})
+	select {
+	case msg := <-received:
+		if msg.Ephemeral || msg.Seq != 0 || msg.Stream != "" || msg.Position != 0 || msg.Code != "" || msg.Expires != nil ||
+			msg.Status != nil || msg.RoomInfo != nil || msg.Highlights != nil || msg.Forwarded != nil || msg.Auto {
+			t.Errorf("サーバーだけが設定するフィールドは取り除くべきです: %+v", msg)
+		}
+		if msg.Message != "こんにちは" || msg.UserID != "u1" {
+			t.Errorf("投稿の内容は変更するべきではありません: %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("投稿が配信されませんでした")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	defer func(d time.Duration) { *idleTimeout = d }(*idleTimeout)
+	*idleTimeout = 300 * time.Millisecond
+	if err := sessions.Create(&Session{ID: "idle-session", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.Delete("idle-session")
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	mux := http.NewServeMux()
+	mux.Handle("/room", MustAuth(rooms))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	cookie := authCookie(&fakeUser{id: "u1", name: "アリス"}, "idle-session")
+
+	tests := []struct {
+		name string
+		pong bool
+		idle bool
+	}{
+		{"Pongを返すクライアント", true, false},
+		{"Pongを返さないクライアント", false, true},
+	}
+	for _, test := range tests {
+		c, err := dialRoom(server.URL, url.Values{"room": {"idle"}}, cookie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.expect(typeWelcome); err != nil {
+			t.Fatal(err)
+		}
+		if !test.pong {
+			c.conn.SetPingHandler(func(string) error { return nil })
+		}
+		// 期限の数倍の間読み続け、切断されるかどうかを確かめる
+		c.timeout = 4 * *idleTimeout
+		for {
+			_, err = c.next()
+			if err != nil {
+				break
+			}
+		}
+		var closeErr *websocket.CloseError
+		switch {
+		case !test.idle && err != errTestTimeout:
+			t.Errorf("%s: 切断するべきではありませんが%vでした", test.name, err)
+		case test.idle && !(errors.As(err, &closeErr) && closeErr.Code == websocket.CloseGoingAway && strings.HasPrefix(closeErr.Text, closeReasonIdle)):
+			t.Errorf("%s: going awayと%sで切断するべきところ%vでした", test.name, closeReasonIdle, err)
+		}
+		c.conn.Close()
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+var (
+	clusterURL           = flag.String("cluster", "", "ノード間でルームのイベントを中継するバックエンドのURL (例: nats://localhost:4222。空の場合は単一ノードで動作する)")
+	clusterSubjectPrefix = flag.String("cluster-subject-prefix", "gochat.room", "NATSでルームのイベントを送受信するサブジェクトの接頭辞")
+)
+
+// ノード間で中継するイベントの種類
+const (
+	// clusterBroadcastはmsg.Roomの在室者全員に配信するイベント
+	clusterBroadcast = ""
+	// clusterDirectはmsg.UserIDのユーザーのクライアントにだけ配信するイベント
+	clusterDirect = "direct"
+	// clusterKickはmsg.UserIDのユーザーをmsg.Messageの理由で退出させる要求
+	clusterKick = "kick"
+)
+
+// Broadcaster 複数のノードの間でルームのイベントを中継する
+type Broadcaster interface {
+	// Publish 他のノードに種類がkindのイベントを送信する
+	Publish(kind string, msg *message) error
+	// Subscribe 他のノードから受信したイベントを種類とともにhandlerに渡す
+	Subscribe(handler func(kind string, msg *message)) error
+	Close() error
+}
+
+// clusterEnvelope ノード間で送受信するイベント
+type clusterEnvelope struct {
+	// Nodeは送信元のノードのID。自分が送信したイベントを受け取らないために使う
+	Node    string
+	Kind    string `json:",omitempty"`
+	Message *message
+}
+
+// newBroadcaster URLのスキームに従ってBroadcasterを生成する
+func newBroadcaster(url string) (Broadcaster, error) {
+	switch {
+	case strings.HasPrefix(url, "nats://"), strings.HasPrefix(url, "tls://"):
+		return newNATSBroadcaster(url, *clusterSubjectPrefix)
+	}
+	return nil, fmt.Errorf("chat: 非対応のクラスターのバックエンドです: %s", url)
+}
+
+// natsBroadcaster NATSでルームごとのサブジェクトにイベントを送受信するBroadcaster
+type natsBroadcaster struct {
+	conn   *nats.Conn
+	prefix string
+	node   string
+	subs   []*nats.Subscription
+}
+
+func newNATSBroadcaster(url, prefix string) (*natsBroadcaster, error) {
+	conn, err := nats.Connect(url,
+		nats.Name("gochat"),
+		// 接続が切れても再接続を試み続ける
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(2*time.Second),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Println("NATSから切断されました:", err)
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Println("NATSに再接続しました:", c.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &natsBroadcaster{conn: conn, prefix: prefix, node: randomID()}, nil
+}
+
+// subject ルームのイベントを送受信するサブジェクト
+// お知らせやユーザー宛てのイベントのようにルームを持たないイベントは接頭辞だけのサブジェクトを使う
+func (b *natsBroadcaster) subject(room string) string {
+	if room == "" {
+		return b.prefix
+	}
+	return b.prefix + "." + room
+}
+
+func (b *natsBroadcaster) Publish(kind string, msg *message) error {
+	data, err := json.Marshal(&clusterEnvelope{Node: b.node, Kind: kind, Message: msg})
+	if err != nil {
+		return err
+	}
+	return b.conn.Publish(b.subject(msg.Room), data)
+}
+
+func (b *natsBroadcaster) Subscribe(handler func(kind string, msg *message)) error {
+	receive := func(m *nats.Msg) {
+		var env clusterEnvelope
+		if err := json.Unmarshal(m.Data, &env); err != nil || env.Message == nil {
+			log.Println("NATSから不正なイベントを受信しました:", m.Subject)
+			return
+		}
+		if env.Node == b.node {
+			return
+		}
+		handler(env.Kind, env.Message)
+	}
+	for _, subject := range []string{b.subject(""), b.subject("*")} {
+		sub, err := b.conn.Subscribe(subject, receive)
+		if err != nil {
+			return err
+		}
+		b.subs = append(b.subs, sub)
+	}
+	return nil
+}
+
+func (b *natsBroadcaster) Close() error {
+	for _, sub := range b.subs {
+		sub.Unsubscribe()
+	}
+	return b.conn.Drain()
+}
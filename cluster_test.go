@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNATS NATSのテキストプロトコルのうちPUB、SUB、UNSUB、PINGだけに対応する偽のサーバー
+type fakeNATS struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	subs map[net.Conn]map[string]string // 接続ごとのsidとサブジェクト
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeNATS{ln: ln, subs: make(map[net.Conn]map[string]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeNATS) url() string {
+	return "nats://" + s.ln.Addr().String()
+}
+
+func (s *fakeNATS) Close() {
+	s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.subs {
+		conn.Close()
+	}
+}
+
+func (s *fakeNATS) serve(conn net.Conn) {
+	s.mu.Lock()
+	s.subs[conn] = make(map[string]string)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	s.write(conn, `INFO {"server_id":"fake","version":"2.10.0","proto":1,"max_payload":1048576}`+"\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			s.write(conn, "PONG\r\n")
+		case "SUB":
+			// SUB <サブジェクト> [キューグループ] <sid>
+			s.mu.Lock()
+			s.subs[conn][args[len(args)-1]] = args[1]
+			s.mu.Unlock()
+		case "UNSUB":
+			s.mu.Lock()
+			delete(s.subs[conn], args[1])
+			s.mu.Unlock()
+		case "PUB":
+			// PUB <サブジェクト> [返信先] <バイト数>
+			size, _ := strconv.Atoi(args[len(args)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			s.route(args[1], payload[:size])
+		}
+	}
+}
+
+// route サブジェクトに一致する購読を持つ全ての接続にメッセージを送る
+func (s *fakeNATS) route(subject string, payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, subs := range s.subs {
+		for sid, pattern := range subs {
+			if subjectMatches(pattern, subject) {
+				s.write(conn, fmt.Sprintf("MSG %s %s %d\r\n%s\r\n", subject, sid, len(payload), payload))
+			}
+		}
+	}
+}
+
+func (s *fakeNATS) write(conn net.Conn, data string) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte(data))
+}
+
+// subjectMatches *を1つのトークン、>を残り全てに一致させてサブジェクトを比較する
+func subjectMatches(pattern, subject string) bool {
+	p, s := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, token := range p {
+		if token == ">" {
+			return len(s) > i
+		}
+		if i >= len(s) || (token != "*" && token != s[i]) {
+			return false
+		}
+	}
+	return len(p) == len(s)
+}
+
+// clusterEvent Broadcasterが受信したイベント
+type clusterEvent struct {
+	kind string
+	msg  *message
+}
+
+func TestNATSBroadcaster(t *testing.T) {
+	server := newFakeNATS(t)
+	defer server.Close()
+	subscribe := func() (*natsBroadcaster, chan clusterEvent) {
+		b, err := newNATSBroadcaster(server.url(), "test.room")
+		if err != nil {
+			t.Fatal(err)
+		}
+		received := make(chan clusterEvent, 10)
+		if err := b.Subscribe(func(kind string, msg *message) { received <- clusterEvent{kind, msg} }); err != nil {
+			t.Fatal(err)
+		}
+		// 購読がサーバーに届いてから送信を始める
+		if err := b.conn.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return b, received
+	}
+	a, fromB := subscribe()
+	defer a.Close()
+	b, fromA := subscribe()
+	defer b.Close()
+
+	tests := []struct {
+		kind string
+		msg  *message
+	}{
+		{clusterBroadcast, &message{Room: "general", Name: "アリス", Message: "こんにちは"}},
+		{clusterDirect, &message{Room: "random", UserID: "u2", Message: "内緒です"}},
+		{clusterKick, &message{UserID: "u2", Message: "規約違反"}},
+	}
+	for _, test := range tests {
+		if err := a.Publish(test.kind, test.msg); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case ev := <-fromA:
+			if ev.kind != test.kind || ev.msg.Room != test.msg.Room || ev.msg.UserID != test.msg.UserID || ev.msg.Message != test.msg.Message {
+				t.Errorf("%q %+v: 送信したイベントを受信するべきですが%q %+vでした", test.kind, test.msg, ev.kind, ev.msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q %+v: 他のノードで受信できませんでした", test.kind, test.msg)
+		}
+	}
+
+	// 不正なイベントは読み飛ばし、後続のイベントは受信を続ける
+	if err := a.conn.Publish(a.subject("general"), []byte("{壊れたJSON")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(clusterBroadcast, &message{Room: "general", Message: "返信"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-fromB:
+		if ev.msg.Message != "返信" {
+			t.Errorf("不正なイベントは受信しないべきですが%+vを受信しました", ev.msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("逆向きに送信したイベントを受信できませんでした")
+	}
+
+	// 自分が送信したイベントは受け取らない
+	a.conn.Flush()
+	b.conn.Flush()
+	select {
+	case ev := <-fromB:
+		t.Errorf("自分が送信したイベントを受信するべきではありません: %+v", ev.msg)
+	case ev := <-fromA:
+		t.Errorf("自分が送信したイベントを受信するべきではありません: %+v", ev.msg)
+	default:
+	}
+}
+
+func TestNewBroadcaster(t *testing.T) {
+	if _, err := newBroadcaster("redis://localhost:6379"); err == nil {
+		t.Error("非対応のバックエンドはエラーにするべきです")
+	}
+}
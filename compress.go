@@ -0,0 +1,213 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+var (
+	compressResponses = flag.Bool("compress", true, "クライアントが対応している場合にHTML、JSON、SSEのレスポンスをgzipまたはbrotliで圧縮する")
+	compressMinSize   = flag.Int("compress-min-size", 1024, "圧縮するレスポンスの最小サイズ (バイト。SSEには適用しない)")
+)
+
+// レスポンスの圧縮形式
+const (
+	encodingGzip   = "gzip"
+	encodingBrotli = "br"
+)
+
+// compressibleTypes 圧縮するレスポンスのContent-Type
+// 画像や添付ファイルなど既に圧縮されている形式は圧縮しない
+var compressibleTypes = map[string]bool{
+	"text/html":              true,
+	"text/plain":             true,
+	"text/css":               true,
+	"text/csv":               true,
+	"text/event-stream":      true,
+	"application/json":       true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+}
+
+// isEventStream SSEのように逐次送信されるレスポンスかどうかを判定する
+func isEventStream(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "text/event-stream"
+}
+
+// compressible Content-Typeが圧縮の対象かどうかを判定する
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && compressibleTypes[mediaType]
+}
+
+// negotiateEncoding Accept-Encodingからレスポンスの圧縮形式を選ぶ
+// 同じ優先度の場合はbrotliを優先する。どちらも受け付けない場合は空文字列を返す
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != encodingGzip && name != encodingBrotli {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > bestQ || (q == bestQ && q > 0 && name == encodingBrotli) {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// withCompression レスポンスを圧縮するミドルウェア
+// WebSocketへのアップグレードと範囲指定のリクエストは圧縮しない
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !*compressResponses || r.Method == http.MethodHead || r.Header.Get("Range") != "" ||
+			strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: *compressMinSize}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// encoder gzipとbrotliのWriterに共通のメソッド
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriter 最初のminSizeバイトを溜めてから圧縮するかどうかを決めるResponseWriter
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	status   int
+	buf      []byte
+	decided  bool
+	enc      encoder
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided || cw.status != 0 {
+		return
+	}
+	cw.status = status
+	// 本文のないレスポンスは圧縮しない
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.passThrough()
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.minSize || isEventStream(cw.Header().Get("Content-Type")) {
+		if err := cw.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide 溜めた内容とContent-Typeから圧縮するかどうかを決め、溜めた内容を書き出す
+func (cw *compressWriter) decide() error {
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	ct := h.Get("Content-Type")
+	// 範囲指定に対応するレスポンスは、再開したダウンロードのオフセットが元の内容と一致するよう圧縮しない
+	if h.Get("Content-Encoding") != "" || h.Get("Accept-Ranges") == "bytes" || !compressible(ct) || (len(cw.buf) < cw.minSize && !isEventStream(ct)) {
+		return cw.passThrough()
+	}
+	cw.decided = true
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", cw.encoding)
+	if cw.encoding == encodingBrotli {
+		cw.enc = brotli.NewWriterLevel(cw.ResponseWriter, brotli.DefaultCompression)
+	} else {
+		cw.enc = gzip.NewWriter(cw.ResponseWriter)
+	}
+	cw.writeStatus()
+	buf := cw.buf
+	cw.buf = nil
+	_, err := cw.enc.Write(buf)
+	return err
+}
+
+// passThrough 圧縮せずに溜めた内容を書き出す
+func (cw *compressWriter) passThrough() error {
+	cw.decided = true
+	cw.writeStatus()
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+func (cw *compressWriter) writeStatus() {
+	if cw.status != 0 {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+}
+
+// Flush SSEなどのストリーミングのため、圧縮中の内容も含めて送信する
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide()
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close ハンドラーの処理が終わった後に残りを書き出す
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		cw.decide()
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+	}
+}
+
+// Unwrap http.ResponseControllerが元のResponseWriterを参照できるようにする
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
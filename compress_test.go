@@ -0,0 +1,102 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                        "",
+		"gzip":                    encodingGzip,
+		"gzip, deflate, br":       encodingBrotli,
+		"br;q=0.5, gzip":          encodingGzip,
+		"br;q=0, gzip;q=0":        "",
+		"identity, deflate":       "",
+		"GZIP;q=0.8, br;q=0.8":    encodingBrotli,
+		"gzip;q=abc, br;q=0.1":    encodingBrotli,
+		" br ; q=1.0 , gzip;q=.9": encodingBrotli,
+	}
+	for header, want := range tests {
+		if got := negotiateEncoding(header); got != want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestWithCompression(t *testing.T) {
+	body := strings.Repeat(`{"message":"hello"}`, 200)
+	handler := withCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"ok":true}`)
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			fmt.Fprint(w, body)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, body)
+		}
+	}))
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", accept)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/json", "gzip")
+	if w.Header().Get("Content-Encoding") != encodingGzip || w.Code != http.StatusCreated {
+		t.Fatalf("JSONはgzipで圧縮するべきです: %d %v", w.Code, w.Header())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(zr); string(data) != body {
+		t.Error("展開した内容が元のレスポンスと一致しません")
+	}
+
+	w = get("/json", "br")
+	if w.Header().Get("Content-Encoding") != encodingBrotli {
+		t.Fatalf("brotliで圧縮するべきです: %v", w.Header())
+	}
+	if data, _ := io.ReadAll(brotli.NewReader(w.Body)); string(data) != body {
+		t.Error("展開した内容が元のレスポンスと一致しません")
+	}
+
+	if w := get("/small", "gzip"); w.Header().Get("Content-Encoding") != "" || w.Body.String() != `{"ok":true}` {
+		t.Error("最小サイズより小さいレスポンスは圧縮しないべきです")
+	}
+	if w := get("/image", "gzip"); w.Header().Get("Content-Encoding") != "" {
+		t.Error("画像は圧縮しないべきです")
+	}
+	if w := get("/json", ""); w.Header().Get("Content-Encoding") != "" || w.Body.String() != body {
+		t.Error("Accept-Encodingがない場合は圧縮しないべきです")
+	}
+}
+
+func TestWithCompressionEventStream(t *testing.T) {
+	handler := withCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: hello\n\n")
+		w.(http.Flusher).Flush()
+	}))
+	r := httptest.NewRequest("GET", "/events", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if !w.Flushed || w.Header().Get("Content-Encoding") != encodingGzip {
+		t.Fatalf("SSEは小さくても圧縮してフラッシュするべきです: %v", w.Header())
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"sync"
+)
+
+var (
+	maxConnections      = flag.Int("max-connections", 0, "同時に接続できるWebSocketの最大数 (0の場合は無制限)")
+	maxConnectionsPerIP = flag.Int("max-connections-per-ip", 0, "1つのIPアドレスから同時に接続できるWebSocketの最大数 (0の場合は無制限)")
+)
+
+// connLimiter 同時に接続しているWebSocketの数を全体とIPアドレスごとに制限する
+type connLimiter struct {
+	mu    sync.Mutex
+	max   int
+	perIP int
+	total int
+	byIP  map[string]int
+}
+
+func newConnLimiter(max, perIP int) *connLimiter {
+	return &connLimiter{max: max, perIP: perIP, byIP: make(map[string]int)}
+}
+
+// acquire 接続を1つ確保する。上限に達している場合は偽を返す
+func (l *connLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if (l.max > 0 && l.total >= l.max) || (l.perIP > 0 && l.byIP[ip] >= l.perIP) {
+		return false
+	}
+	l.total++
+	l.byIP[ip]++
+	return true
+}
+
+// release acquireで確保した接続を解放する
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.byIP[ip]--; l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+}
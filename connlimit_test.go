@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestConnLimiter(t *testing.T) {
+	l := newConnLimiter(3, 2)
+	if !l.acquire("1.1.1.1") || !l.acquire("1.1.1.1") {
+		t.Fatal("上限までは接続できるべきです")
+	}
+	if l.acquire("1.1.1.1") {
+		t.Error("IPアドレスごとの上限を超えて接続できるべきではありません")
+	}
+	if !l.acquire("2.2.2.2") {
+		t.Error("別のIPアドレスからは接続できるべきです")
+	}
+	if l.acquire("3.3.3.3") {
+		t.Error("全体の上限を超えて接続できるべきではありません")
+	}
+	l.release("1.1.1.1")
+	if !l.acquire("3.3.3.3") {
+		t.Error("解放した後は接続できるべきです")
+	}
+}
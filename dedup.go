@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"sync"
+	"time"
+)
+
+var dedupWindow = flag.Duration("dedup-window", 2*time.Minute, "クライアントが指定したIDが同じ投稿を再送とみなす期間 (0の場合は重複を排除しない)")
+
+// maxClientIDLength クライアントが指定するIDの最大の長さ
+const maxClientIDLength = 64
+
+// ErrInvalidClientID クライアントが指定したIDが長すぎる場合に発生するエラー
+var ErrInvalidClientID = errors.New("chat: ClientIDは64文字以内で指定してください。")
+
+// sentEvent 投稿を受け付けたことを知らせるイベント
+// 再送として破棄した場合も、最初の投稿に割り当てたIDを知らせる
+func sentEvent(clientID, id string) *message {
+	return &message{Type: typeSent, ClientID: clientID, ID: id, When: time.Now()}
+}
+
+// sentID 受け付けた投稿のサーバーのIDと受け付けた時刻
+type sentID struct {
+	id string
+	at time.Time
+}
+
+// sendDedup ルームごとにクライアントが指定したIDとサーバーのIDの対応を保持する
+// 接続が切れて再送された投稿を、別の接続からのものも含めて重複として見つける
+type sendDedup struct {
+	mu   sync.Mutex
+	seen map[string]sentID
+}
+
+func newSendDedup() *sendDedup {
+	return &sendDedup{seen: make(map[string]sentID)}
+}
+
+// claim ユーザーとクライアントが指定したIDの組にサーバーのIDを割り当てる
+// dedup-windowの期間内に同じ組が既にあればそのIDとfalseを返す
+func (d *sendDedup) claim(userID, clientID, id string, now time.Time) (string, bool) {
+	if *dedupWindow <= 0 {
+		return id, true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, sent := range d.seen {
+		if now.Sub(sent.at) > *dedupWindow {
+			delete(d.seen, key)
+		}
+	}
+	key := userID + "\x00" + clientID
+	if sent, ok := d.seen[key]; ok {
+		return sent.id, false
+	}
+	d.seen[key] = sentID{id: id, at: now}
+	return id, true
+}
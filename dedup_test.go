@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendDedup(t *testing.T) {
+	d := newSendDedup()
+	now := time.Now()
+	if id, first := d.claim("u1", "c1", "m1", now); id != "m1" || !first {
+		t.Errorf("最初の投稿は受け付けるべきです: %s, %v", id, first)
+	}
+	if id, first := d.claim("u1", "c1", "m2", now.Add(time.Second)); id != "m1" || first {
+		t.Errorf("再送は最初の投稿のIDを返すべきです: %s, %v", id, first)
+	}
+	if _, first := d.claim("u2", "c1", "m3", now); !first {
+		t.Error("他のユーザーの同じIDは重複とみなすべきではありません")
+	}
+	if id, first := d.claim("u1", "c1", "m4", now.Add(*dedupWindow+time.Second)); id != "m4" || !first {
+		t.Errorf("期間を過ぎた投稿は新しい投稿として受け付けるべきです: %s, %v", id, first)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ルームの一覧の並び順
+const (
+	sortRoomsByName     = "name"
+	sortRoomsByMembers  = "members"
+	sortRoomsByActivity = "activity"
+)
+
+// ErrInvalidRoomSort ルームの一覧の並び順の指定が不正な場合に発生するエラー
+var ErrInvalidRoomSort = errors.New("chat: sortにはname、members、activityのいずれかを指定してください。")
+
+// roomSummary ルームの一覧の1件
+type roomSummary struct {
+	RoomInfo
+	// Membersは在室しているユーザーの数。Clientsはこのノードに接続しているクライアントの数
+	Members      int        `json:"members"`
+	Clients      int        `json:"clients"`
+	LastActivity *time.Time `json:"last_activity,omitempty"`
+}
+
+// matches 名前、トピック、説明のいずれかに検索語を含むかどうかを判定する。大文字と小文字は区別しない
+func (s *roomSummary) matches(query string) bool {
+	if query == "" {
+		return true
+	}
+	query = strings.ToLower(query)
+	for _, field := range []string{s.Name, s.Topic, s.Description} {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// roomDirectory 情報が保存されているルームと動作中のルームのうち、非公開でないものを返す
+// アーカイブされたルームはarchivedが真の場合だけ含める
+// queryを指定した場合は一致するルームだけを返し、orderの順に並べる
+func roomDirectory(rooms *roomRegistry, query, order string, archived bool) ([]*roomSummary, error) {
+	var less func(a, b *roomSummary) bool
+	switch order {
+	case sortRoomsByName:
+		less = func(a, b *roomSummary) bool { return a.Name < b.Name }
+	case sortRoomsByMembers:
+		less = func(a, b *roomSummary) bool { return a.Members > b.Members }
+	case sortRoomsByActivity:
+		less = func(a, b *roomSummary) bool {
+			if a.LastActivity == nil || b.LastActivity == nil {
+				return a.LastActivity != nil
+			}
+			return a.LastActivity.After(*b.LastActivity)
+		}
+	default:
+		return nil, ErrInvalidRoomSort
+	}
+	stored, err := roomInfos.List()
+	if err != nil {
+		return nil, err
+	}
+	summaries := make(map[string]*roomSummary)
+	for _, info := range stored {
+		summaries[info.Name] = &roomSummary{RoomInfo: *info}
+	}
+	for _, rm := range rooms.all() {
+		s, ok := summaries[rm.name]
+		if !ok {
+			s = &roomSummary{RoomInfo: RoomInfo{Name: rm.name}}
+			summaries[rm.name] = s
+		}
+		stats := rm.Stats()
+		s.Clients, s.LastActivity = stats.Clients, stats.LastActivity
+	}
+	list := make([]*roomSummary, 0, len(summaries))
+	for _, s := range summaries {
+		if s.Private || (s.Archived && !archived) || !s.matches(query) {
+			continue
+		}
+		if present, err := presence.List(s.Name); err == nil {
+			s.Members = len(present)
+		}
+		list = append(list, s)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	sort.SliceStable(list, func(i, j int) bool { return less(list[i], list[j]) })
+	return list, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoomDirectory(t *testing.T) {
+	defer func(s RoomStore) { roomInfos = s }(roomInfos)
+	roomInfos = newMemoryRoomStore()
+	roomInfos.Save(&RoomInfo{Name: "golang", Topic: "Goの話題"})
+	roomInfos.Save(&RoomInfo{Name: "staff", Topic: "運営", Private: true})
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	rm, _ := rooms.get("general")
+	rm.stats.message(time.Now())
+
+	list, err := roomDirectory(rooms, "", sortRoomsByName, false)
+	if err != nil || len(list) != 2 || list[0].Name != "general" || list[1].Name != "golang" {
+		t.Fatalf("非公開のルームを除いて名前順に返すべきです: %v, %v", list, err)
+	}
+	if list, _ := roomDirectory(rooms, "GOの", sortRoomsByName, false); len(list) != 1 || list[0].Name != "golang" {
+		t.Errorf("トピックで検索できるべきです: %v", list)
+	}
+	if list, _ := roomDirectory(rooms, "", sortRoomsByActivity, false); list[0].Name != "general" {
+		t.Errorf("最近の投稿があるルームを先に返すべきです: %v", list)
+	}
+	if _, err := roomDirectory(rooms, "", "size", false); err != ErrInvalidRoomSort {
+		t.Errorf("不正な並び順はErrInvalidRoomSortになるべきところ%vでした", err)
+	}
+}
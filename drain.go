@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	drainReconnectURL = flag.String("drain-reconnect-url", "", "ドレイン中にクライアントへ再接続先として知らせるURL (ロードバランサーなど。空の場合は同じページを再読み込みさせる)")
+	drainThreshold    = flag.Int64("drain-threshold", 0, "ドレイン中にこの数以下まで接続が減ったら終了する")
+	drainTimeout      = flag.Duration("drain-timeout", 5*time.Minute, "ドレインを開始してから接続が残っていても終了するまでの時間")
+)
+
+// activeConnections このノードに接続しているWebSocketのクライアントの数
+var activeConnections = expvar.NewInt("websocket_connections")
+
+// shutdowner 処理中のリクエストを待って終了できるサーバー
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// drainer 無停止でデプロイするために、新しい接続を受け付けずに既存の接続が減るのを待って終了する
+type drainer struct {
+	mu       sync.Mutex
+	draining bool
+	started  time.Time
+	servers  []shutdowner
+	// doneはサーバーの終了処理が完了すると閉じられる
+	done chan struct{}
+}
+
+func newDrainer() *drainer {
+	return &drainer{done: make(chan struct{})}
+}
+
+// Draining ドレイン中かどうかを返す
+func (d *drainer) Draining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// start ドレインを開始する。既にドレイン中の場合は偽を返す
+func (d *drainer) start(rooms *roomRegistry, reconnectURL string, threshold int64, timeout time.Duration) bool {
+	d.mu.Lock()
+	if d.draining {
+		d.mu.Unlock()
+		return false
+	}
+	d.draining = true
+	d.started = time.Now()
+	d.mu.Unlock()
+
+	// 在室中のクライアントに別のノードへ再接続するよう知らせる
+	// 全員が同時に再接続しないよう、待ち時間をずらすための目安を付ける
+	hint := backoffHint{Jitter: *reconnectJitter}
+	rooms.deliverLocal(hint.apply(&message{Type: typeReconnect, Message: reconnectURL, When: time.Now()}))
+	go d.wait(threshold, timeout)
+	return true
+}
+
+// wait 接続が閾値以下になるか時間切れになるまで待ってサーバーを終了する
+func (d *drainer) wait(threshold int64, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for activeConnections.Value() > threshold && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+	log.Println("ドレインが完了しました。残りの接続:", activeConnections.Value())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, server := range d.servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("サーバーの終了に失敗しました:", err)
+		}
+	}
+	close(d.done)
+}
+
+// readyHandler ロードバランサー向けのレディネスチェック。ドレイン中は503を返す
+// GET /readyz
+func (d *drainer) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if d.Draining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// healthHandler プロセスが応答できるかどうかを確認するライブネスチェック
+// GET /healthz
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// drainHandler 管理者用のドレインの操作API
+// GET  /api/admin/drain  状態を返す
+// POST /api/admin/drain  ドレインを開始する
+type drainHandler struct {
+	drainer *drainer
+	rooms   *roomRegistry
+}
+
+func (h *drainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if h.drainer.start(h.rooms, *drainReconnectURL, *drainThreshold, *drainTimeout) {
+			admin, _ := userFromContext(r.Context())
+			auditRequest(r, auditAdminAction, admin.UniqueID(), "", map[string]string{"action": "drain"})
+		}
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	h.drainer.mu.Lock()
+	status := map[string]interface{}{
+		"draining":    h.drainer.draining,
+		"connections": json.Number(activeConnections.String()),
+	}
+	if h.drainer.draining {
+		status["started_at"] = h.drainer.started
+	}
+	h.drainer.mu.Unlock()
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// shutdownRecorder Shutdownが呼ばれたことを記録するshutdowner
+type shutdownRecorder chan struct{}
+
+func (s shutdownRecorder) Shutdown(ctx context.Context) error {
+	close(s)
+	return nil
+}
+
+func TestDrain(t *testing.T) {
+	defer func(d *drainer) { drain = d }(drain)
+	drain = newDrainer()
+	stopped := make(shutdownRecorder)
+	drain.servers = []shutdowner{stopped}
+	if err := sessions.Create(&Session{ID: "drain-session", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.Delete("drain-session")
+	rooms := newRoomRegistry()
+	mux := http.NewServeMux()
+	mux.Handle("/room", MustAuth(rooms))
+	mux.HandleFunc("/readyz", drain.readyHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	cookie := authCookie(&fakeUser{id: "u1", name: "アリス"}, "drain-session")
+
+	c, err := dialRoom(server.URL, url.Values{"room": {"general"}}, cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if _, err := c.expect(typeWelcome); err != nil {
+		t.Fatal(err)
+	}
+
+	// 接続数に関わらずすぐに終了処理に進むように閾値を大きくする
+	if !drain.start(rooms, "wss://other.example.com/room", 1<<30, time.Minute) {
+		t.Fatal("ドレインを開始できるべきです")
+	}
+	if drain.start(rooms, "", 1<<30, time.Minute) {
+		t.Error("ドレイン中に再び開始するべきではありません")
+	}
+	if msg, err := c.expect(typeReconnect); err != nil || msg.Message != "wss://other.example.com/room" {
+		t.Errorf("在室中のクライアントに再接続先を知らせるべきです: %+v, %v", msg, err)
+	}
+
+	header := http.Header{"Cookie": {cookie.String()}}
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/room", header)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("ドレイン中の新しい接続は503で拒否するべきです: %v, %v", resp, err)
+	}
+	if resp, err := http.Get(server.URL + "/readyz"); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("ドレイン中のレディネスチェックは503を返すべきです: %v, %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	select {
+	case <-drain.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ドレインが完了しませんでした")
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Error("ドレインの完了時にサーバーを終了するべきです")
+	}
+
+	// 終了処理では残っているクライアントをgoing awayで切断する
+	rooms.Shutdown()
+	for {
+		if _, err := c.next(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				t.Errorf("going awayで切断するべきです: %v", err)
+			}
+			break
+		}
+	}
+}
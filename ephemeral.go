@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+var onboardingTip = flag.String("onboarding-tip", "", "接続したクライアントにだけ表示するヒント (空の場合は表示しない)")
+
+// ephemeralMessage 1つの接続にだけ届け、保存も中継もしないシステムメッセージを作る
+// コマンドの出力やエラーの説明、ヒントなどに使用する
+func ephemeralMessage(room, userID, text string) *message {
+	return &message{
+		ID:        randomID(),
+		Room:      room,
+		UserID:    userID,
+		Name:      systemName,
+		Message:   text,
+		When:      time.Now(),
+		Ephemeral: true,
+	}
+}
+
+// ephemeralはこのクライアントにだけ一時的なメッセージを送信する
+func (c *client) ephemeral(text string) {
+	c.reply(ephemeralMessage(c.room.name, c.userID(), text))
+}
@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+func TestEphemeralMessage(t *testing.T) {
+	msg := ephemeralMessage("general", "u1", "ヒント")
+	if !msg.Ephemeral || msg.Name != systemName || msg.UserID != "u1" {
+		t.Errorf("一時的なシステムメッセージとして作るべきです: %+v", msg)
+	}
+	if tracked(msg) {
+		t.Error("一時的なメッセージは再送の対象にするべきではありません")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+var (
+	sentryDSN   = flag.String("sentry-dsn", "", "エラーを報告するSentryのDSN (空の場合は報告しない)")
+	environment = flag.String("environment", "production", "エラー報告に付ける実行環境の名前")
+)
+
+// ErrorReporter 予期しないエラーやパニックを外部のサービスに報告する
+// tagsには報告を絞り込むためのルーム名やリクエストIDなどを指定する
+type ErrorReporter interface {
+	Report(err error, tags map[string]string)
+	Flush(timeout time.Duration)
+}
+
+// nopReporter 何も報告しないErrorReporter
+type nopReporter struct{}
+
+func (nopReporter) Report(error, map[string]string) {}
+func (nopReporter) Flush(time.Duration)             {}
+
+// sentryReporter Sentryにエラーを報告するErrorReporter
+type sentryReporter struct {
+	hub *sentry.Hub
+}
+
+// newSentryReporter DSNとビルド情報から求めたリリース名でSentryのクライアントを生成する
+func newSentryReporter(dsn, env string) (*sentryReporter, error) {
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn:         dsn,
+		Release:     buildRelease(),
+		Environment: env,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sentryReporter{hub: sentry.NewHub(client, sentry.NewScope())}, nil
+}
+
+func (s *sentryReporter) Report(err error, tags map[string]string) {
+	s.hub.WithScope(func(scope *sentry.Scope) {
+		scope.SetTags(tags)
+		s.hub.CaptureException(err)
+	})
+}
+
+func (s *sentryReporter) Flush(timeout time.Duration) {
+	s.hub.Flush(timeout)
+}
+
+// buildRelease ビルド情報からリリース名を返す
+// モジュールのバージョンがない場合はVCSのリビジョンを使う
+func buildRelease() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "gochat@unknown"
+	}
+	version := info.Main.Version
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" && (version == "" || version == "(devel)") {
+			version = s.Value
+			if len(version) > 12 {
+				version = version[:12]
+			}
+		}
+	}
+	if version == "" {
+		version = "unknown"
+	}
+	return "gochat@" + version
+}
+
+// panicError 回復したパニックの値をエラーとして報告するための型
+type panicError struct {
+	value interface{}
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// reportPanic 回復したパニックを報告する
+// deferした関数から呼び出すと、パニックが発生した箇所を含むスタックトレースが記録される
+func reportPanic(p interface{}, tags map[string]string) {
+	err, ok := p.(error)
+	if !ok {
+		err = &panicError{value: p}
+	}
+	reporter.Report(err, tags)
+}
+
+// requestTags リクエストを識別するためのタグを返す
+func requestTags(r *http.Request) map[string]string {
+	return map[string]string{
+		"request_id": requestIDFromContext(r.Context()),
+		"method":     r.Method,
+		"path":       r.URL.Path,
+	}
+}
+
+// reportRequestError リクエストの処理中に発生した予期しないエラーを報告する
+func reportRequestError(r *http.Request, err error) {
+	reporter.Report(err, requestTags(r))
+}
+
+// withRecovery ハンドラーのパニックを回復して報告し、500を返すミドルウェア
+// クライアントの切断を表すhttp.ErrAbortHandlerはそのまま伝える
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if err, ok := p.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(p)
+			}
+			requestLogger(r).Printf("リクエストの処理中にパニックが発生しました: %v\n%s", p, debug.Stack())
+			reportPanic(p, requestTags(r))
+			httpError(w, r, "サーバー内部でエラーが発生しました", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
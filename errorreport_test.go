@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingReporter 報告されたエラーとタグを記録するErrorReporter
+type recordingReporter struct {
+	mu     sync.Mutex
+	errs   []error
+	tags   []map[string]string
+	report chan struct{}
+}
+
+func newRecordingReporter() *recordingReporter {
+	return &recordingReporter{report: make(chan struct{}, 10)}
+}
+
+func (r *recordingReporter) Report(err error, tags map[string]string) {
+	r.mu.Lock()
+	r.errs = append(r.errs, err)
+	r.tags = append(r.tags, tags)
+	r.mu.Unlock()
+	r.report <- struct{}{}
+}
+
+func (r *recordingReporter) Flush(time.Duration) {}
+
+// reported 報告された件数を返す
+func (r *recordingReporter) reported() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.errs)
+}
+
+func TestWithRecovery(t *testing.T) {
+	defer func(r ErrorReporter) { reporter = r }(reporter)
+	tests := []struct {
+		panic    interface{}
+		code     int
+		reported bool
+		repanic  bool
+	}{
+		{nil, http.StatusOK, false, false},
+		{"壊れました", http.StatusInternalServerError, true, false},
+		{errors.New("壊れました"), http.StatusInternalServerError, true, false},
+		{http.ErrAbortHandler, 0, false, true},
+	}
+	for _, test := range tests {
+		rec := newRecordingReporter()
+		reporter = rec
+		h := withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.panic != nil {
+				panic(test.panic)
+			}
+		}))
+		w := httptest.NewRecorder()
+		repanicked := func() (repanicked bool) {
+			defer func() { repanicked = recover() != nil }()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/api/rooms", nil))
+			return false
+		}()
+		if repanicked != test.repanic {
+			t.Errorf("%v: パニックをそのまま伝えるかどうかが%vになるべきです", test.panic, test.repanic)
+			continue
+		}
+		if !test.repanic && w.Code != test.code {
+			t.Errorf("%v: %dになるべきところ%dでした", test.panic, test.code, w.Code)
+		}
+		if (rec.reported() > 0) != test.reported {
+			t.Errorf("%v: 報告するかどうかが%vになるべきところ%d件でした", test.panic, test.reported, rec.reported())
+		}
+		if test.reported && rec.tags[0]["path"] != "/api/rooms" {
+			t.Errorf("%v: リクエストのタグを付けて報告するべきです: %v", test.panic, rec.tags[0])
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// strongETag 内容のハッシュから強いETagを生成する
+func strongETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// fileETags ファイルごとのETagのキャッシュ
+// 更新日時とサイズが変わらない限り、ファイルを読み直さずに同じETagを返す
+type fileETags struct {
+	mu      sync.Mutex
+	entries map[string]fileETag
+}
+
+type fileETag struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+func newFileETags() *fileETags {
+	return &fileETags{entries: make(map[string]fileETag)}
+}
+
+// get nameのETagを返す。キャッシュが古い場合はrの内容をハッシュし直す
+func (c *fileETags) get(name string, modTime time.Time, size int64, r io.ReadSeeker) (string, error) {
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	c.mu.Unlock()
+	if ok && e.modTime.Equal(modTime) && e.size == size {
+		return e.etag, nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	e = fileETag{modTime: modTime, size: size, etag: strongETag(h.Sum(nil))}
+	c.mu.Lock()
+	c.entries[name] = e
+	c.mu.Unlock()
+	return e.etag, nil
+}
+
+// avatarFileHandler アップロードされたアバターの画像をETagとLast-Modified付きで返す
+// 在室者が同じアバターを繰り返し取得しても、変更がなければ304を返す
+type avatarFileHandler struct {
+	dir   http.Dir
+	etags *fileETags
+}
+
+func newAvatarFileHandler(dir string) *avatarFileHandler {
+	return &avatarFileHandler{dir: http.Dir(dir), etags: newFileETags()}
+}
+
+func (h *avatarFileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	name := path.Clean("/" + r.URL.Path)
+	f, err := h.dir.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	etag, err := h.etags.get(name, info.ModTime(), info.Size(), f)
+	if err != nil {
+		httpError(w, r, "アバターを読み込めませんでした", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	// 変更されたアバターがすぐに反映されるよう、キャッシュした場合も毎回確認させる
+	w.Header().Set("Cache-Control", "public, no-cache")
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAvatarFileHandlerConditional(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "u1.png")
+	if err := os.WriteFile(file, []byte("avatar-v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := newAvatarFileHandler(dir)
+	get := func(etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/u1.png", nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	first := get("")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" || first.Header().Get("Last-Modified") == "" {
+		t.Fatalf("ETagとLast-Modifiedを付けて返すべきです: %d %v", first.Code, first.Header())
+	}
+	if w := get(etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("変更がない場合は304を返すべきですが%dでした", w.Code)
+	}
+
+	if err := os.WriteFile(file, []byte("avatar-v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(file, later, later)
+	if w := get(etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag || w.Body.String() != "avatar-v2" {
+		t.Errorf("変更された場合は新しい内容を返すべきです: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestAvatarFileHandlerNoDirectory(t *testing.T) {
+	h := newAvatarFileHandler(t.TempDir())
+	for _, p := range []string{"/", "/../etc/passwd", "/missing.png"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = p
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: 404を返すべきですが%dでした", p, w.Code)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// EventKind 内部のライフサイクルイベントの種類
+type EventKind string
+
+const (
+	// EventClientJoined クライアントがルームに参加した
+	EventClientJoined EventKind = "client_joined"
+	// EventClientLeft クライアントがルームから退室した
+	EventClientLeft EventKind = "client_left"
+	// EventMessageBroadcast このノードで投稿されたイベントがルームに配信された
+	EventMessageBroadcast EventKind = "message_broadcast"
+	// EventUserBanned ユーザーが利用停止になった
+	EventUserBanned EventKind = "user_banned"
+)
+
+// Event 内部のライフサイクルイベント
+type Event struct {
+	Kind EventKind
+	Room string
+	// ConnIDは参加・退室したクライアントの接続のID
+	ConnID string
+	UserID string
+	Name   string
+	// MessageはEventMessageBroadcastで配信されたイベント
+	Message *message
+	When    time.Time
+}
+
+// eventCounts 種類ごとに発行されたイベントの数
+var eventCounts = expvar.NewMap("lifecycle_events")
+
+// eventBus プロセス内でライフサイクルイベントを購読者に配布する
+// Publishは購読者を同期的に呼び出すため、購読者はroom.runのゴルーチンを止めないよう短時間で戻る
+type eventBus struct {
+	mu       sync.RWMutex
+	handlers map[EventKind][]func(Event)
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{handlers: make(map[EventKind][]func(Event))}
+}
+
+// Subscribe 指定された種類のイベントを購読する
+func (b *eventBus) Subscribe(kind EventKind, handler func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[kind] = append(b.handlers[kind], handler)
+}
+
+// Publish イベントを購読者に配布する
+func (b *eventBus) Publish(e Event) {
+	if e.When.IsZero() {
+		e.When = time.Now()
+	}
+	eventCounts.Add(string(e.Kind), 1)
+	b.mu.RLock()
+	handlers := b.handlers[e.Kind]
+	b.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(e)
+	}
+}
+
+// clientEventはクライアントの参加・退室のイベントを生成する
+func clientEvent(kind EventKind, r *room, c *client) Event {
+	userID, _ := c.userData["userid"].(string)
+	name, _ := c.userData["name"].(string)
+	return Event{Kind: kind, Room: r.name, ConnID: c.id, UserID: userID, Name: name}
+}
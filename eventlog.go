@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	kafkaBrokers = flag.String("kafka-brokers", "", "ルームのイベントを送信するKafkaのブローカー (カンマ区切り。空の場合は送信しない)")
+	kafkaTopic   = flag.String("kafka-topic", "gochat-events", "ルームのイベントを送信するKafkaのトピック")
+	kafkaReplay  = flag.Bool("kafka-replay", false, "起動時にKafkaのトピックからメッセージの履歴を復元する")
+)
+
+// EventLog ルームのイベントを外部に記録する
+// 分析やコンプライアンスのためのパイプラインが主なストアを参照せずにチャットの活動を取得できるようにする
+type EventLog interface {
+	Append(msg *message) error
+	// Replay 記録されているイベントを古い順にhandlerに渡す
+	Replay(handler func(*message)) error
+	Close() error
+}
+
+// nopEventLog 何も記録しないEventLog
+type nopEventLog struct{}
+
+func (nopEventLog) Append(*message) error       { return nil }
+func (nopEventLog) Replay(func(*message)) error { return nil }
+func (nopEventLog) Close() error                { return nil }
+
+// kafkaEventLog Kafkaのトピックにイベントを記録するEventLog
+// ルーム名をキーにするため、同じルームのイベントは同じパーティションに順番に記録される
+type kafkaEventLog struct {
+	brokers []string
+	topic   string
+	writer  *kafka.Writer
+}
+
+func newKafkaEventLog(brokers []string, topic string) *kafkaEventLog {
+	return &kafkaEventLog{
+		brokers: brokers,
+		topic:   topic,
+		writer: &kafka.Writer{
+			Addr:     kafka.TCP(brokers...),
+			Topic:    topic,
+			Balancer: &kafka.Hash{},
+			// ルームの処理を止めないように非同期に送信する
+			Async: true,
+			Completion: func(msgs []kafka.Message, err error) {
+				if err != nil {
+					log.Printf("Kafkaへのイベントの送信に失敗しました (%d件): %v\n", len(msgs), err)
+				}
+			},
+		},
+	}
+}
+
+func (l *kafkaEventLog) Append(msg *message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return l.writer.WriteMessages(context.Background(), kafka.Message{Key: []byte(msg.Room), Value: data})
+}
+
+func (l *kafkaEventLog) Replay(handler func(*message)) error {
+	conn, err := kafka.Dial("tcp", l.brokers[0])
+	if err != nil {
+		return err
+	}
+	partitions, err := conn.ReadPartitions(l.topic)
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	for _, p := range partitions {
+		if err := l.replayPartition(p.ID, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayPartition 1つのパーティションを先頭から起動時点の末尾まで読み込む
+func (l *kafkaEventLog) replayPartition(partition int, handler func(*message)) error {
+	leader, err := kafka.DialLeader(context.Background(), "tcp", l.brokers[0], l.topic, partition)
+	if err != nil {
+		return err
+	}
+	first, last, err := leader.ReadOffsets()
+	leader.Close()
+	if err != nil || first >= last {
+		return err
+	}
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   l.brokers,
+		Topic:     l.topic,
+		Partition: partition,
+		MaxWait:   time.Second,
+	})
+	defer reader.Close()
+	if err := reader.SetOffset(first); err != nil {
+		return err
+	}
+	for {
+		m, err := reader.ReadMessage(context.Background())
+		if err != nil {
+			return err
+		}
+		var msg message
+		if err := json.Unmarshal(m.Value, &msg); err == nil {
+			handler(&msg)
+		}
+		if m.Offset >= last-1 {
+			return nil
+		}
+	}
+}
+
+func (l *kafkaEventLog) Close() error {
+	return l.writer.Close()
+}
+
+// openEventLog フラグの設定に従ってEventLogを開く
+func openEventLog() EventLog {
+	if *kafkaBrokers == "" {
+		return nopEventLog{}
+	}
+	return newKafkaEventLog(strings.Split(*kafkaBrokers, ","), *kafkaTopic)
+}
+
+// restoreHistory イベントログからメッセージの履歴を復元する
+// 削除のイベントは以前に復元したメッセージを取り除く
+// パーティションをまたいだ順序は保証されないため、ユーザーの消去は復元がすべて終わってから適用する
+func restoreHistory(l EventLog) (int, error) {
+	restored := 0
+	erased := make(map[string]string)
+	err := l.Replay(func(msg *message) {
+		switch msg.Type {
+		case typeChat, typeSticker, typeGIF, typeCode:
+			if _, err := messages.Get(msg.ID); err == ErrMessageNotFound {
+				if messages.Save(msg) == nil {
+					restored++
+				}
+			}
+		case typeMessageDeleted:
+			messages.Delete(msg.Ref)
+		case typeUserErased:
+			erased[msg.UserID] = msg.Message
+		}
+	})
+	for userID, policy := range erased {
+		if userID == "" {
+			continue
+		}
+		sent, listErr := messages.ListByUser(userID)
+		if listErr != nil {
+			return restored, listErr
+		}
+		for _, m := range sent {
+			if eraseErr := eraseMessage(m, policy); eraseErr != nil {
+				return restored, eraseErr
+			}
+		}
+	}
+	return restored, err
+}
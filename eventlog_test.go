@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// memoryEventLog テスト用にメモリ上にイベントを記録するEventLog
+type memoryEventLog struct {
+	events []*message
+}
+
+func (l *memoryEventLog) Append(msg *message) error {
+	copied := *msg
+	l.events = append(l.events, &copied)
+	return nil
+}
+
+func (l *memoryEventLog) Replay(handler func(*message)) error {
+	for _, msg := range l.events {
+		copied := *msg
+		handler(&copied)
+	}
+	return nil
+}
+
+func (l *memoryEventLog) Close() error { return nil }
+
+func TestRestoreHistorySkipsErasedUsers(t *testing.T) {
+	defer func(u UserStore, m MessageStore, l EventLog) { users, messages, eventLog = u, m, l }(users, messages, eventLog)
+	tests := []struct {
+		policy string
+		want   int
+	}{
+		{erasureAnonymize, 2},
+		{erasureDelete, 1},
+	}
+	for _, tt := range tests {
+		log := &memoryEventLog{}
+		users, messages, eventLog = newMemoryUserStore(), newMemoryMessageStore(), log
+		users.Create(&UserRecord{ID: "u1", Name: "Alice", Provider: "google", ProviderID: "1"})
+		for _, msg := range []*message{
+			{Type: typeChat, ID: "m1", Room: "general", UserID: "u1", Name: "Alice", Message: "消したい投稿", When: time.Now()},
+			{Type: typeChat, ID: "m2", Room: "general", UserID: "u2", Name: "Bob", Message: "返信", When: time.Now()},
+		} {
+			messages.Save(msg)
+			log.Append(msg)
+		}
+		if err := eraseUser("u1", tt.policy); err != nil {
+			t.Fatal(err)
+		}
+
+		messages = newMemoryMessageStore()
+		if _, err := restoreHistory(log); err != nil {
+			t.Fatal(err)
+		}
+		if sent, err := messages.ListByUser("u1"); err != nil || len(sent) != 0 {
+			t.Errorf("%s: 消去したユーザーのメッセージを復元するべきではありません: %v, %v", tt.policy, sent, err)
+		}
+		count := 0
+		messages.Each(func(*message) error { count++; return nil })
+		if count != tt.want {
+			t.Errorf("%s: 復元したメッセージの数が%d件であるべきです: %d", tt.policy, tt.want, count)
+		}
+		if tt.policy == erasureAnonymize {
+			if m, err := messages.Get("m1"); err != nil || m.Name != deletedUserName || m.UserID != "" {
+				t.Errorf("匿名化したメッセージは匿名化したまま復元するべきです: %+v, %v", m, err)
+			}
+		}
+	}
+}
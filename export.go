@@ -0,0 +1,255 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// エクスポートの状態
+const (
+	exportPending = "pending"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+)
+
+// exportJob 1人のユーザーのデータエクスポート
+type exportJob struct {
+	Status      string    `json:"status"`
+	RequestedAt time.Time `json:"requested_at"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	data        []byte
+}
+
+// exportRetention 完了したエクスポートを保持する期間。ダウンロードされた場合はその時点で破棄する
+const exportRetention = 24 * time.Hour
+
+// exporter ユーザーごとのデータエクスポートを非同期に生成して保持する
+type exporter struct {
+	mu   sync.Mutex
+	jobs map[string]*exportJob
+	// retentionは完了したジョブを破棄するまでの時間
+	retention time.Duration
+}
+
+func newExporter() *exporter {
+	return &exporter{jobs: make(map[string]*exportJob), retention: exportRetention}
+}
+
+// start エクスポートの生成を開始する。生成中の場合は既存のジョブを返す
+func (e *exporter) start(userID string) exportJob {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if job, ok := e.jobs[userID]; ok && job.Status == exportPending {
+		return *job
+	}
+	job := &exportJob{Status: exportPending, RequestedAt: time.Now()}
+	e.jobs[userID] = job
+	go e.run(userID, job)
+	return *job
+}
+
+func (e *exporter) run(userID string, job *exportJob) {
+	data, err := buildExport(userID)
+	e.mu.Lock()
+	job.CompletedAt = time.Now()
+	if err != nil {
+		job.Status = exportFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = exportReady
+		job.data = data
+	}
+	e.mu.Unlock()
+	time.AfterFunc(e.retention, func() { e.expire(userID, job) })
+	if err != nil {
+		log.Println("データのエクスポートに失敗しました:", userID, "-", err)
+		notify(notification{UserID: userID, Text: "データのエクスポートに失敗しました。もう一度お試しください。", Subject: "データのエクスポート"}, time.Now())
+		return
+	}
+	notify(notification{UserID: userID, Text: "データのエクスポートが完了しました。/account/export/download からダウンロードできます。", Subject: "データのエクスポート"}, time.Now())
+}
+
+// expire 完了したジョブを破棄する。新しいエクスポートが開始されている場合は何もしない
+func (e *exporter) expire(userID string, job *exportJob) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.jobs[userID] == job {
+		delete(e.jobs, userID)
+	}
+}
+
+// take 完了したエクスポートを返して破棄する。ZIPアーカイブをメモリに残さないようにダウンロード時に使う
+func (e *exporter) take(userID string) (exportJob, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	job, ok := e.jobs[userID]
+	if !ok || job.Status != exportReady {
+		return exportJob{}, false
+	}
+	delete(e.jobs, userID)
+	return *job, true
+}
+
+// get ユーザーのエクスポートの状態を返す
+func (e *exporter) get(userID string) (exportJob, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	job, ok := e.jobs[userID]
+	if !ok {
+		return exportJob{}, false
+	}
+	return *job, true
+}
+
+// buildExport ユーザーに関するすべてのデータをZIPアーカイブにまとめる
+// 含めるデータはアカウントの削除と同じuserDataItemsに従う
+func buildExport(userID string) ([]byte, error) {
+	if _, err := users.GetByID(userID); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	for _, item := range userDataItems {
+		if item.export != nil {
+			v, err := item.export(userID)
+			if err != nil {
+				return nil, err
+			}
+			f, err := z.Create(item.name)
+			if err != nil {
+				return nil, err
+			}
+			enc := json.NewEncoder(f)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(v); err != nil {
+				return nil, err
+			}
+		}
+		if item.files != nil {
+			if err := item.files(userID, z); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// exportAvatarFiles アップロードされたアバターをuploads/に加える
+func exportAvatarFiles(userID string, z *zip.Writer) error {
+	files, err := ioutil.ReadDir("avatars")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range files {
+		filename := file.Name()
+		if file.IsDir() || strings.TrimSuffix(filename, filepath.Ext(filename)) != userID {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join("avatars", filename))
+		if err != nil {
+			return err
+		}
+		f, err := z.Create("uploads/" + filename)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportAttachmentFiles 添付ファイルの内容をattachments/{ID}/{ファイル名}に加える
+func exportAttachmentFiles(userID string, z *zip.Writer) error {
+	own, err := attachments.ListByUser(userID)
+	if err != nil {
+		return err
+	}
+	for _, a := range own {
+		blob, err := blobs.Open(a.ID)
+		if err != nil {
+			return err
+		}
+		f, err := z.Create("attachments/" + a.ID + "/" + filepath.Base(a.Filename))
+		if err == nil {
+			_, err = io.Copy(f, blob)
+		}
+		blob.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportGroups ユーザーが所属しているグループの名前を返す
+func exportGroups(userID string) (interface{}, error) {
+	list, err := groups.List()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, g := range list {
+		for _, id := range g.Members {
+			if id == userID {
+				names = append(names, g.Name)
+				break
+			}
+		}
+	}
+	return names, nil
+}
+
+// exportHandler データエクスポートのAPI
+// POST /account/export で生成を開始し、GET /account/export で状態を返す
+// 完了後は GET /account/export/download でZIPアーカイブを1回だけダウンロードできる
+type exportHandler struct {
+	exporter *exporter
+}
+
+func (h *exportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	if strings.HasSuffix(r.URL.Path, "/download") {
+		job, ok := h.exporter.take(user.UniqueID())
+		if !ok {
+			writeJSONError(w, r, "ダウンロードできるエクスポートがありません", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="gochat-export.zip"`)
+		w.Write(job.data)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		if _, err := users.GetByID(user.UniqueID()); err != nil {
+			writeJSONError(w, r, "このアカウントはエクスポートできません", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, h.exporter.start(user.UniqueID()))
+	case http.MethodGet:
+		job, ok := h.exporter.get(user.UniqueID())
+		if !ok {
+			writeJSONError(w, r, "エクスポートは要求されていません", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
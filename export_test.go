@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chanNotifier 別のゴルーチンから送信されたお知らせをチャネルで受け取るNotifier
+type chanNotifier chan string
+
+func (n chanNotifier) Notify(userID, text string) { n <- userID + ":" + text }
+
+func (n chanNotifier) NotifyEvent(msg *message) { n <- msg.UserID + ":" + msg.Type }
+
+func TestExportHandler(t *testing.T) {
+	defer func(u UserStore, m MessageStore, s SessionStore, n Notifier) {
+		users, messages, sessions, notifier = u, m, s, n
+	}(users, messages, sessions, notifier)
+	defer func(b BlobStore, a AttachmentStore, k APIKeyStore, st StarStore) {
+		blobs, attachments, apiKeys, stars = b, a, k, st
+	}(blobs, attachments, apiKeys, stars)
+	users, messages, sessions = newMemoryUserStore(), newMemoryMessageStore(), newMemorySessionStore()
+	attachments, apiKeys, stars = newMemoryAttachmentStore(), newMemoryAPIKeyStore(), newMemoryStarStore()
+	var err error
+	if blobs, err = newFileBlobStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chanNotifier, 1)
+	notifier = sent
+	users.Create(&UserRecord{ID: "u1", Name: "Alice", Provider: "github", ProviderID: "1"})
+	messages.Save(&message{ID: "m1", Room: "general", UserID: "u1", Message: "こんにちは", When: time.Now()})
+	messages.Save(&message{ID: "m2", Room: "general", UserID: "u2", Message: "他人の投稿", When: time.Now()})
+	sessions.Create(&Session{ID: "s1", UserID: "u1"})
+	attachments.Create(&Attachment{ID: "a1", UserID: "u1", Filename: "photo.png"})
+	blobs.Put("a1", strings.NewReader("画像の内容"))
+	apiKeys.Create(&APIKey{ID: "k1", UserID: "u1", Name: "bot", Hash: "secret-hash"})
+	stars.Add(&Star{UserID: "u1", MessageID: "m2"})
+
+	h := &exportHandler{exporter: newExporter()}
+	do := func(method, path, userID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r = r.WithContext(withUser(r.Context(), sessionUser{uniqueID: userID, name: userID}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("GET", "/account/export", "u1"); w.Code != http.StatusNotFound {
+		t.Errorf("要求前の状態は404になるべきところ%dでした", w.Code)
+	}
+	if w := do("POST", "/account/export", "u1"); w.Code != http.StatusAccepted {
+		t.Fatalf("生成の開始は202になるべきところ%dでした", w.Code)
+	}
+	select {
+	case text := <-sent:
+		if !strings.HasPrefix(text, "u1:データのエクスポートが完了しました") {
+			t.Errorf("完了を本人に知らせるべきです: %s", text)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("完了のお知らせが届きませんでした")
+	}
+	var job exportJob
+	w := do("GET", "/account/export", "u1")
+	if err := json.NewDecoder(w.Body).Decode(&job); err != nil || job.Status != exportReady {
+		t.Fatalf("完了後の状態はreadyになるべきです: %+v, %v", job, err)
+	}
+
+	if w := do("GET", "/account/export/download", "u2"); w.Code != http.StatusNotFound {
+		t.Errorf("他人のエクスポートはダウンロードできないべきところ%dでした", w.Code)
+	}
+	w = do("GET", "/account/export/download", "u1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("本人はダウンロードできるべきところ%dでした", w.Code)
+	}
+	if again := do("GET", "/account/export/download", "u1"); again.Code != http.StatusNotFound {
+		t.Errorf("ダウンロードしたエクスポートは破棄するべきところ%dでした", again.Code)
+	}
+	z, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range z.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+	for _, item := range userDataItems {
+		if _, ok := files[item.name]; item.export != nil && !ok {
+			t.Errorf("%sをアーカイブに含めるべきです", item.name)
+		}
+	}
+	for _, name := range []string{"profile.json", "messages.json", "sessions.json", "api_keys.json", "stars.json", "attachments.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("%sをアーカイブに含めるべきです", name)
+		}
+	}
+	if !strings.Contains(files["messages.json"], "こんにちは") || strings.Contains(files["messages.json"], "他人の投稿") {
+		t.Errorf("本人が送信したメッセージだけを含めるべきです: %s", files["messages.json"])
+	}
+	if !strings.Contains(files["sessions.json"], "s1") {
+		t.Errorf("本人のセッションを含めるべきです: %s", files["sessions.json"])
+	}
+	if files["attachments/a1/photo.png"] != "画像の内容" {
+		t.Errorf("添付ファイルの内容を含めるべきです: %v", files["attachments/a1/photo.png"])
+	}
+	if !strings.Contains(files["api_keys.json"], "bot") || strings.Contains(files["api_keys.json"], "secret-hash") {
+		t.Errorf("APIキーは秘密を除いた情報だけを含めるべきです: %s", files["api_keys.json"])
+	}
+	if !strings.Contains(files["stars.json"], "m2") {
+		t.Errorf("スターを含めるべきです: %s", files["stars.json"])
+	}
+}
+
+func TestExporterExpiresJobs(t *testing.T) {
+	defer func(u UserStore, n Notifier) { users, notifier = u, n }(users, notifier)
+	users = newMemoryUserStore()
+	users.Create(&UserRecord{ID: "u1", Name: "Alice"})
+	sent := make(chanNotifier, 1)
+	notifier = sent
+	e := newExporter()
+	e.retention = 10 * time.Millisecond
+	e.start("u1")
+	<-sent
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if _, ok := e.get("u1"); !ok {
+			return
+		}
+	}
+	t.Error("保持期間を過ぎたエクスポートは破棄するべきです")
+}
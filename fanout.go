@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"runtime"
+	"sync"
+)
+
+var (
+	fanoutWorkers   = flag.Int("fanout-workers", runtime.NumCPU(), "大きなルームで配信を並列に行うワーカーの数")
+	fanoutThreshold = flag.Int("fanout-threshold", 1000, "この人数以上が在室しているルームではワーカーで並列に配信する")
+)
+
+// fanoutJob ワーカーが担当するクライアントの一部への配信
+type fanoutJob struct {
+	clients []*client
+	msg     *outgoing
+	// failedは送信バッファが一杯で送信できなかったクライアント
+	failed []*client
+	wg     *sync.WaitGroup
+}
+
+// fanoutPool 大きなルームの配信を複数のワーカーで分担する
+// ワーカーはチャネルへの送信だけを行い、在室者の変更はルームのゴルーチンに任せる
+type fanoutPool struct {
+	jobs    chan *fanoutJob
+	workers int
+}
+
+func newFanoutPool(workers int) *fanoutPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &fanoutPool{jobs: make(chan *fanoutJob, workers), workers: workers}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *fanoutPool) work() {
+	for job := range p.jobs {
+		for _, c := range job.clients {
+			select {
+			case c.send <- job.msg.forClient(c):
+			default:
+				job.failed = append(job.failed, c)
+			}
+		}
+		job.wg.Done()
+	}
+}
+
+// send clientsにmsgを並列に送信し、すべて終わるまで待つ
+// 送信できなかったクライアントを返す
+func (p *fanoutPool) send(clients []*client, msg *outgoing) []*client {
+	size := (len(clients) + p.workers - 1) / p.workers
+	var wg sync.WaitGroup
+	var jobs []*fanoutJob
+	for start := 0; start < len(clients); start += size {
+		end := start + size
+		if end > len(clients) {
+			end = len(clients)
+		}
+		job := &fanoutJob{clients: clients[start:end], msg: msg, wg: &wg}
+		jobs = append(jobs, job)
+		wg.Add(1)
+		p.jobs <- job
+	}
+	wg.Wait()
+	var failed []*client
+	for _, job := range jobs {
+		failed = append(failed, job.failed...)
+	}
+	return failed
+}
+
+var (
+	fanoutOnce sync.Once
+	fanout     *fanoutPool
+)
+
+// sharedFanoutPool すべてのルームで共有するワーカーを必要になったときに起動して返す
+func sharedFanoutPool() *fanoutPool {
+	fanoutOnce.Do(func() { fanout = newFanoutPool(*fanoutWorkers) })
+	return fanout
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+// benchmarkDeliver 大きなルームへの配信にかかる時間を計測し、p99をレポートする
+func benchmarkDeliver(b *testing.B, threshold int) {
+	const clients = 10000
+	old := *fanoutThreshold
+	*fanoutThreshold = threshold
+	defer func() { *fanoutThreshold = old }()
+
+	r := newRoom()
+	done := make(chan struct{})
+	defer close(done)
+	for i := 0; i < clients; i++ {
+		c := &client{send: make(chan *message, messageBufferSize)}
+		r.clients[c] = true
+		go func() {
+			for {
+				select {
+				case <-c.send:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	msg := &message{Message: "hello"}
+	durations := make([]time.Duration, 0, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		r.deliver(msg)
+		durations = append(durations, time.Since(start))
+	}
+	b.StopTimer()
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	b.ReportMetric(float64(durations[len(durations)*99/100].Microseconds()), "p99-µs")
+}
+
+func BenchmarkDeliverSerial(b *testing.B)   { benchmarkDeliver(b, 1<<30) }
+func BenchmarkDeliverParallel(b *testing.B) { benchmarkDeliver(b, 0) }
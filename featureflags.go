@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	featureFlagsFile     = flag.String("feature-flags", "", "機能フラグの設定ファイル (JSON。空の場合はすべての機能を有効にする)")
+	featureFlagsURL      = flag.String("feature-flags-url", "", "機能フラグの設定を定期的に取得するURL (設定ファイルより優先する)")
+	featureFlagsInterval = flag.Duration("feature-flags-interval", time.Minute, "機能フラグの設定を取得し直す間隔")
+)
+
+// 機能フラグで切り替えられる機能
+// プロトコルのバージョンは"protocol_v"に続けてバージョンを指定する (例: protocol_v2)
+const (
+	featureReport    = "report"
+	featureRemind    = "remind"
+	featureTranslate = "translate"
+	featureBatch     = "batch"
+)
+
+// ErrFlagSource 機能フラグの設定を取得できなかった場合に発生するエラー
+var ErrFlagSource = errors.New("chat: 機能フラグの設定を取得できません。")
+
+// FlagRule 1つの機能を有効にする条件
+// Usersに含まれるユーザー、Roomsで指定されたルームの順に判定し、
+// どちらにも該当しない場合はPercentが正ならユーザーごとの段階的な公開、そうでなければEnabledに従う
+type FlagRule struct {
+	Enabled bool            `json:"enabled"`
+	Percent int             `json:"percent,omitempty"`
+	Rooms   map[string]bool `json:"rooms,omitempty"`
+	Users   []string        `json:"users,omitempty"`
+}
+
+// evaluate 指定されたルームとユーザーに対して機能が有効かどうかを判定する
+func (rule FlagRule) evaluate(name, room, userID string) bool {
+	for _, id := range rule.Users {
+		if id == userID {
+			return true
+		}
+	}
+	if enabled, ok := rule.Rooms[room]; ok {
+		return enabled
+	}
+	if rule.Percent > 0 {
+		return rolloutBucket(name, userID) < rule.Percent
+	}
+	return rule.Enabled
+}
+
+// rolloutBucket ユーザーを0から99のいずれかに割り当てる
+// 機能ごとに割り当てを変えるため、機能名も含めてハッシュする
+func rolloutBucket(name, userID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name + "\x00" + userID))
+	return int(h.Sum32() % 100)
+}
+
+// FlagProvider 機能フラグの設定を読み込む
+type FlagProvider interface {
+	Load() (map[string]FlagRule, error)
+}
+
+// fileFlagProvider JSONファイルから設定を読み込むFlagProvider
+type fileFlagProvider struct {
+	path string
+}
+
+func (p fileFlagProvider) Load() (map[string]FlagRule, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	var rules map[string]FlagRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// remoteFlagProvider HTTPでJSONの設定を取得するFlagProvider
+type remoteFlagProvider struct {
+	url    string
+	client *http.Client
+}
+
+func (p remoteFlagProvider) Load() (map[string]FlagRule, error) {
+	resp, err := p.client.Get(p.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w (status %d)", ErrFlagSource, resp.StatusCode)
+	}
+	var rules map[string]FlagRule
+	if err := json.NewDecoder(resp.Body).Decode(&rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// newFlagProvider フラグの設定に従ってFlagProviderを生成する。どちらも空の場合はnilを返す
+func newFlagProvider(file, url string) FlagProvider {
+	switch {
+	case url != "":
+		return remoteFlagProvider{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+	case file != "":
+		return fileFlagProvider{path: file}
+	}
+	return nil
+}
+
+// featureFlags 実行中に参照される機能フラグ
+// 設定されていない機能は常に有効とみなす
+type featureFlags struct {
+	mu    sync.RWMutex
+	rules map[string]FlagRule
+}
+
+func newFeatureFlags() *featureFlags {
+	return &featureFlags{rules: make(map[string]FlagRule)}
+}
+
+// Enabled 指定されたルームとユーザーに対して機能が有効かどうかを返す
+func (f *featureFlags) Enabled(name, room, userID string) bool {
+	f.mu.RLock()
+	rule, ok := f.rules[name]
+	f.mu.RUnlock()
+	if !ok {
+		return true
+	}
+	return rule.evaluate(name, room, userID)
+}
+
+// Rules 現在の設定を返す
+func (f *featureFlags) Rules() map[string]FlagRule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	rules := make(map[string]FlagRule, len(f.rules))
+	for name, rule := range f.rules {
+		rules[name] = rule
+	}
+	return rules
+}
+
+// Set 設定を置き換える
+func (f *featureFlags) Set(rules map[string]FlagRule) {
+	f.mu.Lock()
+	f.rules = rules
+	f.mu.Unlock()
+}
+
+// reload providerから設定を読み込み直す。失敗した場合はそれまでの設定を使い続ける
+func (f *featureFlags) reload(provider FlagProvider) error {
+	rules, err := provider.Load()
+	if err != nil {
+		return err
+	}
+	f.Set(rules)
+	return nil
+}
+
+// watch intervalごとに設定を読み込み直す
+func (f *featureFlags) watch(provider FlagProvider, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := f.reload(provider); err != nil {
+			log.Println("機能フラグの設定を読み込めませんでした:", err)
+		}
+	}
+}
+
+// capVersion 有効になっていないプロトコルのバージョンを除き、version以下で最も新しいバージョンを返す
+func (f *featureFlags) capVersion(version int, room, userID string) int {
+	for version > minProtocolVersion && !f.Enabled("protocol_v"+strconv.Itoa(version), room, userID) {
+		version--
+	}
+	return version
+}
+
+// featureFlagsHandler 管理者用の機能フラグのAPI
+// GET /api/admin/flags                         現在の設定を返す
+// GET /api/admin/flags?room=&user=             指定されたルームとユーザーに対する判定結果も返す
+func featureFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	rules := features.Rules()
+	resp := map[string]interface{}{"rules": rules}
+	q := r.URL.Query()
+	if room, user := q.Get("room"), q.Get("user"); room != "" || user != "" {
+		evaluated := make(map[string]bool, len(rules))
+		for name := range rules {
+			evaluated[name] = features.Enabled(name, room, user)
+		}
+		resp["evaluated"] = evaluated
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestFlagRuleEvaluate(t *testing.T) {
+	rule := FlagRule{Rooms: map[string]bool{"dev": true, "general": false}, Users: []string{"tester"}}
+	if !rule.evaluate("batch", "general", "tester") {
+		t.Error("Usersに含まれるユーザーは有効になるべきです")
+	}
+	if !rule.evaluate("batch", "dev", "u1") {
+		t.Error("Roomsで有効にしたルームは有効になるべきです")
+	}
+	if rule.evaluate("batch", "general", "u1") {
+		t.Error("Roomsで無効にしたルームは無効になるべきです")
+	}
+	if rule.evaluate("batch", "random", "u1") {
+		t.Error("条件に該当しない場合はEnabledに従うべきです")
+	}
+}
+
+func TestFlagRulePercent(t *testing.T) {
+	rule := FlagRule{Percent: 30}
+	enabled := 0
+	for i := 0; i < 1000; i++ {
+		userID := randomID()
+		if rule.evaluate("threads", "", userID) != rule.evaluate("threads", "", userID) {
+			t.Fatal("同じユーザーには同じ結果を返すべきです")
+		}
+		if rule.evaluate("threads", "", userID) {
+			enabled++
+		}
+	}
+	if enabled < 200 || enabled > 400 {
+		t.Errorf("約30%%のユーザーが有効になるべきです: %d/1000", enabled)
+	}
+}
+
+func TestFeatureFlagsDefaults(t *testing.T) {
+	f := newFeatureFlags()
+	if v := f.capVersion(maxProtocolVersion, "general", "u1"); v != maxProtocolVersion {
+		t.Errorf("設定がない場合はバージョンを変えないべきです: %d", v)
+	}
+	f.Set(map[string]FlagRule{"report": {Enabled: false}})
+	if f.Enabled("report", "general", "u1") {
+		t.Error("無効にした機能は無効になるべきです")
+	}
+	if !f.Enabled("remind", "general", "u1") {
+		t.Error("設定されていない機能は有効になるべきです")
+	}
+}
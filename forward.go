@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	forwardRateLimit  = flag.Int("forward-rate-limit", 20, "1人のユーザーが-forward-rate-windowの間に転送できる回数 (0の場合は制限しない)")
+	forwardRateWindow = flag.Duration("forward-rate-window", time.Minute, "転送の回数を数える期間")
+)
+
+var (
+	// ErrForwardForbidden 転送先のルームに投稿できない場合に発生するエラー
+	ErrForwardForbidden = errors.New("chat: 転送先のルームには投稿できません。")
+	// ErrRoomAccessDenied ルームへの参加が許可されていないユーザーがメッセージを読み書きしようとした場合に発生するエラー
+	ErrRoomAccessDenied = errors.New("chat: このルームを利用する権限がありません。")
+	// ErrForwardRateLimited 転送の回数が上限に達している場合に発生するエラー
+	ErrForwardRateLimited = errors.New("chat: 転送の回数が上限に達しました。しばらくしてから再試行してください。")
+)
+
+// forwardLimits 転送の回数の制限。アップロードと同じようにユーザーごとに数える
+var forwardLimits = newUploadLimiter()
+
+// checkRoomAccess WebSocketでルームに参加するときと同じ条件で、ユーザーがルームを利用できるかどうかを確認する
+// 送信元のIPアドレスが全体またはルームのリストで拒否されている場合や、参加前のフックで拒否された場合はエラーを返す
+// このノードで動作していないルームは生成せず、全体のリストだけを確認する
+func checkRoomAccess(r *http.Request, rooms *roomRegistry, name string, user ChatUser) error {
+	rm, _ := rooms.lookup(name)
+	if !allowedIP(r, rm) {
+		return ErrRoomAccessDenied
+	}
+	if err := runJoinHooks(name, user); err != nil {
+		return ErrRoomAccessDenied
+	}
+	return nil
+}
+
+// maxPermalinkContext パーマリンクで前後に表示するメッセージの最大数
+const maxPermalinkContext = 20
+
+// ForwardInfo 転送したメッセージの転送元
+type ForwardInfo struct {
+	Room      string    `json:"room"`
+	MessageID string    `json:"message_id"`
+	UserID    string    `json:"user_id"`
+	Name      string    `json:"name"`
+	When      time.Time `json:"when"`
+}
+
+// permalink メッセージを表示するページのURL
+func permalink(room, id string) string {
+	return "/rooms/" + room + "/m/" + id
+}
+
+// forwardMessage メッセージを転送元の情報とともに他のルームに投稿する
+// 転送したユーザーの投稿として扱い、投稿できるかどうかや投稿前のフックは通常の投稿と同じように適用する
+// 転送元と転送先のどちらのルームにも参加できるユーザーだけが転送できる
+func forwardMessage(r *http.Request, rooms *roomRegistry, user ChatUser, id, target string) (*message, error) {
+	src, err := messages.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if !validRoomName(target) {
+		return nil, ErrInvalidRoomName
+	}
+	if err := checkRoomAccess(r, rooms, src.Room, user); err != nil {
+		return nil, err
+	}
+	if err := checkRoomAccess(r, rooms, target, user); err != nil {
+		return nil, err
+	}
+	rm, err := rooms.existing(target)
+	if err != nil {
+		return nil, err
+	}
+	if !rm.canPost(user.UniqueID()) {
+		return nil, ErrForwardForbidden
+	}
+	if _, ok := forwardLimits.allow(user.UniqueID(), *forwardRateLimit, *forwardRateWindow); !ok {
+		return nil, ErrForwardRateLimited
+	}
+	data := userData(user)
+	msg := &message{
+		Type:    src.Type,
+		ID:      randomID(),
+		Room:    target,
+		UserID:  user.UniqueID(),
+		Name:    user.Name(),
+		Message: src.Message,
+		When:    time.Now(),
+		Sticker: src.Sticker,
+		GIF:     src.GIF,
+		Snippet: src.Snippet,
+		Forwarded: &ForwardInfo{
+			Room:      src.Room,
+			MessageID: src.ID,
+			UserID:    src.UserID,
+			Name:      src.Name,
+			When:      src.When,
+		},
+	}
+	// 転送されたメッセージをさらに転送した場合も、最初の投稿を転送元とする
+	if src.Forwarded != nil {
+		msg.Forwarded = src.Forwarded
+	}
+	if avatarURL, ok := data["avatar_url"].(string); ok {
+		msg.AvatarURL = avatarURL
+	}
+	if err := runMessageHooks(msg); err != nil {
+		return nil, err
+	}
+	if isShadowBanned(msg.UserID) {
+		rm.sendDirect(msg)
+		return msg, nil
+	}
+	rm.Broadcast(msg)
+	return msg, nil
+}
+
+// messageContext パーマリンクで表示するメッセージと前後のメッセージ
+type messageContext struct {
+	Message   *message   `json:"message"`
+	Context   []*message `json:"context"`
+	Permalink string     `json:"permalink"`
+}
+
+// messageAPIHandler 保存されたメッセージのAPI
+// GET  /api/messages/{id}/context?n=5  メッセージと同じルームの前後n件ずつのメッセージ
+// POST /api/messages/{id}/forward      JSONで指定されたルーム({"room": "random"})に転送する
+type messageAPIHandler struct {
+	rooms *roomRegistry
+}
+
+func (h *messageAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/messages"), "/"), "/")
+	switch {
+	case action == "context" && r.Method == http.MethodGet:
+		n, err := strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil || n < 0 || n > maxPermalinkContext {
+			n = 5
+		}
+		// 前後のメッセージを返す前に、メッセージのルームに参加できるユーザーかどうかを確認する
+		src, err := messages.Get(id)
+		if err == nil {
+			err = checkRoomAccess(r, h.rooms, src.Room, user)
+		}
+		var list []*message
+		if err == nil {
+			list, err = messages.Around(id, n)
+		}
+		switch {
+		case err == ErrMessageNotFound:
+			writeJSONError(w, r, err.Error(), http.StatusNotFound)
+			return
+		case err == ErrRoomAccessDenied:
+			writeJSONError(w, r, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			requestLogger(r).Println("メッセージの取得に失敗しました:", err)
+			writeJSONError(w, r, "メッセージを取得できませんでした", http.StatusInternalServerError)
+			return
+		}
+		ctx := &messageContext{Context: list}
+		for _, m := range list {
+			if m.ID == id {
+				ctx.Message = m
+				ctx.Permalink = permalink(m.Room, m.ID)
+			}
+		}
+		writeJSON(w, http.StatusOK, ctx)
+	case action == "forward" && r.Method == http.MethodPost:
+		var req struct {
+			Room string `json:"room"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, r, ErrInvalidRoomName.Error(), http.StatusBadRequest)
+			return
+		}
+		msg, err := forwardMessage(r, h.rooms, user, id, req.Room)
+		switch {
+		case err == ErrMessageNotFound, err == ErrRoomNotFound:
+			writeJSONError(w, r, err.Error(), http.StatusNotFound)
+		case err == ErrForwardForbidden, err == ErrRoomAccessDenied:
+			writeJSONError(w, r, err.Error(), http.StatusForbidden)
+		case err == ErrForwardRateLimited:
+			writeJSONError(w, r, err.Error(), http.StatusTooManyRequests)
+		case err != nil:
+			writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+		default:
+			writeJSON(w, http.StatusCreated, msg)
+		}
+	default:
+		writeJSONError(w, r, "見つかりません", http.StatusNotFound)
+	}
+}
+
+// permalinkHandler メッセージを前後のメッセージとともに表示するページ
+// GET /rooms/{room}/m/{id}
+type permalinkHandler struct {
+	once  sync.Once
+	templ *template.Template
+}
+
+func (h *permalinkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/rooms/"), "/"), "/")
+	if len(parts) != 3 || parts[1] != "m" || !validRoomName(parts[0]) {
+		httpError(w, r, "見つかりません", http.StatusNotFound)
+		return
+	}
+	m, err := messages.Get(parts[2])
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	// メッセージのIDで特定できるため、ルームの名前が違っていても正しいURLに転送する
+	if m.Room != parts[0] {
+		http.Redirect(w, r, permalink(m.Room, m.ID), http.StatusMovedPermanently)
+		return
+	}
+	h.once.Do(func() {
+		h.templ = template.Must(template.ParseFiles(filepath.Join("templates", "permalink.html")))
+	})
+	h.templ.Execute(w, map[string]interface{}{"Room": m.Room, "ID": m.ID})
+}
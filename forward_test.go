@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAround(t *testing.T) {
+	store := newMemoryMessageStore()
+	for i, room := range []string{"general", "random", "general", "general", "general"} {
+		store.Save(&message{ID: string(rune('a' + i)), Room: room, When: time.Now()})
+	}
+	list, err := store.Around("d", 1)
+	if err != nil || len(list) != 3 || list[0].ID != "c" || list[2].ID != "e" {
+		t.Errorf("同じルームの前後のメッセージを返すべきです: %v, %v", list, err)
+	}
+	if list, _ := store.Around("a", 2); len(list) != 3 {
+		t.Errorf("最初のメッセージでは後のメッセージだけを返すべきです: %v", list)
+	}
+	if _, err := store.Around("z", 1); err != ErrMessageNotFound {
+		t.Errorf("存在しないメッセージではErrMessageNotFoundを返すべきです: %v", err)
+	}
+}
+
+func TestForwardMessage(t *testing.T) {
+	defer func(m MessageStore) { messages = m }(messages)
+	messages = newMemoryMessageStore()
+	defer func(s RoomStore) { roomInfos = s }(roomInfos)
+	roomInfos = newMemoryRoomStore()
+	roomInfos.Save(&RoomInfo{Name: "random", UpdatedAt: time.Now()})
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	messages.Save(&message{ID: "m1", Room: "general", UserID: "u1", Name: "Alice", Message: "こんにちは", When: time.Now()})
+	r := httptest.NewRequest(http.MethodPost, "/api/messages/m1/forward", nil)
+
+	msg, err := forwardMessage(r, rooms, sessionUser{uniqueID: "u2", name: "Bob"}, "m1", "random")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Room != "random" || msg.UserID != "u2" || msg.Message != "こんにちは" || msg.Forwarded == nil || msg.Forwarded.Name != "Alice" {
+		t.Errorf("転送元の情報とともに転送したユーザーの投稿にするべきです: %+v", msg)
+	}
+	if _, err := forwardMessage(r, rooms, sessionUser{uniqueID: "u2", name: "Bob"}, "m9", "random"); err != ErrMessageNotFound {
+		t.Errorf("存在しないメッセージは転送できないべきです: %v", err)
+	}
+	if _, err := forwardMessage(r, rooms, sessionUser{uniqueID: "u2", name: "Bob"}, "m1", "../etc"); err != ErrInvalidRoomName {
+		t.Errorf("不正なルームには転送できないべきです: %v", err)
+	}
+	if _, err := forwardMessage(r, rooms, sessionUser{uniqueID: "u2", name: "Bob"}, "m1", "nowhere"); err != ErrRoomNotFound {
+		t.Errorf("存在しないルームには転送できないべきです: %v", err)
+	}
+	if _, ok := rooms.lookup("nowhere"); ok {
+		t.Error("転送でルームを生成するべきではありません")
+	}
+}
+
+func TestForwardChecksRoomAccess(t *testing.T) {
+	defer func(m MessageStore) { messages = m }(messages)
+	messages = newMemoryMessageStore()
+	defer func(s RoomStore) { roomInfos = s }(roomInfos)
+	roomInfos = newMemoryRoomStore()
+	roomInfos.Save(&RoomInfo{Name: "random", UpdatedAt: time.Now()})
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	messages.Save(&message{ID: "m1", Room: "general", UserID: "u1", Name: "Alice", Message: "秘密", When: time.Now()})
+	general, _ := rooms.get("general")
+	general.SetSettings(roomSettings{IPDeny: []string{"192.0.2.1"}})
+
+	user := sessionUser{uniqueID: "u2", name: "Bob"}
+	h := &messageAPIHandler{rooms: rooms}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"拒否されたルームの前後のメッセージ", http.MethodGet, "/api/messages/m1/context", "", http.StatusForbidden},
+		{"拒否されたルームからの転送", http.MethodPost, "/api/messages/m1/forward", `{"room":"random"}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		r = r.WithContext(withUser(r.Context(), user))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: ステータスコードが不正です: %d", tt.name, w.Code)
+		}
+	}
+
+	// 送信元のIPアドレスが許可されていれば転送できる
+	general.SetSettings(roomSettings{})
+	r := httptest.NewRequest(http.MethodPost, "/api/messages/m1/forward", nil)
+	if _, err := forwardMessage(r, rooms, user, "m1", "random"); err != nil {
+		t.Errorf("参加できるルームの間では転送できるべきです: %v", err)
+	}
+	random, _ := rooms.lookup("random")
+	random.SetSettings(roomSettings{IPDeny: []string{"192.0.2.0/24"}})
+	if _, err := forwardMessage(r, rooms, user, "m1", "random"); err != ErrRoomAccessDenied {
+		t.Errorf("参加できないルームには転送できないべきです: %v", err)
+	}
+}
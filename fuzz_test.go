@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func FuzzDecodeMessage(f *testing.F) {
+	for _, seed := range []string{
+		`{"Message":"hello"}`,
+		`{"Type":"hello","Version":1}`,
+		`{"Type":"remind","Ref":"abc","Message":"1h"}`,
+		`[{"Message":"batch"}]`,
+		`null`,
+		`"text"`,
+		`{"When":"not a time"}`,
+		`{"Versions":[1,2,3],"Features":["a"]}`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := decodeMessage(data)
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			t.Fatal("エラーがない場合はイベントを返すべきです")
+		}
+		// 受信したイベントは配信のためにエンコードし直せるべきです
+		if _, err := json.Marshal(msg); err != nil {
+			t.Fatal("デコードしたイベントをエンコードできません:", err)
+		}
+		prepareMessage(msg)
+		negotiateVersion(msg.Version)
+		capabilities{capCompact: true}.shape(msg)
+	})
+}
+
+func FuzzUserFromCookie(f *testing.F) {
+	f.Add("")
+	f.Add("e30=")
+	f.Add("eyJ1c2VyaWQiOiJ1MSIsInNlc3Npb25faWQiOiJzMSJ9")
+	f.Add("!!!notbase64")
+	f.Fuzz(func(t *testing.T, value string) {
+		user, err := userFromCookie(&http.Cookie{Name: "auth", Value: value})
+		if err != nil {
+			return
+		}
+		if user.UniqueID() == "" || user.sessionID == "" {
+			t.Fatalf("ユーザーIDとセッションIDのないCookieは受け付けないべきです: %+v", user)
+		}
+	})
+}
+
+func FuzzParseReminderTime(f *testing.F) {
+	for _, seed := range []string{"30m", "2h", " 1h30m ", "-1h", "0s", "2026-01-01T00:00:00Z", "9999999999h", ""} {
+		f.Add(seed)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	f.Fuzz(func(t *testing.T, s string) {
+		at, err := parseReminderTime(s, now)
+		if err == nil && !at.After(now) {
+			t.Fatalf("過去の時刻を受け付けないべきです: %q -> %v", s, at)
+		}
+	})
+}
+
+func FuzzParseUploadMetadata(f *testing.F) {
+	f.Add("filename d29ybGQucG5n,filetype aW1hZ2UvcG5n")
+	f.Add("flag,,key !!!")
+	f.Fuzz(func(t *testing.T, s string) {
+		parseUploadMetadata(s)
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+var (
+	geoipDB    = flag.String("geoip-db", "", "国の判定に使用するMaxMindのCountryまたはCityデータベース (空の場合は判定しない)")
+	geoipASNDB = flag.String("geoip-asn-db", "", "ASNの判定に使用するMaxMindのASNデータベース (空の場合は判定しない)")
+)
+
+// GeoInfo IPアドレスから推定した位置とネットワークの情報
+type GeoInfo struct {
+	// CountryはISO 3166-1の2文字の国コード
+	Country string `json:"country,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+	Org     string `json:"org,omitempty"`
+}
+
+// GeoLocator IPアドレスから位置を推定する
+type GeoLocator interface {
+	// Lookup 推定できない項目は空のまま返す
+	Lookup(ip string) GeoInfo
+}
+
+// nopGeoLocator 何も推定しないGeoLocator
+type nopGeoLocator struct{}
+
+func (nopGeoLocator) Lookup(string) GeoInfo { return GeoInfo{} }
+
+// maxmindGeoLocator MaxMindのデータベースで推定するGeoLocator
+type maxmindGeoLocator struct {
+	country *geoip2.Reader
+	asn     *geoip2.Reader
+}
+
+// openGeoLocator フラグの設定に従ってGeoLocatorを生成する
+func openGeoLocator(countryPath, asnPath string) (GeoLocator, error) {
+	if countryPath == "" && asnPath == "" {
+		return nopGeoLocator{}, nil
+	}
+	g := &maxmindGeoLocator{}
+	var err error
+	if countryPath != "" {
+		if g.country, err = geoip2.Open(countryPath); err != nil {
+			return nil, err
+		}
+	}
+	if asnPath != "" {
+		if g.asn, err = geoip2.Open(asnPath); err != nil {
+			if g.country != nil {
+				g.country.Close()
+			}
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+func (g *maxmindGeoLocator) Lookup(addr string) GeoInfo {
+	var info GeoInfo
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return info
+	}
+	if g.country != nil {
+		if c, err := g.country.Country(ip); err == nil {
+			info.Country = c.Country.IsoCode
+		}
+	}
+	if g.asn != nil {
+		if a, err := g.asn.ASN(ip); err == nil {
+			info.ASN, info.Org = a.AutonomousSystemNumber, a.AutonomousSystemOrganization
+		}
+	}
+	return info
+}
+
+// geoCount 国またはASNごとのログイン数
+type geoCount struct {
+	Key    string `json:"key"`
+	Logins int    `json:"logins"`
+	Users  int    `json:"users"`
+}
+
+// geoReport 管理画面に表示するログイン元の集計
+type geoReport struct {
+	Countries []geoCount `json:"countries"`
+	ASNs      []geoCount `json:"asns"`
+}
+
+// geoStatsHandler 管理者用のログイン元の集計API
+// GET /api/admin/stats/geo?days=30
+func geoStatsHandler(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeJSONError(w, r, "daysには1以上の数を指定してください", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	logins, err := auditLog.Query(AuditQuery{Action: auditLogin, Since: time.Now().AddDate(0, 0, -days)})
+	if err != nil {
+		requestLogger(r).Println("監査ログを検索できませんでした:", err)
+		writeJSONError(w, r, "集計に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	countries, asns := newGeoCounter(), newGeoCounter()
+	for _, e := range logins {
+		if e.Country != "" {
+			countries.add(e.Country, e.UserID)
+		}
+		if e.ASN != 0 {
+			asns.add("AS"+strconv.FormatUint(uint64(e.ASN), 10), e.UserID)
+		}
+	}
+	writeJSON(w, http.StatusOK, geoReport{Countries: countries.list(), ASNs: asns.list()})
+}
+
+// geoCounter キーごとのログイン数とユーザー数を数える
+type geoCounter struct {
+	logins map[string]int
+	users  map[string]map[string]bool
+}
+
+func newGeoCounter() *geoCounter {
+	return &geoCounter{logins: make(map[string]int), users: make(map[string]map[string]bool)}
+}
+
+func (c *geoCounter) add(key, userID string) {
+	c.logins[key]++
+	if c.users[key] == nil {
+		c.users[key] = make(map[string]bool)
+	}
+	c.users[key][userID] = true
+}
+
+// list ログイン数の多い順に返す
+func (c *geoCounter) list() []geoCount {
+	list := []geoCount{}
+	for key, n := range c.logins {
+		list = append(list, geoCount{Key: key, Logins: n, Users: len(c.users[key])})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Logins != list[j].Logins {
+			return list[i].Logins > list[j].Logins
+		}
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeGeoLocator 固定の対応表で推定するGeoLocator
+type fakeGeoLocator map[string]GeoInfo
+
+func (f fakeGeoLocator) Lookup(ip string) GeoInfo { return f[ip] }
+
+func TestGeoStats(t *testing.T) {
+	defer func(g GeoLocator, a AuditStore) { geo, auditLog = g, a }(geo, auditLog)
+	geo = fakeGeoLocator{"192.0.2.1": {Country: "JP", ASN: 64500}, "198.51.100.1": {Country: "US"}}
+	auditLog = newMemoryAuditStore(nil)
+	recordAudit(&AuditEntry{Action: auditLogin, UserID: "u1", IP: "192.0.2.1"})
+	recordAudit(&AuditEntry{Action: auditLogin, UserID: "u2", IP: "192.0.2.1"})
+	recordAudit(&AuditEntry{Action: auditLogin, UserID: "u1", IP: "198.51.100.1"})
+
+	w := httptest.NewRecorder()
+	geoStatsHandler(w, httptest.NewRequest("GET", "/api/admin/stats/geo", nil))
+	var report geoReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Countries) != 2 || report.Countries[0] != (geoCount{Key: "JP", Logins: 2, Users: 2}) {
+		t.Errorf("国ごとの集計が不正です: %+v", report.Countries)
+	}
+	if len(report.ASNs) != 1 || report.ASNs[0].Key != "AS64500" {
+		t.Errorf("ASNごとの集計が不正です: %+v", report.ASNs)
+	}
+}
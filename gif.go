@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	gifProvider = flag.String("gif-provider", "", "GIFの検索に使用するサービス (giphy, tenor。空の場合は無効)")
+	gifKey      = flag.String("gif-key", "", "GIFの検索サービスのAPIキー (クライアントには公開しない)")
+	gifRating   = flag.String("gif-rating", "g", "GIFの検索結果に含めるレーティングの上限 (Giphyはg, pg, pg-13, r、Tenorはhigh, medium, low, off)")
+)
+
+// maxGIFResults 1回の検索で返すGIFの最大数
+const maxGIFResults = 50
+
+var (
+	// ErrNoGIFSearch GIFの検索サービスが設定されていない場合に発生するエラー
+	ErrNoGIFSearch = errors.New("chat: GIFの検索は利用できません。")
+	// ErrInvalidGIF 送信されたGIFが検索サービスのものでない場合に発生するエラー
+	ErrInvalidGIF = errors.New("chat: GIFには検索結果のURLを指定してください。")
+)
+
+// GIF 検索結果の1件のGIF
+type GIF struct {
+	ID         string `json:"id"`
+	Title      string `json:"title,omitempty"`
+	URL        string `json:"url"`
+	PreviewURL string `json:"preview_url,omitempty"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+}
+
+// GIFSearcher GIFを検索する
+type GIFSearcher interface {
+	// Search queryに一致するGIFを最大limit件返す
+	Search(query string, limit int) ([]GIF, error)
+	// Owns URLがこのサービスが配信するGIFのものかどうか
+	Owns(rawURL string) bool
+}
+
+// gifHTTPClient GIFの検索サービスへのリクエストに使用するHTTPクライアント
+var gifHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// newGIFSearcher フラグの設定に従ってGIFSearcherを生成する
+func newGIFSearcher(name, key, rating string) (GIFSearcher, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "giphy":
+		return &giphySearcher{key: key, rating: rating, endpoint: "https://api.giphy.com/v1/gifs/search"}, nil
+	case "tenor":
+		return &tenorSearcher{key: key, filter: rating, endpoint: "https://tenor.googleapis.com/v2/search"}, nil
+	}
+	return nil, fmt.Errorf("chat: 非対応のGIFの検索サービスです: %s", name)
+}
+
+// getGIFs 検索サービスにリクエストを送信し、JSONのレスポンスをvに読み込む
+func getGIFs(endpoint string, query url.Values, v interface{}) error {
+	res, err := gifHTTPClient.Get(endpoint + "?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("chat: GIFの検索サービスがエラーを返しました: %s", res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// httpsHost URLがHTTPSで、ホスト名がsuffixで終わるかどうか
+func httpsHost(rawURL string, suffixes ...string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	for _, suffix := range suffixes {
+		if u.Hostname() == strings.TrimPrefix(suffix, ".") || strings.HasSuffix(u.Hostname(), suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// giphySearcher Giphy APIを使用するGIFSearcher
+type giphySearcher struct {
+	key      string
+	rating   string
+	endpoint string
+}
+
+func (s *giphySearcher) Search(query string, limit int) ([]GIF, error) {
+	var body struct {
+		Data []struct {
+			ID     string `json:"id"`
+			Title  string `json:"title"`
+			Images struct {
+				FixedHeight struct {
+					URL    string `json:"url"`
+					Width  string `json:"width"`
+					Height string `json:"height"`
+				} `json:"fixed_height"`
+				FixedWidthSmall struct {
+					URL string `json:"url"`
+				} `json:"fixed_width_small"`
+			} `json:"images"`
+		} `json:"data"`
+	}
+	params := url.Values{"api_key": {s.key}, "q": {query}, "limit": {strconv.Itoa(limit)}, "rating": {s.rating}}
+	if err := getGIFs(s.endpoint, params, &body); err != nil {
+		return nil, err
+	}
+	list := []GIF{}
+	for _, d := range body.Data {
+		width, _ := strconv.Atoi(d.Images.FixedHeight.Width)
+		height, _ := strconv.Atoi(d.Images.FixedHeight.Height)
+		list = append(list, GIF{
+			ID:         d.ID,
+			Title:      d.Title,
+			URL:        d.Images.FixedHeight.URL,
+			PreviewURL: d.Images.FixedWidthSmall.URL,
+			Width:      width,
+			Height:     height,
+		})
+	}
+	return list, nil
+}
+
+func (s *giphySearcher) Owns(rawURL string) bool {
+	return httpsHost(rawURL, ".giphy.com")
+}
+
+// tenorSearcher Tenor API (v2)を使用するGIFSearcher
+type tenorSearcher struct {
+	key      string
+	filter   string
+	endpoint string
+}
+
+func (s *tenorSearcher) Search(query string, limit int) ([]GIF, error) {
+	var body struct {
+		Results []struct {
+			ID                 string `json:"id"`
+			ContentDescription string `json:"content_description"`
+			MediaFormats       map[string]struct {
+				URL  string `json:"url"`
+				Dims []int  `json:"dims"`
+			} `json:"media_formats"`
+		} `json:"results"`
+	}
+	params := url.Values{"key": {s.key}, "q": {query}, "limit": {strconv.Itoa(limit)}, "contentfilter": {s.filter}, "media_filter": {"gif,tinygif"}}
+	if err := getGIFs(s.endpoint, params, &body); err != nil {
+		return nil, err
+	}
+	list := []GIF{}
+	for _, r := range body.Results {
+		gif := GIF{ID: r.ID, Title: r.ContentDescription, URL: r.MediaFormats["gif"].URL, PreviewURL: r.MediaFormats["tinygif"].URL}
+		if dims := r.MediaFormats["gif"].Dims; len(dims) == 2 {
+			gif.Width, gif.Height = dims[0], dims[1]
+		}
+		list = append(list, gif)
+	}
+	return list, nil
+}
+
+func (s *tenorSearcher) Owns(rawURL string) bool {
+	return httpsHost(rawURL, ".tenor.com")
+}
+
+// resolveGIF GIFのメッセージを検証する
+// 任意の画像を埋め込めないように、検索サービスが配信するURLだけを受け付ける
+// 履歴を読むクライアントのために、本文には代替テキストとしてタイトルかURLを設定する
+func resolveGIF(msg *message) error {
+	if gifs == nil {
+		return ErrNoGIFSearch
+	}
+	if msg.GIF == nil || !gifs.Owns(msg.GIF.URL) || (msg.GIF.PreviewURL != "" && !gifs.Owns(msg.GIF.PreviewURL)) {
+		return ErrInvalidGIF
+	}
+	msg.Message = msg.GIF.Title
+	if msg.Message == "" {
+		msg.Message = msg.GIF.URL
+	}
+	return nil
+}
+
+// gifSearchHandler APIキーをクライアントに公開せずにGIFを検索する
+// GET /api/gifs/search?q=cat&limit=20
+func gifSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if gifs == nil {
+		writeJSONError(w, r, ErrNoGIFSearch.Error(), http.StatusNotFound)
+		return
+	}
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		writeJSONError(w, r, "検索する言葉を指定してください", http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > maxGIFResults {
+		limit = 20
+	}
+	list, err := gifs.Search(query, limit)
+	if err != nil {
+		requestLogger(r).Println("GIFの検索に失敗しました:", err)
+		writeJSONError(w, r, "GIFを検索できませんでした", http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGiphySearch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("api_key") != "secret" || r.URL.Query().Get("q") != "cat" {
+			t.Errorf("APIキーと検索する言葉を送信するべきです: %s", r.URL.RawQuery)
+		}
+		w.Write([]byte(`{"data":[{"id":"g1","title":"cat","images":{"fixed_height":{"url":"https://media0.giphy.com/g1.gif","width":"200","height":"100"},"fixed_width_small":{"url":"https://media0.giphy.com/g1s.gif"}}}]}`))
+	}))
+	defer ts.Close()
+	s := &giphySearcher{key: "secret", rating: "g", endpoint: ts.URL}
+	list, err := s.Search("cat", 10)
+	if err != nil || len(list) != 1 || list[0].Width != 200 || list[0].PreviewURL == "" {
+		t.Fatalf("検索結果を変換するべきです: %+v, %v", list, err)
+	}
+
+	defer func(g GIFSearcher) { gifs = g }(gifs)
+	gifs = s
+	msg := &message{Type: typeGIF, GIF: &list[0]}
+	if err := resolveGIF(msg); err != nil || msg.Message != "cat" {
+		t.Errorf("検索結果のGIFは送信できるべきです: %v, %s", err, msg.Message)
+	}
+	for _, u := range []string{"https://evil.example.com/x.gif", "http://media0.giphy.com/g1.gif", "https://giphy.com.evil.example/x.gif"} {
+		if err := resolveGIF(&message{GIF: &GIF{URL: u}}); err != ErrInvalidGIF {
+			t.Errorf("%sは拒否するべきです: %v", u, err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrGroupNotFound 指定されたグループが存在しない場合に発生するエラー
+	ErrGroupNotFound = errors.New("chat: グループが見つかりません。")
+	// ErrInvalidGroup グループの名前やメンバーが不正な場合に発生するエラー
+	ErrInvalidGroup = errors.New("chat: グループの名前には英小文字、数字、-、_を32文字以内で指定し、メンバーには登録済みのユーザーを指定してください。")
+)
+
+// groupNamePattern グループの名前。メッセージでは@に続けて指定する
+var groupNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// mentionPattern メッセージ中のメンション
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([a-z0-9][a-z0-9_-]{0,31})\b`)
+
+// Group メンションでまとめて呼び出せるユーザーのグループ (例: @oncall)
+type Group struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Members     []string  `json:"members"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// GroupStore グループを保存する
+type GroupStore interface {
+	Get(name string) (*Group, error)
+	// List すべてのグループを名前順に返す
+	List() ([]*Group, error)
+	Save(g *Group) error
+	Delete(name string) error
+}
+
+// memoryGroupStore メモリ上にグループを保持するGroupStore
+type memoryGroupStore struct {
+	mu     sync.Mutex
+	groups map[string]*Group
+}
+
+func newMemoryGroupStore() *memoryGroupStore {
+	return &memoryGroupStore{groups: make(map[string]*Group)}
+}
+
+func copyGroup(g *Group) *Group {
+	copied := *g
+	copied.Members = append([]string{}, g.Members...)
+	return &copied
+}
+
+func (s *memoryGroupStore) Get(name string) (*Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[name]
+	if !ok {
+		return nil, ErrGroupNotFound
+	}
+	return copyGroup(g), nil
+}
+
+func (s *memoryGroupStore) List() ([]*Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []*Group{}
+	for _, g := range s.groups {
+		list = append(list, copyGroup(g))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func (s *memoryGroupStore) Save(g *Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups[g.Name] = copyGroup(g)
+	return nil
+}
+
+func (s *memoryGroupStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.groups[name]; !ok {
+		return ErrGroupNotFound
+	}
+	delete(s.groups, name)
+	return nil
+}
+
+// leaveGroups ユーザーをすべてのグループのメンバーから外す
+func leaveGroups(userID string) error {
+	list, err := groups.List()
+	if err != nil {
+		return err
+	}
+	for _, g := range list {
+		members := []string{}
+		for _, id := range g.Members {
+			if id != userID {
+				members = append(members, id)
+			}
+		}
+		if len(members) == len(g.Members) {
+			continue
+		}
+		g.Members = members
+		if err := groups.Save(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mention メッセージ中のメンション。クライアントはTextの部分を強調して表示する
+type Mention struct {
+	Text string `json:"text"`
+	// Groupはグループへのメンションの場合のグループの名前
+	Group string `json:"group,omitempty"`
+}
+
+// resolveMentions メッセージ中のグループへのメンションを見つけ、メンションと通知するユーザーを返す
+// 存在しないグループへのメンションは通常のテキストとして扱う
+func resolveMentions(text string) ([]Mention, []string) {
+	var mentions []Mention
+	var userIDs []string
+	seen := make(map[string]bool)
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name := m[1]
+		if seen["@"+name] {
+			continue
+		}
+		seen["@"+name] = true
+		g, err := groups.Get(name)
+		if err != nil {
+			continue
+		}
+		mentions = append(mentions, Mention{Text: "@" + name, Group: name})
+		for _, id := range g.Members {
+			if !seen[id] {
+				seen[id] = true
+				userIDs = append(userIDs, id)
+			}
+		}
+	}
+	return mentions, userIDs
+}
+
+// notifyMentioned メンションされたユーザーに通知の設定に従って知らせる。投稿者本人には知らせない
+func notifyMentioned(msg *message, userIDs []string) {
+	for _, id := range userIDs {
+		if id == msg.UserID {
+			continue
+		}
+		notify(notification{
+			UserID:  id,
+			Text:    msg.Name + "さんが#" + msg.Room + "でメンションしました: " + msg.Message,
+			Room:    msg.Room,
+			Mention: true,
+		}, time.Now())
+	}
+}
+
+// groupsHandler グループの一覧 (メンションの入力補完用)
+// GET /api/groups
+func groupsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := groups.List()
+	if err != nil {
+		requestLogger(r).Println("グループの取得に失敗しました:", err)
+		writeJSONError(w, r, "グループを取得できませんでした", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// groupAdminHandler グループを管理する
+// PUT    /api/admin/groups/{name}  JSONでグループを作成・更新する
+// DELETE /api/admin/groups/{name}  グループを削除する
+func groupAdminHandler(w http.ResponseWriter, r *http.Request) {
+	admin, _ := userFromContext(r.Context())
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/groups"), "/")
+	if name == "" && r.Method == http.MethodGet {
+		groupsHandler(w, r)
+		return
+	}
+	if !groupNamePattern.MatchString(name) {
+		writeJSONError(w, r, ErrInvalidGroup.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var g Group
+		if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+			writeJSONError(w, r, ErrInvalidGroup.Error(), http.StatusBadRequest)
+			return
+		}
+		g.Name = name
+		g.UpdatedAt = time.Now()
+		members := []string{}
+		seen := make(map[string]bool)
+		for _, id := range g.Members {
+			if seen[id] {
+				continue
+			}
+			if _, err := users.GetByID(id); err != nil {
+				writeJSONError(w, r, ErrInvalidGroup.Error(), http.StatusBadRequest)
+				return
+			}
+			seen[id] = true
+			members = append(members, id)
+		}
+		g.Members = members
+		if err := groups.Save(&g); err != nil {
+			requestLogger(r).Println("グループの保存に失敗しました:", err)
+			writeJSONError(w, r, "グループを保存できませんでした", http.StatusInternalServerError)
+			return
+		}
+		auditRequest(r, auditAdminAction, admin.UniqueID(), "", map[string]string{
+			"action": "save_group", "group": name, "members": strings.Join(g.Members, ","),
+		})
+		writeJSON(w, http.StatusOK, &g)
+	case http.MethodDelete:
+		if err := groups.Delete(name); err != nil {
+			writeJSONError(w, r, err.Error(), http.StatusNotFound)
+			return
+		}
+		auditRequest(r, auditAdminAction, admin.UniqueID(), "", map[string]string{"action": "delete_group", "group": name})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveMentions(t *testing.T) {
+	defer func(g GroupStore) { groups = g }(groups)
+	groups = newMemoryGroupStore()
+	groups.Save(&Group{Name: "oncall", Members: []string{"u1", "u2"}})
+	groups.Save(&Group{Name: "designers", Members: []string{"u2", "u3"}})
+
+	mentions, userIDs := resolveMentions("@oncall と @designers に確認を。@nobody と mail@oncall は対象外、@oncall の重複も")
+	if want := []Mention{{Text: "@oncall", Group: "oncall"}, {Text: "@designers", Group: "designers"}}; !reflect.DeepEqual(mentions, want) {
+		t.Errorf("存在するグループへのメンションだけを返すべきです: %v", mentions)
+	}
+	if want := []string{"u1", "u2", "u3"}; !reflect.DeepEqual(userIDs, want) {
+		t.Errorf("メンバーを重複なく展開するべきです: %v", userIDs)
+	}
+
+	groups.Save(&Group{Name: "oncall", Members: []string{"u1", "u2"}})
+	if err := leaveGroups("u2"); err != nil {
+		t.Fatal(err)
+	}
+	if g, _ := groups.Get("designers"); !reflect.DeepEqual(g.Members, []string{"u3"}) {
+		t.Errorf("削除したユーザーはグループから外すべきです: %v", g.Members)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxHighlightWords 1人のユーザーが登録できるキーワードの最大数
+	maxHighlightWords = 20
+	// maxHighlightWordLength キーワードの最大長 (文字数)
+	maxHighlightWordLength = 50
+	// highlightRefreshInterval 他のノードで変更されたキーワードを読み直す間隔
+	highlightRefreshInterval = time.Minute
+)
+
+var (
+	highlightMinVisits    = flag.Int("highlight-min-visits", 2, "ハイライトのお知らせを受け取るためにルームに参加している必要がある回数")
+	highlightMemberWindow = flag.Duration("highlight-member-window", 30*24*time.Hour, "ハイライトのお知らせを受け取るために最後にルームに参加してから経過してよい期間")
+)
+
+// ErrInvalidHighlights キーワードの指定が不正な場合に発生するエラー
+var ErrInvalidHighlights = errors.New("chat: キーワードは20個以内で、それぞれ1文字以上50文字以内で指定してください。")
+
+// HighlightStore ユーザーが登録したキーワードを保存する
+type HighlightStore interface {
+	// Get ユーザーのキーワードを返す。登録されていない場合は空のスライスを返す
+	Get(userID string) ([]string, error)
+	// Set ユーザーのキーワードを置き換える。空の場合は削除する
+	Set(userID string, words []string) error
+	// All キーワードを登録しているすべてのユーザーのキーワードを返す
+	All() (map[string][]string, error)
+}
+
+// memoryHighlightStore メモリ上にキーワードを保持するHighlightStore
+type memoryHighlightStore struct {
+	mu    sync.RWMutex
+	words map[string][]string
+}
+
+func newMemoryHighlightStore() *memoryHighlightStore {
+	return &memoryHighlightStore{words: make(map[string][]string)}
+}
+
+func (s *memoryHighlightStore) Get(userID string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string{}, s.words[userID]...), nil
+}
+
+func (s *memoryHighlightStore) Set(userID string, words []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(words) == 0 {
+		delete(s.words, userID)
+		return nil
+	}
+	s.words[userID] = append([]string{}, words...)
+	return nil
+}
+
+func (s *memoryHighlightStore) All() (map[string][]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	all := make(map[string][]string, len(s.words))
+	for userID, words := range s.words {
+		all[userID] = append([]string{}, words...)
+	}
+	return all, nil
+}
+
+// normalizeHighlights キーワードの前後の空白を取り除き、大文字と小文字を区別せずに重複を除く
+func normalizeHighlights(words []string) ([]string, error) {
+	normalized := []string{}
+	seen := make(map[string]bool)
+	for _, w := range words {
+		w = strings.TrimSpace(w)
+		if n := utf8.RuneCountInString(w); n == 0 || n > maxHighlightWordLength {
+			return nil, ErrInvalidHighlights
+		}
+		if key := strings.ToLower(w); !seen[key] {
+			seen[key] = true
+			normalized = append(normalized, w)
+		}
+	}
+	if len(normalized) > maxHighlightWords {
+		return nil, ErrInvalidHighlights
+	}
+	return normalized, nil
+}
+
+// highlightIndex 投稿ごとにストアを読まないよう、すべてのユーザーのキーワードを保持する
+// このノードでの変更はすぐに、他のノードでの変更はhighlightRefreshIntervalごとに反映する
+type highlightIndex struct {
+	mu       sync.Mutex
+	words    map[string][]string
+	loadedAt time.Time
+}
+
+// highlightWords キーワードの一覧
+var highlightWords = &highlightIndex{}
+
+// invalidate 次の照合でストアから読み直す
+func (idx *highlightIndex) invalidate() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.words = nil
+}
+
+// match 本文に登録したキーワードが含まれるユーザーと、一致したキーワードを返す
+func (idx *highlightIndex) match(text string, now time.Time) map[string][]string {
+	idx.mu.Lock()
+	if idx.words == nil || now.Sub(idx.loadedAt) > highlightRefreshInterval {
+		all, err := highlights.All()
+		if err != nil {
+			log.Println("キーワードの取得に失敗しました:", err)
+		} else {
+			idx.words, idx.loadedAt = all, now
+		}
+	}
+	words := idx.words
+	idx.mu.Unlock()
+
+	lower := strings.ToLower(text)
+	matched := make(map[string][]string)
+	for userID, list := range words {
+		for _, w := range list {
+			if strings.Contains(lower, strings.ToLower(w)) {
+				matched[userID] = append(matched[userID], w)
+			}
+		}
+	}
+	return matched
+}
+
+// highlightRecipient ユーザーがルームのハイライトのお知らせを受け取れるかどうかを判定する
+// 繰り返し参加していて最近も参加したユーザーで、最後に参加したときのIPアドレスが今も許可されている場合だけ受け取れる
+func highlightRecipient(rooms *roomRegistry, roomName, userID string, now time.Time) bool {
+	m, err := members.Get(roomName, userID)
+	if err != nil {
+		return false
+	}
+	if m.Visits < *highlightMinVisits || now.Sub(m.LastSeen) > *highlightMemberWindow {
+		return false
+	}
+	var rm *room
+	if rooms != nil {
+		rm, _ = rooms.lookup(roomName)
+	}
+	_, allowed := ipAllowedIn(m.IP, rm)
+	return allowed
+}
+
+// notifyHighlights 投稿に登録したキーワードが含まれるユーザーにハイライトのお知らせを送る
+// 投稿者本人、ルームのメンバーとみなせないユーザー、グループへのメンションで通知済みのユーザーには送らない
+func notifyHighlights(rooms *roomRegistry, msg *message) {
+	matched := highlightWords.match(msg.Message, time.Now())
+	if len(matched) == 0 {
+		return
+	}
+	_, mentioned := resolveMentions(msg.Message)
+	skip := map[string]bool{msg.UserID: true}
+	for _, id := range mentioned {
+		skip[id] = true
+	}
+	for userID, words := range matched {
+		if skip[userID] {
+			continue
+		}
+		if !highlightRecipient(rooms, msg.Room, userID, time.Now()) {
+			continue
+		}
+		notify(notification{
+			UserID:  userID,
+			Text:    msg.Name + "さんが#" + msg.Room + "で「" + strings.Join(words, "」「") + "」について投稿しました: " + msg.Message,
+			Room:    msg.Room,
+			Mention: true,
+			Event: &message{
+				Type:       typeHighlight,
+				ID:         randomID(),
+				Room:       msg.Room,
+				UserID:     userID,
+				Name:       msg.Name,
+				Message:    msg.Message,
+				When:       msg.When,
+				Ref:        msg.ID,
+				Highlights: words,
+			},
+		}, time.Now())
+	}
+}
+
+// subscribeHighlights このノードで投稿されたメッセージをキーワードと照合する
+func subscribeHighlights(bus *eventBus, rooms *roomRegistry) {
+	bus.Subscribe(EventMessageBroadcast, func(e Event) {
+		if e.Message != nil && isPost(e.Message) && !e.Message.Auto {
+			go notifyHighlights(rooms, e.Message)
+		}
+	})
+}
+
+// highlightsHandler 自分のキーワードのAPI
+// GET /api/me/highlights  キーワードの一覧
+// PUT /api/me/highlights  JSONでキーワードを置き換える ({"words": ["障害", "deploy"]})
+func highlightsHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	switch r.Method {
+	case http.MethodGet:
+		words, err := highlights.Get(user.UniqueID())
+		if err != nil {
+			requestLogger(r).Println("キーワードの取得に失敗しました:", err)
+			writeJSONError(w, r, "キーワードを取得できませんでした", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"words": words})
+	case http.MethodPut:
+		var req struct {
+			Words []string `json:"words"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, r, ErrInvalidHighlights.Error(), http.StatusBadRequest)
+			return
+		}
+		words, err := normalizeHighlights(req.Words)
+		if err != nil {
+			writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := highlights.Set(user.UniqueID(), words); err != nil {
+			requestLogger(r).Println("キーワードの保存に失敗しました:", err)
+			writeJSONError(w, r, "キーワードを保存できませんでした", http.StatusInternalServerError)
+			return
+		}
+		highlightWords.invalidate()
+		writeJSON(w, http.StatusOK, map[string][]string{"words": words})
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNotifyHighlights(t *testing.T) {
+	defer func(n Notifier, h HighlightStore, m MemberStore, g GroupStore) {
+		notifier, highlights, members, groups = n, h, m, g
+		highlightWords.invalidate()
+	}(notifier, highlights, members, groups)
+	var sent recordingNotifier
+	notifier, highlights, members, groups = &sent, newMemoryHighlightStore(), newMemoryMemberStore(), newMemoryGroupStore()
+	highlightWords.invalidate()
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	general, _ := rooms.get("general")
+	general.SetSettings(roomSettings{IPDeny: []string{"192.0.2.66"}})
+
+	words, err := normalizeHighlights([]string{" Deploy ", "deploy", "障害"})
+	if err != nil || len(words) != 2 {
+		t.Fatalf("キーワードの重複を除くべきです: %v, %v", words, err)
+	}
+	for _, id := range []string{"u1", "u2", "u3", "u4", "u5", "u6", "u7"} {
+		highlights.Set(id, words)
+	}
+	now := time.Now()
+	visits := []struct {
+		userID string
+		ip     string
+		times  int
+		when   time.Time
+	}{
+		{"u1", "192.0.2.1", 2, now},
+		{"u2", "192.0.2.2", 2, now},
+		{"u4", "192.0.2.4", 2, now},
+		{"u5", "192.0.2.5", 1, now},
+		{"u6", "192.0.2.66", 2, now},
+		{"u7", "192.0.2.7", 2, now.Add(-*highlightMemberWindow - time.Hour)},
+	}
+	for _, v := range visits {
+		for i := 0; i < v.times; i++ {
+			members.Visit("general", v.userID, v.ip, v.when)
+		}
+	}
+	groups.Save(&Group{Name: "oncall", Members: []string{"u4"}})
+
+	notifyHighlights(rooms, &message{Type: typeChat, ID: "m1", Room: "general", UserID: "u1", Name: "Alice", Message: "@oncall DEPLOY が失敗しました", When: now})
+	// u1は投稿者、u3はルームに参加したことがなく、u4はメンションで通知済み
+	// u5は一度しか参加しておらず、u6のIPアドレスはルームで拒否され、u7はしばらく参加していない
+	if len(sent) != 1 || sent[0] != "u2:"+typeHighlight {
+		t.Errorf("キーワードを登録したルームのメンバーにだけハイライトを送るべきです: %v", sent)
+	}
+}
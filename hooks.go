@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// HookPoint フックを呼び出す箇所
+type HookPoint int
+
+const (
+	// OnMessage 投稿されたメッセージを配信する前
+	OnMessage HookPoint = iota
+	// OnJoin クライアントがルームに参加する前
+	OnJoin
+	// OnAuth ログインを完了してセッションを発行する前
+	OnAuth
+)
+
+// MessageHook 投稿されたメッセージを受け取る。msgを書き換えることも、エラーを返して投稿を拒否することもできる
+type MessageHook func(msg *message) error
+
+// JoinHook ルームに参加しようとしているユーザーを受け取る。エラーを返すと参加を拒否する
+type JoinHook func(room string, user ChatUser) error
+
+// AuthHook ログインしようとしているユーザーと認証方法を受け取る。エラーを返すとログインを拒否する
+type AuthHook func(user *UserRecord, method string) error
+
+// ErrRejectedByHook フックが処理を拒否した場合に発生するエラー
+var ErrRejectedByHook = errors.New("chat: プラグインによって拒否されました。")
+
+// hooks 登録されたフック。登録順に呼び出す
+var hooks struct {
+	mu      sync.RWMutex
+	message []MessageHook
+	join    []JoinHook
+	auth    []AuthHook
+}
+
+// RegisterHook 指定された箇所で呼び出すフックを登録する
+// 独自の処理を組み込む場合は、ファイルを追加してinit関数から登録する
+//
+//	func init() {
+//		RegisterHook(OnMessage, func(msg *message) error {
+//			msg.Message = strings.TrimSpace(msg.Message)
+//			return nil
+//		})
+//	}
+//
+// 箇所に合わない関数を渡した場合はパニックする
+func RegisterHook(point HookPoint, fn interface{}) {
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	switch f := fn.(type) {
+	case func(*message) error:
+		fn = MessageHook(f)
+	case func(string, ChatUser) error:
+		fn = JoinHook(f)
+	case func(*UserRecord, string) error:
+		fn = AuthHook(f)
+	}
+	switch f := fn.(type) {
+	case MessageHook:
+		if point == OnMessage {
+			hooks.message = append(hooks.message, f)
+			return
+		}
+	case JoinHook:
+		if point == OnJoin {
+			hooks.join = append(hooks.join, f)
+			return
+		}
+	case AuthHook:
+		if point == OnAuth {
+			hooks.auth = append(hooks.auth, f)
+			return
+		}
+	}
+	panic(fmt.Sprintf("chat: フック%dに登録できない関数です: %T", point, fn))
+}
+
+// runMessageHooks 投稿されたメッセージをフックに渡す。拒否された場合はErrRejectedByHookを含むエラーを返す
+func runMessageHooks(msg *message) error {
+	hooks.mu.RLock()
+	defer hooks.mu.RUnlock()
+	for _, hook := range hooks.message {
+		if err := hook(msg); err != nil {
+			return fmt.Errorf("%w %v", ErrRejectedByHook, err)
+		}
+	}
+	return nil
+}
+
+// runJoinHooks ルームに参加しようとしているユーザーをフックに渡す
+func runJoinHooks(room string, user ChatUser) error {
+	hooks.mu.RLock()
+	defer hooks.mu.RUnlock()
+	for _, hook := range hooks.join {
+		if err := hook(room, user); err != nil {
+			return fmt.Errorf("%w %v", ErrRejectedByHook, err)
+		}
+	}
+	return nil
+}
+
+// runAuthHooks ログインしようとしているユーザーをフックに渡す
+func runAuthHooks(user *UserRecord, method string) error {
+	hooks.mu.RLock()
+	defer hooks.mu.RUnlock()
+	for _, hook := range hooks.auth {
+		if err := hook(user, method); err != nil {
+			return fmt.Errorf("%w %v", ErrRejectedByHook, err)
+		}
+	}
+	return nil
+}
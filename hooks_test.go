@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRegisterHook(t *testing.T) {
+	defer func() { hooks.message = nil }()
+	RegisterHook(OnMessage, func(msg *message) error {
+		if msg.Message == "spam" {
+			return errors.New("spam")
+		}
+		msg.Message += "!"
+		return nil
+	})
+	msg := &message{Message: "hello"}
+	if err := runMessageHooks(msg); err != nil || msg.Message != "hello!" {
+		t.Errorf("フックでメッセージを書き換えられるべきです: %q, %v", msg.Message, err)
+	}
+	if err := runMessageHooks(&message{Message: "spam"}); !errors.Is(err, ErrRejectedByHook) {
+		t.Errorf("フックが拒否した場合はErrRejectedByHookを返すべきです: %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("箇所に合わない関数を登録した場合はパニックするべきです")
+		}
+	}()
+	RegisterHook(OnJoin, func(msg *message) error { return nil })
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"strings"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+var (
+	enableH2C   = flag.Bool("h2c", false, "TLSを使わないアドレスでHTTP/2 (h2c)を受け付ける (リバースプロキシからの接続向け)")
+	enableHTTP3 = flag.Bool("http3", false, "-tls-addrと同じポートのUDPでHTTP/3を受け付ける (実験的。WebSocketには使用されない)")
+)
+
+// ErrHTTP3Config HTTP/3の待ち受けに必要な設定がない場合に発生するエラー
+var ErrHTTP3Config = errors.New("chat: HTTP/3には-tls-addrのTCPのアドレスと証明書が必要です。")
+
+// cleartextProtocols TLSを使わないサーバーで受け付けるプロトコル
+// h2cを有効にしてもWebSocketのアップグレードのためHTTP/1.1は受け付ける
+func cleartextProtocols() *http.Protocols {
+	if !*enableH2C {
+		return nil
+	}
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return protocols
+}
+
+// newHTTP3Listener -tls-addrと同じアドレスのUDPで待ち受けるHTTP/3のサーバーを生成する
+// TLSの待ち受けのレスポンスにはAlt-Svcを付けてHTTP/3に切り替えられることを知らせる
+func newHTTP3Listener(tls *listener) (*listener, error) {
+	if strings.HasPrefix(tls.addr, unixAddrPrefix) || strings.HasPrefix(tls.addr, systemdAddrPrefix) {
+		return nil, ErrHTTP3Config
+	}
+	h3 := &http3.Server{Addr: tls.addr, Handler: tls.server.Handler}
+	next := tls.server.Handler
+	tls.server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 待ち受けを開始する前はポートが決まらないためエラーになるが、その場合は付けない
+		h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+	return &listener{addr: tls.addr, h3: h3, certFile: tls.certFile, keyFile: tls.keyFile}, nil
+}
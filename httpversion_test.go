@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// writeTestCert 127.0.0.1向けの自己署名証明書と秘密鍵をファイルに書き出す
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// freeUDPAddr TCPとUDPで同じポートを使うために空いているUDPのアドレスを返す
+func freeUDPAddr(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestNewListenersHTTP3Config(t *testing.T) {
+	savedAddr, savedTLS, savedCert, savedKey := *addr, *tlsAddr, *tlsCert, *tlsKey
+	defer func() {
+		*addr, *tlsAddr, *tlsCert, *tlsKey, *enableHTTP3 = savedAddr, savedTLS, savedCert, savedKey, false
+	}()
+	*addr, *enableHTTP3 = "127.0.0.1:0", true
+	certFile, keyFile := writeTestCert(t)
+	tests := []struct {
+		tlsAddr   string
+		listeners int
+		err       error
+	}{
+		{"", 0, ErrHTTP3Config},
+		{unixAddrPrefix + filepath.Join(t.TempDir(), "gochat.sock"), 0, ErrHTTP3Config},
+		{systemdAddrPrefix + "https", 0, ErrHTTP3Config},
+		{"127.0.0.1:0", 3, nil},
+	}
+	for _, test := range tests {
+		*tlsAddr, *tlsCert, *tlsKey = test.tlsAddr, certFile, keyFile
+		listeners, err := newListeners(http.NotFoundHandler())
+		if err != test.err || len(listeners) != test.listeners {
+			t.Errorf("%q: %d個、%vになるべきところ%d個、%vでした", test.tlsAddr, test.listeners, test.err, len(listeners), err)
+		}
+		for _, l := range listeners {
+			if l.ln != nil {
+				l.ln.Close()
+			}
+		}
+		if err == nil && listeners[2].h3 == nil {
+			t.Errorf("%q: 最後にHTTP/3の待ち受けを追加するべきです", test.tlsAddr)
+		}
+	}
+}
+
+func TestHTTP3Listener(t *testing.T) {
+	savedAddr, savedTLS, savedCert, savedKey := *addr, *tlsAddr, *tlsCert, *tlsKey
+	defer func() {
+		*addr, *tlsAddr, *tlsCert, *tlsKey, *enableHTTP3 = savedAddr, savedTLS, savedCert, savedKey, false
+	}()
+	*addr, *tlsAddr, *enableHTTP3 = "127.0.0.1:0", freeUDPAddr(t), true
+	*tlsCert, *tlsKey = writeTestCert(t)
+	listeners, err := newListeners(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make([]chan error, len(listeners))
+	for i, l := range listeners {
+		served[i] = make(chan error, 1)
+		go func(l *listener, done chan error) { done <- l.serve() }(l, served[i])
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+
+	// UDPの待ち受けが始まるまで再試行する
+	h3 := &http3.Transport{TLSClientConfig: tlsConfig}
+	defer h3.Close()
+	var proto string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		resp, err := (&http.Client{Transport: h3, Timeout: time.Second}).Get("https://" + *tlsAddr + "/")
+		if err != nil {
+			continue
+		}
+		fmt.Fscan(resp.Body, &proto)
+		resp.Body.Close()
+		break
+	}
+	if proto != "HTTP/3.0" {
+		t.Fatalf("HTTP/3で応答するべきですが%qでした", proto)
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get("https://" + *tlsAddr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	_, port, _ := net.SplitHostPort(*tlsAddr)
+	if altSvc := resp.Header.Get("Alt-Svc"); !strings.Contains(altSvc, `h3=":`+port+`"`) {
+		t.Errorf("TLSのレスポンスでHTTP/3のポートを知らせるべきです: %q", altSvc)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, l := range listeners {
+		if err := l.Shutdown(ctx); err != nil {
+			t.Errorf("%s: 終了できませんでした: %v", l.addr, err)
+		}
+	}
+	for i, done := range served {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: Shutdownの後は待ち受けを終了するべきです", listeners[i].addr)
+		}
+	}
+}
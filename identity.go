@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stretchr/gomniauth"
+	gomniauthcommon "github.com/stretchr/gomniauth/common"
+)
+
+const (
+	// linkIntentTTL アカウントの連携を開始してからコールバックまでの制限時間
+	linkIntentTTL = 10 * time.Minute
+	// linkStateKey 連携のノンスを入れるstateのキー
+	linkStateKey = "link"
+)
+
+var (
+	// ErrIdentityInUse 連携しようとしたアカウントが他のユーザーで使われている場合に発生するエラー
+	ErrIdentityInUse = errors.New("chat: このアカウントは既に別のユーザーで使われています。")
+	// ErrIdentityNotFound 解除しようとした連携が存在しない場合に発生するエラー
+	ErrIdentityNotFound = errors.New("chat: 連携したアカウントが見つかりません。")
+	// ErrPrimaryIdentity 最初にログインしたアカウントの連携を解除しようとした場合に発生するエラー
+	ErrPrimaryIdentity = errors.New("chat: 最初にログインしたアカウントの連携は解除できません。")
+)
+
+// verifiedEmail プロバイダーが確認済みとしているメールアドレスを返す。確認されていない場合は空文字列
+// メールアドレスでの自動的な連携は、アドレスの所有を確認できるプロバイダーでのみ行う
+func verifiedEmail(provider string, user gomniauthcommon.User) string {
+	switch provider {
+	case "google":
+		data := user.Data()
+		if data.Get("verified_email").Bool() || data.Get("email_verified").Bool() {
+			return user.Email()
+		}
+	}
+	return ""
+}
+
+// findUserByVerifiedEmail 確認済みのメールアドレスが一致する唯一のユーザーを返す
+// 一致するユーザーが複数いる場合はどれが本人か判断できないため連携しない
+// 保存されているアドレスが未確認の場合も、他人のアドレスで登録されたアカウントの可能性があるため連携しない
+func findUserByVerifiedEmail(email string) (*UserRecord, error) {
+	if email == "" {
+		return nil, ErrUserNotFound
+	}
+	list, err := users.ListByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) != 1 || !list[0].EmailVerified {
+		return nil, ErrUserNotFound
+	}
+	return list[0], nil
+}
+
+// isNewSignup ログインでアカウントが新しく作成されるかどうかを返す
+func isNewSignup(provider string, user gomniauthcommon.User) bool {
+	if _, err := users.GetByProviderID(provider, user.IDForProvider(provider)); err != ErrUserNotFound {
+		return false
+	}
+	_, err := findUserByVerifiedEmail(verifiedEmail(provider, user))
+	return err != nil
+}
+
+// linkIdentity ユーザーに認証プロバイダーのアカウントを連携する
+func linkIdentity(record *UserRecord, provider string, user gomniauthcommon.User) error {
+	providerID := user.IDForProvider(provider)
+	if owner, err := users.GetByProviderID(provider, providerID); err == nil {
+		if owner.ID == record.ID {
+			return nil
+		}
+		return ErrIdentityInUse
+	}
+	if record.Provider == "" {
+		// 事前に登録されたユーザーは最初にログインしたアカウントを主なアカウントにする
+		record.Provider, record.ProviderID = provider, providerID
+	} else {
+		record.Identities = append(record.Identities, LinkedIdentity{
+			Provider:   provider,
+			ProviderID: providerID,
+			Email:      user.Email(),
+			LinkedAt:   time.Now(),
+		})
+	}
+	if err := users.Update(record); err == ErrUserExists {
+		return ErrIdentityInUse
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// unlinkIdentity 連携したアカウントを解除する
+func unlinkIdentity(record *UserRecord, provider string) error {
+	if record.Provider == provider {
+		return ErrPrimaryIdentity
+	}
+	for i, id := range record.Identities {
+		if id.Provider == provider {
+			record.Identities = append(record.Identities[:i:i], record.Identities[i+1:]...)
+			return users.Update(record)
+		}
+	}
+	return ErrIdentityNotFound
+}
+
+// linkHandler ログイン中のユーザーに認証プロバイダーのアカウントを連携する (要ログイン)
+// GET /auth/link/{provider}
+// 連携の意図をセッションと結び付けたCookieに記録し、プロバイダーのログインへリダイレクトする
+// Cookieと同じノンスをstateに含め、他人が開始した認証のコールバックを踏まされても連携しないようにする
+func linkHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	current, ok := user.(sessionUser)
+	if !ok {
+		httpError(w, r, "アカウントの連携にはログインが必要です", http.StatusForbidden)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/auth/link/")
+	provider, err := oauthLogins.get(requestScheme(r), requestHost(r), name)
+	if err != nil {
+		httpError(w, r, "認証プロバイダーの取得に失敗しました", http.StatusBadRequest)
+		return
+	}
+	nonce := randomID()
+	loginURL, err := provider.GetBeginAuthURL(gomniauth.NewState(linkStateKey, nonce), nil)
+	if err != nil {
+		requestLogger(r).Println("GetBeginAuthURLの呼び出し中にエラーが発生しました:", name, "-", err)
+		reportRequestError(r, err)
+		httpError(w, r, "アカウントの連携を開始できませんでした", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oauth_link",
+		Value:    signCookieValue(current.uniqueID + ":" + current.sessionID + ":" + nonce),
+		Path:     "/auth/",
+		MaxAge:   int(linkIntentTTL.Seconds()),
+		Secure:   isSecureRequest(r),
+		HttpOnly: true,
+	})
+	w.Header().Set("Location", loginURL)
+	w.WriteHeader(http.StatusTemporaryRedirect)
+}
+
+// linkIntent コールバックが連携のためのものであれば、連携先のユーザーを返す
+// 連携を開始したときと同じセッションでログインしていて、stateのノンスがCookieと一致する場合だけ受け付ける
+func linkIntent(w http.ResponseWriter, r *http.Request) (*UserRecord, bool) {
+	cookie, err := r.Cookie("oauth_link")
+	if err != nil {
+		return nil, false
+	}
+	http.SetCookie(w, &http.Cookie{Name: "oauth_link", Path: "/auth/", MaxAge: -1})
+	value, _, err := verifyCookieValue(cookie.Value)
+	if err != nil {
+		return nil, false
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	userID, sessionID, nonce := parts[0], parts[1], parts[2]
+	state, err := gomniauth.StateFromParam(r.URL.Query().Get("state"))
+	if err != nil || subtle.ConstantTimeCompare([]byte(state.Get(linkStateKey).Str()), []byte(nonce)) != 1 {
+		return nil, false
+	}
+	auth, err := r.Cookie("auth")
+	if err != nil {
+		return nil, false
+	}
+	current, err := userFromCookie(auth)
+	if err != nil || current.uniqueID != userID || current.sessionID != sessionID {
+		return nil, false
+	}
+	if _, err := sessions.Get(sessionID); err != nil {
+		return nil, false
+	}
+	record, err := users.GetByID(userID)
+	if err != nil {
+		return nil, false
+	}
+	return record, true
+}
+
+// identitiesHandler 連携したアカウントの一覧と解除 (要ログイン)
+// GET    /api/me/identities
+// DELETE /api/me/identities/{provider}
+func identitiesHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	record, err := users.GetByID(user.UniqueID())
+	if err != nil {
+		writeJSONError(w, r, "このアカウントでは連携を利用できません", http.StatusBadRequest)
+		return
+	}
+	provider := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/me/identities"), "/")
+	switch {
+	case provider == "" && r.Method == http.MethodGet:
+		list := []LinkedIdentity{{Provider: record.Provider, ProviderID: record.ProviderID, Email: record.Email, LinkedAt: record.CreatedAt}}
+		if record.Provider == "" {
+			list = list[:0]
+		}
+		writeJSON(w, http.StatusOK, append(list, record.Identities...))
+	case provider != "" && r.Method == http.MethodDelete:
+		switch err := unlinkIdentity(record, provider); err {
+		case nil:
+			auditRequest(r, auditAdminAction, record.ID, record.ID, map[string]string{"action": "identity_unlinked", "provider": provider})
+			w.WriteHeader(http.StatusNoContent)
+		case ErrPrimaryIdentity:
+			writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+		case ErrIdentityNotFound:
+			writeJSONError(w, r, err.Error(), http.StatusNotFound)
+		default:
+			requestLogger(r).Println("連携の解除に失敗しました:", err)
+			writeJSONError(w, r, "連携の解除に失敗しました", http.StatusInternalServerError)
+		}
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
+
+// completeLink コールバックで得たアカウントをログイン中のユーザーに連携し、設定画面へ戻る
+func completeLink(w http.ResponseWriter, r *http.Request, record *UserRecord, provider string, user gomniauthcommon.User) {
+	if err := linkIdentity(record, provider, user); err == ErrIdentityInUse {
+		httpError(w, r, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		requestLogger(r).Println("アカウントの連携に失敗しました:", provider, "-", err)
+		reportRequestError(r, err)
+		httpError(w, r, "アカウントの連携に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	auditRequest(r, auditAdminAction, record.ID, record.ID, map[string]string{"action": "identity_linked", "provider": provider, "method": "explicit"})
+	w.Header().Set("Location", "/settings")
+	w.WriteHeader(http.StatusSeeOther)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/gomniauth"
+	gomniauthtest "github.com/stretchr/gomniauth/test"
+	"github.com/stretchr/objx"
+)
+
+func TestSaveLoginUserLinksVerifiedEmail(t *testing.T) {
+	users = newMemoryUserStore()
+	defer func() { users = newMemoryUserStore() }()
+	users.Create(&UserRecord{ID: "u1", Name: "Alice", Email: "alice@example.com", EmailVerified: true, Provider: "github", ProviderID: "gh1"})
+	users.Create(&UserRecord{ID: "u2", Name: "Mallory", Email: "bob@example.com", Provider: "facebook", ProviderID: "f2"})
+
+	newUser := func(provider, id string, data objx.Map) *gomniauthtest.TestUser {
+		u := &gomniauthtest.TestUser{}
+		u.On("IDForProvider", provider).Return(id)
+		u.On("Name").Return("Alice")
+		u.On("Email").Return("Alice@example.com")
+		u.On("AvatarURL").Return("")
+		u.On("Data").Return(data)
+		return u
+	}
+
+	// 確認済みのメールアドレスが一致するため同じユーザーとして扱う
+	record, err := saveLoginUser("google", newUser("google", "g1", objx.Map{"verified_email": true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.ID != "u1" || len(record.Identities) != 1 {
+		t.Errorf("確認済みのメールアドレスが一致するユーザーに連携するべきです: %+v", record)
+	}
+	if again, err := saveLoginUser("google", newUser("google", "g1", objx.Map{})); err != nil || again.ID != "u1" {
+		t.Errorf("連携したアカウントで同じユーザーとしてログインできるべきです: %+v, %v", again, err)
+	}
+
+	// 確認されていないメールアドレスでは連携しない
+	other, err := saveLoginUser("facebook", newUser("facebook", "f1", objx.Map{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.ID == "u1" {
+		t.Error("確認されていないメールアドレスでは連携するべきではありません")
+	}
+
+	// 保存されているアドレスが未確認のユーザーには連携しない
+	bob := &gomniauthtest.TestUser{}
+	bob.On("IDForProvider", "google").Return("g2")
+	bob.On("Name").Return("Bob")
+	bob.On("Email").Return("bob@example.com")
+	bob.On("AvatarURL").Return("")
+	bob.On("Data").Return(objx.Map{"verified_email": true})
+	if created, err := saveLoginUser("google", bob); err != nil || created.ID == "u2" {
+		t.Errorf("未確認のアドレスを持つユーザーには連携するべきではありません: %+v, %v", created, err)
+	}
+
+	record, _ = users.GetByID("u1")
+	if err := unlinkIdentity(record, "github"); err != ErrPrimaryIdentity {
+		t.Errorf("最初にログインしたアカウントは解除できないべきです: %v", err)
+	}
+	if err := unlinkIdentity(record, "google"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.GetByProviderID("google", "g1"); err != ErrUserNotFound {
+		t.Errorf("解除したアカウントではログインできないべきです: %v", err)
+	}
+}
+
+func TestSaveLoginUserAdminEmail(t *testing.T) {
+	defer func(s UserStore, admins string) { users, *adminEmails = s, admins }(users, *adminEmails)
+	users = newMemoryUserStore()
+	*adminEmails = "admin@example.com"
+	tests := []struct {
+		provider string
+		data     objx.Map
+		role     string
+	}{
+		{"github", objx.Map{}, roleUser},
+		{"facebook", objx.Map{}, roleUser},
+		{"google", objx.Map{}, roleUser},
+		{"google", objx.Map{"verified_email": true}, roleAdmin},
+	}
+	for i, test := range tests {
+		u := &gomniauthtest.TestUser{}
+		u.On("IDForProvider", test.provider).Return(fmt.Sprint(i))
+		u.On("Name").Return(fmt.Sprint("user", i))
+		u.On("Email").Return("admin@example.com")
+		u.On("AvatarURL").Return("")
+		u.On("Data").Return(test.data)
+		record, err := saveLoginUser(test.provider, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Role != test.role {
+			t.Errorf("%s %v: 役割が%qになるべきところ%qでした", test.provider, test.data, test.role, record.Role)
+		}
+	}
+}
+
+func TestLinkIntentRequiresState(t *testing.T) {
+	defer func(s UserStore) { users = s }(users)
+	users = newMemoryUserStore()
+	users.Create(&UserRecord{ID: "u1", Name: "Alice"})
+	sessions.Create(&Session{ID: "s1", UserID: "u1"})
+	defer sessions.Delete("s1")
+
+	auth, err := objx.MSI("userid", "u1", "session_id", "s1").Base64()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := randomID()
+	state := func(value string) string {
+		s, err := gomniauth.NewState(linkStateKey, value).SignedBase64(gomniauth.GetSecurityKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  bool
+	}{
+		{"一致するノンス", "state=" + url.QueryEscape(state(nonce)), true},
+		{"異なるノンス", "state=" + url.QueryEscape(state(randomID())), false},
+		{"stateなし", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/auth/callback/google?"+tt.query, nil)
+		r.AddCookie(&http.Cookie{Name: "auth", Value: signCookieValue(auth)})
+		r.AddCookie(&http.Cookie{Name: "oauth_link", Value: signCookieValue("u1:s1:" + nonce)})
+		if _, ok := linkIntent(httptest.NewRecorder(), r); ok != tt.want {
+			t.Errorf("%s: 連携を受け付けるかどうかが不正です: %v", tt.name, ok)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var imageModeration = flag.String("image-moderation", "", "アップロードされた画像を判定するサービス (http(s)://のURLまたはexec:コマンドのパス。空の場合は判定しない)")
+
+// attachmentPurposeAvatar アバターとしてアップロードされ、審査待ちの添付ファイル
+const attachmentPurposeAvatar = "avatar"
+
+// ImageModerator アップロードされた画像が不適切かどうかを判定する
+type ImageModerator interface {
+	// Check rから読み出した画像を判定し、不適切な場合はその理由を返す
+	Check(r io.Reader, contentType string) (string, error)
+}
+
+// nopImageModerator 何も判定しないImageModerator
+type nopImageModerator struct{}
+
+func (nopImageModerator) Check(io.Reader, string) (string, error) { return "", nil }
+
+// newImageModerator フラグの設定に従ってImageModeratorを生成する
+func newImageModerator(spec string) (ImageModerator, error) {
+	switch {
+	case spec == "":
+		return nopImageModerator{}, nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &httpImageModerator{endpoint: spec, client: &http.Client{Timeout: 30 * time.Second}}, nil
+	case strings.HasPrefix(spec, "exec:"):
+		return &commandImageModerator{path: strings.TrimPrefix(spec, "exec:"), timeout: 30 * time.Second}, nil
+	}
+	return nil, fmt.Errorf("chat: 画像の判定サービスの指定が不正です: %s", spec)
+}
+
+// httpImageModerator 外部のAPIに画像をPOSTして判定するImageModerator
+// APIは {"flagged": true, "reason": "..."} 形式のJSONを返す
+type httpImageModerator struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (m *httpImageModerator) Check(r io.Reader, contentType string) (string, error) {
+	res, err := m.client.Post(m.endpoint, contentType, r)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("chat: 画像の判定サービスがエラーを返しました: %s", res.Status)
+	}
+	var body struct {
+		Flagged bool   `json:"flagged"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if !body.Flagged {
+		return "", nil
+	}
+	if body.Reason == "" {
+		body.Reason = "flagged"
+	}
+	return body.Reason, nil
+}
+
+// commandImageModerator ローカルのコマンド(判定モデルなど)で判定するImageModerator
+// 標準入力に画像を渡し、終了コード0は問題なし、1は不適切(標準出力に理由)として扱う
+type commandImageModerator struct {
+	path    string
+	timeout time.Duration
+}
+
+func (m *commandImageModerator) Check(r io.Reader, contentType string) (string, error) {
+	cmd := exec.Command(m.path, contentType)
+	cmd.Stdin = r
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	timer := time.AfterFunc(m.timeout, func() { cmd.Process.Kill() })
+	err := cmd.Wait()
+	timer.Stop()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		reason := strings.TrimSpace(out.String())
+		if reason == "" {
+			reason = "flagged"
+		}
+		return reason, nil
+	}
+	return "", err
+}
+
+// moderateImage 画像を判定し、不適切な場合は添付ファイルを非公開にしてモデレーション待ちの列に追加する
+// 画像以外のファイルは判定しない。非公開にした場合は真を返す
+func moderateImage(a *Attachment, r io.Reader) (bool, error) {
+	if !strings.HasPrefix(a.ContentType, "image/") {
+		return false, nil
+	}
+	reason, err := imageModerator.Check(r, a.ContentType)
+	if err != nil || reason == "" {
+		return false, err
+	}
+	a.Held = true
+	return true, reports.Create(&Report{
+		ID:           randomID(),
+		AttachmentID: a.ID,
+		SenderID:     a.UserID,
+		Text:         a.Filename,
+		ReporterID:   systemName,
+		Reason:       reason,
+		Status:       reportOpen,
+		CreatedAt:    time.Now(),
+	})
+}
+
+// installAvatar 審査で承認されたアバターをアバターのディレクトリに移す
+func installAvatar(a *Attachment) error {
+	f, err := blobs.Open(a.ID)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err := deleteAvatarFiles(a.UserID); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join("avatars", a.UserID+filepath.Ext(a.Filename)), data, 0644); err != nil {
+		return err
+	}
+	blobs.Delete(a.ID)
+	return attachments.Delete(a.ID)
+}
+
+// approveAttachment 審査待ちの添付ファイルを公開する
+func approveAttachment(id string) error {
+	a, err := attachments.Get(id)
+	if err != nil {
+		return err
+	}
+	if a.Purpose == attachmentPurposeAvatar {
+		return installAvatar(a)
+	}
+	a.Held = false
+	return attachments.Update(a)
+}
+
+// removeAttachment 添付ファイルを削除する
+func removeAttachment(id string) error {
+	if err := attachments.Delete(id); err != nil && err != ErrAttachmentNotFound {
+		return err
+	}
+	if err := blobs.Delete(id); err != nil && err != ErrBlobNotFound {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keywordImageModerator 内容に"nsfw"を含む画像を不適切と判定するImageModerator
+type keywordImageModerator struct{}
+
+func (keywordImageModerator) Check(r io.Reader, contentType string) (string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	if bytes.Contains(data, []byte("nsfw")) {
+		return "nsfw", nil
+	}
+	return "", nil
+}
+
+func TestHTTPImageModerator(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		reason string
+		err    bool
+	}{
+		{http.StatusOK, `{"flagged": false}`, "", false},
+		{http.StatusOK, `{"flagged": true, "reason": "adult"}`, "adult", false},
+		{http.StatusOK, `{"flagged": true}`, "flagged", false},
+		{http.StatusInternalServerError, ``, "", true},
+		{http.StatusOK, `not json`, "", true},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Content-Type") != "image/png" {
+				t.Errorf("画像の種類を送信するべきです: %s", r.Header.Get("Content-Type"))
+			}
+			w.WriteHeader(test.status)
+			io.WriteString(w, test.body)
+		}))
+		m, err := newImageModerator(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reason, err := m.Check(strings.NewReader("png"), "image/png")
+		if reason != test.reason || (err != nil) != test.err {
+			t.Errorf("%d %s: %q、エラー%vになるべきところ%q、%vでした", test.status, test.body, test.reason, test.err, reason, err)
+		}
+		server.Close()
+	}
+}
+
+func TestHeldImageModeration(t *testing.T) {
+	defer func(m ImageModerator, b BlobStore, a AttachmentStore, r ReportStore) {
+		imageModerator, blobs, attachments, reports = m, b, a, r
+	}(imageModerator, blobs, attachments, reports)
+	imageModerator, attachments, reports = keywordImageModerator{}, newMemoryAttachmentStore(), newMemoryReportStore()
+	var err error
+	if blobs, err = newFileBlobStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	if held, err := holdAvatar("u1", "ok.png", []byte("fine")); held || err != nil {
+		t.Errorf("問題のないアバターは保留するべきではありません: %v, %v", held, err)
+	}
+	if held, err := holdAvatar("u1", "bad.png", []byte("nsfw")); !held || err != nil {
+		t.Fatalf("不適切なアバターは保留するべきです: %v, %v", held, err)
+	}
+	text := &Attachment{ID: randomID(), UserID: "u1", Filename: "nsfw.txt", ContentType: "text/plain"}
+	if held, _ := moderateImage(text, strings.NewReader("nsfw")); held {
+		t.Error("画像以外のファイルは判定するべきではありません")
+	}
+	image := &Attachment{ID: randomID(), UserID: "u1", Filename: "photo.png", ContentType: "image/png", Size: 4, CreatedAt: time.Now()}
+	if held, err := moderateImage(image, strings.NewReader("nsfw")); !held || err != nil || !image.Held {
+		t.Fatalf("不適切な画像は非公開にするべきです: %v, %v", held, err)
+	}
+	blobs.Put(image.ID, strings.NewReader("nsfw"))
+	attachments.Create(image)
+
+	download := func(userID string) int {
+		r := httptest.NewRequest("GET", image.URL(), nil)
+		w := httptest.NewRecorder()
+		attachmentHandler(w, r.WithContext(withUser(r.Context(), sessionUser{uniqueID: userID})))
+		return w.Code
+	}
+	if code := download("viewer"); code != http.StatusForbidden {
+		t.Errorf("審査中の添付ファイルは403になるべきところ%dでした", code)
+	}
+
+	open, err := reports.List(reportOpen)
+	if err != nil || len(open) != 2 {
+		t.Fatalf("保留した画像ごとに通報を作成するべきです: %d, %v", len(open), err)
+	}
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	h := &moderationHandler{rooms: rooms}
+	for _, report := range open {
+		action := "dismiss"
+		if report.AttachmentID != image.ID {
+			action = "delete"
+		}
+		if _, err := h.resolve("mod", report.ID, action); err != nil {
+			t.Fatal(err)
+		}
+		if action == "delete" {
+			if _, err := attachments.Get(report.AttachmentID); err != ErrAttachmentNotFound {
+				t.Errorf("削除した画像の添付ファイルは残すべきではありません: %v", err)
+			}
+		}
+	}
+	if code := download("viewer"); code != http.StatusOK {
+		t.Errorf("却下された通報の画像は公開するべきところ%dでした", code)
+	}
+}
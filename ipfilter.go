@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	ipAllow = flag.String("ip-allow", "", "接続を許可するIPアドレスまたはCIDR (カンマ区切り。空の場合はすべて許可する)")
+	ipDeny  = flag.String("ip-deny", "", "接続を拒否するIPアドレスまたはCIDR (カンマ区切り)")
+)
+
+// ErrInvalidIPRule IPアドレスの許可・拒否リストの指定が不正な場合に発生するエラー
+var ErrInvalidIPRule = errors.New("chat: IPアドレスまたはCIDRの指定が不正です。")
+
+// IPRules IPアドレスの許可リストと拒否リスト
+// 拒否リストに一致するアドレスは常に拒否し、許可リストが空でなければ一致するアドレスだけを許可する
+type IPRules struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// ipFilter 解析済みのIPRules
+type ipFilter struct {
+	allow, deny []*net.IPNet
+}
+
+func newIPFilter(rules IPRules) (*ipFilter, error) {
+	allow, err := parseCIDRs(rules.Allow, ErrInvalidIPRule)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRs(rules.Deny, ErrInvalidIPRule)
+	if err != nil {
+		return nil, err
+	}
+	return &ipFilter{allow: allow, deny: deny}, nil
+}
+
+// allows IPアドレスを許可するかどうかを返す。解析できないアドレスは許可リストがある場合のみ拒否する
+func (f *ipFilter) allows(addr string) bool {
+	ip := net.ParseIP(addr)
+	for _, n := range f.deny {
+		if ip != nil && n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipFilterList 管理者が変更できる全体のIPアドレスのリスト
+type ipFilterList struct {
+	mu     sync.RWMutex
+	rules  IPRules
+	filter *ipFilter
+}
+
+func newIPFilterList() *ipFilterList {
+	return &ipFilterList{filter: &ipFilter{}}
+}
+
+// Rules 現在のリストを返す
+func (l *ipFilterList) Rules() IPRules {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.rules
+}
+
+// Set リストを置き換える
+func (l *ipFilterList) Set(rules IPRules) error {
+	filter, err := newIPFilter(rules)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rules, l.filter = rules, filter
+	return nil
+}
+
+func (l *ipFilterList) allows(addr string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.filter.allows(addr)
+}
+
+// splitList カンマ区切りのフラグの値を一覧にする
+func splitList(spec string) []string {
+	var list []string
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// blockedIP リクエストの送信元が全体またはルームのリストで拒否されていれば403を返して真を返す
+// roomが空の場合は全体のリストだけを確認する。拒否した試みは監査ログに記録する
+func blockedIP(w http.ResponseWriter, r *http.Request, rm *room) bool {
+	if allowedIP(r, rm) {
+		return false
+	}
+	httpError(w, r, "このIPアドレスからのアクセスは許可されていません", http.StatusForbidden)
+	return true
+}
+
+// allowedIP リクエストの送信元が全体とルームのリストで許可されているかどうかを判定する
+// roomが空の場合は全体のリストだけを確認する。拒否した試みは監査ログに記録する
+func allowedIP(r *http.Request, rm *room) bool {
+	scope, allowed := ipAllowedIn(clientIP(r), rm)
+	if allowed {
+		return true
+	}
+	target := ""
+	if scope == "room" {
+		target = rm.name
+	}
+	userID := ""
+	if user, ok := userFromContext(r.Context()); ok {
+		userID = user.UniqueID()
+	}
+	auditRequest(r, auditIPBlocked, userID, target, map[string]string{"scope": scope, "path": r.URL.Path})
+	return false
+}
+
+// ipAllowedIn IPアドレスが全体とルームのリストで許可されているかどうかを判定する
+// 拒否された場合は拒否したリスト("global"または"room")を返す。roomが空の場合は全体のリストだけを確認する
+func ipAllowedIn(ip string, rm *room) (string, bool) {
+	if !ipFilters.allows(ip) {
+		return "global", false
+	}
+	if rm != nil {
+		settings := rm.Settings()
+		// 設定は更新時に検証済みのため、解析に失敗することはない
+		if f, err := newIPFilter(IPRules{Allow: settings.IPAllow, Deny: settings.IPDeny}); err == nil && !f.allows(ip) {
+			return "room", false
+		}
+	}
+	return "", true
+}
+
+// ipFilterAdminHandler 全体のIPアドレスのリストを管理する
+// GET /api/admin/ipfilter  リストを返す
+// PUT /api/admin/ipfilter  JSONでリストを置き換える
+func ipFilterAdminHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, ipFilters.Rules())
+	case http.MethodPut:
+		var rules IPRules
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			writeJSONError(w, r, "リストの形式が不正です", http.StatusBadRequest)
+			return
+		}
+		if err := ipFilters.Set(rules); err != nil {
+			writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		admin, _ := userFromContext(r.Context())
+		auditRequest(r, auditAdminAction, admin.UniqueID(), "", map[string]string{
+			"action": "ip_filter", "allow": strings.Join(rules.Allow, ","), "deny": strings.Join(rules.Deny, ","),
+		})
+		writeJSON(w, http.StatusOK, ipFilters.Rules())
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
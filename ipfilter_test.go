@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	f, err := newIPFilter(IPRules{Allow: []string{"10.0.0.0/8", "192.0.2.1"}, Deny: []string{"10.1.0.0/16"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.2.3.4":  true,
+		"192.0.2.1": true,
+		"10.1.2.3":  false,
+		"192.0.2.2": false,
+		"invalid":   false,
+	} {
+		if got := f.allows(ip); got != want {
+			t.Errorf("%sの判定が%vになるべきところ%vでした", ip, want, got)
+		}
+	}
+	if _, err := newIPFilter(IPRules{Deny: []string{"10.0.0.0/33"}}); err != ErrInvalidIPRule {
+		t.Errorf("不正なCIDRでErrInvalidIPRuleになるべきところ%vでした", err)
+	}
+}
+
+func TestBlockedIP(t *testing.T) {
+	defer ipFilters.Set(IPRules{})
+	rm := newRoom()
+	rm.name = "ipfilter"
+	rm.SetSettings(roomSettings{IPDeny: []string{"192.0.2.0/24"}})
+	r := httptest.NewRequest("GET", "/room/ipfilter", nil)
+	r.RemoteAddr = "192.0.2.10:1234"
+	if !blockedIP(httptest.NewRecorder(), r, rm) {
+		t.Error("ルームの拒否リストに一致するアドレスは拒否されるべきです")
+	}
+	if blockedIP(httptest.NewRecorder(), r, nil) {
+		t.Error("全体のリストが空の場合は許可されるべきです")
+	}
+	ipFilters.Set(IPRules{Deny: []string{"192.0.2.10"}})
+	w := httptest.NewRecorder()
+	if !blockedIP(w, r, nil) || w.Code != 403 {
+		t.Errorf("全体の拒否リストに一致するアドレスは403になるべきところ%dでした", w.Code)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var (
+	ldapURL          = flag.String("ldap-url", "", "LDAPまたはActive Directoryのサーバー (例: ldaps://ldap.example.com。空の場合はLDAPでのログインを無効にする)")
+	ldapStartTLS     = flag.Bool("ldap-start-tls", false, "ldap://で接続した後にStartTLSで暗号化する")
+	ldapUserDN       = flag.String("ldap-user-dn", "", "ユーザーとしてバインドする場合のDNの書式 (例: uid=%s,ou=people,dc=example,dc=com。指定しない場合はサービスアカウントで検索する)")
+	ldapBindDN       = flag.String("ldap-bind-dn", "", "ユーザーを検索するサービスアカウントのDN")
+	ldapBindPassword = flag.String("ldap-bind-password", "", "サービスアカウントのパスワード (vault:などの参照も指定できる)")
+	ldapBaseDN       = flag.String("ldap-base-dn", "", "ユーザーを検索するベースDN")
+	ldapUserFilter   = flag.String("ldap-user-filter", "(uid=%s)", "ユーザーを検索するフィルター (Active Directoryでは(sAMAccountName=%s))")
+	ldapGroupRoles   = flag.String("ldap-group-roles", "", "グループのDNと役割の対応 (例: cn=chat-admins,ou=groups,dc=example,dc=com=admin;cn=mods,...=moderator)")
+)
+
+var (
+	// ErrLDAPCredentials ユーザー名またはパスワードが正しくない場合に発生するエラー
+	ErrLDAPCredentials = errors.New("chat: ユーザー名またはパスワードが正しくありません。")
+	// ErrLDAPConfig LDAPの設定が不足している場合に発生するエラー
+	ErrLDAPConfig = errors.New("chat: -ldap-user-dnか、-ldap-bind-dnと-ldap-base-dnを指定してください。")
+	// ErrInvalidGroupRoles -ldap-group-rolesの形式が正しくない場合に発生するエラー
+	ErrInvalidGroupRoles = errors.New("chat: -ldap-group-rolesはグループのDN=役割をセミコロン区切りで指定してください。")
+)
+
+// ldapAttributes ユーザーのエントリーから取得する属性
+var ldapAttributes = []string{"cn", "displayName", "mail", "memberOf"}
+
+// DirectoryUser ディレクトリで認証されたユーザー
+type DirectoryUser struct {
+	// Usernameはログインに使用した名前。小文字にしてプロバイダーIDとして使う
+	Username string
+	DN       string
+	Name     string
+	Email    string
+	Groups   []string
+}
+
+// PasswordAuthenticator ユーザー名とパスワードでユーザーを認証する
+type PasswordAuthenticator interface {
+	// Authenticate 認証に成功した場合はユーザーの情報を返す
+	// *ユーザー名またはパスワードが正しくない場合はErrLDAPCredentialsを返す
+	Authenticate(username, password string) (*DirectoryUser, error)
+}
+
+// ldapAuthenticator LDAPのサーバーで認証するPasswordAuthenticator
+// userDNが指定された場合はユーザーとして直接バインドし、そうでなければサービスアカウントで検索してからバインドする
+type ldapAuthenticator struct {
+	url          string
+	startTLS     bool
+	userDN       string
+	bindDN       string
+	bindPassword string
+	baseDN       string
+	filter       string
+}
+
+func newLDAPAuthenticator() (*ldapAuthenticator, error) {
+	a := &ldapAuthenticator{
+		url:          *ldapURL,
+		startTLS:     *ldapStartTLS,
+		userDN:       *ldapUserDN,
+		bindDN:       *ldapBindDN,
+		bindPassword: *ldapBindPassword,
+		baseDN:       *ldapBaseDN,
+		filter:       *ldapUserFilter,
+	}
+	if a.userDN == "" && (a.bindDN == "" || a.baseDN == "") {
+		return nil, ErrLDAPConfig
+	}
+	return a, nil
+}
+
+func (a *ldapAuthenticator) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.url)
+	if err != nil {
+		return nil, err
+	}
+	if a.startTLS {
+		host := strings.TrimPrefix(strings.TrimPrefix(a.url, "ldap://"), "ldaps://")
+		if i := strings.IndexAny(host, ":/"); i >= 0 {
+			host = host[:i]
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (a *ldapAuthenticator) Authenticate(username, password string) (*DirectoryUser, error) {
+	// 空のパスワードは匿名バインドとして成功してしまうため拒否する
+	if username == "" || password == "" {
+		return nil, ErrLDAPCredentials
+	}
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var dn string
+	var entry *ldap.Entry
+	if a.userDN != "" {
+		dn = fmt.Sprintf(a.userDN, ldap.EscapeDN(username))
+		if err := conn.Bind(dn, password); err != nil {
+			return nil, ldapBindError(err)
+		}
+		res, err := conn.Search(ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+			"(objectClass=*)", ldapAttributes, nil))
+		if err != nil {
+			return nil, err
+		}
+		if len(res.Entries) == 1 {
+			entry = res.Entries[0]
+		}
+	} else {
+		if err := conn.Bind(a.bindDN, a.bindPassword); err != nil {
+			return nil, err
+		}
+		res, err := conn.Search(ldap.NewSearchRequest(a.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+			fmt.Sprintf(a.filter, ldap.EscapeFilter(username)), ldapAttributes, nil))
+		if err != nil {
+			return nil, err
+		}
+		if len(res.Entries) != 1 {
+			return nil, ErrLDAPCredentials
+		}
+		entry = res.Entries[0]
+		dn = entry.DN
+		if err := conn.Bind(dn, password); err != nil {
+			return nil, ldapBindError(err)
+		}
+	}
+	user := &DirectoryUser{Username: strings.ToLower(username), DN: dn, Name: username}
+	if entry != nil {
+		if name := entry.GetAttributeValue("displayName"); name != "" {
+			user.Name = name
+		} else if name := entry.GetAttributeValue("cn"); name != "" {
+			user.Name = name
+		}
+		user.Email = entry.GetAttributeValue("mail")
+		user.Groups = entry.GetAttributeValues("memberOf")
+	}
+	return user, nil
+}
+
+// ldapBindError 認証情報の誤りをErrLDAPCredentialsに変換する
+func ldapBindError(err error) error {
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return ErrLDAPCredentials
+	}
+	return err
+}
+
+// groupRoleMapping グループのDNから役割への対応
+type groupRoleMapping map[string]string
+
+// parseGroupRoles "グループのDN=役割"のセミコロン区切りを解析する
+// DNはカンマを含むため、最後の=で区切る
+func parseGroupRoles(spec string) (groupRoleMapping, error) {
+	m := make(groupRoleMapping)
+	for _, entry := range strings.Split(spec, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		i := strings.LastIndexByte(entry, '=')
+		if i <= 0 {
+			return nil, ErrInvalidGroupRoles
+		}
+		role := strings.TrimSpace(entry[i+1:])
+		switch role {
+		case roleUser, roleModerator, roleAdmin, "user":
+		default:
+			return nil, ErrInvalidGroupRoles
+		}
+		if role == "user" {
+			role = roleUser
+		}
+		m[strings.ToLower(strings.TrimSpace(entry[:i]))] = role
+	}
+	return m, nil
+}
+
+// role 所属するグループのうち最も強い役割を返す。対応がなければokは偽
+func (m groupRoleMapping) role(groups []string) (role string, ok bool) {
+	rank := map[string]int{roleUser: 1, roleModerator: 2, roleAdmin: 3}
+	for _, g := range groups {
+		if r, found := m[strings.ToLower(g)]; found && (!ok || rank[r] > rank[role]) {
+			role, ok = r, true
+		}
+	}
+	return role, ok
+}
+
+// ldapLoginHandler ユーザー名とパスワードによるログイン
+// POST /login/ldap (username, password)
+type ldapLoginHandler struct {
+	auth  PasswordAuthenticator
+	roles groupRoleMapping
+}
+
+func (h *ldapLoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	if blockedIP(w, r, nil) {
+		return
+	}
+	if wait, locked := loginLimits.check(ipKey(r)); locked {
+		tooManyAttempts(w, r, wait)
+		return
+	}
+	username := strings.TrimSpace(r.FormValue("username"))
+	user, err := h.auth.Authenticate(username, r.FormValue("password"))
+	if err == ErrLDAPCredentials {
+		loginLimits.fail(ipKey(r))
+		auditRequest(r, auditAuthFailed, "", "", map[string]string{"method": "ldap", "username": username})
+		httpError(w, r, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		requestLogger(r).Println("LDAPによる認証に失敗しました:", err)
+		reportRequestError(r, err)
+		httpError(w, r, "認証サーバーに接続できませんでした", http.StatusBadGateway)
+		return
+	}
+	record, err := h.save(user)
+	if err != nil {
+		requestLogger(r).Println("ユーザーの保存に失敗しました", user.DN, "-", err)
+		reportRequestError(r, err)
+		httpError(w, r, "ユーザーの保存に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if wait, locked := loginLimits.check(accountKey(record.ID)); locked {
+		tooManyAttempts(w, r, wait)
+		return
+	}
+	if record.Banned {
+		auditRequest(r, auditAuthFailed, record.ID, "", map[string]string{"reason": "banned"})
+		httpError(w, r, "このアカウントは利用停止されています", http.StatusForbidden)
+		return
+	}
+	avatarURL := userData(passkeyUser{record}.chatUser())["avatar_url"].(string)
+	if record.TOTPEnabled {
+		startPendingLogin(w, r, record.ID, avatarURL, "ldap")
+		w.Header().Set("Location", "/login/2fa")
+		w.WriteHeader(http.StatusSeeOther)
+		return
+	}
+	if err := issueSession(w, r, record.ID, avatarURL, "ldap"); err != nil {
+		if errors.Is(err, ErrRejectedByHook) {
+			httpError(w, r, err.Error(), http.StatusForbidden)
+			return
+		}
+		requestLogger(r).Println("セッションの作成に失敗しました", record.ID, "-", err)
+		httpError(w, r, "セッションの作成に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/chat")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// save ディレクトリのユーザーをユーザーストアに保存する
+// -ldap-group-rolesを指定した場合、役割はログインのたびにグループから決め直す
+func (h *ldapLoginHandler) save(user *DirectoryUser) (*UserRecord, error) {
+	record, err := users.GetByProviderID("ldap", user.Username)
+	created := err == ErrUserNotFound
+	switch {
+	case created:
+		record = &UserRecord{ID: uniqueIDFor(user.Name), Name: registrationName(user.Name), Provider: "ldap", ProviderID: user.Username}
+		if _, err := users.GetByID(record.ID); err == nil {
+			record.ID = randomID()
+		}
+	case err != nil:
+		return nil, err
+	}
+	if name, err := validateDisplayName(user.Name, false); err == nil && !record.CustomName {
+		record.Name = name
+	}
+	// ディレクトリが管理しているアドレスは確認済みとみなす
+	record.Email, record.EmailVerified = user.Email, user.Email != ""
+	if role, ok := h.roles.role(user.Groups); ok {
+		record.Role = role
+	} else if len(h.roles) > 0 {
+		record.Role = roleUser
+	}
+	promoteAdmin(record)
+	if created {
+		return record, users.Create(record)
+	}
+	return record, users.Update(record)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// fakeDirectory パスワードが"secret"のユーザーだけを認証するPasswordAuthenticator
+type fakeDirectory map[string]*DirectoryUser
+
+func (d fakeDirectory) Authenticate(username, password string) (*DirectoryUser, error) {
+	user, ok := d[username]
+	if !ok || password != "secret" {
+		return nil, ErrLDAPCredentials
+	}
+	return user, nil
+}
+
+func TestParseGroupRoles(t *testing.T) {
+	roles, err := parseGroupRoles("cn=Admins,ou=groups,dc=example,dc=com=admin; cn=mods,ou=groups,dc=example,dc=com=moderator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role, ok := roles.role([]string{"cn=mods,ou=groups,dc=example,dc=com", "CN=admins,ou=groups,dc=example,dc=com"}); !ok || role != roleAdmin {
+		t.Errorf("最も強い役割を返すべきです: %q", role)
+	}
+	if _, ok := roles.role([]string{"cn=other,dc=example,dc=com"}); ok {
+		t.Error("対応のないグループでは役割を返すべきではありません")
+	}
+	if _, err := parseGroupRoles("cn=x,dc=example=owner"); err != ErrInvalidGroupRoles {
+		t.Errorf("不明な役割は拒否するべきです: %v", err)
+	}
+}
+
+func TestLDAPLogin(t *testing.T) {
+	users = newMemoryUserStore()
+	sessions = newMemorySessionStore()
+	loginLimits = newLoginLimiter(5, 0, 0)
+	defer func() {
+		users = newMemoryUserStore()
+		sessions = newMemorySessionStore()
+	}()
+	roles, _ := parseGroupRoles("cn=mods,dc=example,dc=com=moderator")
+	h := &ldapLoginHandler{
+		auth:  fakeDirectory{"alice": {Username: "alice", Name: "Alice", Groups: []string{"cn=mods,dc=example,dc=com"}}},
+		roles: roles,
+	}
+	login := func(password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/login/ldap", strings.NewReader(url.Values{"username": {"alice"}, "password": {password}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := login("wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("パスワードが誤っている場合は拒否するべきです: %d", w.Code)
+	}
+	w := login("secret")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/chat" {
+		t.Fatalf("ログインに成功するべきです: %d %s", w.Code, w.Body)
+	}
+	record, err := users.GetByProviderID("ldap", "alice")
+	if err != nil || record.Role != roleModerator {
+		t.Errorf("グループに対応する役割で保存するべきです: %+v, %v", record, err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"log"
+	"runtime"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	leakCheckInterval = flag.Duration("leak-check", 0, "デバッグ用: ルームの在室者と接続のゴルーチンの状態を照合する間隔 (0の場合は照合しない)")
+	leakWriteStall    = flag.Duration("leak-write-stall", time.Minute, "デバッグ用: 1つのイベントの書き込みがこの時間を超えて終わらないクライアントを漏れとみなす")
+)
+
+// leakedClients 照合で見つけて切断したクライアントの数
+var leakedClients = expvar.NewMap("leaked_clients")
+
+// 漏れの種類
+const (
+	// leakReaderGone 受信のゴルーチンが終了しているのに在室している
+	leakReaderGone = "reader_gone"
+	// leakWriterGone 送信のゴルーチンが終了しているのに在室している
+	leakWriterGone = "writer_gone"
+	// leakWriteStalled 書き込みが-leak-write-stallを超えて終わらない
+	leakWriteStalled = "write_stalled"
+)
+
+// leakOfはクライアントの接続のゴルーチンの状態を調べ、漏れている場合はその種類を返す
+func (c *client) leakOf(now time.Time) string {
+	switch {
+	case c.readDone.Load():
+		return leakReaderGone
+	case c.writeDone.Load():
+		return leakWriterGone
+	}
+	if started := c.writing.Load(); started != 0 && now.Sub(time.Unix(0, started)) > *leakWriteStall {
+		return leakWriteStalled
+	}
+	return ""
+}
+
+// checkLeaksは在室者と待機中のクライアントを接続のゴルーチンの状態と照合し、漏れているクライアントを切断する
+// 退室の途中のクライアントを誤って検出しないよう、2回続けて漏れていると判定した場合に切断する
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) checkLeaks(now time.Time) {
+	leaked := 0
+	for _, c := range append([]*client(nil), r.waiting...) {
+		if kind := c.leakOf(now); kind == leakReaderGone && r.confirmLeak(c, kind) {
+			r.dropWaiting(c, websocket.CloseGoingAway, "leaked connection")
+			leaked++
+		}
+	}
+	for c := range r.clients {
+		kind := c.leakOf(now)
+		if kind == "" {
+			c.suspectedLeak = ""
+			continue
+		}
+		if !r.confirmLeak(c, kind) {
+			continue
+		}
+		if kind == leakWriteStalled {
+			// 書き込みで止まっている送信のゴルーチンを解放するため、先に接続を閉じる
+			c.socket.Close()
+		}
+		r.remove(c, websocket.CloseGoingAway, "leaked connection")
+		leaked++
+	}
+	// 在室中の接続の数が在室者と食い違っていれば在室者に合わせる
+	counts := make(map[string]int)
+	for c := range r.clients {
+		userID, _ := c.userData["userid"].(string)
+		counts[userID]++
+	}
+	for userID, n := range r.members {
+		if counts[userID] != n {
+			log.Printf("ルーム%sの在室中の接続の数を修正しました: ユーザー=%s 記録=%d 実際=%d", r.name, userID, n, counts[userID])
+		}
+	}
+	r.members = counts
+	if leaked > 0 {
+		log.Printf("ルーム%sで漏れていたクライアントを%d件切断しました (在室=%d 待機=%d ゴルーチン=%d)",
+			r.name, leaked, len(r.clients), len(r.waiting), runtime.NumGoroutine())
+	}
+}
+
+// confirmLeakは漏れの疑いを記録し、前回の照合でも漏れていた場合に真を返す
+func (r *room) confirmLeak(c *client, kind string) bool {
+	if c.suspectedLeak == "" {
+		c.suspectedLeak = kind
+		return false
+	}
+	leakedClients.Add(kind, 1)
+	log.Printf("ルーム%sのクライアントが漏れています: 種類=%s リクエストID=%s 送信待ち=%d/%d",
+		r.name, kind, c.requestID, len(c.send), cap(c.send))
+	return true
+}
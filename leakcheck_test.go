@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckLeaks(t *testing.T) {
+	r := newRoom()
+	r.name = "leaks"
+	live := &client{room: r, send: make(chan *message, 1), userData: map[string]interface{}{"userid": "u1"}}
+	leaked := &client{room: r, send: make(chan *message, 1), userData: map[string]interface{}{"userid": "u2"}}
+	for _, c := range []*client{live, leaked} {
+		r.clients[c] = true
+		r.memberJoined(c)
+	}
+	leaked.readDone.Store(true)
+	now := time.Now()
+
+	r.checkLeaks(now)
+	if !r.clients[leaked] {
+		t.Error("1回目の照合では切断しないべきです")
+	}
+	r.checkLeaks(now)
+	if r.clients[leaked] || !r.clients[live] {
+		t.Error("2回続けて漏れていたクライアントだけを切断するべきです")
+	}
+	if _, ok := <-leaked.send; ok {
+		t.Error("切断したクライアントの送信チャネルは閉じるべきです")
+	}
+	if r.members["u2"] != 0 || r.members["u1"] != 1 {
+		t.Errorf("在室中の接続の数を更新するべきです: %v", r.members)
+	}
+
+	live.writing.Store(now.Add(-2 * *leakWriteStall).UnixNano())
+	if kind := live.leakOf(now); kind != leakWriteStalled {
+		t.Errorf("書き込みが終わらないクライアントを検出するべきです: %q", kind)
+	}
+}
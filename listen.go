@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	proxyproto "github.com/pires/go-proxyproto"
+	"github.com/quic-go/quic-go/http3"
+)
+
+var (
+	proxyProtocol  = flag.Bool("proxy-protocol", false, "接続の先頭のPROXYプロトコルのヘッダーから送信元のアドレスを取得する (TCPの場合は-trusted-proxiesからの接続のみ)")
+	unixSocketMode = flag.Uint("unix-socket-mode", 0660, "Unixドメインソケットのパーミッション")
+)
+
+// unixAddrPrefix アドレスがこの接頭辞で始まる場合はUnixドメインソケットで待ち受ける
+// 例: -addr unix:/run/gochat/gochat.sock
+const unixAddrPrefix = "unix:"
+
+// ErrProxyProtocolUntrusted TCPでPROXYプロトコルを受け付けるのに信頼するプロキシが指定されていない場合に発生するエラー
+var ErrProxyProtocolUntrusted = errors.New("chat: TCPでPROXYプロトコルを受け付けるには-trusted-proxiesを指定してください。")
+
+// listen アドレスで待ち受けるリスナーを生成する
+// -proxy-protocolが指定された場合は、信頼するプロキシからの接続のPROXYヘッダーを解釈する
+func listen(addr string) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if name := strings.TrimPrefix(addr, systemdAddrPrefix); name != addr {
+		// systemdのソケットはUnixドメインソケットの場合もあるため、ポリシーで判別する
+		ln, err = systemdListener(name)
+	} else if path := strings.TrimPrefix(addr, unixAddrPrefix); path != addr {
+		ln, err = listenUnix(path)
+	} else {
+		if *proxyProtocol && len(trustedProxies) == 0 {
+			return nil, ErrProxyProtocolUntrusted
+		}
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil || !*proxyProtocol {
+		return ln, err
+	}
+	return &proxyproto.Listener{Listener: ln, ConnPolicy: proxyPolicy}, nil
+}
+
+// listenUnix Unixドメインソケットで待ち受ける
+// 前回の起動で残ったソケットファイルは削除してから作成する
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(*unixSocketMode)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// proxyPolicy 信頼するプロキシからの接続のみPROXYヘッダーを使い、それ以外はヘッダーを無視する
+// Unixドメインソケットの相手はローカルのプロキシとみなす
+func proxyPolicy(opts proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+	if _, ok := opts.Upstream.(*net.UnixAddr); ok {
+		return proxyproto.USE, nil
+	}
+	host, _, err := net.SplitHostPort(opts.Upstream.String())
+	if err == nil && isTrustedProxy(host) {
+		return proxyproto.USE, nil
+	}
+	return proxyproto.IGNORE, nil
+}
+
+var (
+	tlsAddr   = flag.String("tls-addr", "", "TLSで直接待ち受けるアドレス (空の場合は待ち受けない)")
+	tlsCert   = flag.String("tls-cert", "", "-tls-addrで使用する証明書のファイル")
+	tlsKey    = flag.String("tls-key", "", "-tls-addrで使用する秘密鍵のファイル")
+	adminAddr = flag.String("admin-addr", "", "管理用のAPIとメトリクスだけを提供するアドレス (例: 127.0.0.1:9090。指定した場合は他のアドレスでは提供しない)")
+)
+
+// ErrTLSConfig TLSの待ち受けに必要な証明書か秘密鍵が指定されていない場合に発生するエラー
+var ErrTLSConfig = errors.New("chat: -tls-addrには-tls-certと-tls-keyが必要です。")
+
+// adminPathPrefixes 管理用のアドレスだけで提供するパスの接頭辞
+var adminPathPrefixes = []string{"/api/admin/", "/debug/", "/metrics"}
+
+// isAdminPath 管理用のアドレスだけで提供するパスかどうかを判定する
+func isAdminPath(path string) bool {
+	for _, prefix := range adminPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictPaths allowが偽を返すパスへのリクエストには404を返すハンドラー
+func restrictPaths(next http.Handler, allow func(path string) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allow(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listener 1つのアドレスで待ち受けるHTTPサーバー
+type listener struct {
+	addr   string
+	ln     net.Listener
+	server *http.Server
+	// certFileとkeyFileが指定された場合はTLSで待ち受ける
+	certFile, keyFile string
+	// h3が指定された場合はserverとlnの代わりにUDPでHTTP/3を待ち受ける
+	h3 *http3.Server
+}
+
+func (l *listener) serve() error {
+	if l.h3 != nil {
+		return l.h3.ListenAndServeTLS(l.certFile, l.keyFile)
+	}
+	if l.certFile != "" {
+		return l.server.ServeTLS(l.ln, l.certFile, l.keyFile)
+	}
+	return l.server.Serve(l.ln)
+}
+
+// Shutdown 処理中のリクエストが完了するのを待ってサーバーを終了する
+func (l *listener) Shutdown(ctx context.Context) error {
+	if l.h3 != nil {
+		return l.h3.Shutdown(ctx)
+	}
+	return l.server.Shutdown(ctx)
+}
+
+// newListeners フラグの設定に従って待ち受けるサーバーを生成する
+// -admin-addrを指定した場合、管理用のパスはそのアドレスだけで提供する
+func newListeners(handler http.Handler) ([]*listener, error) {
+	public := handler
+	var specs []*listener
+	if *adminAddr != "" {
+		public = restrictPaths(handler, func(path string) bool { return !isAdminPath(path) })
+		specs = append(specs, &listener{addr: *adminAddr, server: &http.Server{Handler: restrictPaths(handler, isAdminPath), Protocols: cleartextProtocols()}})
+	}
+	specs = append(specs, &listener{addr: *addr, server: &http.Server{Handler: public, Protocols: cleartextProtocols()}})
+	var h3 *listener
+	if *tlsAddr != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			return nil, ErrTLSConfig
+		}
+		tls := &listener{addr: *tlsAddr, server: &http.Server{Handler: public}, certFile: *tlsCert, keyFile: *tlsKey}
+		specs = append(specs, tls)
+		if *enableHTTP3 {
+			var err error
+			if h3, err = newHTTP3Listener(tls); err != nil {
+				return nil, err
+			}
+		}
+	} else if *enableHTTP3 {
+		return nil, ErrHTTP3Config
+	}
+	for i, l := range specs {
+		ln, err := listen(l.addr)
+		if err != nil {
+			for _, opened := range specs[:i] {
+				opened.ln.Close()
+			}
+			return nil, err
+		}
+		l.ln = ln
+	}
+	if h3 != nil {
+		// UDPのソケットはserveで開く
+		specs = append(specs, h3)
+	}
+	return specs, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixProxyProtocol(t *testing.T) {
+	*proxyProtocol = true
+	defer func() { *proxyProtocol = false }()
+	path := filepath.Join(t.TempDir(), "gochat.sock")
+	ln, err := listen(unixAddrPrefix + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, clientIP(r))
+	})}
+	go server.Serve(ln)
+	defer server.Close()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "PROXY TCP4 198.51.100.7 192.0.2.1 40000 80\r\n")
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got string
+	fmt.Fscan(resp.Body, &got)
+	if got != "198.51.100.7" {
+		t.Errorf("PROXYヘッダーの送信元のアドレスを返すべきですが%sでした", got)
+	}
+}
+
+func TestListenProxyProtocolRequiresTrustedProxies(t *testing.T) {
+	*proxyProtocol = true
+	defer func() { *proxyProtocol = false }()
+	if _, err := listen("127.0.0.1:0"); err != ErrProxyProtocolUntrusted {
+		t.Error("信頼するプロキシがない場合はTCPでPROXYプロトコルを受け付けないべきです")
+	}
+}
+
+func TestNewListenersAdminAddr(t *testing.T) {
+	savedAddr, savedAdmin := *addr, *adminAddr
+	*addr, *adminAddr = "127.0.0.1:0", "127.0.0.1:0"
+	defer func() { *addr, *adminAddr = savedAddr, savedAdmin }()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "ok") })
+	listeners, err := newListeners(mux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range listeners {
+		go l.serve()
+		defer l.server.Close()
+	}
+	admin, public := listeners[0].ln.Addr().String(), listeners[1].ln.Addr().String()
+	tests := []struct {
+		addr, path string
+		want       int
+	}{
+		{public, "/chat", http.StatusOK},
+		{public, "/api/admin/users", http.StatusNotFound},
+		{public, "/debug/vars", http.StatusNotFound},
+		{admin, "/api/admin/users", http.StatusOK},
+		{admin, "/metrics", http.StatusOK},
+		{admin, "/chat", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get("http://" + tt.addr + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s%s: ステータスが%dではなく%dでした", tt.addr, tt.path, tt.want, resp.StatusCode)
+		}
+	}
+}
+
+func TestNewListenersH2C(t *testing.T) {
+	savedAddr := *addr
+	*addr, *enableH2C = "127.0.0.1:0", true
+	defer func() { *addr, *enableH2C = savedAddr, false }()
+	listeners, err := newListeners(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go listeners[0].serve()
+	defer listeners[0].server.Close()
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	resp, err := client.Get("http://" + listeners[0].ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var proto string
+	fmt.Fscan(resp.Body, &proto)
+	if proto != "HTTP/2.0" {
+		t.Errorf("h2cで応答するべきですが%sでした", proto)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var loginAlerts = flag.Bool("login-alerts", true, "見慣れない端末・IPアドレス・国からログインした場合に本人へ通知する")
+
+// deviceCookieMaxAge 端末を識別するCookieの有効期間
+const deviceCookieMaxAge = 365 * 24 * time.Hour
+
+// notMeTTL 通知の「心当たりがない」リンクの有効期間
+const notMeTTL = 7 * 24 * time.Hour
+
+// loginHistoryLimit 見慣れないログインかどうかの判定に使用する過去のログインの件数
+const loginHistoryLimit = 200
+
+// ErrNotMeLink 「心当たりがない」リンクが不正か期限切れの場合に発生するエラー
+var ErrNotMeLink = errors.New("chat: リンクが不正か期限切れです。")
+
+// 見慣れないログインの理由
+const (
+	unfamiliarDevice  = "new_device"
+	unfamiliarIP      = "new_ip"
+	unfamiliarCountry = "new_country"
+)
+
+// deviceID 端末を識別するIDを返す。Cookieがなければ新しいIDを発行して設定する
+func deviceID(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie("device"); err == nil {
+		if id, _, err := verifyCookieValue(cookie.Value); err == nil {
+			return id
+		}
+	}
+	id := randomID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     "device",
+		Value:    signCookieValue(id),
+		Path:     "/",
+		MaxAge:   int(deviceCookieMaxAge.Seconds()),
+		Secure:   isSecureRequest(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+// unfamiliarLogin 過去のログインと比べて見慣れない点を返す
+// 初めてのログインは比較できないため見慣れないとはみなさない
+func unfamiliarLogin(userID, device, ip, country string) []string {
+	history, err := auditLog.Query(AuditQuery{UserID: userID, Action: auditLogin, Limit: loginHistoryLimit})
+	if err != nil || len(history) == 0 {
+		return nil
+	}
+	seenDevice, seenIP, seenCountry := false, false, country == ""
+	for _, e := range history {
+		seenDevice = seenDevice || e.Details["device"] == device
+		seenIP = seenIP || e.IP == ip
+		seenCountry = seenCountry || e.Country == country
+	}
+	var reasons []string
+	if !seenDevice {
+		reasons = append(reasons, unfamiliarDevice)
+	}
+	if !seenIP {
+		reasons = append(reasons, unfamiliarIP)
+	}
+	if !seenCountry {
+		reasons = append(reasons, unfamiliarCountry)
+	}
+	return reasons
+}
+
+// notMeLink セッションを失効させるためのリンクを返す
+// Hostヘッダーは偽装できるため-external-urlで設定したURLだけを使い、未設定の場合はパスだけを返す
+func notMeLink(r *http.Request, userID, sessionID string) string {
+	base := ""
+	if oauthLogins != nil && len(oauthLogins.allowed) > 0 {
+		base = oauthLogins.allowed[0]
+		if b, err := oauthLogins.baseURL(requestScheme(r), requestHost(r)); err == nil {
+			base = b
+		}
+	}
+	expires := strconv.FormatInt(time.Now().Add(notMeTTL).Unix(), 10)
+	return base + "/account/not-me?token=" + signCookieValue(userID+":"+sessionID+":"+expires)
+}
+
+// sendLoginAlert 見慣れないログインを本人に通知する
+// セキュリティに関する通知のため、通知の設定に関わらずチャットのお知らせとメールで通知する
+func sendLoginAlert(record *UserRecord, session *Session, reasons []string, link string) {
+	where := session.RemoteAddr
+	if session.Country != "" {
+		where += " (" + session.Country + ")"
+	}
+	text := "新しいログインがありました: " + where + " " + session.UserAgent + "\n" +
+		"心当たりがない場合は次のリンクからセッションを失効させてください: " + link
+	body := record.Name + " 様\n\n" +
+		"お使いのアカウントに見慣れない環境からログインがありました。\n\n" +
+		"日時: " + session.CreatedAt.Format(time.RFC3339) + "\n" +
+		"IPアドレス: " + where + "\n" +
+		"ブラウザ: " + session.UserAgent + "\n" +
+		"理由: " + strings.Join(reasons, ", ") + "\n\n" +
+		"心当たりがない場合は次のリンクを開いてください。このセッションを失効させ、再度のログインを求めます。\n" + link + "\n"
+	notify(notification{UserID: record.ID, Text: text, Subject: "新しいログインのお知らせ", Body: body, Security: true}, time.Now())
+}
+
+// notMeHandler 通知の「心当たりがない」リンクの処理
+// GET  /account/not-me?token=  確認画面を表示する
+// POST /account/not-me         ユーザーのすべてのセッションを失効させ、接続中のクライアントを切断する
+// メールのリンクの事前読み込みで失効しないよう、失効はPOSTだけで行う
+type notMeHandler struct {
+	rooms *roomRegistry
+	once  sync.Once
+	templ *template.Template
+}
+
+func (h *notMeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	userID, sessionID, err := parseNotMeToken(token)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		h.once.Do(func() {
+			h.templ = template.Must(template.ParseFiles(filepath.Join("templates", "notme.html")))
+		})
+		h.templ.Execute(w, map[string]string{"Token": token})
+	case http.MethodPost:
+		if err := sessions.DeleteByUser(userID); err != nil {
+			requestLogger(r).Println("セッションを失効できませんでした:", err)
+			httpError(w, r, "セッションを失効できませんでした", http.StatusInternalServerError)
+			return
+		}
+		h.rooms.Kick(userID, "session_revoked")
+		auditRequest(r, auditLogout, userID, "", map[string]string{"reason": "not_me", "session_id": sessionID})
+		clearAuthCookie(w)
+		w.Header().Set("Location", "/login")
+		w.WriteHeader(http.StatusSeeOther)
+	default:
+		httpError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseNotMeToken リンクのトークンを検証してユーザーとセッションのIDを返す
+func parseNotMeToken(token string) (userID, sessionID string, err error) {
+	value, _, err := verifyCookieValue(token)
+	if err != nil {
+		return "", "", ErrNotMeLink
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return "", "", ErrNotMeLink
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", "", ErrNotMeLink
+	}
+	return parts[0], parts[1], nil
+}
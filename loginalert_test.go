@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestUnfamiliarLogin(t *testing.T) {
+	defer func(a AuditStore) { auditLog = a }(auditLog)
+	auditLog = newMemoryAuditStore(nil)
+	if reasons := unfamiliarLogin("u1", "d1", "192.0.2.1", "JP"); len(reasons) != 0 {
+		t.Errorf("初めてのログインは見慣れないとみなすべきではありません: %v", reasons)
+	}
+	recordAudit(&AuditEntry{Action: auditLogin, UserID: "u1", IP: "192.0.2.1", Country: "JP", Details: map[string]string{"device": "d1"}})
+	if reasons := unfamiliarLogin("u1", "d1", "192.0.2.1", "JP"); len(reasons) != 0 {
+		t.Errorf("同じ環境からのログインは見慣れないとみなすべきではありません: %v", reasons)
+	}
+	reasons := unfamiliarLogin("u1", "d2", "198.51.100.1", "US")
+	if strings.Join(reasons, ",") != "new_device,new_ip,new_country" {
+		t.Errorf("見慣れない点が不正です: %v", reasons)
+	}
+}
+
+func TestNotMeLink(t *testing.T) {
+	defer func(p *oauthProviders) { oauthLogins = p }(oauthLogins)
+	configured, _ := newOAuthProviders("https://chat.example.com, https://chat.example.org", nil)
+	open, _ := newOAuthProviders("", nil)
+	tests := []struct {
+		providers *oauthProviders
+		host      string
+		prefix    string
+	}{
+		{configured, "chat.example.org", "https://chat.example.org/account/not-me?token="},
+		{configured, "evil.example.net", "https://chat.example.com/account/not-me?token="},
+		{open, "evil.example.net", "/account/not-me?token="},
+		{nil, "evil.example.net", "/account/not-me?token="},
+	}
+	for _, test := range tests {
+		oauthLogins = test.providers
+		r := httptest.NewRequest("GET", "http://"+test.host+"/", nil)
+		r.Header.Set("X-Forwarded-Host", test.host)
+		if link := notMeLink(r, "u1", "s1"); !strings.HasPrefix(link, test.prefix) {
+			t.Errorf("%sからのリクエストのリンクは%sで始まるべきところ%sでした", test.host, test.prefix, link)
+		}
+	}
+}
+
+func TestNotMeHandler(t *testing.T) {
+	defer func(s SessionStore) { sessions = s }(sessions)
+	sessions = newMemorySessionStore()
+	sessions.Create(&Session{ID: "s1", UserID: "u1"})
+	link := notMeLink(httptest.NewRequest("GET", "http://chat.example.com/", nil), "u1", "s1")
+	token := link[strings.Index(link, "token=")+len("token="):]
+
+	h := &notMeHandler{rooms: newRoomRegistry()}
+	req := httptest.NewRequest("POST", "/account/not-me", strings.NewReader("token="+url.QueryEscape(token)))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 303 {
+		t.Fatalf("303になるべきところ%dでした", w.Code)
+	}
+	if _, err := sessions.Get("s1"); err != ErrSessionNotFound {
+		t.Error("セッションが失効していません")
+	}
+
+	req = httptest.NewRequest("POST", "/account/not-me", strings.NewReader("token=u1:s1:9999999999.bad"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Errorf("署名が不正なトークンは400になるべきところ%dでした", w.Code)
+	}
+}
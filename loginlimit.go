@@ -0,0 +1,154 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	loginMaxFailures  = flag.Int("login-max-failures", 5, "ロックアウトするまでに許容する認証の連続失敗回数")
+	loginLockout      = flag.Duration("login-lockout", time.Minute, "最初のロックアウトの期間 (失敗が続くたびに2倍になる)")
+	loginLockoutMax   = flag.Duration("login-lockout-max", time.Hour, "ロックアウトの期間の上限")
+	loginFailureCount = expvar.NewInt("login_failures")
+	loginLockoutCount = expvar.NewInt("login_lockouts")
+)
+
+// failureRecord 1つのIPアドレスまたはアカウントの認証失敗の記録
+type failureRecord struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// loginLimiter IPアドレスとアカウントごとに認証の失敗を数え、
+// 失敗が続いた場合は指数的に長くなる期間ロックアウトする
+type loginLimiter struct {
+	mu        sync.Mutex
+	failures  map[string]*failureRecord
+	threshold int
+	base      time.Duration
+	max       time.Duration
+	now       func() time.Time
+	// prunedは最後に古い記録を削除した時刻
+	pruned time.Time
+}
+
+// loginPruneInterval 古い失敗の記録を削除する間隔
+const loginPruneInterval = time.Minute
+
+func newLoginLimiter(threshold int, base, max time.Duration) *loginLimiter {
+	return &loginLimiter{
+		failures:  make(map[string]*failureRecord),
+		threshold: threshold,
+		base:      base,
+		max:       max,
+		now:       time.Now,
+	}
+}
+
+// ipKey IPアドレスごとに数えるためのキー
+func ipKey(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// accountKey アカウントごとに数えるためのキー
+func accountKey(userID string) string {
+	return "user:" + userID
+}
+
+// check いずれかのキーがロックアウト中であれば解除までの時間を返す
+func (l *loginLimiter) check(keys ...string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var wait time.Duration
+	for _, key := range keys {
+		if rec, ok := l.failures[key]; ok && rec.lockedUntil.After(now) {
+			if d := rec.lockedUntil.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait, wait > 0
+}
+
+// fail 認証の失敗を記録する。ロックアウトした場合はその期間を返す
+func (l *loginLimiter) fail(keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	loginFailureCount.Add(1)
+	if now.Sub(l.pruned) >= loginPruneInterval {
+		l.prune(now)
+	}
+	var locked time.Duration
+	for _, key := range keys {
+		rec, ok := l.failures[key]
+		if !ok || now.Sub(rec.last) > l.max {
+			// 十分な時間が経過した失敗は数えない
+			rec = &failureRecord{}
+			l.failures[key] = rec
+		}
+		rec.count++
+		rec.last = now
+		if rec.count < l.threshold {
+			continue
+		}
+		d := time.Duration(float64(l.base) * math.Pow(2, float64(rec.count-l.threshold)))
+		if d > l.max || d <= 0 {
+			d = l.max
+		}
+		rec.lockedUntil = now.Add(d)
+		loginLockoutCount.Add(1)
+		recordAudit(&AuditEntry{Action: auditLockout, Target: key,
+			Details: map[string]string{"failures": fmt.Sprint(rec.count), "duration": d.String()}})
+		if d > locked {
+			locked = d
+		}
+	}
+	return locked
+}
+
+// prune ロックアウト中でなく、数えなくなった古い失敗の記録を削除する。l.muを保持して呼び出す
+func (l *loginLimiter) prune(now time.Time) {
+	for key, rec := range l.failures {
+		if !rec.lockedUntil.After(now) && now.Sub(rec.last) > l.max {
+			delete(l.failures, key)
+		}
+	}
+	l.pruned = now
+}
+
+// succeed 認証に成功したキーの失敗の記録を消去する
+func (l *loginLimiter) succeed(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		delete(l.failures, key)
+	}
+}
+
+// locked ロックアウト中のキーの一覧を返す
+func (l *loginLimiter) locked() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	keys := []string{}
+	for key, rec := range l.failures {
+		if rec.lockedUntil.After(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// tooManyAttempts ロックアウト中であることをRetry-Afterヘッダー付きで返す
+func tooManyAttempts(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+	httpError(w, r, "認証の失敗が続いたため一時的にロックされています", http.StatusTooManyRequests)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newLoginLimiter(3, time.Minute, 10*time.Minute)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if d := l.fail("ip:1.2.3.4"); d != 0 {
+			t.Errorf("%d回目の失敗でロックアウトするべきではありません", i+1)
+		}
+	}
+	if d := l.fail("ip:1.2.3.4"); d != time.Minute {
+		t.Errorf("3回目の失敗で1分間ロックアウトするべきですが%sでした", d)
+	}
+	if _, locked := l.check("ip:1.2.3.4", "user:abc"); !locked {
+		t.Error("ロックアウト中のキーを含む場合、checkはtrueを返すべきです")
+	}
+	if d := l.fail("ip:1.2.3.4"); d != 2*time.Minute {
+		t.Errorf("失敗が続いた場合、ロックアウトの期間は2倍になるべきですが%sでした", d)
+	}
+
+	now = now.Add(3 * time.Minute)
+	if _, locked := l.check("ip:1.2.3.4"); locked {
+		t.Error("ロックアウトの期間が過ぎた場合、checkはfalseを返すべきです")
+	}
+	l.succeed("ip:1.2.3.4")
+	if d := l.fail("ip:1.2.3.4"); d != 0 {
+		t.Error("成功した後は失敗の回数がリセットされるべきです")
+	}
+}
+
+func TestLoginLimiterPrunes(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newLoginLimiter(3, time.Minute, 10*time.Minute)
+	l.now = func() time.Time { return now }
+	for i := 0; i < 100; i++ {
+		l.fail(fmt.Sprintf("ip:10.0.0.%d", i))
+	}
+	for i := 0; i < 3; i++ {
+		l.fail("ip:1.2.3.4")
+	}
+
+	now = now.Add(11 * time.Minute)
+	l.fail("ip:5.6.7.8")
+	if n := len(l.failures); n != 1 {
+		t.Errorf("古い失敗の記録は削除するべきです: %d件", n)
+	}
+}
+
+func TestProtectDebugVars(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {})
+	h := protectDebugVars(mux)
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/debug/vars", http.StatusTemporaryRedirect},
+		{"/healthz", http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: ステータスコードが不正です: %d", tt.path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+var (
+	smtpAddr     = flag.String("smtp-addr", "", "メールの送信に使用するSMTPサーバー (例: smtp.example.com:587。空の場合はメールを送信しない)")
+	smtpFrom     = flag.String("smtp-from", "gochat@localhost", "送信するメールの差出人")
+	smtpUsername = flag.String("smtp-username", "", "SMTPサーバーのユーザー名 (空の場合は認証しない)")
+	smtpPassword = flag.String("smtp-password", "", "SMTPサーバーのパスワード")
+)
+
+// Mailer ユーザーにメールを送信する
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// nopMailer 何も送信しないMailer
+type nopMailer struct{}
+
+func (nopMailer) Send(to, subject, body string) error { return nil }
+
+// smtpMailer SMTPサーバーを経由して送信するMailer
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// newMailer フラグの設定に従ってMailerを生成する
+func newMailer() Mailer {
+	if *smtpAddr == "" {
+		return nopMailer{}
+	}
+	m := &smtpMailer{addr: *smtpAddr, from: *smtpFrom}
+	if *smtpUsername != "" {
+		host, _, _ := net.SplitHostPort(*smtpAddr)
+		m.auth = smtp.PlainAuth("", *smtpUsername, *smtpPassword, host)
+	}
+	return m
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	// ヘッダーの改行による挿入を防ぐ
+	clean := strings.NewReplacer("\r", "", "\n", "")
+	msg := "From: " + clean.Replace(m.from) + "\r\n" +
+		"To: " + clean.Replace(to) + "\r\n" +
+		"Subject: " + mime.BEncoding.Encode("UTF-8", clean.Replace(subject)) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
@@ -1,18 +1,20 @@
 package main
 
 import (
+	"expvar"
 	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"text/template"
+	"time"
 
-	"github.com/goki0524/gopackage/trace"
 	"github.com/stretchr/gomniauth"
-	"github.com/stretchr/gomniauth/providers/google"
-	"github.com/stretchr/objx"
 )
 
 var avatars Avatar = TryAvatars{
@@ -21,6 +23,141 @@ var avatars Avatar = TryAvatars{
 	UseGravatar,
 }
 
+// usersはユーザーの情報を保存する
+var users UserStore = newMemoryUserStore()
+
+// sessionsはログイン中のセッションを保存する
+var sessions SessionStore = newMemorySessionStore()
+
+// messagesは送信されたメッセージの履歴を保存する
+var messages MessageStore = newMemoryMessageStore()
+
+// auditLogは監査ログの保存先
+var auditLog AuditStore = newMemoryAuditStore(nil)
+
+// reportsはモデレーション待ちの通報を保存する
+var reports ReportStore = newMemoryReportStore()
+
+// loginLimitsは認証の失敗によるロックアウトを管理する。起動時にフラグの設定で作り直す
+var loginLimits = newLoginLimiter(*loginMaxFailures, *loginLockout, *loginLockoutMax)
+
+// apiKeysはユーザーが発行したAPIキーを保存する
+var apiKeys APIKeyStore = newMemoryAPIKeyStore()
+
+// remindersはメッセージのリマインダーを保存する
+var reminders ReminderStore = newMemoryReminderStore()
+
+// translatorはメッセージの翻訳に使用される。nilの場合は翻訳を利用できない
+var translator Translator
+
+// gifsはGIFの検索に使用される。nilの場合はGIFを利用できない
+var gifs GIFSearcher
+
+// translationsは翻訳結果のキャッシュ
+var translations = newTranslationCache(*translationCacheSize)
+
+// blobsは添付ファイルの内容を保存する
+var blobs BlobStore
+
+// attachmentsは添付ファイルの情報を保存する
+var attachments AttachmentStore = newMemoryAttachmentStore()
+
+// scannerはアップロードされたファイルのウイルス検査に使用される
+var scanner Scanner = nopScanner{}
+
+// imageModeratorはアップロードされた画像の判定に使用される
+var imageModerator ImageModerator = nopImageModerator{}
+
+// eventLogはルームのイベントを外部に記録する
+var eventLog EventLog = nopEventLog{}
+
+// presenceはルームの在室状況を保持する
+var presence PresenceStore = newMemoryPresenceStore()
+
+// connLimitsは同時に接続できるWebSocketの数を制限する
+var connLimits = newConnLimiter(0, 0)
+
+// groupsはメンションでまとめて呼び出せるユーザーのグループを保存する
+var groups GroupStore = newMemoryGroupStore()
+
+// welcomesはユーザーが参加したことのあるルームを記録し、歓迎メッセージを一度だけ送信するために使用する
+var welcomes WelcomeStore = newMemoryWelcomeStore()
+
+// membersはユーザーがルームに参加した回数や時刻を記録し、ハイライトのお知らせの送信先の判定に使用する
+var members MemberStore = newMemoryMemberStore()
+
+// autoRulesはルームごとの自動応答のルールを保存する
+var autoRules AutoRuleStore = newMemoryAutoRuleStore()
+
+// highlightsはユーザーがハイライトのお知らせを受け取るキーワードを保存する
+var highlights HighlightStore = newMemoryHighlightStore()
+
+// starsはユーザーがスターを付けたメッセージを保存する
+var stars StarStore = newMemoryStarStore()
+
+// stickersはスタンプのパックを保存する
+var stickers StickerStore = newMemoryStickerStore()
+
+// statusesはユーザーが設定した状態を保持する
+var statuses StatusStore = newMemoryStatusStore()
+
+// announcementsは掲示中の管理者からのお知らせを保持する
+var announcements = &announcementBoard{}
+
+// ackedStreamsは確認応答モードの配信ストリームを保持する
+var ackedStreams = newAckStreams()
+
+// drainは無停止でデプロイするためのドレインの状態を保持する
+var drain = newDrainer()
+
+// activityは日ごとのアクティブユーザーを保存する
+var activity ActivityStore = newMemoryActivityStore()
+
+// eventsはルームや利用者のライフサイクルイベントを配布する
+var events = newEventBus()
+
+// notifierはユーザーへのお知らせに使用される
+var notifier Notifier = nopNotifier{}
+
+// signingはCookieやwebhookの署名に使用される
+var signing = newSigningKeyring("")
+
+// reporterは予期しないエラーとパニックの報告に使用される
+var reporter ErrorReporter = nopReporter{}
+
+// featuresは機能フラグの設定を保持する
+var features = newFeatureFlags()
+
+// tokenAuthはBearerトークンの認証に使用される
+var tokenAuth TokenAuthenticator = TryTokenAuthenticators{}
+
+// oauthTokensはログイン時に取得した認証プロバイダーのトークンを保存する
+var oauthTokens OAuthTokenStore = newMemoryOAuthTokenStore()
+
+// captchaは新規登録の前にCAPTCHAを求める。nilの場合は求めない
+var captcha *captchaGate
+
+// oauthLoginsはリクエストのホストに対応する認証プロバイダーを返す
+var oauthLogins *oauthProviders
+
+// ipFiltersは全体のIPアドレスの許可・拒否リスト
+var ipFilters = newIPFilterList()
+
+// geoはIPアドレスから国とASNを推定する
+var geo GeoLocator = nopGeoLocator{}
+
+// mailerはユーザーにメールを送信する
+var mailer Mailer = nopMailer{}
+
+// roomInfosはルームのトピックなどの情報を保存する
+var roomInfos RoomStore = newMemoryRoomStore()
+
+// notificationPrefsはユーザーごとの通知の設定を保存する
+var notificationPrefs NotificationPrefsStore = newMemoryNotificationPrefsStore()
+
+// pusherはユーザーの端末にプッシュ通知を送信する
+var pusher Pusher = nopPusher{}
+
 // templは１つのテンプレートを表す
 type templateHandler struct {
 	once     sync.Once
@@ -34,55 +171,388 @@ func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		t.templ = template.Must(template.ParseFiles(filepath.Join("templates", t.filename)))
 	})
 	data := map[string]interface{}{
-		"Host": r.Host,
+		"Host": requestHost(r),
+		// TLSを終端するプロキシの後ろではwssで接続させる
+		"WebSocketScheme": map[bool]string{false: "ws", true: "wss"}[isSecureRequest(r)],
+		"Room":            defaultRoomName,
 	}
-	if authCookie, err := r.Cookie("auth"); err == nil {
-		data["UserData"] = objx.MustFromBase64(authCookie.Value)
+	if oauthLogins != nil {
+		data["Providers"] = oauthLogins.enabled()
+	}
+	data["LDAP"] = *ldapURL != ""
+	if name := roomNameFromRequest(r); validRoomName(name) {
+		data["Room"] = name
+	}
+	if user, ok := userFromContext(r.Context()); ok {
+		data["UserData"] = userData(user)
+		data["CSRFToken"] = csrfToken(user)
 	}
 	t.templ.Execute(w, data)
 }
 
-var addr = flag.String("addr", ":8080", "アプリケーションアドレス")
+// GoogleのOAuthクライアントの設定。値にはvault:などのシークレットの参照を指定できる
+var (
+	googleClientID     = flag.String("google-client-id", "clien-id", "GoogleのOAuthクライアントID")
+	googleClientSecret = flag.String("google-client-secret", "private-key", "GoogleのOAuthクライアントシークレット")
+	// GitHubとFacebookはクライアントIDを指定した場合だけ有効にする
+	githubClientID       = flag.String("github-client-id", "", "GitHubのOAuthクライアントID")
+	githubClientSecret   = flag.String("github-client-secret", "", "GitHubのOAuthクライアントシークレット")
+	facebookClientID     = flag.String("facebook-client-id", "", "FacebookのOAuthクライアントID")
+	facebookClientSecret = flag.String("facebook-client-secret", "", "FacebookのOAuthクライアントシークレット")
+)
+
+var addr = flag.String("addr", ":8080", "アプリケーションアドレス (unix:で始まる場合はUnixドメインソケットのパス、systemd:の場合はソケットアクティベーションで引き継いだソケット)")
 
 func main() {
+	if err := runCommand(os.Args[1:]); err != nil {
+		log.Fatalln(err)
+	}
+}
 
-	flag.Parse() // フラグを解析
-
+// serve Webサーバーを起動する。フラグは解析済みであること
+func serve() {
 	// Gomniauthのセットアップ
-	gomniauth.SetSecurityKey("security-key")
-	gomniauth.WithProviders(
-		google.New("clien-id", "private-key", "http://localhost:8080/auth/callback/google"),
-	)
+	// gomniauthは1つの鍵しか扱えないため、現在の鍵を使う
+	signing = newSigningKeyring(*securityKeys)
+	warnDefaultSecurityKey()
+	gomniauth.SetSecurityKey(string(signing.current()))
+	var err error
+	if oauthLogins, err = newOAuthProviders(*externalURLs, providerFactories()); err != nil {
+		log.Fatalln(err)
+	}
+	gomniauth.WithProviders(oauthLogins.defaultProviders()...)
+
+	if trustedProxies, err = parseTrustedProxies(*trustedProxiesFlag); err != nil {
+		log.Fatalln(err)
+	}
+	if *sentryDSN != "" {
+		sentry, err := newSentryReporter(*sentryDSN, *environment)
+		if err != nil {
+			log.Fatalln("エラー報告の設定に失敗しました:", err)
+		}
+		reporter = sentry
+		defer reporter.Flush(2 * time.Second)
+	}
+	if *databasePath != "" {
+		db, err := openDatabase(*databasePath)
+		if err != nil {
+			log.Fatalln("データベースを開けませんでした:", err)
+		}
+		defer db.Close()
+		m, err := newMigrator(db)
+		if err != nil {
+			log.Fatalln("スキーマの確認に失敗しました:", err)
+		}
+		if err := m.check(); err != nil {
+			log.Fatalln(err)
+		}
+		users = newSQLUserStore(db)
+		messages = newSQLMessageStore(db)
+		oauthTokens = newSQLOAuthTokenStore(db)
+		roomInfos = newSQLRoomStore(db)
+		notificationPrefs = newSQLNotificationPrefsStore(db)
+		stars = newSQLStarStore(db)
+		groups = newSQLGroupStore(db)
+		welcomes = newSQLWelcomeStore(db)
+		members = newSQLMemberStore(db)
+		highlights = newSQLHighlightStore(db)
+		autoRules = newSQLAutoRuleStore(db)
+	}
+	keys, err := newKeyWrapper(*messageKeys, *messageKMS)
+	if err != nil {
+		log.Fatalln("メッセージの暗号化の設定に失敗しました:", err)
+	}
+	if keys != nil {
+		messages = newEncryptedMessageStore(messages, keys)
+		oauthTokens = newEncryptedOAuthTokenStore(oauthTokens, keys)
+	} else if *databasePath != "" {
+		log.Println("-message-keysまたは-message-kmsが指定されていないため、認証プロバイダーのトークンは保存しません")
+		oauthTokens = nopOAuthTokenStore{}
+	}
+	if auditLog, err = openAuditStore(*auditLogPath); err != nil {
+		log.Fatalln("監査ログを開けませんでした:", err)
+	}
+	if geo, err = openGeoLocator(*geoipDB, *geoipASNDB); err != nil {
+		log.Fatalln("GeoIPのデータベースを開けませんでした:", err)
+	}
+	mailer = newMailer()
+
+	loginLimits = newLoginLimiter(*loginMaxFailures, *loginLockout, *loginLockoutMax)
+	expvar.Publish("login_locked_keys", expvar.Func(func() interface{} { return loginLimits.locked() }))
+
+	bots, err := parseBotTokens(*botTokens)
+	if err != nil {
+		log.Fatalln("ボットトークンの読み込みに失敗しました:", err)
+	}
+	tokenAuth = TryTokenAuthenticators{apiKeyAuthenticator{store: apiKeys}, bots}
 
-	r := newRoom()
-	r.tracer = trace.New(os.Stdout)
+	if translator, err = newTranslator(*translatorName, *translatorKey, *translatorURL); err != nil {
+		log.Fatalln("翻訳サービスの設定に失敗しました:", err)
+	}
+	translations = newTranslationCache(*translationCacheSize)
+	if gifs, err = newGIFSearcher(*gifProvider, *gifKey, *gifRating); err != nil {
+		log.Fatalln("GIFの検索サービスの設定に失敗しました:", err)
+	}
+
+	if *clamdAddr != "" {
+		clamd, err := newClamdScanner(*clamdAddr)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := clamd.Ping(); err != nil {
+			log.Fatalln("clamdに接続できません:", err)
+		}
+		scanner = clamd
+	}
+
+	if imageModerator, err = newImageModerator(*imageModeration); err != nil {
+		log.Fatalln(err)
+	}
+	if blobs, err = newFileBlobStore(*blobDir); err != nil {
+		log.Fatalln("添付ファイルの保存先を作成できません:", err)
+	}
+	tus, err := newTusHandler(filepath.Join(*blobDir, ".partial"))
+	if err != nil {
+		log.Fatalln("アップロードの一時保存先を作成できません:", err)
+	}
+
+	eventLog = openEventLog()
+	defer eventLog.Close()
+	if *kafkaReplay {
+		n, err := restoreHistory(eventLog)
+		if err != nil {
+			log.Fatalln("イベントログからの復元に失敗しました:", err)
+		}
+		log.Println("イベントログからメッセージを復元しました:", n)
+	}
+
+	if !validPresenceTTL(*presenceTTL) {
+		log.Fatalln("-presence-ttlには3秒以上を指定してください")
+	}
+	if *presenceRedis != "" {
+		if presence, err = newRedisPresenceStore(*presenceRedis); err != nil {
+			log.Fatalln("在室状況を共有するRedisに接続できません:", err)
+		}
+	}
+	newPresenceTracker().subscribe(events)
+	subscribeActivity(events)
+	reminderRecipients.subscribe(events)
+	if *scriptDir != "" {
+		if err := loadMessageScripts(*scriptDir, uint32(*scriptMemoryPages), *scriptTimeout, *scriptFailOpen); err != nil {
+			log.Fatalln("スクリプトを読み込めません:", err)
+		}
+	}
+
+	connLimits = newConnLimiter(*maxConnections, *maxConnectionsPerIP)
+	if err := ipFilters.Set(IPRules{Allow: splitList(*ipAllow), Deny: splitList(*ipDeny)}); err != nil {
+		log.Fatalln("-ip-allowまたは-ip-denyが不正です:", err)
+	}
+	if *clientSendBuffer < 1 || *roomForwardBuffer < 0 {
+		log.Fatalln("-client-send-bufferには1以上、-room-forward-bufferには0以上を指定してください")
+	}
+
+	rooms := newRoomRegistry()
+	go rooms.reapIdle(*roomIdleTimeout)
+	subscribeAutoResponder(events, rooms)
+	subscribeHighlights(events, rooms)
+	if _, err := parseTraceSeverity(*traceLevel); err != nil || !validSampleRate(*traceSample) {
+		log.Fatalln("-trace-levelまたは-trace-sampleが不正です:", *traceLevel, *traceSample)
+	}
+	tracer, closeTracer, err := openTracer()
+	if err != nil {
+		log.Fatalln("トレースの出力先を開けません:", err)
+	}
+	defer closeTracer()
+	rooms.tracer = tracer
+	notifier = rooms
+	var roomHandler http.Handler = rooms
+	if *shardNodes != "" {
+		if roomHandler, err = newShardRouter(*shardNodes, *shardNodeID, rooms); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *mqttBroker != "" {
+		bridge, err := newMQTTBridge(*mqttBroker, *mqttTopicPrefix, rooms)
+		if err != nil {
+			log.Fatalln("MQTTブローカーに接続できません:", err)
+		}
+		defer bridge.Close()
+		events.Subscribe(EventMessageBroadcast, func(e Event) { bridge.publish(e.Message) })
+	}
+	if *clusterURL != "" {
+		cluster, err := newBroadcaster(*clusterURL)
+		if err != nil {
+			log.Fatalln("クラスターに接続できません:", err)
+		}
+		defer cluster.Close()
+		if err := rooms.joinCluster(cluster); err != nil {
+			log.Fatalln("クラスターのイベントを購読できません:", err)
+		}
+	}
 
 	http.Handle("/chat", MustAuth(&templateHandler{filename: "chat.html"}))
 	http.Handle("/login", &templateHandler{filename: "login.html"})
 	http.HandleFunc("/auth/", loginHandler)
-	http.Handle("/room", r)
-	http.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
-		http.SetCookie(w, &http.Cookie{
-			Name:   "auth",
-			Value:  "",
-			Path:   "/",
-			MaxAge: -1,
-		})
-		w.Header()["Location"] = []string{"/chat"}
-		w.WriteHeader(http.StatusTemporaryRedirect)
-	})
-	http.Handle("/upload", &templateHandler{filename: "upload.html"})
-	http.HandleFunc("/uploader", uploaderHandler)
+	http.Handle("/auth/link/", MustAuth(http.HandlerFunc(linkHandler)))
+	http.Handle("/api/me/identities", MustAuth(http.HandlerFunc(identitiesHandler)))
+	http.Handle("/api/me/name", MustAuth(http.HandlerFunc(renameHandler)))
+	http.Handle("/api/me/identities/", MustAuth(http.HandlerFunc(identitiesHandler)))
+	http.Handle("/login/2fa", &secondFactorHandler{form: &templateHandler{filename: "totp.html"}})
+	http.Handle("/account/2fa/", MustAuth(http.HandlerFunc(totpSettingsHandler)))
+	passkeys, err := newPasskeyAuth(*webauthnRPID, strings.Split(*webauthnOrigins, ","))
+	if err != nil {
+		log.Fatalln("パスキーの設定に失敗しました:", err)
+	}
+	http.Handle("/account/passkeys/register/", MustAuth(passkeys))
+	http.Handle("/account/passkeys", MustAuth(&templateHandler{filename: "passkeys.html"}))
+	http.HandleFunc("/login/passkey/", passkeys.loginHandler)
+	verifier, err := newCaptchaVerifier(*captchaProvider, *captchaSecret)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	captcha = &captchaGate{verifier: verifier, siteKey: *captchaSiteKey, signups: newSignupTracker(*captchaThreshold)}
+	http.Handle("/login/captcha", captcha)
+	if *ldapURL != "" {
+		auth, err := newLDAPAuthenticator()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		roles, err := parseGroupRoles(*ldapGroupRoles)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		http.Handle("/login/ldap", &ldapLoginHandler{auth: auth, roles: roles})
+	}
+	http.HandleFunc("/login/2fa/passkey/", passkeys.loginHandler)
+	http.Handle("/room", MustAuth(roomHandler))
+	http.HandleFunc("/logout", logoutHandler)
+	http.Handle("/account/delete", MustAuth(&accountDeleteHandler{
+		confirm: &templateHandler{filename: "delete.html"},
+	}))
+	exports := &exportHandler{exporter: newExporter()}
+	http.Handle("/account/export", MustAuth(exports))
+	http.Handle("/account/not-me", &notMeHandler{rooms: rooms})
+	http.Handle("/account/export/download", MustAuth(exports))
+	http.Handle("/api/admin/audit", MustAdmin(http.HandlerFunc(auditQueryHandler)))
+	http.Handle("/api/admin/stats/active", MustAdmin(http.HandlerFunc(activeUsersHandler)))
+	http.Handle("/api/admin/stats/geo", MustAdmin(http.HandlerFunc(geoStatsHandler)))
+	http.Handle("/api/admin/users", MustAdmin(http.HandlerFunc(adminUsersHandler)))
+	http.Handle("/api/admin/users/", MustAdmin(http.HandlerFunc(adminUsersHandler)))
+	// SCIMは独自のBearerトークンで認証する
+	http.Handle("/scim/v2/Users", &scimHandler{rooms: rooms})
+	http.Handle("/scim/v2/Users/", &scimHandler{rooms: rooms})
+	http.Handle("/api/admin/flags", MustAdmin(http.HandlerFunc(featureFlagsHandler)))
+	http.Handle("/api/admin/uploads/gc", MustAdmin(http.HandlerFunc(blobGCHandler)))
+	http.Handle("/api/moderation/reports/", MustAuth(MustRole(roleModerator, &moderationHandler{rooms: rooms})))
+	http.Handle("/api/moderation/users/", MustAuth(MustRole(roleModerator, &moderationUserHandler{rooms: rooms})))
+	http.Handle("/api/me/keys", MustAuth(http.HandlerFunc(apiKeysHandler)))
+	http.Handle("/api/me/keys/", MustAuth(http.HandlerFunc(apiKeysHandler)))
+	reminderAPI := &remindersHandler{rooms: rooms}
+	http.Handle("/api/me/reminders", MustAuth(reminderAPI))
+	http.Handle("/api/me/reminders/", MustAuth(reminderAPI))
+	http.Handle("/settings", MustAuth(&templateHandler{filename: "settings.html"}))
+	http.Handle("/rooms", MustAuth(&templateHandler{filename: "rooms.html"}))
+	http.Handle("/rooms/", MustAuth(&permalinkHandler{}))
+	http.Handle("/api/messages/", MustAuth(&messageAPIHandler{rooms: rooms}))
+	http.Handle("/api/presence", MustAuth(http.HandlerFunc(presenceHandler)))
+	http.Handle("/api/me/storage", MustAuth(http.HandlerFunc(storageHandler)))
+	http.Handle("/api/me/notifications", MustAuth(http.HandlerFunc(notificationPrefsHandler)))
+	http.Handle("/api/me/highlights", MustAuth(http.HandlerFunc(highlightsHandler)))
+	http.Handle("/api/me/status", MustAuth(&statusHandler{rooms: rooms}))
+	http.Handle("/api/me/stars", MustAuth(&starsHandler{rooms: rooms}))
+	http.Handle("/api/me/stars/", MustAuth(&starsHandler{rooms: rooms}))
+	http.Handle("/api/gifs/search", MustAuth(http.HandlerFunc(gifSearchHandler)))
+	http.Handle("/api/stickers", MustAuth(&stickerHandler{prefix: "/api/stickers"}))
+	http.Handle("/api/stickers/", MustAuth(&stickerHandler{prefix: "/api/stickers"}))
+	http.Handle("/api/admin/stickers", MustAdmin(&stickerHandler{prefix: "/api/admin/stickers", curated: true}))
+	http.Handle("/api/admin/stickers/", MustAdmin(&stickerHandler{prefix: "/api/admin/stickers", curated: true}))
+	http.Handle("/api/admin/storage/", MustAdmin(http.HandlerFunc(storageAdminHandler)))
+	http.Handle("/api/admin/drain", MustAdmin(&drainHandler{drainer: drain, rooms: rooms}))
+	http.HandleFunc("/healthz", healthHandler)
+	http.HandleFunc("/readyz", drain.readyHandler)
+	if *metricsPath != "" {
+		http.Handle(*metricsPath, metricsHandler())
+	}
+	http.Handle("/api/admin/rooms/", MustAdmin(&roomAdminHandler{rooms: rooms}))
+	http.Handle("/api/admin/ipfilter", MustAdmin(http.HandlerFunc(ipFilterAdminHandler)))
+	http.Handle("/api/admin/announcements", MustAdmin(&announcementHandler{rooms: rooms}))
+	http.Handle("/api/admin/groups", MustAdmin(http.HandlerFunc(groupAdminHandler)))
+	http.Handle("/api/admin/groups/", MustAdmin(http.HandlerFunc(groupAdminHandler)))
+	http.Handle("/api/groups", MustAuth(http.HandlerFunc(groupsHandler)))
+	roomAPI := &roomInfoHandler{rooms: rooms, stats: &roomStatsHandler{rooms: rooms}}
+	http.Handle("/api/rooms", MustAuth(roomAPI))
+	http.Handle("/api/rooms/", MustAuth(roomAPI))
+	http.Handle("/upload", MustAuth(&templateHandler{filename: "upload.html"}))
+	http.Handle("/uploader", MustAuth(http.HandlerFunc(uploaderHandler)))
+	http.Handle("/files/", MustAuth(tus))
+	http.Handle("/attachments/", MustAuth(http.HandlerFunc(attachmentHandler)))
 	http.Handle("/avatars/",
-		http.StripPrefix("/avatars/",
-			http.FileServer(http.Dir("./avatars"))))
+		http.StripPrefix("/avatars/", newAvatarFileHandler("./avatars")))
+
+	if provider := newFlagProvider(*featureFlagsFile, *featureFlagsURL); provider != nil {
+		if err := features.reload(provider); err != nil {
+			log.Fatalln("機能フラグの設定を読み込めませんでした:", err)
+		}
+		go features.watch(provider, *featureFlagsInterval)
+	}
+
+	// リマインダーの配信を開始
+	go runReminders(reminderInterval)
+	go tus.runExpiry(time.Hour)
+	if *blobGCInterval > 0 {
+		go runBlobGC(*blobGCInterval, *blobGCGrace, *blobGCDryRun)
+	}
+	if *analyticsSink != "" {
+		sink, err := newAnalyticsSink(*analyticsSink)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		collector := newAnalyticsCollector()
+		collector.subscribe(events)
+		go collector.run(sink, *analyticsInterval)
+	}
 
-	// チャットルーム開始
-	go r.run()
+	accessLog, err := openAccessLog(*accessLogPath, *accessLogFormat)
+	if err != nil {
+		log.Fatalln("アクセスログを開けませんでした:", err)
+	}
+	handler := withRequestID(accessLog.Handler(withRecovery(withCompression(protectDebugVars(http.DefaultServeMux)))))
 
 	// Webサーバーを起動
-	log.Println("Webサーバーを起動します。ポート:", *addr)
-	if err := http.ListenAndServe(*addr, nil); err != nil {
-		log.Fatal("ListenAndServe:", err)
+	listeners, err := newListeners(handler)
+	if err != nil {
+		log.Fatalln("待ち受けを開始できませんでした:", err)
+	}
+	for _, l := range listeners {
+		log.Println("Webサーバーを起動します。ポート:", l.addr)
+		drain.servers = append(drain.servers, l)
+	}
+	// SIGINTかSIGTERMを受け取った場合はドレインしてから終了する
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		// ドレイン中に再びシグナルを受け取った場合は待たずに終了できるように既定の動作に戻す
+		signal.Stop(signals)
+		log.Println("シグナルを受信したため終了します:", sig)
+		sdNotify("STOPPING=1")
+		drain.start(rooms, *drainReconnectURL, *drainThreshold, *drainTimeout)
+	}()
+	// Type=notifyで起動された場合は待ち受けを開始したことを知らせる
+	if err := sdNotify("READY=1"); err != nil {
+		log.Println("systemdに起動を通知できませんでした:", err)
+	}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *listener) { errs <- l.serve() }(l)
+	}
+	for range listeners {
+		if err := <-errs; err != http.ErrServerClosed {
+			log.Fatal("Serve:", err)
+		}
 	}
+	<-drain.done
+	// 残っているクライアントを切断してルームを終了する
+	rooms.Shutdown()
+	log.Println("すべてのルームを終了しました")
 }
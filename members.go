@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrMemberNotFound ユーザーがルームに参加した記録がない場合に発生するエラー
+var ErrMemberNotFound = errors.New("chat: ルームに参加した記録がありません。")
+
+// RoomMember ユーザーのルームへの参加の記録
+type RoomMember struct {
+	Room   string
+	UserID string
+	// IPは最後に参加したときの送信元のIPアドレス
+	IP string
+	// Visitsは参加した回数
+	Visits   int
+	JoinedAt time.Time
+	LastSeen time.Time
+}
+
+// MemberStore ユーザーがどのルームにいつ参加したかを記録する
+type MemberStore interface {
+	// Visit ユーザーの参加を記録し、参加した回数、最後に参加した時刻とIPアドレスを更新する
+	Visit(room, userID, ip string, now time.Time) error
+	// Get ユーザーのルームへの参加の記録を返す
+	// *見つからない場合にはErrMemberNotFoundを返す
+	Get(room, userID string) (*RoomMember, error)
+	// DeleteByUser ユーザーの参加の記録を削除する
+	DeleteByUser(userID string) error
+}
+
+// memoryMemberStore メモリ上に参加の記録を保持するMemberStore
+type memoryMemberStore struct {
+	mu sync.Mutex
+	// membersはユーザーごと、ルームごとの参加の記録
+	members map[string]map[string]*RoomMember
+}
+
+func newMemoryMemberStore() *memoryMemberStore {
+	return &memoryMemberStore{members: make(map[string]map[string]*RoomMember)}
+}
+
+func (s *memoryMemberStore) Visit(room, userID, ip string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.members[userID] == nil {
+		s.members[userID] = make(map[string]*RoomMember)
+	}
+	m, ok := s.members[userID][room]
+	if !ok {
+		m = &RoomMember{Room: room, UserID: userID, JoinedAt: now}
+		s.members[userID][room] = m
+	}
+	m.IP, m.LastSeen = ip, now
+	m.Visits++
+	return nil
+}
+
+func (s *memoryMemberStore) Get(room, userID string) (*RoomMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.members[userID][room]
+	if !ok {
+		return nil, ErrMemberNotFound
+	}
+	copied := *m
+	return &copied, nil
+}
+
+func (s *memoryMemberStore) DeleteByUser(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.members, userID)
+	return nil
+}
+
+// recordVisit ユーザーのルームへの参加を記録する。記録できなくても参加は続ける
+func recordVisit(room, userID, ip string) {
+	if err := members.Visit(room, userID, ip, time.Now()); err != nil {
+		log.Println("ルームへの参加の記録に失敗しました:", err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var joinLeaveWindow = flag.Duration("join-leave-window", 5*time.Second, "参加・退室のお知らせをまとめる期間 (0の場合はまとめずに1件ずつ送信する)")
+
+// membershipBatch まとめて送信する前の参加・退室したユーザー (ユーザーID→名前)
+// 期間内に参加して退室したユーザーは打ち消し合う
+type membershipBatch struct {
+	joined map[string]string
+	left   map[string]string
+}
+
+func newMembershipBatch() *membershipBatch {
+	return &membershipBatch{joined: make(map[string]string), left: make(map[string]string)}
+}
+
+func (b *membershipBatch) join(userID, name string) {
+	if _, ok := b.left[userID]; ok {
+		delete(b.left, userID)
+		return
+	}
+	b.joined[userID] = name
+}
+
+func (b *membershipBatch) leave(userID, name string) {
+	if _, ok := b.joined[userID]; ok {
+		delete(b.joined, userID)
+		return
+	}
+	b.left[userID] = name
+}
+
+// event まとめたお知らせを返す。参加も退室もなければnilを返す
+func (b *membershipBatch) event(room string) *message {
+	if len(b.joined) == 0 && len(b.left) == 0 {
+		return nil
+	}
+	msg := &message{Type: typeMembership, ID: randomID(), Room: room, Name: systemName, When: time.Now()}
+	var parts []string
+	describe := func(names map[string]string, verb string) []string {
+		list := make([]string, 0, len(names))
+		for _, name := range names {
+			list = append(list, name)
+		}
+		switch len(list) {
+		case 0:
+		case 1:
+			parts = append(parts, list[0]+"さんが"+verb)
+		default:
+			parts = append(parts, strconv.Itoa(len(list))+"人が"+verb)
+		}
+		return list
+	}
+	msg.Joined = describe(b.joined, "参加しました")
+	msg.Left = describe(b.left, "退室しました")
+	msg.Message = strings.Join(parts, "、")
+	return msg
+}
+
+// memberJoinedはクライアントの参加を記録し、そのユーザーの最初の接続であれば参加のお知らせに加える
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) memberJoined(c *client) {
+	userID, _ := c.userData["userid"].(string)
+	name, _ := c.userData["name"].(string)
+	r.members[userID]++
+	if r.members[userID] == 1 {
+		r.recordMembership(func(b *membershipBatch) { b.join(userID, name) })
+	}
+}
+
+// memberLeftはクライアントの退室を記録し、そのユーザーの最後の接続であれば退室のお知らせに加える
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) memberLeft(c *client) {
+	userID, _ := c.userData["userid"].(string)
+	name, _ := c.userData["name"].(string)
+	if r.members[userID] == 0 {
+		return
+	}
+	if r.members[userID]--; r.members[userID] > 0 {
+		return
+	}
+	delete(r.members, userID)
+	r.recordMembership(func(b *membershipBatch) { b.leave(userID, name) })
+}
+
+// recordMembershipはお知らせにまとめる参加・退室を記録する
+// ルームの設定で抑止されている場合は何もしない
+func (r *room) recordMembership(update func(b *membershipBatch)) {
+	if r.Settings().SuppressJoinLeave {
+		r.membership, r.membershipFlush = nil, nil
+		return
+	}
+	if r.membership == nil {
+		r.membership = newMembershipBatch()
+	}
+	update(r.membership)
+	if *joinLeaveWindow <= 0 {
+		r.flushMembership()
+		return
+	}
+	if r.membershipFlush == nil {
+		r.membershipFlush = time.After(*joinLeaveWindow)
+	}
+}
+
+// flushMembershipはまとめた参加・退室のお知らせを配信する
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) flushMembership() {
+	batch := r.membership
+	r.membership, r.membershipFlush = nil, nil
+	if batch == nil {
+		return
+	}
+	msg := batch.event(r.name)
+	if msg == nil {
+		return
+	}
+	if r.cluster != nil {
+		if err := r.cluster.Publish(clusterBroadcast, msg); err != nil {
+			r.tracer.Error("参加・退室のお知らせの中継に失敗しました: ", err)
+		}
+	}
+	r.deliver(msg)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMembershipAggregation(t *testing.T) {
+	defer func(d time.Duration) { *joinLeaveWindow = d }(*joinLeaveWindow)
+	*joinLeaveWindow = time.Hour
+	r := newRoom()
+	r.name = "test"
+	observer := &client{send: make(chan *message, 8), userData: map[string]interface{}{"userid": "o", "name": "Observer"}}
+	r.clients[observer] = true
+	join := func(id, name string) *client {
+		c := &client{send: make(chan *message, 8), userData: map[string]interface{}{"userid": id, "name": name}}
+		r.admit(c)
+		return c
+	}
+
+	join("a", "Alice")
+	join("b", "Bob")
+	second := join("a", "Alice")
+	c := join("c", "Carol")
+	r.remove(second, 1000, "")
+	r.remove(c, 1000, "")
+	r.flushMembership()
+	msg := <-observer.send
+	if msg.Type != typeMembership || msg.Message != "2人が参加しました" || len(msg.Left) != 0 {
+		t.Errorf("期間内に参加して退室したユーザーと2つ目の接続は数えないべきです: %+v", msg)
+	}
+
+	r.SetSettings(roomSettings{SuppressJoinLeave: true})
+	join("d", "Dave")
+	r.flushMembership()
+	select {
+	case msg := <-observer.send:
+		t.Errorf("抑止されたルームではお知らせを送信しないべきです: %+v", msg)
+	default:
+	}
+}
@@ -1,13 +1,221 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// メッセージの種類
+const (
+	// typeChatは通常のチャットのメッセージ
+	typeChat = ""
+	// typeReportはメッセージの通報 (クライアント→サーバー)
+	typeReport = "report"
+	// typeReportReceivedは通報の受付完了 (サーバー→クライアント)
+	typeReportReceived = "report_received"
+	// typeMessageDeletedはメッセージの削除 (サーバー→クライアント)
+	typeMessageDeleted = "message_deleted"
+	// typeRemindはメッセージのリマインダーの設定 (クライアント→サーバー)
+	// Refに対象のメッセージのID、Messageに時刻または期間を指定する
+	typeRemind = "remind"
+	// typeReminderSetはリマインダーの設定完了 (サーバー→クライアント)
+	typeReminderSet = "reminder_set"
+	// typeTranslateはメッセージの翻訳の要求 (クライアント→サーバー)
+	// Refに対象のメッセージのID、Langに翻訳先の言語を指定する
+	typeTranslate = "translate"
+	// typeTranslationは翻訳結果 (サーバー→クライアント)
+	typeTranslation = "translation"
+	// typeReconnectはノードの終了前に再接続を促すヒント (サーバー→クライアント)
+	// Messageに再接続先のURLを指定する。空の場合は同じURLに再接続する
+	typeReconnect = "reconnect"
+	// typeHelloはプロトコルのバージョンの要求 (クライアント→サーバー)
+	// 接続後の最初のフレームとしてVersionに希望するバージョンを指定する
+	typeHello = "hello"
+	// typeWelcomeは決定したプロトコルのバージョンと利用できる機能 (サーバー→クライアント)
+	typeWelcome = "welcome"
+	// typeBatchは複数のイベントをまとめたフレーム (サーバー内部)
+	// クライアントにはイベントのJSONの配列として送信される
+	typeBatch = "batch"
+	// typeErrorはリクエストの処理に失敗したことを表す (サーバー→クライアント)
+	typeError = "error"
+	// typeRoomUpdatedはルームのトピックなどの情報の変更 (サーバー→クライアント)
+	// RoomInfoに変更後の情報を指定する
+	typeRoomUpdated = "room_updated"
+	// typeRoomArchivedはルームがアーカイブされたことのお知らせ (サーバー→クライアント)
+	// 送信後にクローズ理由archivedで切断する
+	typeRoomArchived = "room_archived"
+	// typeWaitingは定員に達したルームで待機していることのお知らせ (サーバー→クライアント)
+	// Positionに待機している順番 (1から) を指定する。順番が変わるたびに送信する
+	typeWaiting = "waiting"
+	// typeAdmittedは待機していたクライアントがルームに参加したことのお知らせ (サーバー→クライアント)
+	typeAdmitted = "admitted"
+	// typeMembershipは参加・退室のお知らせ (サーバー→クライアント)
+	// -join-leave-windowの期間ごとにまとめ、JoinedとLeftにユーザーの名前を指定する
+	typeMembership = "membership"
+	// typeAckは確認応答モードで受信済みのイベントを知らせる (クライアント→サーバー)
+	// Seqに受信済みの最大の番号を指定する。それ以下のイベントはすべて受信済みとみなす
+	typeAck = "ack"
+	// typeSentはClientIDを指定した投稿を受け付けたことの確認 (サーバー→クライアント)
+	// ClientIDとサーバーが割り当てたIDの対応を知らせる
+	typeSent = "sent"
+	// typeAnnouncementはルームに関係なくすべてのクライアントに送る管理者からのお知らせ (サーバー→クライアント)
+	// Expiresを過ぎたら表示を消す。Messageが空の場合はお知らせの取り下げを表す
+	typeAnnouncement = "announcement"
+	// typeStatusはユーザーの状態(online、away、dnd)の変更のお知らせ (サーバー→クライアント)
+	// 変更したユーザーのいるルームに関係なく、すべてのクライアントに送信する
+	typeStatus = "status"
+	// typeStickerはスタンプのメッセージ (クライアント→サーバー→クライアント)
+	// Stickerにパックとスタンプのidを指定する。サーバーが名前と画像のURLを補う
+	typeSticker = "sticker"
+	// typeGIFはGIFのメッセージ (クライアント→サーバー→クライアント)
+	// GIFに/api/gifs/searchの検索結果を指定する
+	typeGIF = "gif"
+	// typeCodeはコードのメッセージ (クライアント→サーバー→クライアント)
+	// Messageにコード、Snippet.languageに言語を指定する。サーバーが色分けしたSnippet.htmlを補う
+	typeCode = "code"
+	// typeStarredとtypeUnstarredはメッセージにスターを付けた・外したことのお知らせ (サーバー→クライアント)
+	// 本人のクライアントにだけ送信し、Refに対象のメッセージのIDを指定する
+	typeStarred   = "starred"
+	typeUnstarred = "unstarred"
+	// typeHighlightは登録したキーワードを含むメッセージが投稿されたことのお知らせ (サーバー→クライアント)
+	// 本人のクライアントにだけ送信し、Refに投稿のID、Highlightsに一致したキーワードを指定する
+	typeHighlight = "highlight"
+	// typeUserErasedはユーザーのデータを消去したことの記録 (イベントログのみ)
+	// UserIDに消去したユーザー、Messageに過去のメッセージの扱い(anonymizeまたはdelete)を指定する
+	typeUserErased = "user_erased"
 )
 
+// isPost 保存して履歴に残す投稿(チャットのメッセージ、スタンプ、GIF、コード)かどうか
+func isPost(msg *message) bool {
+	switch msg.Type {
+	case typeChat, typeSticker, typeGIF, typeCode:
+		return !msg.Ephemeral
+	}
+	return false
+}
+
 // messageは1つのメッセージを表す
 type message struct {
+	Type      string `json:",omitempty"`
+	ID        string
+	Room      string
+	UserID    string
 	Name      string
 	Message   string
 	When      time.Time
 	AvatarURL string
+	// Refは通報などの対象となるメッセージのID
+	Ref string `json:",omitempty"`
+	// Langは翻訳先の言語
+	Lang string `json:",omitempty"`
+	// RetryAfterは再接続や再送まで待つ秒数。RetryJitterはそれに加える乱数の最大の秒数
+	RetryAfter  int `json:",omitempty"`
+	RetryJitter int `json:",omitempty"`
+	// Versionはプロトコルのバージョン。Versionsはサーバーが対応しているすべてのバージョン
+	Version  int   `json:",omitempty"`
+	Versions []int `json:",omitempty"`
+	// Featuresはサーバーで利用できる機能
+	Features []string `json:",omitempty"`
+	// Codeはエラーイベントの種類を表す機械可読なコード
+	Code string `json:",omitempty"`
+	// RoomInfoはルームの情報の変更後の内容
+	RoomInfo *RoomInfo `json:",omitempty"`
+	// Positionは定員に達したルームで待機している順番
+	Position int `json:",omitempty"`
+	// JoinedとLeftは参加・退室のお知らせにまとめたユーザーの名前
+	Joined []string `json:",omitempty"`
+	Left   []string `json:",omitempty"`
+	// Seqは確認応答モードで接続ごとに割り当てる番号。Streamは再接続時に指定する配信ストリームのID
+	Seq    int64  `json:",omitempty"`
+	Stream string `json:",omitempty"`
+	// ClientIDは再送を見分けるためにクライアントが投稿に付けるID
+	ClientID string `json:",omitempty"`
+	// Ephemeralは1つの接続にだけ届けた一時的なメッセージであることを表す。保存も再送もしない
+	Ephemeral bool `json:",omitempty"`
+	// Expiresはお知らせの有効期限
+	Expires *time.Time `json:",omitempty"`
+	// Statusはユーザーの状態の変更後の内容
+	Status *UserStatus `json:",omitempty"`
+	// Stickerはスタンプのメッセージで送信するスタンプ
+	Sticker *StickerRef `json:",omitempty"`
+	// GIFはGIFのメッセージで送信するGIF
+	GIF *GIF `json:",omitempty"`
+	// Snippetはコードのメッセージの言語と色分けしたHTML
+	Snippet *CodeSnippet `json:",omitempty"`
+	// Forwardedは他のルームから転送したメッセージの転送元
+	Forwarded *ForwardInfo `json:",omitempty"`
+	// Mentionsはメッセージ中のグループへのメンション
+	Mentions []Mention `json:",omitempty"`
+	// Autoは自動応答のルールによる返信であることを表す。自動応答のルールを適用しない
+	Auto bool `json:",omitempty"`
+	// Highlightsはハイライトのお知らせで一致したキーワード
+	Highlights []string `json:",omitempty"`
+	// preparedはprepareMessageでエンコード済みのフレーム。設定されている場合はそのまま送信する
+	prepared *websocket.PreparedMessage
+	// sizeはpreparedのデータのバイト数
+	size int
+}
+
+// エラーイベントのコード
+const (
+	errBadRequest = "bad_request"
+	errReadOnly   = "read_only"
+	// errOverloadedはサーバーが過負荷のため処理できなかったことを表す。RetryAfterを参照して再試行する
+	errOverloaded = "overloaded"
+	// errUnsupportedVersionは要求されたプロトコルのバージョンに対応していないことを表す
+	errUnsupportedVersion = "unsupported_version"
+	// errRoomFullはルームが定員に達しているため参加できなかったことを表す
+	errRoomFull = "room_full"
+)
+
+// resetServerFields クライアントから受信した投稿から、サーバーだけが設定するフィールドを取り除く
+// 偽の転送元や確認応答の番号、お知らせなどを付けた投稿がそのまま配信されないようにする
+func (m *message) resetServerFields() {
+	m.RetryAfter, m.RetryJitter = 0, 0
+	m.Version, m.Versions, m.Features = 0, nil, nil
+	m.Code = ""
+	m.RoomInfo = nil
+	m.Position = 0
+	m.Joined, m.Left = nil, nil
+	m.Seq, m.Stream = 0, ""
+	m.Ephemeral = false
+	m.Expires = nil
+	m.Status = nil
+	m.Forwarded = nil
+	m.Auto = false
+	m.Highlights = nil
+}
+
+// maxFrameSize クライアントから受信する1フレームの最大サイズ
+const maxFrameSize = 64 << 10
+
+// ErrInvalidFrame 受信したフレームがイベントとして解釈できない場合に発生するエラー
+var ErrInvalidFrame = errors.New("chat: イベントの形式が不正です。")
+
+// decodeMessage クライアントから受信したフレームをイベントに変換する
+// JSONのオブジェクトでない場合(配列、文字列、nullなど)はErrInvalidFrameを返す
+func decodeMessage(data []byte) (*message, error) {
+	var msg *message
+	if err := json.Unmarshal(data, &msg); err != nil || msg == nil {
+		return nil, ErrInvalidFrame
+	}
+	return msg, nil
+}
+
+// errorMessageはクライアントに返すエラーイベントを生成する
+func errorMessage(text string) *message {
+	return errorEvent(errBadRequest, text)
+}
+
+// overloadedEventは過負荷のため処理できなかったことを再試行の目安とともに知らせる
+func overloadedEvent(text string) *message {
+	return defaultBackoff().apply(errorEvent(errOverloaded, text))
+}
+
+// errorEventはコード付きのエラーイベントを生成する
+func errorEvent(code, text string) *message {
+	return &message{Type: typeError, Code: code, Name: systemName, Message: text, When: time.Now()}
 }
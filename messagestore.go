@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrMessageNotFound 指定されたメッセージが存在しない場合に発生するエラー
+var ErrMessageNotFound = errors.New("chat: メッセージが見つかりません。")
+
+// MessageStore 送信されたメッセージの履歴を保存する
+type MessageStore interface {
+	Save(m *message) error
+	// Get IDでメッセージを取得する
+	// *見つからない場合にはErrMessageNotFoundを返す
+	Get(id string) (*message, error)
+	// ListByUser ユーザーが送信したメッセージを送信順に返す
+	ListByUser(userID string) ([]*message, error)
+	Update(m *message) error
+	Delete(id string) error
+	// DeleteByRoom ルームのすべてのメッセージを削除し、削除した件数を返す
+	DeleteByRoom(room string) (int, error)
+	// Around 指定されたメッセージと、同じルームのその前後n件ずつのメッセージを送信順に返す
+	// *見つからない場合にはErrMessageNotFoundを返す
+	Around(id string, n int) ([]*message, error)
+	// Each 保存されているすべてのメッセージを送信順にfnに渡す。fnがエラーを返した場合は中断してそのエラーを返す
+	// fnの中でストアを操作してはならない
+	Each(fn func(m *message) error) error
+}
+
+// memoryMessageStore メモリ上にメッセージを保持するMessageStore
+type memoryMessageStore struct {
+	mu       sync.RWMutex
+	messages []*message
+	byID     map[string]*message
+}
+
+func newMemoryMessageStore() *memoryMessageStore {
+	return &memoryMessageStore{byID: make(map[string]*message)}
+}
+
+func (s *memoryMessageStore) Save(m *message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *m
+	s.messages = append(s.messages, &stored)
+	s.byID[m.ID] = &stored
+	return nil
+}
+
+func (s *memoryMessageStore) Get(id string) (*message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.byID[id]
+	if !ok {
+		return nil, ErrMessageNotFound
+	}
+	copied := *m
+	return &copied, nil
+}
+
+func (s *memoryMessageStore) ListByUser(userID string) ([]*message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []*message
+	for _, m := range s.messages {
+		if m.UserID == userID {
+			copied := *m
+			list = append(list, &copied)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryMessageStore) Update(m *message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.byID[m.ID]
+	if !ok {
+		return ErrMessageNotFound
+	}
+	*stored = *m
+	return nil
+}
+
+func (s *memoryMessageStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byID[id]; !ok {
+		return ErrMessageNotFound
+	}
+	delete(s.byID, id)
+	for i, m := range s.messages {
+		if m.ID == id {
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memoryMessageStore) Each(fn func(m *message) error) error {
+	s.mu.RLock()
+	list := make([]message, len(s.messages))
+	for i, m := range s.messages {
+		list[i] = *m
+	}
+	s.mu.RUnlock()
+	for i := range list {
+		if err := fn(&list[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryMessageStore) DeleteByRoom(room string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.messages[:0]
+	for _, m := range s.messages {
+		if m.Room == room {
+			delete(s.byID, m.ID)
+			continue
+		}
+		kept = append(kept, m)
+	}
+	n := len(s.messages) - len(kept)
+	s.messages = kept
+	return n, nil
+}
+
+func (s *memoryMessageStore) Around(id string, n int) ([]*message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	target, ok := s.byID[id]
+	if !ok {
+		return nil, ErrMessageNotFound
+	}
+	var room []*message
+	at := 0
+	for _, m := range s.messages {
+		if m.Room != target.Room {
+			continue
+		}
+		if m == target {
+			at = len(room)
+		}
+		room = append(room, m)
+	}
+	from, to := at-n, at+n+1
+	if from < 0 {
+		from = 0
+	}
+	if to > len(room) {
+		to = len(room)
+	}
+	list := make([]*message, 0, to-from)
+	for _, m := range room[from:to] {
+		copied := *m
+		list = append(list, &copied)
+	}
+	return list, nil
+}
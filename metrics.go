@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsPathの指標は認証なしで公開されるため、既定では公開しない
+var metricsPath = flag.String("metrics-path", "", "Prometheus形式で配信の指標を公開するパス (空の場合は公開しない。認証はしないため内部のネットワークからのみ到達できるようにする)")
+
+var (
+	// fanOutDuration ルームの在室者全員の送信バッファにイベントを入れるまでの時間
+	fanOutDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gochat",
+		Name:      "fanout_duration_seconds",
+		Help:      "ルームの在室者へのイベントの配信にかかった時間",
+		Buckets:   prometheus.ExponentialBuckets(0.00005, 4, 10),
+	}, []string{"room"})
+	// clientWriteDuration 1つのイベントをクライアントの接続に書き込むのにかかった時間
+	clientWriteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gochat",
+		Name:      "client_write_duration_seconds",
+		Help:      "クライアントへのイベントの書き込みにかかった時間",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"room"})
+	// droppedFramesByRoom 送信バッファが一杯のため破棄したイベントの数
+	droppedFramesByRoom = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gochat",
+		Name:      "dropped_frames_total",
+		Help:      "送信バッファが一杯のため破棄したイベントの数",
+	}, []string{"room"})
+)
+
+// deliveryClients 接続中のクライアントごとの指標を収集するprometheus.Collector
+// 接続が終わったクライアントの系列は次の収集から消える
+type deliveryClients struct {
+	mu      sync.Mutex
+	clients map[*client]string
+
+	queueDepth *prometheus.Desc
+	writeTime  *prometheus.Desc
+	writes     *prometheus.Desc
+}
+
+// deliveryMetrics 接続中のクライアントの一覧
+var deliveryMetrics = &deliveryClients{
+	clients: make(map[*client]string),
+	queueDepth: prometheus.NewDesc("gochat_client_queue_depth",
+		"クライアントの送信バッファに溜まっているイベントの数", []string{"room", "client"}, nil),
+	writeTime: prometheus.NewDesc("gochat_client_write_seconds_total",
+		"クライアントへのイベントの書き込みにかかった時間の合計", []string{"room", "client"}, nil),
+	writes: prometheus.NewDesc("gochat_client_writes_total",
+		"クライアントに書き込んだイベントの数", []string{"room", "client"}, nil),
+}
+
+// add ルームに参加したクライアントを収集の対象に加える
+func (d *deliveryClients) add(room string, c *client) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.clients[c] = room
+}
+
+// remove ルームから退室したクライアントを収集の対象から外す
+func (d *deliveryClients) remove(c *client) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.clients, c)
+}
+
+func (d *deliveryClients) Describe(ch chan<- *prometheus.Desc) {
+	ch <- d.queueDepth
+	ch <- d.writeTime
+	ch <- d.writes
+}
+
+func (d *deliveryClients) Collect(ch chan<- prometheus.Metric) {
+	// 同じリクエストIDの接続が重複した場合も収集に失敗しないよう、ラベルごとに合計する
+	type key struct{ room, client string }
+	type values struct {
+		depth, writes int
+		elapsed       time.Duration
+	}
+	sums := make(map[key]*values)
+	d.mu.Lock()
+	for c, room := range d.clients {
+		k := key{room, c.requestID}
+		if sums[k] == nil {
+			sums[k] = &values{}
+		}
+		sums[k].depth += len(c.send)
+		sums[k].writes += int(c.writes.Load())
+		sums[k].elapsed += time.Duration(c.writeNanos.Load())
+	}
+	d.mu.Unlock()
+	for k, v := range sums {
+		ch <- prometheus.MustNewConstMetric(d.queueDepth, prometheus.GaugeValue, float64(v.depth), k.room, k.client)
+		ch <- prometheus.MustNewConstMetric(d.writeTime, prometheus.CounterValue, v.elapsed.Seconds(), k.room, k.client)
+		ch <- prometheus.MustNewConstMetric(d.writes, prometheus.CounterValue, float64(v.writes), k.room, k.client)
+	}
+}
+
+// deliveryRegistry 配信の指標を登録したレジストリ
+var deliveryRegistry = prometheus.NewRegistry()
+
+func init() {
+	deliveryRegistry.MustRegister(fanOutDuration, clientWriteDuration, droppedFramesByRoom, deliveryMetrics,
+		prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+}
+
+// metricsHandler Prometheusが収集する配信の指標
+// GET /metrics
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(deliveryRegistry, promhttp.HandlerOpts{})
+}
+
+// forgetRoomMetrics 削除したルームの系列を指標から取り除く
+func forgetRoomMetrics(room string) {
+	fanOutDuration.DeleteLabelValues(room)
+	clientWriteDuration.DeleteLabelValues(room)
+	droppedFramesByRoom.DeleteLabelValues(room)
+}
+
+// observeWriteはクライアントへの1つのイベントの書き込みにかかった時間を記録する
+func (c *client) observeWrite(start time.Time) {
+	elapsed := time.Since(start)
+	clientWriteDuration.WithLabelValues(c.room.name).Observe(elapsed.Seconds())
+	c.writeNanos.Add(int64(elapsed))
+	c.writes.Add(1)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeliveryMetrics(t *testing.T) {
+	rm := newRoom()
+	rm.name = "metrics"
+	c := &client{room: rm, requestID: "req1", send: make(chan *message, 4)}
+	c.send <- &message{}
+	deliveryMetrics.add(rm.name, c)
+	defer deliveryMetrics.remove(c)
+	c.observeWrite(time.Now().Add(-time.Millisecond))
+
+	rec := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`gochat_client_queue_depth{client="req1",room="metrics"} 1`,
+		`gochat_client_writes_total{client="req1",room="metrics"} 1`,
+		`gochat_client_write_duration_seconds_count{room="metrics"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("指標に%sが含まれるべきです", want)
+		}
+	}
+
+	deliveryMetrics.remove(c)
+	rec = httptest.NewRecorder()
+	metricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rec.Body.String(), `client="req1"`) {
+		t.Error("退室したクライアントの指標は含まれないべきです")
+	}
+}
+
+func TestForgetRoomMetrics(t *testing.T) {
+	fanOutDuration.WithLabelValues("purged").Observe(0.001)
+	droppedFramesByRoom.WithLabelValues("purged").Inc()
+	forgetRoomMetrics("purged")
+
+	rec := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rec.Body.String(), `room="purged"`) {
+		t.Error("削除したルームの指標は含まれないべきです")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+var databasePath = flag.String("database", "", "ユーザーとメッセージを保存するSQLiteのファイル (空の場合はメモリ上に保持する)")
+
+// migrationFiles バイナリに埋め込んだスキーマの移行
+// ファイル名は {バージョン}_{名前}.up.sql と {バージョン}_{名前}.down.sql
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// ErrSchemaTooNew データベースのスキーマがこのバイナリより新しい場合に発生するエラー
+var ErrSchemaTooNew = errors.New("chat: データベースのスキーマがこのバージョンより新しいため起動できません。")
+
+// ErrSchemaPending 適用されていない移行がある場合に発生するエラー
+var ErrSchemaPending = errors.New("chat: 適用されていないスキーマの移行があります。gochat migrate up を実行してください。")
+
+// migration 1つのバージョンのスキーマの移行
+type migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+// loadMigrations 埋め込んだ移行をバージョンの順に返す
+func loadMigrations(files fs.FS) ([]migration, error) {
+	names, err := fs.Glob(files, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*migration)
+	for _, name := range names {
+		base := path.Base(name)
+		direction := "up"
+		if strings.HasSuffix(base, ".down.sql") {
+			direction = "down"
+		}
+		base = strings.TrimSuffix(strings.TrimSuffix(base, ".sql"), "."+direction)
+		i := strings.Index(base, "_")
+		if i < 0 {
+			return nil, fmt.Errorf("chat: 移行のファイル名が不正です: %s", name)
+		}
+		version, err := strconv.Atoi(base[:i])
+		if err != nil {
+			return nil, fmt.Errorf("chat: 移行のファイル名が不正です: %s", name)
+		}
+		data, err := fs.ReadFile(files, name)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: base[i+1:]}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.up = string(data)
+		} else {
+			m.down = string(data)
+		}
+	}
+	list := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+// migrator データベースにスキーマの移行を適用する
+type migrator struct {
+	db         *sql.DB
+	migrations []migration
+}
+
+func newMigrator(db *sql.DB) (*migrator, error) {
+	list, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`); err != nil {
+		return nil, err
+	}
+	return &migrator{db: db, migrations: list}, nil
+}
+
+// latest このバイナリが知っている最新のバージョン
+func (m *migrator) latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// current データベースに適用済みの最新のバージョン
+func (m *migrator) current() (int, error) {
+	var version sql.NullInt64
+	err := m.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	return int(version.Int64), err
+}
+
+// up 適用されていない移行をすべて適用し、適用した数を返す
+func (m *migrator) up() (int, error) {
+	current, err := m.current()
+	if err != nil {
+		return 0, err
+	}
+	applied := 0
+	for _, mig := range m.migrations {
+		if mig.Version <= current {
+			continue
+		}
+		if err := m.apply(mig.Version, mig.up, true); err != nil {
+			return applied, fmt.Errorf("chat: 移行%d_%sに失敗しました: %v", mig.Version, mig.Name, err)
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// down 最後に適用した移行を1つ取り消し、取り消したバージョンを返す
+func (m *migrator) down() (int, error) {
+	current, err := m.current()
+	if err != nil || current == 0 {
+		return 0, err
+	}
+	for _, mig := range m.migrations {
+		if mig.Version == current {
+			if err := m.apply(mig.Version, mig.down, false); err != nil {
+				return 0, fmt.Errorf("chat: 移行%d_%sの取り消しに失敗しました: %v", mig.Version, mig.Name, err)
+			}
+			return current, nil
+		}
+	}
+	return 0, ErrSchemaTooNew
+}
+
+// apply 1つの移行をトランザクションの中で実行し、適用済みのバージョンを記録する
+func (m *migrator) apply(version int, script string, up bool) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+	if up {
+		_, err = tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now())
+	} else {
+		_, err = tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// check 起動前にスキーマがこのバイナリと一致していることを確認する
+func (m *migrator) check() error {
+	current, err := m.current()
+	if err != nil {
+		return err
+	}
+	switch {
+	case current > m.latest():
+		return fmt.Errorf("%w (データベース: %d、このバージョン: %d)", ErrSchemaTooNew, current, m.latest())
+	case current < m.latest():
+		return fmt.Errorf("%w (データベース: %d、このバージョン: %d)", ErrSchemaPending, current, m.latest())
+	}
+	return nil
+}
+
+// openDatabase SQLiteのデータベースを開く
+func openDatabase(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrateCommand gochat migrate up|down|status
+func migrateCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	path := fs.String("database", *databasePath, "移行するSQLiteのファイル")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "使い方: gochat migrate [-database ファイル] up|down|status")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *path == "" || fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("chat: -databaseと操作を指定してください。")
+	}
+	db, err := openDatabase(*path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	m, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+	switch fs.Arg(0) {
+	case "up":
+		n, err := m.up()
+		fmt.Println("適用した移行:", n)
+		return err
+	case "down":
+		version, err := m.down()
+		if err == nil {
+			fmt.Println("取り消した移行:", version)
+		}
+		return err
+	case "status":
+		current, err := m.current()
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			state := "pending"
+			if mig.Version <= current {
+				state = "applied"
+			}
+			fmt.Printf("%04d_%-30s %s\n", mig.Version, mig.Name, state)
+		}
+		if current > m.latest() {
+			fmt.Println("データベースにはこのバージョンが知らない移行が適用されています:", current)
+		}
+		return nil
+	}
+	fs.Usage()
+	return fmt.Errorf("%w: migrate %s", ErrUnknownCommand, fs.Arg(0))
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigrator(t *testing.T) {
+	db, err := openDatabase(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m, err := newMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.check(); !errors.Is(err, ErrSchemaPending) {
+		t.Errorf("移行していないデータベースではErrSchemaPendingを返すべきです: %v", err)
+	}
+	if n, err := m.up(); err != nil || n != len(m.migrations) {
+		t.Fatalf("すべての移行を適用するべきです: %d, %v", n, err)
+	}
+	if err := m.check(); err != nil {
+		t.Errorf("最新のスキーマでは起動できるべきです: %v", err)
+	}
+
+	users := newSQLUserStore(db)
+	u := &UserRecord{ID: "u1", Name: "Alice", Email: "alice@example.com", EmailVerified: true, Provider: "google", ProviderID: "123", RecoveryCodes: []string{"x"}}
+	if err := users.Create(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Create(&UserRecord{ID: "u2", Name: "Bob", Provider: "google", ProviderID: "123"}); err != ErrUserExists {
+		t.Errorf("同じプロバイダーIDのユーザーは作成できないべきです: %v", err)
+	}
+	got, err := users.GetByProviderID("google", "123")
+	if err != nil || got.ID != "u1" || !got.EmailVerified || len(got.RecoveryCodes) != 1 {
+		t.Errorf("プロバイダーIDでユーザーを取得できるべきです: %+v, %v", got, err)
+	}
+	got.Identities = append(got.Identities, LinkedIdentity{Provider: "github", ProviderID: "456", LinkedAt: time.Now()})
+	got.TOTPLastStep = 12345
+	if err := users.Update(got); err != nil {
+		t.Fatal(err)
+	}
+	if linked, err := users.GetByProviderID("github", "456"); err != nil || linked.ID != "u1" || len(linked.Identities) != 1 || linked.TOTPLastStep != 12345 {
+		t.Errorf("連携したアカウントでユーザーを取得できるべきです: %+v, %v", linked, err)
+	}
+
+	messages := newSQLMessageStore(db)
+	for _, id := range []string{"m1", "m2"} {
+		if err := messages.Save(&message{ID: id, Room: "general", UserID: "u1", Name: "Alice", Message: id, When: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if list, err := messages.ListByUser("u1"); err != nil || len(list) != 2 || list[0].ID != "m1" {
+		t.Errorf("送信順にメッセージを返すべきです: %v, %v", list, err)
+	}
+	forwarded := &message{ID: "m3", Room: "random", UserID: "u1", Name: "Alice", Message: "m1", When: time.Now(),
+		Forwarded: &ForwardInfo{Room: "general", MessageID: "m1", UserID: "u1", Name: "Alice"}}
+	if err := messages.Save(forwarded); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := messages.Get("m3"); err != nil || m.Forwarded == nil || m.Forwarded.MessageID != "m1" {
+		t.Errorf("転送元を保存できるべきです: %+v, %v", m, err)
+	}
+	contents := []*message{
+		{ID: "m4", Type: typeSticker, Sticker: &StickerRef{Pack: "p1", ID: "s1", Name: "hi"}},
+		{ID: "m5", Type: typeGIF, GIF: &GIF{ID: "g1", URL: "https://media.example.com/g1.gif"}},
+		{ID: "m6", Type: typeCode, Snippet: &CodeSnippet{Language: "go", HTML: "<pre>x</pre>"}},
+	}
+	for _, c := range contents {
+		c.Room, c.UserID, c.Name, c.When = "random", "u1", "Alice", time.Now()
+		if err := messages.Save(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m, err := messages.Get("m4"); err != nil || m.Type != typeSticker || m.Sticker == nil || m.Sticker.ID != "s1" || m.Forwarded != nil {
+		t.Errorf("スタンプを保存できるべきです: %+v, %v", m, err)
+	}
+	if m, err := messages.Get("m5"); err != nil || m.Type != typeGIF || m.GIF == nil || m.GIF.ID != "g1" {
+		t.Errorf("GIFを保存できるべきです: %+v, %v", m, err)
+	}
+	if m, err := messages.Get("m6"); err != nil || m.Type != typeCode || m.Snippet == nil || m.Snippet.Language != "go" {
+		t.Errorf("コードを保存できるべきです: %+v, %v", m, err)
+	}
+	if list, err := messages.Around("m2", 5); err != nil || len(list) != 2 || list[0].ID != "m1" || list[1].ID != "m2" {
+		t.Errorf("同じルームの前後のメッセージを送信順に返すべきです: %v, %v", list, err)
+	}
+
+	rooms := newSQLRoomStore(db)
+	if err := rooms.Save(&RoomInfo{Name: "general", Topic: "雑談", UpdatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rooms.Save(&RoomInfo{Name: "general", Topic: "お知らせ", UpdatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := rooms.List(); err != nil || len(list) != 1 || list[0].Topic != "お知らせ" {
+		t.Errorf("ルームの情報を更新できるべきです: %v, %v", list, err)
+	}
+	if err := rooms.Save(&RoomInfo{Name: "general", Settings: roomSettings{ReadOnly: true, Owners: []string{"u1"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := rooms.Get("general"); err != nil || !info.Settings.ReadOnly || len(info.Settings.Owners) != 1 {
+		t.Errorf("ルームの設定を保存できるべきです: %+v, %v", info, err)
+	}
+
+	prefs := newSQLNotificationPrefsStore(db)
+	if p, err := prefs.Get("u1"); err != nil || p.Level != notifyAll {
+		t.Errorf("保存していない通知の設定は既定の設定になるべきです: %+v, %v", p, err)
+	}
+	if err := prefs.Save("u1", &NotificationPrefs{Level: notifyMentions, Rooms: map[string]string{"general": notifyNothing}}); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := prefs.Get("u1"); err != nil || p.level("general") != notifyNothing || p.level("random") != notifyMentions {
+		t.Errorf("通知の設定を保存できるべきです: %+v, %v", p, err)
+	}
+
+	starStore := newSQLStarStore(db)
+	for _, id := range []string{"m1", "m2", "m1"} {
+		if err := starStore.Add(&Star{UserID: "u1", MessageID: id, StarredAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := messages.Delete("m2"); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := starStore.List("u1"); err != nil || len(list) != 1 || list[0].MessageID != "m1" {
+		t.Errorf("削除したメッセージのスターは削除されるべきです: %v, %v", list, err)
+	}
+	if err := starStore.Remove("u1", "m2"); err != ErrStarNotFound {
+		t.Errorf("付けていないスターは外せないべきです: %v", err)
+	}
+
+	groupStore := newSQLGroupStore(db)
+	if err := groupStore.Save(&Group{Name: "oncall", Members: []string{"u1"}, UpdatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if g, err := groupStore.Get("oncall"); err != nil || len(g.Members) != 1 {
+		t.Errorf("グループを保存できるべきです: %+v, %v", g, err)
+	}
+
+	if err := rooms.Save(&RoomInfo{Name: "general", Topic: "お知らせ", Welcome: "ようこそ、{name}さん", UpdatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := rooms.Get("general"); err != nil || info.Welcome != "ようこそ、{name}さん" {
+		t.Errorf("歓迎メッセージを保存できるべきです: %+v, %v", info, err)
+	}
+	welcomeStore := newSQLWelcomeStore(db)
+	for i, want := range []bool{true, false} {
+		if first, err := welcomeStore.FirstJoin("general", "u1", time.Now()); err != nil || first != want {
+			t.Errorf("%d回目の参加: %v, %v", i+1, first, err)
+		}
+	}
+	memberStore := newSQLMemberStore(db)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		if err := memberStore.Visit("general", "u1", ip, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if member, err := memberStore.Get("general", "u1"); err != nil || member.Visits != 2 || member.IP != "192.0.2.2" {
+		t.Errorf("参加の回数と最後のIPアドレスを記録するべきです: %+v, %v", member, err)
+	}
+	if _, err := memberStore.Get("random", "u1"); !errors.Is(err, ErrMemberNotFound) {
+		t.Errorf("参加していないルームではErrMemberNotFoundを返すべきです: %v", err)
+	}
+
+	ruleStore := newSQLAutoRuleStore(db)
+	for i, rule := range []*AutoRule{
+		{ID: "r1", Room: "general", Pattern: "help", Reply: "ヘルプ", CreatedBy: "u1", CreatedAt: time.Now()},
+		{ID: "r2", Room: "general", Keyword: "障害", Webhook: "https://example.com/hook", CreatedBy: "u1", CreatedAt: time.Now().Add(time.Second)},
+	} {
+		if err := ruleStore.Save(rule); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if list, err := ruleStore.List("general"); err != nil || len(list) != 2 || list[0].ID != "r1" || list[1].Webhook != "https://example.com/hook" {
+		t.Errorf("自動応答のルールを作成順に保存できるべきです: %+v, %v", list, err)
+	}
+	if err := ruleStore.Delete("random", "r1"); err != ErrAutoRuleNotFound {
+		t.Errorf("別のルームのルールは削除できないべきです: %v", err)
+	}
+	if err := ruleStore.Delete("general", "r1"); err != nil {
+		t.Error(err)
+	}
+
+	highlightStore := newSQLHighlightStore(db)
+	if err := highlightStore.Set("u1", []string{"障害", "deploy"}); err != nil {
+		t.Fatal(err)
+	}
+	if all, err := highlightStore.All(); err != nil || len(all["u1"]) != 2 {
+		t.Errorf("キーワードを保存できるべきです: %v, %v", all, err)
+	}
+	if err := highlightStore.Set("u1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if words, err := highlightStore.Get("u1"); err != nil || len(words) != 0 {
+		t.Errorf("空のキーワードで置き換えると削除するべきです: %v, %v", words, err)
+	}
+
+	if _, err := db.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, m.latest()+1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.check(); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("新しいスキーマではErrSchemaTooNewを返すべきです: %v", err)
+	}
+	if _, err := db.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.latest()+1); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := m.down(); err != nil || version != m.latest() {
+		t.Errorf("最後の移行を取り消すべきです: %d, %v", version, err)
+	}
+	if _, err := users.GetByID("u1"); err == nil {
+		t.Error("取り消した移行の列は削除されるべきです")
+	}
+	if _, err := m.down(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rooms.Get("general"); err == nil {
+		t.Error("取り消した移行の列は削除されるべきです")
+	}
+	if _, err := m.down(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ruleStore.List("general"); err == nil {
+		t.Error("取り消した移行のテーブルは削除されるべきです")
+	}
+	for version := m.latest() - 3; version >= 2; version-- {
+		if _, err := m.down(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := messages.Get("m1"); err == nil {
+		t.Error("取り消した移行のテーブルは削除されるべきです")
+	}
+}
@@ -0,0 +1,19 @@
+CREATE TABLE users (
+	id             TEXT PRIMARY KEY,
+	name           TEXT NOT NULL,
+	email          TEXT NOT NULL DEFAULT '',
+	avatar_url     TEXT NOT NULL DEFAULT '',
+	provider       TEXT NOT NULL DEFAULT '',
+	provider_id    TEXT NOT NULL DEFAULT '',
+	role           TEXT NOT NULL DEFAULT '',
+	banned         BOOLEAN NOT NULL DEFAULT FALSE,
+	shadow_banned  BOOLEAN NOT NULL DEFAULT FALSE,
+	totp_secret    TEXT NOT NULL DEFAULT '',
+	totp_enabled   BOOLEAN NOT NULL DEFAULT FALSE,
+	recovery_codes TEXT NOT NULL DEFAULT '[]',
+	passkeys       TEXT NOT NULL DEFAULT '[]',
+	storage_quota  INTEGER NOT NULL DEFAULT 0,
+	created_at     TIMESTAMP NOT NULL,
+	updated_at     TIMESTAMP NOT NULL
+);
+CREATE UNIQUE INDEX users_provider ON users (provider, provider_id) WHERE provider <> '';
@@ -0,0 +1,11 @@
+CREATE TABLE messages (
+	seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+	id         TEXT NOT NULL UNIQUE,
+	room       TEXT NOT NULL,
+	user_id    TEXT NOT NULL,
+	name       TEXT NOT NULL,
+	message    TEXT NOT NULL,
+	avatar_url TEXT NOT NULL DEFAULT '',
+	sent_at    TIMESTAMP NOT NULL
+);
+CREATE INDEX messages_user ON messages (user_id, seq);
@@ -0,0 +1,10 @@
+CREATE TABLE oauth_tokens (
+	user_id       TEXT NOT NULL,
+	provider      TEXT NOT NULL,
+	access_token  TEXT NOT NULL,
+	refresh_token TEXT NOT NULL DEFAULT '',
+	token_type    TEXT NOT NULL DEFAULT '',
+	expiry        TIMESTAMP,
+	updated_at    TIMESTAMP NOT NULL,
+	PRIMARY KEY (user_id, provider)
+);
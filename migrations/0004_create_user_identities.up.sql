@@ -0,0 +1,9 @@
+CREATE TABLE user_identities (
+	provider    TEXT NOT NULL,
+	provider_id TEXT NOT NULL,
+	user_id     TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	email       TEXT NOT NULL DEFAULT '',
+	linked_at   TIMESTAMP NOT NULL,
+	PRIMARY KEY (provider, provider_id)
+);
+CREATE INDEX user_identities_user ON user_identities (user_id);
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN custom_name BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,8 @@
+CREATE TABLE rooms (
+	name        TEXT PRIMARY KEY,
+	topic       TEXT NOT NULL DEFAULT '',
+	description TEXT NOT NULL DEFAULT '',
+	icon_url    TEXT NOT NULL DEFAULT '',
+	updated_by  TEXT NOT NULL DEFAULT '',
+	updated_at  TIMESTAMP NOT NULL
+);
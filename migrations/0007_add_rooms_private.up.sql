@@ -0,0 +1 @@
+ALTER TABLE rooms ADD COLUMN private BOOLEAN NOT NULL DEFAULT FALSE;
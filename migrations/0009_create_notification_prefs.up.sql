@@ -0,0 +1,5 @@
+CREATE TABLE notification_prefs (
+	user_id    TEXT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+	prefs      TEXT NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,2 @@
+DROP INDEX messages_room;
+ALTER TABLE messages DROP COLUMN forwarded;
@@ -0,0 +1,2 @@
+ALTER TABLE messages ADD COLUMN forwarded TEXT NOT NULL DEFAULT '';
+CREATE INDEX messages_room ON messages (room, seq);
@@ -0,0 +1,7 @@
+CREATE TABLE stars (
+	user_id    TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	message_id TEXT NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+	starred_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (user_id, message_id)
+);
+CREATE INDEX stars_message ON stars (message_id);
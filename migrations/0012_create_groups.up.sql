@@ -0,0 +1,6 @@
+CREATE TABLE groups (
+	name        TEXT PRIMARY KEY,
+	description TEXT NOT NULL DEFAULT '',
+	members     TEXT NOT NULL,
+	updated_at  TIMESTAMP NOT NULL
+);
@@ -0,0 +1,2 @@
+DROP TABLE room_welcomes;
+ALTER TABLE rooms DROP COLUMN welcome;
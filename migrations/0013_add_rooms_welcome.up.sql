@@ -0,0 +1,8 @@
+ALTER TABLE rooms ADD COLUMN welcome TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE room_welcomes (
+	room      TEXT NOT NULL,
+	user_id   TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	joined_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (room, user_id)
+);
@@ -0,0 +1,5 @@
+CREATE TABLE highlights (
+	user_id    TEXT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+	words      TEXT NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,4 @@
+ALTER TABLE messages DROP COLUMN snippet;
+ALTER TABLE messages DROP COLUMN gif;
+ALTER TABLE messages DROP COLUMN sticker;
+ALTER TABLE messages DROP COLUMN type;
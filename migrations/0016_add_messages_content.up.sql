@@ -0,0 +1,4 @@
+ALTER TABLE messages ADD COLUMN type TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN sticker TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN gif TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN snippet TEXT NOT NULL DEFAULT '';
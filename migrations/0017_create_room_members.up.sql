@@ -0,0 +1,9 @@
+CREATE TABLE room_members (
+	room      TEXT NOT NULL,
+	user_id   TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	ip        TEXT NOT NULL DEFAULT '',
+	visits    INTEGER NOT NULL DEFAULT 0,
+	joined_at TIMESTAMP NOT NULL,
+	last_seen TIMESTAMP NOT NULL,
+	PRIMARY KEY (room, user_id)
+);
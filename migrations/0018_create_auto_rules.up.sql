@@ -0,0 +1,12 @@
+CREATE TABLE auto_rules (
+	id         TEXT PRIMARY KEY,
+	room       TEXT NOT NULL,
+	pattern    TEXT NOT NULL DEFAULT '',
+	keyword    TEXT NOT NULL DEFAULT '',
+	reply      TEXT NOT NULL DEFAULT '',
+	webhook    TEXT NOT NULL DEFAULT '',
+	created_by TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX auto_rules_room ON auto_rules (room, created_at);
@@ -0,0 +1 @@
+ALTER TABLE rooms DROP COLUMN settings;
@@ -0,0 +1 @@
+ALTER TABLE rooms ADD COLUMN settings TEXT NOT NULL DEFAULT '{}';
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrReportNotFound 指定された通報が存在しない場合に発生するエラー
+var ErrReportNotFound = errors.New("chat: 通報が見つかりません。")
+
+// ErrReportResolved 既に対応済みの通報を処理しようとした場合に発生するエラー
+var ErrReportResolved = errors.New("chat: 通報は既に対応済みです。")
+
+// ErrOutranked 自分と同じか上の役割のユーザーを利用停止にしようとした場合に発生するエラー
+var ErrOutranked = errors.New("chat: 自分と同じか上の役割のユーザーは操作できません。")
+
+// 通報の状態
+const (
+	reportOpen       = "open"
+	reportDismissed  = "dismissed"
+	reportDeleted    = "deleted"
+	reportSanctioned = "sanctioned"
+)
+
+// Report メッセージの通報
+type Report struct {
+	ID        string `json:"id"`
+	MessageID string `json:"message_id,omitempty"`
+	// AttachmentIDは画像の判定で不適切とされた添付ファイルのID
+	AttachmentID string    `json:"attachment_id,omitempty"`
+	Room         string    `json:"room"`
+	SenderID     string    `json:"sender_id"`
+	Text         string    `json:"text"`
+	ReporterID   string    `json:"reporter_id"`
+	Reason       string    `json:"reason,omitempty"`
+	Status       string    `json:"status"`
+	CreatedAt    time.Time `json:"created_at"`
+	ResolvedBy   string    `json:"resolved_by,omitempty"`
+	ResolvedAt   time.Time `json:"resolved_at,omitempty"`
+}
+
+// ReportStore モデレーション待ちの通報を保存する
+type ReportStore interface {
+	Create(r *Report) error
+	// Get IDで通報を取得する
+	// *見つからない場合にはErrReportNotFoundを返す
+	Get(id string) (*Report, error)
+	// List 指定された状態の通報を古い順に返す。statusが空の場合はすべて返す
+	List(status string) ([]*Report, error)
+	Update(r *Report) error
+}
+
+// memoryReportStore メモリ上に通報を保持するReportStore
+type memoryReportStore struct {
+	mu      sync.RWMutex
+	reports []*Report
+}
+
+func newMemoryReportStore() *memoryReportStore {
+	return &memoryReportStore{}
+}
+
+func (s *memoryReportStore) Create(r *Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *r
+	s.reports = append(s.reports, &stored)
+	return nil
+}
+
+func (s *memoryReportStore) Get(id string) (*Report, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, r := range s.reports {
+		if r.ID == id {
+			copied := *r
+			return &copied, nil
+		}
+	}
+	return nil, ErrReportNotFound
+}
+
+func (s *memoryReportStore) List(status string) ([]*Report, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []*Report
+	for _, r := range s.reports {
+		if status == "" || r.Status == status {
+			copied := *r
+			list = append(list, &copied)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryReportStore) Update(r *Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, stored := range s.reports {
+		if stored.ID == r.ID {
+			copied := *r
+			s.reports[i] = &copied
+			return nil
+		}
+	}
+	return ErrReportNotFound
+}
+
+// reportMessage メッセージを通報してモデレーション待ちの列に追加する
+func reportMessage(reporterID, messageID, reason string) (*Report, error) {
+	msg, err := messages.Get(messageID)
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{
+		ID:         randomID(),
+		MessageID:  msg.ID,
+		Room:       msg.Room,
+		SenderID:   msg.UserID,
+		Text:       msg.Message,
+		ReporterID: reporterID,
+		Reason:     reason,
+		Status:     reportOpen,
+		CreatedAt:  time.Now(),
+	}
+	return r, reports.Create(r)
+}
+
+// banUser ユーザーを利用停止にし、セッションを失効させてチャットルームから退出させる
+func banUser(rooms *roomRegistry, userID string) error {
+	record, err := users.GetByID(userID)
+	if err != nil {
+		return err
+	}
+	record.Banned = true
+	if err := users.Update(record); err != nil {
+		return err
+	}
+	if err := sessions.DeleteByUser(userID); err != nil {
+		return err
+	}
+	rooms.Kick(userID, "banned")
+	events.Publish(Event{Kind: EventUserBanned, UserID: userID, Name: record.Name})
+	return nil
+}
+
+// isShadowBanned ユーザーがシャドウバンされているかどうかを判定する
+func isShadowBanned(userID string) bool {
+	record, err := users.GetByID(userID)
+	return err == nil && record.ShadowBanned
+}
+
+// moderationUserHandler モデレーター用のユーザーの管理API
+// POST /api/moderation/users/{id}/{action}
+// actionは ban, unban, shadowban, unshadowban のいずれか
+type moderationUserHandler struct {
+	rooms *roomRegistry
+}
+
+func (h *moderationUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segs := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/moderation/users"), "/"), "/")
+	if len(segs) != 2 || r.Method != http.MethodPost {
+		writeJSONError(w, r, "見つかりません", http.StatusNotFound)
+		return
+	}
+	userID, action := segs[0], segs[1]
+	record, err := users.GetByID(userID)
+	if err != nil {
+		writeJSONError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	moderator, _ := userFromContext(r.Context())
+	if !outranks(moderator.UniqueID(), record.Role) {
+		writeJSONError(w, r, ErrOutranked.Error(), http.StatusForbidden)
+		return
+	}
+	switch action {
+	case "ban":
+		err = banUser(h.rooms, userID)
+	case "unban":
+		record.Banned = false
+		err = users.Update(record)
+	case "shadowban":
+		record.ShadowBanned = true
+		err = users.Update(record)
+	case "unshadowban":
+		record.ShadowBanned = false
+		err = users.Update(record)
+	default:
+		writeJSONError(w, r, "非対応の操作です: "+action, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Println("ユーザーの操作に失敗しました:", action, userID, "-", err)
+		writeJSONError(w, r, "ユーザーの操作に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	auditAction := auditAdminAction
+	if action == "ban" || action == "shadowban" {
+		auditAction = auditBan
+	}
+	auditRequest(r, auditAction, moderator.UniqueID(), userID, map[string]string{"action": action})
+	record, _ = users.GetByID(userID)
+	writeJSON(w, http.StatusOK, record)
+}
+
+// moderationHandler モデレーター用の通報の管理API
+// GET  /api/moderation/reports?status=open
+// POST /api/moderation/reports/{id}/dismiss  通報を却下する (画像の判定の場合は添付ファイルを公開する)
+// POST /api/moderation/reports/{id}/delete   メッセージ(または添付ファイル)を削除する
+// POST /api/moderation/reports/{id}/sanction メッセージ(または添付ファイル)を削除し送信者を利用停止にする
+type moderationHandler struct {
+	rooms *roomRegistry
+}
+
+func (h *moderationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segs := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/moderation/reports"), "/"), "/")
+	if segs[0] == "" {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		status := r.FormValue("status")
+		if status == "" {
+			status = reportOpen
+		}
+		list, err := reports.List(status)
+		if err != nil {
+			requestLogger(r).Println("通報の取得に失敗しました:", err)
+			writeJSONError(w, r, "通報の取得に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+	if len(segs) != 2 || r.Method != http.MethodPost {
+		writeJSONError(w, r, "見つかりません", http.StatusNotFound)
+		return
+	}
+	moderator, _ := userFromContext(r.Context())
+	report, err := h.resolve(moderator.UniqueID(), segs[0], segs[1])
+	switch err {
+	case nil:
+		auditRequest(r, auditAdminAction, moderator.UniqueID(), report.SenderID,
+			map[string]string{"report_id": report.ID, "action": segs[1]})
+		writeJSON(w, http.StatusOK, report)
+	case ErrReportNotFound:
+		writeJSONError(w, r, err.Error(), http.StatusNotFound)
+	case ErrReportResolved:
+		writeJSONError(w, r, err.Error(), http.StatusConflict)
+	case ErrOutranked:
+		writeJSONError(w, r, err.Error(), http.StatusForbidden)
+	default:
+		requestLogger(r).Println("通報の処理に失敗しました:", err)
+		writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// resolve 通報に対してモデレーターの判断を適用する
+func (h *moderationHandler) resolve(moderatorID, reportID, action string) (*Report, error) {
+	report, err := reports.Get(reportID)
+	if err != nil {
+		return nil, err
+	}
+	if report.Status != reportOpen {
+		return nil, ErrReportResolved
+	}
+	if action == "sanction" {
+		if sender, err := users.GetByID(report.SenderID); err == nil && !outranks(moderatorID, sender.Role) {
+			return nil, ErrOutranked
+		}
+	}
+	switch action {
+	case "dismiss":
+		if report.AttachmentID != "" {
+			if err := approveAttachment(report.AttachmentID); err != nil {
+				return nil, err
+			}
+		}
+		report.Status = reportDismissed
+	case "delete", "sanction":
+		if report.AttachmentID != "" {
+			if err := removeAttachment(report.AttachmentID); err != nil {
+				return nil, err
+			}
+		} else {
+			if err := messages.Delete(report.MessageID); err != nil && err != ErrMessageNotFound {
+				return nil, err
+			}
+			h.rooms.Broadcast(&message{Type: typeMessageDeleted, Room: report.Room, Ref: report.MessageID, When: time.Now()})
+		}
+		report.Status = reportDeleted
+		if action == "sanction" {
+			if err := banUser(h.rooms, report.SenderID); err != nil {
+				return nil, err
+			}
+			recordAudit(&AuditEntry{Action: auditBan, UserID: moderatorID, Target: report.SenderID,
+				Details: map[string]string{"report_id": report.ID}})
+			report.Status = reportSanctioned
+		}
+	default:
+		return nil, errors.New("chat: 非対応の操作です: " + action)
+	}
+	report.ResolvedBy = moderatorID
+	report.ResolvedAt = time.Now()
+	return report, reports.Update(report)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestModerationUserHandlerHidesSecrets(t *testing.T) {
+	defer func(s UserStore) { users = s }(users)
+	users = newMemoryUserStore()
+	users.Create(&UserRecord{ID: "u1", Name: "Alice", TOTPSecret: "JBSWY3DPEHPK3PXP", TOTPEnabled: true, RecoveryCodes: []string{"hash"}})
+	users.Create(&UserRecord{ID: "mod", Name: "mod", Role: roleModerator})
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/moderation/users/u1/shadowban", nil)
+	r = r.WithContext(withUser(r.Context(), sessionUser{uniqueID: "mod", name: "mod"}))
+	(&moderationUserHandler{rooms: rooms}).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("ステータスコードが不正です: %d", w.Code)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"TOTPSecret", "RecoveryCodes", "Passkeys"} {
+		if _, ok := body[key]; ok {
+			t.Errorf("レスポンスに秘密情報%sが含まれています", key)
+		}
+	}
+	if body["ShadowBanned"] != true {
+		t.Errorf("シャドウバンが反映されていません: %v", body)
+	}
+}
+
+func TestModerationRespectsRoles(t *testing.T) {
+	defer func(s UserStore) { users = s }(users)
+	users = newMemoryUserStore()
+	for _, u := range []*UserRecord{
+		{ID: "user", Name: "User"},
+		{ID: "mod", Name: "Mod", Role: roleModerator},
+		{ID: "mod2", Name: "Mod2", Role: roleModerator},
+		{ID: "admin", Name: "Admin", Role: roleAdmin},
+		{ID: "admin2", Name: "Admin2", Role: roleAdmin},
+	} {
+		users.Create(u)
+	}
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	tests := []struct {
+		caller, target string
+		code           int
+	}{
+		{"mod", "user", http.StatusOK},
+		{"mod", "mod2", http.StatusForbidden},
+		{"mod", "admin", http.StatusForbidden},
+		{"admin", "mod", http.StatusOK},
+		{"admin", "admin2", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/moderation/users/"+test.target+"/ban", nil)
+		r = r.WithContext(withUser(r.Context(), sessionUser{uniqueID: test.caller}))
+		(&moderationUserHandler{rooms: rooms}).ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%sが%sを利用停止: %dになるべきところ%dでした", test.caller, test.target, test.code, w.Code)
+		}
+		if record, _ := users.GetByID(test.target); record.Banned != (test.code == http.StatusOK) {
+			t.Errorf("%sが%sを利用停止: 利用停止の状態が不正です", test.caller, test.target)
+		}
+	}
+
+	// 通報から利用停止にする場合も同じように確認する
+	defer func(s ReportStore) { reports = s }(reports)
+	reports = newMemoryReportStore()
+	reports.Create(&Report{ID: "r1", SenderID: "admin2", Status: reportOpen})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/moderation/reports/r1/sanction", nil)
+	r = r.WithContext(withUser(r.Context(), sessionUser{uniqueID: "mod"}))
+	(&moderationHandler{rooms: rooms}).ServeHTTP(w, r)
+	if report, _ := reports.Get("r1"); w.Code != http.StatusForbidden || report.Status != reportOpen {
+		t.Errorf("モデレーターは通報から管理者を利用停止にできないべきです: %d %s", w.Code, report.Status)
+	}
+}
+
+func TestReportRequiresRoom(t *testing.T) {
+	defer func(s MessageStore) { messages = s }(messages)
+	messages = newMemoryMessageStore()
+	defer func(s ReportStore) { reports = s }(reports)
+	reports = newMemoryReportStore()
+	messages.Save(&message{ID: "here", Room: "general", UserID: "u2", Message: "こんにちは"})
+	messages.Save(&message{ID: "secret", Room: "private", UserID: "u2", Message: "秘密"})
+	if err := sessions.Create(&Session{ID: "report-session", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.Delete("report-session")
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	mux := http.NewServeMux()
+	mux.Handle("/room", MustAuth(rooms))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	c, err := dialRoom(server.URL, url.Values{"room": {"general"}}, authCookie(&fakeUser{id: "u1", name: "アリス"}, "report-session"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if _, err := c.expect(typeWelcome); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ref, want string
+	}{
+		{"secret", typeError},
+		{"missing", typeError},
+		{"here", typeReportReceived},
+	}
+	for _, test := range tests {
+		if err := c.conn.WriteJSON(&message{Type: typeReport, Ref: test.ref, Message: "スパム"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.expect(test.want); err != nil {
+			t.Errorf("%s: %sを返すべきです: %v", test.ref, test.want, err)
+		}
+	}
+	if list, _ := reports.List(reportOpen); len(list) != 1 || list[0].MessageID != "here" {
+		t.Errorf("参加しているルームのメッセージだけを通報できるべきです: %v", list)
+	}
+}
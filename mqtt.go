@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	mqttBroker      = flag.String("mqtt-broker", "", "MQTTブリッジが接続するブローカー (例: tcp://localhost:1883。空の場合は無効)")
+	mqttTopicPrefix = flag.String("mqtt-topic-prefix", "gochat/rooms", "ルームに対応するMQTTのトピックの接頭辞")
+	mqttUsername    = flag.String("mqtt-username", "", "MQTTブローカーのユーザー名")
+	mqttPassword    = flag.String("mqtt-password", "", "MQTTブローカーのパスワード")
+)
+
+// mqttPayload デバイスが{prefix}/{room}/inに送信するメッセージ
+// tokenにはボットトークンまたはchat権限を持つAPIキーを指定する
+type mqttPayload struct {
+	Token   string `json:"token"`
+	Message string `json:"message"`
+}
+
+// mqttBridge ルームとMQTTのトピックを対応付け、低電力のデバイスからチャットに参加できるようにする
+//
+//	{prefix}/{room}/in   デバイスからルームへの投稿 (mqttPayload)
+//	{prefix}/{room}/out  ルームのイベント (コマンドなど)
+type mqttBridge struct {
+	client mqtt.Client
+	prefix string
+	rooms  *roomRegistry
+}
+
+func newMQTTBridge(broker, prefix string, rooms *roomRegistry) (*mqttBridge, error) {
+	b := &mqttBridge{prefix: strings.TrimSuffix(prefix, "/"), rooms: rooms}
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID("gochat-" + randomID()[:8]).
+		SetUsername(*mqttUsername).
+		SetPassword(*mqttPassword).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Println("MQTTブローカーから切断されました:", err)
+		}).
+		// 再接続のたびに購読し直す
+		SetOnConnectHandler(func(c mqtt.Client) {
+			if t := c.Subscribe(b.prefix+"/+/in", 1, b.receive); t.Wait() && t.Error() != nil {
+				log.Println("MQTTのトピックを購読できません:", t.Error())
+			}
+		})
+	b.client = mqtt.NewClient(opts)
+	if t := b.client.Connect(); t.WaitTimeout(10*time.Second) && t.Error() != nil {
+		return nil, t.Error()
+	}
+	return b, nil
+}
+
+// receive デバイスからの投稿を認証してルームに転送する
+// 認証されていない投稿でルームが生成されないように、トークンを検証してから既存のルームを探す
+func (b *mqttBridge) receive(_ mqtt.Client, m mqtt.Message) {
+	var payload mqttPayload
+	if err := json.Unmarshal(m.Payload(), &payload); err != nil || payload.Message == "" {
+		return
+	}
+	user, err := tokenAuth.Authenticate(payload.Token)
+	if err != nil {
+		recordAudit(&AuditEntry{Action: auditAuthFailed, Details: map[string]string{"method": "mqtt", "topic": m.Topic()}})
+		return
+	}
+	if scoped, ok := user.(apiKeyUser); ok && !scoped.HasScope(scopeChat) {
+		return
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(m.Topic(), b.prefix+"/"), "/in")
+	r, err := b.rooms.existing(name)
+	if err != nil {
+		return
+	}
+	if isBanned(user.UniqueID()) || !r.canPost(user.UniqueID()) {
+		return
+	}
+	msg := &message{
+		ID:        randomID(),
+		Room:      r.name,
+		UserID:    user.UniqueID(),
+		Name:      user.Name(),
+		AvatarURL: user.AvatarURL(),
+		Message:   payload.Message,
+		When:      time.Now(),
+	}
+	if err := runMessageHooks(msg); err != nil {
+		return
+	}
+	r.Broadcast(msg)
+}
+
+// publish ルームのイベントを{prefix}/{room}/outに送信する
+func (b *mqttBridge) publish(msg *message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	// 送信の完了は待たずにルームの処理を続ける
+	b.client.Publish(b.prefix+"/"+msg.Room+"/out", 0, false, data)
+}
+
+func (b *mqttBridge) Close() {
+	b.client.Disconnect(250)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeMQTTMessage テスト用のmqtt.Message
+type fakeMQTTMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m fakeMQTTMessage) Duplicate() bool   { return false }
+func (m fakeMQTTMessage) Qos() byte         { return 1 }
+func (m fakeMQTTMessage) Retained() bool    { return false }
+func (m fakeMQTTMessage) Topic() string     { return m.topic }
+func (m fakeMQTTMessage) MessageID() uint16 { return 0 }
+func (m fakeMQTTMessage) Payload() []byte   { return m.payload }
+func (m fakeMQTTMessage) Ack()              {}
+
+func TestMQTTBridgeReceive(t *testing.T) {
+	defer func(a TokenAuthenticator) { tokenAuth = a }(tokenAuth)
+	bots, err := parseBotTokens("sensor:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenAuth = TryTokenAuthenticators{bots}
+	defer func(s RoomStore) { roomInfos = s }(roomInfos)
+	roomInfos = newMemoryRoomStore()
+	roomInfos.Save(&RoomInfo{Name: "devices", UpdatedAt: time.Now()})
+	defer func(b *eventBus) { events = b }(events)
+	events = newEventBus()
+	received := make(chan *message, 1)
+	events.Subscribe(EventMessageBroadcast, func(e Event) { received <- e.Message })
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	b := &mqttBridge{prefix: "gochat/rooms", rooms: rooms}
+
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+	}{
+		{"無効なトークン", "gochat/rooms/devices/in", `{"token":"wrong","message":"温度: 21℃"}`},
+		{"存在しないルーム", "gochat/rooms/spam/in", `{"token":"secret","message":"温度: 21℃"}`},
+		{"未認証で存在しないルーム", "gochat/rooms/spam2/in", `{"token":"wrong","message":"温度: 21℃"}`},
+	}
+	for _, tt := range tests {
+		b.receive(nil, fakeMQTTMessage{topic: tt.topic, payload: []byte(tt.payload)})
+		select {
+		case msg := <-received:
+			t.Errorf("%s: 投稿を転送するべきではありません: %+v", tt.name, msg)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	for _, name := range []string{"spam", "spam2"} {
+		if _, ok := rooms.lookup(name); ok {
+			t.Errorf("MQTTの投稿でルーム%sを生成するべきではありません", name)
+		}
+	}
+
+	b.receive(nil, fakeMQTTMessage{topic: "gochat/rooms/devices/in", payload: []byte(`{"token":"secret","message":"温度: 21℃"}`)})
+	select {
+	case msg := <-received:
+		if msg.Room != "devices" || msg.Message != "温度: 21℃" || msg.Name != "sensor" {
+			t.Errorf("認証したデバイスの投稿をルームに転送するべきです: %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("認証したデバイスの投稿をルームに転送するべきです")
+	}
+}
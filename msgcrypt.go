@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	messageKeys = flag.String("message-keys", "", "メッセージの本文を暗号化する鍵 (鍵ID:base64の32バイト をカンマ区切り。先頭が新しいメッセージに使う鍵で、残りは復号のみに使う)")
+	messageKMS  = flag.String("message-kms", "", "メッセージの鍵を包むVaultのTransitの鍵 (例: vault-transit://vault:8200/gochat。トークンはVAULT_TOKEN)")
+)
+
+// sealedPrefix 暗号化したメッセージの本文の接頭辞
+// 接頭辞のない本文は暗号化を有効にする前に保存されたものとしてそのまま返す
+const sealedPrefix = "gochat:enc:v1:"
+
+var (
+	// ErrInvalidMessageKey メッセージの鍵の指定が不正な場合に発生するエラー
+	ErrInvalidMessageKey = errors.New("chat: メッセージの暗号化の鍵が不正です。")
+	// ErrUnknownMessageKey 復号に必要な鍵が設定されていない場合に発生するエラー
+	ErrUnknownMessageKey = errors.New("chat: メッセージを暗号化した鍵が見つかりません。")
+	// ErrSealedMessage 暗号化されたメッセージの本文が壊れている場合に発生するエラー
+	ErrSealedMessage = errors.New("chat: 暗号化されたメッセージを復号できません。")
+)
+
+// KeyWrapper メッセージごとのデータ鍵をマスター鍵で包む (エンベロープ暗号化)
+// マスター鍵を入れ替えても、古い鍵IDで包んだデータ鍵を復号できる限り過去のメッセージを読める
+type KeyWrapper interface {
+	Wrap(dek []byte) (keyID string, wrapped []byte, err error)
+	Unwrap(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// localKeyring 設定で与えられたAES-256の鍵でデータ鍵を包むKeyWrapper
+type localKeyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// parseKeyring "鍵ID:base64"のカンマ区切りを解析する。先頭の鍵で新しいデータ鍵を包む
+func parseKeyring(spec string) (*localKeyring, error) {
+	k := &localKeyring{keys: make(map[string]cipher.AEAD)}
+	for _, entry := range strings.Split(spec, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" || strings.ContainsAny(id, ":.") {
+			return nil, ErrInvalidMessageKey
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, ErrInvalidMessageKey
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		if k.current == "" {
+			k.current = id
+		}
+		k.keys[id] = aead
+	}
+	return k, nil
+}
+
+func (k *localKeyring) Wrap(dek []byte) (string, []byte, error) {
+	sealed, err := sealAEAD(k.keys[k.current], dek, []byte(k.current))
+	return k.current, sealed, err
+}
+
+func (k *localKeyring) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, ErrUnknownMessageKey
+	}
+	return openAEAD(aead, wrapped, []byte(keyID))
+}
+
+// vaultTransit VaultのTransitシークレットエンジンでデータ鍵を包むKeyWrapper
+// 鍵の入れ替えはVault側で行い、暗号文に含まれるバージョンで復号される
+type vaultTransit struct {
+	addr   string
+	key    string
+	token  string
+	client *http.Client
+}
+
+// newVaultTransit vault-transit://host:port/鍵の名前 の形式から生成する
+// VAULT_ADDRが設定されている場合は接続先をそちらに置き換える
+func newVaultTransit(spec string) (*vaultTransit, error) {
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme != "vault-transit" || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, ErrInvalidMessageKey
+	}
+	addr := "https://" + u.Host
+	if env := os.Getenv("VAULT_ADDR"); env != "" {
+		addr = strings.TrimSuffix(env, "/")
+	}
+	return &vaultTransit{
+		addr:   addr,
+		key:    strings.Trim(u.Path, "/"),
+		token:  os.Getenv("VAULT_TOKEN"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (v *vaultTransit) Wrap(dek []byte) (string, []byte, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	err := v.call("encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dek)}, &resp)
+	return v.key, []byte(resp.Data.Ciphertext), err
+}
+
+func (v *vaultTransit) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := v.call("decrypt", map[string]string{"ciphertext": string(wrapped)}, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+}
+
+func (v *vaultTransit) call(op string, body interface{}, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, v.addr+"/v1/transit/"+op+"/"+url.PathEscape(v.key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("chat: Vaultの%sに失敗しました (status %d)", op, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// newKeyWrapper フラグの設定に従ってKeyWrapperを生成する。暗号化しない場合はnilを返す
+func newKeyWrapper(keys, kms string) (KeyWrapper, error) {
+	switch {
+	case kms != "":
+		return newVaultTransit(kms)
+	case keys != "":
+		return parseKeyring(keys)
+	}
+	return nil, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealAEAD ランダムなノンスで暗号化し、ノンスを先頭に付けて返す
+func sealAEAD(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// openAEAD sealAEADで暗号化した内容を復号する
+func openAEAD(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrSealedMessage
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+	if err != nil {
+		return nil, ErrSealedMessage
+	}
+	return plaintext, nil
+}
+
+// encryptedMessageStore メッセージの本文を暗号化して保存するMessageStore
+// メッセージごとにデータ鍵を生成し、KeyWrapperで包んで本文と一緒に保存する
+type encryptedMessageStore struct {
+	store MessageStore
+	keys  KeyWrapper
+}
+
+func newEncryptedMessageStore(store MessageStore, keys KeyWrapper) *encryptedMessageStore {
+	return &encryptedMessageStore{store: store, keys: keys}
+}
+
+// sealText 本文を暗号化する
+// メッセージIDを追加データにして、暗号文を他のメッセージに付け替えられないようにする
+func (s *encryptedMessageStore) sealText(id, text string) (string, error) {
+	return sealString(s.keys, id, text)
+}
+
+// openText sealTextで暗号化した本文を復号する。暗号化されていない本文はそのまま返す
+func (s *encryptedMessageStore) openText(id, text string) (string, error) {
+	return openString(s.keys, id, text)
+}
+
+// sealString データ鍵を生成して文字列を暗号化する
+// 形式: 接頭辞 鍵ID "." 包んだデータ鍵 "." 暗号文 (いずれもbase64)
+func sealString(keys KeyWrapper, additional, text string) (string, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return "", err
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := sealAEAD(aead, []byte(text), []byte(additional))
+	if err != nil {
+		return "", err
+	}
+	keyID, wrapped, err := keys.Wrap(dek)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return sealedPrefix + keyID + "." + enc.EncodeToString(wrapped) + "." + enc.EncodeToString(ciphertext), nil
+}
+
+// openString sealStringで暗号化した文字列を復号する。暗号化されていない文字列はそのまま返す
+func openString(keys KeyWrapper, additional, text string) (string, error) {
+	body, ok := strings.CutPrefix(text, sealedPrefix)
+	if !ok {
+		return text, nil
+	}
+	parts := strings.Split(body, ".")
+	if len(parts) != 3 {
+		return "", ErrSealedMessage
+	}
+	enc := base64.RawURLEncoding
+	wrapped, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrSealedMessage
+	}
+	ciphertext, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrSealedMessage
+	}
+	dek, err := keys.Unwrap(parts[0], wrapped)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return "", ErrSealedMessage
+	}
+	plaintext, err := openAEAD(aead, ciphertext, []byte(additional))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// sealed 本文を暗号化した複製を返す。呼び出し元のメッセージは配信中のため変更しない
+func (s *encryptedMessageStore) sealed(m *message) (*message, error) {
+	text, err := s.sealText(m.ID, m.Message)
+	if err != nil {
+		return nil, err
+	}
+	copied := *m
+	copied.Message = text
+	copied.prepared = nil
+	return &copied, nil
+}
+
+func (s *encryptedMessageStore) opened(m *message) (*message, error) {
+	text, err := s.openText(m.ID, m.Message)
+	if err != nil {
+		return nil, err
+	}
+	m.Message = text
+	return m, nil
+}
+
+func (s *encryptedMessageStore) Save(m *message) error {
+	sealed, err := s.sealed(m)
+	if err != nil {
+		return err
+	}
+	return s.store.Save(sealed)
+}
+
+func (s *encryptedMessageStore) Get(id string) (*message, error) {
+	m, err := s.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.opened(m)
+}
+
+func (s *encryptedMessageStore) ListByUser(userID string) ([]*message, error) {
+	list, err := s.store.ListByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range list {
+		if _, err := s.opened(m); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// Update 現在の鍵で暗号化し直して保存する。古い鍵で暗号化されたメッセージも更新時に入れ替わる
+func (s *encryptedMessageStore) Update(m *message) error {
+	sealed, err := s.sealed(m)
+	if err != nil {
+		return err
+	}
+	return s.store.Update(sealed)
+}
+
+func (s *encryptedMessageStore) Delete(id string) error {
+	return s.store.Delete(id)
+}
+
+func (s *encryptedMessageStore) DeleteByRoom(room string) (int, error) {
+	return s.store.DeleteByRoom(room)
+}
+
+func (s *encryptedMessageStore) Each(fn func(m *message) error) error {
+	return s.store.Each(func(m *message) error {
+		if _, err := s.opened(m); err != nil {
+			return err
+		}
+		return fn(m)
+	})
+}
+
+func (s *encryptedMessageStore) Around(id string, n int) ([]*message, error) {
+	list, err := s.store.Around(id, n)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range list {
+		if _, err := s.opened(m); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
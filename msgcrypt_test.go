@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestEncryptedMessageStore(t *testing.T) {
+	keys, err := parseKeyring("k1:" + testKey('a'))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := newMemoryMessageStore()
+	s := newEncryptedMessageStore(raw, keys)
+	msg := &message{ID: "m1", UserID: "u1", Message: "秘密のメッセージ"}
+	if err := s.Save(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Message != "秘密のメッセージ" {
+		t.Error("保存したメッセージの本文を書き換えるべきではありません")
+	}
+	stored, _ := raw.Get("m1")
+	if !strings.HasPrefix(stored.Message, sealedPrefix) || strings.Contains(stored.Message, "秘密") {
+		t.Errorf("本文は暗号化して保存するべきです: %s", stored.Message)
+	}
+	got, err := s.Get("m1")
+	if err != nil || got.Message != "秘密のメッセージ" {
+		t.Errorf("復号した本文が一致しません: %v %v", got, err)
+	}
+
+	// 新しい鍵を先頭に追加しても古い鍵で暗号化したメッセージを読める
+	s.keys, _ = parseKeyring("k2:" + testKey('b') + ",k1:" + testKey('a'))
+	if err := s.Save(&message{ID: "m2", UserID: "u1", Message: "新しい鍵"}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.ListByUser("u1")
+	if err != nil || len(list) != 2 || list[0].Message != "秘密のメッセージ" || list[1].Message != "新しい鍵" {
+		t.Fatalf("鍵を入れ替えた後も両方のメッセージを読めるべきです: %v", err)
+	}
+	if stored, _ := raw.Get("m2"); !strings.HasPrefix(stored.Message, sealedPrefix+"k2.") {
+		t.Errorf("新しいメッセージは現在の鍵で暗号化するべきです: %s", stored.Message)
+	}
+
+	// 古い鍵を外すと、その鍵で暗号化したメッセージは読めない
+	s.keys, _ = parseKeyring("k2:" + testKey('b'))
+	if _, err := s.Get("m1"); err != ErrUnknownMessageKey {
+		t.Errorf("鍵がない場合はErrUnknownMessageKeyを返すべきです: %v", err)
+	}
+}
+
+func TestEncryptedMessageStoreTampering(t *testing.T) {
+	keys, _ := parseKeyring("k1:" + testKey('a'))
+	raw := newMemoryMessageStore()
+	s := newEncryptedMessageStore(raw, keys)
+	s.Save(&message{ID: "m1", Message: "one"})
+	s.Save(&message{ID: "m2", Message: "two"})
+	// 暗号文を別のメッセージに付け替えても復号できない
+	m1, _ := raw.Get("m1")
+	m2, _ := raw.Get("m2")
+	m2.Message = m1.Message
+	raw.Update(m2)
+	if _, err := s.Get("m2"); err != ErrSealedMessage {
+		t.Errorf("付け替えた暗号文は復号できないべきです: %v", err)
+	}
+	// 暗号化を有効にする前の本文はそのまま読める
+	raw.Save(&message{ID: "m3", Message: "plain"})
+	if m, err := s.Get("m3"); err != nil || m.Message != "plain" {
+		t.Error("暗号化されていない本文はそのまま返すべきです")
+	}
+}
+
+func TestParseKeyringInvalid(t *testing.T) {
+	for _, spec := range []string{"", "k1", "k1:short", "k:1:" + testKey('a'), ":" + testKey('a')} {
+		if _, err := parseKeyring(spec); err != ErrInvalidMessageKey {
+			t.Errorf("%q: ErrInvalidMessageKeyを返すべきです", spec)
+		}
+	}
+}
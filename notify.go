@@ -0,0 +1,19 @@
+package main
+
+// systemName システムからのメッセージの送信者名
+const systemName = "システム"
+
+// Notifier ユーザーにお知らせを届ける
+type Notifier interface {
+	// Notify 指定されたユーザーにお知らせを送信する
+	Notify(userID, text string)
+	// NotifyEvent msg.UserIDのユーザーにお知らせのイベントを送信する
+	NotifyEvent(msg *message)
+}
+
+// nopNotifier 何もしないNotifier
+type nopNotifier struct{}
+
+func (nopNotifier) Notify(userID, text string) {}
+
+func (nopNotifier) NotifyEvent(msg *message) {}
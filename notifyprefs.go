@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 通知の対象にするメッセージの範囲
+const (
+	notifyAll      = "all"
+	notifyMentions = "mentions"
+	notifyNothing  = "nothing"
+)
+
+// ErrInvalidNotificationPrefs 通知の設定が不正な場合に発生するエラー
+var ErrInvalidNotificationPrefs = errors.New("chat: 通知の設定が不正です。levelにはall、mentions、nothingのいずれかを、静かな時間帯にはHH:MM形式の時刻とタイムゾーンを指定してください。")
+
+// QuietHours メールとプッシュ通知を送らない時間帯
+// StartがEndより後の場合は日をまたぐ時間帯とみなす
+type QuietHours struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	TimeZone string `json:"time_zone,omitempty"`
+}
+
+// contains 時刻が静かな時間帯に含まれるかどうかを判定する
+func (q *QuietHours) contains(now time.Time) bool {
+	loc, err := time.LoadLocation(q.TimeZone)
+	if err != nil {
+		return false
+	}
+	start, err1 := time.Parse("15:04", q.Start)
+	end, err2 := time.Parse("15:04", q.End)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	from, to := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// NotificationPrefs ユーザーごとの通知の設定
+type NotificationPrefs struct {
+	// Levelは既定で通知するメッセージの範囲。Roomsでルームごとに上書きできる
+	Level string            `json:"level"`
+	Rooms map[string]string `json:"rooms,omitempty"`
+	// QuietHoursの間はセキュリティに関するもの以外のメールとプッシュ通知を送らない
+	QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+	// EmailとPushは通知に使う手段。チャット内のお知らせは常に送る
+	Email bool `json:"email"`
+	Push  bool `json:"push"`
+}
+
+// defaultNotificationPrefs 設定を保存していないユーザーの通知の設定
+func defaultNotificationPrefs() *NotificationPrefs {
+	return &NotificationPrefs{Level: notifyAll, Push: true}
+}
+
+func validNotifyLevel(level string) bool {
+	return level == notifyAll || level == notifyMentions || level == notifyNothing
+}
+
+// validate 範囲と静かな時間帯の指定を検証する
+func (p *NotificationPrefs) validate() error {
+	if !validNotifyLevel(p.Level) {
+		return ErrInvalidNotificationPrefs
+	}
+	for room, level := range p.Rooms {
+		if !validRoomName(room) || !validNotifyLevel(level) {
+			return ErrInvalidNotificationPrefs
+		}
+	}
+	if q := p.QuietHours; q != nil {
+		if _, err := time.Parse("15:04", q.Start); err != nil {
+			return ErrInvalidNotificationPrefs
+		}
+		if _, err := time.Parse("15:04", q.End); err != nil {
+			return ErrInvalidNotificationPrefs
+		}
+		if _, err := time.LoadLocation(q.TimeZone); err != nil {
+			return ErrInvalidNotificationPrefs
+		}
+	}
+	return nil
+}
+
+// level ルームで通知するメッセージの範囲を返す
+func (p *NotificationPrefs) level(room string) string {
+	if level, ok := p.Rooms[room]; ok {
+		return level
+	}
+	return p.Level
+}
+
+// NotificationPrefsStore 通知の設定を保存する
+type NotificationPrefsStore interface {
+	// Get ユーザーの通知の設定を返す。保存されていない場合は既定の設定を返す
+	Get(userID string) (*NotificationPrefs, error)
+	Save(userID string, p *NotificationPrefs) error
+	Delete(userID string) error
+}
+
+// memoryNotificationPrefsStore メモリ上に通知の設定を保持するNotificationPrefsStore
+type memoryNotificationPrefsStore struct {
+	mu    sync.RWMutex
+	prefs map[string]*NotificationPrefs
+}
+
+func newMemoryNotificationPrefsStore() *memoryNotificationPrefsStore {
+	return &memoryNotificationPrefsStore{prefs: make(map[string]*NotificationPrefs)}
+}
+
+func (s *memoryNotificationPrefsStore) Get(userID string) (*NotificationPrefs, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.prefs[userID]
+	if !ok {
+		return defaultNotificationPrefs(), nil
+	}
+	copied := *p
+	return &copied, nil
+}
+
+func (s *memoryNotificationPrefsStore) Save(userID string, p *NotificationPrefs) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *p
+	s.prefs[userID] = &stored
+	return nil
+}
+
+func (s *memoryNotificationPrefsStore) Delete(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.prefs, userID)
+	return nil
+}
+
+// Pusher ユーザーの端末にプッシュ通知を送信する
+type Pusher interface {
+	Push(userID, text string) error
+}
+
+// nopPusher 何も送信しないPusher
+type nopPusher struct{}
+
+func (nopPusher) Push(userID, text string) error { return nil }
+
+// notification 通知の1件
+type notification struct {
+	UserID string
+	// Textはチャット内のお知らせとプッシュ通知の本文
+	Text string
+	// Subjectとbodyはメールの件名と本文。Bodyが空の場合はTextを使う
+	Subject string
+	Body    string
+	// Roomが指定されている場合はルームのメッセージについての通知として範囲の設定に従う
+	// Mentionは本人宛てのメッセージかどうか
+	Room    string
+	Mention bool
+	// Securityが真の場合は範囲と静かな時間帯の設定に関わらず送る
+	Security bool
+	// Eventが指定されている場合は、チャット内のお知らせとしてTextの代わりにこのイベントを送る
+	Event *message
+}
+
+// notify ユーザーの通知の設定に従って通知を送る
+// チャット内のお知らせは範囲の設定だけに従い、メールとプッシュ通知は手段と静かな時間帯の設定、取り込み中の状態にも従う
+func notify(n notification, now time.Time) {
+	prefs, err := notificationPrefs.Get(n.UserID)
+	if err != nil {
+		prefs = defaultNotificationPrefs()
+	}
+	if !n.Security && n.Room != "" {
+		switch prefs.level(n.Room) {
+		case notifyNothing:
+			return
+		case notifyMentions:
+			if !n.Mention {
+				return
+			}
+		}
+	}
+	if n.Event != nil {
+		notifier.NotifyEvent(n.Event)
+	} else {
+		notifier.Notify(n.UserID, n.Text)
+	}
+	if !n.Security && (doNotDisturb(n.UserID) || (prefs.QuietHours != nil && prefs.QuietHours.contains(now))) {
+		return
+	}
+	if prefs.Push || n.Security {
+		if err := pusher.Push(n.UserID, n.Text); err != nil {
+			log.Println("プッシュ通知を送信できませんでした:", n.UserID, "-", err)
+		}
+	}
+	if (prefs.Email || n.Security) && n.Subject != "" {
+		record, err := users.GetByID(n.UserID)
+		if err != nil || record.Email == "" {
+			return
+		}
+		body := n.Body
+		if body == "" {
+			body = n.Text
+		}
+		if err := mailer.Send(record.Email, n.Subject, body); err != nil {
+			log.Println("通知のメールを送信できませんでした:", n.UserID, "-", err)
+		}
+	}
+}
+
+// notificationPrefsHandler 自分の通知の設定のAPI
+// GET /api/me/notifications  設定を返す
+// PUT /api/me/notifications  JSONで設定を置き換える
+func notificationPrefsHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	switch r.Method {
+	case http.MethodGet:
+		prefs, err := notificationPrefs.Get(user.UniqueID())
+		if err != nil {
+			requestLogger(r).Println("通知の設定を取得できませんでした:", err)
+			writeJSONError(w, r, "通知の設定を取得できませんでした", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, prefs)
+	case http.MethodPut:
+		var prefs NotificationPrefs
+		if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+			writeJSONError(w, r, "通知の設定の形式が不正です", http.StatusBadRequest)
+			return
+		}
+		if err := prefs.validate(); err != nil {
+			writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := notificationPrefs.Save(user.UniqueID(), &prefs); err != nil {
+			requestLogger(r).Println("通知の設定を保存できませんでした:", err)
+			writeJSONError(w, r, "通知の設定を保存できませんでした", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, &prefs)
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
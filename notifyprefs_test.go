@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// recordingNotifier 送信したお知らせを記録するNotifier
+type recordingNotifier []string
+
+func (n *recordingNotifier) Notify(userID, text string) { *n = append(*n, userID+":"+text) }
+
+func (n *recordingNotifier) NotifyEvent(msg *message) { *n = append(*n, msg.UserID+":"+msg.Type) }
+
+// recordingPusher 送信したプッシュ通知を記録するPusher
+type recordingPusher []string
+
+func (p *recordingPusher) Push(userID, text string) error {
+	*p = append(*p, userID+":"+text)
+	return nil
+}
+
+func TestNotify(t *testing.T) {
+	defer func(n Notifier, p Pusher, s NotificationPrefsStore) { notifier, pusher, notificationPrefs = n, p, s }(notifier, pusher, notificationPrefs)
+	var sent recordingNotifier
+	var pushed recordingPusher
+	notifier, pusher, notificationPrefs = &sent, &pushed, newMemoryNotificationPrefsStore()
+	notificationPrefs.Save("u1", &NotificationPrefs{
+		Level:      notifyMentions,
+		Rooms:      map[string]string{"random": notifyNothing},
+		QuietHours: &QuietHours{Start: "22:00", End: "07:00", TimeZone: "UTC"},
+		Push:       true,
+	})
+	noon := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	night := time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)
+
+	notify(notification{UserID: "u1", Text: "a", Room: "general"}, noon)
+	notify(notification{UserID: "u1", Text: "b", Room: "random", Mention: true}, noon)
+	if len(sent) != 0 {
+		t.Errorf("範囲外のメッセージは通知しないべきです: %v", sent)
+	}
+	notify(notification{UserID: "u1", Text: "c", Room: "general", Mention: true}, noon)
+	if len(sent) != 1 || len(pushed) != 1 {
+		t.Errorf("本人宛てのメッセージは通知するべきです: %v, %v", sent, pushed)
+	}
+	notify(notification{UserID: "u1", Text: "d", Room: "general", Mention: true}, night)
+	if len(sent) != 2 || len(pushed) != 1 {
+		t.Errorf("静かな時間帯はチャット内のお知らせだけを送るべきです: %v, %v", sent, pushed)
+	}
+	notify(notification{UserID: "u1", Text: "e", Security: true}, night)
+	if len(pushed) != 2 {
+		t.Errorf("セキュリティに関する通知は静かな時間帯でも送るべきです: %v", pushed)
+	}
+}
+
+func TestNotificationPrefsValidate(t *testing.T) {
+	for _, p := range []NotificationPrefs{
+		{Level: "some"},
+		{Level: notifyAll, Rooms: map[string]string{"general": "loud"}},
+		{Level: notifyAll, QuietHours: &QuietHours{Start: "25:00", End: "07:00", TimeZone: "UTC"}},
+	} {
+		if err := p.validate(); err != ErrInvalidNotificationPrefs {
+			t.Errorf("%+vは不正な設定とみなすべきです: %v", p, err)
+		}
+	}
+}
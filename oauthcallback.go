@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/url"
+	"strings"
+
+	"github.com/stretchr/gomniauth"
+	"github.com/stretchr/gomniauth/common"
+	"github.com/stretchr/gomniauth/providers/facebook"
+	"github.com/stretchr/gomniauth/providers/github"
+	"github.com/stretchr/gomniauth/providers/google"
+)
+
+var externalURLs = flag.String("external-url", "", "OAuthのコールバックに使用する外部からのURL (例: https://chat.example.com。複数のドメインで提供する場合はカンマ区切り。空の場合はリクエストのホストから求める)")
+
+// ErrCallbackHost コールバックに使用できないホストへのリクエストの場合に発生するエラー
+var ErrCallbackHost = errors.New("chat: このホストではOAuthのログインを利用できません。")
+
+// ErrInvalidExternalURL -external-urlの形式が正しくない場合に発生するエラー
+var ErrInvalidExternalURL = errors.New("chat: -external-urlにはスキームとホストを含むURLを指定してください。")
+
+// oauthCallbackPath 認証プロバイダーからのコールバックのパス。{provider}はプロバイダー名に置き換える
+const oauthCallbackPath = "/auth/callback/{provider}"
+
+// providerFactory コールバックのURLを指定して認証プロバイダーを生成する
+type providerFactory func(callbackURL string) common.Provider
+
+// oauthProviders コールバックのURLごとに認証プロバイダーを保持する
+// gomniauthのプロバイダーは生成時にコールバックのURLが決まるため、-external-urlのホストごとに生成しておく
+type oauthProviders struct {
+	factories map[string]providerFactory
+	// allowedは許可する外部からのURL(スキームとホスト)。空の場合はリクエストのホストを使う
+	allowed []string
+	// builtは-external-urlのホストごとに生成したプロバイダー。生成後は変更しない
+	built map[string]common.Provider
+}
+
+func newOAuthProviders(externalURLs string, factories map[string]providerFactory) (*oauthProviders, error) {
+	p := &oauthProviders{factories: factories, built: make(map[string]common.Provider)}
+	for _, s := range strings.Split(externalURLs, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, ErrInvalidExternalURL
+		}
+		p.allowed = append(p.allowed, u.Scheme+"://"+strings.ToLower(u.Host))
+	}
+	for _, base := range p.allowed {
+		for name, factory := range p.factories {
+			callback := callbackURL(base, name)
+			p.built[callback] = factory(callback)
+		}
+	}
+	return p, nil
+}
+
+// callbackURL 外部からのURLとプロバイダー名からコールバックのURLを返す
+func callbackURL(base, name string) string {
+	return base + strings.Replace(oauthCallbackPath, "{provider}", name, 1)
+}
+
+// baseURL リクエストに対応する外部からのURLを返す
+// -external-urlが指定された場合は、そのいずれかのホストへのリクエストだけを受け付ける
+func (p *oauthProviders) baseURL(scheme, host string) (string, error) {
+	host = strings.ToLower(host)
+	if len(p.allowed) == 0 {
+		if host == "" {
+			return "", ErrCallbackHost
+		}
+		return scheme + "://" + host, nil
+	}
+	for _, base := range p.allowed {
+		if strings.HasSuffix(base, "://"+host) {
+			return base, nil
+		}
+	}
+	return "", ErrCallbackHost
+}
+
+// get リクエストのホストに対応するコールバックのURLを持つ認証プロバイダーを返す
+// -external-urlが指定されていない場合は、任意のホストのプロバイダーが溜まらないようにリクエストごとに生成する
+func (p *oauthProviders) get(scheme, host, name string) (common.Provider, error) {
+	factory, ok := p.factories[name]
+	if !ok {
+		// gomniauthと同じエラーを返す
+		return gomniauth.Provider(name)
+	}
+	base, err := p.baseURL(scheme, host)
+	if err != nil {
+		return nil, err
+	}
+	callback := callbackURL(base, name)
+	if provider, ok := p.built[callback]; ok {
+		return provider, nil
+	}
+	return factory(callback), nil
+}
+
+// defaultProviders 最初の-external-url(未指定の場合はlocalhost)をコールバックとするプロバイダー
+// gomniauthに登録し、ホストに依存しない処理で使用する
+func (p *oauthProviders) defaultProviders() []common.Provider {
+	base := "http://localhost:8080"
+	if len(p.allowed) > 0 {
+		base = p.allowed[0]
+	}
+	var providers []common.Provider
+	for name := range p.factories {
+		scheme, host, _ := strings.Cut(base, "://")
+		if provider, err := p.get(scheme, host, name); err == nil {
+			providers = append(providers, provider)
+		}
+	}
+	return providers
+}
+
+// enabled 設定された認証プロバイダーの名前を返す。テンプレートでログインの選択肢の表示に使う
+func (p *oauthProviders) enabled() map[string]bool {
+	names := make(map[string]bool)
+	for name := range p.factories {
+		names[name] = true
+	}
+	return names
+}
+
+// providerFactories フラグで設定された認証プロバイダーを返す
+func providerFactories() map[string]providerFactory {
+	factories := map[string]providerFactory{
+		"google": func(callbackURL string) common.Provider {
+			return google.New(*googleClientID, *googleClientSecret, callbackURL)
+		},
+	}
+	if *githubClientID != "" {
+		factories["github"] = func(callbackURL string) common.Provider {
+			return github.New(*githubClientID, *githubClientSecret, callbackURL)
+		}
+	}
+	if *facebookClientID != "" {
+		factories["facebook"] = func(callbackURL string) common.Provider {
+			return facebook.New(*facebookClientID, *facebookClientSecret, callbackURL)
+		}
+	}
+	return factories
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/gomniauth/common"
+)
+
+// callbackProvider コールバックのURLを記録するだけの認証プロバイダー
+type callbackProvider struct {
+	common.Provider
+	callback string
+}
+
+func TestOAuthProvidersCallback(t *testing.T) {
+	factories := map[string]providerFactory{"google": func(callback string) common.Provider {
+		return &callbackProvider{callback: callback}
+	}}
+	p, err := newOAuthProviders("https://chat.example.com, https://chat.example.org", factories)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := p.get("http", "Chat.Example.org", "google")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := provider.(*callbackProvider).callback; got != "https://chat.example.org/auth/callback/google" {
+		t.Errorf("設定したURLのスキームを使うべきです: %s", got)
+	}
+	if again, _ := p.get("https", "chat.example.org", "google"); again != provider {
+		t.Error("同じホストには同じプロバイダーを返すべきです")
+	}
+	if _, err := p.get("https", "evil.example.net", "google"); err != ErrCallbackHost {
+		t.Errorf("許可していないホストは拒否するべきです: %v", err)
+	}
+
+	open, _ := newOAuthProviders("", factories)
+	provider, err = open.get("https", "localhost:8443", "google")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := provider.(*callbackProvider).callback; got != "https://localhost:8443/auth/callback/google" {
+		t.Errorf("未設定の場合はリクエストのホストを使うべきです: %s", got)
+	}
+	for _, host := range []string{"a.example.net", "b.example.net"} {
+		open.get("https", host, "google")
+	}
+	if len(open.built) != 0 {
+		t.Errorf("未設定の場合はリクエストのホストのプロバイダーを保持するべきではありません: %d", len(open.built))
+	}
+	if len(p.built) != 2 {
+		t.Errorf("設定したホストの分だけプロバイダーを生成するべきです: %d", len(p.built))
+	}
+	if _, err := newOAuthProviders("chat.example.com", factories); err != ErrInvalidExternalURL {
+		t.Errorf("スキームのないURLは拒否するべきです: %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gomniauthcommon "github.com/stretchr/gomniauth/common"
+)
+
+// tokenRefreshMargin 期限までの残りがこの時間を切ったアクセストークンは更新してから使う
+const tokenRefreshMargin = time.Minute
+
+var (
+	// ErrOAuthTokenNotFound ユーザーの認証プロバイダーのトークンが保存されていない場合に発生するエラー
+	ErrOAuthTokenNotFound = errors.New("chat: 認証プロバイダーのトークンが保存されていません。もう一度ログインしてください。")
+	// ErrOAuthTokenExpired アクセストークンの期限が切れ、更新もできない場合に発生するエラー
+	ErrOAuthTokenExpired = errors.New("chat: 認証プロバイダーのトークンの期限が切れています。もう一度ログインしてください。")
+)
+
+// OAuthToken ログイン時に認証プロバイダーから取得したトークン
+// ログイン後にプロバイダーのAPI(連絡先の取り込みなど)を呼び出すために保存する
+type OAuthToken struct {
+	UserID       string
+	Provider     string
+	AccessToken  string
+	RefreshToken string
+	TokenType    string
+	// Expiryはアクセストークンの期限。ゼロ値の場合は期限なし
+	Expiry    time.Time
+	UpdatedAt time.Time
+}
+
+// expired 期限が近い、または切れているかどうかを返す
+func (t *OAuthToken) expired(now time.Time) bool {
+	return !t.Expiry.IsZero() && now.Add(tokenRefreshMargin).After(t.Expiry)
+}
+
+// OAuthTokenStore 認証プロバイダーのトークンを保存する
+type OAuthTokenStore interface {
+	// Save トークンを保存する。同じユーザーとプロバイダーのトークンは置き換える
+	Save(t *OAuthToken) error
+	// Get トークンを取得する
+	// *見つからない場合にはErrOAuthTokenNotFoundを返す
+	Get(userID, provider string) (*OAuthToken, error)
+	// DeleteByUser ユーザーのすべてのトークンを削除する
+	DeleteByUser(userID string) error
+}
+
+// memoryOAuthTokenStore メモリ上にトークンを保持するOAuthTokenStore
+type memoryOAuthTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*OAuthToken
+}
+
+func newMemoryOAuthTokenStore() *memoryOAuthTokenStore {
+	return &memoryOAuthTokenStore{tokens: make(map[string]*OAuthToken)}
+}
+
+func (s *memoryOAuthTokenStore) Save(t *OAuthToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *t
+	s.tokens[t.UserID+"\x00"+t.Provider] = &stored
+	return nil
+}
+
+func (s *memoryOAuthTokenStore) Get(userID, provider string) (*OAuthToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[userID+"\x00"+provider]
+	if !ok {
+		return nil, ErrOAuthTokenNotFound
+	}
+	copied := *t
+	return &copied, nil
+}
+
+func (s *memoryOAuthTokenStore) DeleteByUser(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, t := range s.tokens {
+		if t.UserID == userID {
+			delete(s.tokens, key)
+		}
+	}
+	return nil
+}
+
+// nopOAuthTokenStore トークンを保存しないOAuthTokenStore
+// 暗号化の鍵を設定せずにデータベースを使う場合、平文のトークンをディスクに残さないために使う
+type nopOAuthTokenStore struct{}
+
+func (nopOAuthTokenStore) Save(*OAuthToken) error                  { return nil }
+func (nopOAuthTokenStore) Get(string, string) (*OAuthToken, error) { return nil, ErrOAuthTokenNotFound }
+func (nopOAuthTokenStore) DeleteByUser(string) error               { return nil }
+
+// encryptedOAuthTokenStore アクセストークンとリフレッシュトークンを暗号化して保存するOAuthTokenStore
+// メッセージと同じKeyWrapperを使い、ユーザーとプロバイダーを追加データにする
+type encryptedOAuthTokenStore struct {
+	store OAuthTokenStore
+	keys  KeyWrapper
+}
+
+func newEncryptedOAuthTokenStore(store OAuthTokenStore, keys KeyWrapper) *encryptedOAuthTokenStore {
+	return &encryptedOAuthTokenStore{store: store, keys: keys}
+}
+
+func (s *encryptedOAuthTokenStore) Save(t *OAuthToken) error {
+	sealed := *t
+	aad := t.UserID + "\x00" + t.Provider
+	var err error
+	if sealed.AccessToken, err = sealString(s.keys, aad, t.AccessToken); err != nil {
+		return err
+	}
+	if t.RefreshToken != "" {
+		if sealed.RefreshToken, err = sealString(s.keys, aad, t.RefreshToken); err != nil {
+			return err
+		}
+	}
+	return s.store.Save(&sealed)
+}
+
+func (s *encryptedOAuthTokenStore) Get(userID, provider string) (*OAuthToken, error) {
+	t, err := s.store.Get(userID, provider)
+	if err != nil {
+		return nil, err
+	}
+	aad := userID + "\x00" + provider
+	if t.AccessToken, err = openString(s.keys, aad, t.AccessToken); err != nil {
+		return nil, err
+	}
+	if t.RefreshToken, err = openString(s.keys, aad, t.RefreshToken); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *encryptedOAuthTokenStore) DeleteByUser(userID string) error {
+	return s.store.DeleteByUser(userID)
+}
+
+// tokenFromCredentials ログインで得た資格情報からトークンを作成する
+// expires_inは秒数またはtime.Durationのどちらでも受け付ける
+func tokenFromCredentials(userID, provider string, creds *gomniauthcommon.Credentials, now time.Time) *OAuthToken {
+	t := &OAuthToken{
+		UserID:       userID,
+		Provider:     provider,
+		AccessToken:  creds.Map.Get("access_token").Str(),
+		RefreshToken: creds.Map.Get("refresh_token").Str(),
+		TokenType:    creds.Map.Get("token_type").Str(),
+		UpdatedAt:    now,
+	}
+	if d := expiresIn(creds.Map.Get("expires_in").Data()); d > 0 {
+		t.Expiry = now.Add(d)
+	}
+	return t
+}
+
+func expiresIn(v interface{}) time.Duration {
+	switch v := v.(type) {
+	case time.Duration:
+		return v
+	case float64:
+		return time.Duration(v) * time.Second
+	case int:
+		return time.Duration(v) * time.Second
+	case int64:
+		return time.Duration(v) * time.Second
+	case string:
+		n, _ := strconv.Atoi(v)
+		return time.Duration(n) * time.Second
+	}
+	return 0
+}
+
+// saveLoginToken ログインで得たトークンを保存する
+// 前回のリフレッシュトークンは、プロバイダーが毎回は発行しないため引き継ぐ
+func saveLoginToken(userID, provider string, creds *gomniauthcommon.Credentials) error {
+	if creds == nil || creds.Map == nil {
+		return nil
+	}
+	t := tokenFromCredentials(userID, provider, creds, time.Now())
+	if t.AccessToken == "" {
+		return nil
+	}
+	if t.RefreshToken == "" {
+		if previous, err := oauthTokens.Get(userID, provider); err == nil {
+			t.RefreshToken = previous.RefreshToken
+		}
+	}
+	return oauthTokens.Save(t)
+}
+
+// oauthClient トークンの更新に使用するプロバイダーのクライアントの設定
+type oauthClient struct {
+	tokenURL     string
+	clientID     func() string
+	clientSecret func() string
+}
+
+// oauthClients プロバイダー名ごとのクライアントの設定
+var oauthClients = map[string]oauthClient{
+	"google": {
+		tokenURL:     "https://oauth2.googleapis.com/token",
+		clientID:     func() string { return *googleClientID },
+		clientSecret: func() string { return *googleClientSecret },
+	},
+}
+
+// tokenRefreshClient トークンの更新に使用するHTTPクライアント
+var tokenRefreshClient = &http.Client{Timeout: 10 * time.Second}
+
+// providerToken プロバイダーのAPIの呼び出しに使用できるアクセストークンを返す
+// 期限が近い場合はリフレッシュトークンで更新し、更新したトークンを保存する
+func providerToken(ctx context.Context, userID, provider string) (*OAuthToken, error) {
+	t, err := oauthTokens.Get(userID, provider)
+	if err != nil {
+		return nil, err
+	}
+	if !t.expired(time.Now()) {
+		return t, nil
+	}
+	client, ok := oauthClients[provider]
+	if !ok || t.RefreshToken == "" {
+		return nil, ErrOAuthTokenExpired
+	}
+	if err := refreshToken(ctx, client, t); err != nil {
+		return nil, err
+	}
+	if err := oauthTokens.Save(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// refreshToken リフレッシュトークンでアクセストークンを更新する (RFC 6749 6節)
+// リフレッシュトークンが取り消されている場合はErrOAuthTokenExpiredを返す
+func refreshToken(ctx context.Context, client oauthClient, t *OAuthToken) error {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {t.RefreshToken},
+		"client_id":     {client.clientID()},
+		"client_secret": {client.clientSecret()},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := tokenRefreshClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		Error        string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+	if body.Error == "invalid_grant" {
+		return ErrOAuthTokenExpired
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return fmt.Errorf("chat: トークンを更新できませんでした: %s %s", resp.Status, body.Error)
+	}
+	now := time.Now()
+	t.AccessToken = body.AccessToken
+	if body.RefreshToken != "" {
+		t.RefreshToken = body.RefreshToken
+	}
+	if body.TokenType != "" {
+		t.TokenType = body.TokenType
+	}
+	t.Expiry = time.Time{}
+	if body.ExpiresIn > 0 {
+		t.Expiry = now.Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	t.UpdatedAt = now
+	return nil
+}
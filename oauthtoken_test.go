@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gomniauthcommon "github.com/stretchr/gomniauth/common"
+	"github.com/stretchr/objx"
+)
+
+func TestOAuthTokenRefresh(t *testing.T) {
+	keys, err := parseKeyring("k1:" + testKey('a'))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := newMemoryOAuthTokenStore()
+	oauthTokens = newEncryptedOAuthTokenStore(plain, keys)
+	defer func() { oauthTokens = newMemoryOAuthTokenStore() }()
+
+	creds := &gomniauthcommon.Credentials{Map: objx.Map{"access_token": "old", "refresh_token": "refresh", "expires_in": 30 * time.Second}}
+	if err := saveLoginToken("u1", "test", creds); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := plain.Get("u1", "test"); stored.AccessToken == "old" || stored.RefreshToken == "refresh" {
+		t.Error("トークンは暗号化して保存するべきです")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "refresh" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"new","expires_in":3600,"token_type":"Bearer"}`))
+	}))
+	defer server.Close()
+	oauthClients["test"] = oauthClient{tokenURL: server.URL, clientID: func() string { return "id" }, clientSecret: func() string { return "secret" }}
+	defer delete(oauthClients, "test")
+
+	token, err := providerToken(context.Background(), "u1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "new" || token.RefreshToken != "refresh" || time.Until(token.Expiry) < 59*time.Minute {
+		t.Errorf("期限の近いトークンは更新するべきです: %+v", token)
+	}
+	if saved, _ := oauthTokens.Get("u1", "test"); saved.AccessToken != "new" {
+		t.Errorf("更新したトークンを保存するべきです: %+v", saved)
+	}
+
+	oauthTokens.Save(&OAuthToken{UserID: "u2", Provider: "test", AccessToken: "x", RefreshToken: "revoked", Expiry: time.Now()})
+	if _, err := providerToken(context.Background(), "u2", "test"); err != ErrOAuthTokenExpired {
+		t.Errorf("取り消されたリフレッシュトークンではErrOAuthTokenExpiredを返すべきです: %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+var (
+	webauthnRPID    = flag.String("webauthn-rpid", "localhost", "パスキーのRelying Party ID (通常はドメイン名)")
+	webauthnOrigins = flag.String("webauthn-origins", "http://localhost:8080", "パスキーを受け付けるオリジン (カンマ区切り)")
+)
+
+// passkeyCeremonyTTL パスキーの登録・認証を開始してから完了するまでの制限時間
+const passkeyCeremonyTTL = 5 * time.Minute
+
+// ErrPasskeyCeremony パスキーの登録・認証の状態が見つからない場合に発生するエラー
+var ErrPasskeyCeremony = errors.New("chat: パスキーの手続きが見つからないか期限切れです。")
+
+// passkeyUser UserRecordをwebauthn.Userとして扱うためのアダプター
+type passkeyUser struct {
+	*UserRecord
+}
+
+func (u passkeyUser) WebAuthnID() []byte                         { return []byte(u.ID) }
+func (u passkeyUser) WebAuthnName() string                       { return u.Name }
+func (u passkeyUser) WebAuthnDisplayName() string                { return u.Name }
+func (u passkeyUser) WebAuthnCredentials() []webauthn.Credential { return u.Passkeys }
+
+// passkeyCeremony 開始済みのパスキーの登録・認証
+type passkeyCeremony struct {
+	data    *webauthn.SessionData
+	userID  string
+	expires time.Time
+}
+
+// passkeyAuth パスキーの登録と認証を扱う
+type passkeyAuth struct {
+	webauthn   *webauthn.WebAuthn
+	mu         sync.Mutex
+	ceremonies map[string]*passkeyCeremony
+}
+
+func newPasskeyAuth(rpID string, origins []string) (*passkeyAuth, error) {
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: "Go Chat",
+		RPOrigins:     origins,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &passkeyAuth{webauthn: wa, ceremonies: make(map[string]*passkeyCeremony)}, nil
+}
+
+// save 手続きの状態を保存し、Cookieに対応するトークンを設定する
+func (p *passkeyAuth) save(w http.ResponseWriter, r *http.Request, data *webauthn.SessionData, userID string) {
+	token := randomID()
+	p.mu.Lock()
+	for t, c := range p.ceremonies {
+		if time.Now().After(c.expires) {
+			delete(p.ceremonies, t)
+		}
+	}
+	p.ceremonies[hashToken(token)] = &passkeyCeremony{data: data, userID: userID, expires: time.Now().Add(passkeyCeremonyTTL)}
+	p.mu.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     "passkey",
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(passkeyCeremonyTTL.Seconds()),
+		Secure:   isSecureRequest(r),
+		HttpOnly: true,
+	})
+}
+
+// take 保存された手続きの状態を取り出す。取り出した状態は再利用できない
+func (p *passkeyAuth) take(r *http.Request) (*passkeyCeremony, error) {
+	cookie, err := r.Cookie("passkey")
+	if err != nil {
+		return nil, ErrPasskeyCeremony
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := hashToken(cookie.Value)
+	c, ok := p.ceremonies[key]
+	delete(p.ceremonies, key)
+	if !ok || time.Now().After(c.expires) {
+		return nil, ErrPasskeyCeremony
+	}
+	return c, nil
+}
+
+// ServeHTTP パスキーの登録 (要ログイン)
+// POST /account/passkeys/register/begin
+// POST /account/passkeys/register/finish
+func (p *passkeyAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	user, _ := userFromContext(r.Context())
+	record, err := users.GetByID(user.UniqueID())
+	if err != nil {
+		writeJSONError(w, r, "このアカウントではパスキーを利用できません", http.StatusBadRequest)
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, "/account/passkeys/register/") {
+	case "begin":
+		var exclusions []protocol.CredentialDescriptor
+		for _, c := range record.Passkeys {
+			exclusions = append(exclusions, c.Descriptor())
+		}
+		creation, data, err := p.webauthn.BeginRegistration(passkeyUser{record},
+			webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+			webauthn.WithExclusions(exclusions))
+		if err != nil {
+			requestLogger(r).Println("パスキーの登録を開始できませんでした:", err)
+			writeJSONError(w, r, "パスキーの登録を開始できませんでした", http.StatusInternalServerError)
+			return
+		}
+		p.save(w, r, data, record.ID)
+		writeJSON(w, http.StatusOK, creation)
+	case "finish":
+		c, err := p.take(r)
+		if err != nil || c.userID != record.ID {
+			writeJSONError(w, r, ErrPasskeyCeremony.Error(), http.StatusBadRequest)
+			return
+		}
+		credential, err := p.webauthn.FinishRegistration(passkeyUser{record}, *c.data, r)
+		if err != nil {
+			writeJSONError(w, r, "パスキーを検証できませんでした", http.StatusBadRequest)
+			return
+		}
+		record.Passkeys = append(record.Passkeys, *credential)
+		if err := users.Update(record); err != nil {
+			writeJSONError(w, r, "パスキーの保存に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		auditRequest(r, auditAdminAction, record.ID, record.ID, map[string]string{"action": "passkey_registered"})
+		writeJSON(w, http.StatusOK, map[string]int{"passkeys": len(record.Passkeys)})
+	default:
+		writeJSONError(w, r, "見つかりません", http.StatusNotFound)
+	}
+}
+
+// loginHandler パスキーによるログイン
+// POST /login/passkey/begin, /login/passkey/finish        パスキーだけでログインする
+// POST /login/2fa/passkey/begin, /login/2fa/passkey/finish OAuthのログイン後の二要素目として使用する
+func (p *passkeyAuth) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	if blockedIP(w, r, nil) {
+		return
+	}
+	if wait, locked := loginLimits.check(ipKey(r)); locked {
+		tooManyAttempts(w, r, wait)
+		return
+	}
+	secondFactor := strings.HasPrefix(r.URL.Path, "/login/2fa/")
+	var pending *pendingLogin
+	if secondFactor {
+		var err error
+		if pending, err = pendingLoginFromRequest(r); err != nil {
+			writeJSONError(w, r, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	switch r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:] {
+	case "begin":
+		var assertion *protocol.CredentialAssertion
+		var data *webauthn.SessionData
+		var err error
+		if pending != nil {
+			var record *UserRecord
+			record, err = users.GetByID(pending.userID)
+			if err != nil || len(record.Passkeys) == 0 {
+				writeJSONError(w, r, "パスキーが登録されていません", http.StatusBadRequest)
+				return
+			}
+			assertion, data, err = p.webauthn.BeginLogin(passkeyUser{record})
+		} else {
+			assertion, data, err = p.webauthn.BeginDiscoverableLogin()
+		}
+		if err != nil {
+			requestLogger(r).Println("パスキーによる認証を開始できませんでした:", err)
+			writeJSONError(w, r, "パスキーによる認証を開始できませんでした", http.StatusInternalServerError)
+			return
+		}
+		p.save(w, r, data, "")
+		writeJSON(w, http.StatusOK, assertion)
+	case "finish":
+		c, err := p.take(r)
+		if err != nil {
+			writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var record *UserRecord
+		var credential *webauthn.Credential
+		if pending != nil {
+			if record, err = users.GetByID(pending.userID); err == nil {
+				credential, err = p.webauthn.FinishLogin(passkeyUser{record}, *c.data, r)
+			}
+		} else {
+			credential, err = p.webauthn.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+				found, err := users.GetByID(string(userHandle))
+				if err != nil {
+					return nil, err
+				}
+				record = found
+				return passkeyUser{found}, nil
+			}, *c.data, r)
+		}
+		if err != nil {
+			loginLimits.fail(ipKey(r))
+			auditRequest(r, auditAuthFailed, "", "", map[string]string{"method": "passkey"})
+			writeJSONError(w, r, "パスキーを検証できませんでした", http.StatusUnauthorized)
+			return
+		}
+		if record.Banned {
+			writeJSONError(w, r, "このアカウントは利用停止されています", http.StatusForbidden)
+			return
+		}
+		// 署名カウンターを更新する
+		for i := range record.Passkeys {
+			if bytes.Equal(record.Passkeys[i].ID, credential.ID) {
+				record.Passkeys[i].Authenticator = credential.Authenticator
+			}
+		}
+		if err := users.Update(record); err != nil {
+			requestLogger(r).Println("パスキーの更新に失敗しました:", err)
+		}
+		method, avatarURL := "passkey", userData(passkeyUser{record}.chatUser())["avatar_url"].(string)
+		if pending != nil {
+			method, avatarURL = pending.method+"+passkey", pending.avatarURL
+			finishPendingLogin(w, r)
+		} else if record.TOTPEnabled {
+			// パスキーだけのログインでも二要素認証が有効なユーザーは確認画面へ進む
+			startPendingLogin(w, r, record.ID, avatarURL, method)
+			writeJSON(w, http.StatusOK, map[string]string{"redirect": "/login/2fa"})
+			return
+		}
+		if err := issueSession(w, r, record.ID, avatarURL, method); err != nil {
+			if errors.Is(err, ErrRejectedByHook) {
+				writeJSONError(w, r, err.Error(), http.StatusForbidden)
+				return
+			}
+			requestLogger(r).Println("セッションの作成に失敗しました:", err)
+			writeJSONError(w, r, "セッションの作成に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"redirect": "/chat"})
+	default:
+		writeJSONError(w, r, "見つかりません", http.StatusNotFound)
+	}
+}
+
+// chatUser アバターの取得に使用するChatUserを返す
+func (u passkeyUser) chatUser() ChatUser {
+	return sessionUser{uniqueID: u.ID, name: u.Name, avatarURL: u.UserRecord.AvatarURL}
+}
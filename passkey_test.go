@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func TestPasskeyLoginBeginError(t *testing.T) {
+	defer func(s UserStore) { users = s }(users)
+	users = newMemoryUserStore()
+	users.Create(&UserRecord{ID: "u1", Name: "Alice", Passkeys: []webauthn.Credential{{ID: []byte("c1")}}})
+	token := randomID()
+	pendingLoginsMu.Lock()
+	pendingLogins[hashToken(token)] = &pendingLogin{userID: "u1", method: "google", expires: time.Now().Add(time.Minute)}
+	pendingLoginsMu.Unlock()
+	defer func() {
+		pendingLoginsMu.Lock()
+		delete(pendingLogins, hashToken(token))
+		pendingLoginsMu.Unlock()
+	}()
+
+	// RPOriginsのない設定ではBeginLoginが失敗する
+	p := &passkeyAuth{webauthn: &webauthn.WebAuthn{Config: &webauthn.Config{RPID: "localhost"}}, ceremonies: make(map[string]*passkeyCeremony)}
+	r := httptest.NewRequest(http.MethodPost, "/login/2fa/passkey/begin", nil)
+	r.AddCookie(&http.Cookie{Name: "auth_2fa", Value: token})
+	w := httptest.NewRecorder()
+	p.loginHandler(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("認証を開始できない場合はエラーを返すべきです: %d %s", w.Code, w.Body)
+	}
+	if len(p.ceremonies) != 0 {
+		t.Error("開始できなかった手続きの状態は保存するべきではありません")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// encodeBuffers イベントのエンコードに使うバッファを使い回す
+var encodeBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// prepareMessage イベントを一度だけエンコードし、すべてのクライアントで共有できるフレームを設定した複製を返す
+// 複製したイベントは送信が終わるまで変更しない
+func prepareMessage(msg *message) *message {
+	buf := encodeBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer encodeBuffers.Put(buf)
+	if err := json.NewEncoder(buf).Encode(msg); err != nil {
+		return msg
+	}
+	// PreparedMessageはデータを保持し続けるため、バッファとは別の領域に複製して渡す
+	data := append([]byte(nil), buf.Bytes()...)
+	pm, err := websocket.NewPreparedMessage(websocket.TextMessage, data)
+	if err != nil {
+		return msg
+	}
+	prepared := *msg
+	prepared.prepared = pm
+	prepared.size = len(data)
+	return &prepared
+}
+
+// outgoing 1つのイベントをクライアントの能力ごとに一度だけエンコードしたもの
+type outgoing struct {
+	full        *message
+	compactOnce sync.Once
+	compact     *message
+}
+
+func newOutgoing(msg *message) *outgoing {
+	return &outgoing{full: prepareMessage(msg)}
+}
+
+// forClient クライアントの能力に合わせたエンコード済みのイベントを返す
+// 複数のゴルーチンから呼び出せる
+func (o *outgoing) forClient(c *client) *message {
+	if !c.caps[capCompact] || o.full.AvatarURL == "" {
+		return o.full
+	}
+	o.compactOnce.Do(func() { o.compact = prepareMessage(c.caps.shape(o.full)) })
+	return o.compact
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPrepareMessage(t *testing.T) {
+	msg := &message{Type: typeChat, ID: "m1", Message: "こんにちは", AvatarURL: "http://example.com/a.png"}
+	prepared := prepareMessage(msg)
+	if prepared == msg || msg.prepared != nil {
+		t.Fatal("共有しているイベントを変更せずに複製するべきです")
+	}
+	data, _ := json.Marshal(msg)
+	if prepared.prepared == nil || prepared.size != len(data)+1 {
+		t.Errorf("エンコードしたフレームとその大きさを設定するべきです: %d, %d", prepared.size, len(data)+1)
+	}
+	if prepared.Message != msg.Message || prepared.AvatarURL != msg.AvatarURL {
+		t.Errorf("内容は変更するべきではありません: %+v", prepared)
+	}
+}
+
+func TestOutgoingForClient(t *testing.T) {
+	tests := []struct {
+		avatarURL string
+		shared    bool
+	}{
+		{"http://example.com/a.png", false},
+		{"", true},
+	}
+	for _, test := range tests {
+		out := newOutgoing(&message{Type: typeChat, ID: "m1", AvatarURL: test.avatarURL})
+		full := &client{caps: capabilities{}}
+		compact1 := &client{caps: capabilities{capCompact: true}}
+		compact2 := &client{caps: capabilities{capCompact: true}}
+
+		if out.forClient(full) != out.full {
+			t.Errorf("%q: compactを宣言していないクライアントには共通のフレームを使うべきです", test.avatarURL)
+		}
+		c1, c2 := out.forClient(compact1), out.forClient(compact2)
+		if c1 != c2 || c1.prepared == nil || c1.AvatarURL != "" {
+			t.Errorf("%q: compactのフレームは一度だけエンコードして共有するべきです", test.avatarURL)
+		}
+		if (c1 == out.full) != test.shared {
+			t.Errorf("%q: 省略する項目がない場合だけ共通のフレームを使うべきです", test.avatarURL)
+		}
+	}
+}
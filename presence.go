@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	presenceRedis = flag.String("presence-redis", "", "在室状況を共有するRedisのURL (例: redis://localhost:6379/0。空の場合はこのノードのメモリ上に保持する)")
+	presenceTTL   = flag.Duration("presence-ttl", 30*time.Second, "ハートビートが途絶えた接続を在室中とみなさなくなるまでの時間")
+)
+
+// minPresenceTTL -presence-ttlに指定できる最小の時間。ハートビートはこの3分の1の間隔で送る
+const minPresenceTTL = 3 * time.Second
+
+// validPresenceTTL -presence-ttlとして使用できるかどうかを判定する
+func validPresenceTTL(ttl time.Duration) bool {
+	return ttl >= minPresenceTTL
+}
+
+// Presence ルームに在室しているユーザー
+type Presence struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+	// Statusはユーザーが設定した状態。在室状況の記録には含めず、返す時に付け加える
+	Status *UserStatus `json:"status,omitempty"`
+}
+
+// PresenceStore 接続ごとの在室状況を有効期限付きで保持する
+// 複数のノードで共有すると、どのノードに接続していてもクラスター全体の在室者を返せる
+type PresenceStore interface {
+	// Heartbeat 接続が在室中であることを記録し、ttlの間有効にする
+	Heartbeat(room, connID string, p Presence, ttl time.Duration) error
+	// Remove 接続の在室状況を削除する
+	Remove(room, connID string, p Presence) error
+	// List 有効期限内の在室者をユーザーごとにまとめて返す
+	List(room string) ([]Presence, error)
+}
+
+// presenceEntry memoryPresenceStoreの1件の記録
+type presenceEntry struct {
+	Presence
+	expires time.Time
+}
+
+// memoryPresenceStore メモリ上に在室状況を保持するPresenceStore
+type memoryPresenceStore struct {
+	mu    sync.Mutex
+	rooms map[string]map[string]presenceEntry
+	now   func() time.Time
+}
+
+func newMemoryPresenceStore() *memoryPresenceStore {
+	return &memoryPresenceStore{rooms: make(map[string]map[string]presenceEntry), now: time.Now}
+}
+
+func (s *memoryPresenceStore) Heartbeat(room, connID string, p Presence, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rooms[room] == nil {
+		s.rooms[room] = make(map[string]presenceEntry)
+	}
+	s.rooms[room][connID] = presenceEntry{Presence: p, expires: s.now().Add(ttl)}
+	return nil
+}
+
+func (s *memoryPresenceStore) Remove(room, connID string, _ Presence) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rooms[room], connID)
+	return nil
+}
+
+func (s *memoryPresenceStore) List(room string) ([]Presence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	var list []Presence
+	for connID, e := range s.rooms[room] {
+		if now.After(e.expires) {
+			delete(s.rooms[room], connID)
+			continue
+		}
+		list = append(list, e.Presence)
+	}
+	return uniquePresence(list), nil
+}
+
+// redisPresenceStore Redisのソート済みセットに有効期限をスコアとして記録するPresenceStore
+type redisPresenceStore struct {
+	client *redis.Client
+}
+
+func newRedisPresenceStore(url string) (*redisPresenceStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, err
+	}
+	return &redisPresenceStore{client: client}, nil
+}
+
+// redisPresenceMember ソート済みセットのメンバー。接続ごとに異なる値にする
+type redisPresenceMember struct {
+	Presence
+	Conn string `json:"conn"`
+}
+
+func (s *redisPresenceStore) key(room string) string {
+	return "gochat:presence:" + room
+}
+
+func (s *redisPresenceStore) member(connID string, p Presence) string {
+	data, _ := json.Marshal(redisPresenceMember{Presence: p, Conn: connID})
+	return string(data)
+}
+
+func (s *redisPresenceStore) Heartbeat(room, connID string, p Presence, ttl time.Duration) error {
+	ctx := context.Background()
+	expires := time.Now().Add(ttl)
+	pipe := s.client.TxPipeline()
+	pipe.ZAdd(ctx, s.key(room), redis.Z{Score: float64(expires.UnixNano()), Member: s.member(connID, p)})
+	// 誰も在室しなくなったルームのキーが残らないようにする
+	pipe.Expire(ctx, s.key(room), ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *redisPresenceStore) Remove(room, connID string, p Presence) error {
+	return s.client.ZRem(context.Background(), s.key(room), s.member(connID, p)).Err()
+}
+
+func (s *redisPresenceStore) List(room string) ([]Presence, error) {
+	ctx := context.Background()
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	s.client.ZRemRangeByScore(ctx, s.key(room), "-inf", "("+now)
+	members, err := s.client.ZRange(ctx, s.key(room), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	var list []Presence
+	for _, m := range members {
+		var member redisPresenceMember
+		if json.Unmarshal([]byte(m), &member) == nil {
+			list = append(list, member.Presence)
+		}
+	}
+	return uniquePresence(list), nil
+}
+
+// uniquePresence 複数の接続を持つユーザーを1件にまとめ、名前順に並べる
+func uniquePresence(list []Presence) []Presence {
+	seen := make(map[string]bool)
+	unique := []Presence{}
+	for _, p := range list {
+		if !seen[p.UserID] {
+			seen[p.UserID] = true
+			unique = append(unique, p)
+		}
+	}
+	sort.Slice(unique, func(i, j int) bool { return unique[i].Name < unique[j].Name })
+	return unique
+}
+
+// trackPresence doneが閉じられるまで接続の在室状況を定期的に更新する
+func trackPresence(room, connID string, p Presence, done <-chan struct{}) {
+	presence.Heartbeat(room, connID, p, *presenceTTL)
+	ticker := time.NewTicker(*presenceTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			presence.Heartbeat(room, connID, p, *presenceTTL)
+		case <-done:
+			presence.Remove(room, connID, p)
+			return
+		}
+	}
+}
+
+// presenceHandler ルームの在室者を返す
+// GET /api/presence?room=general
+func presenceHandler(w http.ResponseWriter, r *http.Request) {
+	room := roomNameFromRequest(r)
+	if !validRoomName(room) {
+		writeJSONError(w, r, ErrInvalidRoomName.Error(), http.StatusBadRequest)
+		return
+	}
+	list, err := presence.List(room)
+	if err != nil {
+		requestLogger(r).Println("在室状況の取得に失敗しました:", err)
+		writeJSONError(w, r, "在室状況の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	for i := range list {
+		list[i].Status = statuses.Get(list[i].UserID)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// presenceTracker クライアントの参加・退室のイベントを購読して在室状況を更新する
+type presenceTracker struct {
+	mu   sync.Mutex
+	done map[string]chan struct{}
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{done: make(map[string]chan struct{})}
+}
+
+// subscribe イベントの購読を開始する
+func (t *presenceTracker) subscribe(bus *eventBus) {
+	bus.Subscribe(EventClientJoined, t.joined)
+	bus.Subscribe(EventClientLeft, t.left)
+}
+
+func (t *presenceTracker) joined(e Event) {
+	done := make(chan struct{})
+	t.mu.Lock()
+	t.done[e.ConnID] = done
+	t.mu.Unlock()
+	go trackPresence(e.Room, e.ConnID, Presence{UserID: e.UserID, Name: e.Name}, done)
+}
+
+func (t *presenceTracker) left(e Event) {
+	t.mu.Lock()
+	done, ok := t.done[e.ConnID]
+	delete(t.done, e.ConnID)
+	t.mu.Unlock()
+	if ok {
+		close(done)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidPresenceTTL(t *testing.T) {
+	tests := []struct {
+		ttl  time.Duration
+		want bool
+	}{
+		{0, false},
+		{-time.Second, false},
+		{time.Nanosecond, false},
+		{2 * time.Second, false},
+		{minPresenceTTL, true},
+		{30 * time.Second, true},
+	}
+	for _, tt := range tests {
+		if got := validPresenceTTL(tt.ttl); got != tt.want {
+			t.Errorf("validPresenceTTL(%v) = %v, want %v", tt.ttl, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// WebSocketのプロトコルのバージョン
+// 互換性のない変更を行う場合はバージョンを追加し、古いクライアントには古いバージョンで応答する
+const (
+	minProtocolVersion = 1
+	maxProtocolVersion = 1
+)
+
+// ErrUnsupportedProtocol クライアントが要求したプロトコルのバージョンに対応していない場合に発生するエラー
+var ErrUnsupportedProtocol = errors.New("chat: 対応していないプロトコルのバージョンです。")
+
+// protocolVersions サーバーが対応しているプロトコルのバージョン
+func protocolVersions() []int {
+	var versions []int
+	for v := minProtocolVersion; v <= maxProtocolVersion; v++ {
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// protocolFeatures このサーバーで指定されたルームとユーザーが利用できる機能
+// クライアントは一覧に含まれない機能のイベントを送信しない
+func protocolFeatures(room, userID string) []string {
+	list := []string{"presence", "reconnect", "caps", capAck, typeCode}
+	for _, name := range []string{featureReport, featureRemind, featureBatch} {
+		if features.Enabled(name, room, userID) {
+			list = append(list, name)
+		}
+	}
+	if translator != nil && features.Enabled(featureTranslate, room, userID) {
+		list = append(list, featureTranslate)
+	}
+	if gifs != nil {
+		list = append(list, typeGIF)
+	}
+	return list
+}
+
+// negotiateVersion クライアントが要求したバージョン以下で最も新しいバージョンを選ぶ
+// 0はバージョンを指定しない古いクライアントを表し、最初のバージョンで応答する
+func negotiateVersion(requested int) (int, error) {
+	switch {
+	case requested == 0:
+		return minProtocolVersion, nil
+	case requested < minProtocolVersion:
+		return 0, ErrUnsupportedProtocol
+	case requested > maxProtocolVersion:
+		return maxProtocolVersion, nil
+	}
+	return requested, nil
+}
+
+// versionFromRequest クエリパラメーターvで要求されたプロトコルのバージョンを返す
+func versionFromRequest(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("v")
+	if v == "" {
+		return negotiateVersion(0)
+	}
+	requested, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, ErrUnsupportedProtocol
+	}
+	return negotiateVersion(requested)
+}
+
+// welcomeEvent 接続時やhelloへの応答として、決定したバージョンと利用できる機能を知らせる
+func welcomeEvent(version int, room, userID string) *message {
+	return &message{
+		Type:     typeWelcome,
+		Name:     systemName,
+		Version:  version,
+		Versions: protocolVersions(),
+		Features: protocolFeatures(room, userID),
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		requested int
+		version   int
+		err       error
+	}{
+		{0, minProtocolVersion, nil},
+		{minProtocolVersion, minProtocolVersion, nil},
+		{maxProtocolVersion + 1, maxProtocolVersion, nil},
+		{-1, 0, ErrUnsupportedProtocol},
+	}
+	for _, test := range tests {
+		if v, err := negotiateVersion(test.requested); v != test.version || err != test.err {
+			t.Errorf("%d: %d, %vになるべきところ%d, %vでした", test.requested, test.version, test.err, v, err)
+		}
+	}
+}
+
+func TestVersionFromRequest(t *testing.T) {
+	tests := []struct {
+		query   string
+		version int
+		err     error
+	}{
+		{"", minProtocolVersion, nil},
+		{"v=1", 1, nil},
+		{"v=99", maxProtocolVersion, nil},
+		{"v=abc", 0, ErrUnsupportedProtocol},
+		{"v=-1", 0, ErrUnsupportedProtocol},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/room?"+test.query, nil)
+		if v, err := versionFromRequest(r); v != test.version || err != test.err {
+			t.Errorf("%q: %d, %vになるべきところ%d, %vでした", test.query, test.version, test.err, v, err)
+		}
+	}
+}
+
+func TestProtocolNegotiationOverWebSocket(t *testing.T) {
+	if err := sessions.Create(&Session{ID: "protocol-session", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.Delete("protocol-session")
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	mux := http.NewServeMux()
+	mux.Handle("/room", MustAuth(rooms))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	cookie := authCookie(&fakeUser{id: "u1", name: "アリス"}, "protocol-session")
+
+	c, err := dialRoom(server.URL, url.Values{"room": {"protocol"}, "v": {"abc"}}, cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := c.expect(typeError); err != nil || e.Code != errUnsupportedVersion {
+		t.Errorf("対応していないバージョンはエラーを返すべきです: %+v, %v", e, err)
+	}
+	c.close()
+
+	c, err = dialRoom(server.URL, url.Values{"room": {"protocol"}, "v": {"99"}}, cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	welcome, err := c.expect(typeWelcome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if welcome.Version != maxProtocolVersion || len(welcome.Versions) == 0 {
+		t.Errorf("対応している最新のバージョンと一覧を知らせるべきです: %d %v", welcome.Version, welcome.Versions)
+	}
+	found := map[string]bool{}
+	for _, f := range welcome.Features {
+		found[f] = true
+	}
+	if !found["presence"] || !found[capAck] {
+		t.Errorf("利用できる機能を知らせるべきです: %v", welcome.Features)
+	}
+
+	if err := c.conn.WriteJSON(&message{Type: typeHello, Version: 99}); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := c.expect(typeWelcome); err != nil || e.Version != maxProtocolVersion {
+		t.Errorf("helloにもwelcomeで応答するべきです: %+v, %v", e, err)
+	}
+	if err := c.conn.WriteJSON(&message{Type: typeHello, Version: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := c.expect(typeError); err != nil || e.Code != errUnsupportedVersion {
+		t.Errorf("対応していないバージョンのhelloはエラーを返すべきです: %+v, %v", e, err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var trustedProxiesFlag = flag.String("trusted-proxies", "", "X-Forwarded-ForとX-Forwarded-Protoを信頼するプロキシのIPアドレスまたはCIDR (カンマ区切り)")
+
+// ErrInvalidProxy 信頼するプロキシの指定が不正な場合に発生するエラー
+var ErrInvalidProxy = errors.New("chat: 信頼するプロキシのアドレスが不正です。")
+
+// trustedProxiesはX-Forwarded-*ヘッダーを信頼するプロキシ。空の場合はヘッダーを無視する
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies カンマ区切りのIPアドレスまたはCIDRを解析する
+func parseTrustedProxies(spec string) ([]*net.IPNet, error) {
+	return parseCIDRs(strings.Split(spec, ","), ErrInvalidProxy)
+}
+
+// parseCIDRs IPアドレスまたはCIDRの一覧を解析する。空の要素は無視し、不正な要素があればinvalidを返す
+func parseCIDRs(list []string, invalid error) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, invalid
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, invalid
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// isTrustedProxy アドレスが信頼するプロキシのものかどうかを判定する
+// Unixドメインソケットの相手(アドレスが空または"@")はローカルのプロキシとみなして信頼する
+func isTrustedProxy(addr string) bool {
+	if addr == "" || addr == "@" {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost 直接接続してきた相手のIPアドレスを返す
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP リクエストの送信元のIPアドレスを返す
+// 信頼するプロキシから届いた場合は、X-Forwarded-Forを右から辿って最初に見つかった信頼しないアドレスを返す
+// クライアントが付けたヘッダーは左側に残るため、偽装されたアドレスは使われない
+func clientIP(r *http.Request) string {
+	addr := remoteHost(r)
+	if !isTrustedProxy(addr) {
+		return addr
+	}
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(h, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	if len(hops) == 0 {
+		if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+			return real
+		}
+		return addr
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// 解析できないアドレスより左は信頼できない
+			return addr
+		}
+		if !isTrustedProxy(hops[i]) {
+			return hops[i]
+		}
+		addr = hops[i]
+	}
+	return addr
+}
+
+// requestScheme リクエストのスキーム(httpまたはhttps)を返す
+// TLSを終端する信頼するプロキシから届いた場合はX-Forwarded-Protoに従う
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if isTrustedProxy(remoteHost(r)) {
+		proto := strings.ToLower(strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]))
+		if proto == "https" || proto == "http" {
+			return proto
+		}
+	}
+	return "http"
+}
+
+// isSecureRequest HTTPSで届いたリクエストかどうかを返す。CookieのSecure属性に使用する
+func isSecureRequest(r *http.Request) bool {
+	return requestScheme(r) == "https"
+}
+
+// requestHost リクエストのホスト名(ポートを含む)を返す
+// 信頼するプロキシから届いた場合はX-Forwarded-Hostに従う
+func requestHost(r *http.Request) string {
+	if isTrustedProxy(remoteHost(r)) {
+		if host := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Host"), ",")[0]); host != "" {
+			return host
+		}
+	}
+	return r.Host
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	nets, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = nets
+	defer func() { trustedProxies = nil }()
+
+	tests := []struct {
+		remote string
+		xff    string
+		want   string
+	}{
+		{"203.0.113.5:1234", "1.2.3.4", "203.0.113.5"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"10.0.0.1:1234", "6.6.6.6, 198.51.100.7, 10.0.0.2", "198.51.100.7"},
+		{"192.168.1.1:80", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1:1234", "198.51.100.7, garbage", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("clientIP(%s, %q) = %s, want %s", tt.remote, tt.xff, got, tt.want)
+		}
+	}
+}
+
+func TestRequestScheme(t *testing.T) {
+	trustedProxies, _ = parseTrustedProxies("10.0.0.0/8")
+	defer func() { trustedProxies = nil }()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.5:1234"
+	r.Header.Set("X-Forwarded-Proto", "https")
+	if isSecureRequest(r) {
+		t.Error("信頼しないアドレスからのX-Forwarded-Protoは無視するべきです")
+	}
+	r.RemoteAddr = "10.0.0.1:1234"
+	if !isSecureRequest(r) {
+		t.Error("信頼するプロキシからのX-Forwarded-Protoに従うべきです")
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.TLS = &tls.ConnectionState{}
+	if requestScheme(r) != "https" {
+		t.Error("TLSで届いたリクエストはhttpsであるべきです")
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	if _, err := parseTrustedProxies("10.0.0.0/99"); err != ErrInvalidProxy {
+		t.Error("不正なCIDRはエラーになるべきです")
+	}
+	if _, err := parseTrustedProxies("proxy.local"); err != ErrInvalidProxy {
+		t.Error("IPアドレスでない値はエラーになるべきです")
+	}
+}
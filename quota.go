@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var storageQuota = flag.Int64("storage-quota", 1<<30, "1人のユーザーが保存できるアバターと添付ファイルの合計サイズの既定値 (バイト、0の場合は無制限)")
+
+// ErrStorageQuotaExceeded ユーザーの保存容量の上限を超える場合に発生するエラー
+var ErrStorageQuotaExceeded = errors.New("chat: 保存できる容量の上限を超えています。")
+
+// StorageUsage ユーザーが保存しているファイルの容量
+type StorageUsage struct {
+	Avatars     int64 `json:"avatars"`
+	Attachments int64 `json:"attachments"`
+	Used        int64 `json:"used"`
+	// Quotaは上限。0の場合は無制限
+	Quota int64 `json:"quota"`
+}
+
+// userQuota ユーザーの保存容量の上限。個別に設定されていない場合は既定値を使う
+func userQuota(userID string) int64 {
+	if record, err := users.GetByID(userID); err == nil && record.StorageQuota != 0 {
+		if record.StorageQuota < 0 {
+			return 0
+		}
+		return record.StorageQuota
+	}
+	return *storageQuota
+}
+
+// avatarBytes アップロードされたユーザーのアバターの合計サイズ
+func avatarBytes(userID string) (int64, error) {
+	files, err := ioutil.ReadDir("avatars")
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), userID+".") {
+			total += f.Size()
+		}
+	}
+	return total, nil
+}
+
+// storageUsage ユーザーが保存しているファイルの容量を集計する
+func storageUsage(userID string) (StorageUsage, error) {
+	usage := StorageUsage{Quota: userQuota(userID)}
+	var err error
+	if usage.Avatars, err = avatarBytes(userID); err != nil {
+		return usage, err
+	}
+	list, err := attachments.ListByUser(userID)
+	if err != nil {
+		return usage, err
+	}
+	for _, a := range list {
+		usage.Attachments += a.Size
+	}
+	usage.Used = usage.Avatars + usage.Attachments
+	return usage, nil
+}
+
+// storageReservations 保存中のファイルのために確保している容量
+var storageReservations = struct {
+	sync.Mutex
+	bytes map[string]int64
+}{bytes: make(map[string]int64)}
+
+// checkStorageQuota additionalバイトを新たに保存しても上限を超えないかを確認する
+func checkStorageQuota(userID string, additional int64) error {
+	storageReservations.Lock()
+	defer storageReservations.Unlock()
+	return checkStorageQuotaLocked(userID, additional)
+}
+
+// reserveStorage 上限を超えない場合はadditionalバイトを確保する
+// 同時に保存されるファイルで上限を超えないように、保存を終えてからreleaseを呼び出す
+func reserveStorage(userID string, additional int64) (release func(), err error) {
+	storageReservations.Lock()
+	defer storageReservations.Unlock()
+	if err := checkStorageQuotaLocked(userID, additional); err != nil {
+		return nil, err
+	}
+	storageReservations.bytes[userID] += additional
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			storageReservations.Lock()
+			defer storageReservations.Unlock()
+			if storageReservations.bytes[userID] -= additional; storageReservations.bytes[userID] == 0 {
+				delete(storageReservations.bytes, userID)
+			}
+		})
+	}, nil
+}
+
+// checkStorageQuotaLocked 確保済みの容量も含めて上限を確認する。storageReservationsをロックして呼び出す
+func checkStorageQuotaLocked(userID string, additional int64) error {
+	usage, err := storageUsage(userID)
+	if err != nil {
+		return err
+	}
+	used := usage.Used + storageReservations.bytes[userID]
+	if usage.Quota == 0 || used+additional <= usage.Quota {
+		return nil
+	}
+	return fmt.Errorf("%w (使用量: %s / 上限: %s、追加: %s)", ErrStorageQuotaExceeded,
+		formatBytes(used), formatBytes(usage.Quota), formatBytes(additional))
+}
+
+// formatBytes バイト数を読みやすい単位で表す
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// storageHandler 自分の保存容量の使用状況を返す
+// GET /api/me/storage
+func storageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	user, _ := userFromContext(r.Context())
+	usage, err := storageUsage(user.UniqueID())
+	if err != nil {
+		writeJSONError(w, r, "使用量の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
+// storageAdminHandler 管理者用の保存容量の管理API
+// GET /api/admin/storage/{userID}  使用状況を返す
+// PUT /api/admin/storage/{userID}  {"quota": バイト数}で上限を個別に設定する (0で既定値、-1で無制限)
+func storageAdminHandler(w http.ResponseWriter, r *http.Request) {
+	userID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/storage"), "/")
+	record, err := users.GetByID(userID)
+	if err != nil {
+		writeJSONError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var body struct {
+			Quota *int64 `json:"quota"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Quota == nil || *body.Quota < -1 {
+			writeJSONError(w, r, "quotaにバイト数を指定してください", http.StatusBadRequest)
+			return
+		}
+		record.StorageQuota = *body.Quota
+		if err := users.Update(record); err != nil {
+			writeJSONError(w, r, "上限の更新に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		admin, _ := userFromContext(r.Context())
+		auditRequest(r, auditAdminAction, admin.UniqueID(), userID, map[string]string{"action": "storage_quota", "quota": fmt.Sprint(*body.Quota)})
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	usage, err := storageUsage(userID)
+	if err != nil {
+		writeJSONError(w, r, "使用量の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckStorageQuota(t *testing.T) {
+	defer func(u UserStore, a AttachmentStore, q int64) { users, attachments, *storageQuota = u, a, q }(users, attachments, *storageQuota)
+	users, attachments = newMemoryUserStore(), newMemoryAttachmentStore()
+	*storageQuota = 10
+	users.Create(&UserRecord{ID: "default"})
+	users.Create(&UserRecord{ID: "custom", StorageQuota: 20})
+	users.Create(&UserRecord{ID: "unlimited", StorageQuota: -1})
+	for _, id := range []string{"default", "custom", "unlimited"} {
+		attachments.Create(&Attachment{ID: id + "-a1", UserID: id, Size: 8})
+	}
+	tests := []struct {
+		userID     string
+		additional int64
+		exceeded   bool
+	}{
+		{"default", 2, false},
+		{"default", 3, true},
+		{"custom", 12, false},
+		{"custom", 13, true},
+		{"unlimited", 1 << 40, false},
+	}
+	for _, test := range tests {
+		err := checkStorageQuota(test.userID, test.additional)
+		if errors.Is(err, ErrStorageQuotaExceeded) != test.exceeded {
+			t.Errorf("%s +%d: 上限を超えるかどうかが%vになるべきところ%vでした", test.userID, test.additional, test.exceeded, err)
+		}
+	}
+}
+
+func TestReserveStorage(t *testing.T) {
+	defer func(u UserStore, a AttachmentStore, q int64) { users, attachments, *storageQuota = u, a, q }(users, attachments, *storageQuota)
+	users, attachments = newMemoryUserStore(), newMemoryAttachmentStore()
+	*storageQuota = 10
+
+	release, err := reserveStorage("u1", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reserveStorage("u1", 6); !errors.Is(err, ErrStorageQuotaExceeded) {
+		t.Errorf("確保済みの容量も含めて上限を確認するべきです: %v", err)
+	}
+	if err := checkStorageQuota("u1", 6); !errors.Is(err, ErrStorageQuotaExceeded) {
+		t.Errorf("確認でも確保済みの容量を含めるべきです: %v", err)
+	}
+	if other, err := reserveStorage("u2", 6); err != nil {
+		t.Errorf("他のユーザーの確保には影響しないべきです: %v", err)
+	} else {
+		other()
+	}
+	release()
+	release()
+	again, err := reserveStorage("u1", 10)
+	if err != nil {
+		t.Fatalf("解放した容量は再び確保できるべきです: %v", err)
+	}
+	again()
+	if n := len(storageReservations.bytes); n != 0 {
+		t.Errorf("全て解放した後は確保が残らないべきですが%d件ありました", n)
+	}
+}
+
+func TestTusUploadQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gochat-tus-quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(b BlobStore, a AttachmentStore, s Scanner, u UserStore, q int64) {
+		blobs, attachments, scanner, users, *storageQuota = b, a, s, u, q
+	}(blobs, attachments, scanner, users, *storageQuota)
+	attachments, scanner, users = newMemoryAttachmentStore(), &streamingScanner{}, newMemoryUserStore()
+	*storageQuota = 10
+	if blobs, err = newFileBlobStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	h, err := newTusHandler(filepath.Join(dir, ".partial"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &sessionUser{uniqueID: "quota-user"}
+	do := func(method, path, length, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Tus-Resumable", tusVersion)
+		if method == http.MethodPost {
+			r.Header.Set("Upload-Length", length)
+		}
+		if method == http.MethodPatch {
+			r.Header.Set("Content-Type", "application/offset+octet-stream")
+			r.Header.Set("Upload-Offset", "0")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r.WithContext(withUser(r.Context(), user)))
+		return w
+	}
+
+	if w := do(http.MethodPost, "/files/", "11", ""); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("上限を超えるアップロードは作成時に413で拒否するべきですが%dでした", w.Code)
+	}
+	w := do(http.MethodPost, "/files/", "6", "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("上限内のアップロードは作成できるべきですが%dでした", w.Code)
+	}
+	location := w.Header().Get("Location")
+	if w := do(http.MethodPost, "/files/", "6", ""); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("アップロード途中の分も含めて上限を確認するべきですが%dでした", w.Code)
+	}
+
+	// 作成後に別の経路で保存されたファイルによって上限を超えた場合は、完了時に拒否する
+	attachments.Create(&Attachment{ID: "other", UserID: "quota-user", Size: 6})
+	if w := do(http.MethodPatch, location, "", "hello!"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("完了時に上限を超える場合は413で拒否するべきですが%dでした", w.Code)
+	}
+	id := strings.TrimPrefix(location, "/files/")
+	if _, err := attachments.Get(id); err == nil {
+		t.Error("上限を超えたアップロードは添付ファイルとして保存するべきではありません")
+	}
+	if _, err := blobs.Open(id); err == nil {
+		t.Error("上限を超えたアップロードはBlobStoreに保存するべきではありません")
+	}
+}
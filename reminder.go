@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reminderInterval 期限を迎えたリマインダーを確認する間隔
+const reminderInterval = 15 * time.Second
+
+// ErrReminderNotFound 指定されたリマインダーが存在しない場合に発生するエラー
+var ErrReminderNotFound = errors.New("chat: リマインダーが見つかりません。")
+
+// ErrInvalidReminderTime リマインダーの時刻が不正な場合に発生するエラー
+var ErrInvalidReminderTime = errors.New("chat: リマインダーの時刻は未来の時刻(RFC3339)または期間(例: 30m)で指定してください。")
+
+// Reminder メッセージについて後で知らせるためのリマインダー
+type Reminder struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	MessageID string    `json:"message_id"`
+	Room      string    `json:"room"`
+	At        time.Time `json:"at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReminderStore リマインダーを保存する
+type ReminderStore interface {
+	Create(r *Reminder) error
+	ListByUser(userID string) ([]*Reminder, error)
+	// ListDue 指定された時刻までに期限を迎えるリマインダーを返す
+	ListDue(t time.Time) ([]*Reminder, error)
+	Delete(id string) error
+}
+
+// memoryReminderStore メモリ上にリマインダーを保持するReminderStore
+type memoryReminderStore struct {
+	mu        sync.Mutex
+	reminders map[string]*Reminder
+}
+
+func newMemoryReminderStore() *memoryReminderStore {
+	return &memoryReminderStore{reminders: make(map[string]*Reminder)}
+}
+
+func (s *memoryReminderStore) Create(r *Reminder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *r
+	s.reminders[r.ID] = &stored
+	return nil
+}
+
+func (s *memoryReminderStore) list(match func(*Reminder) bool) []*Reminder {
+	list := []*Reminder{}
+	for _, r := range s.reminders {
+		if match(r) {
+			copied := *r
+			list = append(list, &copied)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].At.Before(list[j].At) })
+	return list
+}
+
+func (s *memoryReminderStore) ListByUser(userID string) ([]*Reminder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list(func(r *Reminder) bool { return r.UserID == userID }), nil
+}
+
+func (s *memoryReminderStore) ListDue(t time.Time) ([]*Reminder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list(func(r *Reminder) bool { return !r.At.After(t) }), nil
+}
+
+func (s *memoryReminderStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.reminders[id]; !ok {
+		return ErrReminderNotFound
+	}
+	delete(s.reminders, id)
+	return nil
+}
+
+// parseReminderTime RFC3339の時刻または現在からの期間を解析する
+func parseReminderTime(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return now.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil || !t.After(now) {
+		return time.Time{}, ErrInvalidReminderTime
+	}
+	return t, nil
+}
+
+// createReminder メッセージのリマインダーを作成する
+// 呼び出す側でユーザーがmsgのルームを利用できることを確認しておく
+func createReminder(userID string, msg *message, at string) (*Reminder, error) {
+	t, err := parseReminderTime(at, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	r := &Reminder{
+		ID:        randomID(),
+		UserID:    userID,
+		MessageID: msg.ID,
+		Room:      msg.Room,
+		At:        t,
+		CreatedAt: time.Now(),
+	}
+	return r, reminders.Create(r)
+}
+
+// messageLink メッセージを表示するためのURLを返す
+func messageLink(room, messageID string) string {
+	return "/chat?room=" + url.QueryEscape(room) + "#m-" + messageID
+}
+
+// connectedUsers このノードに接続しているユーザーごとのクライアントの数
+type connectedUsers struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newConnectedUsers() *connectedUsers {
+	return &connectedUsers{counts: make(map[string]int)}
+}
+
+// subscribe イベントの購読を開始する
+func (c *connectedUsers) subscribe(bus *eventBus) {
+	bus.Subscribe(EventClientJoined, c.observe)
+	bus.Subscribe(EventClientLeft, c.observe)
+}
+
+func (c *connectedUsers) observe(e Event) {
+	if e.UserID == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch e.Kind {
+	case EventClientJoined:
+		c.counts[e.UserID]++
+	case EventClientLeft:
+		if c.counts[e.UserID]--; c.counts[e.UserID] <= 0 {
+			delete(c.counts, e.UserID)
+		}
+	}
+}
+
+// online ユーザーがこのノードに接続しているかどうか
+func (c *connectedUsers) online(userID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[userID] > 0
+}
+
+// reminderRecipients リマインダーを届けられるユーザーの判定に使用する接続中のユーザー
+var reminderRecipients = newConnectedUsers()
+
+// reminderReachable リマインダーを今届けられるかどうか
+// 接続していなくても、プッシュ通知かメールが設定されていて受け取る設定であればそちらで届ける
+func reminderReachable(userID string) bool {
+	if reminderRecipients.online(userID) {
+		return true
+	}
+	prefs, err := notificationPrefs.Get(userID)
+	if err != nil {
+		return false
+	}
+	_, noPush := pusher.(nopPusher)
+	_, noMail := mailer.(nopMailer)
+	return (prefs.Push && !noPush) || (prefs.Email && !noMail)
+}
+
+// runReminders 期限を迎えたリマインダーを定期的に配信する
+func runReminders(interval time.Duration) {
+	for range time.Tick(interval) {
+		deliverReminders(time.Now())
+	}
+}
+
+// deliverReminders 期限を迎えたリマインダーをシステムメッセージとして本人に届ける
+// 届けられないユーザーのリマインダーは削除せず、次に接続したときに届ける
+func deliverReminders(now time.Time) {
+	due, err := reminders.ListDue(now)
+	if err != nil {
+		log.Println("リマインダーの取得に失敗しました:", err)
+		return
+	}
+	for _, r := range due {
+		if !reminderReachable(r.UserID) {
+			continue
+		}
+		text := "リマインダー: " + messageLink(r.Room, r.MessageID)
+		if msg, err := messages.Get(r.MessageID); err == nil {
+			text = fmt.Sprintf("リマインダー: %sさんのメッセージ「%s」 %s", msg.Name, msg.Message, messageLink(r.Room, r.MessageID))
+		}
+		notify(notification{UserID: r.UserID, Text: text, Subject: "リマインダー"}, now)
+		reminders.Delete(r.ID)
+	}
+}
+
+// remindersHandler 自分のリマインダーを管理するAPI
+// GET    /api/me/reminders       一覧を返す
+// POST   /api/me/reminders       message_idとat(RFC3339または期間)を指定して作成する
+// DELETE /api/me/reminders/{id}  取り消す
+type remindersHandler struct {
+	rooms *roomRegistry
+}
+
+func (h *remindersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/me/reminders"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		list, err := reminders.ListByUser(user.UniqueID())
+		if err != nil {
+			writeJSONError(w, r, "リマインダーの取得に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case id == "" && r.Method == http.MethodPost:
+		msg, err := messages.Get(r.FormValue("message_id"))
+		if err != nil {
+			writeJSONError(w, r, ErrMessageNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		if err := checkRoomAccess(r, h.rooms, msg.Room, user); err != nil {
+			writeJSONError(w, r, err.Error(), http.StatusForbidden)
+			return
+		}
+		reminder, err := createReminder(user.UniqueID(), msg, r.FormValue("at"))
+		if err != nil {
+			writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, reminder)
+	case id != "" && r.Method == http.MethodDelete:
+		list, _ := reminders.ListByUser(user.UniqueID())
+		for _, reminder := range list {
+			if reminder.ID == id {
+				reminders.Delete(id)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		writeJSONError(w, r, ErrReminderNotFound.Error(), http.StatusNotFound)
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
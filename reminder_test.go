@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeliverRemindersHoldsForOfflineUsers(t *testing.T) {
+	defer func(s ReminderStore, n Notifier, p NotificationPrefsStore, c *connectedUsers) {
+		reminders, notifier, notificationPrefs, reminderRecipients = s, n, p, c
+	}(reminders, notifier, notificationPrefs, reminderRecipients)
+	var sent recordingNotifier
+	reminders, notifier, notificationPrefs, reminderRecipients = newMemoryReminderStore(), &sent, newMemoryNotificationPrefsStore(), newConnectedUsers()
+	now := time.Now()
+	reminders.Create(&Reminder{ID: "r1", UserID: "u1", MessageID: "m1", Room: "general", At: now.Add(-time.Minute)})
+
+	deliverReminders(now)
+	if list, _ := reminders.ListByUser("u1"); len(sent) != 0 || len(list) != 1 {
+		t.Errorf("接続していないユーザーのリマインダーは届けずに保持するべきです: %v, %v", sent, list)
+	}
+
+	reminderRecipients.observe(Event{Kind: EventClientJoined, UserID: "u1", ConnID: "c1"})
+	deliverReminders(now)
+	if list, _ := reminders.ListByUser("u1"); len(sent) != 1 || len(list) != 0 {
+		t.Errorf("接続したユーザーにはリマインダーを届けるべきです: %v, %v", sent, list)
+	}
+	reminderRecipients.observe(Event{Kind: EventClientLeft, UserID: "u1", ConnID: "c1"})
+	if reminderRecipients.online("u1") {
+		t.Error("退室したユーザーは接続していないとみなすべきです")
+	}
+}
+
+func TestRemindersHandlerChecksRoomAccess(t *testing.T) {
+	defer func(m MessageStore, s ReminderStore) { messages, reminders = m, s }(messages, reminders)
+	messages, reminders = newMemoryMessageStore(), newMemoryReminderStore()
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	secret, _ := rooms.get("secret")
+	secret.SetSettings(roomSettings{IPDeny: []string{"192.0.2.0/24"}})
+	messages.Save(&message{ID: "m1", Room: "general", UserID: "u2", Name: "Bob", Message: "明日の会議", When: time.Now()})
+	messages.Save(&message{ID: "m2", Room: "secret", UserID: "u2", Name: "Bob", Message: "秘密", When: time.Now()})
+	h := &remindersHandler{rooms: rooms}
+
+	tests := []struct {
+		messageID string
+		status    int
+	}{
+		{"m1", http.StatusCreated},
+		{"m2", http.StatusForbidden},
+		{"missing", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		form := url.Values{"message_id": {tt.messageID}, "at": {"30m"}}
+		r := httptest.NewRequest(http.MethodPost, "/api/me/reminders", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "192.0.2.1:1234"
+		r = r.WithContext(withUser(r.Context(), sessionUser{uniqueID: "u1", name: "Alice"}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: ステータスが%dであるべきです: %d", tt.messageID, tt.status, w.Code)
+		}
+	}
+	if list, _ := reminders.ListByUser("u1"); len(list) != 1 || list[0].MessageID != "m1" {
+		t.Errorf("利用できるルームのメッセージにだけリマインダーを作成するべきです: %+v", list)
+	}
+
+	general, _ := rooms.get("general")
+	c := &client{room: general, userData: map[string]interface{}{"userid": "u1"}}
+	if _, err := c.roomMessage("m2"); err != ErrMessageNotFound {
+		t.Errorf("WebSocketでは参加しているルームのメッセージだけを参照できるべきです: %v", err)
+	}
+	if msg, err := c.roomMessage("m1"); err != nil || msg.ID != "m1" {
+		t.Errorf("参加しているルームのメッセージは参照できるべきです: %v, %v", msg, err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// requestIDHeader リクエストIDを受け渡すHTTPヘッダー
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength 外部から受け取るリクエストIDの最大長
+const maxRequestIDLength = 64
+
+// contextKey コンテキストに値を格納する際のキーの型
+type contextKey string
+
+const requestIDKey contextKey = "request_id"
+
+// withRequestID リクエストごとにIDを採番し、コンテキストとレスポンスヘッダーに設定する
+// X-Request-IDヘッダーが付与されている場合はその値を引き継ぐ
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = randomID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// randomID ランダムな16バイトのIDを16進数の文字列で生成する
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID ログやヘッダーにそのまま出力できるIDかどうかを判定する
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFromContext コンテキストに格納されたリクエストIDを返す
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestLogger リクエストIDを接頭辞に付けたロガーを返す
+func requestLogger(r *http.Request) *log.Logger {
+	return log.New(log.Writer(), "["+requestIDFromContext(r.Context())+"] ", log.Flags())
+}
+
+// httpError リクエストIDを含むエラーページを返す
+func httpError(w http.ResponseWriter, r *http.Request, message string, code int) {
+	http.Error(w, fmt.Sprintf("%s (リクエストID: %s)", message, requestIDFromContext(r.Context())), code)
+}
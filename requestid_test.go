@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithRequestID(t *testing.T) {
+	var got string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = requestIDFromContext(r.Context())
+	}))
+
+	// ヘッダーが無い場合は新しいIDを採番する
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got == "" {
+		t.Error("リクエストIDが採番されるべきです")
+	}
+	if w.Header().Get(requestIDHeader) != got {
+		t.Error("レスポンスヘッダーにリクエストIDが設定されるべきです")
+	}
+
+	// 有効なヘッダーはそのまま引き継ぐ
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(requestIDHeader, "abc-123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "abc-123" {
+		t.Errorf("X-Request-IDを引き継ぐべきですが%sが返されました", got)
+	}
+
+	// 不正なヘッダーは無視する
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(requestIDHeader, "abc\n123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got == "abc\n123" {
+		t.Error("不正なX-Request-IDは引き継ぐべきではありません")
+	}
+}
@@ -1,70 +1,370 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
 	"net/http"
-
-	"github.com/stretchr/objx"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/goki0524/gopackage/trace"
 	"github.com/gorilla/websocket"
 )
 
 type room struct {
+	// nameはルームの名前
+	name string
+	// settingsMuはsettingsを保護する
+	settingsMu sync.RWMutex
+	// settingsは管理者が変更できるルームの設定
+	settings roomSettings
 	// forwardは他のクライアントに転送するためのメッセージを保持するチャネル
 	forward chan *message
 	// joinはチャットルームに参加しようとしているクライアントのためのチャネル
 	join chan *client
 	// leaveはチャットルームから退室しようとしているクライアントのためのチャネル
 	leave chan *client
+	// directは特定のユーザーだけに届けるメッセージを保持するチャネル
+	direct chan *message
+	// replyは特定のクライアントだけに届けるメッセージを保持するチャネル
+	reply chan *reply
+	// relayは他のノードから中継されたメッセージを保持するチャネル
+	relay chan *message
+	// kickはチャットルームから退出させるユーザーのためのチャネル
+	kick chan *kick
 	// clientsには在室しているすべてのクライアントが保持される
 	clients map[*client]bool
+	// waitingは定員に空きができるのを待っているクライアント。先頭から参加させる
+	waiting []*client
+	// membersはユーザーごとの在室中の接続の数
+	members map[string]int
+	// membershipはまだ送信していない参加・退室。membershipFlushはそれを送信する時刻に受信できる
+	membership      *membershipBatch
+	membershipFlush <-chan time.Time
 	// tracerはチャットルーム上で行われた操作ログを受け取る
-	tracer trace.Tracer
+	tracer *roomTracer
 	// avatarはアバターの情報を取得する
 	avatar Avatar
+	// clusterは他のノードにメッセージを中継する。nilの場合は単一ノードで動作する
+	cluster Broadcaster
+	// doneはルームが終了し、すべてのクライアントを切断すると閉じられる
+	done chan struct{}
+	// statsはルームの統計情報
+	stats *roomStats
+	// archivedはルームがアーカイブされているかどうか。アーカイブ中は投稿も接続もできない
+	archived atomic.Bool
+	// stopはこのルームだけを終了させる。roomRegistryが設定する
+	stop context.CancelFunc
+	// usedはroomRegistryから最後に参照された時刻。roomRegistry.muで保護する
+	used time.Time
+	// sentはクライアントが指定したIDで再送された投稿を見つける
+	sent *sendDedup
 }
 
 // newRoomはすぐに利用できるチャットルームを生成して返す
 func newRoom() *room {
 	return &room{
-		forward: make(chan *message),
+		forward: make(chan *message, *roomForwardBuffer),
 		join:    make(chan *client),
 		leave:   make(chan *client),
+		direct:  make(chan *message),
+		reply:   make(chan *reply),
+		relay:   make(chan *message),
+		kick:    make(chan *kick),
 		clients: make(map[*client]bool),
-		tracer:  trace.Off(),
+		members: make(map[string]int),
+		done:    make(chan struct{}),
+		stats:   newRoomStats(),
+		tracer:  &roomTracer{out: trace.Off()},
+		stop:    func() {},
+		sent:    newSendDedup(),
 	}
 }
 
-func (r *room) run() {
+// Runはctxがキャンセルされるまでルームの処理を行う
+// 終了時にはすべてのクライアントを切断してからdoneを閉じる
+func (r *room) Run(ctx context.Context) {
+	var leakCheck <-chan time.Time
+	if *leakCheckInterval > 0 {
+		ticker := time.NewTicker(*leakCheckInterval)
+		defer ticker.Stop()
+		leakCheck = ticker.C
+	}
 	for {
+		// 空きができていれば待機中のクライアントを参加させる
+		r.admitWaiting()
 		select {
+		case <-ctx.Done():
+			r.shutdown()
+			return
 		case client := <-r.join:
-			// 参加
-			r.clients[client] = true
-			r.tracer.Trace("新しいクライアントが参加しました")
+			// 参加。定員に達している場合は待機させるか拒否する
+			if r.full() {
+				r.turnAway(client)
+				continue
+			}
+			r.admit(client)
 		case client := <-r.leave:
 			// 退室
-			delete(r.clients, client)
-			close(client.send)
-			r.tracer.Trace("クライアントが退室しました")
-		case msg := <-r.forward:
-			r.tracer.Trace("メッセージを受信しました: ", msg.Message)
-			//すべてのクライアントにメッセージを転送
+			if r.clients[client] {
+				r.remove(client, websocket.CloseNormalClosure, "")
+			} else {
+				r.dropWaiting(client, websocket.CloseNormalClosure, "")
+			}
+			r.tracer.Info("クライアントが退室しました")
+		case k := <-r.kick:
+			// 指定されたユーザーを退出させる。userIDが空の場合はすべてのクライアントを退出させる
+			for _, client := range append([]*client(nil), r.waiting...) {
+				if k.userID == "" || client.userData["userid"] == k.userID {
+					r.dropWaiting(client, websocket.ClosePolicyViolation, k.reason)
+				}
+			}
 			for client := range r.clients {
-				select {
-				case client.send <- msg:
-					// メッセージ送信
-					r.tracer.Trace(" -- クライアントに送信されました")
-				default:
-					// 送信に失敗
-					delete(r.clients, client)
-					close(client.send)
-					r.tracer.Trace(" -- 送信に失敗しました。クライアントをクリーンアップします")
+				if k.userID == "" || client.userData["userid"] == k.userID {
+					if k.notice != nil {
+						r.push(client, client.caps.shape(k.notice))
+					}
+					r.remove(client, websocket.ClosePolicyViolation, k.reason)
+					r.tracer.Info("クライアントを退出させました: ", k.reason)
+				}
+			}
+		case rep := <-r.reply:
+			if !r.clients[rep.client] && r.waitingPosition(rep.client) == 0 {
+				continue
+			}
+			select {
+			case rep.client.send <- rep.msg:
+			default:
+				r.tracer.Warn(" -- 返信の送信に失敗しました")
+			}
+		case msg := <-r.direct:
+			// 宛先のユーザーのクライアントにだけ送信
+			for client := range r.clients {
+				if client.userData["userid"] != msg.UserID {
+					continue
+				}
+				if !r.push(client, client.caps.shape(msg)) {
+					r.tracer.Warn(" -- お知らせの送信に失敗しました")
 				}
 			}
+		case msg := <-r.forward:
+			// 続けて届いているイベントはまとめて配信する
+			batch := r.collectBatch(msg)
+			for _, msg := range batch {
+				r.accept(msg)
+			}
+			r.deliverBatch(batch)
+		case msg := <-r.relay:
+			// 他のノードで保存済みのメッセージなので配信だけを行う
+			r.tracer.Sample("中継されたメッセージを受信しました: ", msg.Message)
+			r.deliver(msg)
+		case <-r.membershipFlush:
+			r.flushMembership()
+		case now := <-leakCheck:
+			r.checkLeaks(now)
+		}
+	}
+}
+
+// shutdownはすべてのクライアントを切断し、ルームへの送信を待っているゴルーチンを解放する
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) shutdown() {
+	for client := range r.clients {
+		r.remove(client, websocket.CloseGoingAway, "server shutdown")
+	}
+	for len(r.waiting) > 0 {
+		r.dropWaiting(r.waiting[0], websocket.CloseGoingAway, "server shutdown")
+	}
+	close(r.done)
+	r.tracer.Info("ルームを終了しました")
+}
+
+// acceptはこのノードで投稿されたイベントを保存し、外部に記録・中継する
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) accept(msg *message) {
+	r.tracer.Sample("メッセージを受信しました: ", msg.Message)
+	if isPost(msg) {
+		r.stats.message(msg.When)
+		if err := messages.Save(msg); err != nil {
+			r.tracer.Error("メッセージの保存に失敗しました: ", err)
+			reporter.Report(err, map[string]string{"room": r.name, "op": "save"})
+		}
+	}
+	if err := eventLog.Append(msg); err != nil {
+		r.tracer.Error("イベントの記録に失敗しました: ", err)
+		reporter.Report(err, map[string]string{"room": r.name, "op": "event_log"})
+	}
+	if r.cluster != nil {
+		if err := r.cluster.Publish(clusterBroadcast, msg); err != nil {
+			r.tracer.Error("メッセージの中継に失敗しました: ", err)
+			reporter.Report(err, map[string]string{"room": r.name, "op": "cluster"})
+		}
+	}
+	events.Publish(Event{Kind: EventMessageBroadcast, Room: r.name, UserID: msg.UserID, Name: msg.Name, Message: msg})
+}
+
+// deliverは在室しているすべてのクライアントにメッセージを転送する
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) deliver(msg *message) {
+	r.fanOut(msg, false)
+}
+
+// fanOutは在室しているクライアントにメッセージを転送する
+// skipBatchが真の場合は、まとめたフレームを送信済みのbatchを宣言したクライアントを除く
+func (r *room) fanOut(msg *message, skipBatch bool) {
+	if len(r.clients) == 0 {
+		return
+	}
+	defer func(start time.Time) {
+		fanOutDuration.WithLabelValues(r.name).Observe(time.Since(start).Seconds())
+	}(time.Now())
+	// すべてのクライアントで同じエンコード結果を共有する
+	out := newOutgoing(msg)
+	if len(r.clients) >= *fanoutThreshold {
+		r.deliverParallel(msg, out, skipBatch)
+		return
+	}
+	for client := range r.clients {
+		if !client.caps.wants(msg) || (skipBatch && client.caps[capBatch]) {
+			continue
+		}
+		if r.push(client, out.forClient(client)) {
+			// メッセージ送信
+			r.tracer.Sample(" -- クライアントに送信されました")
+		} else {
+			// 送信に失敗
+			r.tracer.Warn(" -- 送信に失敗しました")
+		}
+	}
+}
+
+// deliverParallelは在室者を分割してワーカーで並列に配信する
+// 送信できなかったクライアントへの対応は、在室者を変更するためこのゴルーチンで行う
+func (r *room) deliverParallel(msg *message, out *outgoing, skipBatch bool) {
+	clients := make([]*client, 0, len(r.clients))
+	for client := range r.clients {
+		if client.caps.wants(msg) && !(skipBatch && client.caps[capBatch]) {
+			clients = append(clients, client)
+		}
+	}
+	failed := sharedFanoutPool().send(clients, out)
+	r.stats.sent(int64(out.full.size) * int64(len(clients)-len(failed)))
+	for _, client := range failed {
+		if !r.push(client, out.forClient(client)) {
+			r.tracer.Warn(" -- 送信に失敗しました")
+		}
+	}
+}
+
+// Settings ルームの設定を返す
+func (r *room) Settings() roomSettings {
+	r.settingsMu.RLock()
+	defer r.settingsMu.RUnlock()
+	return r.settings
+}
+
+// SetSettings ルームの設定を更新する
+func (r *room) SetSettings(s roomSettings) {
+	r.settingsMu.Lock()
+	defer r.settingsMu.Unlock()
+	r.settings = s
+}
+
+// canPostは指定されたユーザーがこのルームに投稿できるかどうかを判定する
+// アーカイブされたルームには誰も投稿できない
+// 読み取り専用のルームではオーナーとモデレーターだけが投稿できる
+func (r *room) canPost(userID string) bool {
+	if r.archived.Load() {
+		return false
+	}
+	if !r.Settings().ReadOnly {
+		return true
+	}
+	return r.canManage(userID)
+}
+
+// canManageは指定されたユーザーがこのルームのオーナーかモデレーターかどうかを判定する
+func (r *room) canManage(userID string) bool {
+	for _, owner := range r.Settings().Owners {
+		if owner == userID {
+			return true
 		}
 	}
+	return hasRole(userID, roleModerator)
+}
+
+// removeはクライアントを在室者から取り除き、送信チャネルを閉じて接続を終了させる
+// room.runのゴルーチンからのみ呼び出す
+func (r *room) remove(c *client, code int, reason string) {
+	delete(r.clients, c)
+	deliveryMetrics.remove(c)
+	r.memberLeft(c)
+	r.stats.setClients(len(r.clients))
+	events.Publish(clientEvent(EventClientLeft, r, c))
+	if c.dropped > 0 {
+		droppedFramesByClient.Delete(r.name + "/" + c.requestID)
+	}
+	c.closeCode, c.closeReason = code, reason
+	close(c.send)
+}
+
+// replyは特定のクライアントへの返信
+type reply struct {
+	client *client
+	msg    *message
+}
+
+// kickはユーザーを退出させる要求
+type kick struct {
+	userID string
+	reason string
+	// noticeが指定されている場合は切断する前に送信する
+	notice *message
+}
+
+// Kick 指定されたユーザーのすべてのクライアントを退出させる
+func (r *room) Kick(userID, reason string) {
+	select {
+	case r.kick <- &kick{userID: userID, reason: reason}:
+	case <-r.done:
+	}
+}
+
+// Broadcast 在室しているすべてのクライアントにイベントを送信する
+func (r *room) Broadcast(msg *message) {
+	select {
+	case r.forward <- msg:
+	case <-r.done:
+	}
+}
+
+// sendDirect 宛先のユーザーのクライアントにだけイベントを送信する
+func (r *room) sendDirect(msg *message) {
+	select {
+	case r.direct <- msg:
+	case <-r.done:
+	}
+}
+
+// sendRelay 他のノードから中継されたイベントを配信する
+func (r *room) sendRelay(msg *message) {
+	select {
+	case r.relay <- msg:
+	case <-r.done:
+	}
+}
+
+// Notify 指定されたユーザーの在室中のクライアントにシステムメッセージを送信する
+func (r *room) Notify(userID, text string) {
+	r.sendDirect(&message{
+		ID:      randomID(),
+		Room:    r.name,
+		UserID:  userID,
+		Name:    systemName,
+		Message: text,
+		When:    time.Now(),
+	})
 }
 
 const (
@@ -72,27 +372,135 @@ const (
 	messageBufferSize = 256
 )
 
+var (
+	// clientSendBufferは各クライアントの送信チャネルの大きさ
+	// 一杯になった場合はルームのbackpressureの設定に従って破棄または切断する
+	clientSendBuffer = flag.Int("client-send-buffer", messageBufferSize, "クライアントごとに送信を待つイベントの最大数 (超えた場合はルームのbackpressureの設定に従う)")
+	// roomForwardBufferはルームのforwardチャネルの大きさ
+	// 一杯になった場合は投稿したクライアントの受信処理が空くまで待つため、送信側のTCPに負荷が戻る
+	roomForwardBuffer = flag.Int("room-forward-buffer", 0, "ルームが配信を待つイベントの最大数 (超えた場合は投稿したクライアントの受信を一時停止する)")
+)
+
 var upgrader = &websocket.Upgrader{ReadBufferSize: socketBufferSize, WriteBufferSize: socketBufferSize}
 
 func (r *room) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	user, ok := r.checkRequest(w, req)
+	if !ok {
+		return
+	}
+	socket, version, ok := acceptSocket(w, req, r.name, user)
+	if !ok {
+		return
+	}
+	r.serveSocket(socket, req, user, version)
+}
+
+// checkRequestはアップグレードする前に、認証、IPアドレス、アーカイブの状態を確認する
+// 接続できない場合はHTTPのエラーを返して偽を返す
+func (r *room) checkRequest(w http.ResponseWriter, req *http.Request) (ChatUser, bool) {
+	user, ok := userFromContext(req.Context())
+	if !ok {
+		httpError(w, req, "認証されていません", http.StatusUnauthorized)
+		return nil, false
+	}
+	if blockedIP(w, req, r) {
+		return nil, false
+	}
+	if r.archived.Load() {
+		httpError(w, req, ErrRoomArchived.Error(), http.StatusGone)
+		return nil, false
+	}
+	return user, true
+}
+
+// acceptSocketはWebSocketにアップグレードし、プロトコルのバージョンと参加のフックを確認する
+// 参加できない場合は理由を送信して接続を閉じ、偽を返す
+func acceptSocket(w http.ResponseWriter, req *http.Request, room string, user ChatUser) (*websocket.Conn, int, bool) {
+	logger := requestLogger(req)
 	socket, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
-		log.Fatal("ServeHTTP:", err)
-		return
+		logger.Println("ServeHTTP:", err)
+		return nil, 0, false
 	}
-	authCookie, err := req.Cookie("auth")
+	version, err := versionFromRequest(req)
 	if err != nil {
-		log.Fatal("Cookieの取得に失敗しました:", err)
+		socket.WriteJSON(errorEvent(errUnsupportedVersion, err.Error()))
+		socket.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, "unsupported protocol version"), time.Now().Add(closeWriteWait))
+		socket.Close()
+		return nil, 0, false
+	}
+	if err := runJoinHooks(room, user); err != nil {
+		logger.Println("ルームへの参加を拒否しました:", err)
+		socket.WriteJSON(errorMessage(err.Error()))
+		socket.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rejected"), time.Now().Add(closeWriteWait))
+		socket.Close()
+		return nil, 0, false
+	}
+	return socket, features.capVersion(version, room, user.UniqueID()), true
+}
+
+// serveSocketはアップグレードした接続をルームに参加させ、切断されるまで送受信する
+func (r *room) serveSocket(socket *websocket.Conn, req *http.Request, user ChatUser, version int) {
+	logger := requestLogger(req)
+	caps := capabilitiesFromRequest(req)
+	if !features.Enabled(featureBatch, r.name, user.UniqueID()) {
+		delete(caps, capBatch)
+	}
+	ip := clientIP(req)
+	if !connLimits.acquire(ip) {
+		// ブラウザはアップグレード前のHTTPのステータスを読めないため、接続してから理由を付けて閉じる
+		logger.Println("接続数の上限に達したため接続を拒否しました:", ip)
+		socket.WriteJSON(overloadedEvent("接続数が上限に達しています。しばらくしてから再接続してください。"))
+		socket.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, defaultBackoff().closeReason("too many connections")), time.Now().Add(closeWriteWait))
+		socket.Close()
 		return
 	}
+	defer connLimits.release(ip)
+	activeConnections.Add(1)
+	defer activeConnections.Add(-1)
 	client := &client{
-		socket:   socket,
-		send:     make(chan *message, messageBufferSize),
-		room:     r,
-		userData: objx.MustFromBase64(authCookie.Value),
+		id:        randomID(),
+		socket:    socket,
+		send:      make(chan *message, *clientSendBuffer),
+		room:      r,
+		userData:  userData(user),
+		requestID: requestIDFromContext(req.Context()),
+		version:   version,
+		caps:      caps,
+	}
+	welcome := welcomeEvent(version, r.name, user.UniqueID())
+	if caps[capAck] {
+		// 接続ごとに番号を付けて送信するため、共有するフレームにはまとめない
+		delete(caps, capBatch)
+		client.stream = ackedStreams.open(req.URL.Query().Get("resume"), user.UniqueID(), r.name, client.id, time.Now())
+		defer func() { ackedStreams.release(client.stream, client.id, time.Now()) }()
+		welcome.Stream = client.stream.id
 	}
-	r.join <- client
-	defer func() { r.leave <- client }()
+	// 参加する前なので、sendには他のゴルーチンから書き込まれない
+	client.send <- welcome
+	select {
+	case r.join <- client:
+	case <-r.done:
+		client.close(websocket.CloseGoingAway, "server shutdown")
+		return
+	}
+	defer func() {
+		select {
+		case r.leave <- client:
+		case <-r.done:
+		}
+	}()
 	go client.write()
+	if a := announcements.Current(time.Now()); a != nil {
+		client.reply(a)
+	}
+	if *onboardingTip != "" {
+		client.ephemeral(*onboardingTip)
+	}
+	recordVisit(r.name, user.UniqueID(), ip)
+	client.sendWelcome()
 	client.read()
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRoomWithTestClient(t *testing.T) {
+	fake := newFakeAvatar().set("u1", "http://example.com/u1.png")
+	defer func(old Avatar) { avatars = old }(avatars)
+	avatars = fake
+	if err := sessions.Create(&Session{ID: "chattest-session", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.Delete("chattest-session")
+
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	mux := http.NewServeMux()
+	mux.Handle("/room", MustAuth(rooms))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	user := &fakeUser{id: "u1", name: "アリス"}
+	c, err := dialRoom(server.URL, url.Values{"room": {"chattest"}}, authCookie(user, "chattest-session"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if _, err := c.expect(typeWelcome); err != nil {
+		t.Fatal("接続直後にwelcomeを受信するべきです:", err)
+	}
+	if err := c.send("こんにちは"); err != nil {
+		t.Fatal(err)
+	}
+	e, err := c.expect(typeChat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Message != "こんにちは" || e.Name != "アリス" || e.Room != "chattest" {
+		t.Errorf("投稿したメッセージが配信されるべきです: %+v", e)
+	}
+	if e.AvatarURL != "http://example.com/u1.png" {
+		t.Errorf("AvatarのURLが使われるべきです: %s", e.AvatarURL)
+	}
+}
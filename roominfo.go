@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ルームの情報の最大長 (文字数)
+const (
+	maxRoomTopicLength       = 250
+	maxRoomDescriptionLength = 2000
+)
+
+var (
+	// ErrRoomInfoNotFound ルームの情報が保存されていない場合に発生するエラー
+	ErrRoomInfoNotFound = errors.New("chat: ルームの情報が見つかりません。")
+	// ErrInvalidRoomInfo ルームのトピック、説明、歓迎メッセージ、アイコンの指定が不正な場合に発生するエラー
+	ErrInvalidRoomInfo = errors.New("chat: ルームのトピック、説明、歓迎メッセージのいずれかが長すぎるか、アイコンのURLが不正です。")
+)
+
+// RoomInfo オーナーとモデレーターが変更できるルームの表示用の情報
+type RoomInfo struct {
+	Name        string `json:"name"`
+	Topic       string `json:"topic"`
+	Description string `json:"description"`
+	IconURL     string `json:"icon_url"`
+	// Welcomeは初めて参加したユーザーにだけ表示する歓迎メッセージ (renderWelcomeを参照)
+	Welcome string `json:"welcome,omitempty"`
+	// Privateが真の場合はルームの一覧に表示しない
+	Private bool `json:"private"`
+	// Archivedが真の場合は読み取り専用になり、接続できず、既定ではルームの一覧に表示しない
+	Archived  bool      `json:"archived"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+	// Settingsは管理者が変更するルームの設定。オーナーやIPアドレスのリストを含むため公開しない
+	Settings roomSettings `json:"-"`
+}
+
+// validate 長さとアイコンのURLを検証する。アイコンはhttp(s)のURLかサイト内のパスだけを受け付ける
+func (info *RoomInfo) validate() error {
+	if utf8.RuneCountInString(info.Topic) > maxRoomTopicLength || utf8.RuneCountInString(info.Description) > maxRoomDescriptionLength {
+		return ErrInvalidRoomInfo
+	}
+	if !validWelcome(info.Welcome) {
+		return ErrInvalidRoomInfo
+	}
+	if info.IconURL == "" {
+		return nil
+	}
+	if strings.HasPrefix(info.IconURL, "/") && !strings.HasPrefix(info.IconURL, "//") {
+		return nil
+	}
+	u, err := url.Parse(info.IconURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return ErrInvalidRoomInfo
+	}
+	return nil
+}
+
+// RoomStore ルームの情報を保存する
+type RoomStore interface {
+	// Get 名前でルームの情報を取得する
+	// *見つからない場合にはErrRoomInfoNotFoundを返す
+	Get(name string) (*RoomInfo, error)
+	// Save ルームの情報を作成または更新する
+	Save(info *RoomInfo) error
+	// List 保存されているすべてのルームの情報を名前順に返す
+	List() ([]*RoomInfo, error)
+	// Delete ルームの情報を削除する。保存されていない場合は何もしない
+	Delete(name string) error
+}
+
+// memoryRoomStore メモリ上にルームの情報を保持するRoomStore
+type memoryRoomStore struct {
+	mu    sync.RWMutex
+	rooms map[string]*RoomInfo
+}
+
+func newMemoryRoomStore() *memoryRoomStore {
+	return &memoryRoomStore{rooms: make(map[string]*RoomInfo)}
+}
+
+func (s *memoryRoomStore) Get(name string) (*RoomInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info, ok := s.rooms[name]
+	if !ok {
+		return nil, ErrRoomInfoNotFound
+	}
+	copied := *info
+	return &copied, nil
+}
+
+func (s *memoryRoomStore) Save(info *RoomInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *info
+	s.rooms[info.Name] = &stored
+	return nil
+}
+
+func (s *memoryRoomStore) List() ([]*RoomInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]*RoomInfo, 0, len(s.rooms))
+	for _, info := range s.rooms {
+		copied := *info
+		list = append(list, &copied)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func (s *memoryRoomStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rooms, name)
+	return nil
+}
+
+// roomInfoHandler ルームの情報のAPI
+// GET /api/rooms          公開されているルームの一覧を返す (roomDirectoryを参照。archived=trueでアーカイブも含める)
+// GET /api/rooms/{room}   ルームの情報を返す
+// PUT /api/rooms/{room}   JSONでルームの情報を更新する (オーナーとモデレーターのみ)
+// POST /api/rooms/{room}/archive  ルームをアーカイブする (serveArchiveを参照)
+// /api/rooms/{room}/rules  自動応答のルール (serveAutoRulesを参照)
+// GET /api/rooms/{room}/stats はstatsに渡す
+type roomInfoHandler struct {
+	rooms *roomRegistry
+	stats http.Handler
+}
+
+func (h *roomInfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/rooms"), "/")
+	if strings.HasSuffix(name, "/stats") {
+		h.stats.ServeHTTP(w, r)
+		return
+	}
+	if room, ok := strings.CutSuffix(name, "/archive"); ok && validRoomName(room) {
+		h.serveArchive(w, r, room)
+		return
+	}
+	if room, rest, ok := strings.Cut(name, "/rules"); ok && validRoomName(room) && (rest == "" || strings.HasPrefix(rest, "/")) {
+		h.serveAutoRules(w, r, room, strings.Trim(rest, "/"))
+		return
+	}
+	if name == "" {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		h.list(w, r)
+		return
+	}
+	if !validRoomName(name) {
+		writeJSONError(w, r, ErrInvalidRoomName.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, roomInfo(name))
+	case http.MethodPut:
+		h.update(w, r, name)
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
+
+// roomInfo ルームの情報を返す。保存されていない場合は名前だけを返す
+func roomInfo(name string) *RoomInfo {
+	info, err := roomInfos.Get(name)
+	if err != nil {
+		return &RoomInfo{Name: name}
+	}
+	return info
+}
+
+func (h *roomInfoHandler) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	order := q.Get("sort")
+	if order == "" {
+		order = sortRoomsByName
+	}
+	list, err := roomDirectory(h.rooms, q.Get("q"), order, q.Get("archived") == "true")
+	if err == ErrInvalidRoomSort {
+		writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Println("ルームの一覧を取得できませんでした:", err)
+		writeJSONError(w, r, "ルームの一覧を取得できませんでした", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (h *roomInfoHandler) update(w http.ResponseWriter, r *http.Request, name string) {
+	user, _ := userFromContext(r.Context())
+	rm, err := h.rooms.existing(name)
+	if err == ErrRoomNotFound {
+		writeJSONError(w, r, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !rm.canManage(user.UniqueID()) {
+		writeJSONError(w, r, "ルームの情報を変更できるのはオーナーとモデレーターだけです", http.StatusForbidden)
+		return
+	}
+	var info RoomInfo
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		writeJSONError(w, r, "ルームの情報の形式が不正です", http.StatusBadRequest)
+		return
+	}
+	if err := info.validate(); err != nil {
+		writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// アーカイブの状態と設定はserveArchiveと管理者のAPIだけで変更する
+	stored := roomInfo(name)
+	info.Archived, info.Settings = stored.Archived, stored.Settings
+	info.Name, info.UpdatedBy, info.UpdatedAt = name, user.UniqueID(), time.Now()
+	if err := roomInfos.Save(&info); err != nil {
+		requestLogger(r).Println("ルームの情報を保存できませんでした:", err)
+		writeJSONError(w, r, "ルームの情報を保存できませんでした", http.StatusInternalServerError)
+		return
+	}
+	rm.Broadcast(&message{
+		Type:     typeRoomUpdated,
+		ID:       randomID(),
+		Room:     name,
+		UserID:   user.UniqueID(),
+		Name:     user.Name(),
+		When:     info.UpdatedAt,
+		RoomInfo: &info,
+	})
+	writeJSON(w, http.StatusOK, &info)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoomInfoUpdate(t *testing.T) {
+	defer func(s RoomStore, u UserStore) { roomInfos, users = s, u }(roomInfos, users)
+	roomInfos, users = newMemoryRoomStore(), newMemoryUserStore()
+	users.Create(&UserRecord{ID: "owner", Name: "Owner"})
+	users.Create(&UserRecord{ID: "member", Name: "Member"})
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	rm, _ := rooms.get("general")
+	rm.SetSettings(roomSettings{Owners: []string{"owner"}})
+	h := &roomInfoHandler{rooms: rooms}
+
+	put := func(userID, body string) int {
+		r := httptest.NewRequest("PUT", "/api/rooms/general", strings.NewReader(body))
+		r = r.WithContext(withUser(r.Context(), sessionUser{uniqueID: userID, name: userID}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := put("member", `{"topic":"x"}`); code != 403 {
+		t.Errorf("オーナー以外の変更は403になるべきところ%dでした", code)
+	}
+	if code := put("owner", `{"icon_url":"javascript:alert(1)"}`); code != 400 {
+		t.Errorf("不正なアイコンのURLは400になるべきところ%dでした", code)
+	}
+	if code := put("owner", `{"topic":"雑談","icon_url":"https://example.com/icon.png"}`); code != 200 {
+		t.Fatalf("オーナーの変更は200になるべきところ%dでした", code)
+	}
+	if info := roomInfo("general"); info.Topic != "雑談" || info.UpdatedBy != "owner" {
+		t.Errorf("ルームの情報が保存されていません: %+v", info)
+	}
+}
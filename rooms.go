@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goki0524/gopackage/trace"
+	"github.com/gorilla/websocket"
+)
+
+// defaultRoomName ルームが指定されなかった場合に使用するルーム
+const defaultRoomName = "general"
+
+// maxRoomNameLength ルーム名の最大長
+const maxRoomNameLength = 32
+
+var (
+	maxRooms        = flag.Int("max-rooms", 10000, "1つのノードで同時に動作させるルームの最大数 (0の場合は制限しない)")
+	roomIdleTimeout = flag.Duration("room-idle-timeout", 10*time.Minute, "在室者のいないルームを終了するまでの時間 (0の場合は終了しない)")
+)
+
+var (
+	// ErrInvalidRoomName ルーム名に使用できない文字が含まれている場合に発生するエラー
+	ErrInvalidRoomName = errors.New("chat: ルーム名が不正です。")
+	// ErrRoomNotFound 動作しておらず、情報も保存されていないルームを参照した場合に発生するエラー
+	ErrRoomNotFound = errors.New("chat: ルームが見つかりません。")
+	// ErrTooManyRooms 動作中のルームの数が上限に達していて、新しいルームを生成できない場合に発生するエラー
+	ErrTooManyRooms = errors.New("chat: ルームの数が上限に達しています。しばらくしてから再試行してください。")
+)
+
+// validRoomName ルーム名として使用できるかどうかを判定する
+// 英小文字、数字、ハイフン、アンダースコアのみ使用できる
+func validRoomName(name string) bool {
+	if name == "" || len(name) > maxRoomNameLength {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// roomNameFromRequest リクエストのroomパラメーターからルーム名を返す
+func roomNameFromRequest(r *http.Request) string {
+	if name := r.URL.Query().Get("room"); name != "" {
+		return name
+	}
+	return defaultRoomName
+}
+
+// roomRegistryは名前ごとのチャットルームを管理する
+// ルームは最初に参照されたときに生成され、動作を開始する
+type roomRegistry struct {
+	mu    sync.Mutex
+	rooms map[string]*room
+	// tracerは新しく生成するルームのトレースの出力先
+	tracer trace.Tracer
+	// clusterは新しく生成するルームに設定される
+	cluster Broadcaster
+	// ctxがキャンセルされるとすべてのルームが終了する
+	ctx    context.Context
+	cancel context.CancelFunc
+	// wgは動作中のルームの数
+	wg sync.WaitGroup
+}
+
+// newRoomRegistryは空のroomRegistryを生成する
+func newRoomRegistry() *roomRegistry {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &roomRegistry{
+		rooms:  make(map[string]*room),
+		tracer: trace.Off(),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// getは指定された名前のルームを返す。存在しない場合は生成して動作を開始する
+// 任意の名前のルームを生成できるのは参加するときだけで、それ以外の操作ではexistingを使用する
+// 動作中のルームの数が-max-roomsに達している場合はErrTooManyRoomsを返す
+func (rs *roomRegistry) get(name string) (*room, error) {
+	if !validRoomName(name) {
+		return nil, ErrInvalidRoomName
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if r, ok := rs.rooms[name]; ok {
+		r.used = time.Now()
+		return r, nil
+	}
+	if *maxRooms > 0 && len(rs.rooms) >= *maxRooms {
+		return nil, ErrTooManyRooms
+	}
+	r := rs.newNamedRoom(name)
+	r.used = time.Now()
+	ctx, cancel := context.WithCancel(rs.ctx)
+	r.stop = cancel
+	rs.rooms[name] = r
+	rs.wg.Add(1)
+	go rs.supervise(ctx, r)
+	return r, nil
+}
+
+// newNamedRoomは保存されている情報と設定を読み込んだルームを生成する。動作は開始しない
+func (rs *roomRegistry) newNamedRoom(name string) *room {
+	info := roomInfo(name)
+	r := newRoom()
+	r.name = name
+	r.tracer = newRoomTracer(name, rs.tracer)
+	r.cluster = rs.cluster
+	r.archived.Store(info.Archived)
+	r.settings = info.Settings
+	return r
+}
+
+// existingは動作中か、情報が保存されているルームを返す
+// 参加以外の操作で任意の名前のルームが生成されないように、どちらでもない場合はErrRoomNotFoundを返す
+func (rs *roomRegistry) existing(name string) (*room, error) {
+	if !validRoomName(name) {
+		return nil, ErrInvalidRoomName
+	}
+	if r, ok := rs.lookup(name); ok {
+		return r, nil
+	}
+	if _, err := roomInfos.Get(name); err != nil {
+		return nil, ErrRoomNotFound
+	}
+	return rs.get(name)
+}
+
+// removeはルームを終了して登録を解除する。次に参照されたときは新しいルームとして生成される
+func (rs *roomRegistry) remove(name string) {
+	rs.mu.Lock()
+	r, ok := rs.rooms[name]
+	delete(rs.rooms, name)
+	rs.mu.Unlock()
+	if ok {
+		r.stop()
+		<-r.done
+	}
+}
+
+// reapIdleはrs.ctxがキャンセルされるまで、在室者がおらずidleの間参照されていないルームを定期的に終了する
+// 終了したルームは次に参加されたときに生成し直すため、-max-roomsの枠が空く
+func (rs *roomRegistry) reapIdle(idle time.Duration) {
+	if idle <= 0 {
+		return
+	}
+	ticker := time.NewTicker(idle / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.ctx.Done():
+			return
+		case now := <-ticker.C:
+			rs.reap(now, idle)
+		}
+	}
+}
+
+// reapはnowの時点で在室者がおらず、idleの間参照されていないルームを終了して登録を解除する
+// 参加しようとしているクライアントはgetで参照した時刻を更新しているため、終了の対象にならない
+func (rs *roomRegistry) reap(now time.Time, idle time.Duration) int {
+	rs.mu.Lock()
+	var idleRooms []*room
+	for name, r := range rs.rooms {
+		if now.Sub(r.used) >= idle && r.stats.snapshot(name, now).Clients == 0 {
+			delete(rs.rooms, name)
+			idleRooms = append(idleRooms, r)
+		}
+	}
+	rs.mu.Unlock()
+	for _, r := range idleRooms {
+		r.stop()
+		<-r.done
+	}
+	return len(idleRooms)
+}
+
+// roomRestartWait 異常終了したルームを再起動するまでの待ち時間
+const roomRestartWait = time.Second
+
+// superviseはルームを動作させ、パニックで異常終了した場合は再起動する
+// 在室者の情報はルームに残っているため、再起動後もそのまま配信を続けられる
+func (rs *roomRegistry) supervise(ctx context.Context, r *room) {
+	defer rs.wg.Done()
+	for !r.runSafely(ctx) {
+		time.Sleep(roomRestartWait)
+	}
+}
+
+// runSafelyはルームを動作させ、正常に終了した場合は真を、パニックした場合は偽を返す
+func (r *room) runSafely(ctx context.Context) (stopped bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			r.logger().Printf("ルームが異常終了したため再起動します: %v\n%s", p, debug.Stack())
+			reportPanic(p, map[string]string{"room": r.name})
+		}
+	}()
+	r.Run(ctx)
+	return true
+}
+
+// Shutdownはすべてのルームを終了し、クライアントが切断されるまで待つ
+func (rs *roomRegistry) Shutdown() {
+	rs.cancel()
+	rs.wg.Wait()
+}
+
+// joinClusterは他のノードとイベントを中継する。ルームを生成する前に呼び出す
+func (rs *roomRegistry) joinCluster(b Broadcaster) error {
+	rs.cluster = b
+	return b.Subscribe(func(kind string, msg *message) {
+		switch kind {
+		case clusterDirect:
+			rs.sendToUserLocal(msg)
+			return
+		case clusterKick:
+			rs.kickLocal(msg.UserID, msg.Message)
+			return
+		}
+		switch msg.Type {
+		case typeAnnouncement:
+			rs.announceLocal(msg)
+			return
+		case typeStatus:
+			rs.setStatusLocal(msg)
+			return
+		}
+		// このノードで動作していないルームには在室者がいないため、中継のためにルームを生成しない
+		r, ok := rs.lookup(msg.Room)
+		if !ok {
+			return
+		}
+		r.sendRelay(msg)
+	})
+}
+
+// allは生成済みのすべてのルームを返す
+func (rs *roomRegistry) all() []*room {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	list := make([]*room, 0, len(rs.rooms))
+	for _, r := range rs.rooms {
+		list = append(list, r)
+	}
+	return list
+}
+
+// ServeHTTP roomパラメーターで指定されたルームにWebSocketで接続する
+// 接続を確認するだけのリクエストでルームが増えないように、動作していないルームは
+// 保存されている設定で確認し、アップグレードと参加のフックが成功してから生成する
+func (rs *roomRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if drain.Draining() {
+		httpError(w, req, "このサーバーは終了処理中です", http.StatusServiceUnavailable)
+		return
+	}
+	name := roomNameFromRequest(req)
+	if !validRoomName(name) {
+		httpError(w, req, ErrInvalidRoomName.Error(), http.StatusBadRequest)
+		return
+	}
+	r, ok := rs.lookup(name)
+	if !ok {
+		r = rs.newNamedRoom(name)
+	}
+	user, ok := r.checkRequest(w, req)
+	if !ok {
+		return
+	}
+	socket, version, ok := acceptSocket(w, req, name, user)
+	if !ok {
+		return
+	}
+	r, err := rs.get(name)
+	if err != nil {
+		// ブラウザはアップグレード前のHTTPのステータスを読めないため、接続してから理由を付けて閉じる
+		requestLogger(req).Println("ルームを生成できないため接続を拒否しました:", err)
+		socket.WriteJSON(overloadedEvent(err.Error()))
+		socket.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, defaultBackoff().closeReason("too many rooms")), time.Now().Add(closeWriteWait))
+		socket.Close()
+		return
+	}
+	r.serveSocket(socket, req, user, version)
+}
+
+// Notify すべてのルームの指定されたユーザーのクライアントにシステムメッセージを送信する
+func (rs *roomRegistry) Notify(userID, text string) {
+	rs.sendToUser(&message{ID: randomID(), UserID: userID, Name: systemName, Message: text, When: time.Now()})
+}
+
+// NotifyEvent すべてのルームの指定されたユーザー(msg.UserID)のクライアントにお知らせのイベントを送信する
+func (rs *roomRegistry) NotifyEvent(msg *message) {
+	rs.sendToUser(msg)
+}
+
+// sendToUser すべてのルームの指定されたユーザー(msg.UserID)のクライアントにイベントを送信する
+// ユーザーは他のノードに接続していることもあるため、他のノードにも中継する
+func (rs *roomRegistry) sendToUser(msg *message) {
+	rs.sendToUserLocal(msg)
+	if rs.cluster != nil {
+		if err := rs.cluster.Publish(clusterDirect, msg); err != nil {
+			reporter.Report(err, map[string]string{"op": "direct"})
+		}
+	}
+}
+
+// sendToUserLocal このノードのすべてのルームの指定されたユーザーのクライアントにイベントを送信する
+func (rs *roomRegistry) sendToUserLocal(msg *message) {
+	for _, r := range rs.all() {
+		copied := *msg
+		copied.Room = r.name
+		r.sendDirect(&copied)
+	}
+}
+
+// Kick すべてのルームから指定されたユーザーを退出させる
+// 他のノードに接続しているクライアントも退出させる
+func (rs *roomRegistry) Kick(userID, reason string) {
+	rs.kickLocal(userID, reason)
+	if rs.cluster != nil {
+		if err := rs.cluster.Publish(clusterKick, &message{UserID: userID, Message: reason, When: time.Now()}); err != nil {
+			reporter.Report(err, map[string]string{"op": "kick"})
+		}
+	}
+}
+
+// kickLocal このノードのすべてのルームから指定されたユーザーを退出させる
+func (rs *roomRegistry) kickLocal(userID, reason string) {
+	for _, r := range rs.all() {
+		r.Kick(userID, reason)
+	}
+}
+
+// Broadcast msg.Roomで指定されたルームにイベントを送信する
+func (rs *roomRegistry) Broadcast(msg *message) {
+	rs.mu.Lock()
+	r, ok := rs.rooms[msg.Room]
+	rs.mu.Unlock()
+	if ok {
+		r.Broadcast(msg)
+	}
+}
+
+// deliverLocal このノードのすべてのルームのクライアントにイベントを配信する
+// 保存や他のノードへの中継は行わない
+func (rs *roomRegistry) deliverLocal(msg *message) {
+	for _, r := range rs.all() {
+		copied := *msg
+		copied.Room = r.name
+		r.sendRelay(&copied)
+	}
+}
+
+// roomSettings 管理者が変更できるルームの設定
+type roomSettings struct {
+	// ReadOnlyが真の場合、オーナーとモデレーター以外は投稿できない
+	ReadOnly bool     `json:"read_only"`
+	Owners   []string `json:"owners"`
+	// Backpressureは送信バッファが一杯になったクライアントへの対応。空の場合は切断する
+	Backpressure string `json:"backpressure,omitempty"`
+	// BackpressureLimitはdisconnect-after-nで切断するまでに破棄できるイベントの数
+	BackpressureLimit int `json:"backpressure_limit,omitempty"`
+	// MaxClientsはこのノードで同時に在室できるクライアントの数。0の場合は-room-max-clientsに従う
+	MaxClients int `json:"max_clients,omitempty"`
+	// WaitingListが真の場合、定員に達したルームへの接続は拒否せずに空きができるまで待機させる
+	WaitingList bool `json:"waiting_list,omitempty"`
+	// SuppressJoinLeaveが真の場合は参加・退室のお知らせを送信しない
+	SuppressJoinLeave bool `json:"suppress_join_leave,omitempty"`
+	// IPAllowとIPDenyはこのルームへの接続を許可・拒否するIPアドレスまたはCIDR。全体のリストに加えて適用する
+	IPAllow []string `json:"ip_allow,omitempty"`
+	IPDeny  []string `json:"ip_deny,omitempty"`
+}
+
+// roomAdminHandler 管理者用のルームの設定API
+// GET /api/admin/rooms/{room}  設定を返す
+// PUT /api/admin/rooms/{room}  JSONで設定を更新する
+// DELETE /api/admin/rooms/{room}  アーカイブされたルームを完全に削除する
+// GET|PUT /api/admin/rooms/{room}/trace  トレースの出力を切り替える
+// POST|DELETE /api/admin/rooms/{room}/archive  アーカイブする・アーカイブを解除する
+type roomAdminHandler struct {
+	rooms *roomRegistry
+}
+
+func (h *roomAdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/rooms"), "/")
+	name, sub, _ := strings.Cut(path, "/")
+	rm, err := h.rooms.existing(name)
+	if err != nil {
+		writeJSONError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	switch sub {
+	case "":
+	case "trace":
+		h.serveTrace(w, r, rm)
+		return
+	case "archive":
+		h.serveArchive(w, r, rm)
+		return
+	default:
+		writeJSONError(w, r, "見つかりません", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, rm.Settings())
+	case http.MethodPut:
+		var settings roomSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			writeJSONError(w, r, "設定の形式が不正です", http.StatusBadRequest)
+			return
+		}
+		if !validBackpressure(settings.Backpressure) {
+			writeJSONError(w, r, ErrInvalidBackpressure.Error(), http.StatusBadRequest)
+			return
+		}
+		if settings.MaxClients < 0 {
+			writeJSONError(w, r, "max_clientsには0以上を指定してください", http.StatusBadRequest)
+			return
+		}
+		if _, err := newIPFilter(IPRules{Allow: settings.IPAllow, Deny: settings.IPDeny}); err != nil {
+			writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// 再起動後も同じ設定で動作するように保存してから反映する
+		info := roomInfo(rm.name)
+		info.Settings = settings
+		if err := roomInfos.Save(info); err != nil {
+			requestLogger(r).Println("ルームの設定を保存できませんでした:", err)
+			writeJSONError(w, r, "ルームの設定を保存できませんでした", http.StatusInternalServerError)
+			return
+		}
+		rm.SetSettings(settings)
+		admin, _ := userFromContext(r.Context())
+		auditRequest(r, auditAdminAction, admin.UniqueID(), rm.name, map[string]string{"action": "room_settings"})
+		writeJSON(w, http.StatusOK, rm.Settings())
+	case http.MethodDelete:
+		n, err := purgeRoom(h.rooms, rm.name)
+		if err == ErrRoomNotArchived {
+			writeJSONError(w, r, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			requestLogger(r).Println("ルームを削除できませんでした:", err)
+			writeJSONError(w, r, "ルームを削除できませんでした", http.StatusInternalServerError)
+			return
+		}
+		admin, _ := userFromContext(r.Context())
+		auditRequest(r, auditAdminAction, admin.UniqueID(), rm.name, map[string]string{"action": "room_purge", "messages": strconv.Itoa(n)})
+		writeJSON(w, http.StatusOK, map[string]int{"deleted_messages": n})
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
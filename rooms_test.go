@@ -0,0 +1,289 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// capturingBroadcaster 他のノードからの受信を再現するためにhandlerを保持し、送信したイベントを記録するBroadcaster
+type capturingBroadcaster struct {
+	handler   func(string, *message)
+	published []string
+}
+
+func (b *capturingBroadcaster) Publish(kind string, msg *message) error {
+	b.published = append(b.published, kind+":"+msg.UserID)
+	return nil
+}
+func (b *capturingBroadcaster) Subscribe(handler func(string, *message)) error {
+	b.handler = handler
+	return nil
+}
+func (b *capturingBroadcaster) Close() error { return nil }
+
+func TestRoomRegistryCreatesRoomsOnlyWhenJoining(t *testing.T) {
+	defer func(n int) { *maxRooms = n }(*maxRooms)
+	*maxRooms = 2
+	defer func(s RoomStore) { roomInfos = s }(roomInfos)
+	roomInfos = newMemoryRoomStore()
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	cluster := &capturingBroadcaster{}
+	if err := rooms.joinCluster(cluster); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rooms.existing("nowhere"); err != ErrRoomNotFound {
+		t.Errorf("存在しないルームはErrRoomNotFoundを返すべきです: %v", err)
+	}
+	cluster.handler(clusterBroadcast, &message{Type: typeChat, ID: "m1", Room: "relayed", Message: "こんにちは"})
+	for _, name := range []string{"nowhere", "relayed"} {
+		if _, ok := rooms.lookup(name); ok {
+			t.Errorf("参加以外の操作でルーム%sを生成するべきではありません", name)
+		}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"general", nil},
+		{"random", nil},
+		{"general", nil},
+		{"third", ErrTooManyRooms},
+	}
+	for _, tt := range tests {
+		if _, err := rooms.get(tt.name); err != tt.err {
+			t.Errorf("%s: %vを返すべきです: %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestRoomRegistryRelaysUserEvents(t *testing.T) {
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	cluster := &capturingBroadcaster{}
+	if err := rooms.joinCluster(cluster); err != nil {
+		t.Fatal(err)
+	}
+	rm, err := rooms.get("general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{room: rm, send: make(chan *message, messageBufferSize), userData: map[string]interface{}{"userid": "u1", "name": "Alice"}}
+	rm.join <- c
+
+	// receive 条件を満たすイベントを受信するまで待つ。送信チャネルが閉じられた場合はnilを返す
+	receive := func(match func(*message) bool) *message {
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case msg, ok := <-c.send:
+				if !ok {
+					return nil
+				}
+				if match(msg) {
+					return msg
+				}
+			case <-timeout:
+				t.Fatal("イベントが配信されませんでした")
+			}
+		}
+	}
+	cluster.handler(clusterDirect, &message{UserID: "u1", Name: systemName, Message: "お知らせ"})
+	if msg := receive(func(m *message) bool { return m.Message == "お知らせ" }); msg == nil || msg.Room != "general" {
+		t.Errorf("他のノードからのユーザー宛てのイベントは在室中のルームに配信するべきです: %+v", msg)
+	}
+	cluster.handler(clusterKick, &message{UserID: "u1", Message: "banned"})
+	if msg := receive(func(*message) bool { return false }); msg != nil || c.closeReason != "banned" {
+		t.Errorf("他のノードからの要求でユーザーを退出させるべきです: %q", c.closeReason)
+	}
+
+	rooms.Notify("u2", "お知らせ")
+	rooms.Kick("u2", "banned")
+	if got := strings.Join(cluster.published, ","); got != "direct:u2,kick:u2" {
+		t.Errorf("ユーザー宛てのイベントと退出の要求は他のノードに中継するべきです: %s", got)
+	}
+}
+
+func TestRoomRegistryCreatesRoomsAfterUpgrade(t *testing.T) {
+	defer func(n int) { *maxRooms = n }(*maxRooms)
+	*maxRooms = 1
+	defer func(s RoomStore) { roomInfos = s }(roomInfos)
+	roomInfos = newMemoryRoomStore()
+	if err := sessions.Create(&Session{ID: "rooms-session", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.Delete("rooms-session")
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	mux := http.NewServeMux()
+	mux.Handle("/room", MustAuth(rooms))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	cookie := authCookie(&fakeUser{id: "u1", name: "アリス"}, "rooms-session")
+
+	// アップグレードしないリクエストやバージョンが不正な接続ではルームを生成しない
+	req, _ := http.NewRequest("GET", server.URL+"/room?room=probe", nil)
+	req.AddCookie(cookie)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if c, err := dialRoom(server.URL, url.Values{"room": {"versioned"}, "v": {"abc"}}, cookie); err == nil {
+		c.expect(typeError)
+		c.close()
+	}
+	for _, name := range []string{"probe", "versioned"} {
+		if _, ok := rooms.lookup(name); ok {
+			t.Errorf("参加できなかった接続でルーム%sを生成するべきではありません", name)
+		}
+	}
+
+	c, err := dialRoom(server.URL, url.Values{"room": {"general"}}, cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.expect(typeWelcome); err != nil {
+		t.Fatal(err)
+	}
+	second, err := dialRoom(server.URL, url.Values{"room": {"second"}}, cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := second.expect(typeError); err != nil || e.Code != errOverloaded {
+		t.Errorf("ルームの数が上限に達している場合は過負荷のエラーを返すべきです: %+v, %v", e, err)
+	}
+	if _, _, err := second.conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Errorf("再試行を促して切断するべきです: %v", err)
+	}
+	second.close()
+
+	rm, _ := rooms.lookup("general")
+	if n := rooms.reap(time.Now().Add(time.Hour), time.Minute); n != 0 {
+		t.Errorf("在室者のいるルームは終了するべきではありません: %d", n)
+	}
+	c.close()
+	for deadline := time.Now().Add(2 * time.Second); rm.stats.snapshot("general", time.Now()).Clients > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := rooms.reap(time.Now(), time.Minute); n != 0 {
+		t.Errorf("参照されたばかりのルームは終了するべきではありません: %d", n)
+	}
+	if n := rooms.reap(time.Now().Add(time.Hour), time.Minute); n != 1 {
+		t.Errorf("在室者のいないルームを終了するべきところ%d件でした", n)
+	}
+	c, err = dialRoom(server.URL, url.Values{"room": {"second"}}, cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if _, err := c.expect(typeWelcome); err != nil {
+		t.Errorf("ルームを終了した後は新しいルームに参加できるべきです: %v", err)
+	}
+}
+
+func TestRoomSettingsPersist(t *testing.T) {
+	defer func(s RoomStore) { roomInfos = s }(roomInfos)
+	roomInfos = newMemoryRoomStore()
+	defer func(s UserStore) { users = s }(users)
+	users = newMemoryUserStore()
+	users.Create(&UserRecord{ID: "owner", Name: "Owner"})
+	rooms := newRoomRegistry()
+	if _, err := rooms.get("general"); err != nil {
+		t.Fatal(err)
+	}
+	admin := &roomAdminHandler{rooms: rooms}
+	r := httptest.NewRequest("PUT", "/api/admin/rooms/general", strings.NewReader(`{"read_only": true, "owners": ["owner"]}`))
+	r = r.WithContext(withUser(r.Context(), sessionUser{uniqueID: "admin"}))
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("設定を更新できるべきところ%dでした", w.Code)
+	}
+	r = httptest.NewRequest("PUT", "/api/rooms/general", strings.NewReader(`{"topic": "雑談"}`))
+	r = r.WithContext(withUser(r.Context(), sessionUser{uniqueID: "owner"}))
+	w = httptest.NewRecorder()
+	(&roomInfoHandler{rooms: rooms}).ServeHTTP(w, r)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "read_only") {
+		t.Errorf("オーナーが情報を更新でき、設定は公開するべきではありません: %d %s", w.Code, w.Body)
+	}
+	rooms.Shutdown()
+
+	// 再起動後のルームは保存した設定で動作する
+	restarted := newRoomRegistry()
+	defer restarted.Shutdown()
+	rm, err := restarted.get("general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings := rm.Settings(); !settings.ReadOnly || len(settings.Owners) != 1 || rm.canPost("someone") {
+		t.Errorf("保存した設定を読み込むべきです: %+v", settings)
+	}
+	if info := roomInfo("general"); info.Topic != "雑談" {
+		t.Errorf("情報の更新で設定以外も保存するべきです: %+v", info)
+	}
+}
+
+func TestRoomRestartsAfterPanic(t *testing.T) {
+	defer func(r ErrorReporter) { reporter = r }(reporter)
+	rec := newRecordingReporter()
+	reporter = rec
+	if err := sessions.Create(&Session{ID: "restart-session", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.Delete("restart-session")
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	mux := http.NewServeMux()
+	mux.Handle("/room", MustAuth(rooms))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	cookie := authCookie(&fakeUser{id: "u1", name: "アリス"}, "restart-session")
+	var clients []*testClient
+	for i := 0; i < 2; i++ {
+		c, err := dialRoom(server.URL, url.Values{"room": {"general"}}, cookie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.close()
+		if _, err := c.expect(typeWelcome); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+	}
+
+	// 退出させる対象がnilのためルームの処理がパニックする
+	rm, _ := rooms.lookup("general")
+	rm.kick <- nil
+	select {
+	case <-rec.report:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ルームのパニックを報告するべきです")
+	}
+	if rec.tags[0]["room"] != "general" {
+		t.Errorf("ルーム名を付けて報告するべきです: %v", rec.tags[0])
+	}
+	if rooms.all()[0] != rm {
+		t.Error("パニックしたルームを登録から外すべきではありません")
+	}
+
+	// 再起動後も在室者はそのまま配信を受け取れる
+	clients[0].timeout = roomRestartWait + 2*time.Second
+	if err := clients[1].send("再起動しました"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := clients[0].expect(typeChat); err != nil || msg.Message != "再起動しました" {
+		t.Errorf("再起動したルームで在室者に配信するべきです: %+v, %v", msg, err)
+	}
+	if stats := rm.stats.snapshot("general", time.Now()); stats.Clients != 2 {
+		t.Errorf("再起動しても在室者を保持するべきところ%d人でした", stats.Clients)
+	}
+}
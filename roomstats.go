@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RoomStats ある時点のルームの統計情報
+type RoomStats struct {
+	Room    string `json:"room"`
+	Clients int    `json:"clients"`
+	// MessagesPerMinuteは直近1分間に投稿されたメッセージの数
+	MessagesPerMinute int64 `json:"messages_per_minute"`
+	Messages          int64 `json:"messages"`
+	// BytesBroadcastはクライアントに送信したフレームの合計バイト数
+	BytesBroadcast int64      `json:"bytes_broadcast"`
+	Uptime         float64    `json:"uptime_seconds"`
+	StartedAt      time.Time  `json:"started_at"`
+	LastActivity   *time.Time `json:"last_activity,omitempty"`
+}
+
+// roomStats ルームの統計情報を集計する
+// room.runのゴルーチンが更新し、他のゴルーチンはsnapshotで参照する
+type roomStats struct {
+	mu           sync.Mutex
+	started      time.Time
+	lastActivity time.Time
+	clients      int
+	messages     int64
+	bytes        int64
+	// recentは直近1分間の1秒ごとの投稿数。recentAtは各要素の時刻(Unix秒)
+	recent   [60]int64
+	recentAt [60]int64
+}
+
+func newRoomStats() *roomStats {
+	return &roomStats{started: time.Now()}
+}
+
+// setClientsは在室しているクライアントの数を記録する
+func (s *roomStats) setClients(n int) {
+	s.mu.Lock()
+	s.clients = n
+	s.mu.Unlock()
+}
+
+// messageは投稿されたメッセージを1件記録する
+func (s *roomStats) message(now time.Time) {
+	sec := now.Unix()
+	i := sec % int64(len(s.recent))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.recentAt[i] != sec {
+		s.recent[i], s.recentAt[i] = 0, sec
+	}
+	s.recent[i]++
+	s.messages++
+	s.lastActivity = now
+}
+
+// sentはクライアントに送信したフレームのバイト数を記録する
+func (s *roomStats) sent(n int64) {
+	if n <= 0 {
+		return
+	}
+	s.mu.Lock()
+	s.bytes += n
+	s.mu.Unlock()
+}
+
+// snapshotは統計情報の複製を返す。どのゴルーチンからでも呼び出せる
+func (s *roomStats) snapshot(name string, now time.Time) RoomStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := RoomStats{
+		Room:           name,
+		Clients:        s.clients,
+		Messages:       s.messages,
+		BytesBroadcast: s.bytes,
+		Uptime:         now.Sub(s.started).Seconds(),
+		StartedAt:      s.started,
+	}
+	for i, at := range s.recentAt {
+		if now.Unix()-at < int64(len(s.recent)) {
+			stats.MessagesPerMinute += s.recent[i]
+		}
+	}
+	if !s.lastActivity.IsZero() {
+		last := s.lastActivity
+		stats.LastActivity = &last
+	}
+	return stats
+}
+
+// Stats ルームの統計情報を返す
+func (r *room) Stats() RoomStats {
+	return r.stats.snapshot(r.name, time.Now())
+}
+
+// lookupは生成済みのルームを返す。存在しない場合は生成しない
+func (rs *roomRegistry) lookup(name string) (*room, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	r, ok := rs.rooms[name]
+	return r, ok
+}
+
+// roomStatsHandler ルームの統計情報を返すAPI
+// GET /api/rooms/{room}/stats
+type roomStatsHandler struct {
+	rooms *roomRegistry
+}
+
+func (h *roomStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/rooms"), "/")
+	if !strings.HasSuffix(path, "/stats") {
+		writeJSONError(w, r, "見つかりません", http.StatusNotFound)
+		return
+	}
+	name := strings.TrimSuffix(path, "/stats")
+	if !validRoomName(name) {
+		writeJSONError(w, r, ErrInvalidRoomName.Error(), http.StatusBadRequest)
+		return
+	}
+	rm, ok := h.rooms.lookup(name)
+	if !ok {
+		writeJSONError(w, r, "ルームが見つかりません", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, rm.Stats())
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRoomStatsSnapshot(t *testing.T) {
+	s := newRoomStats()
+	now := time.Now()
+	s.message(now.Add(-90 * time.Second))
+	s.message(now.Add(-30 * time.Second))
+	s.message(now.Add(-30 * time.Second))
+	s.message(now)
+	s.sent(100)
+	s.sent(-1)
+	s.setClients(3)
+
+	stats := s.snapshot("general", now)
+	if stats.Room != "general" || stats.Clients != 3 || stats.Messages != 4 || stats.BytesBroadcast != 100 {
+		t.Errorf("記録した値を返すべきです: %+v", stats)
+	}
+	if stats.MessagesPerMinute != 3 {
+		t.Errorf("直近1分間の投稿だけを数えるべきところ%dでした", stats.MessagesPerMinute)
+	}
+	if stats.LastActivity == nil || !stats.LastActivity.Equal(now) {
+		t.Errorf("最後の投稿の時刻を返すべきです: %v", stats.LastActivity)
+	}
+	if later := s.snapshot("general", now.Add(2*time.Minute)); later.MessagesPerMinute != 0 {
+		t.Errorf("1分より前の投稿は数えるべきではありません: %d", later.MessagesPerMinute)
+	}
+	if idle := newRoomStats().snapshot("idle", now); idle.LastActivity != nil {
+		t.Error("投稿のないルームは最後の投稿の時刻を返すべきではありません")
+	}
+}
+
+func TestRoomStatsHandler(t *testing.T) {
+	rooms := newRoomRegistry()
+	defer rooms.Shutdown()
+	if _, err := rooms.get("general"); err != nil {
+		t.Fatal(err)
+	}
+	h := &roomStatsHandler{rooms: rooms}
+	tests := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{"GET", "/api/rooms/general/stats", http.StatusOK},
+		{"GET", "/api/rooms/idle/stats", http.StatusNotFound},
+		{"GET", "/api/rooms/Bad!/stats", http.StatusBadRequest},
+		{"GET", "/api/rooms/general", http.StatusNotFound},
+		{"POST", "/api/rooms/general/stats", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != test.code {
+			t.Errorf("%s %s: %dになるべきところ%dでした", test.method, test.path, test.code, w.Code)
+		}
+		if w.Code == http.StatusOK {
+			var stats RoomStats
+			if err := json.NewDecoder(w.Body).Decode(&stats); err != nil || stats.Room != "general" {
+				t.Errorf("ルームの統計情報を返すべきです: %+v, %v", stats, err)
+			}
+		}
+	}
+	if _, ok := rooms.lookup("idle"); ok {
+		t.Error("統計情報の参照でルームを生成するべきではありません")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/goki0524/gopackage/trace"
+)
+
+var (
+	traceRooms  = flag.String("trace-rooms", "*", "起動時に詳細なトレースを出力するルームのカンマ区切りのリスト (*の場合はすべてのルーム、空の場合は出力しない)")
+	traceLevel  = flag.String("trace-level", "debug", "出力するトレースの最低の重要度 (debug, info, warn, error)")
+	traceSample = flag.Float64("trace-sample", 1, "メッセージごとのトレースを出力する割合 (0から1。0.01の場合は1%)")
+)
+
+// ErrInvalidTraceLevel トレースの重要度や出力する割合の指定が不正な場合に発生するエラー
+var ErrInvalidTraceLevel = errors.New("chat: トレースの重要度にはdebug、info、warn、errorのいずれかを、割合には0から1を指定してください。")
+
+// traceSeverity トレースの重要度
+type traceSeverity int32
+
+const (
+	// traceDebug メッセージごとの配信の詳細。-trace-sampleの割合だけ出力する
+	traceDebug traceSeverity = iota
+	// traceInfo 参加・退室などのルームの状態の変化
+	traceInfo
+	// traceWarn 特定のクライアントへの送信の失敗
+	traceWarn
+	// traceError 保存や中継の失敗
+	traceError
+)
+
+var traceSeverityNames = []string{"debug", "info", "warn", "error"}
+
+func (s traceSeverity) String() string {
+	return traceSeverityNames[s]
+}
+
+// parseTraceSeverity 名前から重要度を返す
+func parseTraceSeverity(name string) (traceSeverity, error) {
+	for i, n := range traceSeverityNames {
+		if n == strings.ToLower(name) {
+			return traceSeverity(i), nil
+		}
+	}
+	return 0, ErrInvalidTraceLevel
+}
+
+// roomTracer ルーム名と重要度を各行の先頭に付けてトレースを出力する
+// 出力するかどうか、最低の重要度、メッセージごとのトレースを出力する割合は管理者が動作中に切り替えられる
+type roomTracer struct {
+	name    string
+	out     trace.Tracer
+	enabled int32
+	level   int32
+	// sampleはメッセージごとのトレースを出力する割合(float64のビット列)
+	sample uint64
+}
+
+// newRoomTracerはoutに出力するルームのトレーサーを生成する
+// -trace-roomsに含まれるルームは最初から出力する
+func newRoomTracer(name string, out trace.Tracer) *roomTracer {
+	t := &roomTracer{name: name, out: out}
+	level, err := parseTraceSeverity(*traceLevel)
+	if err != nil {
+		level = traceDebug
+	}
+	t.SetLevel(level)
+	t.SetSample(*traceSample)
+	for _, n := range strings.Split(*traceRooms, ",") {
+		if n = strings.TrimSpace(n); n == "*" || n == name {
+			t.SetEnabled(true)
+		}
+	}
+	return t
+}
+
+// logは重要度が最低の重要度以上の場合にトレースを出力する
+func (t *roomTracer) log(level traceSeverity, a ...interface{}) {
+	if !t.Enabled() || level < t.Level() {
+		return
+	}
+	t.out.Trace(append([]interface{}{"[" + t.name + "] " + strings.ToUpper(level.String()) + " "}, a...)...)
+}
+
+// Sample メッセージごとの配信の詳細を-trace-sampleの割合だけ出力する
+// 配信の経路で呼び出されるため、出力しない場合はすぐに戻る
+func (t *roomTracer) Sample(a ...interface{}) {
+	if !t.Enabled() || t.Level() > traceDebug {
+		return
+	}
+	if sample := t.SampleRate(); sample < 1 && rand.Float64() >= sample {
+		return
+	}
+	t.log(traceDebug, a...)
+}
+
+// Info ルームの状態の変化を出力する
+func (t *roomTracer) Info(a ...interface{}) { t.log(traceInfo, a...) }
+
+// Warn 特定のクライアントへの送信の失敗を出力する
+func (t *roomTracer) Warn(a ...interface{}) { t.log(traceWarn, a...) }
+
+// Error 保存や中継の失敗を出力する
+func (t *roomTracer) Error(a ...interface{}) { t.log(traceError, a...) }
+
+// Level 出力する最低の重要度を返す
+func (t *roomTracer) Level() traceSeverity {
+	return traceSeverity(atomic.LoadInt32(&t.level))
+}
+
+// SetLevel 出力する最低の重要度を切り替える
+func (t *roomTracer) SetLevel(level traceSeverity) {
+	atomic.StoreInt32(&t.level, int32(level))
+}
+
+// SampleRate メッセージごとのトレースを出力する割合を返す
+func (t *roomTracer) SampleRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&t.sample))
+}
+
+// SetSample メッセージごとのトレースを出力する割合を切り替える
+func (t *roomTracer) SetSample(rate float64) {
+	atomic.StoreUint64(&t.sample, math.Float64bits(rate))
+}
+
+// Enabled トレースを出力しているかどうかを返す
+func (t *roomTracer) Enabled() bool {
+	return atomic.LoadInt32(&t.enabled) == 1
+}
+
+// SetEnabled トレースを出力するかどうかを切り替える
+func (t *roomTracer) SetEnabled(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&t.enabled, v)
+}
+
+// loggerはルーム名を各行の先頭に付けるロガーを返す
+func (r *room) logger() *log.Logger {
+	return log.New(log.Writer(), "[room:"+r.name+"] ", log.Flags())
+}
+
+// roomTraceState ルームのトレースの状態
+type roomTraceState struct {
+	Enabled bool `json:"enabled"`
+	// Levelは出力する最低の重要度、Sampleはメッセージごとのトレースを出力する割合。省略した場合は変更しない
+	Level  string   `json:"level,omitempty"`
+	Sample *float64 `json:"sample,omitempty"`
+}
+
+// validSampleRate 出力する割合として使えるかどうか
+func validSampleRate(rate float64) bool {
+	return rate >= 0 && rate <= 1
+}
+
+// serveTraceはルームのトレースの状態を返し、PUTの場合は切り替える
+// GET /api/admin/rooms/{room}/trace
+// PUT /api/admin/rooms/{room}/trace  {"enabled": true, "level": "info", "sample": 0.01}
+func (h *roomAdminHandler) serveTrace(w http.ResponseWriter, r *http.Request, rm *room) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var state roomTraceState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			writeJSONError(w, r, "設定の形式が不正です", http.StatusBadRequest)
+			return
+		}
+		level := rm.tracer.Level()
+		if state.Level != "" {
+			var err error
+			if level, err = parseTraceSeverity(state.Level); err != nil {
+				writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if state.Sample != nil && !validSampleRate(*state.Sample) {
+			writeJSONError(w, r, ErrInvalidTraceLevel.Error(), http.StatusBadRequest)
+			return
+		}
+		rm.tracer.SetEnabled(state.Enabled)
+		rm.tracer.SetLevel(level)
+		if state.Sample != nil {
+			rm.tracer.SetSample(*state.Sample)
+		}
+		admin, _ := userFromContext(r.Context())
+		auditRequest(r, auditAdminAction, admin.UniqueID(), rm.name, map[string]string{"action": "room_trace"})
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	sample := rm.tracer.SampleRate()
+	writeJSON(w, http.StatusOK, roomTraceState{Enabled: rm.tracer.Enabled(), Level: rm.tracer.Level().String(), Sample: &sample})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// recordingTracer 出力したトレースを記録するtrace.Tracer
+type recordingTracer []string
+
+func (t *recordingTracer) Trace(a ...interface{}) { *t = append(*t, fmt.Sprint(a...)) }
+
+func TestRoomTracerLevels(t *testing.T) {
+	var out recordingTracer
+	tracer := newRoomTracer("general", &out)
+	tracer.SetEnabled(true)
+	tracer.SetLevel(traceWarn)
+	tracer.Sample("受信しました")
+	tracer.Info("参加しました")
+	tracer.Warn("送信に失敗しました")
+	tracer.Error("保存に失敗しました")
+	if len(out) != 2 || out[0] != "[general] WARN 送信に失敗しました" {
+		t.Errorf("最低の重要度以上のトレースだけを出力するべきです: %q", out)
+	}
+
+	out = nil
+	tracer.SetLevel(traceDebug)
+	tracer.SetSample(0)
+	tracer.Sample("受信しました")
+	tracer.SetSample(1)
+	tracer.Sample("受信しました")
+	if len(out) != 1 || out[0] != "[general] DEBUG 受信しました" {
+		t.Errorf("メッセージごとのトレースは割合に従って出力するべきです: %q", out)
+	}
+
+	if _, err := parseTraceSeverity("verbose"); err != ErrInvalidTraceLevel {
+		t.Errorf("不明な重要度は拒否するべきです: %v", err)
+	}
+}
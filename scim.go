@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var scimToken = flag.String("scim-token", "", "SCIMでユーザーを管理するIdPに発行するBearerトークン (空の場合はSCIMを無効にする。vault:などの参照も指定できる)")
+
+// SCIMのスキーマのURN (RFC 7643, 7644)
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// ErrInvalidSCIMPatch SCIMの部分更新の要求が不正な場合に発生するエラー
+var ErrInvalidSCIMPatch = errors.New("chat: SCIMの部分更新の要求が不正です。")
+
+// scimActor SCIMによる操作を監査ログに記録する際の操作者
+const scimActor = "scim"
+
+// scimFilterPattern 対応する唯一のフィルター (userName eq "...")
+var scimFilterPattern = regexp.MustCompile(`^(?i)(userName|emails(?:\.value)?)\s+eq\s+"((?:[^"\\]|\\.)*)"$`)
+
+// scimName SCIMのユーザーの名前
+type scimName struct {
+	Formatted string `json:"formatted,omitempty"`
+}
+
+// scimEmail SCIMのユーザーのメールアドレス
+type scimEmail struct {
+	Value   string `json:"value"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// scimMeta SCIMのリソースのメタデータ
+type scimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+// scimUser SCIMのユーザーのリソース
+// userNameはメールアドレスとして扱い、OAuthでの初回ログイン時に確認済みのメールアドレスで結び付ける
+type scimUser struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	UserName    string      `json:"userName"`
+	Name        *scimName   `json:"name,omitempty"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Emails      []scimEmail `json:"emails,omitempty"`
+	Active      *bool       `json:"active,omitempty"`
+	Meta        *scimMeta   `json:"meta,omitempty"`
+}
+
+// displayName 表示名を返す。指定されていない場合は名前、ユーザー名(@より前)の順に使う
+func (u *scimUser) displayName() string {
+	switch {
+	case u.DisplayName != "":
+		return u.DisplayName
+	case u.Name != nil && u.Name.Formatted != "":
+		return u.Name.Formatted
+	}
+	local, _, _ := strings.Cut(u.UserName, "@")
+	return local
+}
+
+// email メールアドレスを返す。主なアドレスがなければuserNameを使う
+func (u *scimUser) email() string {
+	for _, e := range u.Emails {
+		if e.Primary {
+			return e.Value
+		}
+	}
+	if len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+	return u.UserName
+}
+
+// scimPatch SCIMの部分更新の要求
+type scimPatch struct {
+	Schemas    []string `json:"schemas"`
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+// scimHandler IdPからのユーザーのプロビジョニングを受け付けるSCIM 2.0のサーバー
+// GET    /scim/v2/Users?filter=userName eq "..."
+// POST   /scim/v2/Users
+// GET    /scim/v2/Users/{id}
+// PUT    /scim/v2/Users/{id}
+// PATCH  /scim/v2/Users/{id}
+// DELETE /scim/v2/Users/{id}
+// activeを偽にした場合とDELETEでは、ユーザーを利用停止にしてすべてのセッションを失効させる
+type scimHandler struct {
+	rooms *roomRegistry
+}
+
+func (h *scimHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := bearerToken(r)
+	if *scimToken == "" || !ok || !hmac.Equal([]byte(token), []byte(*scimToken)) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+		writeSCIMError(w, http.StatusUnauthorized, "", "認証に失敗しました")
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/scim/v2/Users"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		h.list(w, r)
+	case id == "" && r.Method == http.MethodPost:
+		h.create(w, r)
+	case id != "" && r.Method == http.MethodGet:
+		record, err := users.GetByID(id)
+		if err != nil {
+			writeSCIMError(w, http.StatusNotFound, "", "ユーザーが見つかりません")
+			return
+		}
+		writeSCIM(w, http.StatusOK, scimUserFromRecord(r, record))
+	case id != "" && (r.Method == http.MethodPut || r.Method == http.MethodPatch):
+		h.update(w, r, id)
+	case id != "" && r.Method == http.MethodDelete:
+		if err := h.setActive(r, id, false); err == ErrUserNotFound {
+			writeSCIMError(w, http.StatusNotFound, "", "ユーザーが見つかりません")
+			return
+		} else if err != nil {
+			requestLogger(r).Println("SCIMによるユーザーの無効化に失敗しました:", id, "-", err)
+			writeSCIMError(w, http.StatusInternalServerError, "", "ユーザーの無効化に失敗しました")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeSCIMError(w, http.StatusMethodNotAllowed, "", "許可されていないメソッドです")
+	}
+}
+
+// list フィルターに一致するユーザーを返す。全件の取得には対応しない
+func (h *scimHandler) list(w http.ResponseWriter, r *http.Request) {
+	m := scimFilterPattern.FindStringSubmatch(strings.TrimSpace(r.URL.Query().Get("filter")))
+	if m == nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidFilter", `userName eq "..."のフィルターを指定してください`)
+		return
+	}
+	value, err := strconv.Unquote(`"` + m[2] + `"`)
+	if err != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidFilter", "フィルターの値が不正です")
+		return
+	}
+	list, err := users.ListByEmail(value)
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", "ユーザーの検索に失敗しました")
+		return
+	}
+	resources := []*scimUser{}
+	for _, record := range list {
+		resources = append(resources, scimUserFromRecord(r, record))
+	}
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimListSchema},
+		"totalResults": len(resources),
+		"itemsPerPage": len(resources),
+		"startIndex":   1,
+		"Resources":    resources,
+	})
+}
+
+func (h *scimHandler) create(w http.ResponseWriter, r *http.Request) {
+	var req scimUser
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserName == "" {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", "userNameを指定してください")
+		return
+	}
+	name, err := validateDisplayName(req.displayName(), true)
+	if err != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	if existing, err := users.ListByEmail(req.email()); err == nil && len(existing) > 0 {
+		writeSCIMError(w, http.StatusConflict, "uniqueness", "同じuserNameのユーザーが既に存在します")
+		return
+	}
+	record := &UserRecord{
+		ID:    uniqueIDFor(name),
+		Name:  name,
+		Email: req.email(),
+		// IDプロバイダーが管理しているアドレスは確認済みとみなす
+		EmailVerified: req.email() != "",
+		Role:          roleUser,
+		Banned:        req.Active != nil && !*req.Active,
+	}
+	if _, err := users.GetByID(record.ID); err == nil {
+		record.ID = randomID()
+	}
+	if err := users.Create(record); err != nil {
+		requestLogger(r).Println("SCIMによるユーザーの作成に失敗しました:", err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "ユーザーの作成に失敗しました")
+		return
+	}
+	auditRequest(r, auditAdminAction, scimActor, record.ID, map[string]string{"action": "scim_provision"})
+	writeSCIM(w, http.StatusCreated, scimUserFromRecord(r, record))
+}
+
+// update PUTでは属性を置き換え、PATCHでは指定された属性だけを変更する
+func (h *scimHandler) update(w http.ResponseWriter, r *http.Request, id string) {
+	record, err := users.GetByID(id)
+	if err != nil {
+		writeSCIMError(w, http.StatusNotFound, "", "ユーザーが見つかりません")
+		return
+	}
+	current := scimUserFromRecord(r, record)
+	if r.Method == http.MethodPut {
+		var req scimUser
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserName == "" {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", "userNameを指定してください")
+			return
+		}
+		if req.Active == nil {
+			req.Active = current.Active
+		}
+		current = &req
+	} else if err := applySCIMPatch(r, current); err != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	name, err := validateDisplayName(current.displayName(), true)
+	if err != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	record.Name = name
+	if email := current.email(); email != record.Email {
+		record.Email, record.EmailVerified = email, email != ""
+	}
+	if err := users.Update(record); err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", "ユーザーの更新に失敗しました")
+		return
+	}
+	if active := current.Active == nil || *current.Active; active == record.Banned {
+		if err := h.setActive(r, id, active); err != nil {
+			writeSCIMError(w, http.StatusInternalServerError, "", "ユーザーの更新に失敗しました")
+			return
+		}
+	}
+	record, _ = users.GetByID(id)
+	writeSCIM(w, http.StatusOK, scimUserFromRecord(r, record))
+}
+
+// applySCIMPatch 部分更新の操作をユーザーに適用する
+// 対応する属性はactive、displayName、userName。pathを省略した場合は値のオブジェクトの属性を使う
+func applySCIMPatch(r *http.Request, u *scimUser) error {
+	var patch scimPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		return ErrInvalidSCIMPatch
+	}
+	for _, op := range patch.Operations {
+		if !strings.EqualFold(op.Op, "replace") && !strings.EqualFold(op.Op, "add") {
+			return ErrInvalidSCIMPatch
+		}
+		values := map[string]json.RawMessage{}
+		if op.Path != "" {
+			values[op.Path] = op.Value
+		} else if err := json.Unmarshal(op.Value, &values); err != nil {
+			return ErrInvalidSCIMPatch
+		}
+		for path, value := range values {
+			var err error
+			switch strings.ToLower(path) {
+			case "active":
+				var active bool
+				// Azure ADは真偽値を文字列で送る
+				if err = json.Unmarshal(value, &active); err != nil {
+					var s string
+					if err = json.Unmarshal(value, &s); err == nil {
+						active, err = strconv.ParseBool(s)
+					}
+				}
+				u.Active = &active
+			case "displayname":
+				err = json.Unmarshal(value, &u.DisplayName)
+			case "username":
+				err = json.Unmarshal(value, &u.UserName)
+				u.Emails = nil
+			default:
+				// 対応しない属性は無視する
+			}
+			if err != nil {
+				return ErrInvalidSCIMPatch
+			}
+		}
+	}
+	return nil
+}
+
+// setActive ユーザーを有効または無効にする。無効にする場合はセッションを失効させて切断する
+func (h *scimHandler) setActive(r *http.Request, id string, active bool) error {
+	record, err := users.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if active {
+		record.Banned = false
+		err = users.Update(record)
+	} else {
+		err = banUser(h.rooms, id)
+	}
+	if err != nil {
+		return err
+	}
+	action := "scim_deprovision"
+	if active {
+		action = "scim_reactivate"
+	}
+	auditRequest(r, auditAdminAction, scimActor, id, map[string]string{"action": action})
+	return nil
+}
+
+// scimUserFromRecord ユーザーをSCIMのリソースに変換する
+func scimUserFromRecord(r *http.Request, record *UserRecord) *scimUser {
+	active := !record.Banned
+	u := &scimUser{
+		Schemas:     []string{scimUserSchema},
+		ID:          record.ID,
+		UserName:    record.Email,
+		Name:        &scimName{Formatted: record.Name},
+		DisplayName: record.Name,
+		Active:      &active,
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Created:      record.CreatedAt,
+			LastModified: record.UpdatedAt,
+			Location:     requestScheme(r) + "://" + requestHost(r) + "/scim/v2/Users/" + record.ID,
+		},
+	}
+	if record.Email != "" {
+		u.Emails = []scimEmail{{Value: record.Email, Primary: true}}
+	} else {
+		u.UserName = record.ID
+	}
+	return u
+}
+
+func writeSCIM(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeSCIMError SCIMの形式でエラーを返す (RFC 7644 3.12)
+func writeSCIMError(w http.ResponseWriter, status int, scimType, detail string) {
+	body := map[string]interface{}{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	writeSCIM(w, status, body)
+}
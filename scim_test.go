@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSCIMProvisioning(t *testing.T) {
+	users = newMemoryUserStore()
+	sessions = newMemorySessionStore()
+	*scimToken = "scim-secret"
+	defer func() {
+		users = newMemoryUserStore()
+		sessions = newMemorySessionStore()
+		*scimToken = ""
+	}()
+	h := &scimHandler{rooms: newRoomRegistry()}
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer scim-secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("POST", "/scim/v2/Users", `{"schemas":["`+scimUserSchema+`"],"userName":"alice@example.com","displayName":"Alice","active":true}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("ユーザーを作成できるべきです: %d %s", w.Code, w.Body)
+	}
+	var created scimUser
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if w := do("POST", "/scim/v2/Users", `{"userName":"alice@example.com"}`); w.Code != http.StatusConflict {
+		t.Errorf("同じuserNameのユーザーは作成できないべきです: %d", w.Code)
+	}
+
+	w = do("GET", "/scim/v2/Users?filter="+url.QueryEscape(`userName eq "ALICE@example.com"`), "")
+	if !strings.Contains(w.Body.String(), `"totalResults":1`) {
+		t.Errorf("userNameで検索できるべきです: %s", w.Body)
+	}
+
+	sessions.Create(&Session{ID: "s1", UserID: created.ID, CreatedAt: time.Now()})
+	patch := `{"schemas":["` + scimPatchSchema + `"],"Operations":[{"op":"Replace","path":"active","value":"False"}]}`
+	if w := do("PATCH", "/scim/v2/Users/"+created.ID, patch); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"active":false`) {
+		t.Errorf("activeを偽にできるべきです: %d %s", w.Code, w.Body)
+	}
+	if !isBanned(created.ID) {
+		t.Error("無効にしたユーザーは利用停止にするべきです")
+	}
+	if _, err := sessions.Get("s1"); err != ErrSessionNotFound {
+		t.Errorf("無効にしたユーザーのセッションは失効させるべきです: %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/scim/v2/Users/"+created.ID, nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("トークンが一致しない場合は拒否するべきです: %d", w.Code)
+	}
+}
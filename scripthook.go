@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+var (
+	scriptDir         = flag.String("script-dir", "", "投稿されたメッセージを検査するWASMのスクリプトを置くディレクトリ (空の場合は使用しない)")
+	scriptTimeout     = flag.Duration("script-timeout", 50*time.Millisecond, "スクリプトが1件のメッセージを処理できる時間")
+	scriptMemoryPages = flag.Uint("script-memory-pages", 256, "スクリプトが使用できるメモリのページ数 (1ページは64KiB)")
+	scriptFailOpen    = flag.Bool("script-fail-open", false, "スクリプトの実行に失敗した場合も投稿を受け付ける (既定では投稿を拒否する)")
+)
+
+// 再コンパイルせずにメッセージの検査を追加するためのWASMのスクリプト
+//
+// スクリプトは次の関数をエクスポートする
+//
+//	alloc(size i32) i32                   入力を書き込む領域を確保する
+//	on_message(ptr i32, len i32) i64      入力を処理して結果の位置を(ptr<<32 | len)で返す
+//
+// 入力はscriptInput、結果はscriptResultのJSON。0を返した場合はそのまま投稿する
+// WASIはファイルシステムや環境変数を渡さずに利用できる。メッセージごとに新しいインスタンスで実行する
+
+// scriptInput スクリプトに渡すメッセージ
+type scriptInput struct {
+	Room    string `json:"room"`
+	UserID  string `json:"user_id"`
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+// scriptResult スクリプトの処理結果
+type scriptResult struct {
+	// Actionはaccept, rewrite, rejectのいずれか
+	Action  string `json:"action"`
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+}
+
+var (
+	// ErrScriptResult スクリプトの結果が不正な場合に発生するエラー
+	ErrScriptResult = errors.New("chat: スクリプトの結果が不正です。")
+	// ErrScriptFailed スクリプトの実行に失敗したため投稿を拒否した場合に発生するエラー
+	ErrScriptFailed = errors.New("chat: メッセージを検査できませんでした。しばらくしてから再試行してください。")
+)
+
+// messageScript 1つのWASMのスクリプト
+type messageScript struct {
+	name     string
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	timeout  time.Duration
+	// failOpenが真の場合は実行に失敗しても投稿を受け付ける
+	failOpen bool
+}
+
+// newMessageScriptはWASMのスクリプトをコンパイルする
+// メモリはpagesまで、1件の処理はtimeoutまでに制限する
+func newMessageScript(name string, wasm []byte, pages uint32, timeout time.Duration) (*messageScript, error) {
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(pages).
+		WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	compiled, err := runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	return &messageScript{name: name, runtime: runtime, compiled: compiled, timeout: timeout}, nil
+}
+
+// run メッセージをスクリプトで処理した結果を返す
+func (s *messageScript) run(in scriptInput) (*scriptResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	mod, err := s.runtime.InstantiateModule(ctx, s.compiled,
+		wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, err
+	}
+	defer mod.Close(ctx)
+	alloc, onMessage := mod.ExportedFunction("alloc"), mod.ExportedFunction("on_message")
+	if alloc == nil || onMessage == nil || mod.Memory() == nil {
+		return nil, ErrScriptResult
+	}
+	data, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	res, err := alloc.Call(ctx, uint64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(res[0])
+	if !mod.Memory().Write(ptr, data) {
+		return nil, ErrScriptResult
+	}
+	res, err = onMessage.Call(ctx, uint64(ptr), uint64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	if res[0] == 0 {
+		return &scriptResult{Action: "accept"}, nil
+	}
+	out, ok := mod.Memory().Read(uint32(res[0]>>32), uint32(res[0]))
+	if !ok {
+		return nil, ErrScriptResult
+	}
+	var result scriptResult
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, ErrScriptResult
+	}
+	return &result, nil
+}
+
+// filterはOnMessageのフックとしてスクリプトを実行する
+// スクリプトが失敗した場合は、検査を迂回されないように投稿を拒否する。failOpenが真の場合は記録だけを行って受け付ける
+func (s *messageScript) filter(msg *message) error {
+	result, err := s.run(scriptInput{Room: msg.Room, UserID: msg.UserID, Name: msg.Name, Message: msg.Message})
+	if err != nil {
+		log.Println("スクリプトの実行に失敗しました:", s.name, "-", err)
+		if s.failOpen {
+			return nil
+		}
+		return ErrScriptFailed
+	}
+	switch result.Action {
+	case "rewrite":
+		msg.Message = result.Message
+	case "reject":
+		if result.Reason == "" {
+			result.Reason = "このメッセージは投稿できません"
+		}
+		return errors.New(result.Reason)
+	}
+	return nil
+}
+
+// loadMessageScripts ディレクトリの*.wasmをファイル名の順にOnMessageのフックとして登録する
+func loadMessageScripts(dir string, pages uint32, timeout time.Duration, failOpen bool) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.wasm"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		wasm, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		script, err := newMessageScript(filepath.Base(file), wasm, pages, timeout)
+		if err != nil {
+			return err
+		}
+		script.failOpen = failOpen
+		RegisterHook(OnMessage, script.filter)
+		log.Println("スクリプトを読み込みました:", script.name)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestScriptFilterFailure(t *testing.T) {
+	// 関数をエクスポートしない空のモジュールは実行に失敗する
+	empty := []byte("\x00asm\x01\x00\x00\x00")
+	tests := []struct {
+		failOpen bool
+		want     error
+	}{
+		{false, ErrScriptFailed},
+		{true, nil},
+	}
+	for _, tt := range tests {
+		script, err := newMessageScript("empty.wasm", empty, 16, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer script.runtime.Close(context.Background())
+		script.failOpen = tt.failOpen
+		msg := &message{Room: "general", UserID: "u1", Name: "Alice", Message: "こんにちは"}
+		if err := script.filter(msg); err != tt.want {
+			t.Errorf("failOpen=%v: %vを返すべきです: %v", tt.failOpen, tt.want, err)
+		}
+	}
+}
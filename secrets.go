@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+var (
+	// ErrInvalidSecretRef シークレットの参照の形式が不正な場合に発生するエラー
+	ErrInvalidSecretRef = errors.New("chat: シークレットの参照の形式が不正です。")
+	// ErrSecretNotFound 参照したシークレットが存在しない場合に発生するエラー
+	ErrSecretNotFound = errors.New("chat: シークレットが見つかりません。")
+)
+
+// SecretProvider 設定値の参照を外部のシークレットの値に解決する
+// refは"vault:secret/gochat#google_secret"の"vault:"より後ろの部分
+type SecretProvider interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// secretProviders 設定値の接頭辞ごとのSecretProvider
+// 値が接頭辞で始まるフラグは起動時にシークレットの値に置き換える
+var secretProviders = map[string]SecretProvider{
+	"vault": newVaultKV(),
+	"awssm": &awsSecrets{},
+	"env":   envSecret{},
+}
+
+// resolveSecretFlags 値がシークレットの参照になっているフラグを解決した値に置き換える
+func resolveSecretFlags(fs *flag.FlagSet) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		scheme, ref, ok := strings.Cut(f.Value.String(), ":")
+		provider, found := secretProviders[scheme]
+		if !ok || !found {
+			return
+		}
+		var value string
+		if value, err = provider.Resolve(ctx, ref); err != nil {
+			err = fmt.Errorf("-%s: %w", f.Name, err)
+			return
+		}
+		err = f.Value.Set(value)
+	})
+	return err
+}
+
+// splitSecretRef "パス#キー"をパスとキーに分ける。キーがない場合は空文字列を返す
+func splitSecretRef(ref string) (path, key string, err error) {
+	path, key, _ = strings.Cut(ref, "#")
+	if path == "" {
+		return "", "", ErrInvalidSecretRef
+	}
+	return path, key, nil
+}
+
+// envSecret 環境変数の値を返すSecretProvider (例: env:GOOGLE_CLIENT_SECRET)
+type envSecret struct{}
+
+func (envSecret) Resolve(_ context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
+
+// vaultKV VaultのKVシークレットエンジン(バージョン2)から値を取得するSecretProvider
+// 参照は"マウント/パス#キー"の形式 (例: vault:secret/gochat/oauth#google_secret)
+// 接続先とトークンはVAULT_ADDRとVAULT_TOKENで指定する
+type vaultKV struct {
+	client *http.Client
+	mu     sync.Mutex
+	// cacheは同じパスの複数のキーを参照する場合に一度だけ取得するためのキャッシュ
+	cache map[string]map[string]interface{}
+}
+
+func newVaultKV() *vaultKV {
+	return &vaultKV{client: &http.Client{Timeout: 10 * time.Second}, cache: make(map[string]map[string]interface{})}
+}
+
+func (v *vaultKV) Resolve(ctx context.Context, ref string) (string, error) {
+	path, key, err := splitSecretRef(ref)
+	if err != nil || key == "" {
+		return "", ErrInvalidSecretRef
+	}
+	data, err := v.read(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	value, ok := data[key].(string)
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
+
+func (v *vaultKV) read(ctx context.Context, path string) (map[string]interface{}, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if data, ok := v.cache[path]; ok {
+		return data, nil
+	}
+	mount, rest, ok := strings.Cut(path, "/")
+	if !ok || rest == "" {
+		return nil, ErrInvalidSecretRef
+	}
+	addr := strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		addr = "https://127.0.0.1:8200"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr+"/v1/"+mount+"/data/"+rest, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrSecretNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("chat: Vaultからシークレットを取得できません (status %d)", resp.StatusCode)
+	}
+	var body struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	v.cache[path] = body.Data.Data
+	return body.Data.Data, nil
+}
+
+// awsSecrets AWS Secrets Managerから値を取得するSecretProvider
+// 参照は"シークレット名#キー"の形式。キーを指定した場合は値をJSONとして解析してキーの値を返す
+// 認証情報とリージョンはAWS SDKの標準の方法(環境変数、共有設定、IAMロール)で取得する
+type awsSecrets struct {
+	once   sync.Once
+	client *secretsmanager.Client
+	err    error
+}
+
+func (a *awsSecrets) Resolve(ctx context.Context, ref string) (string, error) {
+	name, key, err := splitSecretRef(ref)
+	if err != nil {
+		return "", err
+	}
+	a.once.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			a.err = err
+			return
+		}
+		a.client = secretsmanager.NewFromConfig(cfg)
+	})
+	if a.err != nil {
+		return "", a.err
+	}
+	out, err := a.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(name)})
+	if err != nil {
+		return "", err
+	}
+	value := aws.ToString(out.SecretString)
+	if key == "" {
+		return value, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", ErrInvalidSecretRef
+	}
+	field, ok := fields[key].(string)
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return field, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveSecretFlags(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/v1/secret/data/gochat/oauth" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"data":{"data":{"client_secret":"from-vault"}}}`))
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "test-token")
+	t.Setenv("GOCHAT_TEST_SECRET", "from-env")
+	saved := secretProviders["vault"]
+	secretProviders["vault"] = newVaultKV()
+	defer func() { secretProviders["vault"] = saved }()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	oauth := fs.String("oauth", "", "")
+	env := fs.String("env", "", "")
+	sink := fs.String("sink", "", "")
+	fs.Parse([]string{"-oauth", "vault:secret/gochat/oauth#client_secret", "-env", "env:GOCHAT_TEST_SECRET", "-sink", "file:/tmp/report"})
+	if err := resolveSecretFlags(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *oauth != "from-vault" || *env != "from-env" {
+		t.Errorf("シークレットの参照を解決するべきです: %q %q", *oauth, *env)
+	}
+	if *sink != "file:/tmp/report" {
+		t.Error("シークレットの参照でない値は変更しないべきです")
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("missing", "", "")
+	fs.Parse([]string{"-missing", "vault:secret/gochat/oauth#nothing"})
+	if err := resolveSecretFlags(fs); err == nil {
+		t.Error("存在しないキーを参照した場合はエラーになるべきです")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// seedNames デモ用のユーザーの名前
+var seedNames = []string{"佐藤 花子", "鈴木 一郎", "高橋 美咲", "田中 健太", "伊藤 さくら", "渡辺 翔", "山本 陽菜", "中村 大輔"}
+
+// seedRooms デモ用のルームとそこで交わされる会話
+var seedRooms = map[string][]string{
+	defaultRoomName: {
+		"おはようございます!",
+		"今日もよろしくお願いします。",
+		"お昼どこに行きますか?",
+		"駅前のラーメン屋が気になってます",
+		"いいですね、12時に集合しましょう",
+		"午後の打ち合わせは15時からに変更になりました",
+		"了解です 👍",
+		"お疲れさまでした!",
+	},
+	"dev": {
+		"mainブランチのビルドが落ちています",
+		"さっきのマージが原因っぽいので見てみます",
+		"修正のPRを出しました。レビューお願いします",
+		"LGTMです",
+		"リリースは明日の10時で大丈夫ですか?",
+		"テスト環境で確認できました",
+		"ログの出力をもう少し減らしたいですね",
+	},
+	"random": {
+		"週末は雨みたいですね",
+		"おすすめの本があったら教えてください",
+		"最近ボードゲームにはまっています",
+		"猫の写真を貼ってもいいですか",
+		"このチャット、思ったより便利ですね",
+	},
+}
+
+// seedProvider デモ用のユーザーの認証プロバイダー。実際にはログインできない
+const seedProvider = "demo"
+
+// seedCommand gochat seed
+// デモ用のユーザーとルームのメッセージの履歴をデータベースに作成する
+func seedCommand(args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	path := fs.String("database", *databasePath, "データを作成するSQLiteのファイル")
+	userCount := fs.Int("users", 5, "作成するユーザーの数")
+	messageCount := fs.Int("messages", 200, "作成するメッセージの数")
+	days := fs.Int("days", 7, "メッセージの履歴を作成する過去の日数")
+	seed := fs.Int64("seed", 1, "乱数のシード (同じ値では同じデータを作成する)")
+	fs.Parse(args)
+	if *path == "" {
+		fs.Usage()
+		return errors.New("chat: -databaseを指定してください。メモリ上のストアにはサーバーの外から作成できません。")
+	}
+	if *messageCount < 0 || *days < 1 {
+		return errors.New("chat: -messagesには0以上、-daysには1以上を指定してください。")
+	}
+	if *userCount < 1 || *userCount > len(seedNames) {
+		return fmt.Errorf("chat: -usersには1から%dまでの数を指定してください。", len(seedNames))
+	}
+	db, err := openDatabase(*path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	m, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+	if _, err := m.up(); err != nil {
+		return err
+	}
+	if err := m.check(); err != nil {
+		return err
+	}
+	userStore, messageStore := newSQLUserStore(db), newSQLMessageStore(db)
+
+	var created []*UserRecord
+	for i, name := range seedNames[:*userCount] {
+		record := &UserRecord{
+			ID:         uniqueIDFor(name),
+			Name:       name,
+			Email:      fmt.Sprintf("demo%d@example.com", i+1),
+			Provider:   seedProvider,
+			ProviderID: fmt.Sprint(i + 1),
+		}
+		if existing, err := userStore.GetByID(record.ID); err == nil {
+			created = append(created, existing)
+			continue
+		}
+		if err := userStore.Create(record); err != nil {
+			return err
+		}
+		created = append(created, record)
+	}
+	if sent, err := messageStore.ListByUser(created[0].ID); err != nil {
+		return err
+	} else if len(sent) > 0 {
+		fmt.Println("デモ用のデータは作成済みです")
+		return nil
+	}
+
+	rnd := rand.New(rand.NewSource(*seed))
+	rooms := make([]string, 0, len(seedRooms))
+	for room := range seedRooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	// 古いものから順に、会話らしく短い間隔で続けて投稿する
+	when := time.Now().AddDate(0, 0, -*days)
+	step := time.Duration(*days) * 24 * time.Hour / time.Duration(*messageCount+1)
+	if step < time.Second {
+		step = time.Second
+	}
+	for i := 0; i < *messageCount; i++ {
+		when = when.Add(time.Duration(rnd.Int63n(int64(step)*2) + 1))
+		if when.After(time.Now()) {
+			when = time.Now()
+		}
+		room := rooms[rnd.Intn(len(rooms))]
+		lines := seedRooms[room]
+		user := created[rnd.Intn(len(created))]
+		msg := &message{
+			ID:        randomID(),
+			Room:      room,
+			UserID:    user.ID,
+			Name:      user.Name,
+			AvatarURL: user.AvatarURL,
+			Message:   lines[rnd.Intn(len(lines))],
+			When:      when,
+		}
+		if err := messageStore.Save(msg); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("ユーザー%d人、メッセージ%d件を作成しました (ルーム: %v)\n", len(created), *messageCount, rooms)
+	return nil
+}
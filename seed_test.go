@@ -0,0 +1,65 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSeedCommand(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"-database", ""}, false},
+		{[]string{"-database", filepath.Join(dir, "bad.db"), "-users", "0"}, false},
+		{[]string{"-database", filepath.Join(dir, "bad.db"), "-users", "99"}, false},
+		{[]string{"-database", filepath.Join(dir, "bad.db"), "-days", "0"}, false},
+		{[]string{"-database", filepath.Join(dir, "bad.db"), "-messages", "-1"}, false},
+		{[]string{"-database", filepath.Join(dir, "a.db"), "-users", "3", "-messages", "20", "-days", "2"}, true},
+		{[]string{"-database", filepath.Join(dir, "a.db"), "-users", "3", "-messages", "20", "-days", "2"}, true},
+		{[]string{"-database", filepath.Join(dir, "b.db"), "-users", "3", "-messages", "20", "-days", "2"}, true},
+	}
+	for _, test := range tests {
+		if err := seedCommand(test.args); (err == nil) != test.ok {
+			t.Errorf("%v: エラー%vになるべきところ%vでした", test.args, !test.ok, err)
+		}
+	}
+
+	// seeded 作成されたメッセージをルームと本文の組として返す
+	seeded := func(name string) []string {
+		db, err := openDatabase(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		userStore := newSQLUserStore(db)
+		for i, name := range seedNames[:3] {
+			u, err := userStore.GetByID(uniqueIDFor(name))
+			if err != nil || u.Provider != seedProvider {
+				t.Errorf("%d人目のデモ用のユーザーを作成するべきです: %+v, %v", i+1, u, err)
+			}
+		}
+		var list []string
+		since := time.Now().AddDate(0, 0, -2)
+		newSQLMessageStore(db).Each(func(m *message) error {
+			if _, ok := seedRooms[m.Room]; !ok || m.When.Before(since) || m.When.After(time.Now()) {
+				t.Errorf("デモ用のルームに期間内のメッセージを作成するべきです: %+v", m)
+			}
+			list = append(list, m.Room+":"+m.Message)
+			return nil
+		})
+		return list
+	}
+	a, b := seeded("a.db"), seeded("b.db")
+	if len(a) != 20 {
+		t.Errorf("再実行してもメッセージを重複して作成するべきではありません: %d件", len(a))
+	}
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			t.Errorf("同じシードでは同じ履歴を作成するべきです: %q", a[i])
+			break
+		}
+	}
+}
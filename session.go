@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrSessionNotFound セッションが存在しないか失効している場合に発生するエラー
+var ErrSessionNotFound = errors.New("chat: セッションが見つかりません。")
+
+// Session ログインごとに発行されるセッション
+type Session struct {
+	ID         string
+	UserID     string
+	UserAgent  string
+	RemoteAddr string
+	// CountryとASNはログイン時のRemoteAddrから推定した国とASN
+	Country   string
+	ASN       uint
+	CreatedAt time.Time
+}
+
+// SessionStore ログイン中のセッションを保存する
+// セッションを削除すると、そのセッションの認証用Cookieは無効になる
+type SessionStore interface {
+	Create(s *Session) error
+	// Get IDでセッションを取得する
+	// *見つからない場合にはErrSessionNotFoundを返す
+	Get(id string) (*Session, error)
+	ListByUser(userID string) ([]*Session, error)
+	Delete(id string) error
+	// DeleteByUser ユーザーのすべてのセッションを失効させる
+	DeleteByUser(userID string) error
+}
+
+// memorySessionStore メモリ上にセッションを保持するSessionStore
+type memorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]*Session)}
+}
+
+func (s *memorySessionStore) Create(sess *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess.CreatedAt.IsZero() {
+		sess.CreatedAt = time.Now()
+	}
+	stored := *sess
+	s.sessions[sess.ID] = &stored
+	return nil
+}
+
+func (s *memorySessionStore) Get(id string) (*Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	copied := *sess
+	return &copied, nil
+}
+
+func (s *memorySessionStore) ListByUser(userID string) ([]*Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []*Session
+	for _, sess := range s.sessions {
+		if sess.UserID == userID {
+			copied := *sess
+			list = append(list, &copied)
+		}
+	}
+	return list, nil
+}
+
+func (s *memorySessionStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memorySessionStore) DeleteByUser(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		if sess.UserID == userID {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
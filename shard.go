@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	shardNodes  = flag.String("shard-nodes", "", "ルームを分担するノード (ID=URL をカンマ区切りで指定。例: a=http://10.0.0.1:8080,b=http://10.0.0.2:8080)")
+	shardNodeID = flag.String("shard-node-id", "", "-shard-nodesの中でのこのノードのID")
+)
+
+// shardReplicas 1つのノードをハッシュリング上に配置する数
+const shardReplicas = 128
+
+// shardForwardedHeader 他のノードから転送されたリクエストに付与するヘッダー
+// 転送先でさらに転送してループすることを防ぐ
+const shardForwardedHeader = "X-Gochat-Shard-Forwarded"
+
+// hashRing ルーム名から担当するノードをコンシステントハッシュで決める
+// ノードが増減しても担当が変わるルームは一部に限られる
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+func newHashRing(nodes []string) *hashRing {
+	ring := &hashRing{owners: make(map[uint32]string)}
+	for _, node := range nodes {
+		for i := 0; i < shardReplicas; i++ {
+			p := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+			ring.points = append(ring.points, p)
+			ring.owners[p] = node
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// owner keyを担当するノードを返す
+func (ring *hashRing) owner(key string) string {
+	if len(ring.points) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= h })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.owners[ring.points[i]]
+}
+
+// shardRouter ルームへの接続を担当するノードに転送する
+// ルームの順序はそのルームを担当する1つのノードだけが決める
+type shardRouter struct {
+	self    string
+	ring    *hashRing
+	proxies map[string]*httputil.ReverseProxy
+	next    http.Handler
+}
+
+// newShardRouter "ID=URL"をカンマ区切りで並べた文字列からshardRouterを生成する
+func newShardRouter(spec, self string, next http.Handler) (*shardRouter, error) {
+	s := &shardRouter{self: self, proxies: make(map[string]*httputil.ReverseProxy), next: next}
+	var ids []string
+	for _, entry := range strings.Split(spec, ",") {
+		i := strings.Index(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("chat: ノードの指定が不正です: %q", entry)
+		}
+		id := strings.TrimSpace(entry[:i])
+		target, err := url.Parse(strings.TrimSpace(entry[i+1:]))
+		if err != nil || target.Host == "" {
+			return nil, fmt.Errorf("chat: ノードのURLが不正です: %q", entry)
+		}
+		ids = append(ids, id)
+		s.proxies[id] = httputil.NewSingleHostReverseProxy(target)
+	}
+	if _, ok := s.proxies[self]; !ok {
+		return nil, errors.New("chat: -shard-node-idが-shard-nodesに含まれていません。")
+	}
+	s.ring = newHashRing(ids)
+	return s, nil
+}
+
+func (s *shardRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	owner := s.ring.owner(roomNameFromRequest(r))
+	if owner == s.self || r.Header.Get(shardForwardedHeader) != "" {
+		s.next.ServeHTTP(w, r)
+		return
+	}
+	r.Header.Set(shardForwardedHeader, s.self)
+	// ReverseProxyはWebSocketへのアップグレードもそのまま中継する
+	s.proxies[owner].ServeHTTP(w, r)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+	ring := newHashRing([]string{"a", "b", "c"})
+	counts := map[string]int{}
+	owners := map[string]string{}
+	for i := 0; i < 3000; i++ {
+		room := fmt.Sprintf("room-%d", i)
+		owner := ring.owner(room)
+		if owner != ring.owner(room) {
+			t.Fatal("同じルームは常に同じノードが担当するべきです")
+		}
+		counts[owner]++
+		owners[room] = owner
+	}
+	for _, node := range []string{"a", "b", "c"} {
+		if counts[node] < 500 {
+			t.Errorf("ルームが偏って割り当てられています: %v", counts)
+		}
+	}
+
+	// ノードを追加しても、既存のノード同士の間で担当が入れ替わることはない
+	grown := newHashRing([]string{"a", "b", "c", "d"})
+	for room, owner := range owners {
+		if o := grown.owner(room); o != owner && o != "d" {
+			t.Errorf("%sの担当が%sから%sに移動しました", room, owner, o)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var securityKeys = flag.String("security-keys", "", "Cookieやwebhookの署名に使う鍵 (カンマ区切り。先頭で署名し、残りは検証のみに使う。入れ替える場合は新しい鍵を先頭に追加する)")
+
+// defaultSecurityKey -security-keysが指定されていない場合の鍵。本番環境では必ず指定すること
+const defaultSecurityKey = "security-key"
+
+// ErrBadSignature 署名がないか、どの鍵でも検証できない場合に発生するエラー
+var ErrBadSignature = errors.New("chat: 署名を検証できません。")
+
+// signingKeyring 署名に使う現在の鍵と、検証だけに使う以前の鍵
+// 鍵を入れ替えても、以前の鍵で署名されたCookieは次のリクエストで現在の鍵に署名し直される
+type signingKeyring struct {
+	keys [][]byte
+}
+
+// newSigningKeyring カンマ区切りの鍵からsigningKeyringを生成する
+func newSigningKeyring(spec string) *signingKeyring {
+	k := &signingKeyring{}
+	for _, key := range strings.Split(spec, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			k.keys = append(k.keys, []byte(key))
+		}
+	}
+	if len(k.keys) == 0 {
+		k.keys = [][]byte{[]byte(defaultSecurityKey)}
+	}
+	return k
+}
+
+// current 新しい署名に使う鍵
+func (k *signingKeyring) current() []byte {
+	return k.keys[0]
+}
+
+func mac(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Sign 現在の鍵でdataに署名する
+func (k *signingKeyring) Sign(data string) string {
+	return base64.RawURLEncoding.EncodeToString(mac(k.current(), data))
+}
+
+// Verify いずれかの鍵で署名を検証する。currentは現在の鍵で署名されている場合に真になる
+func (k *signingKeyring) Verify(data, signature string) (current bool, err error) {
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false, ErrBadSignature
+	}
+	for i, key := range k.keys {
+		if hmac.Equal(sig, mac(key, data)) {
+			return i == 0, nil
+		}
+	}
+	return false, ErrBadSignature
+}
+
+// SignAll すべての鍵による署名を返す
+// 受信側がどちらの鍵を設定していても検証できるよう、webhookには全員分の署名を付ける
+func (k *signingKeyring) SignAll(data []byte) []string {
+	sigs := make([]string, len(k.keys))
+	for i, key := range k.keys {
+		sigs[i] = "sha256=" + hex.EncodeToString(mac(key, string(data)))
+	}
+	return sigs
+}
+
+// signCookieValue Cookieの値に署名を付ける。値と署名は"."で区切る
+func signCookieValue(value string) string {
+	return value + "." + signing.Sign(value)
+}
+
+// verifyCookieValue 署名を検証して署名を除いた値を返す
+// renewは以前の鍵で署名されていて、現在の鍵で署名し直すべき場合に真になる
+func verifyCookieValue(signed string) (value string, renew bool, err error) {
+	i := strings.LastIndexByte(signed, '.')
+	if i < 0 {
+		return "", false, ErrBadSignature
+	}
+	value = signed[:i]
+	current, err := signing.Verify(value, signed[i+1:])
+	if err != nil {
+		return "", false, err
+	}
+	return value, !current, nil
+}
+
+// signatureHeader webhookの本文の署名を付けるヘッダー
+const signatureHeader = "X-Gochat-Signature"
+
+// signWebhook webhookのリクエストにすべての鍵による署名を付ける
+func signWebhook(req *http.Request, body []byte) {
+	req.Header.Set(signatureHeader, strings.Join(signing.SignAll(body), ", "))
+}
+
+// warnDefaultSecurityKey 既定の鍵のまま起動した場合に警告する
+func warnDefaultSecurityKey() {
+	if *securityKeys == "" {
+		log.Println("警告: -security-keysが指定されていないため、既定の鍵で署名します")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// signedCookie テスト用に組み立てたCookieに現在の鍵で署名する
+func signedCookie(c *http.Cookie) *http.Cookie {
+	c.Value = signCookieValue(c.Value)
+	return c
+}
+
+func TestSigningKeyringRotation(t *testing.T) {
+	saved := signing
+	defer func() { signing = saved }()
+
+	signing = newSigningKeyring("old")
+	cookie := signCookieValue("payload")
+	if value, renew, err := verifyCookieValue(cookie); err != nil || value != "payload" || renew {
+		t.Fatalf("現在の鍵の署名を検証できるべきです: %q %v %v", value, renew, err)
+	}
+
+	// 新しい鍵を先頭に追加しても、以前の鍵の署名は検証でき、署名し直すよう知らせる
+	signing = newSigningKeyring("new, old")
+	if value, renew, err := verifyCookieValue(cookie); err != nil || value != "payload" || !renew {
+		t.Errorf("以前の鍵の署名は検証でき、renewが真になるべきです: %q %v %v", value, renew, err)
+	}
+
+	// 以前の鍵を外すと検証できない
+	signing = newSigningKeyring("new")
+	if _, _, err := verifyCookieValue(cookie); err != ErrBadSignature {
+		t.Errorf("外した鍵の署名は検証できないべきです: %v", err)
+	}
+	if _, _, err := verifyCookieValue("payload"); err != ErrBadSignature {
+		t.Error("署名のない値は検証できないべきです")
+	}
+	if _, _, err := verifyCookieValue(strings.Replace(signCookieValue("payload"), "payload", "tampered", 1)); err != ErrBadSignature {
+		t.Error("改ざんされた値は検証できないべきです")
+	}
+}
+
+func TestRenewAuthCookie(t *testing.T) {
+	saved := signing
+	defer func() { signing = saved }()
+	signing = newSigningKeyring("old")
+	cookie := &http.Cookie{Name: "auth", Value: signCookieValue("payload")}
+	signing = newSigningKeyring("new,old")
+
+	w := httptest.NewRecorder()
+	renewAuthCookie(w, httptest.NewRequest("GET", "/", nil), cookie)
+	renewed := w.Result().Cookies()
+	if len(renewed) != 1 {
+		t.Fatal("以前の鍵で署名されたCookieは署名し直すべきです")
+	}
+	if _, renew, err := verifyCookieValue(renewed[0].Value); err != nil || renew {
+		t.Errorf("署名し直したCookieは現在の鍵で検証できるべきです: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	renewAuthCookie(w, httptest.NewRequest("GET", "/", nil), renewed[0])
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("現在の鍵で署名されたCookieは設定し直さないべきです")
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	saved := signing
+	defer func() { signing = saved }()
+	signing = newSigningKeyring("new,old")
+	req := httptest.NewRequest("POST", "/hook", nil)
+	signWebhook(req, []byte(`{"ok":true}`))
+	if sigs := strings.Split(req.Header.Get(signatureHeader), ", "); len(sigs) != 2 || !strings.HasPrefix(sigs[0], "sha256=") {
+		t.Errorf("すべての鍵の署名を付けるべきです: %v", sigs)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+var codeStyle = flag.String("code-style", "github", "コードのメッセージの色分けに使用するスタイル (chromaのスタイル名)")
+
+// maxCodeSize コードのメッセージの本文の最大バイト数
+const maxCodeSize = 32 << 10
+
+// ErrInvalidCode コードのメッセージが空または大きすぎる場合に発生するエラー
+var ErrInvalidCode = errors.New("chat: コードは1バイト以上32KB以内で指定してください。")
+
+// CodeSnippet コードのメッセージの言語と色分けしたHTML
+// 元のテキストはメッセージの本文に保存する
+type CodeSnippet struct {
+	// Languageは色分けに使用した言語。判定できなかった場合はplaintext
+	Language string `json:"language"`
+	// HTMLはサーバーが色分けしたHTML。本文はすべてエスケープされ、スタイル以外の属性は含まない
+	HTML string `json:"html,omitempty"`
+}
+
+// highlightCode 言語に従ってコードを色分けしたHTMLを返す
+// 言語が指定されていないか不明な場合は内容から推測し、それでも判定できなければ色分けしない
+func highlightCode(language, body string) (string, string, error) {
+	lexer := lexers.Get(language)
+	if lexer == nil {
+		lexer = lexers.Analyse(body)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	lexer = chroma.Coalesce(lexer)
+	iterator, err := lexer.Tokenise(nil, body)
+	if err != nil {
+		return "", "", err
+	}
+	var buf bytes.Buffer
+	// クライアントにスタイルシートを配布しなくても同じ表示になるように、スタイルは属性に含める
+	formatter := html.New(html.WithClasses(false), html.TabWidth(4))
+	if err := formatter.Format(&buf, styles.Get(*codeStyle), iterator); err != nil {
+		return "", "", err
+	}
+	return strings.ToLower(lexer.Config().Name), buf.String(), nil
+}
+
+// resolveCode コードのメッセージを検証し、色分けしたHTMLを設定する
+// 本文には元のテキストを残し、色分けに対応していないクライアントや履歴の検索に使用する
+func resolveCode(msg *message) error {
+	if strings.TrimSpace(msg.Message) == "" || len(msg.Message) > maxCodeSize {
+		return ErrInvalidCode
+	}
+	language := ""
+	if msg.Snippet != nil {
+		language = msg.Snippet.Language
+	}
+	language, highlighted, err := highlightCode(language, msg.Message)
+	if err != nil {
+		return err
+	}
+	msg.Snippet = &CodeSnippet{Language: language, HTML: highlighted}
+	return nil
+}
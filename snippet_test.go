@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveCode(t *testing.T) {
+	msg := &message{Type: typeCode, Message: `fmt.Println("<script>")`, Snippet: &CodeSnippet{Language: "go", HTML: "<script>alert(1)</script>"}}
+	if err := resolveCode(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Snippet.Language != "go" || !strings.Contains(msg.Snippet.HTML, "&lt;script&gt;") || strings.Contains(msg.Snippet.HTML, "<script>") {
+		t.Errorf("コードはエスケープして色分けするべきです: %+v", msg.Snippet)
+	}
+	if msg.Message != `fmt.Println("<script>")` {
+		t.Errorf("本文には元のテキストを残すべきです: %s", msg.Message)
+	}
+	if err := resolveCode(&message{Type: typeCode, Message: " "}); err != ErrInvalidCode {
+		t.Errorf("空のコードは拒否するべきです: %v", err)
+	}
+	unknown := &message{Type: typeCode, Message: "hello", Snippet: &CodeSnippet{Language: "no-such-language"}}
+	if err := resolveCode(unknown); err != nil || unknown.Snippet.HTML == "" {
+		t.Errorf("不明な言語でもHTMLを生成するべきです: %+v, %v", unknown.Snippet, err)
+	}
+}
@@ -0,0 +1,828 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// sqlUserStore SQLiteにユーザーを保存するUserStore
+type sqlUserStore struct {
+	db *sql.DB
+}
+
+func newSQLUserStore(db *sql.DB) *sqlUserStore {
+	return &sqlUserStore{db: db}
+}
+
+const userColumns = `id, name, email, email_verified, avatar_url, provider, provider_id, role, banned, shadow_banned,
+	totp_secret, totp_enabled, totp_last_step, recovery_codes, passkeys, storage_quota, custom_name, created_at, updated_at`
+
+func (s *sqlUserStore) Create(u *UserRecord) error {
+	now := time.Now()
+	stored := *u
+	stored.CreatedAt, stored.UpdatedAt = now, now
+	codes, passkeys, err := marshalUserLists(&stored)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		stored.ID, stored.Name, stored.Email, stored.EmailVerified, stored.AvatarURL, stored.Provider, stored.ProviderID, stored.Role,
+		stored.Banned, stored.ShadowBanned, stored.TOTPSecret, stored.TOTPEnabled, stored.TOTPLastStep, codes, passkeys,
+		stored.StorageQuota, stored.CustomName, stored.CreatedAt, stored.UpdatedAt)
+	if err == nil {
+		err = saveIdentities(tx, &stored)
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrUserExists
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	*u = stored
+	return nil
+}
+
+// saveIdentities 連携したアカウントを保存し直す
+// 他のユーザーが最初にログインしたアカウントと重複する場合はErrUserExistsを返す
+func saveIdentities(tx *sql.Tx, u *UserRecord) error {
+	if _, err := tx.Exec(`DELETE FROM user_identities WHERE user_id = ?`, u.ID); err != nil {
+		return err
+	}
+	for _, id := range u.Identities {
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE provider = ? AND provider_id = ? AND id <> ?`,
+			id.Provider, id.ProviderID, u.ID).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrUserExists
+		}
+		if _, err := tx.Exec(`INSERT INTO user_identities (provider, provider_id, user_id, email, linked_at) VALUES (?, ?, ?, ?, ?)`,
+			id.Provider, id.ProviderID, u.ID, id.Email, id.LinkedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadIdentities ユーザーに連携したアカウントを読み込む
+func (s *sqlUserStore) loadIdentities(u *UserRecord) (*UserRecord, error) {
+	rows, err := s.db.Query(`SELECT provider, provider_id, email, linked_at FROM user_identities WHERE user_id = ? ORDER BY linked_at`, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id LinkedIdentity
+		if err := rows.Scan(&id.Provider, &id.ProviderID, &id.Email, &id.LinkedAt); err != nil {
+			return nil, err
+		}
+		u.Identities = append(u.Identities, id)
+	}
+	return u, rows.Err()
+}
+
+func (s *sqlUserStore) GetByID(id string) (*UserRecord, error) {
+	u, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+	return s.loadIdentities(u)
+}
+
+func (s *sqlUserStore) GetByProviderID(provider, providerID string) (*UserRecord, error) {
+	u, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE (provider = ? AND provider_id = ? AND provider <> '')
+		OR id = (SELECT user_id FROM user_identities WHERE provider = ? AND provider_id = ?)`,
+		provider, providerID, provider, providerID))
+	if err != nil {
+		return nil, err
+	}
+	return s.loadIdentities(u)
+}
+
+func (s *sqlUserStore) ListByEmail(email string) ([]*UserRecord, error) {
+	rows, err := s.db.Query(`SELECT id FROM users WHERE email <> '' AND lower(email) = lower(?)`, email)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var list []*UserRecord
+	for _, id := range ids {
+		u, err := s.GetByID(id)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, u)
+	}
+	return list, nil
+}
+
+func (s *sqlUserStore) Update(u *UserRecord) error {
+	stored := *u
+	stored.UpdatedAt = time.Now()
+	codes, passkeys, err := marshalUserLists(&stored)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`UPDATE users SET name = ?, email = ?, email_verified = ?, avatar_url = ?, provider = ?, provider_id = ?, role = ?,
+		banned = ?, shadow_banned = ?, totp_secret = ?, totp_enabled = ?, totp_last_step = ?, recovery_codes = ?, passkeys = ?,
+		storage_quota = ?, custom_name = ?, updated_at = ? WHERE id = ?`,
+		stored.Name, stored.Email, stored.EmailVerified, stored.AvatarURL, stored.Provider, stored.ProviderID, stored.Role,
+		stored.Banned, stored.ShadowBanned, stored.TOTPSecret, stored.TOTPEnabled, stored.TOTPLastStep, codes, passkeys,
+		stored.StorageQuota, stored.CustomName, stored.UpdatedAt, stored.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	if err := saveIdentities(tx, &stored); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrUserExists
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	current, err := s.GetByID(u.ID)
+	if err != nil {
+		return err
+	}
+	*u = *current
+	return nil
+}
+
+func (s *sqlUserStore) Delete(id string) error {
+	res, err := s.db.Exec(`DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// marshalUserLists リカバリーコードとパスキーをJSONの列に変換する
+func marshalUserLists(u *UserRecord) (string, string, error) {
+	codes, err := json.Marshal(u.RecoveryCodes)
+	if err != nil {
+		return "", "", err
+	}
+	passkeys, err := json.Marshal(u.Passkeys)
+	if err != nil {
+		return "", "", err
+	}
+	return string(codes), string(passkeys), nil
+}
+
+func scanUser(row *sql.Row) (*UserRecord, error) {
+	var u UserRecord
+	var codes, passkeys string
+	err := row.Scan(&u.ID, &u.Name, &u.Email, &u.EmailVerified, &u.AvatarURL, &u.Provider, &u.ProviderID, &u.Role,
+		&u.Banned, &u.ShadowBanned, &u.TOTPSecret, &u.TOTPEnabled, &u.TOTPLastStep, &codes, &passkeys,
+		&u.StorageQuota, &u.CustomName, &u.CreatedAt, &u.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(codes), &u.RecoveryCodes); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(passkeys), &u.Passkeys); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// sqlMessageStore SQLiteにメッセージを保存するMessageStore
+type sqlMessageStore struct {
+	db *sql.DB
+}
+
+func newSQLMessageStore(db *sql.DB) *sqlMessageStore {
+	return &sqlMessageStore{db: db}
+}
+
+const messageColumns = `id, room, user_id, name, message, avatar_url, sent_at, forwarded, type, sticker, gif, snippet`
+
+// jsonColumn 転送元やスタンプなどの構造体をJSONとして保存する値。nilの場合は空文字列
+func jsonColumn(v interface{}) string {
+	data, _ := json.Marshal(v)
+	if string(data) == "null" {
+		return ""
+	}
+	return string(data)
+}
+
+// messageContentColumns メッセージの転送元、種類、スタンプ、GIF、コードの列の値
+func messageContentColumns(m *message) []interface{} {
+	return []interface{}{jsonColumn(m.Forwarded), m.Type, jsonColumn(m.Sticker), jsonColumn(m.GIF), jsonColumn(m.Snippet)}
+}
+
+// scanMessage messageColumnsの順に選択した行をメッセージに読み込む
+func scanMessage(row interface{ Scan(...interface{}) error }) (*message, error) {
+	var m message
+	var forwarded, sticker, gif, snippet string
+	if err := row.Scan(&m.ID, &m.Room, &m.UserID, &m.Name, &m.Message, &m.AvatarURL, &m.When,
+		&forwarded, &m.Type, &sticker, &gif, &snippet); err != nil {
+		return nil, err
+	}
+	for _, c := range []struct {
+		value string
+		dst   interface{}
+	}{{forwarded, &m.Forwarded}, {sticker, &m.Sticker}, {gif, &m.GIF}, {snippet, &m.Snippet}} {
+		if c.value == "" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(c.value), c.dst); err != nil {
+			return nil, err
+		}
+	}
+	return &m, nil
+}
+
+// scanMessages messageColumnsの順に選択したすべての行をメッセージに読み込む
+func scanMessages(rows *sql.Rows) ([]*message, error) {
+	defer rows.Close()
+	var list []*message
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlMessageStore) Save(m *message) error {
+	args := append([]interface{}{m.ID, m.Room, m.UserID, m.Name, m.Message, m.AvatarURL, m.When}, messageContentColumns(m)...)
+	_, err := s.db.Exec(`INSERT INTO messages (`+messageColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, args...)
+	return err
+}
+
+func (s *sqlMessageStore) Get(id string) (*message, error) {
+	m, err := scanMessage(s.db.QueryRow(`SELECT `+messageColumns+` FROM messages WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *sqlMessageStore) ListByUser(userID string) ([]*message, error) {
+	rows, err := s.db.Query(`SELECT `+messageColumns+` FROM messages WHERE user_id = ? ORDER BY seq`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+func (s *sqlMessageStore) Each(fn func(m *message) error) error {
+	rows, err := s.db.Query(`SELECT ` + messageColumns + ` FROM messages ORDER BY seq`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqlMessageStore) Around(id string, n int) ([]*message, error) {
+	var room string
+	var seq int64
+	err := s.db.QueryRow(`SELECT room, seq FROM messages WHERE id = ?`, id).Scan(&room, &seq)
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT `+messageColumns+` FROM messages WHERE room = ? AND seq < ? ORDER BY seq DESC LIMIT ?`, room, seq, n)
+	if err != nil {
+		return nil, err
+	}
+	before, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	rows, err = s.db.Query(`SELECT `+messageColumns+` FROM messages WHERE room = ? AND seq >= ? ORDER BY seq LIMIT ?`, room, seq, n+1)
+	if err != nil {
+		return nil, err
+	}
+	after, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*message, 0, len(before)+len(after))
+	for i := len(before) - 1; i >= 0; i-- {
+		list = append(list, before[i])
+	}
+	return append(list, after...), nil
+}
+
+func (s *sqlMessageStore) Update(m *message) error {
+	args := append([]interface{}{m.Room, m.UserID, m.Name, m.Message, m.AvatarURL, m.When}, messageContentColumns(m)...)
+	res, err := s.db.Exec(`UPDATE messages SET room = ?, user_id = ?, name = ?, message = ?, avatar_url = ?, sent_at = ?,
+		forwarded = ?, type = ?, sticker = ?, gif = ?, snippet = ? WHERE id = ?`, append(args, m.ID)...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+func (s *sqlMessageStore) Delete(id string) error {
+	res, err := s.db.Exec(`DELETE FROM messages WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+func (s *sqlMessageStore) DeleteByRoom(room string) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM messages WHERE room = ?`, room)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// sqlOAuthTokenStore SQLiteに認証プロバイダーのトークンを保存するOAuthTokenStore
+// 平文で保存するため、encryptedOAuthTokenStoreで包んで使う
+type sqlOAuthTokenStore struct {
+	db *sql.DB
+}
+
+func newSQLOAuthTokenStore(db *sql.DB) *sqlOAuthTokenStore {
+	return &sqlOAuthTokenStore{db: db}
+}
+
+func (s *sqlOAuthTokenStore) Save(t *OAuthToken) error {
+	var expiry sql.NullTime
+	if !t.Expiry.IsZero() {
+		expiry = sql.NullTime{Time: t.Expiry, Valid: true}
+	}
+	_, err := s.db.Exec(`INSERT INTO oauth_tokens (user_id, provider, access_token, refresh_token, token_type, expiry, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, provider) DO UPDATE SET access_token = excluded.access_token, refresh_token = excluded.refresh_token,
+			token_type = excluded.token_type, expiry = excluded.expiry, updated_at = excluded.updated_at`,
+		t.UserID, t.Provider, t.AccessToken, t.RefreshToken, t.TokenType, expiry, t.UpdatedAt)
+	return err
+}
+
+func (s *sqlOAuthTokenStore) Get(userID, provider string) (*OAuthToken, error) {
+	t := OAuthToken{UserID: userID, Provider: provider}
+	var expiry sql.NullTime
+	err := s.db.QueryRow(`SELECT access_token, refresh_token, token_type, expiry, updated_at FROM oauth_tokens WHERE user_id = ? AND provider = ?`,
+		userID, provider).Scan(&t.AccessToken, &t.RefreshToken, &t.TokenType, &expiry, &t.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrOAuthTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.Expiry = expiry.Time
+	return &t, nil
+}
+
+func (s *sqlOAuthTokenStore) DeleteByUser(userID string) error {
+	_, err := s.db.Exec(`DELETE FROM oauth_tokens WHERE user_id = ?`, userID)
+	return err
+}
+
+// sqlRoomStore SQLiteにルームの情報を保存するRoomStore
+type sqlRoomStore struct {
+	db *sql.DB
+}
+
+func newSQLRoomStore(db *sql.DB) *sqlRoomStore {
+	return &sqlRoomStore{db: db}
+}
+
+const roomColumns = `name, topic, description, icon_url, welcome, private, archived, updated_by, updated_at, settings`
+
+// scanRoomInfo 1行をRoomInfoとして読み込む。設定はJSONとして保存されている
+func scanRoomInfo(row interface{ Scan(...interface{}) error }) (*RoomInfo, error) {
+	var info RoomInfo
+	var settings string
+	if err := row.Scan(&info.Name, &info.Topic, &info.Description, &info.IconURL, &info.Welcome, &info.Private, &info.Archived, &info.UpdatedBy, &info.UpdatedAt, &settings); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(settings), &info.Settings); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (s *sqlRoomStore) Get(name string) (*RoomInfo, error) {
+	info, err := scanRoomInfo(s.db.QueryRow(`SELECT `+roomColumns+` FROM rooms WHERE name = ?`, name))
+	if err == sql.ErrNoRows {
+		return nil, ErrRoomInfoNotFound
+	}
+	return info, err
+}
+
+func (s *sqlRoomStore) Save(info *RoomInfo) error {
+	settings, err := json.Marshal(info.Settings)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO rooms (`+roomColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET topic = excluded.topic, description = excluded.description,
+			icon_url = excluded.icon_url, welcome = excluded.welcome, private = excluded.private, archived = excluded.archived, updated_by = excluded.updated_by, updated_at = excluded.updated_at,
+			settings = excluded.settings`,
+		info.Name, info.Topic, info.Description, info.IconURL, info.Welcome, info.Private, info.Archived, info.UpdatedBy, info.UpdatedAt, string(settings))
+	return err
+}
+
+func (s *sqlRoomStore) List() ([]*RoomInfo, error) {
+	rows, err := s.db.Query(`SELECT ` + roomColumns + ` FROM rooms ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []*RoomInfo
+	for rows.Next() {
+		info, err := scanRoomInfo(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, info)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlRoomStore) Delete(name string) error {
+	_, err := s.db.Exec(`DELETE FROM rooms WHERE name = ?`, name)
+	return err
+}
+
+// sqlNotificationPrefsStore SQLiteに通知の設定を保存するNotificationPrefsStore
+type sqlNotificationPrefsStore struct {
+	db *sql.DB
+}
+
+func newSQLNotificationPrefsStore(db *sql.DB) *sqlNotificationPrefsStore {
+	return &sqlNotificationPrefsStore{db: db}
+}
+
+func (s *sqlNotificationPrefsStore) Get(userID string) (*NotificationPrefs, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT prefs FROM notification_prefs WHERE user_id = ?`, userID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return defaultNotificationPrefs(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p NotificationPrefs
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *sqlNotificationPrefsStore) Save(userID string, p *NotificationPrefs) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO notification_prefs (user_id, prefs, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET prefs = excluded.prefs, updated_at = excluded.updated_at`,
+		userID, string(data), time.Now())
+	return err
+}
+
+func (s *sqlNotificationPrefsStore) Delete(userID string) error {
+	_, err := s.db.Exec(`DELETE FROM notification_prefs WHERE user_id = ?`, userID)
+	return err
+}
+
+// sqlGroupStore SQLiteにグループを保存するGroupStore
+// メンバーはJSONの配列として保存する
+type sqlGroupStore struct {
+	db *sql.DB
+}
+
+func newSQLGroupStore(db *sql.DB) *sqlGroupStore {
+	return &sqlGroupStore{db: db}
+}
+
+// scanGroup name, description, members, updated_atの順に選択した行をグループに読み込む
+func scanGroup(row interface{ Scan(...interface{}) error }) (*Group, error) {
+	var g Group
+	var members string
+	if err := row.Scan(&g.Name, &g.Description, &members, &g.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(members), &g.Members); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (s *sqlGroupStore) Get(name string) (*Group, error) {
+	g, err := scanGroup(s.db.QueryRow(`SELECT name, description, members, updated_at FROM groups WHERE name = ?`, name))
+	if err == sql.ErrNoRows {
+		return nil, ErrGroupNotFound
+	}
+	return g, err
+}
+
+func (s *sqlGroupStore) List() ([]*Group, error) {
+	rows, err := s.db.Query(`SELECT name, description, members, updated_at FROM groups ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*Group{}
+	for rows.Next() {
+		g, err := scanGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, g)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlGroupStore) Save(g *Group) error {
+	members, err := json.Marshal(g.Members)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO groups (name, description, members, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET description = excluded.description, members = excluded.members, updated_at = excluded.updated_at`,
+		g.Name, g.Description, string(members), g.UpdatedAt)
+	return err
+}
+
+func (s *sqlGroupStore) Delete(name string) error {
+	res, err := s.db.Exec(`DELETE FROM groups WHERE name = ?`, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrGroupNotFound
+	}
+	return nil
+}
+
+// sqlStarStore SQLiteにスターを保存するStarStore
+// メッセージを削除するとスターも削除される
+type sqlStarStore struct {
+	db *sql.DB
+}
+
+func newSQLStarStore(db *sql.DB) *sqlStarStore {
+	return &sqlStarStore{db: db}
+}
+
+func (s *sqlStarStore) Add(star *Star) error {
+	_, err := s.db.Exec(`INSERT INTO stars (user_id, message_id, starred_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+		star.UserID, star.MessageID, star.StarredAt)
+	return err
+}
+
+func (s *sqlStarStore) Remove(userID, messageID string) error {
+	res, err := s.db.Exec(`DELETE FROM stars WHERE user_id = ? AND message_id = ?`, userID, messageID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrStarNotFound
+	}
+	return nil
+}
+
+func (s *sqlStarStore) List(userID string) ([]*Star, error) {
+	rows, err := s.db.Query(`SELECT user_id, message_id, starred_at FROM stars WHERE user_id = ? ORDER BY starred_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*Star{}
+	for rows.Next() {
+		var star Star
+		if err := rows.Scan(&star.UserID, &star.MessageID, &star.StarredAt); err != nil {
+			return nil, err
+		}
+		list = append(list, &star)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStarStore) DeleteByUser(userID string) error {
+	_, err := s.db.Exec(`DELETE FROM stars WHERE user_id = ?`, userID)
+	return err
+}
+
+// sqlWelcomeStore SQLiteに参加の記録を保存するWelcomeStore
+type sqlWelcomeStore struct {
+	db *sql.DB
+}
+
+func newSQLWelcomeStore(db *sql.DB) *sqlWelcomeStore {
+	return &sqlWelcomeStore{db: db}
+}
+
+func (s *sqlWelcomeStore) FirstJoin(room, userID string, now time.Time) (bool, error) {
+	res, err := s.db.Exec(`INSERT INTO room_welcomes (room, user_id, joined_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`, room, userID, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *sqlWelcomeStore) DeleteByUser(userID string) error {
+	_, err := s.db.Exec(`DELETE FROM room_welcomes WHERE user_id = ?`, userID)
+	return err
+}
+
+// sqlMemberStore SQLiteに参加の記録を保存するMemberStore
+type sqlMemberStore struct {
+	db *sql.DB
+}
+
+func newSQLMemberStore(db *sql.DB) *sqlMemberStore {
+	return &sqlMemberStore{db: db}
+}
+
+func (s *sqlMemberStore) Visit(room, userID, ip string, now time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO room_members (room, user_id, ip, visits, joined_at, last_seen) VALUES (?, ?, ?, 1, ?, ?)
+		ON CONFLICT (room, user_id) DO UPDATE SET ip = excluded.ip, visits = visits + 1, last_seen = excluded.last_seen`,
+		room, userID, ip, now, now)
+	return err
+}
+
+func (s *sqlMemberStore) Get(room, userID string) (*RoomMember, error) {
+	var m RoomMember
+	err := s.db.QueryRow(`SELECT room, user_id, ip, visits, joined_at, last_seen FROM room_members WHERE room = ? AND user_id = ?`, room, userID).
+		Scan(&m.Room, &m.UserID, &m.IP, &m.Visits, &m.JoinedAt, &m.LastSeen)
+	if err == sql.ErrNoRows {
+		return nil, ErrMemberNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *sqlMemberStore) DeleteByUser(userID string) error {
+	_, err := s.db.Exec(`DELETE FROM room_members WHERE user_id = ?`, userID)
+	return err
+}
+
+// sqlHighlightStore SQLiteにキーワードを保存するHighlightStore
+// キーワードはJSONの配列として保存する
+type sqlHighlightStore struct {
+	db *sql.DB
+}
+
+func newSQLHighlightStore(db *sql.DB) *sqlHighlightStore {
+	return &sqlHighlightStore{db: db}
+}
+
+func (s *sqlHighlightStore) Get(userID string) ([]string, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT words FROM highlights WHERE user_id = ?`, userID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var words []string
+	err = json.Unmarshal([]byte(data), &words)
+	return words, err
+}
+
+func (s *sqlHighlightStore) Set(userID string, words []string) error {
+	if len(words) == 0 {
+		_, err := s.db.Exec(`DELETE FROM highlights WHERE user_id = ?`, userID)
+		return err
+	}
+	data, err := json.Marshal(words)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO highlights (user_id, words, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET words = excluded.words, updated_at = excluded.updated_at`,
+		userID, string(data), time.Now())
+	return err
+}
+
+func (s *sqlHighlightStore) All() (map[string][]string, error) {
+	rows, err := s.db.Query(`SELECT user_id, words FROM highlights`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	all := make(map[string][]string)
+	for rows.Next() {
+		var userID, data string
+		if err := rows.Scan(&userID, &data); err != nil {
+			return nil, err
+		}
+		var words []string
+		if err := json.Unmarshal([]byte(data), &words); err != nil {
+			return nil, err
+		}
+		all[userID] = words
+	}
+	return all, rows.Err()
+}
+
+// sqlAutoRuleStore SQLiteに自動応答のルールを保存するAutoRuleStore
+type sqlAutoRuleStore struct {
+	db *sql.DB
+}
+
+func newSQLAutoRuleStore(db *sql.DB) *sqlAutoRuleStore {
+	return &sqlAutoRuleStore{db: db}
+}
+
+func (s *sqlAutoRuleStore) List(room string) ([]*AutoRule, error) {
+	rows, err := s.db.Query(`SELECT id, room, pattern, keyword, reply, webhook, created_by, created_at FROM auto_rules
+		WHERE room = ? ORDER BY created_at`, room)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*AutoRule{}
+	for rows.Next() {
+		var rule AutoRule
+		if err := rows.Scan(&rule.ID, &rule.Room, &rule.Pattern, &rule.Keyword, &rule.Reply, &rule.Webhook, &rule.CreatedBy, &rule.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, &rule)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlAutoRuleStore) Save(rule *AutoRule) error {
+	_, err := s.db.Exec(`INSERT INTO auto_rules (id, room, pattern, keyword, reply, webhook, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET pattern = excluded.pattern, keyword = excluded.keyword, reply = excluded.reply, webhook = excluded.webhook`,
+		rule.ID, rule.Room, rule.Pattern, rule.Keyword, rule.Reply, rule.Webhook, rule.CreatedBy, rule.CreatedAt)
+	return err
+}
+
+func (s *sqlAutoRuleStore) Delete(room, id string) error {
+	res, err := s.db.Exec(`DELETE FROM auto_rules WHERE room = ? AND id = ?`, room, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAutoRuleNotFound
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrStarNotFound 指定されたメッセージにスターを付けていない場合に発生するエラー
+var ErrStarNotFound = errors.New("chat: スターを付けていないメッセージです。")
+
+// Star ユーザーがスターを付けて保存したメッセージ
+type Star struct {
+	UserID    string    `json:"user_id"`
+	MessageID string    `json:"message_id"`
+	StarredAt time.Time `json:"starred_at"`
+}
+
+// StarStore ユーザーごとにスターを付けたメッセージを保存する
+type StarStore interface {
+	// Add スターを付ける。既に付けている場合は何もしない
+	Add(s *Star) error
+	// Remove スターを外す。付けていない場合はErrStarNotFoundを返す
+	Remove(userID, messageID string) error
+	// List ユーザーがスターを付けたメッセージを新しい順に返す
+	List(userID string) ([]*Star, error)
+	DeleteByUser(userID string) error
+}
+
+// memoryStarStore メモリ上にスターを保持するStarStore
+type memoryStarStore struct {
+	mu    sync.Mutex
+	stars map[string]map[string]*Star
+}
+
+func newMemoryStarStore() *memoryStarStore {
+	return &memoryStarStore{stars: make(map[string]map[string]*Star)}
+}
+
+func (m *memoryStarStore) Add(s *Star) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stars[s.UserID] == nil {
+		m.stars[s.UserID] = make(map[string]*Star)
+	}
+	if _, ok := m.stars[s.UserID][s.MessageID]; !ok {
+		stored := *s
+		m.stars[s.UserID][s.MessageID] = &stored
+	}
+	return nil
+}
+
+func (m *memoryStarStore) Remove(userID, messageID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.stars[userID][messageID]; !ok {
+		return ErrStarNotFound
+	}
+	delete(m.stars[userID], messageID)
+	return nil
+}
+
+func (m *memoryStarStore) List(userID string) ([]*Star, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := []*Star{}
+	for _, s := range m.stars[userID] {
+		copied := *s
+		list = append(list, &copied)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StarredAt.After(list[j].StarredAt) })
+	return list, nil
+}
+
+func (m *memoryStarStore) DeleteByUser(userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.stars, userID)
+	return nil
+}
+
+// starredMessage スターを付けたメッセージとその内容
+type starredMessage struct {
+	Message   *message  `json:"message"`
+	StarredAt time.Time `json:"starred_at"`
+}
+
+// starredMessages ユーザーがスターを付けたメッセージの内容を新しい順に返す
+// 削除されたメッセージは含めない
+func starredMessages(userID string) ([]starredMessage, error) {
+	list, err := stars.List(userID)
+	if err != nil {
+		return nil, err
+	}
+	starred := []starredMessage{}
+	for _, s := range list {
+		m, err := messages.Get(s.MessageID)
+		if err == ErrMessageNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		starred = append(starred, starredMessage{Message: m, StarredAt: s.StarredAt})
+	}
+	return starred, nil
+}
+
+// starsHandler 自分がスターを付けたメッセージのAPI
+// GET    /api/me/stars       スターを付けたメッセージを新しい順に返す
+// PUT    /api/me/stars/{id}  メッセージにスターを付ける
+// DELETE /api/me/stars/{id}  スターを外す
+// 変更は本人の在室中のクライアントにstarred・unstarredイベントで知らせる
+type starsHandler struct {
+	rooms *roomRegistry
+}
+
+func (h *starsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	userID := user.UniqueID()
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/me/stars"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		list, err := starredMessages(userID)
+		if err != nil {
+			requestLogger(r).Println("スターを付けたメッセージの取得に失敗しました:", err)
+			writeJSONError(w, r, "スターを付けたメッセージを取得できませんでした", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case id != "" && r.Method == http.MethodPut:
+		if _, err := messages.Get(id); err != nil {
+			writeJSONError(w, r, ErrMessageNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		s := &Star{UserID: userID, MessageID: id, StarredAt: time.Now()}
+		if err := stars.Add(s); err != nil {
+			requestLogger(r).Println("スターの保存に失敗しました:", err)
+			writeJSONError(w, r, "スターを付けられませんでした", http.StatusInternalServerError)
+			return
+		}
+		h.rooms.sendToUser(&message{Type: typeStarred, UserID: userID, Ref: id, When: s.StarredAt})
+		writeJSON(w, http.StatusOK, s)
+	case id != "" && r.Method == http.MethodDelete:
+		if err := stars.Remove(userID, id); err != nil {
+			writeJSONError(w, r, err.Error(), http.StatusNotFound)
+			return
+		}
+		h.rooms.sendToUser(&message{Type: typeUnstarred, UserID: userID, Ref: id, When: time.Now()})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
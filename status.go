@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ユーザーが設定できる状態
+const (
+	statusOnline = "online"
+	statusAway   = "away"
+	// statusDNDは取り込み中。チャット内のお知らせ以外の通知(メールとプッシュ通知)を送らない
+	statusDND = "dnd"
+)
+
+// ErrInvalidStatus ユーザーの状態が不正な場合に発生するエラー
+var ErrInvalidStatus = errors.New("chat: 状態にはonline、away、dndのいずれかを指定してください。メッセージは100文字、絵文字は16文字以内で指定してください。")
+
+// UserStatus ユーザーが設定した状態
+type UserStatus struct {
+	UserID    string    `json:"user_id"`
+	State     string    `json:"state"`
+	Text      string    `json:"text,omitempty"`
+	Emoji     string    `json:"emoji,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (s *UserStatus) validate() error {
+	switch s.State {
+	case statusOnline, statusAway, statusDND:
+	default:
+		return ErrInvalidStatus
+	}
+	if utf8.RuneCountInString(s.Text) > 100 || utf8.RuneCountInString(s.Emoji) > 16 {
+		return ErrInvalidStatus
+	}
+	return nil
+}
+
+// StatusStore ユーザーの状態を保持する
+type StatusStore interface {
+	// Get ユーザーの状態を返す。設定していない場合はonlineを返す
+	Get(userID string) *UserStatus
+	// Set ユーザーの状態を保存する
+	Set(s *UserStatus)
+}
+
+// memoryStatusStore メモリ上にユーザーの状態を保持するStatusStore
+// 他のノードとは状態の変更のイベントを中継して同期する
+type memoryStatusStore struct {
+	mu       sync.Mutex
+	statuses map[string]*UserStatus
+}
+
+func newMemoryStatusStore() *memoryStatusStore {
+	return &memoryStatusStore{statuses: make(map[string]*UserStatus)}
+}
+
+func (m *memoryStatusStore) Get(userID string) *UserStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.statuses[userID]; ok {
+		copied := *s
+		return &copied
+	}
+	return &UserStatus{UserID: userID, State: statusOnline}
+}
+
+func (m *memoryStatusStore) Set(s *UserStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s.State == statusOnline && s.Text == "" && s.Emoji == "" {
+		delete(m.statuses, s.UserID)
+		return
+	}
+	copied := *s
+	m.statuses[s.UserID] = &copied
+}
+
+// doNotDisturb ユーザーが取り込み中かどうか
+func doNotDisturb(userID string) bool {
+	return statuses.Get(userID).State == statusDND
+}
+
+// SetStatus ユーザーの状態を変更し、すべてのルームのクライアントと他のノードに知らせる
+func (rs *roomRegistry) SetStatus(s *UserStatus, name string) {
+	msg := &message{Type: typeStatus, UserID: s.UserID, Name: name, Status: s, When: s.UpdatedAt}
+	rs.setStatusLocal(msg)
+	if rs.cluster != nil {
+		if err := rs.cluster.Publish(clusterBroadcast, msg); err != nil {
+			reporter.Report(err, map[string]string{"op": "status"})
+		}
+	}
+}
+
+// setStatusLocal このノードでユーザーの状態を保存し、すべてのルームのクライアントに配信する
+func (rs *roomRegistry) setStatusLocal(msg *message) {
+	statuses.Set(msg.Status)
+	rs.deliverLocal(msg)
+}
+
+// statusHandler 自分の状態のAPI
+// GET /api/me/status  状態を返す
+// PUT /api/me/status  JSONで状態を変更する
+type statusHandler struct {
+	rooms *roomRegistry
+}
+
+func (h *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, statuses.Get(user.UniqueID()))
+	case http.MethodPut:
+		var s UserStatus
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			writeJSONError(w, r, ErrInvalidStatus.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.validate(); err != nil {
+			writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.UserID = user.UniqueID()
+		s.UpdatedAt = time.Now()
+		h.rooms.SetStatus(&s, user.Name())
+		writeJSON(w, http.StatusOK, &s)
+	default:
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
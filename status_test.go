@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatusDNDSuppressesPush(t *testing.T) {
+	defer func(n Notifier, p Pusher, s NotificationPrefsStore, st StatusStore) {
+		notifier, pusher, notificationPrefs, statuses = n, p, s, st
+	}(notifier, pusher, notificationPrefs, statuses)
+	var sent recordingNotifier
+	var pushed recordingPusher
+	notifier, pusher, notificationPrefs, statuses = &sent, &pushed, newMemoryNotificationPrefsStore(), newMemoryStatusStore()
+
+	statuses.Set(&UserStatus{UserID: "u1", State: statusDND, Text: "会議中"})
+	notify(notification{UserID: "u1", Text: "a"}, time.Now())
+	if len(sent) != 1 || len(pushed) != 0 {
+		t.Errorf("取り込み中はチャット内のお知らせだけを送るべきです: %v, %v", sent, pushed)
+	}
+	statuses.Set(&UserStatus{UserID: "u1", State: statusOnline})
+	if s := statuses.Get("u1"); s.State != statusOnline || s.Text != "" {
+		t.Errorf("状態を戻せるべきです: %+v", s)
+	}
+	notify(notification{UserID: "u1", Text: "b"}, time.Now())
+	if len(pushed) != 1 {
+		t.Errorf("取り込み中でなければプッシュ通知を送るべきです: %v", pushed)
+	}
+	if err := (&UserStatus{State: "busy"}).validate(); err != ErrInvalidStatus {
+		t.Errorf("不明な状態は不正とみなすべきです: %v", err)
+	}
+}
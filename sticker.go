@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxStickerPacksPerUser 1人のユーザーが作成できるスタンプのパックの最大数
+	maxStickerPacksPerUser = 20
+	// maxStickersPerPack 1つのパックに登録できるスタンプの最大数
+	maxStickersPerPack = 100
+)
+
+var (
+	// ErrStickerPackNotFound 指定されたスタンプのパックが存在しない場合に発生するエラー
+	ErrStickerPackNotFound = errors.New("chat: スタンプのパックが見つかりません。")
+	// ErrStickerNotFound 指定されたスタンプが存在しない場合に発生するエラー
+	ErrStickerNotFound = errors.New("chat: スタンプが見つかりません。")
+	// ErrInvalidSticker スタンプの名前や画像が不正な場合に発生するエラー
+	ErrInvalidSticker = errors.New("chat: スタンプの名前は1文字以上32文字以内で、画像には自分がアップロードした公開済みの画像を指定してください。")
+	// ErrStickerLimit パックやスタンプの数が上限に達している場合に発生するエラー
+	ErrStickerLimit = errors.New("chat: スタンプのパックまたはスタンプの数が上限に達しています。")
+)
+
+// Sticker パックに登録された1つのスタンプ。画像は添付ファイルとして保存される
+type Sticker struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	AttachmentID string `json:"attachment_id"`
+}
+
+// URL スタンプの画像のURL
+func (s *Sticker) URL() string {
+	return "/attachments/" + s.AttachmentID
+}
+
+// StickerPack スタンプのパック
+// Curatedが真のパックは管理者が用意したもので、すべてのユーザーが使える
+// それ以外はOwnerIDのユーザーがアップロードしたもので、本人だけが使える
+type StickerPack struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	OwnerID   string    `json:"owner_id,omitempty"`
+	Curated   bool      `json:"curated"`
+	Stickers  []Sticker `json:"stickers"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// availableTo ユーザーがパックのスタンプを使えるかどうか
+func (p *StickerPack) availableTo(userID string) bool {
+	return p.Curated || p.OwnerID == userID
+}
+
+// sticker パックに登録されたスタンプを返す
+func (p *StickerPack) sticker(id string) (*Sticker, error) {
+	for i := range p.Stickers {
+		if p.Stickers[i].ID == id {
+			return &p.Stickers[i], nil
+		}
+	}
+	return nil, ErrStickerNotFound
+}
+
+// StickerRef メッセージで送信するスタンプ
+type StickerRef struct {
+	Pack string `json:"pack"`
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+// StickerStore スタンプのパックを保存する
+type StickerStore interface {
+	Get(id string) (*StickerPack, error)
+	// List ユーザーが使えるパックを、管理者が用意したもの、作成順の順に返す
+	List(userID string) ([]*StickerPack, error)
+	Save(p *StickerPack) error
+	Delete(id string) error
+}
+
+// memoryStickerStore メモリ上にスタンプのパックを保持するStickerStore
+type memoryStickerStore struct {
+	mu    sync.Mutex
+	packs map[string]*StickerPack
+}
+
+func newMemoryStickerStore() *memoryStickerStore {
+	return &memoryStickerStore{packs: make(map[string]*StickerPack)}
+}
+
+func copyStickerPack(p *StickerPack) *StickerPack {
+	copied := *p
+	copied.Stickers = append([]Sticker{}, p.Stickers...)
+	return &copied
+}
+
+func (s *memoryStickerStore) Get(id string) (*StickerPack, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.packs[id]
+	if !ok {
+		return nil, ErrStickerPackNotFound
+	}
+	return copyStickerPack(p), nil
+}
+
+func (s *memoryStickerStore) List(userID string) ([]*StickerPack, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []*StickerPack{}
+	for _, p := range s.packs {
+		if p.availableTo(userID) {
+			list = append(list, copyStickerPack(p))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Curated != list[j].Curated {
+			return list[i].Curated
+		}
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list, nil
+}
+
+func (s *memoryStickerStore) Save(p *StickerPack) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packs[p.ID] = copyStickerPack(p)
+	return nil
+}
+
+func (s *memoryStickerStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.packs[id]; !ok {
+		return ErrStickerPackNotFound
+	}
+	delete(s.packs, id)
+	return nil
+}
+
+// validStickerName スタンプやパックの名前として使えるかどうか
+func validStickerName(name string) bool {
+	n := utf8.RuneCountInString(name)
+	return n > 0 && n <= 32
+}
+
+// resolveSticker スタンプのメッセージを検証し、スタンプの名前と画像のURLを設定する
+// 履歴を読むクライアントのために、本文には代替テキストとして":名前:"を設定する
+func resolveSticker(userID string, msg *message) error {
+	if msg.Sticker == nil {
+		return ErrStickerNotFound
+	}
+	pack, err := stickers.Get(msg.Sticker.Pack)
+	if err != nil || !pack.availableTo(userID) {
+		return ErrStickerPackNotFound
+	}
+	s, err := pack.sticker(msg.Sticker.ID)
+	if err != nil {
+		return err
+	}
+	msg.Sticker = &StickerRef{Pack: pack.ID, ID: s.ID, Name: s.Name, URL: s.URL()}
+	msg.Message = ":" + s.Name + ":"
+	return nil
+}
+
+// stickerHandler スタンプのパックのAPI
+// GET    {prefix}                        使えるパックの一覧
+// POST   {prefix}                        パックを作成する
+// DELETE {prefix}/{pack}                 パックを削除する
+// POST   {prefix}/{pack}/stickers        スタンプを登録する
+// DELETE {prefix}/{pack}/stickers/{id}   スタンプを削除する
+// 利用者向け(/api/stickers)は自分のパックだけを、管理者向け(/api/admin/stickers)はすべてのユーザーが使えるパックを管理する
+type stickerHandler struct {
+	prefix string
+	// curatedが真の場合は管理者向けのAPIとして動作する
+	curated bool
+}
+
+func (h *stickerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, h.prefix), "/")
+	if path == "" {
+		switch r.Method {
+		case http.MethodGet:
+			h.list(w, r, user.UniqueID())
+		case http.MethodPost:
+			h.create(w, r, user.UniqueID())
+		default:
+			writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	parts := strings.Split(path, "/")
+	pack, err := stickers.Get(parts[0])
+	if err != nil || !h.manages(pack, user.UniqueID()) {
+		writeJSONError(w, r, ErrStickerPackNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if err := stickers.Delete(pack.ID); err != nil {
+			writeJSONError(w, r, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "stickers" && r.Method == http.MethodPost:
+		h.add(w, r, user.UniqueID(), pack)
+	case len(parts) == 3 && parts[1] == "stickers" && r.Method == http.MethodDelete:
+		if _, err := pack.sticker(parts[2]); err != nil {
+			writeJSONError(w, r, err.Error(), http.StatusNotFound)
+			return
+		}
+		kept := pack.Stickers[:0]
+		for _, s := range pack.Stickers {
+			if s.ID != parts[2] {
+				kept = append(kept, s)
+			}
+		}
+		pack.Stickers = kept
+		if err := stickers.Save(pack); err != nil {
+			requestLogger(r).Println("スタンプのパックの保存に失敗しました:", err)
+			writeJSONError(w, r, "スタンプを削除できませんでした", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, r, "見つかりません", http.StatusNotFound)
+	}
+}
+
+// manages このAPIでパックを変更できるかどうか
+func (h *stickerHandler) manages(p *StickerPack, userID string) bool {
+	if h.curated {
+		return p.Curated
+	}
+	return !p.Curated && p.OwnerID == userID
+}
+
+func (h *stickerHandler) list(w http.ResponseWriter, r *http.Request, userID string) {
+	list, err := stickers.List(userID)
+	if err != nil {
+		requestLogger(r).Println("スタンプのパックの取得に失敗しました:", err)
+		writeJSONError(w, r, "スタンプのパックを取得できませんでした", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (h *stickerHandler) create(w http.ResponseWriter, r *http.Request, userID string) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validStickerName(req.Name) {
+		writeJSONError(w, r, ErrInvalidSticker.Error(), http.StatusBadRequest)
+		return
+	}
+	pack := &StickerPack{ID: randomID(), Name: req.Name, Curated: h.curated, Stickers: []Sticker{}, CreatedAt: time.Now()}
+	if !h.curated {
+		pack.OwnerID = userID
+		list, err := stickers.List(userID)
+		if err != nil {
+			writeJSONError(w, r, "スタンプのパックを取得できませんでした", http.StatusInternalServerError)
+			return
+		}
+		owned := 0
+		for _, p := range list {
+			if p.OwnerID == userID {
+				owned++
+			}
+		}
+		if owned >= maxStickerPacksPerUser {
+			writeJSONError(w, r, ErrStickerLimit.Error(), http.StatusConflict)
+			return
+		}
+	}
+	if err := stickers.Save(pack); err != nil {
+		requestLogger(r).Println("スタンプのパックの保存に失敗しました:", err)
+		writeJSONError(w, r, "スタンプのパックを作成できませんでした", http.StatusInternalServerError)
+		return
+	}
+	if h.curated {
+		auditRequest(r, auditAdminAction, userID, "", map[string]string{"action": "create_sticker_pack", "pack": pack.ID, "name": pack.Name})
+	}
+	writeJSON(w, http.StatusCreated, pack)
+}
+
+// add アップロード済みの画像をスタンプとしてパックに登録する
+func (h *stickerHandler) add(w http.ResponseWriter, r *http.Request, userID string, pack *StickerPack) {
+	var req struct {
+		Name         string `json:"name"`
+		AttachmentID string `json:"attachment_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validStickerName(req.Name) {
+		writeJSONError(w, r, ErrInvalidSticker.Error(), http.StatusBadRequest)
+		return
+	}
+	a, err := attachments.Get(req.AttachmentID)
+	if err != nil || a.UserID != userID || a.Held || !strings.HasPrefix(a.ContentType, "image/") {
+		writeJSONError(w, r, ErrInvalidSticker.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(pack.Stickers) >= maxStickersPerPack {
+		writeJSONError(w, r, ErrStickerLimit.Error(), http.StatusConflict)
+		return
+	}
+	s := Sticker{ID: randomID(), Name: req.Name, AttachmentID: a.ID}
+	pack.Stickers = append(pack.Stickers, s)
+	if err := stickers.Save(pack); err != nil {
+		requestLogger(r).Println("スタンプのパックの保存に失敗しました:", err)
+		writeJSONError(w, r, "スタンプを登録できませんでした", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, s)
+}
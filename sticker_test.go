@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestResolveSticker(t *testing.T) {
+	defer func(s StickerStore) { stickers = s }(stickers)
+	stickers = newMemoryStickerStore()
+	stickers.Save(&StickerPack{ID: "p1", Name: "公式", Curated: true, Stickers: []Sticker{{ID: "s1", Name: "ok", AttachmentID: "a1"}}})
+	stickers.Save(&StickerPack{ID: "p2", Name: "自作", OwnerID: "u1", Stickers: []Sticker{{ID: "s2", Name: "yay", AttachmentID: "a2"}}})
+
+	msg := &message{Type: typeSticker, Sticker: &StickerRef{Pack: "p1", ID: "s1"}}
+	if err := resolveSticker("u2", msg); err != nil || msg.Sticker.URL != "/attachments/a1" || msg.Message != ":ok:" {
+		t.Errorf("管理者が用意したスタンプは誰でも使えるべきです: %+v, %v", msg.Sticker, err)
+	}
+	if err := resolveSticker("u2", &message{Sticker: &StickerRef{Pack: "p2", ID: "s2"}}); err != ErrStickerPackNotFound {
+		t.Errorf("他のユーザーのスタンプは使えないべきです: %v", err)
+	}
+	if err := resolveSticker("u1", &message{Sticker: &StickerRef{Pack: "p2", ID: "s9"}}); err != ErrStickerNotFound {
+		t.Errorf("存在しないスタンプは拒否するべきです: %v", err)
+	}
+	if list, _ := stickers.List("u1"); len(list) != 2 || !list[0].Curated {
+		t.Errorf("管理者が用意したパックを先に返すべきです: %v", list)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// systemdAddrPrefix アドレスがこの接頭辞で始まる場合はsystemdから引き継いだソケットで待ち受ける
+// "systemd:"は最初のソケットを、"systemd:名前"はFileDescriptorName=で名前を付けたソケットを使う
+const systemdAddrPrefix = "systemd:"
+
+// sdListenFDsStart systemdが引き継ぐ最初のファイルディスクリプタ
+const sdListenFDsStart = 3
+
+// ErrNoSystemdSocket systemdからソケットを引き継いでいない場合に発生するエラー
+var ErrNoSystemdSocket = errors.New("chat: systemdから引き継いだソケットが見つかりません。")
+
+var (
+	systemdOnce      sync.Once
+	systemdListeners map[string][]net.Listener
+	systemdOrder     []net.Listener
+	systemdErr       error
+)
+
+// inheritSystemdListeners ソケットアクティベーションで引き継いだソケットをリスナーにする (sd_listen_fds)
+// 子プロセスに引き継がれないよう、読み取った環境変数は削除する
+func inheritSystemdListeners() {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	systemdListeners = make(map[string][]net.Listener)
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(sdListenFDsStart+i), "systemd-socket-"+strconv.Itoa(i))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			systemdErr = err
+			return
+		}
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		systemdListeners[name] = append(systemdListeners[name], ln)
+		systemdOrder = append(systemdOrder, ln)
+	}
+}
+
+// systemdListener systemdから引き継いだソケットのうち、名前が一致するものを返す
+// 名前が空の場合は最初のソケットを返す
+func systemdListener(name string) (net.Listener, error) {
+	systemdOnce.Do(inheritSystemdListeners)
+	if systemdErr != nil {
+		return nil, systemdErr
+	}
+	if name == "" {
+		if len(systemdOrder) == 0 {
+			return nil, ErrNoSystemdSocket
+		}
+		return systemdOrder[0], nil
+	}
+	list := systemdListeners[name]
+	if len(list) == 0 {
+		return nil, ErrNoSystemdSocket
+	}
+	return list[0], nil
+}
+
+// sdNotify systemdにサービスの状態を通知する (sd_notify)
+// Type=notifyで起動されていない場合は何もしない
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Errorf("通知した状態が一致しません: %q", buf[:n])
+	}
+}
+
+func TestSystemdListenerOtherProcess(t *testing.T) {
+	// 他のプロセスに宛てたソケットは引き継がない
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	if _, err := systemdListener(""); err != ErrNoSystemdSocket {
+		t.Error("ソケットを引き継いでいない場合はエラーになるべきです")
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("読み取った環境変数は削除するべきです")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var botTokens = flag.String("bot-tokens", "", "ボット用のBearerトークン (名前:トークン をカンマ区切りで指定)")
+
+// ErrInvalidToken Bearerトークンを検証できなかった場合に発生するエラー
+var ErrInvalidToken = errors.New("chat: トークンが無効です。")
+
+// TokenAuthenticator Bearerトークンを検証し対応するユーザーを返す
+type TokenAuthenticator interface {
+	// Authenticate 指定されたトークンに対応するユーザーを返す
+	// *トークンが無効な場合にはErrInvalidTokenを返す
+	Authenticate(token string) (ChatUser, error)
+}
+
+// TryTokenAuthenticators 複数のトークン認証を順番に試す
+type TryTokenAuthenticators []TokenAuthenticator
+
+// Authenticate Receiver:TryTokenAuthenticators
+func (a TryTokenAuthenticators) Authenticate(token string) (ChatUser, error) {
+	for _, auth := range a {
+		if user, err := auth.Authenticate(token); err == nil {
+			return user, nil
+		}
+	}
+	return nil, ErrInvalidToken
+}
+
+// botUser ボットトークンで認証されたユーザー
+type botUser struct {
+	uniqueID string
+	name     string
+}
+
+func (u botUser) UniqueID() string  { return u.uniqueID }
+func (u botUser) Name() string      { return u.name }
+func (u botUser) AvatarURL() string { return "" }
+
+// staticTokens 起動時に設定された固定のトークン。キーはトークンのSHA-256ハッシュ
+type staticTokens map[string]ChatUser
+
+// parseBotTokens "名前:トークン"をカンマ区切りで並べた文字列からstaticTokensを生成する
+func parseBotTokens(s string) (staticTokens, error) {
+	tokens := staticTokens{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.Index(entry, ":")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("chat: ボットトークンの形式が不正です: %q", entry)
+		}
+		name, token := entry[:i], entry[i+1:]
+		m := md5.New()
+		io.WriteString(m, "bot:"+strings.ToLower(name))
+		tokens[hashToken(token)] = botUser{uniqueID: fmt.Sprintf("%x", m.Sum(nil)), name: name}
+	}
+	return tokens, nil
+}
+
+// Authenticate Receiver:staticTokens
+func (t staticTokens) Authenticate(token string) (ChatUser, error) {
+	if user, ok := t[hashToken(token)]; ok {
+		return user, nil
+	}
+	return nil, ErrInvalidToken
+}
+
+// hashToken トークンを平文のまま保持しないためにハッシュ化する
+func hashToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// bearerToken AuthorizationヘッダーからBearerトークンを取り出す
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(h[len(prefix):]), true
+}
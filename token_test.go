@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseBotTokens(t *testing.T) {
+	tests := []struct {
+		in    string
+		count int
+		ok    bool
+	}{
+		{"", 0, true},
+		{"alerts:s1", 1, true},
+		{"alerts:s1, deploy:s2", 2, true},
+		{"alerts", 0, false},
+		{":s1", 0, false},
+		{"alerts:", 0, false},
+	}
+	for _, test := range tests {
+		tokens, err := parseBotTokens(test.in)
+		if (err == nil) != test.ok || len(tokens) != test.count {
+			t.Errorf("%q: %d件、エラー%vになるべきところ%d件、%vでした", test.in, test.count, !test.ok, len(tokens), err)
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		token  string
+		ok     bool
+	}{
+		{"Bearer abc", "abc", true},
+		{"bearer  abc ", "abc", true},
+		{"Bearer ", "", false},
+		{"Basic YWJj", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", test.header)
+		if token, ok := bearerToken(r); token != test.token || ok != test.ok {
+			t.Errorf("%q: %q, %vになるべきところ%q, %vでした", test.header, test.token, test.ok, token, ok)
+		}
+	}
+}
+
+func TestMustAuthBearer(t *testing.T) {
+	defer func(a TokenAuthenticator) { tokenAuth = a }(tokenAuth)
+	bots, err := parseBotTokens("alerts:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenAuth = TryTokenAuthenticators{bots}
+	defer func(l *loginLimiter) { loginLimits = l }(loginLimits)
+	loginLimits = newLoginLimiter(5, 0, 0)
+
+	h := MustAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := userFromContext(r.Context())
+		w.Write([]byte(user.Name()))
+	}))
+	tests := []struct {
+		header string
+		code   int
+		body   string
+	}{
+		{"Bearer secret", http.StatusOK, "alerts"},
+		{"Bearer wrong", http.StatusUnauthorized, ""},
+		{"", http.StatusTemporaryRedirect, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/api/rooms", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%q: %dになるべきところ%dでした", test.header, test.code, w.Code)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%q: トークンのユーザー%sとして処理するべきところ%sでした", test.header, test.body, w.Body.String())
+		}
+		if test.code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%q: WWW-Authenticateヘッダーを返すべきです", test.header)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOTPのパラメーター (RFC 6238)
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	totpIssuer        = "GoChat"
+	recoveryCodeCount = 10
+	// secondFactorTTL OAuthのログイン後に二要素認証を完了するまでの制限時間
+	secondFactorTTL = 5 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret ランダムなTOTPの秘密鍵を生成する
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err.Error())
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpCode 指定された時刻のTOTPのコードを計算する
+func totpCode(secret string, t time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/totpPeriod))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000), nil
+}
+
+// validTOTP 時刻のずれを前後1ステップまで許容してコードを検証し、一致したタイムステップを返す
+// 一度使われたコードを再び使えないように、lastStep以前のステップのコードは受け付けない
+func validTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	for i := -totpSkew; i <= totpSkew; i++ {
+		t := now.Add(time.Duration(i*totpPeriod) * time.Second)
+		step := t.Unix() / totpPeriod
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, t)
+		if err == nil && hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI 認証アプリのQRコードに埋め込むプロビジョニングURIを返す
+func totpURI(secret, account string) string {
+	label := url.PathEscape(totpIssuer + ":" + account)
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// newRecoveryCodes リカバリーコードを生成し、平文とハッシュを返す
+func newRecoveryCodes() (codes, hashes []string) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := randomID()[:10]
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes
+}
+
+// secondFactorMu 同じコードが同時に送信されても一度だけ受け付けるよう、検証と保存をまとめて行う
+var secondFactorMu sync.Mutex
+
+// verifySecondFactor TOTPのコードまたはリカバリーコードを検証する
+// TOTPのコードとリカバリーコードはどちらも一度使用すると無効になる
+func verifySecondFactor(record *UserRecord, code string) (bool, error) {
+	secondFactorMu.Lock()
+	defer secondFactorMu.Unlock()
+	// 他のリクエストで使用済みになったコードを反映する
+	if stored, err := users.GetByID(record.ID); err == nil {
+		record.TOTPLastStep, record.RecoveryCodes = stored.TOTPLastStep, stored.RecoveryCodes
+	}
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if step, ok := validTOTP(record.TOTPSecret, code, time.Now(), record.TOTPLastStep); ok {
+		record.TOTPLastStep = step
+		return true, users.Update(record)
+	}
+	hashed := hashToken(strings.ToLower(code))
+	for i, h := range record.RecoveryCodes {
+		if hmac.Equal([]byte(h), []byte(hashed)) {
+			record.RecoveryCodes = append(record.RecoveryCodes[:i:i], record.RecoveryCodes[i+1:]...)
+			return true, users.Update(record)
+		}
+	}
+	return false, nil
+}
+
+// pendingLogin OAuthのログインは完了したが二要素認証が済んでいないログイン
+type pendingLogin struct {
+	userID    string
+	avatarURL string
+	method    string
+	expires   time.Time
+}
+
+var (
+	pendingLoginsMu sync.Mutex
+	pendingLogins   = make(map[string]*pendingLogin)
+)
+
+// beginSecondFactor 二要素認証待ちのログインを記録し、確認画面へリダイレクトする
+func beginSecondFactor(w http.ResponseWriter, r *http.Request, userID, avatarURL, method string) {
+	startPendingLogin(w, r, userID, avatarURL, method)
+	w.Header()["Location"] = []string{"/login/2fa"}
+	w.WriteHeader(http.StatusTemporaryRedirect)
+}
+
+// startPendingLogin 二要素認証待ちのログインを記録し、対応するCookieを設定する
+func startPendingLogin(w http.ResponseWriter, r *http.Request, userID, avatarURL, method string) {
+	token := randomID()
+	pendingLoginsMu.Lock()
+	for t, p := range pendingLogins {
+		if time.Now().After(p.expires) {
+			delete(pendingLogins, t)
+		}
+	}
+	pendingLogins[hashToken(token)] = &pendingLogin{
+		userID:    userID,
+		avatarURL: avatarURL,
+		method:    method,
+		expires:   time.Now().Add(secondFactorTTL),
+	}
+	pendingLoginsMu.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth_2fa",
+		Value:    token,
+		Path:     "/login/2fa",
+		MaxAge:   int(secondFactorTTL.Seconds()),
+		Secure:   isSecureRequest(r),
+		HttpOnly: true,
+	})
+}
+
+// ErrNoPendingLogin 二要素認証待ちのログインが見つからない場合に発生するエラー
+var ErrNoPendingLogin = errors.New("chat: 有効期限が切れました。もう一度ログインしてください。")
+
+// pendingLoginFromRequest Cookieに対応する二要素認証待ちのログインを返す
+func pendingLoginFromRequest(r *http.Request) (*pendingLogin, error) {
+	cookie, err := r.Cookie("auth_2fa")
+	if err != nil {
+		return nil, ErrNoPendingLogin
+	}
+	pendingLoginsMu.Lock()
+	defer pendingLoginsMu.Unlock()
+	pending, ok := pendingLogins[hashToken(cookie.Value)]
+	if !ok || time.Now().After(pending.expires) {
+		return nil, ErrNoPendingLogin
+	}
+	return pending, nil
+}
+
+// finishPendingLogin 二要素認証が完了したログインの記録とCookieを削除する
+func finishPendingLogin(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie("auth_2fa"); err == nil {
+		pendingLoginsMu.Lock()
+		delete(pendingLogins, hashToken(cookie.Value))
+		pendingLoginsMu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: "auth_2fa", Value: "", Path: "/login/2fa", MaxAge: -1})
+}
+
+// secondFactorHandler ログイン時の二要素認証の確認画面
+// GETでコードの入力画面を表示し、POSTでコードを検証してログインを完了する
+type secondFactorHandler struct {
+	form http.Handler
+}
+
+func (h *secondFactorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, err := r.Cookie("auth_2fa"); err != nil {
+		w.Header()["Location"] = []string{"/login"}
+		w.WriteHeader(http.StatusTemporaryRedirect)
+		return
+	}
+	pending, err := pendingLoginFromRequest(r)
+	if err != nil {
+		httpError(w, r, "有効期限が切れました。もう一度ログインしてください", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		h.form.ServeHTTP(w, r)
+		return
+	}
+	if wait, locked := loginLimits.check(ipKey(r), accountKey(pending.userID)); locked {
+		tooManyAttempts(w, r, wait)
+		return
+	}
+	record, err := users.GetByID(pending.userID)
+	if err != nil {
+		httpError(w, r, "ユーザーが見つかりません", http.StatusUnauthorized)
+		return
+	}
+	if ok, err := verifySecondFactor(record, r.FormValue("code")); err != nil {
+		requestLogger(r).Println("リカバリーコードの更新に失敗しました:", err)
+		httpError(w, r, "二要素認証に失敗しました", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		loginLimits.fail(ipKey(r), accountKey(record.ID))
+		auditRequest(r, auditAuthFailed, record.ID, "", map[string]string{"method": "totp"})
+		httpError(w, r, "コードが正しくありません", http.StatusUnauthorized)
+		return
+	}
+	finishPendingLogin(w, r)
+	completeLogin(w, r, record.ID, pending.avatarURL, pending.method+"+totp")
+}
+
+// totpSettingsHandler 二要素認証の設定API
+// POST /account/2fa/enroll  秘密鍵とプロビジョニングURIを発行する
+// POST /account/2fa/confirm コードを確認して有効にし、リカバリーコードを返す
+// POST /account/2fa/disable コードを確認して無効にする
+func totpSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	user, _ := userFromContext(r.Context())
+	record, err := users.GetByID(user.UniqueID())
+	if err != nil {
+		writeJSONError(w, r, "このアカウントでは二要素認証を利用できません", http.StatusBadRequest)
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, "/account/2fa/") {
+	case "enroll":
+		if record.TOTPEnabled {
+			writeJSONError(w, r, "二要素認証は既に有効です", http.StatusConflict)
+			return
+		}
+		record.TOTPSecret = newTOTPSecret()
+		record.TOTPLastStep = 0
+		if err := users.Update(record); err != nil {
+			writeJSONError(w, r, "秘密鍵の保存に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		account := record.Email
+		if account == "" {
+			account = record.Name
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"secret": record.TOTPSecret,
+			"uri":    totpURI(record.TOTPSecret, account),
+		})
+	case "confirm":
+		step, ok := validTOTP(record.TOTPSecret, r.FormValue("code"), time.Now(), record.TOTPLastStep)
+		if record.TOTPSecret == "" || !ok {
+			writeJSONError(w, r, "コードが正しくありません", http.StatusBadRequest)
+			return
+		}
+		codes, hashes := newRecoveryCodes()
+		record.TOTPLastStep = step
+		record.TOTPEnabled = true
+		record.RecoveryCodes = hashes
+		if err := users.Update(record); err != nil {
+			writeJSONError(w, r, "設定の保存に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		auditRequest(r, auditAdminAction, record.ID, record.ID, map[string]string{"action": "totp_enabled"})
+		writeJSON(w, http.StatusOK, map[string]interface{}{"recovery_codes": codes})
+	case "disable":
+		if ok, err := verifySecondFactor(record, r.FormValue("code")); err != nil || !ok {
+			writeJSONError(w, r, "コードが正しくありません", http.StatusBadRequest)
+			return
+		}
+		record.TOTPEnabled = false
+		record.TOTPSecret = ""
+		record.RecoveryCodes = nil
+		if err := users.Update(record); err != nil {
+			writeJSONError(w, r, "設定の保存に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		auditRequest(r, auditAdminAction, record.ID, record.ID, map[string]string{"action": "totp_disabled"})
+		writeJSON(w, http.StatusOK, map[string]bool{"enabled": false})
+	default:
+		writeJSONError(w, r, "見つかりません", http.StatusNotFound)
+	}
+}
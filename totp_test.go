@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 付録Bのテストベクター (SHA-1)
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range tests {
+		got, err := totpCode(secret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatalf("totpCodeがエラーを返しました: %s", err)
+		}
+		if got != want {
+			t.Errorf("時刻%dのコードは%sであるべきですが%sでした", unix, want, got)
+		}
+	}
+	// 時刻59のコードはタイムステップ1のもの
+	validTests := []struct {
+		now      int64
+		lastStep int64
+		valid    bool
+	}{
+		{59, 0, true},
+		{59 + totpPeriod, 0, true},
+		{59 + 3*totpPeriod, 0, false},
+		// 既に受け付けたステップのコードは再び使えない
+		{59, 1, false},
+		{59 + totpPeriod, 1, false},
+		{59 + totpPeriod, 2, false},
+	}
+	for _, test := range validTests {
+		step, ok := validTOTP(secret, "287082", time.Unix(test.now, 0), test.lastStep)
+		if ok != test.valid || (ok && step != 1) {
+			t.Errorf("時刻%d、最後のステップ%d: %vになるべきところ%v (ステップ%d)でした", test.now, test.lastStep, test.valid, ok, step)
+		}
+	}
+}
+
+func TestVerifySecondFactorReplay(t *testing.T) {
+	defer func(u UserStore) { users = u }(users)
+	users = newMemoryUserStore()
+	secret := newTOTPSecret()
+	_, hashes := newRecoveryCodes()
+	users.Create(&UserRecord{ID: "u1", Name: "Alice", TOTPSecret: secret, TOTPEnabled: true, RecoveryCodes: hashes})
+	code, err := totpCode(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, _ := users.GetByID("u1")
+	if ok, err := verifySecondFactor(record, code); err != nil || !ok {
+		t.Fatalf("有効なコードは受け付けるべきです: %v", err)
+	}
+	if stored, _ := users.GetByID("u1"); stored.TOTPLastStep != time.Now().Unix()/totpPeriod && stored.TOTPLastStep != time.Now().Unix()/totpPeriod-1 {
+		t.Errorf("受け付けたタイムステップを保存するべきですが%dでした", stored.TOTPLastStep)
+	}
+	// 別のリクエストで読み込んだユーザーでも、使用済みのコードは受け付けない
+	stale := &UserRecord{ID: "u1", Name: "Alice", TOTPSecret: secret, TOTPEnabled: true, RecoveryCodes: hashes}
+	for _, r := range []*UserRecord{record, stale} {
+		if ok, _ := verifySecondFactor(r, code); ok {
+			t.Error("一度使用したコードは再び受け付けるべきではありません")
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goki0524/gopackage/trace"
+)
+
+var (
+	traceStdout     = flag.Bool("trace-stdout", true, "トレースを標準出力に出力する")
+	traceFile       = flag.String("trace-file", "", "トレースを出力するファイル (空の場合はファイルに出力しない)")
+	traceMaxSize    = flag.Int64("trace-max-size", 100, "トレースのファイルがこのサイズ(MB)を超えたら切り替える (0の場合はサイズでは切り替えない)")
+	traceMaxAge     = flag.Duration("trace-max-age", 24*time.Hour, "トレースのファイルをこの期間ごとに切り替える (0の場合は期間では切り替えない)")
+	traceMaxBackups = flag.Int("trace-max-backups", 7, "切り替えた古いトレースのファイルを残す数 (0の場合はすべて残す)")
+	traceCompress   = flag.Bool("trace-compress", true, "切り替えた古いトレースのファイルをgzipで圧縮する")
+)
+
+// rotatedSuffix 切り替えたファイルの名前に付ける時刻の書式
+const rotatedSuffix = "20060102-150405.000"
+
+// rotatingFile サイズか期間の上限に達すると新しいファイルに切り替えるio.WriteCloser
+// 古いファイルは"{path}.{時刻}"に名前を変え、必要に応じて圧縮し、maxBackupsを超えた分を削除する
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+	// nowは現在時刻を返す。テストで置き換える
+	now func() time.Time
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	// compressingは圧縮中の古いファイル。Closeで完了を待つ
+	compressing sync.WaitGroup
+}
+
+// newRotatingFile ファイルを追記で開く
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int, compress bool) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups, compress: compress, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.openedAt = file, info.Size(), f.now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	if f.size > 0 && ((f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize) || (f.maxAge > 0 && now.Sub(f.openedAt) >= f.maxAge)) {
+		if err := f.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotateは現在のファイルの名前を変えて新しいファイルを開く
+// f.muを保持して呼び出す
+func (f *rotatingFile) rotate(now time.Time) error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	rotated := f.path + "." + now.Format(rotatedSuffix)
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	if !f.compress {
+		f.prune()
+		return nil
+	}
+	// 書き込みを止めないよう、圧縮は別のゴルーチンで行う
+	f.compressing.Add(1)
+	go func() {
+		defer f.compressing.Done()
+		if err := gzipFile(rotated); err != nil {
+			log.Println("トレースのファイルを圧縮できませんでした:", err)
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.prune()
+	}()
+	return nil
+}
+
+// pruneはmaxBackupsを超えた古いファイルを削除する
+// f.muを保持して呼び出す
+func (f *rotatingFile) prune() {
+	if f.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	// 圧縮前と圧縮後のファイルを同じものとして数える
+	seen := make(map[string]bool)
+	var names []string
+	for _, b := range backups {
+		name := strings.TrimSuffix(b, ".gz")
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	// 時刻の書式は辞書順に並べると古い順になる
+	sort.Strings(names)
+	for len(names) > f.maxBackups {
+		os.Remove(names[0])
+		os.Remove(names[0] + ".gz")
+		names = names[1:]
+	}
+}
+
+// Close ファイルを閉じ、圧縮中のファイルがあれば完了を待つ
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	err := f.file.Close()
+	f.mu.Unlock()
+	f.compressing.Wait()
+	return err
+}
+
+// gzipFile ファイルを"{path}.gz"に圧縮して元のファイルを削除する
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// openTracer フラグの設定に従ってトレースの出力先を開く
+// 標準出力とファイルの両方が指定されている場合は両方に出力し、どちらもなければ出力しない
+// 返す関数は終了時にファイルを閉じる
+func openTracer() (trace.Tracer, func() error, error) {
+	var writers []io.Writer
+	closeFile := func() error { return nil }
+	if *traceStdout {
+		writers = append(writers, os.Stdout)
+	}
+	if *traceFile != "" {
+		f, err := newRotatingFile(*traceFile, *traceMaxSize<<20, *traceMaxAge, *traceMaxBackups, *traceCompress)
+		if err != nil {
+			return nil, nil, err
+		}
+		writers = append(writers, f)
+		closeFile = f.Close
+	}
+	if len(writers) == 0 {
+		return trace.Off(), closeFile, nil
+	}
+	return trace.New(io.MultiWriter(writers...)), closeFile, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace.log")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f, err := newRotatingFile(path, 10, time.Hour, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.now = func() time.Time { return now }
+
+	// サイズの上限で2回、期間の上限で1回切り替える
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Second)
+	}
+	now = now.Add(time.Hour)
+	f.Write([]byte("dddd\n"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := ioutil.ReadFile(path); string(data) != "dddd\n" {
+		t.Errorf("現在のファイルには切り替えた後の出力だけが含まれるべきです: %q", data)
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("古いファイルは-trace-max-backupsの数だけ残すべきです: %v", backups)
+	}
+	r, err := os.Open(backups[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("古いファイルは圧縮するべきです: %v", err)
+	}
+	if data, _ := ioutil.ReadAll(zr); string(data) != "cccccccc\n" {
+		t.Errorf("圧縮したファイルの内容が違います: %q", data)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	translatorName = flag.String("translator", "", "メッセージの翻訳に使用するサービス (deepl, google, libretranslate。空の場合は無効)")
+	translatorKey  = flag.String("translator-key", "", "翻訳サービスのAPIキー")
+	translatorURL  = flag.String("translator-url", "", "翻訳サービスのURL (LibreTranslateでは必須、DeepLでは有料版のURLを指定できる)")
+	// translationCacheSizeを超えた翻訳結果は最も長く使われていないものから破棄する
+	translationCacheSize = flag.Int("translation-cache-size", 10000, "メモリ上に保持する翻訳結果の最大数")
+)
+
+// ErrNoTranslator 翻訳サービスが設定されていない場合に発生するエラー
+var ErrNoTranslator = errors.New("chat: 翻訳は利用できません。")
+
+// Translator テキストを翻訳する
+type Translator interface {
+	// Translate textをlang(ISO 639-1の言語コード)に翻訳する
+	Translate(text, lang string) (string, error)
+}
+
+// translatorHTTPClient 翻訳サービスへのリクエストに使用するHTTPクライアント
+var translatorHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// newTranslator フラグの設定に従ってTranslatorを生成する
+func newTranslator(name, key, endpoint string) (Translator, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "deepl":
+		if endpoint == "" {
+			endpoint = "https://api-free.deepl.com/v2/translate"
+		}
+		return &deepLTranslator{key: key, endpoint: endpoint}, nil
+	case "google":
+		if endpoint == "" {
+			endpoint = "https://translation.googleapis.com/language/translate/v2"
+		}
+		return &googleTranslator{key: key, endpoint: endpoint}, nil
+	case "libretranslate":
+		if endpoint == "" {
+			return nil, errors.New("chat: LibreTranslateのURLを指定してください。")
+		}
+		return &libreTranslator{key: key, endpoint: strings.TrimSuffix(endpoint, "/") + "/translate"}, nil
+	}
+	return nil, fmt.Errorf("chat: 非対応の翻訳サービスです: %s", name)
+}
+
+// postTranslation 翻訳サービスにリクエストを送信し、JSONのレスポンスをvに読み込む
+func postTranslation(req *http.Request, v interface{}) error {
+	res, err := translatorHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("chat: 翻訳サービスがエラーを返しました: %s", res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// deepLTranslator DeepL APIを使用するTranslator
+type deepLTranslator struct {
+	key      string
+	endpoint string
+}
+
+func (t *deepLTranslator) Translate(text, lang string) (string, error) {
+	form := url.Values{"text": {text}, "target_lang": {strings.ToUpper(lang)}}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "DeepL-Auth-Key "+t.key)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var body struct {
+		Translations []struct {
+			Text string `json:"text"`
+		} `json:"translations"`
+	}
+	if err := postTranslation(req, &body); err != nil {
+		return "", err
+	}
+	if len(body.Translations) == 0 {
+		return "", errors.New("chat: 翻訳結果がありません。")
+	}
+	return body.Translations[0].Text, nil
+}
+
+// googleTranslator Google Cloud Translation API (v2)を使用するTranslator
+type googleTranslator struct {
+	key      string
+	endpoint string
+}
+
+func (t *googleTranslator) Translate(text, lang string) (string, error) {
+	form := url.Values{"q": {text}, "target": {lang}, "format": {"text"}}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint+"?key="+url.QueryEscape(t.key), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var body struct {
+		Data struct {
+			Translations []struct {
+				TranslatedText string `json:"translatedText"`
+			} `json:"translations"`
+		} `json:"data"`
+	}
+	if err := postTranslation(req, &body); err != nil {
+		return "", err
+	}
+	if len(body.Data.Translations) == 0 {
+		return "", errors.New("chat: 翻訳結果がありません。")
+	}
+	return body.Data.Translations[0].TranslatedText, nil
+}
+
+// libreTranslator LibreTranslateを使用するTranslator
+type libreTranslator struct {
+	key      string
+	endpoint string
+}
+
+func (t *libreTranslator) Translate(text, lang string) (string, error) {
+	payload, err := json.Marshal(map[string]string{
+		"q":       text,
+		"source":  "auto",
+		"target":  lang,
+		"format":  "text",
+		"api_key": t.key,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var body struct {
+		TranslatedText string `json:"translatedText"`
+	}
+	if err := postTranslation(req, &body); err != nil {
+		return "", err
+	}
+	return body.TranslatedText, nil
+}
+
+// translationCache メッセージの翻訳結果を言語ごとに保持する
+// sizeを超えた場合は最も長く使われていない結果から破棄する
+type translationCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	// recentは使われた順の翻訳結果。先頭が最も新しい
+	recent *list.List
+}
+
+// translationEntry キャッシュされた1件の翻訳結果
+type translationEntry struct {
+	key  string
+	text string
+}
+
+func newTranslationCache(size int) *translationCache {
+	if size < 1 {
+		size = 1
+	}
+	return &translationCache{size: size, entries: make(map[string]*list.Element), recent: list.New()}
+}
+
+func (c *translationCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	c.recent.MoveToFront(e)
+	return e.Value.(*translationEntry).text, true
+}
+
+func (c *translationCache) put(key, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*translationEntry).text = text
+		c.recent.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.recent.PushFront(&translationEntry{key: key, text: text})
+	for c.recent.Len() > c.size {
+		oldest := c.recent.Back()
+		c.recent.Remove(oldest)
+		delete(c.entries, oldest.Value.(*translationEntry).key)
+	}
+}
+
+// translateMessage メッセージを翻訳する。一度翻訳した結果はキャッシュから返す
+// 呼び出す側でユーザーがmsgのルームを利用できることを確認しておく
+func (c *translationCache) translateMessage(t Translator, msg *message, lang string) (string, error) {
+	if t == nil {
+		return "", ErrNoTranslator
+	}
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if lang == "" || len(lang) > 8 {
+		return "", errors.New("chat: 翻訳先の言語を指定してください。")
+	}
+	key := msg.ID + "/" + lang
+	if text, ok := c.get(key); ok {
+		return text, nil
+	}
+	text, err := t.Translate(msg.Message, lang)
+	if err != nil {
+		return "", err
+	}
+	c.put(key, text)
+	return text, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+// countingTranslator 翻訳した回数を数えるTranslator
+type countingTranslator struct {
+	calls int
+}
+
+func (t *countingTranslator) Translate(text, lang string) (string, error) {
+	t.calls++
+	return "[" + lang + "] " + text, nil
+}
+
+func TestTranslationCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	tr := &countingTranslator{}
+	c := newTranslationCache(2)
+	msgs := []*message{
+		{ID: "m1", Message: "こんにちは"},
+		{ID: "m2", Message: "ありがとう"},
+		{ID: "m3", Message: "さようなら"},
+	}
+	tests := []struct {
+		msg   *message
+		calls int
+	}{
+		{msgs[0], 1},
+		{msgs[1], 2},
+		{msgs[0], 2}, // キャッシュから返し、m1を最近使ったものにする
+		{msgs[2], 3}, // 最も長く使われていないm2を破棄する
+		{msgs[0], 3},
+		{msgs[1], 4},
+	}
+	for i, tt := range tests {
+		text, err := c.translateMessage(tr, tt.msg, "EN")
+		if err != nil || text != "[en] "+tt.msg.Message {
+			t.Errorf("%d: 翻訳結果が不正です: %q, %v", i, text, err)
+		}
+		if tr.calls != tt.calls {
+			t.Errorf("%d: 翻訳サービスを%d回呼び出すべきです: %d", i, tt.calls, tr.calls)
+		}
+	}
+	if c.recent.Len() != 2 || len(c.entries) != 2 {
+		t.Errorf("キャッシュは上限の数までに抑えるべきです: %d, %d", c.recent.Len(), len(c.entries))
+	}
+}
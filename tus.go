@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	uploadMaxSize       = flag.Int64("upload-max-size", 100<<20, "1つの添付ファイルの最大サイズ (バイト)")
+	uploadPendingQuota  = flag.Int64("upload-pending-quota", 500<<20, "1人のユーザーがアップロード途中で保持できる合計サイズ (バイト)")
+	uploadPartialExpiry = flag.Duration("upload-partial-expiry", 24*time.Hour, "更新されないアップロード途中のファイルを削除するまでの時間")
+)
+
+// tusVersion 対応しているtusプロトコルのバージョン
+const tusVersion = "1.0.0"
+
+// ErrUploadQuotaExceeded アップロードの容量の上限を超える場合に発生するエラー
+var ErrUploadQuotaExceeded = errors.New("chat: アップロードできる容量の上限を超えています。")
+
+// tusUpload アップロード途中のファイル
+type tusUpload struct {
+	ID        string
+	UserID    string
+	Length    int64
+	Offset    int64
+	Metadata  map[string]string
+	UpdatedAt time.Time
+	// busyはPATCHの処理中であることを表す
+	busy bool
+}
+
+// tusHandler tusプロトコル(https://tus.io/protocols/resumable-upload)で
+// 中断しても再開できるアップロードを受け付け、完了したファイルをBlobStoreに保存する
+//
+//	POST   /files/      アップロードの作成 (Upload-Length, Upload-Metadata)
+//	HEAD   /files/{id}  現在のオフセットの取得
+//	PATCH  /files/{id}  続きのデータの送信
+//	DELETE /files/{id}  アップロードの中止
+type tusHandler struct {
+	dir     string
+	mu      sync.Mutex
+	uploads map[string]*tusUpload
+}
+
+func newTusHandler(dir string) (*tusHandler, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &tusHandler{dir: dir, uploads: make(map[string]*tusUpload)}, nil
+}
+
+func (h *tusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination")
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(*uploadMaxSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		httpError(w, r, "非対応のtusのバージョンです", http.StatusPreconditionFailed)
+		return
+	}
+	user, _ := userFromContext(r.Context())
+	id := strings.TrimPrefix(r.URL.Path, "/files/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			httpError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+			return
+		}
+		h.create(w, r, user.UniqueID())
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		u, ok := h.get(id, user.UniqueID())
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		h.patch(w, r, id, user.UniqueID())
+	case http.MethodDelete:
+		if _, ok := h.get(id, user.UniqueID()); !ok {
+			httpError(w, r, "アップロードが見つかりません", http.StatusNotFound)
+			return
+		}
+		h.remove(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		httpError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+	}
+}
+
+// create 新しいアップロードを作成する
+func (h *tusHandler) create(w http.ResponseWriter, r *http.Request, userID string) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		httpError(w, r, "Upload-Lengthが不正です", http.StatusBadRequest)
+		return
+	}
+	if length > *uploadMaxSize {
+		httpError(w, r, "ファイルが大きすぎます", http.StatusRequestEntityTooLarge)
+		return
+	}
+	u := &tusUpload{
+		ID:        randomID(),
+		UserID:    userID,
+		Length:    length,
+		Metadata:  parseUploadMetadata(r.Header.Get("Upload-Metadata")),
+		UpdatedAt: time.Now(),
+	}
+	h.mu.Lock()
+	if h.pendingBytes(userID)+length > *uploadPendingQuota {
+		h.mu.Unlock()
+		httpError(w, r, ErrUploadQuotaExceeded.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	pending := h.pendingBytes(userID)
+	h.uploads[u.ID] = u
+	h.mu.Unlock()
+	// アップロード途中の分も含めて保存容量の上限を超えないか確認する
+	if err := checkStorageQuota(userID, pending+length); err != nil {
+		h.remove(u.ID)
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrStorageQuotaExceeded) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		httpError(w, r, err.Error(), status)
+		return
+	}
+	f, err := os.Create(h.partialPath(u.ID))
+	if err != nil {
+		h.remove(u.ID)
+		requestLogger(r).Println("アップロードの作成に失敗しました:", err)
+		httpError(w, r, "アップロードを作成できませんでした", http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+	w.Header().Set("Location", "/files/"+u.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// patch アップロードの続きのデータを書き込み、全て揃ったらBlobStoreに移す
+func (h *tusHandler) patch(w http.ResponseWriter, r *http.Request, id, userID string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		httpError(w, r, "Content-Typeはapplication/offset+octet-streamを指定してください", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		httpError(w, r, "Upload-Offsetが不正です", http.StatusBadRequest)
+		return
+	}
+	h.mu.Lock()
+	u, ok := h.uploads[id]
+	switch {
+	case !ok || u.UserID != userID:
+		h.mu.Unlock()
+		httpError(w, r, "アップロードが見つかりません", http.StatusNotFound)
+		return
+	case u.busy || u.Offset != offset:
+		h.mu.Unlock()
+		httpError(w, r, "Upload-Offsetが現在のオフセットと一致しません", http.StatusConflict)
+		return
+	}
+	u.busy = true
+	h.mu.Unlock()
+
+	f, err := os.OpenFile(h.partialPath(id), os.O_WRONLY|os.O_APPEND, 0)
+	var n int64
+	if err == nil {
+		// 宣言された長さを超えるデータは受け取らない
+		n, err = io.Copy(f, io.LimitReader(r.Body, u.Length-offset))
+		f.Close()
+	}
+	h.mu.Lock()
+	u.Offset += n
+	u.UpdatedAt = time.Now()
+	u.busy = false
+	done := u.Offset == u.Length
+	h.mu.Unlock()
+	if err != nil {
+		// 途中まで書き込めた分はクライアントがHEADで確認して再開できる
+		requestLogger(r).Println("アップロードの書き込みに失敗しました:", err)
+		httpError(w, r, "アップロードを書き込めませんでした", http.StatusInternalServerError)
+		return
+	}
+	if done {
+		a, err := h.complete(r, u)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case err == ErrInfected:
+				status = http.StatusUnprocessableEntity
+			case errors.Is(err, ErrStorageQuotaExceeded):
+				status = http.StatusRequestEntityTooLarge
+			}
+			httpError(w, r, err.Error(), status)
+			return
+		}
+		w.Header().Set("Location", a.URL())
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// complete アップロードが完了したファイルを検査してBlobStoreに保存する
+// ファイルはメモリに読み込まず、検査、判定、保存のたびに先頭から読み直す
+func (h *tusHandler) complete(r *http.Request, u *tusUpload) (*Attachment, error) {
+	defer h.remove(u.ID)
+	f, err := os.Open(h.partialPath(u.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	filename := filepath.Base(u.Metadata["filename"])
+	if filename == "." || filename == string(filepath.Separator) {
+		filename = u.ID
+	}
+	signature, err := scanner.Scan(f)
+	if err != nil {
+		requestLogger(r).Println("ファイルの検査に失敗しました:", err)
+		return nil, errors.New("chat: ファイルを検査できませんでした。")
+	}
+	if signature != "" {
+		auditRequest(r, auditUploadRejected, u.UserID, filename, map[string]string{"signature": signature})
+		return nil, ErrInfected
+	}
+	a := &Attachment{
+		ID:          u.ID,
+		UserID:      u.UserID,
+		Filename:    filename,
+		ContentType: attachmentContentType(filename, u.Metadata["filetype"]),
+		CreatedAt:   time.Now(),
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := moderateImage(a, f); err != nil {
+		requestLogger(r).Println("画像の判定に失敗しました:", err)
+		return nil, errors.New("chat: 画像を判定できませんでした。")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	// 作成時の確認の後に他のアップロードが保存されている場合があるため、保存の直前に容量を確保し直す
+	release, err := reserveStorage(u.UserID, u.Length)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if a.Size, err = blobs.Put(a.ID, f); err != nil {
+		return nil, err
+	}
+	if err := attachments.Create(a); err != nil {
+		blobs.Delete(a.ID)
+		return nil, err
+	}
+	return a, nil
+}
+
+func (h *tusHandler) get(id, userID string) (tusUpload, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	u, ok := h.uploads[id]
+	if !ok || u.UserID != userID {
+		return tusUpload{}, false
+	}
+	return *u, true
+}
+
+func (h *tusHandler) remove(id string) {
+	h.mu.Lock()
+	delete(h.uploads, id)
+	h.mu.Unlock()
+	os.Remove(h.partialPath(id))
+}
+
+// pendingBytes ユーザーのアップロード途中のファイルの合計サイズ。h.muをロックして呼び出す
+func (h *tusHandler) pendingBytes(userID string) int64 {
+	var total int64
+	for _, u := range h.uploads {
+		if u.UserID == userID {
+			total += u.Length
+		}
+	}
+	return total
+}
+
+func (h *tusHandler) partialPath(id string) string {
+	return filepath.Join(h.dir, id)
+}
+
+// expire 一定時間更新されていないアップロードを削除する
+func (h *tusHandler) expire(now time.Time) {
+	h.mu.Lock()
+	var expired []string
+	for id, u := range h.uploads {
+		if !u.busy && now.Sub(u.UpdatedAt) > *uploadPartialExpiry {
+			expired = append(expired, id)
+		}
+	}
+	h.mu.Unlock()
+	for _, id := range expired {
+		h.remove(id)
+	}
+	if len(expired) > 0 {
+		log.Println("放棄されたアップロードを削除しました:", len(expired))
+	}
+}
+
+// runExpiry 放棄されたアップロードを定期的に削除する
+func (h *tusHandler) runExpiry(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		h.expire(now)
+	}
+}
+
+// parseUploadMetadata "key base64value,key2 base64value2"形式のUpload-Metadataを解析する
+func parseUploadMetadata(s string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		value := ""
+		if len(fields) > 1 {
+			b, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				continue
+			}
+			value = string(b)
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata
+}
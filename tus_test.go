@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// streamingScanner 読み出した内容を検査するScanner。ファイルから直接読み出されたかどうかを記録する
+type streamingScanner struct {
+	fromFile bool
+}
+
+func (s *streamingScanner) Scan(r io.Reader) (string, error) {
+	_, s.fromFile = r.(*os.File)
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(string(data), "EICAR") {
+		return "Eicar-Test-Signature", nil
+	}
+	return "", nil
+}
+
+func TestTusUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gochat-tus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(b BlobStore, a AttachmentStore, s Scanner) { blobs, attachments, scanner = b, a, s }(blobs, attachments, scanner)
+	attachments = newMemoryAttachmentStore()
+	scan := &streamingScanner{}
+	scanner = scan
+	if blobs, err = newFileBlobStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	h, err := newTusHandler(filepath.Join(dir, ".partial"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &sessionUser{uniqueID: "tus-user"}
+	do := func(method, path, offset, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Tus-Resumable", tusVersion)
+		if method == http.MethodPost {
+			r.Header.Set("Upload-Length", "11")
+			r.Header.Set("Upload-Metadata", "filename aGVsbG8udHh0")
+		}
+		if method == http.MethodPatch {
+			r.Header.Set("Content-Type", "application/offset+octet-stream")
+			r.Header.Set("Upload-Offset", offset)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r.WithContext(withUser(r.Context(), user)))
+		return w
+	}
+
+	w := do(http.MethodPost, "/files/", "", "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("アップロードの作成は201を返すべきですが%dでした", w.Code)
+	}
+	location := w.Header().Get("Location")
+	if w := do(http.MethodPatch, location, "0", "hello "); w.Header().Get("Upload-Offset") != "6" {
+		t.Errorf("1回目のPATCHの後のオフセットは6であるべきですが%sでした", w.Header().Get("Upload-Offset"))
+	}
+	if w := do(http.MethodPatch, location, "0", "world"); w.Code != http.StatusConflict {
+		t.Errorf("オフセットが一致しない場合は409を返すべきですが%dでした", w.Code)
+	}
+	if w := do(http.MethodHead, location, "", ""); w.Header().Get("Upload-Offset") != "6" {
+		t.Errorf("HEADは現在のオフセット6を返すべきですが%sでした", w.Header().Get("Upload-Offset"))
+	}
+	w = do(http.MethodPatch, location, "6", "world")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("最後のPATCHは204を返すべきですが%dでした", w.Code)
+	}
+
+	a, err := attachments.Get(strings.TrimPrefix(location, "/files/"))
+	if err != nil {
+		t.Fatal("完了したアップロードは添付ファイルとして保存されるべきです:", err)
+	}
+	if a.Filename != "hello.txt" || a.Size != 11 {
+		t.Errorf("添付ファイルの情報が正しくありません: %+v", a)
+	}
+	f, err := blobs.Open(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if data, _ := ioutil.ReadAll(f); string(data) != "hello world" {
+		t.Errorf("保存された内容が正しくありません: %q", data)
+	}
+	if !scan.fromFile {
+		t.Error("完了したファイルはメモリに読み込まずにファイルから検査するべきです")
+	}
+
+	location = do(http.MethodPost, "/files/", "", "").Header().Get("Location")
+	if w := do(http.MethodPatch, location, "0", "EICAR-TEST!"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("マルウェアが検出されたファイルは422で拒否するべきですが%dでした", w.Code)
+	}
+	if _, err := attachments.Get(strings.TrimPrefix(location, "/files/")); err == nil {
+		t.Error("マルウェアが検出されたファイルは保存するべきではありません")
+	}
+}
@@ -1,30 +1,199 @@
 package main
 
 import (
-	"io"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
 	"io/ioutil"
+	"math"
+	"mime"
 	"net/http"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
+var (
+	avatarMaxSize      = flag.Int64("avatar-max-size", 5<<20, "アップロードできるアバターの画像の最大サイズ (バイト)")
+	avatarAllowedTypes = flag.String("avatar-allowed-types", "image/png,image/jpeg,image/gif,image/webp", "アップロードできるアバターの画像の種類のカンマ区切りのリスト (image/*のように指定することもできる)")
+	uploadRateLimit    = flag.Int("upload-rate-limit", 10, "1人のユーザーが-upload-rate-windowの間にアップロードできる回数 (0の場合は制限しない)")
+	uploadRateWindow   = flag.Duration("upload-rate-window", time.Minute, "アップロードの回数を数える期間")
+)
+
+// multipartOverhead フォームの境界やヘッダーのために、ファイルの最大サイズに加えて受け付けるバイト数
+const multipartOverhead = 64 << 10
+
+var (
+	// ErrUploadTooLarge アップロードされたファイルが大きすぎる場合に発生するエラー
+	ErrUploadTooLarge = errors.New("chat: ファイルが大きすぎます。")
+	// ErrUploadType アップロードされたファイルの種類が許可されていない場合に発生するエラー
+	ErrUploadType = errors.New("chat: この種類のファイルはアップロードできません。")
+	// ErrUploadRateLimited アップロードの回数が上限に達している場合に発生するエラー
+	ErrUploadRateLimited = errors.New("chat: アップロードの回数が上限に達しました。しばらくしてから再試行してください。")
+)
+
+// allowedType ファイルの種類がカンマ区切りのリストに含まれるかどうか
+// リストの"type/*"はその大分類のすべての種類に一致する
+func allowedType(contentType, list string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range strings.Split(list, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == mediaType || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadLimiter ユーザーごとに一定の期間内のアップロードの回数を数える
+type uploadLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*uploadWindow
+	now     func() time.Time
+}
+
+// uploadWindow 1人のユーザーの現在の期間のアップロードの回数
+type uploadWindow struct {
+	start time.Time
+	count int
+}
+
+func newUploadLimiter() *uploadLimiter {
+	return &uploadLimiter{windows: make(map[string]*uploadWindow), now: time.Now}
+}
+
+// uploadLimits アップロードの回数の制限
+var uploadLimits = newUploadLimiter()
+
+// allow アップロードを1回数え、上限を超えている場合は次の期間までの時間を返す
+func (l *uploadLimiter) allow(userID string, limit int, window time.Duration) (time.Duration, bool) {
+	if limit <= 0 {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	// 期間が過ぎたユーザーの記録は使わないため、数える前に取り除く
+	for id, w := range l.windows {
+		if now.Sub(w.start) >= window {
+			delete(l.windows, id)
+		}
+	}
+	w, ok := l.windows[userID]
+	if !ok {
+		w = &uploadWindow{start: now}
+		l.windows[userID] = w
+	}
+	if w.count >= limit {
+		return w.start.Add(window).Sub(now), false
+	}
+	w.count++
+	return 0, true
+}
+
+// uploaderHandler アバターの画像をアップロードする
+// POST /uploader  multipart/form-dataのavatarFileに画像を指定する
+// 結果はJSONで返し、失敗した場合は{"error": "..."}と状態コードで理由を示す
 func uploaderHandler(w http.ResponseWriter, req *http.Request) {
-	userID := req.FormValue("userid")
+	if req.Method != http.MethodPost {
+		writeJSONError(w, req, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	user, _ := userFromContext(req.Context())
+	userID := user.UniqueID()
+	if wait, ok := uploadLimits.allow(userID, *uploadRateLimit, *uploadRateWindow); !ok {
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+		writeJSONError(w, req, ErrUploadRateLimited.Error(), http.StatusTooManyRequests)
+		return
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, *avatarMaxSize+multipartOverhead)
 	file, header, err := req.FormFile("avatarFile")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSONError(w, req, ErrUploadTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
-		io.WriteString(w, err.Error())
+		writeJSONError(w, req, "avatarFileに画像を指定してください", http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
+	if header.Size > *avatarMaxSize {
+		writeJSONError(w, req, ErrUploadTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
 	data, err := ioutil.ReadAll(file)
 	if err != nil {
-		io.WriteString(w, err.Error())
+		requestLogger(req).Println("アップロードされたファイルを読み込めませんでした:", err)
+		writeJSONError(w, req, "ファイルを読み込めませんでした", http.StatusBadRequest)
 		return
 	}
-	filename := filepath.Join("avatars", userID+filepath.Ext(header.Filename))
-	err = ioutil.WriteFile(filename, data, 0777)
+	// 拡張子から判断した種類と内容から判断した種類の両方が許可されている場合だけ受け付ける
+	if !allowedType(attachmentContentType(header.Filename, ""), *avatarAllowedTypes) || !allowedType(http.DetectContentType(data), *avatarAllowedTypes) {
+		auditRequest(req, auditUploadRejected, userID, header.Filename, map[string]string{"content_type": http.DetectContentType(data)})
+		writeJSONError(w, req, ErrUploadType.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	// 既存のアバターは置き換えられるため、その分を差し引いて上限を確認する
+	current, _ := avatarBytes(userID)
+	release, err := reserveStorage(userID, int64(len(data))-current)
+	if err != nil {
+		writeJSONError(w, req, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	defer release()
+	signature, err := scanner.Scan(bytes.NewReader(data))
+	if err != nil {
+		requestLogger(req).Println("ファイルの検査に失敗しました:", err)
+		writeJSONError(w, req, "ファイルを検査できませんでした", http.StatusServiceUnavailable)
+		return
+	}
+	if signature != "" {
+		auditRequest(req, auditUploadRejected, userID, header.Filename, map[string]string{"signature": signature})
+		writeJSONError(w, req, ErrInfected.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	held, err := holdAvatar(userID, header.Filename, data)
 	if err != nil {
-		io.WriteString(w, err.Error())
+		requestLogger(req).Println("画像の判定に失敗しました:", err)
+		writeJSONError(w, req, "画像を判定できませんでした", http.StatusServiceUnavailable)
 		return
 	}
-	io.WriteString(w, "成功")
+	if held {
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"held": true, "message": "画像はモデレーターの審査後に反映されます"})
+		return
+	}
+	filename := filepath.Join("avatars", userID+filepath.Ext(header.Filename))
+	if err := ioutil.WriteFile(filename, data, 0777); err != nil {
+		requestLogger(req).Println("アバターを保存できませんでした:", err)
+		writeJSONError(w, req, "アバターを保存できませんでした", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"held": false, "message": "成功"})
+}
+
+// holdAvatar アバターの画像を判定し、不適切な場合は公開せずに審査待ちとして保存する
+func holdAvatar(userID, filename string, data []byte) (bool, error) {
+	a := &Attachment{
+		ID:          randomID(),
+		UserID:      userID,
+		Filename:    filepath.Base(filename),
+		ContentType: attachmentContentType(filename, ""),
+		Size:        int64(len(data)),
+		Purpose:     attachmentPurposeAvatar,
+		CreatedAt:   time.Now(),
+	}
+	held, err := moderateImage(a, bytes.NewReader(data))
+	if err != nil || !held {
+		return false, err
+	}
+	if _, err := blobs.Put(a.ID, bytes.NewReader(data)); err != nil {
+		return false, err
+	}
+	return true, attachments.Create(a)
 }
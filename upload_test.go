@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllowedType(t *testing.T) {
+	list := "image/png, image/jpeg,video/*"
+	for contentType, want := range map[string]bool{
+		"image/png":                true,
+		"image/jpeg; charset=utf8": true,
+		"video/mp4":                true,
+		"image/svg+xml":            false,
+		"text/html; charset=utf-8": false,
+		"":                         false,
+	} {
+		if got := allowedType(contentType, list); got != want {
+			t.Errorf("%qの判定が違います: %v", contentType, got)
+		}
+	}
+}
+
+func TestUploadLimiter(t *testing.T) {
+	l := newUploadLimiter()
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if _, ok := l.allow("u1", 2, time.Minute); !ok {
+			t.Fatal("上限までは許可するべきです")
+		}
+	}
+	if wait, ok := l.allow("u1", 2, time.Minute); ok || wait != time.Minute {
+		t.Errorf("上限を超えたら次の期間までの時間を返すべきです: %v, %v", wait, ok)
+	}
+	if _, ok := l.allow("u2", 2, time.Minute); !ok {
+		t.Error("ユーザーごとに数えるべきです")
+	}
+	now = now.Add(time.Minute)
+	if _, ok := l.allow("u1", 2, time.Minute); !ok {
+		t.Error("次の期間では再び許可するべきです")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/stretchr/objx"
+)
+
+var (
+	nameMaxLength = flag.Int("name-max-length", 32, "表示名の最大の文字数")
+	reservedNames = flag.String("reserved-names", "admin,administrator,system,root,moderator,gochat,support,staff", "ユーザーが名乗れない名前 (カンマ区切り)")
+	profanityList = flag.String("profanity-list", "", "表示名に使えない語を1行に1つずつ書いたファイル")
+)
+
+var (
+	// ErrNameLength 表示名が空または長すぎる場合に発生するエラー
+	ErrNameLength = errors.New("chat: 表示名の長さが不正です。")
+	// ErrNameCharacters 表示名に使えない文字が含まれる場合に発生するエラー
+	ErrNameCharacters = errors.New("chat: 表示名に使えない文字が含まれています。")
+	// ErrNameReserved 管理者やシステムを装う名前の場合に発生するエラー
+	ErrNameReserved = errors.New("chat: この表示名は予約されているため使えません。")
+	// ErrNameProfane 表示名に不適切な語が含まれる場合に発生するエラー
+	ErrNameProfane = errors.New("chat: 表示名に不適切な語が含まれています。")
+)
+
+// nameSymbols 表示名に使える記号
+const nameSymbols = " ._-'"
+
+// lookalikes 予約語との比較の前に置き換える、文字に似せた数字や記号
+var lookalikes = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s", "!", "i", "|", "l")
+
+// profanity -profanity-listから読み込んだ語。最初の検証の際に読み込む
+var profanity struct {
+	mu    sync.Mutex
+	path  string
+	words map[string]bool
+}
+
+// loadProfanity 不適切な語の一覧を読み込む。ファイルが読めない場合は記録して空とする
+func loadProfanity() map[string]bool {
+	profanity.mu.Lock()
+	defer profanity.mu.Unlock()
+	if profanity.words != nil && profanity.path == *profanityList {
+		return profanity.words
+	}
+	profanity.path, profanity.words = *profanityList, make(map[string]bool)
+	if *profanityList == "" {
+		return profanity.words
+	}
+	f, err := os.Open(*profanityList)
+	if err != nil {
+		reporter.Report(err, map[string]string{"component": "profanity_list"})
+		return profanity.words
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if word := foldName(strings.TrimSpace(s.Text())); word != "" && !strings.HasPrefix(word, "#") {
+			profanity.words[word] = true
+		}
+	}
+	return profanity.words
+}
+
+// foldName 比較のために小文字にし、文字に似せた数字や記号を置き換える
+func foldName(name string) string {
+	return lookalikes.Replace(strings.ToLower(name))
+}
+
+// nameTokens 表示名を比較用の語に分ける。区切りを除いた全体も含める
+// "Adm1n_Team"は[admin team adminteam]になる
+func nameTokens(name string) []string {
+	folded := foldName(name)
+	tokens := strings.FieldsFunc(folded, func(r rune) bool { return strings.ContainsRune(nameSymbols, r) })
+	return append(tokens, strings.Join(tokens, ""))
+}
+
+// validateDisplayName 表示名を検証し、前後の空白を除いた名前を返す
+// allowReservedが真の場合は予約された名前を許可する (管理者による登録)
+func validateDisplayName(name string, allowReserved bool) (string, error) {
+	name = strings.Join(strings.Fields(name), " ")
+	if n := utf8.RuneCountInString(name); n == 0 || n > *nameMaxLength {
+		return "", ErrNameLength
+	}
+	for _, r := range name {
+		// 書式文字(ゼロ幅文字や書字方向の制御)は見た目を偽るために使われるため許可しない
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.In(r, unicode.Mn, unicode.Mc) && !strings.ContainsRune(nameSymbols, r) {
+			return "", ErrNameCharacters
+		}
+	}
+	tokens := nameTokens(name)
+	if !allowReserved {
+		for _, reserved := range strings.Split(*reservedNames, ",") {
+			reserved = foldName(strings.TrimSpace(reserved))
+			for _, token := range tokens {
+				if reserved != "" && token == reserved {
+					return "", ErrNameReserved
+				}
+			}
+		}
+	}
+	words := loadProfanity()
+	for _, token := range tokens {
+		if words[token] {
+			return "", ErrNameProfane
+		}
+	}
+	return name, nil
+}
+
+// registrationName 認証プロバイダーから得た名前を登録に使える名前にする
+// 検証に通らない場合はログインを拒否せず、仮の名前を付ける
+func registrationName(name string) string {
+	if valid, err := validateDisplayName(name, false); err == nil {
+		return valid
+	}
+	return "user-" + randomID()[:6]
+}
+
+// renameHandler 自分の表示名を変更する (要ログイン)
+// PUT /api/me/name (name)
+// 変更後はログイン時に認証プロバイダーの名前で上書きしない
+func renameHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		writeJSONError(w, r, "許可されていないメソッドです", http.StatusMethodNotAllowed)
+		return
+	}
+	user, _ := userFromContext(r.Context())
+	record, err := users.GetByID(user.UniqueID())
+	if err != nil {
+		writeJSONError(w, r, "このアカウントでは表示名を変更できません", http.StatusBadRequest)
+		return
+	}
+	name, err := validateDisplayName(r.FormValue("name"), false)
+	if err != nil {
+		writeJSONError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	previous := record.Name
+	record.Name, record.CustomName = name, true
+	if err := users.Update(record); err != nil {
+		requestLogger(r).Println("表示名の変更に失敗しました:", err)
+		writeJSONError(w, r, "表示名の変更に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	// このセッションのCookieには古い名前が入っているため発行し直す
+	if current, ok := user.(sessionUser); ok {
+		setAuthCookie(w, r, objx.New(map[string]interface{}{
+			"userid":     current.uniqueID,
+			"name":       name,
+			"avatar_url": current.avatarURL,
+			"session_id": current.sessionID,
+		}).MustBase64())
+	}
+	auditRequest(r, auditAdminAction, record.ID, record.ID, map[string]string{"action": "rename", "from": previous, "to": name})
+	writeJSON(w, http.StatusOK, map[string]string{"name": name})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateDisplayName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profanity.txt")
+	os.WriteFile(path, []byte("# コメント\nbadword\n"), 0600)
+	*profanityList = path
+	defer func() { *profanityList = "" }()
+
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"  Alice   Smith ", nil},
+		{"山田 太郎", nil},
+		{"Badminton", nil},
+		{"", ErrNameLength},
+		{"abcdefghijklmnopqrstuvwxyz0123456", ErrNameLength},
+		{"Alice​", ErrNameCharacters},
+		{"<script>", ErrNameCharacters},
+		{"Admin", ErrNameReserved},
+		{"Adm1n_Team", ErrNameReserved},
+		{"S Y S T E M", ErrNameReserved},
+		{"b4dw0rd", ErrNameProfane},
+	}
+	for _, tt := range tests {
+		if _, err := validateDisplayName(tt.name, false); err != tt.err {
+			t.Errorf("validateDisplayName(%q) = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+	if got, _ := validateDisplayName("  Alice   Smith ", false); got != "Alice Smith" {
+		t.Errorf("空白を詰めるべきです: %q", got)
+	}
+	if _, err := validateDisplayName("Admin", true); err != nil {
+		t.Errorf("管理者による登録では予約された名前を使えるべきです: %v", err)
+	}
+}
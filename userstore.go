@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// ErrUserNotFound 指定されたユーザーが存在しない場合に発生するエラー
+var ErrUserNotFound = errors.New("chat: ユーザーが見つかりません。")
+
+// ErrUserExists 既に存在するユーザーを作成しようとした場合に発生するエラー
+var ErrUserExists = errors.New("chat: ユーザーは既に存在します。")
+
+// UserRecord 永続化されたユーザーの情報
+type UserRecord struct {
+	ID    string
+	Name  string
+	Email string
+	// EmailVerifiedはEmailの所有が確認されているかどうか
+	// 確認済みのアドレスを持つユーザーだけがメールアドレスでの自動的な連携の対象になる
+	EmailVerified bool
+	AvatarURL     string
+	Provider      string
+	ProviderID    string
+	Role          string
+	Banned        bool
+	// ShadowBannedが設定されたユーザーのメッセージは本人にだけ表示される
+	ShadowBanned bool
+	// TOTPSecretは二要素認証のBase32形式の秘密鍵。TOTPEnabledが偽の間は登録待ち
+	// 秘密情報のためJSONには出力しない
+	TOTPSecret  string `json:"-"`
+	TOTPEnabled bool
+	// TOTPLastStepは最後に受け付けたTOTPのタイムステップ。同じコードを再び使えないようにする
+	TOTPLastStep int64 `json:"-"`
+	// RecoveryCodesはハッシュ化された未使用のリカバリーコード
+	RecoveryCodes []string `json:"-"`
+	// Passkeysは登録されたパスキーの公開鍵などの情報
+	Passkeys []webauthn.Credential `json:"-"`
+	// StorageQuotaは保存容量の個別の上限 (バイト)。0の場合は既定値、負の場合は無制限
+	StorageQuota int64
+	// CustomNameはユーザーが名前を変更したかどうか。真の場合はログイン時にプロバイダーの名前で上書きしない
+	CustomName bool
+	// Identitiesは後から連携した他の認証プロバイダーのアカウント
+	// Provider/ProviderIDは最初にログインしたプロバイダーのまま変えない
+	Identities []LinkedIdentity
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// LinkedIdentity ユーザーに連携した認証プロバイダーのアカウント
+type LinkedIdentity struct {
+	Provider   string    `json:"provider"`
+	ProviderID string    `json:"provider_id"`
+	Email      string    `json:"email,omitempty"`
+	LinkedAt   time.Time `json:"linked_at"`
+}
+
+// providerKeys ユーザーがログインに使えるすべてのプロバイダーのアカウントのキーを返す
+func (u *UserRecord) providerKeys() []string {
+	var keys []string
+	if u.Provider != "" {
+		keys = append(keys, providerKey(u.Provider, u.ProviderID))
+	}
+	for _, id := range u.Identities {
+		keys = append(keys, providerKey(id.Provider, id.ProviderID))
+	}
+	return keys
+}
+
+// UserStore ユーザーの情報を保存する
+type UserStore interface {
+	// Create 新しいユーザーを保存する
+	// *同じIDまたはプロバイダーIDのユーザーが存在する場合にはErrUserExistsを返す
+	Create(u *UserRecord) error
+	// GetByID IDでユーザーを取得する
+	// *見つからない場合にはErrUserNotFoundを返す
+	GetByID(id string) (*UserRecord, error)
+	// GetByProviderID 認証プロバイダーとプロバイダー上のIDでユーザーを取得する
+	// 連携したアカウントのIDでも取得できる
+	// *見つからない場合にはErrUserNotFoundを返す
+	GetByProviderID(provider, providerID string) (*UserRecord, error)
+	// ListByEmail メールアドレスが一致するユーザーを返す。大文字と小文字は区別しない
+	ListByEmail(email string) ([]*UserRecord, error)
+	// Update 既存のユーザーの情報を更新する
+	Update(u *UserRecord) error
+	// Delete ユーザーを削除する
+	Delete(id string) error
+}
+
+// memoryUserStore メモリ上にユーザーを保持するUserStore
+type memoryUserStore struct {
+	mu         sync.RWMutex
+	byID       map[string]*UserRecord
+	byProvider map[string]string
+}
+
+// newMemoryUserStore 空のmemoryUserStoreを生成する
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{
+		byID:       make(map[string]*UserRecord),
+		byProvider: make(map[string]string),
+	}
+}
+
+func providerKey(provider, providerID string) string {
+	return provider + ":" + providerID
+}
+
+func (s *memoryUserStore) Create(u *UserRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byID[u.ID]; ok {
+		return ErrUserExists
+	}
+	for _, key := range u.providerKeys() {
+		if _, ok := s.byProvider[key]; ok {
+			return ErrUserExists
+		}
+	}
+	now := time.Now()
+	stored := *u
+	stored.CreatedAt, stored.UpdatedAt = now, now
+	s.byID[u.ID] = &stored
+	for _, key := range u.providerKeys() {
+		s.byProvider[key] = u.ID
+	}
+	*u = stored
+	return nil
+}
+
+func (s *memoryUserStore) GetByID(id string) (*UserRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.byID[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	copied := *u
+	return &copied, nil
+}
+
+func (s *memoryUserStore) GetByProviderID(provider, providerID string) (*UserRecord, error) {
+	s.mu.RLock()
+	id, ok := s.byProvider[providerKey(provider, providerID)]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return s.GetByID(id)
+}
+
+func (s *memoryUserStore) ListByEmail(email string) ([]*UserRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []*UserRecord
+	for _, u := range s.byID {
+		if email != "" && strings.EqualFold(u.Email, email) {
+			copied := *u
+			list = append(list, &copied)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryUserStore) Update(u *UserRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.byID[u.ID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	for _, key := range u.providerKeys() {
+		if id, ok := s.byProvider[key]; ok && id != u.ID {
+			return ErrUserExists
+		}
+	}
+	stored := *u
+	stored.CreatedAt = old.CreatedAt
+	stored.UpdatedAt = time.Now()
+	for _, key := range old.providerKeys() {
+		delete(s.byProvider, key)
+	}
+	for _, key := range stored.providerKeys() {
+		s.byProvider[key] = stored.ID
+	}
+	s.byID[u.ID] = &stored
+	*u = stored
+	return nil
+}
+
+func (s *memoryUserStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.byID[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	for _, key := range u.providerKeys() {
+		delete(s.byProvider, key)
+	}
+	delete(s.byID, id)
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestMemoryUserStore(t *testing.T) {
+	store := newMemoryUserStore()
+	u := &UserRecord{ID: "abc", Name: "太郎", Provider: "google", ProviderID: "123"}
+	if err := store.Create(u); err != nil {
+		t.Fatalf("Createがエラーを返しました: %s", err)
+	}
+	if u.CreatedAt.IsZero() {
+		t.Error("CreateはCreatedAtを設定するべきです")
+	}
+	if err := store.Create(&UserRecord{ID: "def", Provider: "google", ProviderID: "123"}); err != ErrUserExists {
+		t.Error("同じプロバイダーIDのユーザーを作成した場合、ErrUserExistsを返すべきです")
+	}
+
+	got, err := store.GetByProviderID("google", "123")
+	if err != nil || got.ID != "abc" {
+		t.Errorf("GetByProviderIDが誤った値を返しました: %v %v", got, err)
+	}
+
+	got.Name = "花子"
+	if err := store.Update(got); err != nil {
+		t.Fatalf("Updateがエラーを返しました: %s", err)
+	}
+	if got, _ := store.GetByID("abc"); got.Name != "花子" {
+		t.Errorf("Updateの内容が反映されていません: %s", got.Name)
+	}
+
+	if err := store.Delete("abc"); err != nil {
+		t.Fatalf("Deleteがエラーを返しました: %s", err)
+	}
+	if _, err := store.GetByProviderID("google", "123"); err != ErrUserNotFound {
+		t.Error("削除されたユーザーに対してはErrUserNotFoundを返すべきです")
+	}
+}
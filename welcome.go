@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxRoomWelcomeLength ルームの歓迎メッセージの最大長 (文字数)
+const maxRoomWelcomeLength = 2000
+
+// WelcomeStore ユーザーが参加したことのあるルームを記録する
+type WelcomeStore interface {
+	// FirstJoin ユーザーがルームに参加したことを記録し、初めての参加かどうかを返す
+	FirstJoin(room, userID string, now time.Time) (bool, error)
+	// DeleteByUser ユーザーの参加の記録を削除する
+	DeleteByUser(userID string) error
+}
+
+// memoryWelcomeStore メモリ上に参加の記録を保持するWelcomeStore
+type memoryWelcomeStore struct {
+	mu sync.Mutex
+	// joinedはユーザーごとの参加したことのあるルーム
+	joined map[string]map[string]time.Time
+}
+
+func newMemoryWelcomeStore() *memoryWelcomeStore {
+	return &memoryWelcomeStore{joined: make(map[string]map[string]time.Time)}
+}
+
+func (s *memoryWelcomeStore) FirstJoin(room, userID string, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.joined[userID][room]; ok {
+		return false, nil
+	}
+	if s.joined[userID] == nil {
+		s.joined[userID] = make(map[string]time.Time)
+	}
+	s.joined[userID][room] = now
+	return true, nil
+}
+
+func (s *memoryWelcomeStore) DeleteByUser(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.joined, userID)
+	return nil
+}
+
+// renderWelcome 歓迎メッセージの変数を置き換える
+// {name}は参加したユーザーの名前、{room}はルームの名前、{topic}はルームのトピック
+func renderWelcome(info *RoomInfo, name string) string {
+	return strings.NewReplacer("{name}", name, "{room}", info.Name, "{topic}", info.Topic).Replace(info.Welcome)
+}
+
+// validWelcome 歓迎メッセージの長さを検証する
+func validWelcome(text string) bool {
+	return utf8.RuneCountInString(text) <= maxRoomWelcomeLength
+}
+
+// sendWelcomeはルームに初めて参加したユーザーに、ルームの歓迎メッセージを一時的なメッセージとして送信する
+// 歓迎メッセージが設定される前に参加したユーザーも、設定後の最初の参加では受け取る
+func (c *client) sendWelcome() {
+	userID := c.userID()
+	info := roomInfo(c.room.name)
+	if userID == "" || info.Welcome == "" {
+		return
+	}
+	first, err := welcomes.FirstJoin(c.room.name, userID, time.Now())
+	if err != nil {
+		log.Println("参加の記録に失敗しました:", err)
+		return
+	}
+	if !first {
+		return
+	}
+	name, _ := c.userData["name"].(string)
+	c.ephemeral(renderWelcome(info, name))
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenderWelcome(t *testing.T) {
+	info := &RoomInfo{Name: "general", Topic: "雑談", Welcome: "{name}さん、#{room}へようこそ。トピック: {topic}"}
+	if got := renderWelcome(info, "Alice"); got != "Aliceさん、#generalへようこそ。トピック: 雑談" {
+		t.Errorf("変数を置き換えるべきです: %s", got)
+	}
+}
+
+func TestWelcomeFirstJoin(t *testing.T) {
+	s := newMemoryWelcomeStore()
+	now := time.Now()
+	if first, _ := s.FirstJoin("general", "u1", now); !first {
+		t.Error("最初の参加では真を返すべきです")
+	}
+	if first, _ := s.FirstJoin("general", "u1", now); first {
+		t.Error("2回目の参加では偽を返すべきです")
+	}
+	if first, _ := s.FirstJoin("random", "u1", now); !first {
+		t.Error("ルームごとに記録するべきです")
+	}
+	s.DeleteByUser("u1")
+	if first, _ := s.FirstJoin("general", "u1", now); !first {
+		t.Error("記録を削除したユーザーは再び歓迎するべきです")
+	}
+}